@@ -0,0 +1,385 @@
+// Copyright 2014 Bowery, Inc.
+// Contains abuse report intake. Anyone can report an abusive account, e.g.
+// spam sent from a Bowery environment, which opens a moderation case linked
+// to the developer and assigned to the admin with the fewest open cases.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// Limits on abuse reports.
+const (
+	maxAbuseDescription = 5000
+	maxAbuseEvidence    = 10
+)
+
+// abuseCategories are the kinds of abuse that can be reported.
+var abuseCategories = []string{"spam", "phishing", "malware", "copyright", "other"}
+
+// abuseTransitions are the statuses a case can move to from each status.
+// Closed cases can be reopened for more investigation.
+var abuseTransitions = map[string][]string{
+	db.AbuseOpen:          {db.AbuseInvestigating, db.AbuseActioned, db.AbuseDismissed},
+	db.AbuseInvestigating: {db.AbuseActioned, db.AbuseDismissed},
+	db.AbuseActioned:      {db.AbuseInvestigating},
+	db.AbuseDismissed:     {db.AbuseInvestigating},
+}
+
+// abuseReq is the body third parties send with a report.
+type abuseReq struct {
+	Email       string   `json:"email"`
+	Category    string   `json:"category"`
+	Account     string   `json:"account"`
+	Description string   `json:"description"`
+	Evidence    []string `json:"evidence"`
+}
+
+// validateAbuseReport checks a report has what moderators need to act on it.
+func validateAbuseReport(r *abuseReq) error {
+	r.Email = strings.TrimSpace(r.Email)
+	r.Account = strings.TrimSpace(r.Account)
+	r.Description = strings.TrimSpace(r.Description)
+
+	if _, err := mail.ParseAddress(r.Email); err != nil {
+		return errors.New("A valid email Required so we can follow up.")
+	}
+	known := false
+	for _, c := range abuseCategories {
+		known = known || c == r.Category
+	}
+	if !known {
+		return fmt.Errorf("Category must be one of %s.", strings.Join(abuseCategories, ", "))
+	}
+	if r.Account == "" {
+		return errors.New("Account Required, the email or token of the account being reported.")
+	}
+	if r.Description == "" || len(r.Description) > maxAbuseDescription {
+		return fmt.Errorf("Description Required, up to %d characters.", maxAbuseDescription)
+	}
+	if len(r.Evidence) > maxAbuseEvidence {
+		return fmt.Errorf("Up to %d evidence links allowed.", maxAbuseEvidence)
+	}
+	for _, e := range r.Evidence {
+		u, err := url.Parse(e)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Evidence %q must be an http or https link.", e)
+		}
+	}
+
+	return nil
+}
+
+// abuseDeveloper returns the id of the developer in req's tenant an account
+// refers to, by email, token or id. It's empty if there's no such developer.
+func abuseDeveloper(req *http.Request, account string) (bson.ObjectId, error) {
+	query := bson.M{"token": account}
+	if strings.Contains(account, "@") {
+		query = bson.M{"email": account}
+	} else if bson.IsObjectIdHex(account) {
+		query = bson.M{"_id": bson.ObjectIdHex(account)}
+	}
+
+	d, err := tenantFor(req).GetDeveloper(query)
+	if err == db.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return d.ID, nil
+}
+
+// pickAbuseAssignee returns the admin with the fewest open cases, empty if
+// there are no admins.
+func pickAbuseAssignee(admins []string, open map[string]int) string {
+	assignee := ""
+	for _, admin := range admins {
+		if assignee == "" || open[admin] < open[assignee] {
+			assignee = admin
+		}
+	}
+
+	return assignee
+}
+
+// canMoveAbuseCase reports whether a case can go from one status to another.
+func canMoveAbuseCase(from, to string) bool {
+	for _, s := range abuseTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notifyAbuseAssignee emails the admin a case was assigned to. Failures are
+// only printed.
+func notifyAbuseAssignee(req *http.Request, c *db.AbuseCase) {
+	if c.Assignee == "" {
+		return
+	}
+
+	message, err := RenderEmail("abuse_case_email", map[string]interface{}{
+		"case": c,
+		"url":  baseURL(req) + "/admin/abuse/" + c.ID.Hex(),
+	})
+	if err == nil {
+		err = sendEmail(context.Background(), gochimp.Message{
+			Subject:   fmt.Sprintf("Abuse report assigned to you: %s about %s", c.Category, c.Account),
+			FromEmail: "support@bowery.io",
+			FromName:  "Bowery Support",
+			To:        []gochimp.Recipient{{Email: c.Assignee}},
+			Html:      message,
+		})
+	}
+	if err != nil {
+		fmt.Println("unable to email abuse case to", c.Assignee, err)
+	}
+}
+
+// POST /abuse, Reports an abusive account
+func AbuseReportHandler(rw http.ResponseWriter, req *http.Request) {
+	var body abuseReq
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateAbuseReport(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	developerID, err := abuseDeveloper(req, body.Account)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	admins, err := db.GetAdminEmails()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	open, err := db.CountOpenAbuseCases()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c := &db.AbuseCase{
+		ReporterEmail: body.Email,
+		ReporterIP:    clientIP(req),
+		Category:      body.Category,
+		Account:       body.Account,
+		Description:   body.Description,
+		Evidence:      body.Evidence,
+		DeveloperID:   developerID,
+		Assignee:      pickAbuseAssignee(admins, open),
+	}
+	if err := db.SaveAbuseCase(c); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if os.Getenv("ENV") == "production" {
+		notifyAbuseAssignee(req, c)
+		go notifySlack(slackChannel("abuse"), fmt.Sprintf("New %s report about %s, assigned to %s: /admin/abuse/%s",
+			c.Category, c.Account, c.Assignee, c.ID.Hex()))
+	}
+
+	// Reporters only get the case id, not who it was linked to.
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusCreated,
+		"id":     c.ID.Hex(),
+	})
+}
+
+// GET /admin/abuse, Lists abuse cases, filtered by ?status=, ?assignee= and ?developer=
+func AdminAbuseHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if status := req.FormValue("status"); status != "" {
+		query["status"] = status
+	}
+	if assignee := req.FormValue("assignee"); assignee != "" {
+		query["assignee"] = assignee
+	}
+	if developer := req.FormValue("developer"); bson.IsObjectIdHex(developer) {
+		query["developerId"] = bson.ObjectIdHex(developer)
+	}
+
+	cs, err := db.GetAbuseCases(query, 200)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"cases":  cs,
+	})
+}
+
+// abuseCase returns the case with the id in the route.
+func abuseCase(req *http.Request) (*db.AbuseCase, error) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		return nil, db.ErrNotFound
+	}
+
+	return db.GetAbuseCase(bson.ObjectIdHex(id))
+}
+
+// GET /admin/abuse/{id}, Gets an abuse case and the developer it's about
+func AdminAbuseCaseHandler(rw http.ResponseWriter, req *http.Request) {
+	c, err := abuseCase(req)
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	res := map[string]interface{}{
+		"status": requests.StatusFound,
+		"case":   c,
+	}
+	if c.DeveloperID != "" {
+		if d, err := tenantFor(req).GetDeveloper(bson.M{"_id": c.DeveloperID}); err == nil {
+			res["developer"] = map[string]interface{}{
+				"id":     d.ID,
+				"name":   d.Name,
+				"email":  d.Email,
+				"isPaid": d.IsPaid,
+			}
+		}
+		if sus, err := db.GetSuspension(c.DeveloperID); err == nil {
+			res["suspension"] = sus
+		}
+		if others, err := db.GetAbuseCases(bson.M{"developerId": c.DeveloperID, "_id": bson.M{"$ne": c.ID}}, 20); err == nil {
+			res["related"] = others
+		}
+	}
+
+	renderer.JSON(rw, http.StatusOK, res)
+}
+
+// PUT /admin/abuse/{id}, Moves an abuse case along, reassigns it or adds a note
+func UpdateAbuseCaseHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Status   string `json:"status"`
+		Assignee string `json:"assignee"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c, err := abuseCase(req)
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	update := bson.M{}
+	if body.Status != "" && body.Status != c.Status {
+		if !canMoveAbuseCase(c.Status, body.Status) {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  fmt.Sprintf("A case can't move from %s to %s.", c.Status, body.Status),
+			})
+			return
+		}
+		update["status"] = body.Status
+	} else {
+		body.Status = ""
+	}
+	if body.Assignee != "" && body.Assignee != c.Assignee {
+		update["assignee"] = body.Assignee
+	}
+	if len(update) == 0 && strings.TrimSpace(body.Note) == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Status, assignee or note Required.",
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	note := &db.AbuseNote{Author: actor, Status: body.Status, Text: strings.TrimSpace(body.Note)}
+	err = db.UpdateAbuseCase(c.ID, c.Status, update, note)
+	if err == db.ErrConflict {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "The case was updated by someone else, reload it and try again.",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	detail := c.ID.Hex()
+	if body.Status != "" {
+		detail += " " + c.Status + " -> " + body.Status
+	}
+	audit(req, "abuse.update", actor, detail)
+
+	if assignee, ok := update["assignee"].(string); ok && os.Getenv("ENV") == "production" {
+		c.Assignee = assignee
+		notifyAbuseAssignee(req, c)
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
@@ -0,0 +1,160 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the access log, one JSON line per request with the route it
+// matched, its status, sizes and how long it spent on each dependency. Route
+// variables and query parameters that carry credentials are redacted so the
+// log can be shipped anywhere.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Bowery/gopackages/web"
+	"github.com/gorilla/mux"
+)
+
+// Where the access log is written.
+var accessLogOutput io.Writer = os.Stdout
+
+// dependencyTiming is the time a request spent calling a dependency.
+type dependencyTiming struct {
+	Calls      int     `json:"calls"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// requestTimings collects dependency timings for a request, calls can be
+// made from several goroutines.
+type requestTimings struct {
+	mutex sync.Mutex
+	deps  map[string]*dependencyTiming
+}
+
+type timingsKey struct{}
+
+// recordDependency adds a call to a dependency to the timings of the
+// request ctx belongs to, if any.
+func recordDependency(ctx context.Context, name string, d time.Duration) {
+	t, ok := ctx.Value(timingsKey{}).(*requestTimings)
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	dep, ok := t.deps[name]
+	if !ok {
+		dep = &dependencyTiming{}
+		t.deps[name] = dep
+	}
+	dep.Calls++
+	dep.DurationMs += float64(d) / float64(time.Millisecond)
+}
+
+// accessRecord is a line of the access log.
+type accessRecord struct {
+	Time          time.Time                    `json:"time"`
+	Method        string                       `json:"method"`
+	Route         string                       `json:"route"`
+	Path          string                       `json:"path"`
+	Query         string                       `json:"query,omitempty"`
+	Status        int                          `json:"status"`
+	DurationMs    float64                      `json:"durationMs"`
+	RequestBytes  int64                        `json:"requestBytes"`
+	ResponseBytes int64                        `json:"responseBytes"`
+	IP            string                       `json:"ip"`
+	Dependencies  map[string]*dependencyTiming `json:"dependencies,omitempty"`
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// countingWriter records the status and bytes written to a response.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLog wraps the server, logging each request once it's served. Routes
+// are matched again here since the server's router is out of reach, so the
+// log has the route's template rather than a path with ids in it.
+func accessLog(h http.Handler, routes []web.Route) http.Handler {
+	router := mux.NewRouter()
+	for _, r := range routes {
+		router.Methods(r.Method).Path(r.Path).Name(r.Method + " " + r.Path)
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		timings := &requestTimings{deps: map[string]*dependencyTiming{}}
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		cw := &countingWriter{ResponseWriter: rw, status: http.StatusOK}
+
+		var match mux.RouteMatch
+		route := ""
+		if router.Match(req, &match) {
+			route = match.Route.GetName()
+		}
+		record := &accessRecord{
+			Time:   start,
+			Method: req.Method,
+			Route:  route,
+			Path:   redactPath(req.URL.Path, match.Vars),
+			Query:  redactQuery(req.URL.Query()),
+			IP:     clientIP(req),
+		}
+
+		h.ServeHTTP(cw, req.WithContext(context.WithValue(req.Context(), timingsKey{}, timings)))
+
+		record.Status = cw.status
+		record.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+		record.RequestBytes = body.n
+		record.ResponseBytes = cw.n
+		timings.mutex.Lock()
+		if len(timings.deps) > 0 {
+			record.Dependencies = timings.deps
+		}
+		line, err := json.Marshal(record)
+		timings.mutex.Unlock()
+		if err != nil {
+			fmt.Println("unable to write access log", err)
+			return
+		}
+		fmt.Fprintln(accessLogOutput, string(line))
+	})
+}
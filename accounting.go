@@ -0,0 +1,613 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the export of settled charges and refunds to QuickBooks or Xero.
+// Transactions are queued from payments, checkouts and Stripe refunds, then
+// pushed to the provider on a schedule. Anything that couldn't be pushed
+// shows up in the reconciliation report. Broome doesn't issue credit notes,
+// refunds are exported as refund receipts or spend money transactions.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// accountingSyncEvery is how often transactions are queued and exported.
+	accountingSyncEvery = 15 * time.Minute
+
+	// Transactions that settled this long ago are queued, so a missed run
+	// is caught up by the next.
+	accountingLookback = 7 * 24 * time.Hour
+
+	// Exports that fail this many times are left for the reconciliation
+	// report.
+	accountingMaxAttempts = 5
+)
+
+var accountingHTTPClient = &http.Client{Timeout: 20 * time.Second}
+
+// accountingExporter pushes a transaction to a provider, returning the id
+// the provider gave it.
+type accountingExporter interface {
+	tokenURL() string
+	export(cfg *db.AccountingConfig, token string, s *db.AccountingSync, d *schemas.Developer) (string, error)
+}
+
+var accountingExporters = map[string]accountingExporter{
+	db.AccountingQuickBooks: &quickbooksExporter{API: "https://quickbooks.api.intuit.com"},
+	db.AccountingXero:       &xeroExporter{API: "https://api.xero.com"},
+}
+
+func init() {
+	schedule("sync-accounting", accountingSyncEvery, syncAccounting)
+}
+
+// accountingRequest sends a JSON request to a provider. A nil body sends
+// nothing and a nil out ignores the response.
+func accountingRequest(method, url, token string, header http.Header, body, out interface{}) error {
+	var buf []byte
+	if body != nil {
+		var err error
+		if buf, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := accountingHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var msg bytes.Buffer
+		msg.ReadFrom(res.Body)
+		return fmt.Errorf("%s returned %s: %s", req.URL.Host, res.Status, strings.TrimSpace(msg.String()))
+	}
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// accountingToken returns an access token for the provider, refreshing it
+// if it's expired. Providers rotate the refresh token, so both are saved.
+func accountingToken(cfg *db.AccountingConfig, exporter accountingExporter) (string, error) {
+	if cfg.AccessToken != "" && time.Now().Before(cfg.ExpiresAt.Add(-time.Minute)) {
+		return cfg.AccessToken, nil
+	}
+	if cfg.RefreshToken == "" {
+		return "", errors.New(cfg.Provider + " isn't connected, set a refresh token")
+	}
+
+	access, refresh, expiresAt, err := refreshOAuthToken(cfg.Provider, exporter.tokenURL(), cfg.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	cfg.AccessToken = access
+	cfg.RefreshToken = refresh
+	cfg.ExpiresAt = expiresAt
+	return cfg.AccessToken, db.SaveAccountingTokens(cfg.AccessToken, cfg.RefreshToken, cfg.ExpiresAt)
+}
+
+// refreshOAuthToken exchanges a refresh token for an access token, using the
+// provider's client id and secret from <PROVIDER>_CLIENT_ID and
+// <PROVIDER>_CLIENT_SECRET. Providers that don't rotate the refresh token
+// get the old one back, and ones that don't say when it expires get an hour.
+func refreshOAuthToken(provider, tokenURL, refreshToken string) (string, string, time.Time, error) {
+	env := strings.ToUpper(provider)
+	params := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	req.SetBasicAuth(os.Getenv(env+"_CLIENT_ID"), os.Getenv(env+"_CLIENT_SECRET"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := accountingHTTPClient.Do(req)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", "", time.Time{}, fmt.Errorf("refreshing %s token returned %s", provider, res.Status)
+	}
+
+	var body struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", "", time.Time{}, err
+	}
+	if body.RefreshToken == "" {
+		body.RefreshToken = refreshToken
+	}
+	if body.ExpiresIn <= 0 {
+		body.ExpiresIn = 3600
+	}
+
+	return body.AccessToken, body.RefreshToken, time.Now().Add(time.Duration(body.ExpiresIn) * time.Second), nil
+}
+
+// accountingItem returns the provider's item for a plan.
+func accountingItem(cfg *db.AccountingConfig, plan string) string {
+	if item, ok := cfg.PlanItems[plan]; ok {
+		return item
+	}
+
+	return cfg.DefaultItem
+}
+
+// quickbooksExporter records charges as sales receipts and refunds as refund
+// receipts.
+type quickbooksExporter struct {
+	API string
+}
+
+func (q *quickbooksExporter) tokenURL() string {
+	return "https://oauth.platform.intuit.com/oauth2/v1/tokens/bearer"
+}
+
+func (q *quickbooksExporter) export(cfg *db.AccountingConfig, token string, s *db.AccountingSync, d *schemas.Developer) (string, error) {
+	kind, account := "SalesReceipt", cfg.DepositAccount
+	if s.Kind == db.AccountingRefund {
+		kind = "RefundReceipt"
+		if cfg.RefundAccount != "" {
+			account = cfg.RefundAccount
+		}
+	}
+
+	line := map[string]interface{}{
+		"Amount":      majorAmount(s.Amount, s.Currency),
+		"Description": s.Plan,
+		"DetailType":  "SalesItemLineDetail",
+		"SalesItemLineDetail": map[string]interface{}{
+			"ItemRef":    map[string]string{"value": accountingItem(cfg, s.Plan)},
+			"TaxCodeRef": map[string]string{"value": cfg.TaxCode},
+		},
+	}
+	body := map[string]interface{}{
+		"TxnDate":             s.OccurredAt.Format("2006-01-02"),
+		"PrivateNote":         s.ID,
+		"CurrencyRef":         map[string]string{"value": strings.ToUpper(s.Currency)},
+		"DepositToAccountRef": map[string]string{"value": account},
+		"Line":                []interface{}{line},
+	}
+	if d != nil {
+		body["BillEmail"] = map[string]string{"Address": d.Email}
+	}
+
+	var res struct {
+		SalesReceipt struct {
+			ID string `json:"Id"`
+		}
+		RefundReceipt struct {
+			ID string `json:"Id"`
+		}
+	}
+	path := fmt.Sprintf("%s/v3/company/%s/%s?minorversion=65", q.API, url.PathEscape(cfg.CompanyID), strings.ToLower(kind))
+	if err := accountingRequest("POST", path, token, nil, body, &res); err != nil {
+		return "", err
+	}
+
+	if s.Kind == db.AccountingRefund {
+		return res.RefundReceipt.ID, nil
+	}
+	return res.SalesReceipt.ID, nil
+}
+
+// xeroExporter records charges as receive money transactions and refunds as
+// spend money transactions against the deposit account.
+type xeroExporter struct {
+	API string
+}
+
+func (x *xeroExporter) tokenURL() string {
+	return "https://identity.xero.com/connect/token"
+}
+
+func (x *xeroExporter) export(cfg *db.AccountingConfig, token string, s *db.AccountingSync, d *schemas.Developer) (string, error) {
+	kind, account := "RECEIVE", cfg.IncomeAccount
+	if s.Kind == db.AccountingRefund {
+		kind = "SPEND"
+		if cfg.RefundAccount != "" {
+			account = cfg.RefundAccount
+		}
+	}
+
+	contact := "Stripe"
+	if d != nil {
+		contact = d.Email
+	}
+	body := map[string]interface{}{
+		"BankTransactions": []interface{}{map[string]interface{}{
+			"Type":         kind,
+			"Date":         s.OccurredAt.Format("2006-01-02"),
+			"Reference":    s.ID,
+			"CurrencyCode": strings.ToUpper(s.Currency),
+			"Contact":      map[string]string{"Name": contact},
+			"BankAccount":  map[string]string{"Code": cfg.DepositAccount},
+			"LineItems": []interface{}{map[string]interface{}{
+				"Description": s.Plan,
+				"Quantity":    1,
+				"UnitAmount":  majorAmount(s.Amount, s.Currency),
+				"AccountCode": account,
+				"ItemCode":    accountingItem(cfg, s.Plan),
+				"TaxType":     cfg.TaxCode,
+			}},
+		}},
+	}
+
+	var res struct {
+		BankTransactions []struct {
+			ID string `json:"BankTransactionID"`
+		}
+	}
+	header := http.Header{"Xero-Tenant-Id": {cfg.CompanyID}}
+	if err := accountingRequest("PUT", x.API+"/api.xro/2.0/BankTransactions", token, header, body, &res); err != nil {
+		return "", err
+	}
+	if len(res.BankTransactions) == 0 {
+		return "", errors.New("xero didn't return the transaction")
+	}
+
+	return res.BankTransactions[0].ID, nil
+}
+
+// stripeRefund is the part of a Stripe refund broome exports.
+type stripeRefund struct {
+	ID            string `json:"id"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	Status        string `json:"status"`
+	Created       int64  `json:"created"`
+	PaymentIntent string `json:"payment_intent"`
+}
+
+// stripeRefunds lists refunds made since a time, refunds are made from the
+// Stripe dashboard.
+func stripeRefunds(ctx context.Context, since time.Time) ([]*stripeRefund, error) {
+	refunds := []*stripeRefund{}
+	after := ""
+	for {
+		var page struct {
+			Data    []*stripeRefund `json:"data"`
+			HasMore bool            `json:"has_more"`
+		}
+		path := "/refunds?limit=100&created[gte]=" + strconv.FormatInt(since.Unix(), 10)
+		if after != "" {
+			path += "&starting_after=" + url.QueryEscape(after)
+		}
+
+		err := callStripe(ctx, func() error {
+			return stripeRequest(ctx, "GET", path, url.Values{}, "", &page)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		refunds = append(refunds, page.Data...)
+		if !page.HasMore || len(page.Data) == 0 {
+			return refunds, nil
+		}
+		after = page.Data[len(page.Data)-1].ID
+	}
+}
+
+// queueAccountingSyncs queues transactions that settled since a time.
+func queueAccountingSyncs(since time.Time) error {
+	now := time.Now()
+	queue := func(s *db.AccountingSync) error {
+		s.Currency = strings.ToLower(s.Currency)
+		_, err := db.QueueAccountingSync(s)
+		return err
+	}
+
+	ps, err := db.GetRevenuePayments(since, now)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		err := queue(&db.AccountingSync{
+			ID:          "payment:" + p.ID,
+			Kind:        db.AccountingCharge,
+			DeveloperID: p.DeveloperID,
+			Plan:        p.Plan,
+			Amount:      p.Amount,
+			Currency:    p.Currency,
+			OccurredAt:  p.UpdatedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cs, err := db.GetRevenueCheckouts(since, now)
+	if err != nil {
+		return err
+	}
+	for _, c := range cs {
+		err := queue(&db.AccountingSync{
+			ID:          "checkout:" + c.ID,
+			Kind:        db.AccountingCharge,
+			DeveloperID: c.DeveloperID,
+			Plan:        c.Plan,
+			Amount:      c.Amount,
+			Currency:    c.Currency,
+			OccurredAt:  c.CompletedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	refunds, err := stripeRefunds(context.Background(), since)
+	if err != nil {
+		return err
+	}
+	for _, r := range refunds {
+		if r.Status != "succeeded" {
+			continue
+		}
+
+		s := &db.AccountingSync{
+			ID:         "refund:" + r.ID,
+			Kind:       db.AccountingRefund,
+			Amount:     r.Amount,
+			Currency:   r.Currency,
+			OccurredAt: time.Unix(r.Created, 0),
+		}
+		if p, err := db.GetPayment(r.PaymentIntent); err == nil {
+			s.DeveloperID = p.DeveloperID
+			s.Plan = p.Plan
+		}
+		if err := queue(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportAccounting pushes queued transactions to the configured provider.
+func exportAccounting(cfg *db.AccountingConfig) error {
+	exporter, ok := accountingExporters[cfg.Provider]
+	if !ok {
+		return fmt.Errorf("unknown accounting provider %q", cfg.Provider)
+	}
+
+	ss, err := db.GetAccountingSyncs(bson.M{
+		"status":   bson.M{"$in": []string{db.SyncPending, db.SyncFailed}},
+		"attempts": bson.M{"$lt": accountingMaxAttempts},
+	}, 100)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range ss {
+		var d *schemas.Developer
+		if s.DeveloperID != "" {
+			d, _ = db.GetDeveloper(bson.M{"_id": s.DeveloperID})
+		}
+
+		var id string
+		err := callDependency(context.Background(), "accounting", transientError, func() error {
+			token, err := accountingToken(cfg, exporter)
+			if err != nil {
+				return err
+			}
+
+			id, err = exporter.export(cfg, token, s, d)
+			return err
+		})
+		if err == errBreakerOpen {
+			return err
+		}
+		if err != nil {
+			if s.Attempts+1 >= accountingMaxAttempts {
+				notifySlackOnce(notificationKey("accounting.failed", s.ID), slackChannel("billing"),
+					fmt.Sprintf("Couldn't export %s to %s: %s", s.ID, cfg.Provider, err))
+			}
+			if merr := db.MarkAccountingFailed(s.ID, cfg.Provider, err.Error()); merr != nil {
+				return merr
+			}
+			continue
+		}
+
+		if err := db.MarkAccountingSynced(s.ID, cfg.Provider, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncAccounting queues recently settled transactions and exports them, if
+// a provider is configured.
+func syncAccounting() error {
+	cfg, err := db.GetAccountingConfig()
+	if err != nil || cfg.Provider == "" {
+		return err
+	}
+
+	if err := queueAccountingSyncs(time.Now().Add(-accountingLookback)); err != nil {
+		return err
+	}
+	return exportAccounting(cfg)
+}
+
+// validateAccountingConfig checks the mapping has what the provider needs.
+func validateAccountingConfig(c *db.AccountingConfig) error {
+	if c.Provider == "" {
+		return nil
+	}
+	if _, ok := accountingExporters[c.Provider]; !ok {
+		return errors.New("Provider must be quickbooks or xero.")
+	}
+	if c.CompanyID == "" || c.DepositAccount == "" {
+		return errors.New("Company id and deposit account Required.")
+	}
+	if c.Provider == db.AccountingXero && c.IncomeAccount == "" {
+		return errors.New("Income account Required for Xero.")
+	}
+	if c.Provider == db.AccountingQuickBooks && c.DefaultItem == "" {
+		return errors.New("Default item Required for QuickBooks.")
+	}
+
+	return nil
+}
+
+// GET /admin/accounting, Gets the accounting provider and account mapping
+func AdminAccountingHandler(rw http.ResponseWriter, req *http.Request) {
+	cfg, err := db.GetAccountingConfig()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"config":    cfg,
+		"connected": cfg.RefreshToken != "",
+	})
+}
+
+// PUT /admin/accounting, Updates the accounting provider and account mapping
+func UpdateAccountingHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		db.AccountingConfig
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateAccountingConfig(&body.AccountingConfig); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	err := db.SaveAccountingMapping(&body.AccountingConfig, actor)
+	if err == nil && body.RefreshToken != "" {
+		// Connecting a provider, the access token is fetched on first use.
+		err = db.SaveAccountingTokens("", body.RefreshToken, time.Time{})
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "accounting.update", actor, body.Provider)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"config": body.AccountingConfig,
+	})
+}
+
+// GET /admin/accounting/unsynced, Reconciliation report of transactions not yet in the accounting provider
+func UnsyncedAccountingHandler(rw http.ResponseWriter, req *http.Request) {
+	ss, err := db.GetAccountingSyncs(bson.M{"status": bson.M{"$ne": db.SyncSynced}}, 0)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if req.FormValue("format") == "csv" {
+		writeUnsyncedCSV(rw, ss)
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusFound,
+		"transactions": ss,
+	})
+}
+
+// writeUnsyncedCSV writes the reconciliation report as a CSV download.
+func writeUnsyncedCSV(rw http.ResponseWriter, ss []*db.AccountingSync) {
+	rw.Header().Set("Content-Type", "text/csv")
+	rw.Header().Set("Content-Disposition", `attachment; filename="unsynced-transactions.csv"`)
+
+	w := csv.NewWriter(rw)
+	w.Write([]string{"id", "kind", "date", "plan", "currency", "amount", "status", "attempts", "error"})
+	for _, s := range ss {
+		w.Write([]string{
+			s.ID,
+			s.Kind,
+			s.OccurredAt.Format(time.RFC3339),
+			s.Plan,
+			s.Currency,
+			strconv.FormatInt(s.Amount, 10),
+			s.Status,
+			strconv.Itoa(s.Attempts),
+			s.Error,
+		})
+	}
+	w.Flush()
+}
+
+// POST /admin/accounting/{id}/retry, Puts a failed export back in the queue
+func RetryAccountingHandler(rw http.ResponseWriter, req *http.Request) {
+	err := db.RetryAccountingSync(mux.Vars(req)["id"])
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
@@ -0,0 +1,290 @@
+// Copyright 2014 Bowery, Inc.
+// Contains bank transfer payments for annual plans. The account is verified
+// with micro-deposits, then the transfer takes a few days to settle and the
+// developer is marked paid once it has.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// achAccount is the bank account a developer pays from.
+type achAccount struct {
+	Plan          string `json:"plan"`
+	HolderName    string `json:"accountHolderName"`
+	HolderType    string `json:"accountHolderType"`
+	RoutingNumber string `json:"routingNumber"`
+	AccountNumber string `json:"accountNumber"`
+
+	BillingAddress *db.BillingAddress `json:"billingAddress"`
+}
+
+// validate checks the account before it's sent to Stripe.
+func (a *achAccount) validate() error {
+	if a.HolderName == "" || a.RoutingNumber == "" || a.AccountNumber == "" {
+		return errors.New("Account holder name, routing number and account number Required.")
+	}
+	if len(a.RoutingNumber) != 9 {
+		return errors.New("Routing numbers are 9 digits.")
+	}
+	if _, err := strconv.ParseUint(a.RoutingNumber, 10, 64); err != nil {
+		return errors.New("Routing numbers are 9 digits.")
+	}
+	if a.HolderType == "" {
+		a.HolderType = "company"
+	}
+	if a.HolderType != "company" && a.HolderType != "individual" {
+		return errors.New("Account holder type must be company or individual.")
+	}
+
+	return validateBillingAddress(a.BillingAddress)
+}
+
+// setPendingPayment marks whether the developer has a payment waiting to
+// settle, so support can see it on their record.
+func setPendingPayment(developerID bson.ObjectId, paymentID string) error {
+	return db.UpdateDeveloper(bson.M{"_id": developerID}, bson.M{"pendingPayment": paymentID})
+}
+
+// clearPendingPayment clears a finished payment from the developer.
+func clearPendingPayment(p *db.Payment) {
+	if p.Method != db.MethodACH {
+		return
+	}
+
+	if err := setPendingPayment(p.DeveloperID, ""); err != nil {
+		fmt.Println("unable to clear pending payment for", p.DeveloperID.Hex(), err)
+	}
+}
+
+// chargeBankAccount starts a transfer for a plan, verified by micro-deposits.
+func chargeBankAccount(req *http.Request, d *schemas.Developer, plan *db.Plan, customer string, a *achAccount) (*paymentIntent, error) {
+	params := url.Values{
+		"amount":                    {strconv.FormatInt(plan.Amount, 10)},
+		"currency":                  {plan.Currency},
+		"description":               {plan.Description},
+		"customer":                  {customer},
+		"payment_method_types[]":    {"us_bank_account"},
+		"payment_method_data[type]": {"us_bank_account"},
+		"payment_method_data[billing_details][name]":                   {a.HolderName},
+		"payment_method_data[us_bank_account][account_holder_type]":    {a.HolderType},
+		"payment_method_data[us_bank_account][routing_number]":         {a.RoutingNumber},
+		"payment_method_data[us_bank_account][account_number]":         {a.AccountNumber},
+		"payment_method_options[us_bank_account][verification_method]": {"microdeposits"},
+		"mandate_data[customer_acceptance][type]":                      {"online"},
+		"mandate_data[customer_acceptance][online][ip_address]":        {clientIP(req)},
+		"mandate_data[customer_acceptance][online][user_agent]":        {req.UserAgent()},
+		"metadata[developerId]":                                        {d.ID.Hex()},
+		"metadata[plan]":                                               {plan.Slug},
+	}
+	addressParams(params, "payment_method_data[billing_details][address]", a.BillingAddress)
+
+	return confirmPaymentIntent(req.Context(), params, "ach-"+d.ID.Hex()+"-"+bson.NewObjectId().Hex())
+}
+
+// POST /developers/{token}/ach, Starts paying for an annual plan by bank transfer
+func CreateACHPaymentHandler(rw http.ResponseWriter, req *http.Request) {
+	var body achAccount
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := body.validate(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if body.Plan == "" {
+		body.Plan = db.PlanCrosby
+	}
+	plan, err := db.GetPlan(body.Plan)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if plan.Interval != "year" || plan.Currency != "usd" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Bank transfers are only available for annual plans billed in USD.",
+		})
+		return
+	}
+
+	if err := db.SetBillingAddress(d.ID, body.BillingAddress); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	customer, err := createStripeCustomer(req.Context(), d)
+	if stripeUnavailable(rw, err) {
+		return
+	}
+
+	var pi *paymentIntent
+	if err == nil {
+		pi, err = chargeBankAccount(req, d, plan, customer, &body)
+	}
+	if stripeUnavailable(rw, err) {
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	p, err := recordPayment(d, plan, db.PaymentPurchase, db.MethodACH, pi)
+	var status string
+	if err == nil {
+		status, err = settlePayment(p, pi)
+	}
+	if err == nil && (status == db.PaymentRequiresAction || status == db.PaymentProcessing) {
+		err = setPendingPayment(d.ID, p.ID)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	track("ach.started", d, map[string]interface{}{"plan": plan.Slug})
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusCreated,
+		"payment": p,
+	})
+}
+
+// POST /developers/{token}/ach/{id}/verify, Verifies the account with the micro-deposit amounts or code
+func VerifyACHPaymentHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Amounts        []int64 `json:"amounts"`
+		DescriptorCode string  `json:"descriptorCode"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	params := url.Values{}
+	switch {
+	case body.DescriptorCode != "":
+		params.Set("descriptor_code", body.DescriptorCode)
+	case len(body.Amounts) == 2:
+		for _, amount := range body.Amounts {
+			params.Add("amounts[]", strconv.FormatInt(amount, 10))
+		}
+	default:
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "The two deposit amounts or the descriptor code Required.",
+		})
+		return
+	}
+
+	d, p, err := paymentFor(req)
+	if err == nil && p.Method != db.MethodACH {
+		err = errors.New("Unknown payment")
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	pi := &paymentIntent{}
+	err = callStripe(req.Context(), func() error {
+		return stripeRequest(req.Context(), "POST", "/payment_intents/"+url.PathEscape(p.ID)+"/verify_microdeposits", params, "", pi)
+	})
+	if stripeUnavailable(rw, err) {
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	status, err := settlePayment(p, pi)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	track("ach.verified", d, nil)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":        requests.StatusUpdated,
+		"paymentStatus": status,
+	})
+}
+
+// GET /developers/{token}/payments, Lists a developer's payments and their states
+func GetPaymentsHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	ps, err := db.GetPayments(bson.M{"developerId": d.ID}, 50)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"payments": ps,
+	})
+}
@@ -0,0 +1,339 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the admin activity feed, the audit logs and the business events
+// merged newest first. Each entry has a type worked out from its action, so
+// the feed can be filtered to e.g. payments or admin actions.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"labix.org/v2/mgo/bson"
+)
+
+// Activity types.
+const (
+	activitySignup       = "signup"
+	activityPayment      = "payment"
+	activityCancellation = "cancellation"
+	activityAdmin        = "admin"
+	activityAccount      = "account"
+	activitySystem       = "system"
+)
+
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 200
+)
+
+// activityEvents are the events shown in the feed by type. Other events,
+// like heartbeats, are too noisy for it.
+var activityEvents = map[string][]string{
+	activitySignup:  {"developer.created", "session.created"},
+	activityPayment: {"developer.paid", "charge.failed", "charge.action_required", "ach.verified"},
+}
+
+// activityCancellations are the audit actions for developers leaving.
+var activityCancellations = []string{"developer.deleted", "subscription.canceled"}
+
+// Audit actions typed by their prefix rather than where they were made.
+var (
+	activitySignupAction  = regexp.MustCompile(`^signup\.`)
+	activityPaymentAction = regexp.MustCompile(`^refund\.`)
+	activityTypedAction   = `^(signup|refund)\.`
+)
+
+// activity is an entry in the feed.
+type activity struct {
+	At          time.Time `json:"at"`
+	Type        string    `json:"type"`
+	Name        string    `json:"name"`
+	Actor       string    `json:"actor,omitempty"`
+	DeveloperID string    `json:"developerId,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+	Source      string    `json:"source"`
+}
+
+// auditActivityType returns the type of an audit log. Actions made without
+// a request, e.g. by the scheduler, are system activity.
+func auditActivityType(l *db.AuditLog) string {
+	switch {
+	case containsString(activityCancellations, l.Action):
+		return activityCancellation
+	case activitySignupAction.MatchString(l.Action):
+		return activitySignup
+	case activityPaymentAction.MatchString(l.Action):
+		return activityPayment
+	case strings.HasPrefix(l.Path, "/admin/"):
+		return activityAdmin
+	case l.Path == "":
+		return activitySystem
+	}
+	return activityAccount
+}
+
+// eventActivityType returns the type of an event, empty if it isn't shown.
+func eventActivityType(name string) string {
+	for kind, names := range activityEvents {
+		if containsString(names, name) {
+			return kind
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// auditActivityQuery returns the audit log query for a type, matching
+// exactly the logs auditActivityType gives it. ok is false for types with
+// no audit logs.
+func auditActivityQuery(kind string) (query bson.M, ok bool) {
+	untyped := bson.M{
+		"$nin": activityCancellations,
+		"$not": bson.RegEx{Pattern: activityTypedAction},
+	}
+
+	switch kind {
+	case "":
+		return bson.M{}, true
+	case activityCancellation:
+		return bson.M{"action": bson.M{"$in": activityCancellations}}, true
+	case activitySignup:
+		return bson.M{"action": bson.RegEx{Pattern: activitySignupAction.String()}}, true
+	case activityPayment:
+		return bson.M{"action": bson.RegEx{Pattern: activityPaymentAction.String()}}, true
+	case activityAdmin:
+		return bson.M{"action": untyped, "path": bson.RegEx{Pattern: "^/admin/"}}, true
+	case activitySystem:
+		return bson.M{"action": untyped, "path": ""}, true
+	case activityAccount:
+		return bson.M{"action": untyped, "path": bson.M{
+			"$ne":  "",
+			"$not": bson.RegEx{Pattern: "^/admin/"},
+		}}, true
+	}
+	return nil, false
+}
+
+// eventActivityQuery returns the event query for a type, ok is false for
+// types with no events.
+func eventActivityQuery(kind string) (query bson.M, ok bool) {
+	names := []string{}
+	if kind == "" {
+		for _, ns := range activityEvents {
+			names = append(names, ns...)
+		}
+	} else {
+		names = activityEvents[kind]
+	}
+	if len(names) == 0 {
+		return nil, false
+	}
+
+	return bson.M{"name": bson.M{"$in": names}}, true
+}
+
+// eventDetail formats an event's properties as sorted key=value pairs.
+func eventDetail(properties map[string]interface{}) string {
+	pairs := []string{}
+	for key, value := range properties {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", key, value))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// activityByTime sorts entries newest first.
+type activityByTime []*activity
+
+func (a activityByTime) Len() int           { return len(a) }
+func (a activityByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a activityByTime) Less(i, j int) bool { return a[i].At.After(a[j].At) }
+
+// mergeActivity sorts entries newest first and keeps limit of them.
+func mergeActivity(entries []*activity, limit int) []*activity {
+	sort.Stable(activityByTime(entries))
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// loadActivity returns a page of the feed before a time, filtered by type
+// and actor, and whether there are older entries. Events are made by the
+// developer they're for, so they match an actor by the developer's email.
+func loadActivity(kind, actor string, before time.Time, limit int) ([]*activity, bool, error) {
+	entries := []*activity{}
+	more := false
+	created := bson.M{"$lt": before}
+
+	if query, ok := auditActivityQuery(kind); ok {
+		query["createdAt"] = created
+		if actor != "" {
+			query["actor"] = actor
+		}
+		ls, err := db.GetAuditLogs(query, limit)
+		if err != nil {
+			return nil, false, err
+		}
+		more = more || len(ls) == limit
+
+		for _, l := range ls {
+			entries = append(entries, &activity{
+				At:          l.CreatedAt,
+				Type:        auditActivityType(l),
+				Name:        l.Action,
+				Actor:       l.Actor,
+				DeveloperID: l.DeveloperID.Hex(),
+				Detail:      l.Detail,
+				Source:      "audit",
+			})
+		}
+	}
+
+	if query, ok := eventActivityQuery(kind); ok {
+		query["createdAt"] = created
+		skip := false
+		if actor != "" {
+			d, err := db.GetDeveloper(bson.M{"email": actor})
+			if err != nil && err != db.ErrNotFound {
+				return nil, false, err
+			}
+			skip = err == db.ErrNotFound
+			if err == nil {
+				query["developerId"] = d.ID.Hex()
+			}
+		}
+
+		if !skip {
+			es, err := db.GetEvents(query, limit)
+			if err != nil {
+				return nil, false, err
+			}
+			more = more || len(es) == limit
+			if err := addEventActivity(&entries, es); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	merged := mergeActivity(entries, limit)
+	return merged, more || len(entries) > limit, nil
+}
+
+// addEventActivity adds events to the entries, with the emails of the
+// developers they're for as the actor.
+func addEventActivity(entries *[]*activity, es []*db.Event) error {
+	ids := []bson.ObjectId{}
+	for _, e := range es {
+		if bson.IsObjectIdHex(e.DeveloperID) {
+			ids = append(ids, bson.ObjectIdHex(e.DeveloperID))
+		}
+	}
+	emails := map[string]string{}
+	if len(ids) > 0 {
+		ds, err := db.GetDevelopersByIDs(db.ReadAdmin, ids)
+		if err != nil {
+			return err
+		}
+		for id, d := range ds {
+			emails[id.Hex()] = d.Email
+		}
+	}
+
+	for _, e := range es {
+		*entries = append(*entries, &activity{
+			At:          e.CreatedAt,
+			Type:        eventActivityType(e.Name),
+			Name:        e.Name,
+			Actor:       emails[e.DeveloperID],
+			DeveloperID: e.DeveloperID,
+			Detail:      eventDetail(e.Properties),
+			Source:      "event",
+		})
+	}
+	return nil
+}
+
+// GET /admin/activity, The activity feed, filtered by ?type= and ?actor=, paged with ?before=, as JSON with format=json
+func ActivityHandler(rw http.ResponseWriter, req *http.Request) {
+	kind := req.FormValue("type")
+	actor := strings.TrimSpace(req.FormValue("actor"))
+	asJSON := req.FormValue("format") == "json"
+	fail := func(status int, err error) {
+		if asJSON {
+			renderer.JSON(rw, status, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+
+	if _, ok := auditActivityQuery(kind); !ok {
+		fail(http.StatusBadRequest, fmt.Errorf("unknown type %s", kind))
+		return
+	}
+	before := time.Now()
+	if val := req.FormValue("before"); val != "" {
+		t, err := time.Parse(time.RFC3339Nano, val)
+		if err != nil {
+			fail(http.StatusBadRequest, errors.New("invalid before"))
+			return
+		}
+		before = t
+	}
+	limit := defaultActivityLimit
+	if l, err := strconv.Atoi(req.FormValue("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxActivityLimit {
+		limit = maxActivityLimit
+	}
+
+	entries, more, err := loadActivity(kind, actor, before, limit)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	next := ""
+	if more && len(entries) > 0 {
+		next = entries[len(entries)-1].At.Format(time.RFC3339Nano)
+	}
+
+	if asJSON {
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status":   requests.StatusFound,
+			"activity": entries,
+			"before":   next,
+		})
+		return
+	}
+
+	if err := RenderAdminTemplate(rw, "activity", map[string]interface{}{
+		"Activity": entries,
+		"Type":     kind,
+		"Actor":    actor,
+		"Types":    []string{activitySignup, activityPayment, activityCancellation, activityAdmin, activityAccount, activitySystem},
+		"Before":   next,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the IP allowlist for admin routes.
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Bowery/gopackages/requests"
+)
+
+// Header carrying the emergency token that bypasses the allowlist.
+const breakGlassHeader = "X-Break-Glass"
+
+// adminAllowlist holds the networks allowed to reach admin routes, read from
+// ADMIN_ALLOWLIST as comma separated CIDRs or IPs. Empty allows everyone.
+var adminAllowlist = parseAllowlist(os.Getenv("ADMIN_ALLOWLIST"))
+
+// parseAllowlist parses comma separated CIDRs, treating bare IPs as a
+// single address.
+func parseAllowlist(list string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			panic("invalid ADMIN_ALLOWLIST entry " + entry)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// ipAllowed reports whether ip is in one of the networks.
+func ipAllowed(nets []*net.IPNet, ip string) bool {
+	if len(nets) == 0 {
+		return true
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// breakGlass reports whether req carries the emergency token set in
+// BREAK_GLASS_TOKEN.
+func breakGlass(req *http.Request) bool {
+	token := os.Getenv("BREAK_GLASS_TOKEN")
+	given := req.Header.Get(breakGlassHeader)
+	if token == "" || given == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+}
+
+// adminAllowlisted wraps the whole server so every /admin route is checked
+// against the allowlist, including the ones that don't need a login.
+func adminAllowlisted(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		actor := ""
+		if user, pass, ok := req.BasicAuth(); ok && pass != "" {
+			actor = user
+		}
+
+		if !allowAdminRequest(req, actor) {
+			renderer.JSON(rw, http.StatusForbidden, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "Your address isn't allowed to use admin routes.",
+			})
+			return
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// allowAdminRequest checks admin routes against the allowlist. Blocked
+// attempts and break glass use are audited.
+func allowAdminRequest(req *http.Request, actor string) bool {
+	if !strings.HasPrefix(req.URL.Path, "/admin") {
+		return true
+	}
+
+	ip := clientIP(req)
+	if ipAllowed(adminAllowlist, ip) {
+		return true
+	}
+
+	if breakGlass(req) {
+		audit(req, "admin.break-glass", actor, "allowlist bypassed from "+ip)
+		if os.Getenv("ENV") == "production" {
+			go notifySlack(slackChannel("activity"), "Break glass used by "+actor+" from "+ip+" on "+req.URL.Path)
+		}
+		return true
+	}
+
+	audit(req, "admin.blocked", actor, "ip not in allowlist")
+	return false
+}
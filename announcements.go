@@ -0,0 +1,345 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for announcement banners.
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// developerPlan returns the plan name announcements are targeted by.
+func developerPlan(d *schemas.Developer) string {
+	if d.IsPaid {
+		return "paid"
+	}
+
+	return "free"
+}
+
+// announcementMatches reports whether a reaches a client on plan and version.
+func announcementMatches(a *db.Announcement, plan, version string) bool {
+	if len(a.Plans) > 0 && plan != "" {
+		found := false
+		for _, p := range a.Plans {
+			if p == plan {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if version != "" {
+		if a.MinVersion != "" && compareVersions(version, a.MinVersion) < 0 {
+			return false
+		}
+		if a.MaxVersion != "" && compareVersions(version, a.MaxVersion) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseAnnouncementForm copies the submitted fields onto a, returning an
+// error message if a field is invalid.
+func parseAnnouncementForm(req *http.Request, a *db.Announcement) string {
+	for field, dest := range map[string]*string{
+		"title":      &a.Title,
+		"body":       &a.Body,
+		"kind":       &a.Kind,
+		"minVersion": &a.MinVersion,
+		"maxVersion": &a.MaxVersion,
+	} {
+		if val, ok := req.Form[field]; ok {
+			*dest = strings.TrimSpace(val[0])
+		}
+	}
+
+	if _, ok := req.Form["plans"]; ok {
+		a.Plans = []string{}
+		for _, p := range strings.Split(req.FormValue("plans"), ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				a.Plans = append(a.Plans, p)
+			}
+		}
+	}
+
+	for field, dest := range map[string]*time.Time{
+		"startsAt": &a.StartsAt,
+		"endsAt":   &a.EndsAt,
+	} {
+		val, ok := req.Form[field]
+		if !ok {
+			continue
+		}
+		if val[0] == "" {
+			*dest = time.Time{}
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, val[0])
+		if err != nil {
+			return "invalid " + field
+		}
+		*dest = t
+	}
+
+	if a.Title == "" {
+		return "Title Required."
+	}
+
+	return ""
+}
+
+// GET /announcements, Lists live announcements for the plan and version. If
+// a token is given the developer's plan is used and unread state returned.
+func GetAnnouncementsHandler(rw http.ResponseWriter, req *http.Request) {
+	plan := req.FormValue("plan")
+	version := req.FormValue("version")
+
+	var dev *schemas.Developer
+	if token := req.FormValue("token"); token != "" {
+		var err error
+		dev, err = tenantFor(req).GetDeveloper(bson.M{"token": token})
+		if err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "Invalid Token.",
+			})
+			return
+		}
+
+		plan = developerPlan(dev)
+		if version == "" {
+			version = dev.Version
+		}
+	}
+
+	as, err := db.GetLiveAnnouncements(time.Now())
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	type announcement struct {
+		*db.Announcement
+		Read bool `json:"read"`
+	}
+
+	res := []*announcement{}
+	ids := []bson.ObjectId{}
+	for _, a := range as {
+		if !announcementMatches(a, plan, version) {
+			continue
+		}
+
+		res = append(res, &announcement{Announcement: a})
+		ids = append(ids, a.ID)
+	}
+
+	if dev != nil && len(ids) > 0 {
+		read, err := db.GetReadAnnouncements(dev.ID, ids)
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+		for _, item := range res {
+			item.Read = read[item.ID]
+		}
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":        requests.StatusFound,
+		"announcements": res,
+	})
+}
+
+// POST /announcements/{id}/read, Marks an announcement read for the developer
+func ReadAnnouncementHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid announcement id",
+		})
+		return
+	}
+
+	token := req.FormValue("token")
+	if token == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Token Required.",
+		})
+		return
+	}
+
+	dev, err := tenantFor(req).GetDeveloper(bson.M{"token": token})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Invalid Token.",
+		})
+		return
+	}
+
+	if err := db.MarkAnnouncementRead(bson.ObjectIdHex(id), dev.ID); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// GET /admin/announcements, Admin interface for announcements
+func AdminAnnouncementsHandler(rw http.ResponseWriter, req *http.Request) {
+	as, err := db.GetAnnouncements(bson.M{})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderAdminTemplate(rw, "announcements", map[string]interface{}{
+		"Announcements": as,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// POST /admin/announcements, Creates an announcement
+func CreateAnnouncementHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	a := &db.Announcement{}
+	if msg := parseAnnouncementForm(req, a); msg != "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  msg,
+		})
+		return
+	}
+
+	if err := db.SaveAnnouncement(a); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusCreated,
+		"announcement": a,
+	})
+}
+
+// PUT /admin/announcements/{id}, Edits an announcement
+func UpdateAnnouncementHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid announcement id",
+		})
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	a, err := db.GetAnnouncement(bson.M{"_id": bson.ObjectIdHex(id)})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if msg := parseAnnouncementForm(req, a); msg != "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  msg,
+		})
+		return
+	}
+
+	if err := db.UpdateAnnouncement(a.ID, bson.M{
+		"title":      a.Title,
+		"body":       a.Body,
+		"kind":       a.Kind,
+		"plans":      a.Plans,
+		"minVersion": a.MinVersion,
+		"maxVersion": a.MaxVersion,
+		"startsAt":   a.StartsAt,
+		"endsAt":     a.EndsAt,
+	}); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusUpdated,
+		"announcement": a,
+	})
+}
+
+// DELETE /admin/announcements/{id}, Removes an announcement
+func DeleteAnnouncementHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid announcement id",
+		})
+		return
+	}
+
+	if err := db.DeleteAnnouncement(bson.ObjectIdHex(id)); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
@@ -0,0 +1,222 @@
+// Copyright 2014 Bowery, Inc.
+// Contains anonymizing production data for staging. clone-staging copies
+// the developer collections into another database with emails, names,
+// tokens and IPs replaced by fakes and billing details stripped. Fakes are
+// an HMAC of the real value keyed by ANONYMIZE_SALT, so the same email is
+// the same fake in every collection and every clone, and references
+// between documents still line up.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"labix.org/v2/mgo/bson"
+)
+
+var anonymizeSalt = os.Getenv("ANONYMIZE_SALT")
+
+// Fields left out of cloned documents, lowercase without separators.
+// Staging doesn't bill anyone, so it has no use for them.
+var strippedFields = map[string]bool{
+	"billingaddress": true,
+	"billingcontact": true,
+	"emailhash":      true,
+	"invoice":        true,
+	"paymentmethod":  true,
+	"stripetoken":    true,
+}
+
+var (
+	// Emails in free text, e.g. in audit entries and notes.
+	anonymizeEmail = regexp.MustCompile(`[0-9A-Za-z._%+-]+@[0-9A-Za-z.-]+\.[A-Za-z]{2,}`)
+
+	// Stripe ids, replaced by fakes with the same prefix so they can't be
+	// used against Stripe but payments still match their developers.
+	anonymizeStripeID = regexp.MustCompile(`\b(cus|pi|ch|cs|pm|seti|in|sub|src|card|ba|re|txn|evt|tok|btok|acct)_[0-9A-Za-z_]{14,}`)
+)
+
+// anonymizer replaces PII with fakes derived from it.
+type anonymizer struct {
+	salt []byte
+}
+
+// newAnonymizer returns an anonymizer keyed by ANONYMIZE_SALT.
+func newAnonymizer() (*anonymizer, error) {
+	if len(anonymizeSalt) < 16 {
+		return nil, errors.New("ANONYMIZE_SALT must be at least 16 characters")
+	}
+
+	return &anonymizer{salt: []byte(anonymizeSalt)}, nil
+}
+
+// sum returns the HMAC of a kind of value.
+func (a *anonymizer) sum(kind, value string) []byte {
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(kind + ":" + value))
+	return mac.Sum(nil)
+}
+
+// fake returns n hex characters standing in for a value.
+func (a *anonymizer) fake(kind, value string, n int) string {
+	return hex.EncodeToString(a.sum(kind, value))[:n]
+}
+
+// email returns the fake for an email, case insensitive like lookups.
+func (a *anonymizer) email(email string) string {
+	return "dev-" + a.fake("email", strings.ToLower(strings.TrimSpace(email)), 16) + "@example.com"
+}
+
+// name returns the fake for a developer's name.
+func (a *anonymizer) name(name string) string {
+	return "Developer " + a.fake("name", name, 8)
+}
+
+// token returns the fake for a token, a valid test token so staging
+// clients can use it.
+func (a *anonymizer) token(token string) string {
+	sum := a.sum("token", token)
+	random := make([]byte, tokenRandomLength)
+	for i := range random {
+		random[i] = base62[int(sum[i%len(sum)])%len(base62)]
+	}
+
+	return tokenPrefixTest + string(random) + tokenChecksum(string(random))
+}
+
+// ip returns the fake for an IP, a private address.
+func (a *anonymizer) ip(ip string) string {
+	sum := a.sum("ip", ip)
+	return fmt.Sprintf("10.%d.%d.%d", sum[0], sum[1], sum[2])
+}
+
+// text returns free text with the emails and Stripe ids in it replaced.
+func (a *anonymizer) text(s string) (string, error) {
+	s, err := db.OpenPII(s)
+	if err != nil {
+		return "", err
+	}
+	s = anonymizeEmail.ReplaceAllStringFunc(s, a.email)
+
+	return anonymizeStripeID.ReplaceAllStringFunc(s, func(id string) string {
+		if !strings.ContainsAny(id, "0123456789") {
+			return id
+		}
+		prefix := id[:strings.Index(id, "_")]
+		return prefix + "_anon" + a.fake("stripe", id, 20)
+	}), nil
+}
+
+// document returns a copy of a document with its PII replaced and its
+// billing details stripped.
+func (a *anonymizer) document(doc bson.M) (bson.M, error) {
+	clean := bson.M{}
+	for key, value := range doc {
+		field := strings.ToLower(strings.NewReplacer("_", "", "-", "", ".", "").Replace(key))
+		s, isString := value.(string)
+		if isString {
+			var err error
+			if s, err = db.OpenPII(s); err != nil {
+				return nil, err
+			}
+		}
+
+		switch {
+		case strippedFields[field]:
+			continue
+		case !isString || s == "":
+			v, err := a.value(value)
+			if err != nil {
+				return nil, err
+			}
+			clean[key] = v
+		case field == "email":
+			clean[key] = a.email(s)
+		case field == "name" && doc["email"] != nil:
+			clean[key] = a.name(s)
+		case field == "token":
+			clean[key] = a.token(s)
+		case field == "tokenhash":
+			// Rehashed from the fake token so it still authenticates.
+			if token, ok := doc["token"].(string); ok && token != "" {
+				clean[key] = db.TokenHash(a.token(token))
+			} else {
+				clean[key] = a.fake(field, s, len(s))
+			}
+		case field == "ip":
+			clean[key] = a.ip(s)
+		case isSensitiveKey(key):
+			clean[key] = a.fake(field, s, 32)
+		default:
+			v, err := a.text(s)
+			if err != nil {
+				return nil, err
+			}
+			clean[key] = v
+		}
+	}
+
+	return clean, nil
+}
+
+// value returns v with its PII replaced, walking into documents and lists.
+func (a *anonymizer) value(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return a.text(v)
+	case bson.M:
+		return a.document(v)
+	case map[string]interface{}:
+		return a.document(bson.M(v))
+	case []interface{}:
+		clean := make([]interface{}, len(v))
+		for i, item := range v {
+			c, err := a.value(item)
+			if err != nil {
+				return nil, err
+			}
+			clean[i] = c
+		}
+		return clean, nil
+	}
+
+	return v, nil
+}
+
+// cloneStaging copies the developer collections into an empty database,
+// anonymized, returning how many documents were copied from each.
+func cloneStaging(database string) (map[string]int, error) {
+	if database == "" || database == db.Client.Db.Name {
+		return nil, errors.New("clone into a staging database, not " + db.Client.Db.Name)
+	}
+	a, err := newAnonymizer()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range db.BackupCollections {
+		if n, err := db.CountCollection(database, name); err != nil || n > 0 {
+			if err == nil {
+				err = fmt.Errorf("%s.%s isn't empty", database, name)
+			}
+			return nil, err
+		}
+	}
+
+	cloned := map[string]int{}
+	for _, name := range db.BackupCollections {
+		n, err := db.CloneCollection(database, name, a.document)
+		cloned[name] = n
+		if err != nil {
+			return cloned, fmt.Errorf("unable to clone %s: %s", name, err)
+		}
+	}
+
+	return cloned, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 Bowery, Inc.
+// Contains helpers for recording audit logs.
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/gorilla/mux"
+)
+
+// clientIP returns the address of the caller. X-Forwarded-For is only
+// trusted when TRUST_PROXY is set, since anyone can send it otherwise.
+// TRUST_PROXY is how many proxies sit in front of broome ("true" means one),
+// each appends the address it got the request from so the caller is that
+// many entries from the right. Anything further left was sent by the caller.
+func clientIP(req *http.Request) string {
+	if hops := proxyHops(); hops > 0 {
+		var entries []string
+		for _, fwd := range req.Header["X-Forwarded-For"] {
+			entries = append(entries, strings.Split(fwd, ",")...)
+		}
+		if len(entries) >= hops {
+			return strings.TrimSpace(entries[len(entries)-hops])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// proxyHops returns the number of trusted proxies set in TRUST_PROXY.
+func proxyHops() int {
+	trust := os.Getenv("TRUST_PROXY")
+	if trust == "" {
+		return 0
+	}
+	if hops, err := strconv.Atoi(trust); err == nil && hops >= 0 {
+		return hops
+	}
+
+	return 1
+}
+
+// audit records an action taken on req. Failures are only printed so they
+// never block the request being audited.
+func audit(req *http.Request, action, actor, detail string) {
+	err := db.SaveAuditLog(&db.AuditLog{
+		Action: action,
+		Actor:  actor,
+		IP:     clientIP(req),
+		Method: req.Method,
+		Path:   redactPath(req.URL.Path, mux.Vars(req)),
+		Detail: redactString(detail),
+	})
+	if err != nil {
+		fmt.Println("unable to save audit log", action, err)
+		return
+	}
+
+	go exportAuditLogs()
+}
@@ -0,0 +1,314 @@
+// Copyright 2014 Bowery, Inc.
+// Contains backfills, long running repairs of developer documents. A
+// backfill works through every developer in id order a chunk at a time,
+// checkpointing after each chunk so it picks up where it left off if the
+// instance running it goes away or it's paused and resumed. Runs are
+// limited to a rate of developers a second so they don't crowd out
+// requests, and can be dry runs that only count what they'd change.
+// Progress is at /admin/jobs.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Developers read and checkpointed at a time.
+	backfillChunk = 100
+
+	// Developers a second a backfill runs at unless it's given a rate.
+	defaultBackfillRate = 50
+	maxBackfillRate     = 1000
+
+	// How long a running backfill can go without a checkpoint before
+	// another instance takes it over.
+	backfillStale = 2 * time.Minute
+
+	// Backfills shown on the jobs page.
+	backfillPageLimit = 50
+)
+
+// backfill is a repair that can be run over every developer. Fix returns
+// the fields to set on a developer, nil if they're fine.
+type backfill struct {
+	Description string
+	Fix         func(doc bson.M) (bson.M, error)
+}
+
+var backfills = map[string]*backfill{
+	"normalize-emails": {
+		"Trims and lower cases emails, skipping any that would clash with another developer's.",
+		normalizeEmailBackfill,
+	},
+	"hash-tokens": {
+		"Stores the hash of each developer's token, for developers from before it was kept.",
+		hashTokenBackfill,
+	},
+	"fix-expiration-types": {
+		"Converts expirations stored as text or milliseconds to dates.",
+		fixExpirationBackfill,
+	},
+}
+
+func init() {
+	schedule("backfills", time.Minute, runBackfills)
+}
+
+func normalizeEmailBackfill(doc bson.M) (bson.M, error) {
+	email, _ := doc["email"].(string)
+	normalized := strings.ToLower(strings.TrimSpace(email))
+	if normalized == email || normalized == "" {
+		return nil, nil
+	}
+
+	if _, err := db.GetDeveloper(bson.M{"email": normalized, "_id": bson.M{"$ne": doc["_id"]}}); err != db.ErrNotFound {
+		if err == nil {
+			err = errors.New(normalized + " is already used by another developer")
+		}
+		return nil, err
+	}
+	return bson.M{"email": normalized}, nil
+}
+
+func hashTokenBackfill(doc bson.M) (bson.M, error) {
+	token, _ := doc["token"].(string)
+	if token == "" {
+		return nil, nil
+	}
+
+	hash := db.TokenHash(token)
+	if existing, _ := doc["tokenHash"].(string); existing == hash {
+		return nil, nil
+	}
+	return bson.M{"tokenHash": hash}, nil
+}
+
+func fixExpirationBackfill(doc bson.M) (bson.M, error) {
+	switch v := doc["expiration"].(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("expiration %q isn't a date", v)
+		}
+		return bson.M{"expiration": t}, nil
+	case int64:
+		return bson.M{"expiration": time.Unix(0, v*int64(time.Millisecond))}, nil
+	case float64:
+		return bson.M{"expiration": time.Unix(0, int64(v)*int64(time.Millisecond))}, nil
+	}
+
+	return nil, nil
+}
+
+// runBackfills runs a backfill that's waiting or was left by an instance
+// that stopped. It's started in the background so one long backfill
+// doesn't hold up the scheduler.
+func runBackfills() error {
+	b, err := db.ClaimBackfill(instanceID, time.Now().Add(-backfillStale))
+	if err == db.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := runBackfill(b); err != nil {
+			fmt.Println("backfill", b.Name, b.ID.Hex(), "failed:", err)
+
+			// Failed backfills wait for a retry from the jobs page.
+			b.LastError = err.Error()
+			if err := db.CheckpointBackfill(b, instanceID); err == nil {
+				db.SetBackfillStatus(b.ID, []string{db.BackfillRunning}, db.BackfillFailed)
+			}
+		}
+	}()
+	return nil
+}
+
+// runBackfill works through the developers after a backfill's checkpoint
+// until there are none left, or it's paused.
+func runBackfill(b *db.Backfill) error {
+	bf, ok := backfills[b.Name]
+	if !ok {
+		return errors.New("unknown backfill " + b.Name)
+	}
+	if b.Total == 0 {
+		total, err := db.CountDevelopers(bson.M{})
+		if err != nil {
+			return err
+		}
+		b.Total = total
+	}
+	rate := b.Rate
+	if rate <= 0 {
+		rate = defaultBackfillRate
+	}
+
+	for {
+		start := time.Now()
+		docs, err := db.GetDeveloperDocumentsAfter(b.Checkpoint, backfillChunk)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return db.SetBackfillStatus(b.ID, []string{db.BackfillRunning}, db.BackfillDone)
+		}
+
+		for _, doc := range docs {
+			id, _ := doc["_id"].(bson.ObjectId)
+			set, err := bf.Fix(doc)
+			if err == nil && set != nil && !b.DryRun {
+				err = db.UpdateDeveloper(bson.M{"_id": id}, set)
+			}
+			if err != nil {
+				b.Errors++
+				b.LastError = id.Hex() + ": " + err.Error()
+			} else if set != nil {
+				b.Changed++
+			}
+			b.Processed++
+			b.Checkpoint = id
+		}
+
+		err = db.CheckpointBackfill(b, instanceID)
+		if err == db.ErrConflict {
+			// Paused, or taken over after a checkpoint was missed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if wait := time.Duration(len(docs))*time.Second/time.Duration(rate) - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// backfillFromRoute returns the backfill with the id in the route.
+func backfillFromRoute(req *http.Request) (*db.Backfill, error) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		return nil, db.ErrNotFound
+	}
+
+	return db.GetBackfill(bson.ObjectIdHex(id))
+}
+
+// GET /admin/jobs/backfills/{id}, Shows a backfill's progress
+func BackfillHandler(rw http.ResponseWriter, req *http.Request) {
+	b, err := backfillFromRoute(req)
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"backfill": b,
+	})
+}
+
+// POST /admin/jobs/backfills, Starts a backfill, e.g. {"name": "normalize-emails", "dryRun": true, "rate": 50}
+func StartBackfillHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name   string `json:"name"`
+		DryRun bool   `json:"dryRun"`
+		Rate   int    `json:"rate"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if _, ok := backfills[body.Name]; err == nil && !ok {
+		err = errors.New("unknown backfill " + body.Name)
+	}
+	if err == nil && (body.Rate < 0 || body.Rate > maxBackfillRate) {
+		err = fmt.Errorf("rate must be between 1 and %d developers a second", maxBackfillRate)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	b := &db.Backfill{Name: body.Name, DryRun: body.DryRun, Rate: body.Rate, StartedBy: actor}
+	if err := db.SaveBackfill(b); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	detail := b.Name
+	if b.DryRun {
+		detail += " (dry run)"
+	}
+	audit(req, "backfill.started", actor, detail)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusCreated,
+		"backfill": b,
+	})
+}
+
+// POST /admin/jobs/backfills/{id}/pause, Pauses a backfill after its current chunk
+func PauseBackfillHandler(rw http.ResponseWriter, req *http.Request) {
+	setBackfillStatus(rw, req, []string{db.BackfillPending, db.BackfillRunning}, db.BackfillPaused, "backfill.paused")
+}
+
+// POST /admin/jobs/backfills/{id}/resume, Resumes a paused backfill from its checkpoint
+func ResumeBackfillHandler(rw http.ResponseWriter, req *http.Request) {
+	setBackfillStatus(rw, req, []string{db.BackfillPaused}, db.BackfillPending, "backfill.resumed")
+}
+
+// setBackfillStatus moves the backfill in the route from one of from to
+// status, auditing it as action.
+func setBackfillStatus(rw http.ResponseWriter, req *http.Request, from []string, status, action string) {
+	b, err := backfillFromRoute(req)
+	if err == nil {
+		err = db.SetBackfillStatus(b.ID, from, status)
+	}
+	if err == db.ErrConflict {
+		err = fmt.Errorf("backfill is %s, it must be %s", b.Status, strings.Join(from, " or "))
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, action, actor, b.Name+" "+b.ID.Hex())
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
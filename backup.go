@@ -0,0 +1,398 @@
+// Copyright 2014 Bowery, Inc.
+// Contains backups of the developer database. Each backup is a gzipped tar
+// of the collections as BSON with a manifest of their counts and checksums,
+// encrypted with BACKUP_KEY and uploaded to S3. Backups are downloaded and
+// checked against the manifest after upload, and again before a restore.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Backups kept unless BACKUP_KEEP says otherwise.
+	defaultBackupKeep = 14
+
+	// Backups shown on the admin page.
+	backupPageLimit = 60
+
+	backupPrefix   = "broome/"
+	backupManifest = "manifest.json"
+)
+
+// backupMagic starts every encrypted archive so a wrong file is caught
+// before decrypting.
+var backupMagic = []byte("BRB1")
+
+var (
+	backupBucket = os.Getenv("BACKUP_BUCKET")
+	backupRegion = os.Getenv("BACKUP_REGION")
+	backupKey    = os.Getenv("BACKUP_KEY")
+)
+
+func init() {
+	scheduleDaily("backup", 2, func() error {
+		if backupBucket == "" {
+			return nil
+		}
+
+		_, err := runBackup()
+		return err
+	})
+}
+
+// backupManifestEntry is a collection in an archive.
+type backupManifestEntry struct {
+	Count  int    `json:"count"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupArchiveManifest describes an archive's collections.
+type backupArchiveManifest struct {
+	CreatedAt   time.Time                       `json:"createdAt"`
+	Collections map[string]*backupManifestEntry `json:"collections"`
+}
+
+// backupCipher returns the AES-GCM cipher for BACKUP_KEY, 32 bytes encoded
+// as base64.
+func backupCipher() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(backupKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("BACKUP_KEY must be 32 bytes encoded as base64")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptBackup seals an archive, prefixed by the magic and nonce.
+func encryptBackup(gcm cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append(append([]byte{}, backupMagic...), nonce...)
+	return gcm.Seal(out, nonce, plain, backupMagic), nil
+}
+
+// decryptBackup opens an archive sealed by encryptBackup, failing if it was
+// changed or sealed with another key.
+func decryptBackup(gcm cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < len(backupMagic)+gcm.NonceSize() || !bytes.Equal(data[:len(backupMagic)], backupMagic) {
+		return nil, errors.New("not a broome backup")
+	}
+	data = data[len(backupMagic):]
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], backupMagic)
+}
+
+// writeBackupArchive writes a gzipped tar of the collections, dumped by
+// dump, followed by their manifest.
+func writeBackupArchive(w io.Writer, collections []string, dump func(string, io.Writer) (int, error)) (*backupArchiveManifest, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	m := &backupArchiveManifest{CreatedAt: time.Now(), Collections: map[string]*backupManifestEntry{}}
+
+	add := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: m.CreatedAt})
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		return err
+	}
+
+	for _, name := range collections {
+		var buf bytes.Buffer
+		n, err := dump(name, &buf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to dump %s: %s", name, err)
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		m.Collections[name] = &backupManifestEntry{Count: n, SHA256: hex.EncodeToString(sum[:])}
+
+		if err := add(name+".bson", buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := json.Marshal(m)
+	if err == nil {
+		err = add(backupManifest, manifest)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return m, err
+}
+
+// readBackupArchive reads an archive's collections and checks each against
+// its manifest.
+func readBackupArchive(r io.Reader) (*backupArchiveManifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	var m *backupArchiveManifest
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if hdr.Name == backupManifest {
+			m = &backupArchiveManifest{}
+			if err := json.Unmarshal(data, m); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		files[strings.TrimSuffix(hdr.Name, ".bson")] = data
+	}
+	if m == nil {
+		return nil, nil, errors.New("archive has no manifest")
+	}
+
+	for name, entry := range m.Collections {
+		data, ok := files[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("archive is missing %s", name)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return nil, nil, fmt.Errorf("%s doesn't match its checksum", name)
+		}
+	}
+
+	return m, files, nil
+}
+
+// backupBucketFor returns the S3 bucket backups are kept in, with the
+// credentials from the environment.
+func backupBucketFor() (*s3.Bucket, error) {
+	if backupBucket == "" {
+		return nil, errors.New("BACKUP_BUCKET isn't set")
+	}
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		return nil, err
+	}
+	region, ok := aws.Regions[backupRegion]
+	if !ok {
+		region = aws.USEast
+	}
+
+	return s3.New(auth, region).Bucket(backupBucket), nil
+}
+
+// downloadBackup fetches and decrypts an archive, checking it against its
+// manifest.
+func downloadBackup(key string) (*backupArchiveManifest, map[string][]byte, error) {
+	gcm, err := backupCipher()
+	if err != nil {
+		return nil, nil, err
+	}
+	bucket, err := backupBucketFor()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := bucket.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := decryptBackup(gcm, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return readBackupArchive(bytes.NewReader(plain))
+}
+
+// runBackup dumps the collections to a new archive on S3, verifies it can
+// be downloaded and read back, then rotates out old backups.
+func runBackup() (*db.Backup, error) {
+	b := &db.Backup{ID: bson.NewObjectId(), CreatedAt: time.Now()}
+	b.Key = backupPrefix + b.CreatedAt.UTC().Format("20060102T150405Z") + ".tar.gz.enc"
+
+	err := func() error {
+		gcm, err := backupCipher()
+		if err != nil {
+			return err
+		}
+		bucket, err := backupBucketFor()
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		m, err := writeBackupArchive(&buf, db.BackupCollections, db.DumpCollection)
+		if err != nil {
+			return err
+		}
+		data, err := encryptBackup(gcm, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(b.Key, data, "application/octet-stream", s3.Private); err != nil {
+			return err
+		}
+
+		b.Size = len(data)
+		b.Collections = map[string]int{}
+		for name, entry := range m.Collections {
+			b.Collections[name] = entry.Count
+		}
+		b.Status = db.BackupCompleted
+		if err := db.SaveBackup(b); err != nil {
+			return err
+		}
+
+		if _, _, err := downloadBackup(b.Key); err != nil {
+			return fmt.Errorf("uploaded backup didn't verify: %s", err)
+		}
+		b.Status = db.BackupVerified
+		b.VerifiedAt = time.Now()
+		return db.SaveBackup(b)
+	}()
+	if err != nil {
+		b.Status = db.BackupFailed
+		b.Error = err.Error()
+		db.SaveBackup(b)
+		notifySlack(slackChannel("activity"), "Backup "+b.Key+" failed: "+err.Error())
+		return b, err
+	}
+
+	if err := rotateBackups(); err != nil {
+		fmt.Println("unable to rotate backups", err)
+	}
+	return b, nil
+}
+
+// backupKeep returns how many verified backups are kept.
+func backupKeep() int {
+	if keep, err := strconv.Atoi(os.Getenv("BACKUP_KEEP")); err == nil && keep > 0 {
+		return keep
+	}
+
+	return defaultBackupKeep
+}
+
+// rotateBackups deletes verified backups past the newest backupKeep, so a
+// run of failures never rotates out the last good backup.
+func rotateBackups() error {
+	bs, err := db.GetBackups(bson.M{"status": db.BackupVerified}, 0)
+	if err != nil || len(bs) <= backupKeep() {
+		return err
+	}
+	bucket, err := backupBucketFor()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range bs[backupKeep():] {
+		if err := bucket.Del(b.Key); err != nil {
+			return err
+		}
+		b.Status = db.BackupRotated
+		if err := db.SaveBackup(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreBackup restores an archive into an empty database, then checks
+// each collection has the documents the manifest says it should. The live
+// database is never restored into, so a restore can be checked before it's
+// switched to.
+func restoreBackup(key, database string) (map[string]int, error) {
+	if database == "" || database == db.Client.Db.Name {
+		return nil, errors.New("restore into a new database, not " + db.Client.Db.Name)
+	}
+
+	m, files, err := downloadBackup(key)
+	if err != nil {
+		return nil, err
+	}
+	for name := range m.Collections {
+		if n, err := db.CountCollection(database, name); err != nil || n > 0 {
+			if err == nil {
+				err = fmt.Errorf("%s.%s isn't empty", database, name)
+			}
+			return nil, err
+		}
+	}
+
+	restored := map[string]int{}
+	for name, entry := range m.Collections {
+		if _, err := db.RestoreCollection(database, name, bytes.NewReader(files[name])); err != nil {
+			return restored, fmt.Errorf("unable to restore %s: %s", name, err)
+		}
+
+		n, err := db.CountCollection(database, name)
+		if err != nil {
+			return restored, err
+		}
+		restored[name] = n
+		if n != entry.Count {
+			return restored, fmt.Errorf("restored %d of %d %s", n, entry.Count, name)
+		}
+	}
+
+	return restored, nil
+}
+
+// GET /admin/backups, Shows recent backups and whether they verified
+func BackupsHandler(rw http.ResponseWriter, req *http.Request) {
+	bs, err := db.GetBackups(nil, backupPageLimit)
+	if err == nil {
+		err = RenderAdminTemplate(rw, "backups", map[string]interface{}{
+			"Backups":    bs,
+			"Configured": backupBucket != "",
+			"Keep":       backupKeep(),
+		})
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
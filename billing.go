@@ -0,0 +1,535 @@
+// Copyright 2014 Bowery, Inc.
+// Contains billing addresses, PO numbers and invoice memos, collected when a
+// developer pays and printed on their invoices and receipts. Organizations
+// billed together keep them on the organization. Billing emails can go to a
+// contact other than the developer, like an accounts payable inbox.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// postalCodes are the formats checked for countries we bill often, other
+// countries only need a postal code.
+var postalCodes = map[string]*regexp.Regexp{
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"AU": regexp.MustCompile(`^\d{4}$`),
+}
+
+var countryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Limits on invoice details, to keep them on one invoice line.
+const (
+	maxPONumber    = 64
+	maxInvoiceMemo = 500
+)
+
+// validateBillingAddress normalizes an address and checks it has what an
+// invoice needs.
+func validateBillingAddress(a *db.BillingAddress) error {
+	if a == nil {
+		return errors.New("Billing address Required.")
+	}
+	a.Line1 = strings.TrimSpace(a.Line1)
+	a.Line2 = strings.TrimSpace(a.Line2)
+	a.City = strings.TrimSpace(a.City)
+	a.State = strings.TrimSpace(a.State)
+	a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+
+	if a.Line1 == "" || a.City == "" || a.PostalCode == "" || a.Country == "" {
+		return errors.New("Address line 1, city, postal code and country Required.")
+	}
+	if !countryCode.MatchString(a.Country) {
+		return errors.New("Country must be a two letter code, e.g. US.")
+	}
+	if re, ok := postalCodes[a.Country]; ok && !re.MatchString(a.PostalCode) {
+		return errors.New("Invalid postal code for " + a.Country + ".")
+	}
+
+	return nil
+}
+
+// validateInvoiceDetails trims a PO number and memo and checks they fit.
+func validateInvoiceDetails(i *db.InvoiceDetails) error {
+	i.PONumber = strings.TrimSpace(i.PONumber)
+	i.Memo = strings.TrimSpace(i.Memo)
+
+	if len(i.PONumber) > maxPONumber {
+		return fmt.Errorf("PO numbers are at most %d characters.", maxPONumber)
+	}
+	if len(i.Memo) > maxInvoiceMemo {
+		return fmt.Errorf("Invoice memos are at most %d characters.", maxInvoiceMemo)
+	}
+
+	return nil
+}
+
+// validateBillingContact checks the contact's email address.
+func validateBillingContact(c *db.BillingContact) error {
+	c.Email = strings.TrimSpace(c.Email)
+	c.Name = strings.TrimSpace(c.Name)
+
+	addr, err := mail.ParseAddress(c.Email)
+	if err != nil || addr.Address != c.Email {
+		return errors.New("Invalid billing contact email.")
+	}
+
+	return nil
+}
+
+// billingRecipients returns who a developer's billing emails go to.
+func billingRecipients(d *schemas.Developer) ([]gochimp.Recipient, error) {
+	developer := gochimp.Recipient{Email: d.Email, Name: d.Name}
+
+	c, err := db.GetBillingContact(d.ID)
+	if err != nil || c == nil {
+		return []gochimp.Recipient{developer}, err
+	}
+
+	to := []gochimp.Recipient{{Email: c.Email, Name: c.Name}}
+	if c.CC && !strings.EqualFold(c.Email, d.Email) {
+		to = append(to, developer)
+	}
+
+	return to, nil
+}
+
+// billingFor returns what's printed on a developer's invoices. An
+// organization's address and details take precedence over the developer's.
+func billingFor(d *schemas.Developer, org *db.Organization) (*db.BillingAddress, *db.InvoiceDetails, error) {
+	address, err := db.GetBillingAddress(d.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	details, err := db.GetInvoiceDetails(d.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if org == nil {
+		return address, details, nil
+	}
+
+	if org.Billing != nil {
+		address = org.Billing
+	}
+	if org.Invoice.PONumber != "" {
+		details.PONumber = org.Invoice.PONumber
+	}
+	if org.Invoice.Memo != "" {
+		details.Memo = org.Invoice.Memo
+	}
+
+	return address, details, nil
+}
+
+// addressParams adds an address to Stripe params under prefix, e.g.
+// "address" or "payment_method_data[billing_details][address]".
+func addressParams(params url.Values, prefix string, a *db.BillingAddress) {
+	if a == nil {
+		return
+	}
+
+	params.Set(prefix+"[line1]", a.Line1)
+	params.Set(prefix+"[line2]", a.Line2)
+	params.Set(prefix+"[city]", a.City)
+	params.Set(prefix+"[state]", a.State)
+	params.Set(prefix+"[postal_code]", a.PostalCode)
+	params.Set(prefix+"[country]", a.Country)
+}
+
+// stripeAddress is an address as Stripe returns it.
+type stripeAddress struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
+// billingAddress converts a Stripe address, nil if Stripe didn't collect one.
+func (s *stripeAddress) billingAddress() *db.BillingAddress {
+	if s == nil || s.Line1 == "" {
+		return nil
+	}
+
+	return &db.BillingAddress{
+		Line1:      s.Line1,
+		Line2:      s.Line2,
+		City:       s.City,
+		State:      s.State,
+		PostalCode: s.PostalCode,
+		Country:    s.Country,
+	}
+}
+
+// saveBillingAddress validates and stores a developer's address.
+func saveBillingAddress(developerID bson.ObjectId, a *db.BillingAddress) error {
+	if err := validateBillingAddress(a); err != nil {
+		return err
+	}
+
+	return db.SetBillingAddress(developerID, a)
+}
+
+// notifyReceipt sends the developer a receipt for a settled payment.
+func notifyReceipt(d *schemas.Developer, p *db.Payment, plan *db.Plan) error {
+	address, details, err := billingFor(d, nil)
+	if err != nil {
+		return err
+	}
+
+	message, err := RenderEmail("receipt_email", map[string]interface{}{
+		"name":    strings.Split(d.Name, " ")[0],
+		"payment": p,
+		"plan":    plan,
+		"address": address,
+		"details": details,
+	})
+	if err != nil {
+		return err
+	}
+
+	to, err := billingRecipients(d)
+	if err != nil {
+		return err
+	}
+
+	_, err = dispatchNotice(d, &notice{
+		Kind: noticePaymentReceipt,
+		Key:  notificationKey("payment.receipt", p.ID),
+		Email: gochimp.Message{
+			Subject:   "Your Bowery receipt",
+			FromEmail: "support@bowery.io",
+			FromName:  "Bowery Support",
+			To:        to,
+			Html:      message,
+		},
+		Text: "Your Bowery payment of " + formatCurrency(p.Amount, p.Currency) + " for " + plan.Name + " went through.",
+		Data: map[string]interface{}{"payment": p},
+	})
+	return err
+}
+
+// GET /developers/{token}/billing-address, Gets the address printed on invoices
+func GetBillingAddressHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	a, err := db.GetBillingAddress(d.ID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":         requests.StatusFound,
+		"billingAddress": a,
+	})
+}
+
+// PUT /developers/{token}/billing-address, Updates the address printed on invoices
+func UpdateBillingAddressHandler(rw http.ResponseWriter, req *http.Request) {
+	var body db.BillingAddress
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := validateBillingAddress(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := db.SetBillingAddress(d.ID, &body); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	track("billing.address", d, map[string]interface{}{"country": body.Country})
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":         requests.StatusUpdated,
+		"billingAddress": body,
+	})
+}
+
+// GET /developers/{token}/invoice-details, Gets the PO number and memo printed on invoices
+func GetInvoiceDetailsHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	details, err := db.GetInvoiceDetails(d.ID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":         requests.StatusFound,
+		"invoiceDetails": details,
+	})
+}
+
+// PUT /developers/{token}/invoice-details, Updates the PO number and memo printed on invoices
+func UpdateInvoiceDetailsHandler(rw http.ResponseWriter, req *http.Request) {
+	var body db.InvoiceDetails
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateInvoiceDetails(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := db.SetInvoiceDetails(d.ID, &body); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":         requests.StatusUpdated,
+		"invoiceDetails": body,
+	})
+}
+
+// GET /developers/{token}/billing-contact, Gets who receives billing emails
+func GetBillingContactHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c, err := db.GetBillingContact(d.ID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":         requests.StatusFound,
+		"billingContact": c,
+	})
+}
+
+// PUT /developers/{token}/billing-contact, Sends billing emails to another address
+func UpdateBillingContactHandler(rw http.ResponseWriter, req *http.Request) {
+	var body db.BillingContact
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateBillingContact(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := db.SetBillingContact(d.ID, &body); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	track("billing.contact", d, map[string]interface{}{"cc": body.CC})
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":         requests.StatusUpdated,
+		"billingContact": body,
+	})
+}
+
+// DELETE /developers/{token}/billing-contact, Sends billing emails back to the developer
+func DeleteBillingContactHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := db.SetBillingContact(d.ID, nil); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// PUT /admin/organizations/{slug}/billing-address, Updates the address on an organization's invoices
+func UpdateOrganizationBillingHandler(rw http.ResponseWriter, req *http.Request) {
+	slug := mux.Vars(req)["slug"]
+
+	var body db.BillingAddress
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateBillingAddress(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	err := db.SetOrganizationBillingAddress(slug, &body)
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "organization.billing", actor, slug+" "+body.Country)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":         requests.StatusUpdated,
+		"billingAddress": body,
+	})
+}
+
+// GET /payments/{token}/{id}/invoice, Shows the invoice for a payment
+func InvoiceHandler(rw http.ResponseWriter, req *http.Request) {
+	d, p, err := paymentFor(req)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	if p.Status != db.PaymentSucceeded {
+		RenderTemplate(rw, "error", map[string]string{"Error": "Invoices are available once a payment has settled."})
+		return
+	}
+
+	// Developers on an organization's domain are billed to the organization.
+	org := orgFor(req)
+	address, details, err := billingFor(d, org)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	plan, err := db.GetPlan(p.Plan)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	RenderTemplate(rw, "invoice", map[string]interface{}{
+		"developer": d,
+		"payment":   p,
+		"plan":      plan,
+		"address":   address,
+		"details":   details,
+		"org":       org,
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 Bowery, Inc.
+// Contains loading the keys the billing store is encrypted with. In
+// production they're data keys wrapped by AWS KMS, BILLING_DATA_KEY, which
+// are unwrapped once at startup so the plain keys are only ever in memory.
+// Elsewhere BILLING_KEY can hold plain keys instead.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/env"
+	"github.com/mitchellh/goamz/aws"
+)
+
+var (
+	billingDataKey   = os.Getenv("BILLING_DATA_KEY")
+	billingKMSRegion = os.Getenv("BILLING_KMS_REGION")
+	billingPlainKey  = os.Getenv("BILLING_KEY")
+
+	kmsHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// loadBillingKey sets the billing store's keys from the environment.
+// Either variable can list keys newest first, the first seals and the rest
+// open accounts until rotate-keys reseals them. Without one the store can't
+// be read or written, which is only allowed outside production.
+func loadBillingKey() error {
+	keys, plain := billingDataKey, false
+	switch {
+	case billingDataKey != "":
+	case billingPlainKey != "" && !env.Current.Production:
+		keys, plain = billingPlainKey, true
+	case env.Current.Production:
+		return errors.New("BILLING_DATA_KEY must be set in production")
+	default:
+		fmt.Println("no billing key, cards can't be saved or charged")
+		return nil
+	}
+
+	current := ""
+	byID := map[string][]byte{}
+	for _, encoded := range splitKeys(keys) {
+		var wrapped, key []byte
+		var err error
+		if plain {
+			wrapped = []byte(encoded)
+			key, err = base64.StdEncoding.DecodeString(encoded)
+		} else {
+			wrapped, err = base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return errors.New("BILLING_DATA_KEY must be base64")
+			}
+			key, err = kmsDecrypt(wrapped)
+		}
+		if err != nil {
+			return err
+		}
+		if len(key) != 32 {
+			return errors.New("the billing key must be 32 bytes")
+		}
+
+		// Keys are known by the hash of their wrapped form, which is safe
+		// to store alongside what they seal.
+		sum := sha256.Sum256(wrapped)
+		id := hex.EncodeToString(sum[:8])
+		if current == "" {
+			current = id
+		}
+		byID[id] = key
+	}
+
+	return db.SetBillingKeys(current, byID)
+}
+
+// kmsDecrypt unwraps a data key with AWS KMS.
+func kmsDecrypt(wrapped []byte) ([]byte, error) {
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		return nil, err
+	}
+	region, ok := aws.Regions[billingKMSRegion]
+	if !ok {
+		region = aws.USEast
+	}
+
+	body, err := json.Marshal(map[string][]byte{"CiphertextBlob": wrapped})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", "https://kms."+region.Name+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	aws.NewV4Signer(auth, "kms", region).Sign(req)
+
+	res, err := kmsHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kms responded with %d: %s", res.StatusCode, data)
+	}
+
+	var out struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	return out.Plaintext, json.Unmarshal(data, &out)
+}
@@ -0,0 +1,215 @@
+// Copyright 2014 Bowery, Inc.
+// Contains bot detection for the public signup forms.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Hidden field real visitors never fill in.
+	honeypotField = "website"
+
+	// Humans take at least this long to fill in the form.
+	minFillTime = 3 * time.Second
+
+	// Form tokens older than this are rejected.
+	maxFormAge = 24 * time.Hour
+
+	// Status returned for signups held for review.
+	statusPending = "pending"
+)
+
+// formSecrets sign form tokens, read from FORM_SECRET so tokens survive
+// restarts and work across servers. The first signs, older ones are still
+// accepted until the tokens they signed are past maxFormAge.
+var formSecrets [][]byte
+
+func init() {
+	for _, secret := range splitKeys(os.Getenv("FORM_SECRET")) {
+		formSecrets = append(formSecrets, []byte(secret))
+	}
+
+	if len(formSecrets) == 0 {
+		// Tokens signed with a random secret fail on every other instance.
+		if os.Getenv("ENV") == "production" {
+			panic("FORM_SECRET must be set in production")
+		}
+
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+		formSecrets = [][]byte{secret}
+	}
+}
+
+// signupSignals are the bot detection fields sent with a signup.
+type signupSignals struct {
+	Honeypot  string
+	FormToken string
+}
+
+func formMAC(secret []byte, timestamp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newFormToken returns a token recording when the form was rendered.
+func newFormToken() string {
+	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return ts + "." + formMAC(formSecrets[0], ts)
+}
+
+// validFormMAC reports whether a form token's MAC was made with any of the
+// form secrets.
+func validFormMAC(timestamp, sig string) bool {
+	for _, secret := range formSecrets {
+		if hmac.Equal([]byte(sig), []byte(formMAC(secret, timestamp))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formTokenAge returns how long ago the token was issued.
+func formTokenAge(token string) (time.Duration, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !validFormMAC(parts[0], parts[1]) {
+		return 0, errors.New("invalid form token")
+	}
+
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(time.Unix(0, ts)), nil
+}
+
+// botReasons returns why a signup from a form looks automated, empty if it
+// doesn't. The CLI signs up at its own route and isn't checked.
+func botReasons(s *signupSignals) []string {
+	reasons := []string{}
+	if s.Honeypot != "" {
+		reasons = append(reasons, "honeypot filled")
+	}
+
+	age, err := formTokenAge(s.FormToken)
+	switch {
+	case err != nil:
+		reasons = append(reasons, "invalid form token")
+	case age < minFillTime:
+		reasons = append(reasons, "form filled too quickly")
+	case age > maxFormAge:
+		reasons = append(reasons, "form token expired")
+	}
+
+	return reasons
+}
+
+// quarantineSignup holds the developer for review and responds as pending.
+func quarantineSignup(rw http.ResponseWriter, req *http.Request, d *schemas.Developer, reasons []string) {
+	q := &db.QuarantinedSignup{
+		Developer: d,
+		Reasons:   reasons,
+		IP:        clientIP(req),
+	}
+	if err := db.QuarantineSignup(q); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	audit(req, "signup.quarantined", d.Email, strings.Join(reasons, ", "))
+	renderer.JSON(rw, http.StatusAccepted, map[string]string{
+		"status": statusPending,
+		"error":  "Your signup is pending review.",
+	})
+}
+
+// GET /admin/quarantine, Lists signups held for review
+func QuarantineHandler(rw http.ResponseWriter, req *http.Request) {
+	qs, err := db.GetQuarantinedSignups(bson.M{})
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"signups": qs,
+	})
+}
+
+// PUT /admin/quarantine/{id}/release, Creates a held developer
+func ReleaseSignupHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid signup id",
+		})
+		return
+	}
+
+	d, err := db.ReleaseSignup(bson.ObjectIdHex(id))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusCreated,
+		"developer": d,
+	})
+}
+
+// DELETE /admin/quarantine/{id}, Discards a held signup
+func DiscardSignupHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid signup id",
+		})
+		return
+	}
+
+	if err := db.DiscardSignup(bson.ObjectIdHex(id)); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 Bowery, Inc.
+// Contains a circuit breaker for calls to external services.
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// errBreakerOpen is returned instead of calling a service that's failing.
+var errBreakerOpen = errors.New("service unavailable")
+
+// circuitBreaker stops calling a service after it fails repeatedly, letting a
+// single trial call through once the cooldown has passed.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+	metrics  breakerMetrics
+}
+
+// breakerMetrics are running totals for a breaker since the server started.
+type breakerMetrics struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Calls    int64     `json:"calls"`
+	Failures int64     `json:"failures"`
+	Rejected int64     `json:"rejected"`
+	Trips    int64     `json:"trips"`
+	OpenedAt time.Time `json:"openedAt,omitempty"`
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether a call may be made now.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			b.metrics.Rejected++
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+	case breakerHalfOpen:
+		// Only the one trial call is let through.
+		if b.trial {
+			b.metrics.Rejected++
+			return false
+		}
+		b.trial = true
+	}
+
+	b.metrics.Calls++
+	return true
+}
+
+// record counts the outcome of a call allowed by allow.
+func (b *circuitBreaker) record(failed bool, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !failed {
+		b.state = breakerClosed
+		b.failures = 0
+		b.trial = false
+		return
+	}
+
+	b.failures++
+	b.metrics.Failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			b.metrics.Trips++
+		}
+		b.state = breakerOpen
+		b.openedAt = now
+		b.trial = false
+	}
+}
+
+// release gives back an allowed call that was never made, so a half open
+// breaker can let another trial through.
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.trial = false
+	}
+}
+
+// status returns the breaker's state and consecutive failures.
+func (b *circuitBreaker) status() (string, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state, b.failures
+}
+
+// snapshot returns the breaker's metrics.
+func (b *circuitBreaker) snapshot() breakerMetrics {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	m := b.metrics
+	m.Name = b.name
+	m.State = b.state
+	if b.state != breakerClosed {
+		m.OpenedAt = b.openedAt
+	}
+	return m
+}
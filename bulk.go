@@ -0,0 +1,332 @@
+// Copyright 2014 Bowery, Inc.
+// Contains bulk mutations of developers: CSV imports, plan migrations and
+// integration engineer rebalances. Each can be a dry run, which works out
+// exactly what would change and writes nothing. Either way the changes are
+// saved as a report that can be downloaded for review.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Most developers a bulk mutation can change, so a report fits in a
+// document.
+const maxBulkRows = 5000
+
+// bulkUpdate is the fields a bulk mutation sets on one developer, or why it
+// can't.
+type bulkUpdate struct {
+	Doc   bson.M
+	Email string
+	Set   bson.M
+	Error string
+}
+
+// bulkMutations work out the updates each kind of bulk mutation makes from
+// its request, and the params it was given for the report.
+var bulkMutations = map[string]func(req *http.Request) ([]*bulkUpdate, string, error){
+	"import":              planImport,
+	"plan-migration":      planPlanMigration,
+	"rebalance-engineers": planEngineerRebalance,
+}
+
+// bulkDocuments returns the developers matching the query, failing if
+// there are too many for one bulk mutation.
+func bulkDocuments(query bson.M) ([]bson.M, error) {
+	docs, err := db.GetDeveloperDocuments(query, maxBulkRows+1)
+	if err == nil && len(docs) > maxBulkRows {
+		err = fmt.Errorf("more than %d developers match, narrow the mutation down", maxBulkRows)
+	}
+	return docs, err
+}
+
+// planImport updates developers matched by email from a CSV. The first
+// column is the email and the others are named by the header after the
+// fields that can be edited inline. Empty cells are left as they are.
+func planImport(req *http.Request) ([]*bulkUpdate, string, error) {
+	r := csv.NewReader(req.Body)
+	header, err := r.Read()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(header) < 2 || strings.TrimSpace(header[0]) != "email" {
+		return nil, "", errors.New("the first column must be email, followed by the fields to set")
+	}
+	fields := []*developerField{}
+	for _, name := range header[1:] {
+		name = strings.TrimSpace(name)
+		field, ok := developerFields[name]
+		if !ok || name == "email" {
+			return nil, "", fmt.Errorf("can't import %q", name)
+		}
+		fields = append(fields, field)
+	}
+
+	updates := []*bulkUpdate{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if len(updates) == maxBulkRows {
+			return nil, "", fmt.Errorf("imports are limited to %d rows", maxBulkRows)
+		}
+
+		u := &bulkUpdate{Email: strings.ToLower(strings.TrimSpace(record[0])), Set: bson.M{}}
+		updates = append(updates, u)
+		for i, field := range fields {
+			if strings.TrimSpace(record[i+1]) == "" {
+				continue
+			}
+			value, err := field.Parse(record[i+1])
+			if err != nil {
+				u.Error = header[i+1] + " " + err.Error()
+				break
+			}
+			u.Set[field.Key] = value
+		}
+		if u.Error != "" {
+			continue
+		}
+
+		docs, err := db.GetDeveloperDocuments(bson.M{"email": u.Email}, 1)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(docs) == 0 {
+			u.Error = "no developer with this email"
+			continue
+		}
+		u.Doc = docs[0]
+	}
+
+	return updates, strings.Join(header, ","), nil
+}
+
+// planPlanMigration moves the developers on one plan to another.
+func planPlanMigration(req *http.Request) ([]*bulkUpdate, string, error) {
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, "", err
+	}
+	if body.From == "" || body.To == "" || body.From == body.To {
+		return nil, "", errors.New("from and to must be different plans")
+	}
+	if _, err := db.GetPlan(body.To); err != nil {
+		return nil, "", errors.New("no plan " + body.To)
+	}
+
+	docs, err := bulkDocuments(bson.M{"plan": body.From})
+	if err != nil {
+		return nil, "", err
+	}
+	updates := []*bulkUpdate{}
+	for _, doc := range docs {
+		updates = append(updates, &bulkUpdate{Doc: doc, Set: bson.M{"plan": body.To}})
+	}
+
+	return updates, body.From + " to " + body.To, nil
+}
+
+// planEngineerRebalance spreads an integration engineer's developers
+// evenly over other engineers, oldest developer first.
+func planEngineerRebalance(req *http.Request) ([]*bulkUpdate, string, error) {
+	var body struct {
+		From string   `json:"from"`
+		To   []string `json:"to"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, "", err
+	}
+	if body.From == "" || len(body.To) == 0 {
+		return nil, "", errors.New("from and to are required")
+	}
+	for _, name := range body.To {
+		if name == body.From || strings.TrimSpace(name) == "" {
+			return nil, "", errors.New("to must be other engineers")
+		}
+	}
+
+	docs, err := bulkDocuments(bson.M{"integrationEngineer": body.From})
+	if err != nil {
+		return nil, "", err
+	}
+	updates := []*bulkUpdate{}
+	for i, doc := range docs {
+		updates = append(updates, &bulkUpdate{
+			Doc: doc,
+			Set: bson.M{"integrationEngineer": body.To[i%len(body.To)]},
+		})
+	}
+
+	return updates, body.From + " to " + strings.Join(body.To, ", "), nil
+}
+
+// withFields returns a copy of doc with the fields set, dotted fields set
+// in nested documents.
+func withFields(doc, set bson.M) bson.M {
+	out := bson.M{}
+	for key, value := range doc {
+		out[key] = value
+	}
+
+	for field, value := range set {
+		parts := strings.SplitN(field, ".", 2)
+		if len(parts) == 1 {
+			out[field] = value
+			continue
+		}
+
+		nested, _ := out[parts[0]].(bson.M)
+		out[parts[0]] = withFields(nested, bson.M{parts[1]: value})
+	}
+
+	return out
+}
+
+// runBulk works out each update's changes and, unless it's a dry run,
+// makes them. Updates that change nothing are left out of the report.
+func runBulk(report *db.BulkReport, updates []*bulkUpdate) {
+	report.Rows = []*db.BulkRow{}
+	for _, u := range updates {
+		row := &db.BulkRow{Email: u.Email, Changes: []*db.FieldChange{}, Error: u.Error}
+		if u.Doc != nil {
+			row.DeveloperID, _ = u.Doc["_id"].(bson.ObjectId)
+			row.Email, _ = u.Doc["email"].(string)
+			row.Changes = diffDocuments(u.Doc, withFields(u.Doc, u.Set))
+			report.Matched++
+		}
+		if row.Error == "" && len(row.Changes) == 0 {
+			continue
+		}
+
+		if row.Error == "" && !report.DryRun {
+			if err := db.UpdateDeveloper(bson.M{"_id": row.DeveloperID}, u.Set); err != nil {
+				row.Error = err.Error()
+			} else if token, ok := u.Doc["token"].(string); ok {
+				entitlements.invalidate(token)
+			}
+		}
+		if row.Error != "" {
+			report.Failed++
+		} else {
+			report.Changed++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+}
+
+// POST /admin/bulk/{mutation}, Runs a bulk mutation, or with ?dryRun=true reports what it would change without writing
+func BulkHandler(rw http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["mutation"]
+	plan, ok := bulkMutations[name]
+	if !ok {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "unknown bulk mutation " + name,
+		})
+		return
+	}
+
+	report := &db.BulkReport{Mutation: name, DryRun: req.URL.Query().Get("dryRun") == "true"}
+	updates, params, err := plan(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	report.Params = params
+	if dev, err := currentDeveloper(req); err == nil {
+		report.CreatedBy = dev.Email
+	}
+
+	runBulk(report, updates)
+	if err := db.SaveBulkReport(report); err != nil {
+		fmt.Println("unable to save bulk report", name, err)
+	}
+	if !report.DryRun {
+		audit(req, "bulk."+name, report.CreatedBy, fmt.Sprintf("%s: %d changed, %d failed, report %s",
+			params, report.Changed, report.Failed, report.ID.Hex()))
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusSuccess,
+		"report": report,
+		"url":    "/admin/bulk/reports/" + report.ID.Hex() + "?format=csv",
+	})
+}
+
+// GET /admin/bulk/reports/{id}, Shows a bulk mutation's report, as a CSV download with format=csv
+func BulkReportHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	var report *db.BulkReport
+	err := error(db.ErrNotFound)
+	if bson.IsObjectIdHex(id) {
+		report, err = db.GetBulkReport(bson.ObjectIdHex(id))
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if req.FormValue("format") != "csv" {
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status": requests.StatusFound,
+			"report": report,
+		})
+		return
+	}
+
+	kind := "run"
+	if report.DryRun {
+		kind = "dry-run"
+	}
+	rw.Header().Set("Content-Type", "text/csv")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		report.Mutation+"-"+kind+"-"+report.CreatedAt.UTC().Format("20060102T150405Z")+".csv"))
+	writeBulkReportCSV(rw, report)
+}
+
+// writeBulkReportCSV writes a line for each field a report changed, and one
+// for each developer that failed.
+func writeBulkReportCSV(w io.Writer, report *db.BulkReport) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"developer id", "email", "field", "from", "to", "error"})
+	for _, row := range report.Rows {
+		id := ""
+		if row.DeveloperID != "" {
+			id = row.DeveloperID.Hex()
+		}
+		if row.Error != "" || len(row.Changes) == 0 {
+			cw.Write([]string{id, row.Email, "", "", "", row.Error})
+			continue
+		}
+
+		for _, c := range row.Changes {
+			cw.Write([]string{id, row.Email, c.Field, c.From, c.To, ""})
+		}
+	}
+	cw.Flush()
+}
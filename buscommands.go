@@ -0,0 +1,377 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the consumer of commands other services send over the message
+// bus, for account operations they'd otherwise make one HTTP call at a
+// time. Every instance consumes, NATS spreading commands over a queue group
+// and RabbitMQ over a shared queue. Commands are kept by the id their
+// sender gives them so one delivered twice is only carried out once, and
+// the result of each is published as an event, the stored result again for
+// a repeat.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/nats-io/nats"
+	"github.com/streadway/amqp"
+	"labix.org/v2/mgo/bson"
+)
+
+// Bus command types.
+const (
+	commandExtendTrial  = "extend-trial"
+	commandDeactivate   = "deactivate"
+	commandGrantFeature = "grant-feature"
+)
+
+const (
+	// How long an instance has to carry out a command before another may
+	// take it over.
+	busCommandLease = 2 * time.Minute
+
+	// Queue, or NATS queue group, commands are shared over.
+	busCommandQueue = "broome.commands"
+
+	// Commands RabbitMQ hands an instance before it acks any.
+	busCommandPrefetch = 10
+
+	// Most days a trial can be extended by at once.
+	maxTrialExtension = 365
+)
+
+var (
+	consumer      commandConsumer
+	consumerMutex sync.Mutex
+)
+
+func init() {
+	scheduleEveryInstance("consume-commands", 30*time.Second, ensureCommandConsumer)
+}
+
+// busCommandMessage is a command as sent over the bus, e.g.
+// {"id": "...", "type": "extend-trial", "developerId": "...", "params": {"days": 14}}.
+type busCommandMessage struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	DeveloperID string `json:"developerId"`
+	RequestedBy string `json:"requestedBy"`
+	Params      struct {
+		Days    int       `json:"days"`
+		Reason  string    `json:"reason"`
+		Feature string    `json:"feature"`
+		Until   time.Time `json:"until"`
+	} `json:"params"`
+}
+
+// commandResult is the event published for a command's outcome.
+type commandResult struct {
+	ID          string                 `json:"id"`
+	CommandID   string                 `json:"commandId"`
+	Type        string                 `json:"type"`
+	Version     int                    `json:"version"`
+	Status      string                 `json:"status"`
+	DeveloperID string                 `json:"developerId,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	Result      map[string]interface{} `json:"result,omitempty"`
+}
+
+// commandHandlers carry out each type of command for a developer, returning
+// what changed.
+var commandHandlers = map[string]func(*schemas.Developer, *busCommandMessage) (map[string]interface{}, error){
+	commandExtendTrial:  extendTrial,
+	commandDeactivate:   deactivateDeveloper,
+	commandGrantFeature: grantFeature,
+}
+
+// extendTrial moves a developer's expiration out by days, from now if it's
+// already passed.
+func extendTrial(d *schemas.Developer, c *busCommandMessage) (map[string]interface{}, error) {
+	if c.Params.Days < 1 || c.Params.Days > maxTrialExtension {
+		return nil, fmt.Errorf("days must be between 1 and %d", maxTrialExtension)
+	}
+	state, err := developerLifecycle(d)
+	if err != nil {
+		return nil, err
+	}
+	if state != db.LifecycleTrialing && !db.CanTransition(state, db.LifecycleTrialing) {
+		return nil, errors.New(state + " developers can't be put on a trial")
+	}
+
+	expiration := d.Expiration
+	if now := time.Now(); expiration.Before(now) {
+		expiration = now
+	}
+	expiration = expiration.AddDate(0, 0, c.Params.Days)
+	if err := transitionDeveloper(d, db.LifecycleTrialing, bson.M{"expiration": expiration}); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"expiration": expiration, "lifecycle": db.LifecycleTrialing}, nil
+}
+
+// deactivateDeveloper suspends a developer, until the time given if any.
+func deactivateDeveloper(d *schemas.Developer, c *busCommandMessage) (map[string]interface{}, error) {
+	reason := strings.TrimSpace(c.Params.Reason)
+	if reason == "" || len(reason) > maxSuspensionReason {
+		return nil, fmt.Errorf("reason required, up to %d characters", maxSuspensionReason)
+	}
+
+	sus := &db.Suspension{Reason: reason, Until: c.Params.Until, SuspendedBy: c.RequestedBy}
+	if err := db.SuspendDeveloper(d.ID, sus); err != nil {
+		return nil, err
+	}
+	suspended.set(d.Token, d.Email, sus)
+	entitlements.invalidate(d.Token)
+
+	return map[string]interface{}{"suspension": sus}, nil
+}
+
+// grantFeature turns a feature flag on for a developer, until the time
+// given if any.
+func grantFeature(d *schemas.Developer, c *busCommandMessage) (map[string]interface{}, error) {
+	feature := strings.TrimSpace(c.Params.Feature)
+	if feature == "" {
+		return nil, errors.New("feature required")
+	}
+
+	g := &db.FeatureGrant{DeveloperID: d.ID, Feature: feature, Until: c.Params.Until, GrantedBy: c.RequestedBy}
+	if err := db.GrantFeature(g); err != nil {
+		return nil, err
+	}
+	featureGrants.add(d.ID, feature)
+	entitlements.invalidate(d.Token)
+
+	return map[string]interface{}{"feature": feature, "until": g.Until}, nil
+}
+
+// newCommandResult returns the result event for a stored command.
+func newCommandResult(c *db.BusCommand) *commandResult {
+	res := &commandResult{
+		ID:        c.ID + ":result",
+		CommandID: c.ID,
+		Type:      c.Type,
+		Version:   developerEventVersion,
+		Status:    c.Status,
+		Error:     c.Error,
+		Result:    c.Result,
+	}
+	if c.DeveloperID != "" {
+		res.DeveloperID = c.DeveloperID.Hex()
+	}
+
+	return res
+}
+
+// processCommand carries out a command, returning its result. It returns
+// an error if the command should be delivered again, e.g. another instance
+// is carrying it out.
+func processCommand(subject string, body []byte) (*commandResult, error) {
+	msg := &busCommandMessage{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return &commandResult{Status: db.BusCommandFailed, Version: developerEventVersion, Error: err.Error()}, nil
+	}
+	if msg.ID == "" {
+		return &commandResult{Type: msg.Type, Status: db.BusCommandFailed, Version: developerEventVersion, Error: "id required"}, nil
+	}
+
+	c := &db.BusCommand{ID: msg.ID, Type: msg.Type}
+	if bson.IsObjectIdHex(msg.DeveloperID) {
+		c.DeveloperID = bson.ObjectIdHex(msg.DeveloperID)
+	}
+	c, claimed, err := db.ClaimBusCommand(c, instanceID, busCommandLease)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		if c.Status == db.BusCommandProcessing {
+			return nil, errors.New("command " + c.ID + " is being processed")
+		}
+		return newCommandResult(c), nil
+	}
+
+	handler, ok := commandHandlers[msg.Type]
+	var d *schemas.Developer
+	switch {
+	case !ok:
+		err = errors.New("unknown command " + msg.Type)
+	case c.DeveloperID == "":
+		err = errors.New("developerId required")
+	default:
+		d, err = db.GetDeveloper(bson.M{"_id": c.DeveloperID})
+		if err != nil && err != db.ErrNotFound {
+			// Let it be taken again when it's redelivered.
+			db.ReleaseBusCommand(c, instanceID)
+			return nil, err
+		}
+	}
+	if err == nil {
+		c.Result, err = handler(d, msg)
+	}
+
+	c.Status = db.BusCommandDone
+	if err != nil {
+		c.Status = db.BusCommandFailed
+		c.Error = err.Error()
+	}
+	if err := db.FinishBusCommand(c, instanceID); err != nil {
+		return nil, err
+	}
+
+	if c.Status == db.BusCommandDone {
+		aerr := db.SaveAuditLog(&db.AuditLog{
+			Action:      "command." + msg.Type,
+			Actor:       msg.RequestedBy,
+			DeveloperID: c.DeveloperID,
+			Method:      "BUS",
+			Path:        subject,
+			Detail:      d.Email + " " + msg.ID,
+		})
+		if aerr != nil {
+			fmt.Println("unable to save audit log", msg.Type, aerr)
+		} else {
+			go exportAuditLogs()
+		}
+	}
+
+	return newCommandResult(c), nil
+}
+
+// handleCommand processes a command and publishes its result, returning an
+// error if it should be delivered again.
+func handleCommand(subject string, body []byte) (*commandResult, error) {
+	res, err := processCommand(subject, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, publishMessages([]*busMessage{{busSubjectPrefix + "command." + res.Status, res.ID, res}})
+}
+
+// commandConsumer is a subscription to commands.
+type commandConsumer interface {
+	closed() bool
+}
+
+// natsConsumer consumes commands from NATS, replying with the result to
+// commands sent as requests. NATS doesn't redeliver, so commands that fail
+// to be processed are only reported.
+type natsConsumer struct {
+	conn *nats.Conn
+}
+
+func (c *natsConsumer) closed() bool {
+	return c.conn.IsClosed()
+}
+
+// amqpConsumer consumes commands from a durable RabbitMQ queue, acking each
+// once its result is published and requeueing it otherwise.
+type amqpConsumer struct {
+	conn *amqp.Connection
+	done chan struct{}
+}
+
+func (c *amqpConsumer) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// dialCommandConsumer subscribes to commands on the bus at BUS_URL.
+func dialCommandConsumer() (commandConsumer, error) {
+	subject := busSubjectPrefix + "commands.*"
+	if strings.HasPrefix(busURL, "nats") || strings.HasPrefix(busURL, "tls") {
+		conn, err := nats.Connect(busURL)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = conn.QueueSubscribe(subject, busCommandQueue, func(m *nats.Msg) {
+			res, err := handleCommand(m.Subject, m.Data)
+			if err != nil {
+				fmt.Println("unable to process command on", m.Subject, err)
+			}
+			if res != nil && m.Reply != "" {
+				body, _ := json.Marshal(res)
+				conn.Publish(m.Reply, body)
+			}
+		})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &natsConsumer{conn: conn}, nil
+	}
+
+	conn, err := amqp.Dial(busURL)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err == nil {
+		err = channel.ExchangeDeclare(busExchange, "topic", true, false, false, false, nil)
+	}
+	if err == nil {
+		_, err = channel.QueueDeclare(busCommandQueue, true, false, false, false, nil)
+	}
+	if err == nil {
+		err = channel.QueueBind(busCommandQueue, subject, busExchange, false, nil)
+	}
+	if err == nil {
+		err = channel.Qos(busCommandPrefetch, 0, false)
+	}
+	var deliveries <-chan amqp.Delivery
+	if err == nil {
+		deliveries, err = channel.Consume(busCommandQueue, instanceID, false, false, false, false, nil)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &amqpConsumer{conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		defer conn.Close()
+		for d := range deliveries {
+			if _, err := handleCommand(d.RoutingKey, d.Body); err != nil {
+				fmt.Println("unable to process command on", d.RoutingKey, err)
+				// Give the database or bus a moment before it's redelivered.
+				time.Sleep(time.Second)
+				d.Nack(false, true)
+				continue
+			}
+			d.Ack(false)
+		}
+	}()
+	return c, nil
+}
+
+// ensureCommandConsumer subscribes to commands if this instance isn't
+// already, or its subscription was lost.
+func ensureCommandConsumer() error {
+	if busURL == "" {
+		return nil
+	}
+
+	consumerMutex.Lock()
+	defer consumerMutex.Unlock()
+	if consumer != nil && !consumer.closed() {
+		return nil
+	}
+
+	c, err := dialCommandConsumer()
+	if err != nil {
+		return err
+	}
+	consumer = c
+	return nil
+}
@@ -0,0 +1,657 @@
+// Copyright 2014 Bowery, Inc.
+// Contains broadcast email campaigns. An admin writes a templated email for
+// a segment of developers, previews it and schedules it. When it's due each
+// recipient gets an outbox message, spread out to the campaign rate, and
+// opens are counted with a tracking image.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+const outboxCampaignEmail = "email.campaign"
+
+const (
+	// defaultCampaignRate is the emails sent per minute, the campaign-email
+	// rate limit overrides it.
+	defaultCampaignRate = 300
+
+	// campaignQueueChunk is the outbox messages saved per insert.
+	campaignQueueChunk = 500
+)
+
+// campaignPixel is a transparent 1x1 gif.
+var campaignPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00,
+	0x00, 0x02, 0x01, 0x44, 0x00, 0x3b,
+}
+
+func init() {
+	outboxHandlers[outboxCampaignEmail] = sendCampaignEmail
+	schedule("queue-campaigns", time.Minute, queueCampaigns)
+}
+
+// campaignRate returns the campaign emails sent per minute.
+func campaignRate() int {
+	if limit := rateLimit("campaign-email"); limit > 0 {
+		return limit
+	}
+
+	return defaultCampaignRate
+}
+
+// segmentQuery returns the developer query for the parts of a segment
+// stored on developers. Unsubscribed and undeliverable addresses never
+// match.
+func segmentQuery(seg db.CampaignSegment) bson.M {
+	query := bson.M{
+		"emailSubscription.unsubscribed": bson.M{"$ne": true},
+		"emailHealth.status":             bson.M{"$nin": db.UndeliverableEmails},
+	}
+
+	paid, free := false, false
+	for _, p := range seg.Plans {
+		paid = paid || p == "paid"
+		free = free || p == "free"
+	}
+	if paid != free {
+		query["isPaid"] = paid
+	}
+	if len(seg.Tags) > 0 {
+		query["tags"] = bson.M{"$in": seg.Tags}
+	}
+
+	// Developers store when they signed up in milliseconds.
+	created := bson.M{}
+	if !seg.SignedUpAfter.IsZero() {
+		created["$gte"] = seg.SignedUpAfter.UnixNano() / int64(time.Millisecond)
+	}
+	if !seg.SignedUpBefore.IsZero() {
+		created["$lt"] = seg.SignedUpBefore.UnixNano() / int64(time.Millisecond)
+	}
+	if len(created) > 0 {
+		query["createdAt"] = created
+	}
+
+	return query
+}
+
+// segmentDevelopers returns the developers in a segment, filtering by
+// heartbeats for activity and by the saved segment's members.
+func segmentDevelopers(seg db.CampaignSegment, now time.Time) ([]*schemas.Developer, error) {
+	query := segmentQuery(seg)
+	if seg.Saved != "" {
+		ids, err := segmentMemberIDs(seg.Saved)
+		if err != nil {
+			return nil, err
+		}
+		query["_id"] = bson.M{"$in": ids}
+	}
+
+	ds, err := db.GetDevelopersFor(db.ReadReports, query)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := func(days int, active bool) error {
+		if days <= 0 {
+			return nil
+		}
+		ids, err := db.ActiveDeveloperIDs(now.AddDate(0, 0, -days))
+		if err != nil {
+			return err
+		}
+
+		seen := map[string]bool{}
+		for _, id := range ids {
+			seen[id] = true
+		}
+		kept := ds[:0]
+		for _, d := range ds {
+			if seen[d.ID.Hex()] == active {
+				kept = append(kept, d)
+			}
+		}
+		ds = kept
+		return nil
+	}
+
+	if err := filter(seg.ActiveWithinDays, true); err != nil {
+		return nil, err
+	}
+	if err := filter(seg.InactiveDays, false); err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// validateCampaign checks a campaign can be rendered and sent.
+func validateCampaign(c *db.Campaign) error {
+	if c.Name == "" || c.Subject == "" {
+		return errors.New("name and subject are required")
+	}
+	if _, err := mail.ParseAddress(c.FromEmail); err != nil {
+		return errors.New("fromEmail must be an email address")
+	}
+	if c.Body == "" {
+		return errors.New("body is required")
+	}
+	if _, err := template.New("campaign").Funcs(templateFuncs).Parse(c.Body); err != nil {
+		return err
+	}
+	for _, p := range c.Segment.Plans {
+		if p != "free" && p != "paid" {
+			return errors.New("segment plans must be free or paid")
+		}
+	}
+	tags, err := normalizeTags(c.Segment.Tags)
+	if err != nil {
+		return err
+	}
+	c.Segment.Tags = tags
+	if c.Segment.ActiveWithinDays < 0 || c.Segment.InactiveDays < 0 {
+		return errors.New("segment days must not be negative")
+	}
+	if c.Segment.Saved != "" {
+		if _, err := db.GetSegment(c.Segment.Saved); err != nil {
+			return errors.New("no saved segment " + c.Segment.Saved)
+		}
+	}
+
+	return nil
+}
+
+// renderCampaign renders a campaign for a developer. The body gets name,
+// fullName, email and plan.
+func renderCampaign(c *db.Campaign, d *schemas.Developer, host string) (string, error) {
+	t, err := template.New("campaign").Funcs(templateFuncs).Parse(c.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var body bytes.Buffer
+	err = t.Execute(&body, map[string]interface{}{
+		"name":     strings.Split(d.Name, " ")[0],
+		"fullName": d.Name,
+		"email":    d.Email,
+		"plan":     developerPlan(d),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	openURL := ""
+	if host != "" {
+		openURL = host + "/campaigns/" + c.ID.Hex() + "/open/" + d.ID.Hex()
+	}
+	return RenderEmail("campaign_email", map[string]interface{}{
+		"body":    template.HTML(body.String()),
+		"openURL": openURL,
+	})
+}
+
+// queueCampaigns queues the campaigns that are due. A campaign that fails
+// is scheduled again for the next run, recipients already queued aren't
+// emailed twice.
+func queueCampaigns() error {
+	for {
+		c, err := db.ClaimDueCampaign()
+		if err == db.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := queueCampaign(c, time.Now()); err != nil {
+			if uerr := db.UpdateCampaign(c.ID, []string{db.CampaignQueueing}, bson.M{"status": db.CampaignScheduled}); uerr != nil && uerr != db.ErrConflict {
+				return uerr
+			}
+			return err
+		}
+	}
+}
+
+// queueCampaign saves an outbox message for each recipient, due at the
+// campaign rate from start.
+func queueCampaign(c *db.Campaign, start time.Time) error {
+	ds, err := segmentDevelopers(c.Segment, start)
+	if err != nil {
+		return err
+	}
+
+	rate := campaignRate()
+	ms := []*db.OutboxMessage{}
+	for i, d := range ds {
+		ms = append(ms, &db.OutboxMessage{
+			Kind:          outboxCampaignEmail,
+			DeveloperID:   d.ID,
+			Payload:       map[string]interface{}{"campaignId": c.ID.Hex()},
+			NextAttemptAt: start.Add(time.Duration(i) * time.Minute / time.Duration(rate)),
+		})
+
+		if len(ms) == campaignQueueChunk || i == len(ds)-1 {
+			if err := db.SaveOutboxMessages(ms...); err != nil {
+				return err
+			}
+			ms = []*db.OutboxMessage{}
+		}
+	}
+
+	return db.UpdateCampaign(c.ID, []string{db.CampaignQueueing}, bson.M{
+		"status":     db.CampaignQueued,
+		"recipients": len(ds),
+		"queuedAt":   time.Now(),
+	})
+}
+
+// sendCampaignEmail sends a campaign to one recipient, unless it's been
+// cancelled since it was queued.
+func sendCampaignEmail(m *db.OutboxMessage, d *schemas.Developer) error {
+	id, _ := m.Payload["campaignId"].(string)
+	if !bson.IsObjectIdHex(id) {
+		return errors.New("invalid campaign id " + id)
+	}
+	c, err := db.GetCampaign(bson.ObjectIdHex(id))
+	if err != nil {
+		return err
+	}
+	if c.Status == db.CampaignCancelled {
+		return nil
+	}
+
+	message, err := renderCampaign(c, d, c.Host)
+	if err != nil {
+		return err
+	}
+
+	// Only count emails sent, a recipient queued twice is suppressed.
+	sent, err := dispatchNotice(d, &notice{
+		Kind: noticeAnnouncement,
+		Key:  notificationKey("campaign:"+id, d.Email),
+		Email: gochimp.Message{
+			Subject:   c.Subject,
+			FromEmail: c.FromEmail,
+			FromName:  c.FromName,
+			To:        []gochimp.Recipient{{Email: d.Email, Name: d.Name}},
+			Html:      message,
+			Tags:      []string{"campaign-" + id},
+			Metadata:  map[string]string{"campaignId": id},
+		},
+		Text: c.Subject,
+		Data: map[string]interface{}{"campaignId": id},
+	})
+	if err != nil || !sent {
+		return err
+	}
+
+	return db.IncCampaignSent(c.ID)
+}
+
+// campaignBody is the editable part of a campaign.
+type campaignBody struct {
+	Name      string             `json:"name"`
+	Subject   string             `json:"subject"`
+	FromEmail string             `json:"fromEmail"`
+	FromName  string             `json:"fromName"`
+	Body      string             `json:"body"`
+	Segment   db.CampaignSegment `json:"segment"`
+}
+
+func (b *campaignBody) campaign() *db.Campaign {
+	return &db.Campaign{
+		Name:      strings.TrimSpace(b.Name),
+		Subject:   strings.TrimSpace(b.Subject),
+		FromEmail: strings.TrimSpace(b.FromEmail),
+		FromName:  strings.TrimSpace(b.FromName),
+		Body:      b.Body,
+		Segment:   b.Segment,
+	}
+}
+
+// campaignFromRoute returns the campaign in the route, writing the error
+// response if there isn't one.
+func campaignFromRoute(rw http.ResponseWriter, req *http.Request) (*db.Campaign, bool) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid campaign id",
+		})
+		return nil, false
+	}
+
+	c, err := db.GetCampaign(bson.ObjectIdHex(id))
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return nil, false
+	}
+
+	return c, true
+}
+
+// GET /admin/campaigns, Lists broadcast email campaigns
+func AdminCampaignsHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if status := req.FormValue("status"); status != "" {
+		query["status"] = status
+	}
+
+	cs, err := db.GetCampaigns(query, 100)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"campaigns": cs,
+	})
+}
+
+// POST /admin/campaigns, Creates a draft campaign
+func CreateCampaignHandler(rw http.ResponseWriter, req *http.Request) {
+	var body campaignBody
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c := body.campaign()
+	if err := validateCampaign(c); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if dev, err := currentDeveloper(req); err == nil {
+		c.CreatedBy = dev.Email
+	}
+
+	if err := db.SaveCampaign(c); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	audit(req, "campaign.created", c.CreatedBy, c.ID.Hex()+" "+c.Name)
+	renderer.JSON(rw, http.StatusCreated, map[string]interface{}{
+		"status":   requests.StatusCreated,
+		"campaign": c,
+	})
+}
+
+// PUT /admin/campaigns/{id}, Edits a draft campaign
+func UpdateCampaignHandler(rw http.ResponseWriter, req *http.Request) {
+	c, ok := campaignFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	var body campaignBody
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	edited := body.campaign()
+	if err := validateCampaign(edited); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	err := db.UpdateCampaign(c.ID, []string{db.CampaignDraft}, bson.M{
+		"name":      edited.Name,
+		"subject":   edited.Subject,
+		"fromEmail": edited.FromEmail,
+		"fromName":  edited.FromName,
+		"body":      edited.Body,
+		"segment":   edited.Segment,
+	})
+	if err == db.ErrConflict {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Only drafts can be edited.",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// GET /admin/campaigns/{id}, Shows a campaign with its audience and delivery stats
+func AdminCampaignHandler(rw http.ResponseWriter, req *http.Request) {
+	c, ok := campaignFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	stats := map[string]interface{}{
+		"recipients": c.Recipients,
+		"sent":       c.Sent,
+		"opens":      c.Opens,
+	}
+	if c.Sent > 0 {
+		stats["openRate"] = float64(c.Opens) / float64(c.Sent)
+	}
+
+	if c.Status == db.CampaignDraft || c.Status == db.CampaignScheduled {
+		ds, err := segmentDevelopers(c.Segment, time.Now())
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+		stats["audience"] = len(ds)
+	} else {
+		for name, states := range map[string][]string{
+			"pending": {db.OutboxPending, db.OutboxProcessing},
+			"failed":  {db.OutboxFailed},
+		} {
+			n, err := db.CountOutboxMessages(bson.M{
+				"kind":               outboxCampaignEmail,
+				"payload.campaignId": c.ID.Hex(),
+				"status":             bson.M{"$in": states},
+			})
+			if err != nil {
+				renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+					"status": requests.StatusFailed,
+					"error":  err.Error(),
+				})
+				return
+			}
+			stats[name] = n
+		}
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"campaign": c,
+		"stats":    stats,
+	})
+}
+
+// GET /admin/campaigns/{id}/preview, Renders a campaign for a developer in its segment, or the one given by email
+func PreviewCampaignHandler(rw http.ResponseWriter, req *http.Request) {
+	c, ok := campaignFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	var d *schemas.Developer
+	if email := req.FormValue("email"); email != "" {
+		var err error
+		if d, err = tenantFor(req).GetDeveloper(bson.M{"email": email}); err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+	} else {
+		ds, err := segmentDevelopers(c.Segment, time.Now())
+		if err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+		if len(ds) == 0 {
+			RenderTemplate(rw, "error", map[string]string{"Error": "No developers are in the campaign's segment."})
+			return
+		}
+		d = ds[0]
+	}
+
+	message, err := renderCampaign(c, d, "")
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Write([]byte(message))
+}
+
+// POST /admin/campaigns/{id}/schedule, Schedules a draft to send at scheduledAt, or now
+func ScheduleCampaignHandler(rw http.ResponseWriter, req *http.Request) {
+	c, ok := campaignFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ScheduledAt time.Time `json:"scheduledAt"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if body.ScheduledAt.IsZero() {
+		body.ScheduledAt = time.Now()
+	}
+
+	err := db.UpdateCampaign(c.ID, []string{db.CampaignDraft}, bson.M{
+		"status":      db.CampaignScheduled,
+		"scheduledAt": body.ScheduledAt,
+		"host":        baseURL(req),
+	})
+	if err == db.ErrConflict {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Only drafts can be scheduled.",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "campaign.scheduled", actor, c.ID.Hex()+" at "+body.ScheduledAt.UTC().Format(time.RFC3339))
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// POST /admin/campaigns/{id}/cancel, Stops a scheduled or sending campaign
+func CancelCampaignHandler(rw http.ResponseWriter, req *http.Request) {
+	c, ok := campaignFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	err := db.UpdateCampaign(c.ID, []string{db.CampaignDraft, db.CampaignScheduled, db.CampaignQueued},
+		bson.M{"status": db.CampaignCancelled})
+	if err == db.ErrConflict {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Campaign was already cancelled or is being queued.",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "campaign.cancelled", actor, c.ID.Hex())
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// GET /campaigns/{id}/open/{developer}, Counts a campaign open from its tracking image
+func CampaignOpenHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if bson.IsObjectIdHex(vars["id"]) && bson.IsObjectIdHex(vars["developer"]) {
+		if _, err := db.RecordCampaignOpen(bson.ObjectIdHex(vars["id"]), bson.ObjectIdHex(vars["developer"])); err != nil {
+			fmt.Println("unable to record campaign open", vars["id"], err)
+		}
+	}
+
+	rw.Header().Set("Content-Type", "image/gif")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Write(campaignPixel)
+}
@@ -0,0 +1,280 @@
+// Copyright 2014 Bowery, Inc.
+// Contains weighted canary routing between a route's stable handler and a
+// rewritten one, with automatic rollback when the canary errors too often.
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Error rates are measured over a window of this length.
+	canaryWindow = 5 * time.Minute
+
+	// Fewest canary requests in a window before the error rate is trusted.
+	canaryMinRequests = 20
+
+	// The canary is rolled back once its error rate is this much higher
+	// than the stable handler's.
+	canaryErrorMargin = 0.05
+)
+
+// canaryStats counts requests and server errors for one side of a split.
+type canaryStats struct {
+	Requests int `json:"requests"`
+	Errors   int `json:"errors"`
+}
+
+func (s *canaryStats) rate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+// canaryRoute is the in memory state for a route with a canary registered.
+type canaryRoute struct {
+	handler     http.HandlerFunc
+	weight      int
+	stable      canaryStats
+	canary      canaryStats
+	windowStart time.Time
+}
+
+var (
+	canaryMutex  sync.Mutex
+	canaryRoutes = map[string]*canaryRoute{}
+)
+
+func init() {
+	scheduleEveryInstance("refresh-canaries", time.Minute, refreshCanaries)
+}
+
+// registerCanary sets the handler being rolled out for route. It receives no
+// traffic until a weight is set from the admin endpoint.
+func registerCanary(route string, handler http.HandlerFunc) {
+	canaryMutex.Lock()
+	defer canaryMutex.Unlock()
+	canaryRoutes[route] = &canaryRoute{handler: handler, windowStart: time.Now()}
+}
+
+// refreshCanaries loads the weights from the database so changes made
+// through another instance take effect here.
+func refreshCanaries() error {
+	cs, err := db.GetCanaries(bson.M{})
+	if err != nil {
+		return err
+	}
+
+	canaryMutex.Lock()
+	defer canaryMutex.Unlock()
+	for _, c := range cs {
+		if r, ok := canaryRoutes[c.Route]; ok {
+			r.weight = c.Weight
+		}
+	}
+
+	return nil
+}
+
+// statusWriter records the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// canary wraps the stable handler for route, sending a share of requests to
+// the registered canary. Requests for the same token always go the same way
+// so a developer doesn't flip between implementations mid flow.
+func canary(route string, stable http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		canaryMutex.Lock()
+		r, ok := canaryRoutes[route]
+		weight := 0
+		if ok {
+			weight = r.weight
+		}
+		canaryMutex.Unlock()
+
+		useCanary := weight > 0 && canaryBucket(req) < weight
+		handler := stable
+		if useCanary {
+			handler = r.handler
+		}
+
+		sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		handler(sw, req)
+
+		if ok {
+			recordCanaryResult(route, useCanary, sw.status >= 500)
+		}
+	}
+}
+
+// canaryBucket places the request in a bucket from 0 to 99.
+func canaryBucket(req *http.Request) int {
+	token := mux.Vars(req)["token"]
+	if token == "" {
+		return rand.Intn(100)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return int(h.Sum32() % 100)
+}
+
+// recordCanaryResult counts a response and rolls the canary back if it's
+// erroring noticeably more than the stable handler.
+func recordCanaryResult(route string, usedCanary, failed bool) {
+	canaryMutex.Lock()
+	r := canaryRoutes[route]
+	if time.Since(r.windowStart) > canaryWindow {
+		r.stable = canaryStats{}
+		r.canary = canaryStats{}
+		r.windowStart = time.Now()
+	}
+
+	stats := &r.stable
+	if usedCanary {
+		stats = &r.canary
+	}
+	stats.Requests++
+	if failed {
+		stats.Errors++
+	}
+
+	rollback := r.weight > 0 && r.canary.Requests >= canaryMinRequests &&
+		r.canary.rate() > r.stable.rate()+canaryErrorMargin
+	var reason string
+	if rollback {
+		reason = fmt.Sprintf("canary error rate %.1f%% vs stable %.1f%%",
+			r.canary.rate()*100, r.stable.rate()*100)
+		r.weight = 0
+	}
+	canaryMutex.Unlock()
+
+	if rollback {
+		go rollbackCanary(route, reason)
+	}
+}
+
+func rollbackCanary(route, reason string) {
+	c, err := db.GetCanary(route)
+	if err == nil {
+		c.Weight = 0
+		c.RolledBack = true
+		c.Reason = reason
+		c.UpdatedBy = "automatic rollback"
+		err = db.SaveCanary(c)
+	}
+	if err != nil {
+		fmt.Println("unable to save rollback for", route, err)
+	}
+
+	notifySlack(slackChannel("activity"), "Rolled back canary for "+route+": "+reason)
+}
+
+// GET /admin/canaries, Lists canaries with their split and current error rates
+func AdminCanariesHandler(rw http.ResponseWriter, req *http.Request) {
+	cs, err := db.GetCanaries(bson.M{})
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	type status struct {
+		*db.Canary
+		StableStats canaryStats `json:"stableStats"`
+		CanaryStats canaryStats `json:"canaryStats"`
+	}
+
+	saved := map[string]*db.Canary{}
+	for _, c := range cs {
+		saved[c.Route] = c
+	}
+
+	res := []*status{}
+	canaryMutex.Lock()
+	for route, r := range canaryRoutes {
+		c, ok := saved[route]
+		if !ok {
+			c = &db.Canary{Route: route}
+		}
+		res = append(res, &status{Canary: c, StableStats: r.stable, CanaryStats: r.canary})
+	}
+	canaryMutex.Unlock()
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"canaries": res,
+	})
+}
+
+// PUT /admin/canaries/{route}, Sets the percentage of traffic sent to a canary
+func UpdateCanaryHandler(rw http.ResponseWriter, req *http.Request) {
+	route := mux.Vars(req)["route"]
+	canaryMutex.Lock()
+	r, ok := canaryRoutes[route]
+	canaryMutex.Unlock()
+	if !ok {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "no canary registered for " + route,
+		})
+		return
+	}
+
+	weight, err := strconv.Atoi(req.FormValue("weight"))
+	if err != nil || weight < 0 || weight > 100 {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Weight between 0 and 100 Required.",
+		})
+		return
+	}
+
+	c := &db.Canary{Route: route, Weight: weight}
+	if dev, err := currentDeveloper(req); err == nil {
+		c.UpdatedBy = dev.Email
+	}
+	if err := db.SaveCanary(c); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	canaryMutex.Lock()
+	r.weight = weight
+	r.stable = canaryStats{}
+	r.canary = canaryStats{}
+	r.windowStart = time.Now()
+	canaryMutex.Unlock()
+
+	audit(req, "canary.update", c.UpdatedBy, fmt.Sprintf("%s weight %d", route, weight))
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"canary": c,
+	})
+}
@@ -0,0 +1,228 @@
+// Copyright 2014 Bowery, Inc.
+// Contains canceling subscriptions. Developers give a reason and choose
+// whether access ends now or at the end of the period they paid for, and a
+// day later are emailed a discount to come back, applied to the next time
+// they pay.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Percent off the win-back offer gives.
+	winBackPercent = 30
+
+	// How long after canceling the win-back offer is emailed, and how long
+	// it can be redeemed for after canceling.
+	winBackDelay = 24 * time.Hour
+	winBackValid = 30 * 24 * time.Hour
+
+	// Longest comment kept with a cancellation.
+	maxCancellationComment = 1000
+)
+
+// cancelReq is the body of a cancellation.
+type cancelReq struct {
+	Reason    string `json:"reason"`
+	Comment   string `json:"comment"`
+	Immediate bool   `json:"immediate"`
+}
+
+// validateCancellation checks a cancellation's reason and comment, which is
+// required for other reasons.
+func validateCancellation(body *cancelReq) error {
+	body.Reason = strings.TrimSpace(body.Reason)
+	body.Comment = strings.TrimSpace(body.Comment)
+
+	valid := false
+	for _, reason := range db.CancellationReasons {
+		valid = valid || reason == body.Reason
+	}
+	if !valid {
+		return fmt.Errorf("reason must be one of %s", strings.Join(db.CancellationReasons, ", "))
+	}
+	if body.Reason == db.CancelOther && body.Comment == "" {
+		return fmt.Errorf("a comment is required for %s", db.CancelOther)
+	}
+	if len(body.Comment) > maxCancellationComment {
+		return fmt.Errorf("comment can be up to %d characters", maxCancellationComment)
+	}
+
+	return nil
+}
+
+// DELETE /developers/{token}/subscription, Cancels a developer's subscription now or at the end of its period
+func CancelSubscriptionHandler(rw http.ResponseWriter, req *http.Request) {
+	var body cancelReq
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateCancellation(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	var state string
+	if err == nil {
+		state, err = developerLifecycle(d)
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if !paidLifecycle(state) && state != db.LifecyclePaused {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "There's no subscription to cancel.",
+		})
+		return
+	}
+
+	now := time.Now()
+	c := &db.Cancellation{
+		DeveloperID:    d.ID,
+		Reason:         body.Reason,
+		Comment:        body.Comment,
+		Immediate:      body.Immediate,
+		From:           state,
+		CanceledAt:     now,
+		EndsAt:         d.Expiration,
+		OfferPercent:   winBackPercent,
+		OfferExpiresAt: now.Add(winBackValid),
+	}
+	// Past due developers haven't paid for the period they're in, and
+	// paused ones aren't using it.
+	if body.Immediate || state != db.LifecycleActive || c.EndsAt.Before(now) {
+		c.EndsAt = developerNow(d.ID)
+	}
+	if state == db.LifecyclePaused {
+		if err := setStripePause(req.Context(), d, time.Time{}); err != nil {
+			fmt.Println("unable to clear pause in stripe for", d.Email, err)
+		}
+	}
+
+	err = transitionDeveloper(d, db.LifecycleCanceled, bson.M{"isPaid": false, "expiration": c.EndsAt})
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := db.SaveCancellation(c); err != nil {
+		fmt.Println("unable to save cancellation for", d.Email, err)
+	} else {
+		err := db.SaveOutboxMessages(&db.OutboxMessage{
+			Kind:          outboxWinBackEmail,
+			DeveloperID:   d.ID,
+			Payload:       map[string]interface{}{"cancellationId": c.ID.Hex()},
+			NextAttemptAt: now.Add(winBackDelay),
+		})
+		if err != nil {
+			fmt.Println("unable to queue win-back email for", d.Email, err)
+		}
+	}
+
+	actor := d.Email
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "subscription.canceled", actor, d.Email+" "+body.Reason)
+	track("subscription.canceled", d, map[string]interface{}{"reason": body.Reason, "immediate": c.Immediate})
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusSuccess,
+		"endsAt": c.EndsAt,
+	})
+}
+
+// sendWinBackEmail emails a canceled developer their offer to come back,
+// unless they already have or it's no longer theirs to redeem.
+func sendWinBackEmail(m *db.OutboxMessage, d *schemas.Developer) error {
+	state, err := developerLifecycle(d)
+	if err != nil || state != db.LifecycleCanceled {
+		return err
+	}
+	c, err := db.GetWinBackOffer(d.ID, time.Now())
+	if err == db.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	message, err := RenderEmail("winback_email", map[string]interface{}{
+		"name":      strings.Split(d.Name, " ")[0],
+		"token":     d.Token,
+		"percent":   c.OfferPercent,
+		"expiresAt": c.OfferExpiresAt.Format("January 2, 2006"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendEmailOnce(notificationKey(m.Kind, c.ID.Hex()), gochimp.Message{
+		Subject:   fmt.Sprintf("%d%% off if you come back to Bowery", c.OfferPercent),
+		FromEmail: "hello@bowery.io",
+		FromName:  "Bowery",
+		To: []gochimp.Recipient{{
+			Email: d.Email,
+			Name:  d.Name,
+		}},
+		Html: message,
+	})
+}
+
+// winBackPlan returns the plan at the price a developer pays for it, less
+// their win-back offer if they have one.
+func winBackPlan(d *schemas.Developer, plan *db.Plan) *db.Plan {
+	c, err := db.GetWinBackOffer(d.ID, time.Now())
+	if err != nil {
+		if err != db.ErrNotFound {
+			fmt.Println("unable to get win-back offer for", d.Email, err)
+		}
+		return plan
+	}
+
+	discounted := *plan
+	discounted.Amount = plan.Amount * int64(100-c.OfferPercent) / 100
+	return &discounted
+}
+
+// redeemWinBackOffer uses up a developer's win-back offer once they've paid.
+func redeemWinBackOffer(d *schemas.Developer) {
+	c, err := db.GetWinBackOffer(d.ID, time.Now())
+	if err == nil {
+		err = db.RedeemWinBackOffer(c.ID)
+		if err == nil {
+			track("subscription.won_back", d, map[string]interface{}{"reason": c.Reason})
+		}
+	}
+	if err != nil && err != db.ErrNotFound && err != db.ErrConflict {
+		fmt.Println("unable to redeem win-back offer for", d.Email, err)
+	}
+}
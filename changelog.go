@@ -0,0 +1,279 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for the in-product changelog.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Default and max page sizes for the changelog.
+const (
+	defaultChangelogPage = 20
+	maxChangelogPage     = 100
+)
+
+// parseChangelogForm copies the submitted fields onto e, returning an
+// error message if a field is invalid.
+func parseChangelogForm(req *http.Request, e *db.ChangelogEntry) string {
+	for field, dest := range map[string]*string{
+		"title":   &e.Title,
+		"body":    &e.Body,
+		"version": &e.Version,
+	} {
+		if val, ok := req.Form[field]; ok {
+			*dest = strings.TrimSpace(val[0])
+		}
+	}
+
+	if _, ok := req.Form["channels"]; ok {
+		e.Channels = []string{}
+		for _, c := range strings.Split(req.FormValue("channels"), ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				if !db.ValidChannel(c) {
+					return "invalid channel " + c
+				}
+				e.Channels = append(e.Channels, c)
+			}
+		}
+	}
+
+	if val := req.FormValue("publishedAt"); val != "" {
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return "invalid publishedAt"
+		}
+		e.PublishedAt = t
+	}
+
+	if e.Title == "" {
+		return "Title Required."
+	}
+
+	return ""
+}
+
+// GET /changelog, Pages through the changelog for a channel. With a token
+// each entry says whether the developer has read it.
+func ChangelogHandler(rw http.ResponseWriter, req *http.Request) {
+	_, channel := clientVersion(req)
+
+	page, _ := strconv.Atoi(req.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(req.FormValue("perPage"))
+	if perPage < 1 {
+		perPage = defaultChangelogPage
+	}
+	if perPage > maxChangelogPage {
+		perPage = maxChangelogPage
+	}
+
+	var dev *schemas.Developer
+	var readAt time.Time
+	if token := req.FormValue("token"); token != "" {
+		var err error
+		dev, err = tenantFor(req).GetDeveloper(bson.M{"token": token})
+		if err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "Invalid Token.",
+			})
+			return
+		}
+
+		readAt, err = db.GetChangelogReadAt(dev.ID)
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+	}
+
+	es, total, err := db.GetChangelog(channel, (page-1)*perPage, perPage)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	type entry struct {
+		*db.ChangelogEntry
+		Read bool `json:"read"`
+	}
+
+	entries := []*entry{}
+	for _, e := range es {
+		entries = append(entries, &entry{
+			ChangelogEntry: e,
+			Read:           dev != nil && !e.PublishedAt.After(readAt),
+		})
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"entries": entries,
+		"page":    page,
+		"perPage": perPage,
+		"total":   total,
+	})
+}
+
+// POST /changelog/read, Marks the changelog read for the developer
+func ReadChangelogHandler(rw http.ResponseWriter, req *http.Request) {
+	token := req.FormValue("token")
+	if token == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Token Required.",
+		})
+		return
+	}
+
+	dev, err := tenantFor(req).GetDeveloper(bson.M{"token": token})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Invalid Token.",
+		})
+		return
+	}
+
+	if err := db.MarkChangelogRead(dev.ID, time.Now()); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// POST /admin/changelog, Creates a changelog entry
+func CreateChangelogHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	e := &db.ChangelogEntry{}
+	if msg := parseChangelogForm(req, e); msg != "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  msg,
+		})
+		return
+	}
+
+	if err := db.SaveChangelogEntry(e); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"entry":  e,
+	})
+}
+
+// PUT /admin/changelog/{id}, Edits a changelog entry
+func UpdateChangelogHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid entry id",
+		})
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	e, err := db.GetChangelogEntry(bson.ObjectIdHex(id))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if msg := parseChangelogForm(req, e); msg != "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  msg,
+		})
+		return
+	}
+
+	if err := db.UpdateChangelogEntry(e.ID, bson.M{
+		"title":       e.Title,
+		"body":        e.Body,
+		"version":     e.Version,
+		"channels":    e.Channels,
+		"publishedAt": e.PublishedAt,
+	}); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"entry":  e,
+	})
+}
+
+// DELETE /admin/changelog/{id}, Removes a changelog entry
+func DeleteChangelogHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid entry id",
+		})
+		return
+	}
+
+	if err := db.DeleteChangelogEntry(bson.ObjectIdHex(id)); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
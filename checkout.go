@@ -0,0 +1,337 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the hosted checkout. Developers are sent to a Stripe Checkout
+// session, which collects the card and runs 3-D Secure when the bank asks
+// for it, then come back to be marked paid.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/env"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+var stripeAPI = "https://api.stripe.com/v1"
+
+// Open checkouts are checked with Stripe after this, in case the developer
+// paid but never came back, and expired once Stripe has expired them.
+const checkoutReconcileAfter = 5 * time.Minute
+
+var stripeHTTPClient = &http.Client{Timeout: stripeSlowCall}
+
+// stripeAPIError is an error response from the Stripe API.
+type stripeAPIError struct {
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	DeclineCode string `json:"decline_code"`
+	Message     string `json:"message"`
+
+	// Set when a PaymentIntent couldn't be confirmed, e.g. it needs
+	// authentication.
+	PaymentIntent *paymentIntent `json:"payment_intent"`
+}
+
+func (e *stripeAPIError) Error() string {
+	return e.Message
+}
+
+// checkoutSession is the part of a Stripe Checkout session broome uses.
+type checkoutSession struct {
+	ID                string `json:"id"`
+	URL               string `json:"url"`
+	Status            string `json:"status"`
+	PaymentStatus     string `json:"payment_status"`
+	ClientReferenceID string `json:"client_reference_id"`
+	Customer          string `json:"customer"`
+	PaymentIntent     string `json:"payment_intent"`
+	CustomerDetails   *struct {
+		Address *stripeAddress `json:"address"`
+	} `json:"customer_details"`
+}
+
+func init() {
+	schedule("reconcile-checkouts", checkoutReconcileAfter, reconcileCheckouts)
+}
+
+// stripeRequest calls the Stripe API directly, for endpoints the stripe
+// package doesn't have. Requests with an idempotency key are safe to retry.
+func stripeRequest(ctx context.Context, method, path string, params url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequest(method, stripeAPI+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(env.Current.StripeSecretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	res, err := stripeHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		var body struct {
+			Error *stripeAPIError `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.Error == nil {
+			return &stripeAPIError{Type: "api_error", Message: "stripe returned " + res.Status}
+		}
+
+		return body.Error
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// baseURL returns the scheme and host the request was made to.
+func baseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil || os.Getenv("ENV") == "production" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + req.Host
+}
+
+// createCheckoutSession starts a Stripe Checkout session for the plan. The
+// card is saved for future charges so renewals don't need the developer.
+func createCheckoutSession(ctx context.Context, d *schemas.Developer, plan *db.Plan, base string) (*checkoutSession, error) {
+	params := url.Values{
+		"mode":                                          {"payment"},
+		"customer_email":                                {d.Email},
+		"client_reference_id":                           {d.ID.Hex()},
+		"line_items[0][quantity]":                       {"1"},
+		"line_items[0][price_data][currency]":           {plan.Currency},
+		"line_items[0][price_data][unit_amount]":        {strconv.FormatInt(plan.Amount, 10)},
+		"line_items[0][price_data][product_data][name]": {plan.Description},
+		"payment_intent_data[setup_future_usage]":       {"off_session"},
+		"billing_address_collection":                    {"required"},
+		"metadata[developerId]":                         {d.ID.Hex()},
+		"metadata[plan]":                                {plan.Slug},
+		"success_url":                                   {base + "/checkout/" + d.Token + "/complete?session_id={CHECKOUT_SESSION_ID}"},
+		"cancel_url":                                    {base + "/checkout/" + d.Token + "?canceled=true"},
+	}
+
+	s := &checkoutSession{}
+	key := "checkout-" + bson.NewObjectId().Hex()
+	return s, callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/checkout/sessions", params, key, s)
+	})
+}
+
+// getCheckoutSession retrieves a Checkout session from Stripe.
+func getCheckoutSession(ctx context.Context, id string) (*checkoutSession, error) {
+	s := &checkoutSession{}
+	return s, callStripe(ctx, func() error {
+		return stripeRequest(ctx, "GET", "/checkout/sessions/"+url.PathEscape(id), url.Values{}, "", s)
+	})
+}
+
+// markPaid records a developer's payment for a plan.
+func markPaid(d *schemas.Developer, plan *db.Plan) error {
+	if err := transitionDeveloper(d, db.LifecycleActive, bson.M{"isPaid": true, "plan": plan.Slug}); err != nil {
+		return err
+	}
+
+	d.IsPaid = true
+	redeemWinBackOffer(d)
+	if _, err := issueLicense(d); err != nil {
+		fmt.Println("unable to issue license for", d.Email, err)
+	}
+	track("developer.paid", d, map[string]interface{}{"amount": plan.Amount, "currency": plan.Currency})
+	return nil
+}
+
+// fulfillCheckout marks the developer paid if the session was paid for. A
+// checkout is only fulfilled once, however many times it's checked.
+func fulfillCheckout(c *db.Checkout, s *checkoutSession) (bool, error) {
+	if s.ClientReferenceID != c.DeveloperID.Hex() {
+		return false, fmt.Errorf("checkout %s belongs to another developer", c.ID)
+	}
+
+	if s.Status == "expired" {
+		_, err := db.CloseCheckout(c.ID, db.CheckoutExpired)
+		return false, err
+	}
+	if s.PaymentStatus != "paid" {
+		return false, nil
+	}
+
+	closed, err := db.CloseCheckout(c.ID, db.CheckoutComplete)
+	if err != nil || !closed {
+		return closed, err
+	}
+
+	if s.Customer != "" {
+		if err := db.SetStripeCustomer(c.DeveloperID, s.Customer); err != nil {
+			fmt.Println("unable to save stripe customer for", c.DeveloperID.Hex(), err)
+		}
+	}
+	if s.CustomerDetails != nil {
+		if a := s.CustomerDetails.Address.billingAddress(); a != nil {
+			if err := db.SetBillingAddress(c.DeveloperID, a); err != nil {
+				fmt.Println("unable to save billing address for", c.DeveloperID.Hex(), err)
+			}
+		}
+	}
+
+	d, err := db.GetDeveloper(bson.M{"_id": c.DeveloperID})
+	if err != nil {
+		return false, err
+	}
+	plan, err := db.GetPlan(c.Plan)
+	if err != nil {
+		return false, err
+	}
+
+	return true, markPaid(d, plan)
+}
+
+// reconcileCheckouts fulfills open checkouts that were paid for without the
+// developer coming back, and expires abandoned ones.
+func reconcileCheckouts() error {
+	cs, err := db.GetCheckouts(bson.M{
+		"status":    db.CheckoutOpen,
+		"createdAt": bson.M{"$lt": time.Now().Add(-checkoutReconcileAfter)},
+	}, 100)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range cs {
+		s, err := getCheckoutSession(context.Background(), c.ID)
+		if err == nil {
+			_, err = fulfillCheckout(c, s)
+		}
+		if err != nil {
+			fmt.Println("unable to reconcile checkout", c.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// GET /checkout/{token}, Sends the developer to a Stripe Checkout session for their plan
+func CheckoutHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": "Invalid Token"})
+		return
+	}
+
+	plan, err := purchasePlan(d, db.PlanBowery)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	plan = winBackPlan(d, plan)
+
+	s, err := createCheckoutSession(req.Context(), d, plan, baseURL(req))
+	if err != nil {
+		if err == errStripeBusy || err == errBreakerOpen {
+			rw.Header().Set("Retry-After", "30")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	err = db.SaveCheckout(&db.Checkout{
+		ID:          s.ID,
+		DeveloperID: d.ID,
+		Plan:        plan.Slug,
+		Amount:      plan.Amount,
+		Currency:    plan.Currency,
+	})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	track("checkout.started", d, map[string]interface{}{"plan": plan.Slug})
+	recordConversion(req, "pricing")
+
+	http.Redirect(rw, req, s.URL, http.StatusSeeOther)
+}
+
+// GET /checkout/{token}/complete, Where Stripe sends the developer back after paying
+func CheckoutCompleteHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": "Invalid Token"})
+		return
+	}
+
+	c, err := db.GetCheckout(req.FormValue("session_id"))
+	if err == db.ErrNotFound || (err == nil && c.DeveloperID != d.ID) {
+		RenderTemplate(rw, "error", map[string]string{"Error": "Unknown checkout"})
+		return
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if c.Status == db.CheckoutOpen {
+		s, err := getCheckoutSession(req.Context(), c.ID)
+		if err == nil {
+			_, err = fulfillCheckout(c, s)
+		}
+		if err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+
+		if c, err = db.GetCheckout(c.ID); err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+	}
+
+	if c.Status != db.CheckoutComplete {
+		// Payments needing more time, e.g. bank debits, finish in the background.
+		RenderTemplate(rw, "error", map[string]string{"Error": "Your payment is still processing, please check back in a few minutes."})
+		return
+	}
+
+	if err := RenderTemplate(rw, "thanks", map[string]interface{}{"org": orgFor(req)}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /admin/checkouts, Lists checkouts, open ones by default
+func AdminCheckoutsHandler(rw http.ResponseWriter, req *http.Request) {
+	status := req.FormValue("status")
+	if status == "" {
+		status = db.CheckoutOpen
+	}
+
+	cs, err := db.GetCheckouts(bson.M{"status": status}, 100)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"checkouts": cs,
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 Bowery, Inc.
+// Contains churn risk scoring for developers.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+// Scores at or above this are considered high risk.
+const churnThreshold = 0.6
+
+// churnSignals are the inputs to a developer's churn score.
+type churnSignals struct {
+	RecentHeartbeats   int
+	PreviousHeartbeats int
+	FailedCharges      int
+	Expired            bool
+}
+
+func init() {
+	scheduleDaily("churn-scores", 6, computeChurnScores)
+}
+
+// churnScore turns signals into a score between 0 and 1, with the reasons
+// it's raised.
+func churnScore(s *churnSignals) (float64, []string) {
+	score := 0.0
+	reasons := []string{}
+
+	switch {
+	case s.PreviousHeartbeats > 0 && s.RecentHeartbeats == 0:
+		score += 0.5
+		reasons = append(reasons, "stopped using the client")
+	case s.PreviousHeartbeats > 0 && s.RecentHeartbeats*2 < s.PreviousHeartbeats:
+		score += 0.3
+		reasons = append(reasons, "usage halved")
+	}
+
+	if s.FailedCharges > 0 {
+		score += 0.2
+		if s.FailedCharges > 1 {
+			score += 0.2
+		}
+		reasons = append(reasons, fmt.Sprintf("%d failed charges", s.FailedCharges))
+	}
+
+	if s.Expired {
+		score += 0.2
+		reasons = append(reasons, "license expired")
+	}
+
+	if score > 1 {
+		score = 1
+	}
+	return score, reasons
+}
+
+// gatherChurnSignals reads the signals for a developer from local events.
+func gatherChurnSignals(d *schemas.Developer, now time.Time) (*churnSignals, error) {
+	id := d.ID.Hex()
+	twoWeeks := 14 * 24 * time.Hour
+	s := &churnSignals{Expired: !d.Expiration.IsZero() && d.Expiration.Before(now)}
+
+	var err error
+	s.RecentHeartbeats, err = db.CountEvents(bson.M{
+		"name":        "developer.heartbeat",
+		"developerId": id,
+		"createdAt":   bson.M{"$gte": now.Add(-twoWeeks)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.PreviousHeartbeats, err = db.CountEvents(bson.M{
+		"name":        "developer.heartbeat",
+		"developerId": id,
+		"createdAt":   bson.M{"$gte": now.Add(-2 * twoWeeks), "$lt": now.Add(-twoWeeks)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.FailedCharges, err = db.CountEvents(bson.M{
+		"name":        "charge.failed",
+		"developerId": id,
+		"createdAt":   bson.M{"$gte": now.Add(-2 * twoWeeks)},
+	})
+	return s, err
+}
+
+// computeChurnScores scores every developer, alerting Slack when a paid
+// account crosses the threshold.
+func computeChurnScores() error {
+	now := time.Now()
+	return db.EachDeveloper(db.ReadReports, bson.M{}, func(d *schemas.Developer) error {
+		s, err := gatherChurnSignals(d, now)
+		if err != nil {
+			return err
+		}
+
+		score, reasons := churnScore(s)
+		previous, err := db.GetChurnScore(d.ID)
+		if err != nil {
+			previous = &db.ChurnScore{}
+		}
+
+		if err := db.SaveChurnScore(&db.ChurnScore{
+			DeveloperID: d.ID,
+			Name:        d.Name,
+			Email:       d.Email,
+			Token:       d.Token,
+			IsPaid:      d.IsPaid,
+			Score:       score,
+			Signals:     reasons,
+			ComputedAt:  now,
+		}); err != nil {
+			return err
+		}
+
+		crossed := previous.Score < churnThreshold && score >= churnThreshold
+		if crossed && d.IsPaid && os.Getenv("ENV") == "production" {
+			go notifySlack(slackChannel("activity"), fmt.Sprintf("%s %s is at risk of churning (%.1f): %v",
+				d.Name, d.Email, score, reasons))
+		}
+		return nil
+	})
+}
+
+// GET /admin/churn, Lists high risk developers
+func ChurnHandler(rw http.ResponseWriter, req *http.Request) {
+	cs, err := db.GetChurnScores(churnThreshold)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderAdminTemplate(rw, "churn", map[string]interface{}{
+		"Scores":    cs,
+		"Threshold": churnThreshold,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
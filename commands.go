@@ -0,0 +1,168 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the commands run as "broome <command>" instead of the server.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Bowery/broome/db"
+)
+
+const (
+	// Developers moved at a time by move-stripe-customers.
+	stripeCustomerBatch = 500
+
+	// Documents sealed at a time by encrypt-pii, in each collection.
+	encryptPIIBatch = 500
+
+	// Licenses, billing accounts or documents rotate-keys re-signs or
+	// reseals at a time, and how long it waits between batches by default
+	// so rotating doesn't crowd out requests.
+	rotateKeysBatch = 100
+	rotateKeysPause = time.Second
+)
+
+// keyRotations are what rotate-keys moves to the current keys, in order.
+var keyRotations = []struct {
+	name   string
+	rotate func(limit int) (int, error)
+}{
+	{"licenses", resignLicenses},
+	{"billing accounts", db.RotateBillingAccounts},
+	{"documents with PII", db.EncryptDeveloperPII},
+}
+
+// commands by name, each given the arguments after its name.
+var commands = map[string]func(args []string) error{
+	"backup": func(args []string) error {
+		b, err := runBackup()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("backed up", b.Key, b.Size, "bytes")
+		printCounts(b.Collections)
+		return nil
+	},
+	"restore": func(args []string) error {
+		if len(args) != 2 {
+			return errors.New("usage: broome restore <backup key> <database>")
+		}
+
+		restored, err := restoreBackup(args[0], args[1])
+		printCounts(restored)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("restored and verified", args[0], "into", args[1])
+		return nil
+	},
+	"clone-staging": func(args []string) error {
+		if len(args) != 1 {
+			return errors.New("usage: broome clone-staging <database>")
+		}
+
+		cloned, err := cloneStaging(args[0])
+		printCounts(cloned)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("cloned anonymized data into", args[0])
+		return nil
+	},
+	"doctor": func(args []string) error {
+		failed, _ := runChecks(os.Stdout, doctorChecks)
+		if failed > 0 {
+			return fmt.Errorf("%d checks failed", failed)
+		}
+
+		fmt.Println("everything looks good")
+		return nil
+	},
+	"move-stripe-customers": func(args []string) error {
+		total := 0
+		for {
+			moved, err := db.MoveStripeCustomers(stripeCustomerBatch)
+			total += moved
+			if err != nil || moved == 0 {
+				fmt.Println("moved", total, "stripe customers to the billing store")
+				return err
+			}
+		}
+	},
+	"rotate-keys": func(args []string) error {
+		pause := rotateKeysPause
+		if len(args) > 0 {
+			var err error
+			if pause, err = time.ParseDuration(args[0]); err != nil {
+				return errors.New("usage: broome rotate-keys [pause between batches]")
+			}
+		}
+
+		for _, r := range keyRotations {
+			total := 0
+			for {
+				n, err := r.rotate(rotateKeysBatch)
+				total += n
+				if err != nil && err != db.ErrNoBillingKey && err != db.ErrNoPIIKey {
+					fmt.Println("moved", total, r.name, "to the current keys")
+					return err
+				}
+				if err != nil || n == 0 {
+					break
+				}
+				time.Sleep(pause)
+			}
+			fmt.Println("moved", total, r.name, "to the current keys")
+		}
+
+		return nil
+	},
+	"encrypt-pii": func(args []string) error {
+		total := 0
+		for _, encrypt := range []func(int) (int, error){db.EncryptDeveloperPII, db.EncryptEmailPII} {
+			for {
+				sealed, err := encrypt(encryptPIIBatch)
+				total += sealed
+				if err != nil {
+					return err
+				}
+				if sealed == 0 {
+					break
+				}
+			}
+		}
+
+		fmt.Println("sealed the PII of", total, "documents under the current key")
+		return nil
+	},
+}
+
+// runCommand runs the named command.
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %s", name)
+	}
+
+	return cmd(args)
+}
+
+// printCounts prints document counts by collection.
+func printCounts(counts map[string]int) {
+	names := []string{}
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("  %-20s %d\n", name, counts[name])
+	}
+}
@@ -0,0 +1,546 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the push of signups and trial-to-paid conversions to HubSpot or
+// Salesforce, so sales can see them in the CRM. Signups and first payments
+// are queued on a schedule and pushed as contacts, deduplicated by email.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// crmSyncEvery is how often signups and conversions are queued and
+	// pushed.
+	crmSyncEvery = 15 * time.Minute
+
+	// Signups and conversions this recent are queued, so a missed run is
+	// caught up by the next.
+	crmLookback = 7 * 24 * time.Hour
+
+	// Pushes that fail this many times are left for the sync status view.
+	crmMaxAttempts = 5
+)
+
+// crmConnector creates or updates a contact in a CRM, returning its id.
+// contactID is the contact already pushed for the email, if there is one.
+type crmConnector interface {
+	tokenURL() string
+	defaultFields() map[string]string
+	upsert(cfg *db.CRMConfig, token, contactID, email string, props map[string]string) (string, error)
+}
+
+var crmConnectors = map[string]crmConnector{
+	db.CRMHubSpot:    &hubspotConnector{API: "https://api.hubapi.com"},
+	db.CRMSalesforce: &salesforceConnector{},
+}
+
+// crmFieldNames are the developer fields that can be mapped onto CRM
+// properties.
+var crmFieldNames = []string{
+	"email", "name", "firstName", "lastName", "company", "plan", "paid",
+	"lifecycle", "engineer", "signedUpAt", "convertedAt",
+}
+
+func init() {
+	schedule("sync-crm", crmSyncEvery, syncCRM)
+}
+
+// crmFields returns the values of the fields for a developer. Developers
+// without a last name use their email's local part, since CRMs require one.
+func crmFields(d *schemas.Developer, s *db.CRMSync) map[string]string {
+	first, last := "", d.Name
+	if i := strings.Index(d.Name, " "); i > 0 {
+		first, last = d.Name[:i], strings.TrimSpace(d.Name[i+1:])
+	}
+	local, domain := d.Email, ""
+	if i := strings.LastIndex(d.Email, "@"); i >= 0 {
+		local, domain = d.Email[:i], d.Email[i+1:]
+	}
+	if last == "" {
+		last = local
+	}
+
+	fields := map[string]string{
+		"email":      d.Email,
+		"name":       d.Name,
+		"firstName":  first,
+		"lastName":   last,
+		"company":    domain,
+		"plan":       developerPlan(d),
+		"paid":       strconv.FormatBool(d.IsPaid),
+		"lifecycle":  "lead",
+		"engineer":   d.IntegrationEngineer,
+		"signedUpAt": time.Unix(0, d.CreatedAt*int64(time.Millisecond)).UTC().Format("2006-01-02"),
+	}
+	if s.Kind == db.CRMConversion {
+		fields["lifecycle"] = "customer"
+		fields["convertedAt"] = s.OccurredAt.UTC().Format("2006-01-02")
+		if s.Plan != "" {
+			fields["plan"] = s.Plan
+		}
+	}
+
+	return fields
+}
+
+// crmProperties maps developer fields onto CRM properties with the config's
+// mapping, or the connector's default if there isn't one.
+func crmProperties(cfg *db.CRMConfig, connector crmConnector, fields map[string]string) map[string]string {
+	mapping := cfg.Fields
+	if len(mapping) == 0 {
+		mapping = connector.defaultFields()
+	}
+
+	props := map[string]string{}
+	for field, prop := range mapping {
+		if v := fields[field]; v != "" && prop != "" {
+			props[prop] = v
+		}
+	}
+	return props
+}
+
+// crmToken returns an access token for the CRM, refreshing it if it's
+// expired.
+func crmToken(cfg *db.CRMConfig, connector crmConnector) (string, error) {
+	if cfg.AccessToken != "" && time.Now().Before(cfg.ExpiresAt.Add(-time.Minute)) {
+		return cfg.AccessToken, nil
+	}
+	if cfg.RefreshToken == "" {
+		return "", errors.New(cfg.Provider + " isn't connected, set a refresh token")
+	}
+
+	access, refresh, expiresAt, err := refreshOAuthToken(cfg.Provider, connector.tokenURL(), cfg.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	cfg.AccessToken = access
+	cfg.RefreshToken = refresh
+	cfg.ExpiresAt = expiresAt
+	return cfg.AccessToken, db.SaveCRMTokens(cfg.AccessToken, cfg.RefreshToken, cfg.ExpiresAt)
+}
+
+// hubspotConnector pushes contacts, upserted by email so a contact created
+// in HubSpot by sales is updated rather than duplicated.
+type hubspotConnector struct {
+	API string
+}
+
+func (h *hubspotConnector) tokenURL() string {
+	return "https://api.hubapi.com/oauth/v1/token"
+}
+
+func (h *hubspotConnector) defaultFields() map[string]string {
+	return map[string]string{
+		"email":     "email",
+		"firstName": "firstname",
+		"lastName":  "lastname",
+		"company":   "company",
+		"lifecycle": "lifecyclestage",
+	}
+}
+
+func (h *hubspotConnector) upsert(cfg *db.CRMConfig, token, contactID, email string, props map[string]string) (string, error) {
+	if contactID != "" {
+		path := h.API + "/crm/v3/objects/contacts/" + url.PathEscape(contactID)
+		return contactID, accountingRequest("PATCH", path, token, nil, map[string]interface{}{"properties": props}, nil)
+	}
+
+	var res struct {
+		Results []struct {
+			ID string `json:"id"`
+		} `json:"results"`
+	}
+	body := map[string]interface{}{
+		"inputs": []interface{}{map[string]interface{}{
+			"idProperty": "email",
+			"id":         email,
+			"properties": props,
+		}},
+	}
+	if err := accountingRequest("POST", h.API+"/crm/v3/objects/contacts/batch/upsert", token, nil, body, &res); err != nil {
+		return "", err
+	}
+	if len(res.Results) == 0 {
+		return "", errors.New("hubspot didn't return the contact")
+	}
+
+	return res.Results[0].ID, nil
+}
+
+// salesforceConnector pushes leads, looking up an existing lead by email
+// before creating one.
+type salesforceConnector struct{}
+
+func (s *salesforceConnector) tokenURL() string {
+	return "https://login.salesforce.com/services/oauth2/token"
+}
+
+func (s *salesforceConnector) defaultFields() map[string]string {
+	return map[string]string{
+		"email":     "Email",
+		"firstName": "FirstName",
+		"lastName":  "LastName",
+		"company":   "Company",
+	}
+}
+
+func (s *salesforceConnector) upsert(cfg *db.CRMConfig, token, contactID, email string, props map[string]string) (string, error) {
+	api := strings.TrimRight(cfg.InstanceURL, "/") + "/services/data/v59.0"
+	if contactID == "" {
+		var found struct {
+			Records []struct {
+				ID string `json:"Id"`
+			} `json:"records"`
+		}
+		escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(email)
+		query := url.Values{"q": {"SELECT Id FROM Lead WHERE Email = '" + escaped + "' LIMIT 1"}}
+		if err := accountingRequest("GET", api+"/query?"+query.Encode(), token, nil, nil, &found); err != nil {
+			return "", err
+		}
+		if len(found.Records) > 0 {
+			contactID = found.Records[0].ID
+		}
+	}
+
+	if contactID != "" {
+		path := api + "/sobjects/Lead/" + url.PathEscape(contactID)
+		return contactID, accountingRequest("PATCH", path, token, nil, props, nil)
+	}
+
+	var res struct {
+		ID string `json:"id"`
+	}
+	if err := accountingRequest("POST", api+"/sobjects/Lead", token, nil, props, &res); err != nil {
+		return "", err
+	}
+
+	return res.ID, nil
+}
+
+// queueCRMSyncs queues signups and first payments since a time. Bowery's
+// own signups aren't pushed.
+func queueCRMSyncs(since time.Time) error {
+	queue := func(s *db.CRMSync) error {
+		if strings.Contains(s.Email, "@bowery.io") {
+			return nil
+		}
+
+		_, err := db.QueueCRMSync(s)
+		return err
+	}
+
+	// Developers store when they signed up in milliseconds.
+	err := db.EachDeveloper(db.ReadReports, bson.M{"createdAt": bson.M{
+		"$gte": since.UnixNano() / int64(time.Millisecond),
+	}}, func(d *schemas.Developer) error {
+		return queue(&db.CRMSync{
+			ID:          db.CRMSignup + ":" + d.ID.Hex(),
+			Kind:        db.CRMSignup,
+			DeveloperID: d.ID,
+			Email:       strings.ToLower(d.Email),
+			OccurredAt:  time.Unix(0, d.CreatedAt*int64(time.Millisecond)),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	conversions := []*db.CRMSync{}
+	ps, err := db.GetRevenuePayments(since, now)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		conversions = append(conversions, &db.CRMSync{DeveloperID: p.DeveloperID, Plan: p.Plan, OccurredAt: p.UpdatedAt})
+	}
+	cs, err := db.GetRevenueCheckouts(since, now)
+	if err != nil {
+		return err
+	}
+	for _, c := range cs {
+		conversions = append(conversions, &db.CRMSync{DeveloperID: c.DeveloperID, Plan: c.Plan, OccurredAt: c.CompletedAt})
+	}
+
+	ids := []bson.ObjectId{}
+	for _, s := range conversions {
+		ids = append(ids, s.DeveloperID)
+	}
+	ds, err := db.GetDevelopersByIDs(db.ReadReports, ids)
+	if err != nil {
+		return err
+	}
+
+	// Only the first payment is a conversion, the id keeps renewals out.
+	sort.Sort(crmSyncsByTime(conversions))
+	for _, s := range conversions {
+		d, ok := ds[s.DeveloperID]
+		if !ok {
+			continue
+		}
+
+		s.ID = db.CRMConversion + ":" + s.DeveloperID.Hex()
+		s.Kind = db.CRMConversion
+		s.Email = strings.ToLower(d.Email)
+		if err := queue(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// crmSyncsByTime sorts syncs oldest first.
+type crmSyncsByTime []*db.CRMSync
+
+func (s crmSyncsByTime) Len() int           { return len(s) }
+func (s crmSyncsByTime) Less(i, j int) bool { return s[i].OccurredAt.Before(s[j].OccurredAt) }
+func (s crmSyncsByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// pushCRM pushes queued signups and conversions to the configured CRM.
+func pushCRM(cfg *db.CRMConfig) error {
+	connector, ok := crmConnectors[cfg.Provider]
+	if !ok {
+		return fmt.Errorf("unknown crm provider %q", cfg.Provider)
+	}
+
+	ss, err := db.GetCRMSyncs(bson.M{
+		"status":   bson.M{"$in": []string{db.SyncPending, db.SyncFailed}},
+		"attempts": bson.M{"$lt": crmMaxAttempts},
+	}, 100)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range ss {
+		d, err := db.GetDeveloper(bson.M{"_id": s.DeveloperID})
+		if err == db.ErrNotFound {
+			err = errors.New("developer no longer exists")
+		}
+		if err != nil {
+			if merr := db.MarkCRMFailed(s.ID, cfg.Provider, err.Error()); merr != nil {
+				return merr
+			}
+			continue
+		}
+
+		// Earlier pushes for the email find the contact without a lookup.
+		contactID, err := db.GetCRMContactID(cfg.Provider, s.Email)
+		if err != nil {
+			return err
+		}
+
+		var id string
+		props := crmProperties(cfg, connector, crmFields(d, s))
+		err = callDependency(context.Background(), "crm", transientError, func() error {
+			token, err := crmToken(cfg, connector)
+			if err != nil {
+				return err
+			}
+
+			id, err = connector.upsert(cfg, token, contactID, s.Email, props)
+			return err
+		})
+		if err == errBreakerOpen {
+			return err
+		}
+		if err != nil {
+			if s.Attempts+1 >= crmMaxAttempts {
+				notifySlackOnce(notificationKey("crm.failed", s.ID), slackChannel("activity"),
+					fmt.Sprintf("Couldn't push %s to %s: %s", s.ID, cfg.Provider, err))
+			}
+			if merr := db.MarkCRMFailed(s.ID, cfg.Provider, err.Error()); merr != nil {
+				return merr
+			}
+			continue
+		}
+
+		if err := db.MarkCRMSynced(s.ID, cfg.Provider, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncCRM queues recent signups and conversions and pushes them, if a CRM
+// is configured.
+func syncCRM() error {
+	cfg, err := db.GetCRMConfig()
+	if err != nil || cfg.Provider == "" {
+		return err
+	}
+
+	if err := queueCRMSyncs(time.Now().Add(-crmLookback)); err != nil {
+		return err
+	}
+	return pushCRM(cfg)
+}
+
+// validateCRMConfig checks the provider is known and the mapping only uses
+// developer fields.
+func validateCRMConfig(c *db.CRMConfig) error {
+	if c.Provider == "" {
+		return nil
+	}
+	if _, ok := crmConnectors[c.Provider]; !ok {
+		return errors.New("Provider must be hubspot or salesforce.")
+	}
+	if c.Provider == db.CRMSalesforce && c.InstanceURL == "" {
+		return errors.New("Instance url Required for Salesforce.")
+	}
+
+	for field, prop := range c.Fields {
+		known := false
+		for _, name := range crmFieldNames {
+			known = known || name == field
+		}
+		if !known {
+			return fmt.Errorf("Unknown field %q, fields are %s.", field, strings.Join(crmFieldNames, ", "))
+		}
+		if prop == "" {
+			return fmt.Errorf("Field %q isn't mapped to a property.", field)
+		}
+	}
+	if len(c.Fields) > 0 && c.Fields["email"] == "" {
+		return errors.New("The email field must be mapped.")
+	}
+
+	return nil
+}
+
+// GET /admin/crm, Gets the CRM provider, field mapping and sync status
+func AdminCRMHandler(rw http.ResponseWriter, req *http.Request) {
+	cfg, err := db.GetCRMConfig()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	counts, err := db.CountCRMSyncs()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	fields := cfg.Fields
+	if connector, ok := crmConnectors[cfg.Provider]; ok && len(fields) == 0 {
+		fields = connector.defaultFields()
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"config":    cfg,
+		"fields":    fields,
+		"connected": cfg.RefreshToken != "",
+		"syncs":     counts,
+	})
+}
+
+// PUT /admin/crm, Updates the CRM provider and field mapping
+func UpdateCRMHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		db.CRMConfig
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateCRMConfig(&body.CRMConfig); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	err := db.SaveCRMMapping(&body.CRMConfig, actor)
+	if err == nil && body.RefreshToken != "" {
+		// Connecting a provider, the access token is fetched on first use.
+		err = db.SaveCRMTokens("", body.RefreshToken, time.Time{})
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "crm.update", actor, body.Provider)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"config": body.CRMConfig,
+	})
+}
+
+// GET /admin/crm/syncs, Lists pushed and pending signups and conversions, filtered by ?status=
+func AdminCRMSyncsHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if status := req.FormValue("status"); status != "" {
+		query["status"] = status
+	}
+	if email := req.FormValue("email"); email != "" {
+		query["email"] = strings.ToLower(email)
+	}
+
+	ss, err := db.GetCRMSyncs(query, 500)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"syncs":  ss,
+	})
+}
+
+// POST /admin/crm/{id}/retry, Puts a failed push back in the queue
+func RetryCRMHandler(rw http.ResponseWriter, req *http.Request) {
+	err := db.RetryCRMSync(mux.Vars(req)["id"])
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
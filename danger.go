@@ -0,0 +1,385 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the admin danger zone. Actions like refunds and revoking
+// licenses need the admin to have re-entered their password recently (sudo
+// mode), and actions listed in the settings' approvals also need a second
+// admin to sign off. Each step is recorded in the audit log.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// sudoWindow is how long a re-authentication lasts.
+	sudoWindow = 10 * time.Minute
+
+	// approvalWindow is how long a request waits for a second admin, and
+	// then how long the approval can be used.
+	approvalWindow = 24 * time.Hour
+
+	sudoHeader     = "X-Sudo-Token"
+	sudoCookie     = "broome_sudo"
+	approvalHeader = "X-Approval-Id"
+
+	// maxApprovalBody caps the body hashed for an approval.
+	maxApprovalBody = 1 << 20
+)
+
+// needsApproval reports whether the settings require a second admin for
+// action.
+func needsApproval(action string) bool {
+	for _, a := range getSettings().Approvals {
+		if a == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sudoToken returns the sudo token sent with req.
+func sudoToken(req *http.Request) string {
+	if token := req.Header.Get(sudoHeader); token != "" {
+		return token
+	}
+	if c, err := req.Cookie(sudoCookie); err == nil {
+		return c.Value
+	}
+
+	return ""
+}
+
+// sudoAdmin returns the admin making req if they're in sudo mode.
+func sudoAdmin(req *http.Request) (*schemas.Developer, error) {
+	dev, err := currentDeveloper(req)
+	if err != nil {
+		return nil, err
+	}
+	if !dev.IsAdmin {
+		return nil, fmt.Errorf("%s isn't an admin", dev.Email)
+	}
+
+	token := sudoToken(req)
+	if token == "" {
+		return nil, errors.New("Re-authenticate at /admin/sudo first.")
+	}
+	s, err := db.GetSudoSession(token)
+	if err != nil || s.DeveloperID != dev.ID {
+		return nil, errors.New("Sudo session expired, re-authenticate at /admin/sudo.")
+	}
+
+	return dev, nil
+}
+
+// requireAdmin wraps a handler so only admins can call it.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		dev, err := currentDeveloper(req)
+		if err == nil && !dev.IsAdmin {
+			err = fmt.Errorf("%s isn't an admin", dev.Email)
+		}
+		if err != nil {
+			renderer.JSON(rw, http.StatusForbidden, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+// requireSudo wraps a handler so only admins in sudo mode can call it.
+func requireSudo(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if _, err := sudoAdmin(req); err != nil {
+			renderer.JSON(rw, http.StatusForbidden, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+// dangerous wraps a danger zone handler. The admin must be in sudo mode, and
+// if action needs approval the first request is held for a second admin
+// and replayed with its approval id in the X-Approval-Id header.
+func dangerous(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		dev, err := sudoAdmin(req)
+		if err != nil {
+			audit(req, "danger.denied", "", action+": "+err.Error())
+			renderer.JSON(rw, http.StatusForbidden, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		detail := action
+		if needsApproval(action) {
+			id := req.Header.Get(approvalHeader)
+			if id == "" {
+				requestApproval(rw, req, dev, action)
+				return
+			}
+
+			ok := false
+			hash, herr := requestHash(req)
+			if herr != nil {
+				err = herr
+			} else if bson.IsObjectIdHex(id) {
+				ok, err = db.UseApproval(bson.ObjectIdHex(id), action, req.Method, req.URL.Path, hash, dev.Email)
+			}
+			if err != nil || !ok {
+				msg := "Approval isn't approved for this request."
+				if err != nil {
+					msg = err.Error()
+				}
+				renderer.JSON(rw, http.StatusForbidden, map[string]string{
+					"status": requests.StatusFailed,
+					"error":  msg,
+				})
+				return
+			}
+			detail += " approval " + id
+		}
+
+		audit(req, "danger."+action, dev.Email, detail)
+		handler(rw, req)
+	}
+}
+
+// requestHash hashes the query and body of req so an approval only covers
+// the request it was asked for. JSON bodies are re-encoded first so key
+// order and spacing don't matter, and the reason given isn't included. The
+// body is left intact for the handler.
+func requestHash(req *http.Request) (string, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxApprovalBody+1))
+		if err != nil {
+			return "", err
+		}
+		if len(body) > maxApprovalBody {
+			return "", errors.New("request body is too large")
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		if m, ok := v.(map[string]interface{}); ok {
+			delete(m, "reason")
+		}
+		body, _ = json.Marshal(v)
+	}
+
+	query := req.URL.Query()
+	query.Del("reason")
+
+	h := sha256.New()
+	h.Write([]byte(query.Encode() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// requestApproval holds a danger zone request for a second admin.
+func requestApproval(rw http.ResponseWriter, req *http.Request, dev *schemas.Developer, action string) {
+	hash, err := requestHash(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	a := &db.Approval{
+		Action:      action,
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		RequestHash: hash,
+		Reason:      req.FormValue("reason"),
+		RequestedBy: dev.Email,
+		ExpiresAt:   time.Now().Add(approvalWindow),
+	}
+	if err = db.SaveApproval(a); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	audit(req, "danger.requested", dev.Email, action+" approval "+a.ID.Hex())
+	go notifySlack(slackChannel("admin"), fmt.Sprintf("%s wants to %s %s, approve %s at /admin/approvals/%s/approve",
+		dev.Email, req.Method, req.URL.Path, action, a.ID.Hex()))
+
+	renderer.JSON(rw, http.StatusAccepted, map[string]interface{}{
+		"status":   requests.StatusCreated,
+		"approval": a,
+	})
+}
+
+// POST /admin/sudo, Re-checks the admin's password and starts a sudo session
+func SudoHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	dev, err := currentDeveloper(req)
+	if err != nil || !dev.IsAdmin || body.Password == "" ||
+		dev.Password != util.HashPassword(body.Password, dev.Salt) {
+		audit(req, "sudo.failed", "", "")
+		renderer.JSON(rw, http.StatusUnauthorized, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Password is incorrect.",
+		})
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	s := &db.SudoSession{
+		ID:          hex.EncodeToString(secret),
+		DeveloperID: dev.ID,
+		Email:       dev.Email,
+		IP:          clientIP(req),
+		ExpiresAt:   time.Now().Add(sudoWindow),
+	}
+	if err := db.SaveSudoSession(s); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "sudo.granted", dev.Email, "until "+s.ExpiresAt.UTC().Format(time.RFC3339))
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     sudoCookie,
+		Value:    s.ID,
+		Path:     "/admin",
+		Expires:  s.ExpiresAt,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+	})
+	rw.Header().Set(sudoHeader, s.ID)
+	renderer.JSON(rw, http.StatusCreated, map[string]interface{}{
+		"status":    requests.StatusCreated,
+		"sudoToken": s.ID,
+		"expiresAt": s.ExpiresAt,
+	})
+}
+
+// GET /admin/approvals, Lists danger zone requests, pending ones by default
+func AdminApprovalsHandler(rw http.ResponseWriter, req *http.Request) {
+	status := req.FormValue("status")
+	if status == "" {
+		status = db.ApprovalPending
+	}
+
+	as, err := db.GetApprovals(bson.M{"status": status}, 100)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"approvals": as,
+	})
+}
+
+// POST /admin/approvals/{id}/approve, Approves another admin's danger zone request
+func ApproveHandler(rw http.ResponseWriter, req *http.Request) {
+	decideApproval(rw, req, db.ApprovalApproved)
+}
+
+// POST /admin/approvals/{id}/deny, Denies another admin's danger zone request
+func DenyHandler(rw http.ResponseWriter, req *http.Request) {
+	decideApproval(rw, req, db.ApprovalDenied)
+}
+
+// decideApproval approves or denies a pending request. Admins can't decide
+// their own.
+func decideApproval(rw http.ResponseWriter, req *http.Request, status string) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid approval id",
+		})
+		return
+	}
+
+	dev, err := sudoAdmin(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusForbidden, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	err = db.DecideApproval(bson.ObjectIdHex(id), status, dev.Email)
+	if err == db.ErrConflict {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Approval isn't pending or was requested by you.",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	audit(req, "danger."+status, dev.Email, "approval "+id)
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
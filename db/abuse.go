@@ -0,0 +1,133 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Abuse case states. Cases start open, are investigated, then closed as
+// actioned or dismissed.
+const (
+	AbuseOpen          = "open"
+	AbuseInvestigating = "investigating"
+	AbuseActioned      = "actioned"
+	AbuseDismissed     = "dismissed"
+)
+
+// AbuseNote is an admin's note or status change on a case.
+type AbuseNote struct {
+	Author    string    `bson:"author" json:"author"`
+	Status    string    `bson:"status,omitempty" json:"status,omitempty"`
+	Text      string    `bson:"text,omitempty" json:"text,omitempty"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// AbuseCase is a report of an abusive account from a third party, linked
+// to the developer it's about if they could be found.
+type AbuseCase struct {
+	ID            bson.ObjectId `bson:"_id" json:"id"`
+	ReporterEmail string        `bson:"reporterEmail" json:"reporterEmail"`
+	ReporterIP    string        `bson:"reporterIp" json:"reporterIp"`
+	Category      string        `bson:"category" json:"category"`
+	Account       string        `bson:"account" json:"account"`
+	Description   string        `bson:"description" json:"description"`
+	Evidence      []string      `bson:"evidence,omitempty" json:"evidence,omitempty"`
+	DeveloperID   bson.ObjectId `bson:"developerId,omitempty" json:"developerId,omitempty"`
+	Status        string        `bson:"status" json:"status"`
+	Assignee      string        `bson:"assignee" json:"assignee"`
+	Notes         []*AbuseNote  `bson:"notes" json:"notes"`
+	CreatedAt     time.Time     `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time     `bson:"updatedAt" json:"updatedAt"`
+}
+
+var abuseCases *mgo.Collection
+
+func init() {
+	abuseCases = Client.Db.C("abuseCases")
+	ensureIndex(abuseCases, mgo.Index{Key: []string{"status", "-createdAt"}})
+	ensureIndex(abuseCases, mgo.Index{Key: []string{"developerId"}})
+}
+
+// SaveAbuseCase stores a new case.
+func SaveAbuseCase(c *AbuseCase) error {
+	c.ID = bson.NewObjectId()
+	c.Status = AbuseOpen
+	c.Notes = []*AbuseNote{}
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	return abuseCases.Insert(c)
+}
+
+// GetAbuseCase returns the case with the id.
+func GetAbuseCase(id bson.ObjectId) (*AbuseCase, error) {
+	c := &AbuseCase{}
+	return c, abuseCases.FindId(id).One(c)
+}
+
+// GetAbuseCases returns cases matching the query, newest first.
+func GetAbuseCases(query bson.M, limit int) ([]*AbuseCase, error) {
+	cs := []*AbuseCase{}
+	return cs, abuseCases.Find(query).Sort("-createdAt").Limit(limit).All(&cs)
+}
+
+// CountOpenAbuseCases returns how many unclosed cases each admin has.
+func CountOpenAbuseCases() (map[string]int, error) {
+	var rows []struct {
+		Assignee string `bson:"_id"`
+		Count    int    `bson:"count"`
+	}
+	err := abuseCases.Pipe([]bson.M{
+		{"$match": bson.M{"status": bson.M{"$in": []string{AbuseOpen, AbuseInvestigating}}}},
+		{"$group": bson.M{"_id": "$assignee", "count": bson.M{"$sum": 1}}},
+	}).All(&rows)
+
+	counts := map[string]int{}
+	for _, row := range rows {
+		counts[row.Assignee] = row.Count
+	}
+	return counts, err
+}
+
+// UpdateAbuseCase sets fields on a case in the given status and adds a
+// note, returning ErrConflict if the case has moved on.
+func UpdateAbuseCase(id bson.ObjectId, status string, update bson.M, note *AbuseNote) error {
+	note.CreatedAt = time.Now()
+	update["updatedAt"] = note.CreatedAt
+
+	err := abuseCases.Update(bson.M{"_id": id, "status": status}, bson.M{
+		"$set":  update,
+		"$push": bson.M{"notes": note},
+	})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+
+	return err
+}
+
+// GetAdminEmails returns the emails of every admin.
+func GetAdminEmails() ([]string, error) {
+	var rows []struct {
+		Email string `bson:"email"`
+	}
+	err := devs.Find(bson.M{"isAdmin": true}).Select(bson.M{"email": 1}).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sealed emails can't be sorted by Mongo.
+	emails := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if err := openPIIFields(&row.Email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, row.Email)
+	}
+	sort.Strings(emails)
+
+	return emails, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Accounting providers.
+const (
+	AccountingQuickBooks = "quickbooks"
+	AccountingXero       = "xero"
+)
+
+// Accounting transaction kinds.
+const (
+	AccountingCharge = "charge"
+	AccountingRefund = "refund"
+)
+
+// Accounting sync states.
+const (
+	SyncPending = "pending"
+	SyncSynced  = "synced"
+	SyncFailed  = "failed"
+)
+
+// AccountingConfig is where transactions are exported to and how they map
+// onto the provider's accounts. Plans without an item use DefaultItem.
+type AccountingConfig struct {
+	Provider       string            `bson:"provider" json:"provider"`
+	CompanyID      string            `bson:"companyId" json:"companyId"`
+	DepositAccount string            `bson:"depositAccount" json:"depositAccount"`
+	IncomeAccount  string            `bson:"incomeAccount" json:"incomeAccount"`
+	RefundAccount  string            `bson:"refundAccount" json:"refundAccount"`
+	DefaultItem    string            `bson:"defaultItem" json:"defaultItem"`
+	PlanItems      map[string]string `bson:"planItems" json:"planItems"`
+	TaxCode        string            `bson:"taxCode" json:"taxCode"`
+
+	// OAuth tokens, rotated by the provider on every refresh.
+	AccessToken  string    `bson:"accessToken" json:"-"`
+	RefreshToken string    `bson:"refreshToken" json:"-"`
+	ExpiresAt    time.Time `bson:"expiresAt" json:"-"`
+
+	UpdatedBy string    `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// AccountingSync is a settled transaction to export, keyed by its source so
+// it's only exported once.
+type AccountingSync struct {
+	ID          string        `bson:"_id" json:"id"`
+	Kind        string        `bson:"kind" json:"kind"`
+	DeveloperID bson.ObjectId `bson:"developerId,omitempty" json:"developerId,omitempty"`
+	Plan        string        `bson:"plan" json:"plan"`
+	Amount      int64         `bson:"amount" json:"amount"`
+	Currency    string        `bson:"currency" json:"currency"`
+	OccurredAt  time.Time     `bson:"occurredAt" json:"occurredAt"`
+	Status      string        `bson:"status" json:"status"`
+	Provider    string        `bson:"provider,omitempty" json:"provider,omitempty"`
+	ExternalID  string        `bson:"externalId,omitempty" json:"externalId,omitempty"`
+	Attempts    int           `bson:"attempts" json:"attempts"`
+	Error       string        `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	SyncedAt    time.Time     `bson:"syncedAt,omitempty" json:"syncedAt,omitempty"`
+}
+
+// There's one accounting config per deployment, stored under this id.
+const accountingConfigID = "default"
+
+var (
+	accountingConfigs *mgo.Collection
+	accountingSyncs   *mgo.Collection
+)
+
+func init() {
+	accountingConfigs = Client.Db.C("accountingConfigs")
+	accountingSyncs = Client.Db.C("accountingSyncs")
+	ensureIndex(accountingSyncs, mgo.Index{Key: []string{"status", "occurredAt"}})
+}
+
+// GetAccountingConfig returns the saved config, empty if there isn't one.
+func GetAccountingConfig() (*AccountingConfig, error) {
+	c := &AccountingConfig{}
+	err := accountingConfigs.FindId(accountingConfigID).One(c)
+	if err == mgo.ErrNotFound {
+		return c, nil
+	}
+
+	return c, err
+}
+
+// SaveAccountingMapping replaces the provider and account mapping, keeping
+// the tokens.
+func SaveAccountingMapping(c *AccountingConfig, updatedBy string) error {
+	_, err := accountingConfigs.UpsertId(accountingConfigID, bson.M{"$set": bson.M{
+		"provider":       c.Provider,
+		"companyId":      c.CompanyID,
+		"depositAccount": c.DepositAccount,
+		"incomeAccount":  c.IncomeAccount,
+		"refundAccount":  c.RefundAccount,
+		"defaultItem":    c.DefaultItem,
+		"planItems":      c.PlanItems,
+		"taxCode":        c.TaxCode,
+		"updatedBy":      updatedBy,
+		"updatedAt":      time.Now(),
+	}})
+	return err
+}
+
+// SaveAccountingTokens stores refreshed OAuth tokens.
+func SaveAccountingTokens(access, refresh string, expiresAt time.Time) error {
+	_, err := accountingConfigs.UpsertId(accountingConfigID, bson.M{"$set": bson.M{
+		"accessToken":  access,
+		"refreshToken": refresh,
+		"expiresAt":    expiresAt,
+	}})
+	return err
+}
+
+// QueueAccountingSync records a transaction to export, returning false if
+// it was already queued.
+func QueueAccountingSync(s *AccountingSync) (bool, error) {
+	s.Status = SyncPending
+	s.CreatedAt = time.Now()
+
+	err := accountingSyncs.Insert(s)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetAccountingSyncs returns syncs matching the query, oldest first.
+func GetAccountingSyncs(query bson.M, limit int) ([]*AccountingSync, error) {
+	ss := []*AccountingSync{}
+	return ss, accountingSyncs.Find(query).Sort("occurredAt").Limit(limit).All(&ss)
+}
+
+// MarkAccountingSynced records where a transaction was exported to.
+func MarkAccountingSynced(id, provider, externalID string) error {
+	return accountingSyncs.UpdateId(id, bson.M{
+		"$set": bson.M{
+			"status":     SyncSynced,
+			"provider":   provider,
+			"externalId": externalID,
+			"syncedAt":   time.Now(),
+			"error":      "",
+		},
+		"$inc": bson.M{"attempts": 1},
+	})
+}
+
+// MarkAccountingFailed records a failed export.
+func MarkAccountingFailed(id, provider, msg string) error {
+	return accountingSyncs.UpdateId(id, bson.M{
+		"$set": bson.M{"status": SyncFailed, "provider": provider, "error": msg},
+		"$inc": bson.M{"attempts": 1},
+	})
+}
+
+// RetryAccountingSync puts a failed sync back in the queue.
+func RetryAccountingSync(id string) error {
+	return accountingSyncs.Update(bson.M{"_id": id, "status": SyncFailed}, bson.M{
+		"$set": bson.M{"status": SyncPending, "attempts": 0},
+	})
+}
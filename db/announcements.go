@@ -0,0 +1,111 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Announcement is a notice shown by the CLI and dashboard. Plans and the
+// version range narrow who sees it, empty values match everyone.
+type Announcement struct {
+	ID         bson.ObjectId `bson:"_id" json:"id"`
+	Title      string        `bson:"title" json:"title"`
+	Body       string        `bson:"body" json:"body"`
+	Kind       string        `bson:"kind" json:"kind"`
+	Plans      []string      `bson:"plans" json:"plans,omitempty"`
+	MinVersion string        `bson:"minVersion" json:"minVersion,omitempty"`
+	MaxVersion string        `bson:"maxVersion" json:"maxVersion,omitempty"`
+	StartsAt   time.Time     `bson:"startsAt" json:"startsAt"`
+	EndsAt     time.Time     `bson:"endsAt,omitempty" json:"endsAt,omitempty"`
+	CreatedAt  time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+var (
+	announcements     *mgo.Collection
+	announcementReads *mgo.Collection
+)
+
+func init() {
+	announcements = Client.Db.C("announcements")
+	announcementReads = Client.Db.C("announcementReads")
+
+	ensureIndex(announcementReads, mgo.Index{Key: []string{"developerId", "announcementId"}, Unique: true})
+	ensureIndex(announcementReads, mgo.Index{Key: []string{"announcementId"}})
+}
+
+func SaveAnnouncement(a *Announcement) error {
+	if a.ID == "" {
+		a.ID = bson.NewObjectId()
+	}
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now()
+	}
+	if a.StartsAt.IsZero() {
+		a.StartsAt = a.CreatedAt
+	}
+	return announcements.Insert(a)
+}
+
+func GetAnnouncement(query bson.M) (*Announcement, error) {
+	a := &Announcement{}
+	return a, announcements.Find(query).One(a)
+}
+
+func GetAnnouncements(query bson.M) ([]*Announcement, error) {
+	as := []*Announcement{}
+	return as, announcements.Find(query).Sort("-startsAt").All(&as)
+}
+
+// GetLiveAnnouncements returns announcements scheduled to show at t.
+func GetLiveAnnouncements(t time.Time) ([]*Announcement, error) {
+	return GetAnnouncements(bson.M{
+		"startsAt": bson.M{"$lte": t},
+		"$or": []bson.M{
+			{"endsAt": bson.M{"$exists": false}},
+			{"endsAt": time.Time{}},
+			{"endsAt": bson.M{"$gt": t}},
+		},
+	})
+}
+
+func UpdateAnnouncement(id bson.ObjectId, update bson.M) error {
+	return announcements.UpdateId(id, bson.M{"$set": update})
+}
+
+// DeleteAnnouncement removes the announcement and who has read it.
+func DeleteAnnouncement(id bson.ObjectId) error {
+	if err := announcements.RemoveId(id); err != nil {
+		return err
+	}
+
+	_, err := announcementReads.RemoveAll(bson.M{"announcementId": id})
+	return err
+}
+
+// MarkAnnouncementRead records that the developer has seen the announcement.
+// Reads are kept a document each so announcements don't grow with every
+// developer that reads them.
+func MarkAnnouncementRead(id, developerID bson.ObjectId) error {
+	_, err := announcementReads.Upsert(bson.M{"developerId": developerID, "announcementId": id},
+		bson.M{"$setOnInsert": bson.M{"readAt": time.Now()}})
+	return err
+}
+
+// GetReadAnnouncements returns which of the announcements the developer has
+// seen.
+func GetReadAnnouncements(developerID bson.ObjectId, ids []bson.ObjectId) (map[bson.ObjectId]bool, error) {
+	reads := []struct {
+		AnnouncementID bson.ObjectId `bson:"announcementId"`
+	}{}
+	err := announcementReads.Find(bson.M{"developerId": developerID, "announcementId": bson.M{"$in": ids}}).
+		Select(bson.M{"announcementId": 1}).All(&reads)
+
+	read := map[bson.ObjectId]bool{}
+	for _, r := range reads {
+		read[r.AnnouncementID] = true
+	}
+	return read, err
+}
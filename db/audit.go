@@ -0,0 +1,112 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// AuditLog records a security relevant action. Actions on a developer's
+// account have DeveloperID set, so they can be shown to the developer.
+type AuditLog struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Action      string        `bson:"action" json:"action"`
+	Actor       string        `bson:"actor" json:"actor"`
+	ActorHash   string        `bson:"actorHash,omitempty" json:"-"`
+	DeveloperID bson.ObjectId `bson:"developerId,omitempty" json:"developerId,omitempty"`
+	IP          string        `bson:"ip" json:"ip"`
+	Country     string        `bson:"country,omitempty" json:"country,omitempty"`
+	Method      string        `bson:"method" json:"method"`
+	Path        string        `bson:"path" json:"path"`
+	Detail      string        `bson:"detail" json:"detail,omitempty"`
+	Exported    bool          `bson:"exported" json:"-"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+var auditLogs *mgo.Collection
+
+func init() {
+	auditLogs = Client.Db.C("auditLogs")
+	ensureIndex(auditLogs, mgo.Index{Key: []string{"developerId", "-createdAt"}, Sparse: true})
+	ensureIndex(auditLogs, mgo.Index{Key: []string{"-createdAt"}})
+	ensureIndex(auditLogs, mgo.Index{Key: []string{"actor", "-createdAt"}})
+	ensureIndex(auditLogs, mgo.Index{Key: []string{"actorHash", "-createdAt"}, Sparse: true})
+	ensureIndex(auditLogs, mgo.Index{Key: []string{"exported", "createdAt"}})
+}
+
+func SaveAuditLog(l *AuditLog) error {
+	if l.ID == "" {
+		l.ID = bson.NewObjectId()
+	}
+	if l.CreatedAt.IsZero() {
+		l.CreatedAt = time.Now()
+	}
+
+	sealed := *l
+	if err := sealEmail(&sealed.Actor, &sealed.ActorHash); err != nil {
+		return err
+	}
+	return auditLogs.Insert(&sealed)
+}
+
+// GetAuditLogs returns the newest logs first. An actor in the query matches
+// by its hash too, sealed actors can't be compared.
+func GetAuditLogs(query bson.M, limit int) ([]*AuditLog, error) {
+	if actor, ok := query["actor"].(string); ok {
+		q := bson.M{}
+		for key, v := range query {
+			q[key] = v
+		}
+		delete(q, "actor")
+		match := emailFieldQuery("actor", actor)
+		if and, ok := query["$and"]; ok {
+			q["$and"] = []interface{}{bson.M{"$and": and}, match}
+		} else {
+			q["$and"] = []interface{}{match}
+		}
+		query = q
+	}
+
+	ls := []*AuditLog{}
+	if err := auditLogs.Find(query).Sort("-createdAt").Limit(limit).All(&ls); err != nil {
+		return ls, err
+	}
+
+	return ls, openAuditLogs(ls)
+}
+
+// openAuditLogs opens the actors of logs in place.
+func openAuditLogs(ls []*AuditLog) error {
+	for _, l := range ls {
+		if err := openPIIFields(&l.Actor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unexportedAuditLogs matches logs not yet exported, including those saved
+// before logs were exported at all.
+var unexportedAuditLogs = bson.M{"exported": bson.M{"$ne": true}}
+
+// GetUnexportedAuditLogs returns the oldest logs not yet exported.
+func GetUnexportedAuditLogs(limit int) ([]*AuditLog, error) {
+	ls := []*AuditLog{}
+	if err := auditLogs.Find(unexportedAuditLogs).Sort("createdAt").Limit(limit).All(&ls); err != nil {
+		return ls, err
+	}
+
+	return ls, openAuditLogs(ls)
+}
+
+func CountUnexportedAuditLogs() (int, error) {
+	return auditLogs.Find(unexportedAuditLogs).Count()
+}
+
+func MarkAuditLogsExported(ids []bson.ObjectId) error {
+	_, err := auditLogs.UpdateAll(bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"exported": true}})
+	return err
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Backfill statuses.
+const (
+	BackfillPending   = "pending"
+	BackfillRunning   = "running"
+	BackfillPaused    = "paused"
+	BackfillDone      = "done"
+	BackfillFailed    = "failed"
+	BackfillCancelled = "cancelled"
+)
+
+// Backfill is a run of a data repair over every developer. Checkpoint is
+// the id of the last developer processed, so a run that stops picks up
+// after it. Owner is the instance running it, which heartbeats each chunk.
+type Backfill struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Name        string        `bson:"name" json:"name"`
+	Status      string        `bson:"status" json:"status"`
+	DryRun      bool          `bson:"dryRun" json:"dryRun"`
+	Rate        int           `bson:"rate" json:"rate"`
+	Priority    bool          `bson:"priority" json:"priority"`
+	Total       int           `bson:"total" json:"total"`
+	Processed   int           `bson:"processed" json:"processed"`
+	Changed     int           `bson:"changed" json:"changed"`
+	Errors      int           `bson:"errors" json:"errors"`
+	LastError   string        `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	Checkpoint  bson.ObjectId `bson:"checkpoint,omitempty" json:"checkpoint,omitempty"`
+	Owner       string        `bson:"owner,omitempty" json:"owner,omitempty"`
+	HeartbeatAt time.Time     `bson:"heartbeatAt,omitempty" json:"heartbeatAt,omitempty"`
+	StartedBy   string        `bson:"startedBy" json:"startedBy"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	FinishedAt  time.Time     `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+}
+
+var backfills *mgo.Collection
+
+func init() {
+	backfills = Client.Db.C("backfills")
+	ensureIndex(backfills, mgo.Index{Key: []string{"status", "heartbeatAt"}})
+	ensureIndex(backfills, mgo.Index{Key: []string{"-priority", "createdAt"}})
+	ensureIndex(backfills, mgo.Index{Key: []string{"-createdAt"}})
+}
+
+func SaveBackfill(b *Backfill) error {
+	if b.ID == "" {
+		b.ID = bson.NewObjectId()
+	}
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = time.Now()
+	}
+	if b.Status == "" {
+		b.Status = BackfillPending
+	}
+
+	return backfills.Insert(b)
+}
+
+func GetBackfill(id bson.ObjectId) (*Backfill, error) {
+	b := &Backfill{}
+	return b, backfills.FindId(id).One(b)
+}
+
+// GetBackfills returns the newest backfills first.
+func GetBackfills(limit int) ([]*Backfill, error) {
+	bs := []*Backfill{}
+	return bs, backfills.Find(nil).Sort("-createdAt").Limit(limit).All(&bs)
+}
+
+// ClaimBackfill gives owner a pending backfill, or a running one whose
+// owner stopped heartbeating before stale, prioritized ones first. It
+// returns ErrNotFound if there isn't one to run.
+func ClaimBackfill(owner string, stale time.Time) (*Backfill, error) {
+	b := &Backfill{}
+	_, err := backfills.Find(bson.M{"$or": []bson.M{
+		{"status": BackfillPending},
+		{"status": BackfillRunning, "heartbeatAt": bson.M{"$lt": stale}},
+	}}).Sort("-priority", "createdAt").Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": BackfillRunning, "owner": owner, "heartbeatAt": time.Now()}},
+		ReturnNew: true,
+	}, b)
+
+	return b, err
+}
+
+// CheckpointBackfill records progress on a backfill owner is running. It
+// returns ErrConflict if owner no longer has it running, e.g. it was
+// paused, so the owner stops.
+func CheckpointBackfill(b *Backfill, owner string) error {
+	err := backfills.Update(bson.M{"_id": b.ID, "owner": owner, "status": BackfillRunning}, bson.M{"$set": bson.M{
+		"total":       b.Total,
+		"processed":   b.Processed,
+		"changed":     b.Changed,
+		"errors":      b.Errors,
+		"lastError":   b.LastError,
+		"checkpoint":  b.Checkpoint,
+		"heartbeatAt": time.Now(),
+	}})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
+
+// SetBackfillStatus moves a backfill to status if it's in one of from. It
+// returns ErrConflict if it isn't.
+func SetBackfillStatus(id bson.ObjectId, from []string, status string) error {
+	set := bson.M{"status": status}
+	if status == BackfillDone || status == BackfillFailed || status == BackfillCancelled {
+		set["finishedAt"] = time.Now()
+	}
+	if status != BackfillRunning {
+		set["owner"] = ""
+	}
+
+	err := backfills.Update(bson.M{"_id": id, "status": bson.M{"$in": from}}, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
+
+// GetDeveloperDocumentsAfter returns up to limit whole developer documents
+// with ids after the one given, in id order. An empty id starts from the
+// beginning.
+func GetDeveloperDocumentsAfter(after bson.ObjectId, limit int) ([]bson.M, error) {
+	query := bson.M{}
+	if after != "" {
+		query["_id"] = bson.M{"$gt": after}
+	}
+
+	docs := []bson.M{}
+	if err := devs.Find(query).Sort("_id").Limit(limit).All(&docs); err != nil {
+		return docs, err
+	}
+
+	return docs, openDeveloperDocs(docs)
+}
+
+// PrioritizeBackfill makes a pending backfill the next one claimed. It
+// returns ErrConflict if it isn't pending.
+func PrioritizeBackfill(id bson.ObjectId) error {
+	err := backfills.Update(bson.M{"_id": id, "status": BackfillPending}, bson.M{"$set": bson.M{"priority": true}})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Backup statuses.
+const (
+	BackupCompleted = "completed"
+	BackupVerified  = "verified"
+	BackupFailed    = "failed"
+	BackupRotated   = "rotated"
+)
+
+// BackupCollections are the developers and the collections that belong to
+// them, dumped by each backup.
+var BackupCollections = []string{
+	"developers",
+	"deletedDevelopers",
+	"legalHolds",
+	"organizations",
+	"plans",
+	"planChanges",
+	"payments",
+	"checkouts",
+	"refundRequests",
+	"grants",
+	"licenses",
+	"waitlist",
+	"auditLogs",
+}
+
+// Backup records an archive of BackupCollections.
+type Backup struct {
+	ID          bson.ObjectId  `bson:"_id" json:"id"`
+	Key         string         `bson:"key" json:"key"`
+	Size        int            `bson:"size" json:"size"`
+	Collections map[string]int `bson:"collections" json:"collections"`
+	Status      string         `bson:"status" json:"status"`
+	Error       string         `bson:"error,omitempty" json:"error,omitempty"`
+	VerifiedAt  time.Time      `bson:"verifiedAt,omitempty" json:"verifiedAt,omitempty"`
+	CreatedAt   time.Time      `bson:"createdAt" json:"createdAt"`
+}
+
+var backups *mgo.Collection
+
+func init() {
+	backups = Client.Db.C("backups")
+	ensureIndex(backups, mgo.Index{Key: []string{"-createdAt"}})
+}
+
+func SaveBackup(b *Backup) error {
+	if b.ID == "" {
+		b.ID = bson.NewObjectId()
+	}
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = time.Now()
+	}
+
+	_, err := backups.UpsertId(b.ID, b)
+	return err
+}
+
+// GetBackups returns the newest backups first.
+func GetBackups(query bson.M, limit int) ([]*Backup, error) {
+	bs := []*Backup{}
+	return bs, backups.Find(query).Sort("-createdAt").Limit(limit).All(&bs)
+}
+
+// DumpCollection writes every document in a collection to w as BSON, the
+// same format as mongodump, returning how many were written.
+func DumpCollection(name string, w io.Writer) (int, error) {
+	c, done := readFrom(ReadReports, Client.Db.C(name))
+	defer done()
+
+	n := 0
+	doc := bson.Raw{}
+	iter := c.Find(nil).Sort("_id").Iter()
+	for iter.Next(&doc) {
+		if _, err := w.Write(doc.Data); err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+	}
+
+	return n, iter.Close()
+}
+
+// RestoreCollection inserts the BSON documents read from r into a
+// collection of the named database, returning how many were inserted.
+func RestoreCollection(database, name string, r io.Reader) (int, error) {
+	c := Client.Db.Session.DB(database).C(name)
+
+	n := 0
+	for {
+		var size int32
+		err := binary.Read(r, binary.LittleEndian, &size)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if size < 5 {
+			return n, errors.New("invalid document in " + name)
+		}
+
+		data := make([]byte, size)
+		binary.LittleEndian.PutUint32(data, uint32(size))
+		if _, err := io.ReadFull(r, data[4:]); err != nil {
+			return n, err
+		}
+		if err := c.Insert(bson.Raw{Kind: 3, Data: data}); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// CloneCollection copies every document in a live collection into a
+// collection of the named database, passing each through fn first,
+// returning how many were copied.
+func CloneCollection(database, name string, fn func(bson.M) (bson.M, error)) (int, error) {
+	src, done := readFrom(ReadReports, Client.Db.C(name))
+	defer done()
+	dst := Client.Db.Session.DB(database).C(name)
+
+	n := 0
+	doc := bson.M{}
+	iter := src.Find(nil).Sort("_id").Batch(developerStreamBatch).Iter()
+	for iter.Next(&doc) {
+		clone, err := fn(doc)
+		if err == nil {
+			err = dst.Insert(clone)
+		}
+		if err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+		doc = bson.M{}
+	}
+
+	return n, iter.Close()
+}
+
+// CountCollection returns how many documents a collection of the named
+// database has.
+func CountCollection(database, name string) (int, error) {
+	return Client.Db.Session.DB(database).C(name).Count()
+}
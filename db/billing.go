@@ -0,0 +1,109 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// BillingAddress is printed on invoices. Country is an ISO 3166 alpha-2 code.
+type BillingAddress struct {
+	Line1      string    `bson:"line1" json:"line1"`
+	Line2      string    `bson:"line2,omitempty" json:"line2,omitempty"`
+	City       string    `bson:"city" json:"city"`
+	State      string    `bson:"state,omitempty" json:"state,omitempty"`
+	PostalCode string    `bson:"postalCode" json:"postalCode"`
+	Country    string    `bson:"country" json:"country"`
+	UpdatedAt  time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// InvoiceDetails are printed on a customer's invoices and receipts, for
+// enterprises that need a purchase order number to pay.
+type InvoiceDetails struct {
+	PONumber string `bson:"poNumber,omitempty" json:"poNumber,omitempty"`
+	Memo     string `bson:"memo,omitempty" json:"memo,omitempty"`
+}
+
+// BillingContact receives a developer's receipts and payment emails. With CC
+// set the developer gets them too.
+type BillingContact struct {
+	Email string `bson:"email" json:"email"`
+	Name  string `bson:"name,omitempty" json:"name,omitempty"`
+	CC    bool   `bson:"cc" json:"cc"`
+}
+
+// SetBillingAddress stores the address on the developer's record, sealed
+// like the rest of their PII.
+func SetBillingAddress(developerID bson.ObjectId, a *BillingAddress) error {
+	a.UpdatedAt = time.Now()
+	return UpdateDeveloper(bson.M{"_id": developerID}, bson.M{"billingAddress": a})
+}
+
+// GetBillingAddress returns the developer's address, nil if they haven't
+// given one.
+func GetBillingAddress(developerID bson.ObjectId) (*BillingAddress, error) {
+	doc := bson.M{}
+	err := devs.FindId(developerID).Select(bson.M{"billingAddress": 1}).One(&doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := openDeveloperDoc(doc); err != nil {
+		return nil, err
+	}
+	address, ok := doc["billingAddress"].(bson.M)
+	if !ok {
+		return nil, nil
+	}
+
+	raw, err := bson.Marshal(address)
+	if err != nil {
+		return nil, err
+	}
+	a := &BillingAddress{}
+	return a, bson.Unmarshal(raw, a)
+}
+
+// SetInvoiceDetails stores the developer's PO number and memo.
+func SetInvoiceDetails(developerID bson.ObjectId, i *InvoiceDetails) error {
+	return UpdateDeveloper(bson.M{"_id": developerID}, bson.M{"invoice": i})
+}
+
+// GetInvoiceDetails returns the developer's PO number and memo.
+func GetInvoiceDetails(developerID bson.ObjectId) (*InvoiceDetails, error) {
+	var d struct {
+		Invoice InvoiceDetails `bson:"invoice"`
+	}
+
+	err := devs.FindId(developerID).Select(bson.M{"invoice": 1}).One(&d)
+	return &d.Invoice, err
+}
+
+// SetBillingContact stores the developer's billing contact, nil removes it.
+func SetBillingContact(developerID bson.ObjectId, c *BillingContact) error {
+	if c == nil {
+		return updateDeveloper(bson.M{"_id": developerID}, bson.M{"$unset": bson.M{"billingContact": ""}})
+	}
+
+	return UpdateDeveloper(bson.M{"_id": developerID}, bson.M{"billingContact": c})
+}
+
+// GetBillingContact returns the developer's billing contact, nil if billing
+// emails go to them.
+func GetBillingContact(developerID bson.ObjectId) (*BillingContact, error) {
+	var d struct {
+		BillingContact *BillingContact `bson:"billingContact"`
+	}
+
+	err := devs.FindId(developerID).Select(bson.M{"billingContact": 1}).One(&d)
+	return d.BillingContact, err
+}
+
+// SetOrganizationBillingAddress stores the address on an organization.
+func SetOrganizationBillingAddress(slug string, a *BillingAddress) error {
+	a.UpdatedAt = time.Now()
+	return orgs.Update(bson.M{"slug": slug}, bson.M{"$set": bson.M{
+		"billingAddress": a,
+		"updatedAt":      a.UpdatedAt,
+	}})
+}
@@ -0,0 +1,291 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Reasons a developer's Stripe customer can be read for. Reads for any other
+// reason fail, so every code path that handles a card reference is listed
+// here and nowhere else.
+const (
+	BillingRenewal = "renewal" // charging a renewal off session
+	BillingCredit  = "credit"  // crediting the customer's balance
+	BillingPause   = "pause"   // recording a pause on the customer
+)
+
+var billingReasons = map[string]bool{
+	BillingRenewal: true,
+	BillingCredit:  true,
+	BillingPause:   true,
+}
+
+var (
+	// ErrNoBillingKey is returned by the billing store until its key is set.
+	ErrNoBillingKey = errors.New("the billing key isn't loaded")
+
+	// ErrBillingReason is returned for reads with a reason that isn't
+	// allowed.
+	ErrBillingReason = errors.New("not a reason to read billing accounts")
+)
+
+// billingAccount is a developer's card references, kept out of the
+// developer document. The customer is sealed with the billing key, bound to
+// the developer so it can't be copied onto another account.
+type billingAccount struct {
+	DeveloperID bson.ObjectId `bson:"_id"`
+	Customer    []byte        `bson:"customer"`
+	KeyID       string        `bson:"keyId"`
+	UpdatedAt   time.Time     `bson:"updatedAt"`
+}
+
+var (
+	billingAccounts *mgo.Collection
+
+	billingMutex sync.RWMutex
+	billingKeys  map[string]cipher.AEAD
+	billingKeyID string
+)
+
+func init() {
+	billingAccounts = Client.Db.C("billingAccounts")
+}
+
+// SetBillingKey sets the 32 byte key billing accounts are sealed with, and
+// the id it's recorded under.
+func SetBillingKey(keyID string, key []byte) error {
+	return SetBillingKeys(keyID, map[string][]byte{keyID: key})
+}
+
+// SetBillingKeys sets the 32 byte keys billing accounts are sealed with, by
+// id. Accounts are sealed with the current one, the rest can only open
+// accounts sealed before it until RotateBillingAccounts reseals them.
+func SetBillingKeys(current string, keys map[string][]byte) error {
+	if _, ok := keys[current]; !ok {
+		return errors.New("the current billing key isn't one of the keys")
+	}
+
+	gcms := map[string]cipher.AEAD{}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		gcms[id] = gcm
+	}
+
+	billingMutex.Lock()
+	defer billingMutex.Unlock()
+	billingKeys = gcms
+	billingKeyID = current
+	return nil
+}
+
+// billingCipher returns the key billing accounts are sealed with and its
+// id.
+func billingCipher() (cipher.AEAD, string, error) {
+	billingMutex.RLock()
+	defer billingMutex.RUnlock()
+	gcm, ok := billingKeys[billingKeyID]
+	if !ok {
+		return nil, "", ErrNoBillingKey
+	}
+
+	return gcm, billingKeyID, nil
+}
+
+// billingCipherFor returns the key an account was sealed with. Accounts
+// without a key id are from before keys were rotated, sealed with the
+// current one.
+func billingCipherFor(keyID string) (cipher.AEAD, error) {
+	if keyID == "" {
+		gcm, _, err := billingCipher()
+		return gcm, err
+	}
+
+	billingMutex.RLock()
+	defer billingMutex.RUnlock()
+	gcm, ok := billingKeys[keyID]
+	if !ok {
+		return nil, ErrNoBillingKey
+	}
+
+	return gcm, nil
+}
+
+// SetStripeCustomer stores a developer's Stripe customer.
+func SetStripeCustomer(developerID bson.ObjectId, customer string) error {
+	gcm, keyID, err := billingCipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	_, err = billingAccounts.UpsertId(developerID, &billingAccount{
+		DeveloperID: developerID,
+		Customer:    gcm.Seal(nonce, nonce, []byte(customer), []byte(developerID)),
+		KeyID:       keyID,
+		UpdatedAt:   time.Now(),
+	})
+	return err
+}
+
+// GetStripeCustomer returns a developer's Stripe customer for one of the
+// billing reasons, empty if they don't have one.
+func GetStripeCustomer(developerID bson.ObjectId, reason string) (string, error) {
+	if !billingReasons[reason] {
+		return "", ErrBillingReason
+	}
+	if _, _, err := billingCipher(); err != nil {
+		return "", err
+	}
+
+	a := &billingAccount{}
+	err := billingAccounts.FindId(developerID).One(a)
+	if err == ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return openBillingAccount(a)
+}
+
+// openBillingAccount returns the customer sealed in an account.
+func openBillingAccount(a *billingAccount) (string, error) {
+	gcm, err := billingCipherFor(a.KeyID)
+	if err != nil {
+		return "", err
+	}
+	if len(a.Customer) < gcm.NonceSize() {
+		return "", errors.New("billing account is corrupt")
+	}
+
+	customer, err := gcm.Open(nil, a.Customer[:gcm.NonceSize()], a.Customer[gcm.NonceSize():], []byte(a.DeveloperID))
+	return string(customer), err
+}
+
+// RotateBillingAccounts reseals up to limit billing accounts sealed with
+// an older key under the current one, returning how many were resealed.
+// Accounts changed while they're resealed are left to their new key.
+func RotateBillingAccounts(limit int) (int, error) {
+	gcm, keyID, err := billingCipher()
+	if err != nil {
+		return 0, err
+	}
+
+	as := []*billingAccount{}
+	err = billingAccounts.Find(bson.M{"keyId": bson.M{"$ne": keyID}}).Limit(limit).All(&as)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, a := range as {
+		customer, err := openBillingAccount(a)
+		if err != nil {
+			return i, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return i, err
+		}
+
+		err = billingAccounts.Update(bson.M{"_id": a.DeveloperID, "keyId": a.KeyID}, bson.M{"$set": bson.M{
+			"customer": gcm.Seal(nonce, nonce, []byte(customer), []byte(a.DeveloperID)),
+			"keyId":    keyID,
+		}})
+		if err != nil && err != ErrNotFound {
+			return i, err
+		}
+	}
+
+	return len(as), nil
+}
+
+// HasStripeCustomer reports whether a developer has a Stripe customer,
+// without reading it.
+func HasStripeCustomer(developerID bson.ObjectId) (bool, error) {
+	n, err := billingAccounts.FindId(developerID).Count()
+	return n > 0, err
+}
+
+// RemoveBillingAccounts removes the billing accounts of developers.
+func RemoveBillingAccounts(ids []bson.ObjectId) error {
+	_, err := billingAccounts.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// MoveStripeCustomers moves Stripe customers left on developer documents,
+// including deleted developers, into the billing store, returning how many
+// were moved. Copies in developer versions are removed once none are left.
+func MoveStripeCustomers(limit int) (int, error) {
+	moved := 0
+	for _, c := range []struct {
+		collection *mgo.Collection
+		field      string
+	}{
+		{devs, "stripeToken"},
+		{deletedDevs, "developer.stripeToken"},
+	} {
+		docs := []bson.M{}
+		err := c.collection.Find(bson.M{c.field: bson.M{"$exists": true}}).Select(bson.M{c.field: 1}).Limit(limit).All(&docs)
+		if err != nil {
+			return moved, err
+		}
+
+		for _, doc := range docs {
+			id, _ := doc["_id"].(bson.ObjectId)
+			customer := stripeToken(doc)
+			if customer != "" {
+				if err := SetStripeCustomer(id, customer); err != nil {
+					return moved, err
+				}
+			}
+
+			// Only unset the customer moved, one changed since is moved next
+			// time.
+			query := bson.M{"_id": id}
+			if customer != "" {
+				query[c.field] = customer
+			}
+			err := c.collection.Update(query, bson.M{"$unset": bson.M{c.field: ""}})
+			if err != nil && err != ErrNotFound {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	if moved > 0 {
+		return moved, nil
+	}
+
+	_, err := developerVersions.UpdateAll(bson.M{"document.stripeToken": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"document.stripeToken": ""}})
+	return moved, err
+}
+
+// stripeToken returns the Stripe customer on a developer document, or a
+// deleted developer's.
+func stripeToken(doc bson.M) string {
+	if dev, ok := doc["developer"].(bson.M); ok {
+		doc = dev
+	}
+	customer, _ := doc["stripeToken"].(string)
+
+	return customer
+}
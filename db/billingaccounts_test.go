@@ -0,0 +1,62 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestStripeCustomers(t *testing.T) {
+	if err := SetBillingKey("test", bytes.Repeat([]byte{7}, 32)); err != nil {
+		t.Fatal("Unable to set billing key:", err)
+	}
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	if err := SetStripeCustomer(mock.ID, "cus_4fdAW5ftNQow1a"); err != nil {
+		t.Fatal("Unable to set customer:", err)
+	}
+	raw := bson.M{}
+	if err := billingAccounts.FindId(mock.ID).One(&raw); err != nil {
+		t.Fatal("Unable to read billing account:", err)
+	}
+	if sealed, _ := raw["customer"].([]byte); bytes.Contains(sealed, []byte("cus_")) {
+		t.Error("Expected the customer to be encrypted at rest.")
+	}
+
+	customer, err := GetStripeCustomer(mock.ID, BillingRenewal)
+	if err != nil || customer != "cus_4fdAW5ftNQow1a" {
+		t.Error("Expected the customer back, got", customer, err)
+	}
+	if _, err := GetStripeCustomer(mock.ID, "export"); err != ErrBillingReason {
+		t.Error("Expected reads for other reasons to be refused, got", err)
+	}
+	if customer, err := GetStripeCustomer(bson.NewObjectId(), BillingRenewal); err != nil || customer != "" {
+		t.Error("Expected no customer for a developer without one, got", customer, err)
+	}
+
+	// A customer left on the document is moved out of it.
+	if err := devs.UpdateId(mock.ID, bson.M{"$set": bson.M{"stripeToken": "cus_moved12345"}}); err != nil {
+		t.Fatal("Unable to set stripe token:", err)
+	}
+	for {
+		moved, err := MoveStripeCustomers(100)
+		if err != nil {
+			t.Fatal("Unable to move customers:", err)
+		}
+		if moved == 0 {
+			break
+		}
+	}
+	doc, err := GetDeveloperDocument(mock.ID)
+	if _, ok := doc["stripeToken"]; err != nil || ok {
+		t.Error("Expected stripeToken to be removed from the developer, got", doc["stripeToken"], err)
+	}
+	if customer, err := GetStripeCustomer(mock.ID, BillingCredit); err != nil || customer != "cus_moved12345" {
+		t.Error("Expected the moved customer, got", customer, err)
+	}
+}
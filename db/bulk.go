@@ -0,0 +1,78 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long bulk reports are kept for review.
+const bulkReportRetention = time.Hour * 24 * 30
+
+// FieldChange is a field that differs between two versions of a document.
+type FieldChange struct {
+	Field string `bson:"field" json:"field"`
+	From  string `bson:"from" json:"from"`
+	To    string `bson:"to" json:"to"`
+}
+
+// BulkRow is a developer a bulk mutation changed, or would change in a dry
+// run, and how.
+type BulkRow struct {
+	DeveloperID bson.ObjectId  `bson:"developerId,omitempty" json:"developerId,omitempty"`
+	Email       string         `bson:"email" json:"email"`
+	Changes     []*FieldChange `bson:"changes" json:"changes"`
+	Error       string         `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// BulkReport records a bulk mutation, or a dry run of one.
+type BulkReport struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Mutation  string        `bson:"mutation" json:"mutation"`
+	DryRun    bool          `bson:"dryRun" json:"dryRun"`
+	Params    string        `bson:"params,omitempty" json:"params,omitempty"`
+	Matched   int           `bson:"matched" json:"matched"`
+	Changed   int           `bson:"changed" json:"changed"`
+	Failed    int           `bson:"failed" json:"failed"`
+	Rows      []*BulkRow    `bson:"rows" json:"rows"`
+	CreatedBy string        `bson:"createdBy" json:"createdBy"`
+	CreatedAt time.Time     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time     `bson:"expiresAt" json:"-"`
+}
+
+var bulkReports *mgo.Collection
+
+func init() {
+	bulkReports = Client.Db.C("bulkReports")
+	ensureIndex(bulkReports, mgo.Index{Key: []string{"expiresAt"}, ExpireAfter: time.Second})
+}
+
+func SaveBulkReport(r *BulkReport) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+	r.ExpiresAt = r.CreatedAt.Add(bulkReportRetention)
+
+	return bulkReports.Insert(r)
+}
+
+func GetBulkReport(id bson.ObjectId) (*BulkReport, error) {
+	r := &BulkReport{}
+	return r, bulkReports.FindId(id).One(r)
+}
+
+// GetDeveloperDocuments returns the whole documents of the developers
+// matching the query, oldest first, up to limit.
+func GetDeveloperDocuments(query bson.M, limit int) ([]bson.M, error) {
+	docs := []bson.M{}
+	if err := devs.Find(piiQuery(query)).Sort("_id").Limit(limit).All(&docs); err != nil {
+		return docs, err
+	}
+
+	return docs, openDeveloperDocs(docs)
+}
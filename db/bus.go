@@ -0,0 +1,93 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// BusCursor is how far a feed of published events has got. The versions
+// feed goes by id, the expirations feed by At and then id.
+type BusCursor struct {
+	Name  string        `bson:"_id" json:"name"`
+	After bson.ObjectId `bson:"after,omitempty" json:"after,omitempty"`
+	At    time.Time     `bson:"at,omitempty" json:"at,omitempty"`
+}
+
+var busCursors *mgo.Collection
+
+func init() {
+	busCursors = Client.Db.C("busCursors")
+}
+
+// GetBusCursor returns the named cursor, an empty one if the feed hasn't
+// published anything.
+func GetBusCursor(name string) (*BusCursor, error) {
+	c := &BusCursor{}
+	err := busCursors.FindId(name).One(c)
+	if err == ErrNotFound {
+		return &BusCursor{Name: name}, nil
+	}
+
+	return c, err
+}
+
+// SaveBusCursor records how far a feed has got.
+func SaveBusCursor(c *BusCursor) error {
+	_, err := busCursors.UpsertId(c.Name, c)
+	return err
+}
+
+// GetDeveloperVersionsAfter returns up to limit versions with ids after the
+// one given and saved before the time given, in id order. An empty id
+// starts from the beginning.
+func GetDeveloperVersionsAfter(after bson.ObjectId, before time.Time, limit int) ([]*DeveloperVersion, error) {
+	query := bson.M{"createdAt": bson.M{"$lt": before}}
+	if after != "" {
+		query["_id"] = bson.M{"$gt": after}
+	}
+
+	vs := []*DeveloperVersion{}
+	if err := developerVersions.Find(query).Sort("_id").Limit(limit).All(&vs); err != nil {
+		return vs, err
+	}
+
+	return vs, openVersions(vs...)
+}
+
+// GetPreviousDeveloperVersion returns the version a developer was at before
+// the one given. It returns ErrNotFound for a developer's first version.
+func GetPreviousDeveloperVersion(v *DeveloperVersion) (*DeveloperVersion, error) {
+	prev := &DeveloperVersion{}
+	err := developerVersions.Find(bson.M{
+		"developerId": v.DeveloperID,
+		"_id":         bson.M{"$lt": v.ID},
+	}).Sort("-_id").One(prev)
+	if err != nil {
+		return prev, err
+	}
+
+	return prev, openVersions(prev)
+}
+
+// GetDevelopersExpiredBetween returns the developers whose expiration is
+// after from, or at from with an id after the one given, and no later than
+// to, in expiration and id order.
+func GetDevelopersExpiredBetween(from time.Time, after bson.ObjectId, to time.Time, limit int) ([]bson.M, error) {
+	query := bson.M{"expiration": bson.M{"$gt": from, "$lte": to}}
+	if after != "" {
+		query = bson.M{"$or": []bson.M{
+			query,
+			{"expiration": from, "_id": bson.M{"$gt": after}},
+		}}
+	}
+
+	docs := []bson.M{}
+	if err := devs.Find(query).Sort("expiration", "_id").Limit(limit).All(&docs); err != nil {
+		return docs, err
+	}
+
+	return docs, openDeveloperDocs(docs)
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long processed commands are remembered, and so deduped.
+const busCommandRetention = time.Hour * 24 * 14
+
+// Bus command statuses.
+const (
+	BusCommandProcessing = "processing"
+	BusCommandDone       = "done"
+	BusCommandFailed     = "failed"
+)
+
+// BusCommand is a command received from the message bus, kept by the id
+// its sender gave it so a command delivered twice is only carried out once.
+type BusCommand struct {
+	ID          string                 `bson:"_id" json:"id"`
+	Type        string                 `bson:"type" json:"type"`
+	DeveloperID bson.ObjectId          `bson:"developerId,omitempty" json:"developerId,omitempty"`
+	Status      string                 `bson:"status" json:"status"`
+	Result      map[string]interface{} `bson:"result,omitempty" json:"result,omitempty"`
+	Error       string                 `bson:"error,omitempty" json:"error,omitempty"`
+	Owner       string                 `bson:"owner,omitempty" json:"-"`
+	LockedUntil time.Time              `bson:"lockedUntil,omitempty" json:"-"`
+	ReceivedAt  time.Time              `bson:"receivedAt" json:"receivedAt"`
+	FinishedAt  time.Time              `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+	ExpiresAt   time.Time              `bson:"expiresAt" json:"-"`
+}
+
+var busCommands *mgo.Collection
+
+func init() {
+	busCommands = Client.Db.C("busCommands")
+	ensureIndex(busCommands, mgo.Index{Key: []string{"expiresAt"}, ExpireAfter: time.Second})
+}
+
+// ClaimBusCommand records a command as being processed by owner for lease.
+// If the command was seen before it returns the stored command and false,
+// unless its processing was abandoned, in which case owner takes it over.
+func ClaimBusCommand(c *BusCommand, owner string, lease time.Duration) (*BusCommand, bool, error) {
+	now := time.Now()
+	c.Status = BusCommandProcessing
+	c.Owner = owner
+	c.LockedUntil = now.Add(lease)
+	c.ReceivedAt = now
+	c.ExpiresAt = now.Add(busCommandRetention)
+
+	err := busCommands.Insert(c)
+	if err == nil {
+		return c, true, nil
+	}
+	if !mgo.IsDup(err) {
+		return nil, false, err
+	}
+
+	existing := &BusCommand{}
+	_, err = busCommands.Find(bson.M{
+		"_id":         c.ID,
+		"status":      BusCommandProcessing,
+		"lockedUntil": bson.M{"$lt": now},
+	}).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"owner": owner, "lockedUntil": now.Add(lease)}},
+		ReturnNew: true,
+	}, existing)
+	if err == nil {
+		return existing, true, nil
+	}
+	if err != mgo.ErrNotFound {
+		return nil, false, err
+	}
+
+	return existing, false, busCommands.FindId(c.ID).One(existing)
+}
+
+// FinishBusCommand records the outcome of a command owner processed.
+func FinishBusCommand(c *BusCommand, owner string) error {
+	return busCommands.Update(bson.M{"_id": c.ID, "owner": owner}, bson.M{"$set": bson.M{
+		"status":     c.Status,
+		"result":     c.Result,
+		"error":      c.Error,
+		"finishedAt": time.Now(),
+	}})
+}
+
+// ReleaseBusCommand gives up a command owner was processing so it can be
+// taken again straight away.
+func ReleaseBusCommand(c *BusCommand, owner string) error {
+	return busCommands.Update(bson.M{"_id": c.ID, "owner": owner, "status": BusCommandProcessing},
+		bson.M{"$set": bson.M{"lockedUntil": time.Now()}})
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Campaign states. Queued campaigns have a message in the outbox for each
+// recipient.
+const (
+	CampaignDraft     = "draft"
+	CampaignScheduled = "scheduled"
+	CampaignQueueing  = "queueing"
+	CampaignQueued    = "queued"
+	CampaignCancelled = "cancelled"
+)
+
+// CampaignSegment narrows who a campaign is sent to, empty values match
+// everyone. Plans are "free" or "paid", Tags match developers with any of
+// them, and Saved is the slug of a saved segment recipients must also be in.
+type CampaignSegment struct {
+	Saved            string    `bson:"saved,omitempty" json:"saved,omitempty"`
+	Plans            []string  `bson:"plans,omitempty" json:"plans,omitempty"`
+	Tags             []string  `bson:"tags,omitempty" json:"tags,omitempty"`
+	SignedUpAfter    time.Time `bson:"signedUpAfter,omitempty" json:"signedUpAfter,omitempty"`
+	SignedUpBefore   time.Time `bson:"signedUpBefore,omitempty" json:"signedUpBefore,omitempty"`
+	ActiveWithinDays int       `bson:"activeWithinDays,omitempty" json:"activeWithinDays,omitempty"`
+	InactiveDays     int       `bson:"inactiveDays,omitempty" json:"inactiveDays,omitempty"`
+}
+
+// Campaign is a broadcast email to a segment of developers. Body is an
+// html template, executed for each recipient.
+type Campaign struct {
+	ID          bson.ObjectId   `bson:"_id" json:"id"`
+	Name        string          `bson:"name" json:"name"`
+	Subject     string          `bson:"subject" json:"subject"`
+	FromEmail   string          `bson:"fromEmail" json:"fromEmail"`
+	FromName    string          `bson:"fromName" json:"fromName"`
+	Body        string          `bson:"body" json:"body"`
+	Segment     CampaignSegment `bson:"segment" json:"segment"`
+	Status      string          `bson:"status" json:"status"`
+	Host        string          `bson:"host,omitempty" json:"-"`
+	ScheduledAt time.Time       `bson:"scheduledAt,omitempty" json:"scheduledAt,omitempty"`
+	Recipients  int             `bson:"recipients" json:"recipients"`
+	Sent        int             `bson:"sent" json:"sent"`
+	Opens       int             `bson:"opens" json:"opens"`
+	CreatedBy   string          `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time       `bson:"createdAt" json:"createdAt"`
+	QueuedAt    time.Time       `bson:"queuedAt,omitempty" json:"queuedAt,omitempty"`
+}
+
+var (
+	campaigns     *mgo.Collection
+	campaignOpens *mgo.Collection
+)
+
+func init() {
+	campaigns = Client.Db.C("campaigns")
+	campaignOpens = Client.Db.C("campaignOpens")
+
+	ensureIndex(campaigns, mgo.Index{Key: []string{"status", "scheduledAt"}})
+}
+
+// SaveCampaign stores a new draft.
+func SaveCampaign(c *Campaign) error {
+	c.ID = bson.NewObjectId()
+	c.Status = CampaignDraft
+	c.CreatedAt = time.Now()
+	return campaigns.Insert(c)
+}
+
+// GetCampaign returns the campaign with the id.
+func GetCampaign(id bson.ObjectId) (*Campaign, error) {
+	c := &Campaign{}
+	return c, campaigns.FindId(id).One(c)
+}
+
+// GetCampaigns returns the newest campaigns first.
+func GetCampaigns(query bson.M, limit int) ([]*Campaign, error) {
+	cs := []*Campaign{}
+	return cs, campaigns.Find(query).Sort("-createdAt").Limit(limit).All(&cs)
+}
+
+// UpdateCampaign sets fields on a campaign in one of the states, returning
+// ErrConflict if it's moved on.
+func UpdateCampaign(id bson.ObjectId, states []string, update bson.M) error {
+	err := campaigns.Update(bson.M{
+		"_id":    id,
+		"status": bson.M{"$in": states},
+	}, bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+
+	return err
+}
+
+// ClaimDueCampaign takes the next campaign due to be queued, so only one
+// instance queues it.
+func ClaimDueCampaign() (*Campaign, error) {
+	c := &Campaign{}
+	_, err := campaigns.Find(bson.M{
+		"status":      CampaignScheduled,
+		"scheduledAt": bson.M{"$lte": time.Now()},
+	}).Sort("scheduledAt").Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": CampaignQueueing}},
+		ReturnNew: true,
+	}, c)
+
+	return c, err
+}
+
+// IncCampaignSent counts a delivered message.
+func IncCampaignSent(id bson.ObjectId) error {
+	return campaigns.UpdateId(id, bson.M{"$inc": bson.M{"sent": 1}})
+}
+
+// RecordCampaignOpen counts the first open of a campaign by a developer,
+// returning false for repeat opens.
+func RecordCampaignOpen(id, developerID bson.ObjectId) (bool, error) {
+	err := campaignOpens.Insert(bson.M{
+		"_id":      id.Hex() + ":" + developerID.Hex(),
+		"openedAt": time.Now(),
+	})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, campaigns.UpdateId(id, bson.M{"$inc": bson.M{"opens": 1}})
+}
@@ -0,0 +1,49 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Canary is the traffic split between a route's stable handler and the
+// handler being rolled out. Weight is the percentage sent to the canary.
+type Canary struct {
+	Route      string    `bson:"route" json:"route"`
+	Weight     int       `bson:"weight" json:"weight"`
+	RolledBack bool      `bson:"rolledBack" json:"rolledBack"`
+	Reason     string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	UpdatedBy  string    `bson:"updatedBy,omitempty" json:"updatedBy,omitempty"`
+	UpdatedAt  time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+var canaries *mgo.Collection
+
+func init() {
+	canaries = Client.Db.C("canaries")
+}
+
+func GetCanaries(query bson.M) ([]*Canary, error) {
+	cs := []*Canary{}
+	return cs, canaries.Find(query).Sort("route").All(&cs)
+}
+
+// GetCanary returns the split for the route, routes without one send no
+// traffic to the canary.
+func GetCanary(route string) (*Canary, error) {
+	c := &Canary{}
+	err := canaries.Find(bson.M{"route": route}).One(c)
+	if err == mgo.ErrNotFound {
+		return &Canary{Route: route}, nil
+	}
+
+	return c, err
+}
+
+func SaveCanary(c *Canary) error {
+	c.UpdatedAt = time.Now()
+	_, err := canaries.Upsert(bson.M{"route": c.Route}, c)
+	return err
+}
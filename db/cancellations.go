@@ -0,0 +1,134 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Cancellation reasons.
+const (
+	CancelTooExpensive    = "too-expensive"
+	CancelMissingFeatures = "missing-features"
+	CancelNotUsing        = "not-using"
+	CancelSwitched        = "switched"
+	CancelTechnical       = "technical-issues"
+	CancelOther           = "other"
+)
+
+// CancellationReasons lists the reasons a developer can give.
+var CancellationReasons = []string{
+	CancelTooExpensive, CancelMissingFeatures, CancelNotUsing,
+	CancelSwitched, CancelTechnical, CancelOther,
+}
+
+// Cancellation is a developer canceling their subscription, with the
+// win-back discount they're offered to come back. Access ends at EndsAt,
+// the cancellation time if Immediate and otherwise the end of the period
+// they paid for.
+type Cancellation struct {
+	ID              bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID     bson.ObjectId `bson:"developerId" json:"developerId"`
+	Reason          string        `bson:"reason" json:"reason"`
+	Comment         string        `bson:"comment,omitempty" json:"comment,omitempty"`
+	Immediate       bool          `bson:"immediate" json:"immediate"`
+	From            string        `bson:"from" json:"from"`
+	CanceledAt      time.Time     `bson:"canceledAt" json:"canceledAt"`
+	EndsAt          time.Time     `bson:"endsAt" json:"endsAt"`
+	OfferPercent    int           `bson:"offerPercent,omitempty" json:"offerPercent,omitempty"`
+	OfferExpiresAt  time.Time     `bson:"offerExpiresAt,omitempty" json:"offerExpiresAt,omitempty"`
+	OfferRedeemedAt time.Time     `bson:"offerRedeemedAt,omitempty" json:"offerRedeemedAt,omitempty"`
+}
+
+// CancellationStats summarizes cancellations over a period. WonBack is how
+// many redeemed their win-back offer.
+type CancellationStats struct {
+	Total     int               `json:"total"`
+	Immediate int               `json:"immediate"`
+	WonBack   int               `json:"wonBack"`
+	ByReason  []*DeveloperCount `json:"byReason"`
+}
+
+var cancellations *mgo.Collection
+
+func init() {
+	cancellations = Client.Db.C("cancellations")
+	ensureIndex(cancellations, mgo.Index{Key: []string{"developerId", "-canceledAt"}})
+	ensureIndex(cancellations, mgo.Index{Key: []string{"canceledAt"}})
+}
+
+// SaveCancellation stores a cancellation.
+func SaveCancellation(c *Cancellation) error {
+	if c.ID == "" {
+		c.ID = bson.NewObjectId()
+	}
+	if c.CanceledAt.IsZero() {
+		c.CanceledAt = time.Now()
+	}
+
+	return cancellations.Insert(c)
+}
+
+// GetWinBackOffer returns a developer's latest cancellation if its offer
+// hasn't run out or been redeemed by now.
+func GetWinBackOffer(id bson.ObjectId, now time.Time) (*Cancellation, error) {
+	c := &Cancellation{}
+	return c, cancellations.Find(bson.M{
+		"developerId":     id,
+		"offerPercent":    bson.M{"$gt": 0},
+		"offerExpiresAt":  bson.M{"$gt": now},
+		"offerRedeemedAt": bson.M{"$exists": false},
+	}).Sort("-canceledAt").One(c)
+}
+
+// RedeemWinBackOffer marks a cancellation's offer used. It returns
+// ErrConflict if it already was.
+func RedeemWinBackOffer(id bson.ObjectId) error {
+	err := cancellations.Update(bson.M{"_id": id, "offerRedeemedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"offerRedeemedAt": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
+
+// GetCancellationStats summarizes the cancellations since from.
+func GetCancellationStats(from time.Time) (*CancellationStats, error) {
+	c, done := readFrom(ReadReports, cancellations)
+	defer done()
+
+	var rows []struct {
+		Reason    string `bson:"_id"`
+		Count     int    `bson:"count"`
+		Immediate int    `bson:"immediate"`
+		WonBack   int    `bson:"wonBack"`
+	}
+	err := c.Pipe([]bson.M{
+		{"$match": bson.M{"canceledAt": bson.M{"$gte": from}}},
+		{"$group": bson.M{
+			"_id":       "$reason",
+			"count":     bson.M{"$sum": 1},
+			"immediate": bson.M{"$sum": bson.M{"$cond": []interface{}{"$immediate", 1, 0}}},
+			"wonBack": bson.M{"$sum": bson.M{"$cond": []interface{}{
+				bson.M{"$gt": []interface{}{"$offerRedeemedAt", nil}}, 1, 0,
+			}}},
+		}},
+	}).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &CancellationStats{ByReason: []*DeveloperCount{}}
+	for _, row := range rows {
+		stats.Total += row.Count
+		stats.Immediate += row.Immediate
+		stats.WonBack += row.WonBack
+		stats.ByReason = append(stats.ByReason, &DeveloperCount{Key: row.Reason, Count: row.Count})
+	}
+	sort.Sort(developerCounts(stats.ByReason))
+
+	return stats, nil
+}
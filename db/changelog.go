@@ -0,0 +1,100 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ChangelogEntry is a "what's new" item. Empty Channels shows it on every
+// channel.
+type ChangelogEntry struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Title       string        `bson:"title" json:"title"`
+	Body        string        `bson:"body" json:"body"`
+	Version     string        `bson:"version" json:"version,omitempty"`
+	Channels    []string      `bson:"channels" json:"channels,omitempty"`
+	PublishedAt time.Time     `bson:"publishedAt" json:"publishedAt"`
+}
+
+var (
+	changelog      *mgo.Collection
+	changelogReads *mgo.Collection
+)
+
+func init() {
+	changelog = Client.Db.C("changelog")
+	changelogReads = Client.Db.C("changelogReads")
+}
+
+func SaveChangelogEntry(e *ChangelogEntry) error {
+	if e.ID == "" {
+		e.ID = bson.NewObjectId()
+	}
+	if e.PublishedAt.IsZero() {
+		e.PublishedAt = time.Now()
+	}
+	if e.Channels == nil {
+		e.Channels = []string{}
+	}
+
+	return changelog.Insert(e)
+}
+
+func GetChangelogEntry(id bson.ObjectId) (*ChangelogEntry, error) {
+	e := &ChangelogEntry{}
+	return e, changelog.FindId(id).One(e)
+}
+
+// GetChangelog returns a page of published entries for the channel, newest
+// first, along with the total number of entries.
+func GetChangelog(channel string, skip, limit int) ([]*ChangelogEntry, int, error) {
+	query := bson.M{"publishedAt": bson.M{"$lte": time.Now()}}
+	if channel != "" {
+		query["$or"] = []bson.M{
+			{"channels": bson.M{"$size": 0}},
+			{"channels": channel},
+		}
+	}
+
+	c, done := readFrom(ReadPublic, changelog)
+	defer done()
+
+	total, err := c.Find(query).Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	es := []*ChangelogEntry{}
+	return es, total, c.Find(query).Sort("-publishedAt").Skip(skip).Limit(limit).All(&es)
+}
+
+func UpdateChangelogEntry(id bson.ObjectId, update bson.M) error {
+	return changelog.UpdateId(id, bson.M{"$set": update})
+}
+
+func DeleteChangelogEntry(id bson.ObjectId) error {
+	return changelog.RemoveId(id)
+}
+
+// GetChangelogReadAt returns when the developer last read the changelog.
+func GetChangelogReadAt(developerID bson.ObjectId) (time.Time, error) {
+	r := struct {
+		ReadAt time.Time `bson:"readAt"`
+	}{}
+
+	err := changelogReads.FindId(developerID).One(&r)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, nil
+	}
+
+	return r.ReadAt, err
+}
+
+// MarkChangelogRead marks every entry published before t as read.
+func MarkChangelogRead(developerID bson.ObjectId, t time.Time) error {
+	_, err := changelogReads.UpsertId(developerID, bson.M{"$set": bson.M{"readAt": t}})
+	return err
+}
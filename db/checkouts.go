@@ -0,0 +1,83 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Checkout states.
+const (
+	CheckoutOpen     = "open"
+	CheckoutComplete = "complete"
+	CheckoutExpired  = "expired"
+)
+
+// Checkout is a Stripe Checkout session started for a developer. Stripe
+// collects the card and runs any authentication, and the developer is marked
+// paid once the session is.
+type Checkout struct {
+	ID          string        `bson:"_id" json:"id"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Plan        string        `bson:"plan" json:"plan"`
+	Amount      int64         `bson:"amount" json:"amount"`
+	Currency    string        `bson:"currency" json:"currency"`
+	Status      string        `bson:"status" json:"status"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	CompletedAt time.Time     `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+}
+
+var checkouts *mgo.Collection
+
+func init() {
+	checkouts = Client.Db.C("checkouts")
+}
+
+// SaveCheckout records a new open checkout.
+func SaveCheckout(c *Checkout) error {
+	c.Status = CheckoutOpen
+	c.CreatedAt = time.Now()
+	return checkouts.Insert(c)
+}
+
+// GetCheckout returns the checkout with the session id.
+func GetCheckout(id string) (*Checkout, error) {
+	c := &Checkout{}
+	return c, checkouts.FindId(id).One(c)
+}
+
+// GetCheckouts returns checkouts matching the query, oldest first.
+func GetCheckouts(query bson.M, limit int) ([]*Checkout, error) {
+	cs := []*Checkout{}
+	return cs, checkouts.Find(query).Sort("createdAt").Limit(limit).All(&cs)
+}
+
+// CloseCheckout moves an open checkout to status, returning false if it was
+// already closed. Only the caller that closes it fulfills it.
+func CloseCheckout(id, status string) (bool, error) {
+	update := bson.M{"status": status}
+	if status == CheckoutComplete {
+		update["completedAt"] = time.Now()
+	}
+
+	err := checkouts.Update(bson.M{"_id": id, "status": CheckoutOpen}, bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// GetRevenueCheckouts returns checkouts completed in [from, to).
+func GetRevenueCheckouts(from, to time.Time) ([]*Checkout, error) {
+	c, done := readFrom(ReadReports, checkouts)
+	defer done()
+
+	cs := []*Checkout{}
+	return cs, c.Find(bson.M{
+		"status":      CheckoutComplete,
+		"completedAt": bson.M{"$gte": from, "$lt": to},
+	}).Sort("completedAt").All(&cs)
+}
@@ -0,0 +1,49 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ChurnScore is the nightly churn risk computed for a developer, between 0
+// and 1 with the signals that contributed to it.
+type ChurnScore struct {
+	DeveloperID bson.ObjectId `bson:"_id" json:"developerId"`
+	Name        string        `bson:"name" json:"name"`
+	Email       string        `bson:"email" json:"email"`
+	Token       string        `bson:"token" json:"-"`
+	IsPaid      bool          `bson:"isPaid" json:"isPaid"`
+	Score       float64       `bson:"score" json:"score"`
+	Signals     []string      `bson:"signals" json:"signals"`
+	ComputedAt  time.Time     `bson:"computedAt" json:"computedAt"`
+}
+
+var churnScores *mgo.Collection
+
+func init() {
+	churnScores = Client.Db.C("churnScores")
+}
+
+// GetChurnScore returns the last score for the developer.
+func GetChurnScore(developerID bson.ObjectId) (*ChurnScore, error) {
+	c := &ChurnScore{}
+	return c, churnScores.FindId(developerID).One(c)
+}
+
+// GetChurnScores returns scores at or above min, riskiest first.
+func GetChurnScores(min float64) ([]*ChurnScore, error) {
+	cs := []*ChurnScore{}
+	return cs, churnScores.Find(bson.M{"score": bson.M{"$gte": min}}).Sort("-score").All(&cs)
+}
+
+// SaveChurnScore stores the score and copies it onto the developer record.
+func SaveChurnScore(c *ChurnScore) error {
+	if _, err := churnScores.UpsertId(c.DeveloperID, c); err != nil {
+		return err
+	}
+
+	return UpdateDeveloper(bson.M{"_id": c.DeveloperID}, bson.M{"churnRisk": c.Score})
+}
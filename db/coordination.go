@@ -0,0 +1,134 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"strconv"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Collections used to coordinate between broome instances so state isn't
+// kept in any one process.
+var (
+	locks         *mgo.Collection
+	counters      *mgo.Collection
+	nonces        *mgo.Collection
+	invalidations *mgo.Collection
+)
+
+// Invalidation tells every instance to drop a key from one of its caches.
+type Invalidation struct {
+	ID    bson.ObjectId `bson:"_id"`
+	Cache string        `bson:"cache"`
+	Key   string        `bson:"key"`
+	At    time.Time     `bson:"at"`
+}
+
+func init() {
+	locks = Client.Db.C("locks")
+	counters = Client.Db.C("counters")
+	nonces = Client.Db.C("nonces")
+	invalidations = Client.Db.C("invalidations")
+
+	// Expired documents are cleaned up by Mongo.
+	for _, c := range []*mgo.Collection{counters, nonces} {
+		ensureIndex(c, mgo.Index{Key: []string{"expiresAt"}, ExpireAfter: time.Second})
+	}
+	ensureIndex(invalidations, mgo.Index{Key: []string{"at"}, ExpireAfter: time.Hour})
+	ensureIndex(invalidations, mgo.Index{Key: []string{"cache", "_id"}})
+}
+
+// AcquireLock takes the named lock for owner until ttl passes, returning
+// false if another owner holds it. An owner may extend a lock it holds.
+func AcquireLock(name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := locks.Upsert(bson.M{
+		"_id": name,
+		"$or": []bson.M{
+			{"expiresAt": bson.M{"$lt": now}},
+			{"owner": owner},
+		},
+	}, bson.M{"$set": bson.M{"owner": owner, "expiresAt": now.Add(ttl)}})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// ReleaseLock gives up the named lock if owner holds it.
+func ReleaseLock(name, owner string) error {
+	err := locks.Remove(bson.M{"_id": name, "owner": owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// IncrementCounter adds one to the counter for key in the window starting at
+// start, returning the new count. Counters are removed after ttl.
+func IncrementCounter(key string, start time.Time, ttl time.Duration) (int, error) {
+	res := struct {
+		Count int `bson:"count"`
+	}{}
+
+	_, err := counters.Find(bson.M{"_id": key + ":" + strconv.FormatInt(start.Unix(), 10)}).Apply(mgo.Change{
+		Update: bson.M{
+			"$inc": bson.M{"count": 1},
+			"$set": bson.M{"expiresAt": start.Add(ttl)},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &res)
+
+	return res.Count, err
+}
+
+// GetCounter returns the count for key in the window starting at start, 0
+// if nothing's been counted.
+func GetCounter(key string, start time.Time) (int, error) {
+	res := struct {
+		Count int `bson:"count"`
+	}{}
+
+	err := counters.FindId(key + ":" + strconv.FormatInt(start.Unix(), 10)).One(&res)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return res.Count, err
+}
+
+// UseNonce records a single use value, returning false if it was already
+// used. Nonces are forgotten after ttl.
+func UseNonce(nonce string, ttl time.Duration) (bool, error) {
+	err := nonces.Insert(bson.M{"_id": nonce, "expiresAt": time.Now().Add(ttl)})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// SaveInvalidation asks every instance to drop key from the named cache.
+func SaveInvalidation(cache, key string) error {
+	return invalidations.Insert(&Invalidation{
+		ID:    bson.NewObjectId(),
+		Cache: cache,
+		Key:   key,
+		At:    time.Now(),
+	})
+}
+
+// GetInvalidations returns invalidations for the cache with ids after the
+// one given, in id order. Ids are made from each writer's clock, so callers
+// should ask from a little before the last id they saw.
+func GetInvalidations(cache string, after bson.ObjectId) ([]*Invalidation, error) {
+	is := []*Invalidation{}
+	return is, invalidations.Find(bson.M{
+		"cache": cache,
+		"_id":   bson.M{"$gt": after},
+	}).Sort("_id").All(&is)
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestAcquireLock(t *testing.T) {
+	name := "test:" + bson.NewObjectId().Hex()
+	defer locks.RemoveId(name)
+
+	if ok, err := AcquireLock(name, "a", 50*time.Millisecond); !ok || err != nil {
+		t.Fatal("Expected a free lock to be taken, got", ok, err)
+	}
+	if ok, err := AcquireLock(name, "b", time.Minute); ok || err != nil {
+		t.Error("Expected a held lock to be refused to another owner, got", ok, err)
+	}
+	if ok, err := AcquireLock(name, "a", 50*time.Millisecond); !ok || err != nil {
+		t.Error("Expected the owner to extend its lock, got", ok, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if ok, err := AcquireLock(name, "b", time.Minute); !ok || err != nil {
+		t.Error("Expected an expired lock to be taken over, got", ok, err)
+	}
+	if ok, _ := AcquireLock(name, "a", time.Minute); ok {
+		t.Error("Expected the previous owner to be refused once it's taken over")
+	}
+
+	if err := ReleaseLock(name, "a"); err != nil {
+		t.Error(err)
+	}
+	if ok, _ := AcquireLock(name, "a", time.Minute); ok {
+		t.Error("Expected only the owner to be able to release a lock")
+	}
+	if err := ReleaseLock(name, "b"); err != nil {
+		t.Error(err)
+	}
+	if ok, err := AcquireLock(name, "a", time.Minute); !ok || err != nil {
+		t.Error("Expected a released lock to be free, got", ok, err)
+	}
+}
+
+func TestIncrementCounter(t *testing.T) {
+	key := "test:" + bson.NewObjectId().Hex()
+	window := time.Now().Truncate(time.Minute)
+	next := window.Add(time.Minute)
+
+	for want := 1; want <= 3; want++ {
+		if n, err := IncrementCounter(key, window, time.Minute); n != want || err != nil {
+			t.Fatal("Expected count", want, "got", n, err)
+		}
+	}
+	if n, err := IncrementCounter(key, next, time.Minute); n != 1 || err != nil {
+		t.Error("Expected the next window to start over, got", n, err)
+	}
+
+	if n, err := GetCounter(key, window); n != 3 || err != nil {
+		t.Error("Expected the first window to keep its count, got", n, err)
+	}
+	if n, err := GetCounter(key, next.Add(time.Minute)); n != 0 || err != nil {
+		t.Error("Expected an uncounted window to be 0, got", n, err)
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+	nonce := "test:" + bson.NewObjectId().Hex()
+	if ok, err := UseNonce(nonce, time.Minute); !ok || err != nil {
+		t.Fatal("Expected a new nonce to be used, got", ok, err)
+	}
+	if ok, err := UseNonce(nonce, time.Minute); ok || err != nil {
+		t.Error("Expected a reused nonce to be rejected, got", ok, err)
+	}
+}
+
+func TestGetInvalidations(t *testing.T) {
+	cache := "test:" + bson.NewObjectId().Hex()
+	since := bson.NewObjectIdWithTime(time.Now().Add(-time.Second))
+	for _, key := range []string{"a", "b"} {
+		if err := SaveInvalidation(cache, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	is, err := GetInvalidations(cache, since)
+	if err != nil || len(is) != 2 || is[0].Key != "a" || is[1].Key != "b" {
+		t.Fatal("Expected both invalidations oldest first, got", is, err)
+	}
+	if is, _ := GetInvalidations(cache, is[1].ID); len(is) != 0 {
+		t.Error("Expected nothing after the last invalidation, got", is)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// CRM providers.
+const (
+	CRMHubSpot    = "hubspot"
+	CRMSalesforce = "salesforce"
+)
+
+// CRM sync kinds.
+const (
+	CRMSignup     = "signup"
+	CRMConversion = "conversion"
+)
+
+// CRMConfig is the CRM signups are pushed to and how developer fields map
+// onto its contact properties. InstanceURL is the Salesforce org's url.
+type CRMConfig struct {
+	Provider    string            `bson:"provider" json:"provider"`
+	InstanceURL string            `bson:"instanceUrl,omitempty" json:"instanceUrl,omitempty"`
+	Fields      map[string]string `bson:"fields" json:"fields"`
+
+	// OAuth tokens, refreshed when they expire.
+	AccessToken  string    `bson:"accessToken" json:"-"`
+	RefreshToken string    `bson:"refreshToken" json:"-"`
+	ExpiresAt    time.Time `bson:"expiresAt" json:"-"`
+
+	UpdatedBy string    `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// CRMSync is a signup or conversion to push to the CRM, keyed by kind and
+// developer so each is pushed once.
+type CRMSync struct {
+	ID          string        `bson:"_id" json:"id"`
+	Kind        string        `bson:"kind" json:"kind"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Email       string        `bson:"email" json:"email"`
+	Plan        string        `bson:"plan,omitempty" json:"plan,omitempty"`
+	OccurredAt  time.Time     `bson:"occurredAt" json:"occurredAt"`
+	Status      string        `bson:"status" json:"status"`
+	Provider    string        `bson:"provider,omitempty" json:"provider,omitempty"`
+	ExternalID  string        `bson:"externalId,omitempty" json:"externalId,omitempty"`
+	Attempts    int           `bson:"attempts" json:"attempts"`
+	Error       string        `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	SyncedAt    time.Time     `bson:"syncedAt,omitempty" json:"syncedAt,omitempty"`
+}
+
+// There's one CRM config per deployment, stored under this id.
+const crmConfigID = "default"
+
+var (
+	crmConfigs *mgo.Collection
+	crmSyncs   *mgo.Collection
+)
+
+func init() {
+	crmConfigs = Client.Db.C("crmConfigs")
+	crmSyncs = Client.Db.C("crmSyncs")
+	ensureIndex(crmSyncs, mgo.Index{Key: []string{"status", "occurredAt"}})
+	ensureIndex(crmSyncs, mgo.Index{Key: []string{"email"}})
+}
+
+// GetCRMConfig returns the saved config, empty if there isn't one.
+func GetCRMConfig() (*CRMConfig, error) {
+	c := &CRMConfig{}
+	err := crmConfigs.FindId(crmConfigID).One(c)
+	if err == mgo.ErrNotFound {
+		return c, nil
+	}
+
+	return c, err
+}
+
+// SaveCRMMapping replaces the provider and field mapping, keeping the
+// tokens.
+func SaveCRMMapping(c *CRMConfig, updatedBy string) error {
+	_, err := crmConfigs.UpsertId(crmConfigID, bson.M{"$set": bson.M{
+		"provider":    c.Provider,
+		"instanceUrl": c.InstanceURL,
+		"fields":      c.Fields,
+		"updatedBy":   updatedBy,
+		"updatedAt":   time.Now(),
+	}})
+	return err
+}
+
+// SaveCRMTokens stores refreshed OAuth tokens.
+func SaveCRMTokens(access, refresh string, expiresAt time.Time) error {
+	_, err := crmConfigs.UpsertId(crmConfigID, bson.M{"$set": bson.M{
+		"accessToken":  access,
+		"refreshToken": refresh,
+		"expiresAt":    expiresAt,
+	}})
+	return err
+}
+
+// QueueCRMSync records a signup or conversion to push, returning false if
+// it was already queued.
+func QueueCRMSync(s *CRMSync) (bool, error) {
+	s.Status = SyncPending
+	s.CreatedAt = time.Now()
+
+	err := crmSyncs.Insert(s)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetCRMSyncs returns syncs matching the query, oldest first.
+func GetCRMSyncs(query bson.M, limit int) ([]*CRMSync, error) {
+	ss := []*CRMSync{}
+	return ss, crmSyncs.Find(query).Sort("occurredAt").Limit(limit).All(&ss)
+}
+
+// CountCRMSyncs totals syncs by status.
+func CountCRMSyncs() (map[string]int, error) {
+	var rows []struct {
+		Status string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	err := crmSyncs.Pipe([]bson.M{
+		{"$group": bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}},
+	}).All(&rows)
+
+	counts := map[string]int{}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, err
+}
+
+// GetCRMContactID returns the CRM contact already pushed for an email,
+// empty if there isn't one.
+func GetCRMContactID(provider, email string) (string, error) {
+	s := &CRMSync{}
+	err := crmSyncs.Find(bson.M{
+		"email":      email,
+		"provider":   provider,
+		"status":     SyncSynced,
+		"externalId": bson.M{"$ne": ""},
+	}).Select(bson.M{"externalId": 1}).One(s)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+
+	return s.ExternalID, err
+}
+
+// MarkCRMSynced records the contact a sync was pushed to.
+func MarkCRMSynced(id, provider, externalID string) error {
+	return crmSyncs.UpdateId(id, bson.M{
+		"$set": bson.M{
+			"status":     SyncSynced,
+			"provider":   provider,
+			"externalId": externalID,
+			"syncedAt":   time.Now(),
+			"error":      "",
+		},
+		"$inc": bson.M{"attempts": 1},
+	})
+}
+
+// MarkCRMFailed records a failed push.
+func MarkCRMFailed(id, provider, msg string) error {
+	return crmSyncs.UpdateId(id, bson.M{
+		"$set": bson.M{"status": SyncFailed, "provider": provider, "error": msg},
+		"$inc": bson.M{"attempts": 1},
+	})
+}
+
+// RetryCRMSync puts a failed sync back in the queue.
+func RetryCRMSync(id string) error {
+	return crmSyncs.Update(bson.M{"_id": id, "status": SyncFailed}, bson.M{
+		"$set": bson.M{"status": SyncPending, "attempts": 0},
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long a deleted developer can be restored for.
+const DeletionGracePeriod = time.Hour * 24 * 30
+
+// DeletedDeveloper is a developer removed from the developers collection
+// but kept until PurgeAt so it can be restored.
+type DeletedDeveloper struct {
+	ID           bson.ObjectId      `bson:"_id" json:"id"`
+	Developer    *schemas.Developer `bson:"developer" json:"developer"`
+	RestoreToken string             `bson:"restoreToken" json:"-"`
+	DeletedAt    time.Time          `bson:"deletedAt" json:"deletedAt"`
+	PurgeAt      time.Time          `bson:"purgeAt" json:"purgeAt"`
+}
+
+var deletedDevs *mgo.Collection
+
+func init() {
+	deletedDevs = Client.Db.C("deletedDevelopers")
+}
+
+// DeleteDeveloper moves the developer out of the developers collection.
+func DeleteDeveloper(d *schemas.Developer) (*DeletedDeveloper, error) {
+	if d.StripeToken != "" {
+		if err := SetStripeCustomer(d.ID, d.StripeToken); err != nil {
+			return nil, err
+		}
+		d.StripeToken = ""
+	}
+	sealed, err := sealedDeveloper(d)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	dd := &DeletedDeveloper{
+		ID:           d.ID,
+		Developer:    sealed,
+		RestoreToken: uuid.New(),
+		DeletedAt:    now,
+		PurgeAt:      now.Add(DeletionGracePeriod),
+	}
+
+	if err := deletedDevs.Insert(dd); err != nil {
+		return nil, err
+	}
+	dd.Developer = d
+
+	return dd, devs.RemoveId(d.ID)
+}
+
+// RestoreDeveloper moves a deleted developer back before it's purged.
+func RestoreDeveloper(restoreToken string) (*schemas.Developer, error) {
+	dd := &DeletedDeveloper{}
+	err := deletedDevs.Find(bson.M{
+		"restoreToken": restoreToken,
+		"purgeAt":      bson.M{"$gt": time.Now()},
+	}).One(dd)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := sealedDeveloper(dd.Developer)
+	if err != nil {
+		return nil, err
+	}
+	if err := openDeveloper(dd.Developer); err != nil {
+		return nil, err
+	}
+	if err := devs.Insert(sealed); err != nil {
+		return nil, err
+	}
+	update := bson.M{"$unset": bson.M{"stripeToken": ""}}
+	if hash := EmailHash(dd.Developer.Email); hash != "" {
+		update["$set"] = bson.M{"emailHash": hash}
+	}
+	if err := devs.UpdateId(dd.ID, update); err != nil {
+		return nil, err
+	}
+	if err := saveDeveloperVersion(sealed); err != nil {
+		return nil, err
+	}
+
+	return dd.Developer, deletedDevs.RemoveId(dd.ID)
+}
+
+// GetDeletedDevelopers returns deleted developers, soonest purge first.
+func GetDeletedDevelopers(query bson.M) ([]*DeletedDeveloper, error) {
+	dds := []*DeletedDeveloper{}
+	if err := deletedDevs.Find(query).Sort("purgeAt").All(&dds); err != nil {
+		return dds, err
+	}
+	for _, dd := range dds {
+		if err := openDeveloper(dd.Developer); err != nil {
+			return dds, err
+		}
+	}
+
+	return dds, nil
+}
+
+// PurgeDeletedDevelopers permanently removes developers past their grace
+// period, other than those on legal hold, returning how many were removed.
+// Each leaves a last version that only records they were purged.
+func PurgeDeletedDevelopers(now time.Time) (int, error) {
+	held, err := GetLegalHoldIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	dds := []*DeletedDeveloper{}
+	err = deletedDevs.Find(bson.M{
+		"purgeAt": bson.M{"$lte": now},
+		"_id":     bson.M{"$nin": held},
+	}).Select(bson.M{"_id": 1}).All(&dds)
+	if err != nil || len(dds) == 0 {
+		return 0, err
+	}
+
+	ids := make([]bson.ObjectId, len(dds))
+	for i, dd := range dds {
+		ids[i] = dd.ID
+		err := saveDeveloperVersion(bson.M{"_id": dd.ID, "lifecycle": LifecyclePurged, "lifecycleChangedAt": now})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := RemoveBillingAccounts(ids); err != nil {
+		return 0, err
+	}
+	info, err := deletedDevs.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Removed, nil
+}
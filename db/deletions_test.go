@@ -0,0 +1,87 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestDeleteAndRestoreDeveloper(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	dd, err := DeleteDeveloper(mock)
+	if err != nil {
+		t.Fatal("Unable to delete developer:", err)
+	}
+
+	if _, err := GetDeveloperById(mock.ID.Hex()); err == nil {
+		t.Error("deleted developer still found.")
+	}
+
+	if _, err := RestoreDeveloper(dd.RestoreToken); err != nil {
+		t.Fatal("Unable to restore developer:", err)
+	}
+
+	if _, err := GetDeveloperById(mock.ID.Hex()); err != nil {
+		t.Error("restored developer not found.")
+	}
+
+	if _, err := RestoreDeveloper(dd.RestoreToken); err == nil {
+		t.Error("restore token worked twice.")
+	}
+}
+
+func TestPurgeDeletedDevelopers(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	dd, err := DeleteDeveloper(mock)
+	if err != nil {
+		t.Fatal("Unable to delete developer:", err)
+	}
+	defer MockDB()
+
+	if _, err := PurgeDeletedDevelopers(time.Now().Add(DeletionGracePeriod + time.Hour)); err != nil {
+		t.Fatal("Unable to purge:", err)
+	}
+
+	if _, err := RestoreDeveloper(dd.RestoreToken); err == nil {
+		t.Error("purged developer was restored.")
+	}
+}
+
+func TestPurgeSkipsLegalHolds(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	dd, err := DeleteDeveloper(mock)
+	if err != nil {
+		t.Fatal("Unable to delete developer:", err)
+	}
+	defer MockDB()
+	if err := PlaceLegalHold(&LegalHold{DeveloperID: mock.ID, Reason: "litigation"}); err != nil {
+		t.Fatal("Unable to hold developer:", err)
+	}
+	defer ReleaseLegalHold(mock.ID)
+
+	if _, err := PurgeDeletedDevelopers(time.Now().Add(DeletionGracePeriod + time.Hour)); err != nil {
+		t.Fatal("Unable to purge:", err)
+	}
+
+	dds, err := GetDeletedDevelopers(bson.M{"_id": dd.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dds) != 1 {
+		t.Error("held developer was purged.")
+	}
+}
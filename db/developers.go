@@ -2,6 +2,8 @@
 package db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"os"
 	"time"
@@ -14,35 +16,113 @@ import (
 	"labix.org/v2/mgo/bson"
 )
 
+const (
+	// Ids or tokens looked up in one query, keeping the query well under
+	// the document size limit.
+	developerLookupBatch = 1000
+
+	// Developers fetched from the server at a time when streaming.
+	developerStreamBatch = 500
+)
+
 var devs *mgo.Collection
 
 func init() {
 	devs = Client.Db.C("developers")
+	ensureIndex(devs, mgo.Index{Key: []string{"tokenHash"}, Sparse: true})
+	ensureIndex(devs, mgo.Index{Key: []string{"organizationId"}, Sparse: true})
+	ensureIndex(devs, mgo.Index{Key: []string{"outbox._id"}, Sparse: true})
 }
 
-func Save(d *schemas.Developer) error {
+// TokenHash returns the hash of a developer's token kept alongside it as
+// tokenHash, so tokens can be looked up without being stored in the clear.
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashPassword salts and hashes the developer's password if it hasn't been.
+func hashPassword(d *schemas.Developer) {
 	if d.Salt == "" {
 		d.Salt = uuid.New()
 		d.Password = util.HashPassword(d.Password, d.Salt)
 	}
+}
+
+func Save(d *schemas.Developer) error {
+	return save(d, bson.M{}, nil)
+}
+
+// save inserts a developer along with the outbox messages for it, then sets
+// the fields derived from it along with those in set.
+func save(d *schemas.Developer, set bson.M, ms []*OutboxMessage) error {
+	hashPassword(d)
+	if err := checkDeveloperWrite(d); err != nil {
+		return err
+	}
+	customer := d.StripeToken
+	d.StripeToken = ""
+	sealed, err := sealedDeveloper(d)
+	if err != nil {
+		return err
+	}
+	doc, err := withOutbox(sealed, ms)
+	if err != nil {
+		return err
+	}
 
-	var err error
 	b := backoff.NewTicker(backoff.NewExponentialBackOff()).C
 
 	for _ = range b {
-		if err = devs.Insert(d); err != nil {
+		if err = devs.Insert(doc); err != nil {
 			continue
 		}
 
 		break
 	}
+	if err != nil {
+		return err
+	}
+	set["lifecycle"] = DeriveLifecycle(bson.M{"isPaid": d.IsPaid, "expiration": d.Expiration}, time.Now())
+	set["lifecycleChangedAt"] = time.Now()
+	if d.Token != "" {
+		set["tokenHash"] = TokenHash(d.Token)
+	}
+	if hash := EmailHash(d.Email); hash != "" {
+		set["emailHash"] = hash
+	}
+	if err := devs.UpdateId(d.ID, bson.M{"$set": set, "$unset": bson.M{"stripeToken": ""}}); err != nil {
+		return err
+	}
+	if customer != "" {
+		if err := SetStripeCustomer(d.ID, customer); err != nil {
+			return err
+		}
+	}
 
-	return err
+	return saveDeveloperVersion(sealed)
 }
 
+// GetDeveloper returns the developer matching the query. Documents that
+// don't match the schema are flagged for the repair job but still read.
 func GetDeveloper(query bson.M) (*schemas.Developer, error) {
+	return getDeveloper(devs, query)
+}
+
+func getDeveloper(c *mgo.Collection, query bson.M) (*schemas.Developer, error) {
 	d := &schemas.Developer{}
-	return d, devs.Find(query).One(&d)
+	raw := bson.Raw{}
+	if err := c.Find(piiQuery(query)).One(&raw); err != nil {
+		return d, err
+	}
+	if issues := checkRawDeveloper(raw); len(issues) > 0 {
+		flagDeveloper(raw, issues)
+	}
+	if err := raw.Unmarshal(d); err != nil {
+		return d, err
+	}
+
+	return d, openDeveloper(d)
 }
 
 func GetDeveloperById(id string) (*schemas.Developer, error) {
@@ -50,12 +130,207 @@ func GetDeveloperById(id string) (*schemas.Developer, error) {
 }
 
 func GetDevelopers(query bson.M) ([]*schemas.Developer, error) {
+	return getDevelopers(devs, query)
+}
+
+func getDevelopers(c *mgo.Collection, query bson.M) ([]*schemas.Developer, error) {
+	ds := []*schemas.Developer{}
+	if err := c.Find(piiQuery(query)).All(&ds); err != nil {
+		return ds, err
+	}
+
+	return ds, openDevelopers(ds)
+}
+
+// openDevelopers opens the PII of developers in place.
+func openDevelopers(ds []*schemas.Developer) error {
+	for _, d := range ds {
+		if err := openDeveloper(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetDevelopersFor lists developers using the read preference for kind. Use
+// GetDevelopers for anything that authenticates a developer.
+func GetDevelopersFor(kind string, query bson.M) ([]*schemas.Developer, error) {
+	c, done := readFrom(kind, devs)
+	defer done()
+
 	ds := []*schemas.Developer{}
-	return ds, devs.Find(query).All(&ds)
+	if err := c.Find(piiQuery(query)).All(&ds); err != nil {
+		return ds, err
+	}
+
+	return ds, openDevelopers(ds)
+}
+
+// GetDevelopersByIDs returns the developers with the ids, keyed by id, using
+// the read preference for kind. Ids with no developer are left out.
+func GetDevelopersByIDs(kind string, ids []bson.ObjectId) (map[bson.ObjectId]*schemas.Developer, error) {
+	c, done := readFrom(kind, devs)
+	defer done()
+
+	res := map[bson.ObjectId]*schemas.Developer{}
+	for start := 0; start < len(ids); start += developerLookupBatch {
+		end := start + developerLookupBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		ds := []*schemas.Developer{}
+		if err := c.Find(bson.M{"_id": bson.M{"$in": ids[start:end]}}).All(&ds); err != nil {
+			return nil, err
+		}
+		if err := openDevelopers(ds); err != nil {
+			return nil, err
+		}
+		for _, d := range ds {
+			res[d.ID] = d
+		}
+	}
+
+	return res, nil
+}
+
+// GetDevelopersByTokens returns the developers with the tokens, keyed by
+// token. It always reads the primary since it's used to authenticate.
+func GetDevelopersByTokens(tokens []string) (map[string]*schemas.Developer, error) {
+	res := map[string]*schemas.Developer{}
+	for start := 0; start < len(tokens); start += developerLookupBatch {
+		end := start + developerLookupBatch
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		ds := []*schemas.Developer{}
+		if err := devs.Find(bson.M{"token": bson.M{"$in": tokens[start:end]}}).All(&ds); err != nil {
+			return nil, err
+		}
+		if err := openDevelopers(ds); err != nil {
+			return nil, err
+		}
+		for _, d := range ds {
+			res[d.Token] = d
+		}
+	}
+
+	return res, nil
+}
+
+// DeveloperCursor streams the developers matching a query in id order, a
+// batch at a time, so scans of the whole collection don't hold it in
+// memory. It must be closed.
+type DeveloperCursor struct {
+	iter *mgo.Iter
+	done func()
+	err  error
+}
+
+// StreamDevelopers returns a cursor over the developers matching the
+// query, using the read preference for kind.
+func StreamDevelopers(kind string, query bson.M) *DeveloperCursor {
+	c, done := readFrom(kind, devs)
+	return &DeveloperCursor{
+		iter: c.Find(piiQuery(query)).Sort("_id").Batch(developerStreamBatch).Iter(),
+		done: done,
+	}
+}
+
+// Next returns the next developer, or false once there are none left or
+// the cursor failed. Close returns why.
+func (c *DeveloperCursor) Next() (*schemas.Developer, bool) {
+	d := &schemas.Developer{}
+	if !c.iter.Next(d) {
+		return nil, false
+	}
+	if err := openDeveloper(d); err != nil {
+		c.err = err
+		return nil, false
+	}
+
+	return d, true
+}
+
+// Close closes the cursor, returning the error it stopped on if any.
+func (c *DeveloperCursor) Close() error {
+	defer c.done()
+	err := c.iter.Close()
+	if err == nil {
+		err = c.err
+	}
+
+	return err
+}
+
+// EachDeveloper calls fn with each developer matching the query in id
+// order, stopping at the first error fn returns.
+func EachDeveloper(kind string, query bson.M, fn func(*schemas.Developer) error) error {
+	cursor := StreamDevelopers(kind, query)
+	for d, ok := cursor.Next(); ok; d, ok = cursor.Next() {
+		if err := fn(d); err != nil {
+			cursor.Close()
+			return err
+		}
+	}
+
+	return cursor.Close()
+}
+
+// GetDeveloperPlan returns the plan slug and paid flag of the developer
+// matching the query, without loading the rest of the developer.
+func GetDeveloperPlan(query bson.M) (string, bool, error) {
+	return getDeveloperPlan(devs, query)
+}
+
+func getDeveloperPlan(c *mgo.Collection, query bson.M) (string, bool, error) {
+	var d struct {
+		Plan   string `bson:"plan"`
+		IsPaid bool   `bson:"isPaid"`
+	}
+	err := c.Find(piiQuery(query)).Select(bson.M{"plan": 1, "isPaid": 1}).One(&d)
+	return d.Plan, d.IsPaid, err
+}
+
+func CountDevelopers(query bson.M) (int, error) {
+	c, done := readFrom(ReadReports, devs)
+	defer done()
+
+	return c.Find(piiQuery(query)).Count()
 }
 
 func UpdateDeveloper(query, update bson.M) error {
-	return devs.Update(query, bson.M{"$set": update})
+	return updateDeveloper(query, bson.M{"$set": update})
+}
+
+// UpdateDeveloperField sets one field on a developer if their revision is
+// still the one given, bumping it. It returns ErrConflict if the developer
+// was edited since. Developers that were never edited are at revision 0.
+func UpdateDeveloperField(id bson.ObjectId, revision int, field string, value interface{}) error {
+	query := bson.M{"_id": id, "revision": revision}
+	if revision == 0 {
+		query["revision"] = bson.M{"$in": []interface{}{0, nil}}
+	}
+
+	err := updateDeveloper(query, bson.M{
+		"$set": bson.M{field: value},
+		"$inc": bson.M{"revision": 1},
+	})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
+
+// GetDeveloperRevision returns how many times a developer has been edited
+// field by field.
+func GetDeveloperRevision(id bson.ObjectId) (int, error) {
+	var d struct {
+		Revision int `bson:"revision"`
+	}
+	return d.Revision, devs.FindId(id).Select(bson.M{"revision": 1}).One(&d)
 }
 
 func MockDB() (*schemas.Developer, error) {
@@ -87,3 +362,23 @@ func MockDB() (*schemas.Developer, error) {
 
 	return dev, nil
 }
+
+// AddLoginCountry records a country the developer signed in from, returning
+// true if they hadn't signed in from it before. The first country recorded
+// isn't new, there's nothing to compare it to.
+func AddLoginCountry(developerID bson.ObjectId, country string) (bool, error) {
+	var d struct {
+		Countries []string `bson:"loginCountries"`
+	}
+	if err := devs.FindId(developerID).Select(bson.M{"loginCountries": 1}).One(&d); err != nil {
+		return false, err
+	}
+	for _, c := range d.Countries {
+		if c == country {
+			return false, nil
+		}
+	}
+
+	err := updateDeveloper(bson.M{"_id": developerID}, bson.M{"$addToSet": bson.M{"loginCountries": country}})
+	return err == nil && len(d.Countries) > 0, err
+}
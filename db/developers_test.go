@@ -2,8 +2,11 @@
 package db
 
 import (
-	"labix.org/v2/mgo/bson"
+	"errors"
 	"testing"
+
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
 )
 
 func TestGetDeveloper(t *testing.T) {
@@ -63,3 +66,76 @@ func TestGetDeveloperById(t *testing.T) {
 		t.Error("email not saved correctly.")
 	}
 }
+
+func TestUpdateDeveloperFieldConflict(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	revision, err := GetDeveloperRevision(mock.ID)
+	if err != nil {
+		t.Fatal("Unable to get revision:", err)
+	}
+	if err := UpdateDeveloperField(mock.ID, revision, "name", "Ada"); err != nil {
+		t.Fatal("Unable to update field:", err)
+	}
+	if err := UpdateDeveloperField(mock.ID, revision, "name", "Grace"); err != ErrConflict {
+		t.Error("Expected a stale revision to conflict, got", err)
+	}
+
+	if _, err := GetDeveloper(bson.M{"_id": bson.NewObjectId()}); err != ErrNotFound {
+		t.Error("Expected a missing developer to be ErrNotFound, got", err)
+	}
+}
+
+func TestGetDevelopersByIDs(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	missing := bson.NewObjectId()
+	ds, err := GetDevelopersByIDs(ReadAdmin, []bson.ObjectId{mock.ID, missing})
+	if err != nil {
+		t.Fatal("Unable to get developers:", err)
+	}
+	if len(ds) != 1 || ds[mock.ID] == nil || ds[mock.ID].Email != mock.Email {
+		t.Error("Expected only the mock developer:", ds)
+	}
+
+	byToken, err := GetDevelopersByTokens([]string{mock.Token, "missing"})
+	if err != nil {
+		t.Fatal("Unable to get developers:", err)
+	}
+	if len(byToken) != 1 || byToken[mock.Token] == nil || byToken[mock.Token].ID != mock.ID {
+		t.Error("Expected only the mock developer:", byToken)
+	}
+}
+
+func TestEachDeveloper(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	seen := 0
+	err = EachDeveloper(ReadReports, bson.M{"_id": mock.ID}, func(d *schemas.Developer) error {
+		seen++
+		if d.Email != mock.Email {
+			t.Error("Developer not streamed correctly.")
+		}
+		return nil
+	})
+	if err != nil || seen != 1 {
+		t.Error("Expected one developer:", err, seen)
+	}
+
+	stop := errors.New("stop")
+	err = EachDeveloper(ReadReports, bson.M{"_id": mock.ID}, func(d *schemas.Developer) error {
+		return stop
+	})
+	if err != stop {
+		t.Error("Expected fn's error to stop the scan, got", err)
+	}
+}
@@ -0,0 +1,494 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Kinds a developer field is stored as.
+const (
+	KindString   = "string"
+	KindBool     = "bool"
+	KindNumber   = "number"
+	KindTime     = "time"
+	KindObjectID = "objectId"
+	KindList     = "list"
+	KindDocument = "document"
+)
+
+// Problems a developer document can have.
+const (
+	SchemaUnknown   = "unknown"
+	SchemaMissing   = "missing"
+	SchemaWrongKind = "wrongKind"
+)
+
+// schemaField is a developer field and the kind it's stored as.
+type schemaField struct {
+	Kind     string
+	Required bool
+}
+
+// developerSchema is every field a developer document is expected to
+// have. Fields set from outside the developer struct are here too. Little
+// is required since signups from the site don't have a token or password
+// until the CLI is set up.
+var developerSchema = map[string]schemaField{
+	"_id":                 {KindObjectID, true},
+	"email":               {KindString, true},
+	"password":            {KindString, false},
+	"salt":                {KindString, false},
+	"token":               {KindString, false},
+	"tokenHash":           {KindString, false},
+	"emailHash":           {KindString, false},
+	"createdAt":           {KindNumber, false},
+	"name":                {KindString, false},
+	"isAdmin":             {KindBool, false},
+	"isPaid":              {KindBool, false},
+	"integrationEngineer": {KindString, false},
+	"license":             {KindString, false},
+	"expiration":          {KindTime, false},
+	"lifecycle":           {KindString, false},
+	"lifecycleChangedAt":  {KindTime, false},
+	"pausedAt":            {KindTime, false},
+	"pauseEndsAt":         {KindTime, false},
+	"resumedAt":           {KindTime, false},
+	"nextPaymentTime":     {KindTime, false},
+	"version":             {KindString, false},
+	"stripeToken":         {KindString, false}, // until moved to the billing store
+	"plan":                {KindString, false},
+	"pendingPayment":      {KindString, false},
+	"revision":            {KindNumber, false},
+	"tags":                {KindList, false},
+	"loginCountries":      {KindList, false},
+	"churnRisk":           {KindNumber, false},
+	"adminDefaultView":    {KindString, false},
+	"emailHealth":         {KindDocument, false},
+	"emailSubscription":   {KindDocument, false},
+	"signupRisk":          {KindDocument, false},
+	"billingAddress":      {KindDocument, false},
+	"billingContact":      {KindDocument, false},
+	"invoice":             {KindDocument, false},
+	"suspension":          {KindDocument, false},
+	"organizationId":      {KindObjectID, false},
+	"outbox":              {KindList, false},
+}
+
+// rawKinds maps BSON element kinds to schema kinds.
+var rawKinds = map[byte]string{
+	0x01: KindNumber,
+	0x02: KindString,
+	0x03: KindDocument,
+	0x04: KindList,
+	0x07: KindObjectID,
+	0x08: KindBool,
+	0x09: KindTime,
+	0x10: KindNumber,
+	0x12: KindNumber,
+}
+
+// SchemaIssue is a way a developer document differs from the schema.
+type SchemaIssue struct {
+	Field   string `bson:"field" json:"field"`
+	Problem string `bson:"problem" json:"problem"`
+	Kind    string `bson:"kind,omitempty" json:"kind,omitempty"`
+}
+
+func (i *SchemaIssue) String() string {
+	if i.Problem == SchemaWrongKind {
+		return fmt.Sprintf("%s is a %s, expected a %s", i.Field, i.Kind, developerSchema[i.Field].Kind)
+	}
+	return i.Field + " is " + i.Problem
+}
+
+// SchemaError is returned when a write would leave a developer document
+// that doesn't match the schema.
+type SchemaError struct {
+	Issues []*SchemaIssue
+}
+
+func (e *SchemaError) Error() string {
+	problems := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		problems[i] = issue.String()
+	}
+	return "invalid developer: " + strings.Join(problems, ", ")
+}
+
+// schemaIssues sorts issues by field.
+type schemaIssues []*SchemaIssue
+
+func (s schemaIssues) Len() int           { return len(s) }
+func (s schemaIssues) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s schemaIssues) Less(i, j int) bool { return s[i].Field < s[j].Field }
+
+// valueKind returns the schema kind a value is stored as, "" for null.
+func valueKind(value interface{}) string {
+	switch value.(type) {
+	case time.Time, *time.Time:
+		return KindTime
+	case bson.ObjectId:
+		return KindObjectID
+	}
+
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return ""
+	case reflect.String:
+		return KindString
+	case reflect.Bool:
+		return KindBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return KindNumber
+	case reflect.Slice, reflect.Array:
+		return KindList
+	}
+
+	// Structs and maps are stored as documents.
+	return KindDocument
+}
+
+// checkField returns the issue with a top level field holding a value of
+// kind, nil if there isn't one. An empty kind is a null.
+func checkField(field, kind string) *SchemaIssue {
+	f, ok := developerSchema[field]
+	if !ok {
+		return &SchemaIssue{Field: field, Problem: SchemaUnknown}
+	}
+	if kind == "" {
+		if f.Required {
+			return &SchemaIssue{Field: field, Problem: SchemaMissing}
+		}
+		return nil
+	}
+	if kind != f.Kind {
+		return &SchemaIssue{Field: field, Problem: SchemaWrongKind, Kind: kind}
+	}
+
+	return nil
+}
+
+// DeveloperFields returns the name of every field in the developer schema,
+// sorted.
+func DeveloperFields() []string {
+	fields := make([]string, 0, len(developerSchema))
+	for field := range developerSchema {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+// CheckDeveloperDocument returns the issues with a whole developer
+// document, sorted by field.
+func CheckDeveloperDocument(doc bson.M) []*SchemaIssue {
+	issues := []*SchemaIssue{}
+	for field, value := range doc {
+		if issue := checkField(field, valueKind(value)); issue != nil {
+			issues = append(issues, issue)
+		}
+	}
+	for field, f := range developerSchema {
+		if _, ok := doc[field]; f.Required && !ok {
+			issues = append(issues, &SchemaIssue{Field: field, Problem: SchemaMissing})
+		}
+	}
+
+	sort.Sort(schemaIssues(issues))
+	return issues
+}
+
+// checkRawDeveloper is CheckDeveloperDocument for a document as read, only
+// looking at the kind of each element so reads don't decode twice.
+func checkRawDeveloper(raw bson.Raw) []*SchemaIssue {
+	var elems bson.RawD
+	if err := raw.Unmarshal(&elems); err != nil {
+		return []*SchemaIssue{{Field: "_id", Problem: err.Error()}}
+	}
+
+	seen := map[string]bool{}
+	issues := []*SchemaIssue{}
+	for _, e := range elems {
+		seen[e.Name] = true
+		kind, ok := rawKinds[e.Value.Kind]
+		if !ok && e.Value.Kind != 0x0A {
+			kind = fmt.Sprintf("bson %#x", e.Value.Kind)
+		}
+		if issue := checkField(e.Name, kind); issue != nil {
+			issues = append(issues, issue)
+		}
+	}
+	for field, f := range developerSchema {
+		if f.Required && !seen[field] {
+			issues = append(issues, &SchemaIssue{Field: field, Problem: SchemaMissing})
+		}
+	}
+
+	sort.Sort(schemaIssues(issues))
+	return issues
+}
+
+// checkDeveloperWrite returns a SchemaError if a whole document being saved
+// has a field of the wrong kind or is missing a required one. Unknown fields
+// are left for reads to flag, the developer struct can have fields this
+// package doesn't know about. A missing id is fine, Mongo assigns one.
+func checkDeveloperWrite(doc interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	bad := []*SchemaIssue{}
+	for _, issue := range checkRawDeveloper(bson.Raw{Kind: 0x03, Data: raw}) {
+		if issue.Problem != SchemaUnknown && issue.Field != "_id" {
+			bad = append(bad, issue)
+		}
+	}
+	if len(bad) > 0 {
+		return &SchemaError{Issues: bad}
+	}
+
+	return nil
+}
+
+// checkDeveloperUpdate returns a SchemaError if an update sets a field
+// that isn't in the schema, or sets one to a value of the wrong kind.
+// Dotted fields are checked by their top level field.
+func checkDeveloperUpdate(update bson.M) error {
+	bad := []*SchemaIssue{}
+	for op, fields := range update {
+		set, ok := fields.(bson.M)
+		if m, isMap := fields.(map[string]interface{}); isMap {
+			set, ok = m, true
+		}
+		if !ok {
+			continue
+		}
+
+		for field, value := range set {
+			top := strings.SplitN(field, ".", 2)[0]
+			f, known := developerSchema[top]
+			switch {
+			case !known:
+				bad = append(bad, &SchemaIssue{Field: top, Problem: SchemaUnknown})
+			case op == "$unset" && f.Required:
+				bad = append(bad, &SchemaIssue{Field: top, Problem: SchemaMissing})
+			case op == "$set" && top == field:
+				if issue := checkField(top, valueKind(value)); issue != nil {
+					bad = append(bad, issue)
+				}
+			}
+		}
+	}
+	if len(bad) > 0 {
+		sort.Sort(schemaIssues(bad))
+		return &SchemaError{Issues: bad}
+	}
+
+	return nil
+}
+
+// SchemaFlag records the issues found with a developer's document.
+type SchemaFlag struct {
+	DeveloperID bson.ObjectId  `bson:"_id" json:"developerId"`
+	Email       string         `bson:"email,omitempty" json:"email,omitempty"`
+	Issues      []*SchemaIssue `bson:"issues" json:"issues"`
+	FlaggedAt   time.Time      `bson:"flaggedAt" json:"flaggedAt"`
+}
+
+var (
+	schemaFlags *mgo.Collection
+
+	// Developers flagged by this process, so reads only write a flag the
+	// first time they see a bad document.
+	flaggedMutex sync.Mutex
+	flagged      = map[bson.ObjectId]bool{}
+)
+
+func init() {
+	schemaFlags = Client.Db.C("developerSchemaFlags")
+	ensureIndex(schemaFlags, mgo.Index{Key: []string{"-flaggedAt"}})
+}
+
+// flagDeveloper records the issues found reading a developer. It's best
+// effort, reads never fail because a document is off.
+func flagDeveloper(raw bson.Raw, issues []*SchemaIssue) {
+	var d struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Email string        `bson:"email"`
+	}
+	if raw.Unmarshal(&d) != nil || d.ID == "" {
+		return
+	}
+
+	flaggedMutex.Lock()
+	seen := flagged[d.ID]
+	flagged[d.ID] = true
+	flaggedMutex.Unlock()
+	if seen {
+		return
+	}
+
+	schemaFlags.UpsertId(d.ID, &SchemaFlag{DeveloperID: d.ID, Email: d.Email, Issues: issues, FlaggedAt: time.Now()})
+}
+
+// unflagDeveloper removes a developer's flag once their document is fine.
+func unflagDeveloper(id bson.ObjectId) error {
+	flaggedMutex.Lock()
+	delete(flagged, id)
+	flaggedMutex.Unlock()
+
+	err := schemaFlags.RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// GetSchemaFlags returns flagged developers, most recently flagged first.
+func GetSchemaFlags(limit int) ([]*SchemaFlag, error) {
+	fs := []*SchemaFlag{}
+	if err := schemaFlags.Find(nil).Sort("-flaggedAt").Limit(limit).All(&fs); err != nil {
+		return fs, err
+	}
+	for _, f := range fs {
+		if err := openPIIFields(&f.Email); err != nil {
+			return fs, err
+		}
+	}
+
+	return fs, nil
+}
+
+// coerceField converts a value to the kind of the field it's stored in,
+// if there's an obvious conversion. Anything else is left for a person.
+func coerceField(field string, value interface{}) (interface{}, bool) {
+	f, ok := developerSchema[field]
+	if !ok {
+		return nil, false
+	}
+
+	switch v := value.(type) {
+	case string:
+		switch f.Kind {
+		case KindBool:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "on", "1":
+				return true, true
+			case "false", "off", "0", "":
+				return false, true
+			}
+		case KindTime:
+			if t, err := time.Parse(time.RFC3339, strings.TrimSpace(v)); err == nil {
+				return t, true
+			}
+		case KindObjectID:
+			if bson.IsObjectIdHex(v) {
+				return bson.ObjectIdHex(v), true
+			}
+		}
+	case time.Time:
+		// Signups are stored in milliseconds.
+		if f.Kind == KindNumber && field == "createdAt" {
+			return v.UnixNano() / int64(time.Millisecond), true
+		}
+	case bool:
+		if f.Kind == KindString {
+			return fmt.Sprint(v), true
+		}
+	case int, int32, int64, float64:
+		if f.Kind == KindString {
+			return fmt.Sprint(v), true
+		}
+	}
+
+	return nil, false
+}
+
+// SchemaRepair is the result of a repair run.
+type SchemaRepair struct {
+	Checked  int           `json:"checked"`
+	Repaired int           `json:"repaired"`
+	Flagged  []*SchemaFlag `json:"flagged"`
+	DryRun   bool          `json:"dryRun"`
+}
+
+// RepairDeveloperDocuments checks every developer against the schema,
+// converting fields of the wrong kind where it's obvious how. Developers
+// with issues left are flagged, and those that are fine are unflagged.
+// Unknown fields are never removed. With dryRun nothing is written.
+func RepairDeveloperDocuments(dryRun bool) (*SchemaRepair, error) {
+	c, done := readFrom(ReadReports, devs)
+	defer done()
+
+	res := &SchemaRepair{Flagged: []*SchemaFlag{}, DryRun: dryRun}
+	doc := bson.M{}
+	iter := c.Find(nil).Sort("_id").Batch(developerStreamBatch).Iter()
+	for iter.Next(&doc) {
+		res.Checked++
+		id, _ := doc["_id"].(bson.ObjectId)
+		email, _ := doc["email"].(string)
+
+		set := bson.M{}
+		left := []*SchemaIssue{}
+		for _, issue := range CheckDeveloperDocument(doc) {
+			if issue.Problem == SchemaWrongKind {
+				if value, ok := coerceField(issue.Field, doc[issue.Field]); ok {
+					set[issue.Field] = value
+					continue
+				}
+			}
+			left = append(left, issue)
+		}
+
+		if len(set) > 0 {
+			res.Repaired++
+			if !dryRun {
+				if err := updateDeveloper(bson.M{"_id": id}, bson.M{"$set": set}); err != nil {
+					iter.Close()
+					return res, err
+				}
+			}
+		}
+
+		if len(left) > 0 {
+			flag := &SchemaFlag{DeveloperID: id, Email: email, Issues: left, FlaggedAt: time.Now()}
+			if !dryRun {
+				if _, err := schemaFlags.UpsertId(id, flag); err != nil {
+					iter.Close()
+					return res, err
+				}
+			}
+			// Flags keep the email as it's stored, only opened to be shown.
+			if err := openPIIFields(&flag.Email); err != nil {
+				iter.Close()
+				return res, err
+			}
+			res.Flagged = append(res.Flagged, flag)
+		} else if !dryRun {
+			if err := unflagDeveloper(id); err != nil {
+				iter.Close()
+				return res, err
+			}
+		}
+
+		doc = bson.M{}
+	}
+
+	return res, iter.Close()
+}
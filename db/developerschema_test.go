@@ -0,0 +1,63 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestCheckDeveloperDocument(t *testing.T) {
+	issues := CheckDeveloperDocument(bson.M{
+		"_id":        bson.NewObjectId(),
+		"isPaid":     "true",
+		"expiration": time.Now(),
+		"nickname":   "ada",
+	})
+
+	expected := []SchemaIssue{
+		{Field: "email", Problem: SchemaMissing},
+		{Field: "isPaid", Problem: SchemaWrongKind, Kind: KindString},
+		{Field: "nickname", Problem: SchemaUnknown},
+	}
+	if len(issues) != len(expected) {
+		t.Fatal("Unexpected issues:", issues)
+	}
+	for i, issue := range issues {
+		if *issue != expected[i] {
+			t.Error("Expected", expected[i], "got", *issue)
+		}
+	}
+
+	if value, ok := coerceField("isPaid", "true"); !ok || value != true {
+		t.Error("Expected a string bool to be converted:", value)
+	}
+	if _, ok := coerceField("tags", "a,b"); ok {
+		t.Error("Only obvious conversions should be made.")
+	}
+}
+
+func TestCheckDeveloperUpdate(t *testing.T) {
+	valid := []bson.M{
+		{"$set": bson.M{"isPaid": true, "invoice.memo": "net 30"}},
+		{"$addToSet": bson.M{"loginCountries": "US"}},
+		{"$unset": bson.M{"billingContact": ""}},
+	}
+	for _, update := range valid {
+		if err := checkDeveloperUpdate(update); err != nil {
+			t.Error("Expected update to be valid:", update, err)
+		}
+	}
+
+	invalid := []bson.M{
+		{"$set": bson.M{"isPaid": "yes"}},
+		{"$set": bson.M{"nickname": "ada"}},
+		{"$unset": bson.M{"email": ""}},
+	}
+	for _, update := range invalid {
+		if _, ok := checkDeveloperUpdate(update).(*SchemaError); !ok {
+			t.Error("Expected update to be refused:", update)
+		}
+	}
+}
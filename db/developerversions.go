@@ -0,0 +1,190 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// DeveloperVersion is a developer's whole document as it was after a write,
+// so it can be compared with and restored over later ones.
+type DeveloperVersion struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Document    bson.M        `bson:"document" json:"-"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+var developerVersions *mgo.Collection
+
+func init() {
+	developerVersions = Client.Db.C("developerVersions")
+	ensureIndex(developerVersions, mgo.Index{Key: []string{"developerId", "-createdAt"}})
+}
+
+// updateDeveloper applies an update to the developer matching the query and
+// saves the version it leaves them at.
+func updateDeveloper(query, update bson.M) error {
+	if err := checkDeveloperUpdate(update); err != nil {
+		return err
+	}
+	if set, ok := update["$set"].(bson.M); ok {
+		if token, ok := set["token"].(string); ok && token != "" {
+			set["tokenHash"] = TokenHash(token)
+		}
+
+		sealed, err := sealedDeveloperDoc(set)
+		if err != nil {
+			return err
+		}
+		update = copyUpdate(update)
+		update["$set"] = sealed
+	}
+
+	doc := bson.M{}
+	_, err := devs.Find(piiQuery(query)).Apply(mgo.Change{Update: update, ReturnNew: true}, &doc)
+	if err != nil {
+		return err
+	}
+
+	return saveDeveloperVersion(doc)
+}
+
+// copyUpdate returns a copy of an update, so its operators can be replaced
+// without the caller's changing.
+func copyUpdate(update bson.M) bson.M {
+	c := bson.M{}
+	for op, fields := range update {
+		c[op] = fields
+	}
+
+	return c
+}
+
+// saveDeveloperVersion saves a developer's document as a version.
+func saveDeveloperVersion(doc interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	m := bson.M{}
+	if err := bson.Unmarshal(raw, m); err != nil {
+		return err
+	}
+	id, _ := m["_id"].(bson.ObjectId)
+	// Card references are only kept in the billing store.
+	delete(m, "stripeToken")
+
+	return developerVersions.Insert(&DeveloperVersion{
+		ID:          bson.NewObjectId(),
+		DeveloperID: id,
+		Document:    m,
+		CreatedAt:   time.Now(),
+	})
+}
+
+// openVersions opens the PII of versions' documents in place.
+func openVersions(vs ...*DeveloperVersion) error {
+	for _, v := range vs {
+		if err := openDeveloperDoc(v.Document); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetDeveloperVersions returns a developer's versions, newest first.
+func GetDeveloperVersions(id bson.ObjectId, limit int) ([]*DeveloperVersion, error) {
+	vs := []*DeveloperVersion{}
+	if err := developerVersions.Find(bson.M{"developerId": id}).Sort("-createdAt").Limit(limit).All(&vs); err != nil {
+		return vs, err
+	}
+
+	return vs, openVersions(vs...)
+}
+
+// GetDeveloperVersion returns one of a developer's versions.
+func GetDeveloperVersion(id, versionID bson.ObjectId) (*DeveloperVersion, error) {
+	v := &DeveloperVersion{}
+	if err := developerVersions.Find(bson.M{"_id": versionID, "developerId": id}).One(v); err != nil {
+		return v, err
+	}
+
+	return v, openVersions(v)
+}
+
+// GetDeveloperDocument returns a developer's whole document.
+func GetDeveloperDocument(id bson.ObjectId) (bson.M, error) {
+	doc := bson.M{}
+	if err := devs.FindId(id).One(&doc); err != nil {
+		return doc, err
+	}
+
+	return doc, openDeveloperDoc(doc)
+}
+
+// RestoreDeveloperVersion replaces a developer with one of their versions,
+// returning the document restored. The revision moves on from the current
+// one so edits made against the replaced document conflict.
+func RestoreDeveloperVersion(v *DeveloperVersion) (bson.M, error) {
+	revision, err := GetDeveloperRevision(v.DeveloperID)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := bson.M{}
+	for key, value := range v.Document {
+		doc[key] = value
+	}
+	doc["revision"] = revision + 1
+	delete(doc, "stripeToken")
+	if err := checkDeveloperWrite(doc); err != nil {
+		return nil, err
+	}
+	sealed, err := sealedDeveloperDoc(doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := devs.UpdateId(v.DeveloperID, sealed); err != nil {
+		return nil, err
+	}
+
+	return doc, saveDeveloperVersion(sealed)
+}
+
+// PruneDeveloperVersions removes versions from before a time, other than
+// those of held developers. Each developer's newest version is kept however
+// old it is, so it can always be restored.
+func PruneDeveloperVersions(before time.Time, held []bson.ObjectId) (int, error) {
+	latest := []struct {
+		ID bson.ObjectId `bson:"latest"`
+	}{}
+	err := developerVersions.Pipe([]bson.M{
+		{"$sort": bson.M{"createdAt": 1}},
+		{"$group": bson.M{"_id": "$developerId", "latest": bson.M{"$last": "$_id"}}},
+	}).All(&latest)
+	if err != nil {
+		return 0, err
+	}
+
+	keep := []bson.ObjectId{}
+	for _, l := range latest {
+		keep = append(keep, l.ID)
+	}
+	query := bson.M{
+		"createdAt": bson.M{"$lt": before},
+		"_id":       bson.M{"$nin": keep},
+	}
+	if len(held) > 0 {
+		query["developerId"] = bson.M{"$nin": held}
+	}
+
+	info, err := developerVersions.RemoveAll(query)
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Discount application kinds, named for the plan an approval gives.
+const (
+	DiscountStudent    = PlanStudent
+	DiscountOpenSource = PlanOpenSource
+)
+
+// Discount application statuses.
+const (
+	DiscountPending  = "pending"
+	DiscountApproved = "approved"
+	DiscountDenied   = "denied"
+)
+
+// DiscountApplication is a developer asking for a discounted plan, with
+// the proof they're eligible: a school email for students and a repository
+// they maintain for open source.
+type DiscountApplication struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Email       string        `bson:"email" json:"email"`
+	Kind        string        `bson:"kind" json:"kind"`
+	EduEmail    string        `bson:"eduEmail,omitempty" json:"eduEmail,omitempty"`
+	RepoURL     string        `bson:"repoUrl,omitempty" json:"repoUrl,omitempty"`
+	Note        string        `bson:"note,omitempty" json:"note,omitempty"`
+	Status      string        `bson:"status" json:"status"`
+	Response    string        `bson:"response,omitempty" json:"response,omitempty"`
+	ReviewedBy  string        `bson:"reviewedBy,omitempty" json:"reviewedBy,omitempty"`
+	ReviewedAt  time.Time     `bson:"reviewedAt,omitempty" json:"reviewedAt,omitempty"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+var discountApplications *mgo.Collection
+
+func init() {
+	discountApplications = Client.Db.C("discountApplications")
+	ensureIndex(discountApplications, mgo.Index{Key: []string{"status", "createdAt"}})
+	ensureIndex(discountApplications, mgo.Index{Key: []string{"developerId", "-createdAt"}})
+}
+
+// SaveDiscountApplication stores a new pending application. It returns
+// ErrDuplicate if the developer already has one pending.
+func SaveDiscountApplication(a *DiscountApplication) error {
+	n, err := discountApplications.Find(bson.M{"developerId": a.DeveloperID, "status": DiscountPending}).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicate
+	}
+
+	a.ID = bson.NewObjectId()
+	a.Status = DiscountPending
+	a.CreatedAt = time.Now()
+	return discountApplications.Insert(a)
+}
+
+// GetDiscountApplication returns an application by id.
+func GetDiscountApplication(id bson.ObjectId) (*DiscountApplication, error) {
+	a := &DiscountApplication{}
+	return a, discountApplications.FindId(id).One(a)
+}
+
+// GetDiscountApplications returns the applications matching the query,
+// oldest first so the review queue is worked in order.
+func GetDiscountApplications(query bson.M, limit int) ([]*DiscountApplication, error) {
+	as := []*DiscountApplication{}
+	return as, discountApplications.Find(query).Sort("createdAt").Limit(limit).All(&as)
+}
+
+// ReviewDiscountApplication approves or denies a pending application. It
+// returns ErrConflict if it was already reviewed.
+func ReviewDiscountApplication(a *DiscountApplication) error {
+	a.ReviewedAt = time.Now()
+	err := discountApplications.Update(bson.M{"_id": a.ID, "status": DiscountPending}, bson.M{"$set": bson.M{
+		"status":     a.Status,
+		"response":   a.Response,
+		"reviewedBy": a.ReviewedBy,
+		"reviewedAt": a.ReviewedAt,
+	}})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
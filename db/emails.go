@@ -0,0 +1,219 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Email health states, kept on the developer from delivery events.
+const (
+	EmailHealthy      = "ok"
+	EmailSoftBouncing = "soft-bouncing"
+	EmailBounced      = "bounced"
+	EmailComplained   = "complained"
+	EmailRejected     = "rejected"
+	EmailCleaned      = "cleaned"
+)
+
+// UndeliverableEmails are the health states broadcasts skip.
+var UndeliverableEmails = []string{EmailBounced, EmailComplained, EmailRejected, EmailCleaned}
+
+// EmailMessage is an email sent through Mandrill to one recipient, updated
+// by Mandrill's webhook as it's delivered, opened and clicked.
+type EmailMessage struct {
+	ID        string    `bson:"_id" json:"id"`
+	Email     string    `bson:"email" json:"email"`
+	Subject   string    `bson:"subject" json:"subject"`
+	Tags      []string  `bson:"tags,omitempty" json:"tags,omitempty"`
+	Status    string    `bson:"status" json:"status"`
+	LastEvent string    `bson:"lastEvent,omitempty" json:"lastEvent,omitempty"`
+	Opens     int       `bson:"opens" json:"opens"`
+	Clicks    int       `bson:"clicks" json:"clicks"`
+	SentAt    time.Time `bson:"sentAt" json:"sentAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// EmailHealth is how deliverable a developer's address is.
+type EmailHealth struct {
+	Status      string    `bson:"status" json:"status"`
+	SoftBounces int       `bson:"softBounces" json:"softBounces"`
+	Reason      string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	UpdatedAt   time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// EmailSubscription is a developer's mailing list subscription as
+// Mailchimp last reported it. Email is set when the address on the list
+// was changed in Mailchimp.
+type EmailSubscription struct {
+	Unsubscribed bool      `bson:"unsubscribed" json:"unsubscribed"`
+	Reason       string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	Email        string    `bson:"email,omitempty" json:"email,omitempty"`
+	UpdatedAt    time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// EmailStatusCount is the messages in a status for the deliverability
+// report.
+type EmailStatusCount struct {
+	Status  string `bson:"_id" json:"status"`
+	Count   int    `bson:"count" json:"count"`
+	Opened  int    `bson:"opened" json:"opened"`
+	Clicked int    `bson:"clicked" json:"clicked"`
+}
+
+var emailMessages *mgo.Collection
+
+func init() {
+	emailMessages = Client.Db.C("emailMessages")
+
+	ensureIndex(emailMessages, mgo.Index{Key: []string{"sentAt"}})
+	ensureIndex(emailMessages, mgo.Index{Key: []string{"email", "-sentAt"}})
+}
+
+// SaveEmailMessages records sent messages.
+func SaveEmailMessages(ms ...*EmailMessage) error {
+	docs := []interface{}{}
+	now := time.Now()
+	for _, m := range ms {
+		m.Email = strings.ToLower(m.Email)
+		m.SentAt = now
+		m.UpdatedAt = now
+		docs = append(docs, m)
+	}
+
+	return emailMessages.Insert(docs...)
+}
+
+// ApplyEmailEvent records a webhook event on a message. Messages sent
+// before they were recorded are created from the event.
+func ApplyEmailEvent(id, email, subject, event, status string, at time.Time) error {
+	update := bson.M{
+		"$set": bson.M{"lastEvent": event, "updatedAt": at},
+		"$setOnInsert": bson.M{
+			"email":   strings.ToLower(email),
+			"subject": subject,
+			"sentAt":  at,
+		},
+	}
+	if status != "" {
+		update["$set"].(bson.M)["status"] = status
+	}
+	switch event {
+	case "open":
+		update["$inc"] = bson.M{"opens": 1}
+	case "click":
+		update["$inc"] = bson.M{"clicks": 1}
+	}
+
+	_, err := emailMessages.UpsertId(id, update)
+	return err
+}
+
+// GetEmailMessages returns the newest messages matching the query first.
+func GetEmailMessages(query bson.M, limit int) ([]*EmailMessage, error) {
+	ms := []*EmailMessage{}
+	return ms, emailMessages.Find(query).Sort("-sentAt").Limit(limit).All(&ms)
+}
+
+// CountEmailStatuses totals messages sent in [from, to) by status.
+func CountEmailStatuses(from, to time.Time) ([]*EmailStatusCount, error) {
+	c, done := readFrom(ReadReports, emailMessages)
+	defer done()
+
+	counted := func(field string) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{field, 0}}, 1, 0}}}
+	}
+
+	cs := []*EmailStatusCount{}
+	return cs, c.Pipe([]bson.M{
+		{"$match": bson.M{"sentAt": bson.M{"$gte": from, "$lt": to}}},
+		{"$group": bson.M{
+			"_id":     "$status",
+			"count":   bson.M{"$sum": 1},
+			"opened":  counted("$opens"),
+			"clicked": counted("$clicks"),
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}).All(&cs)
+}
+
+// GetEmailHealth returns the health of a developer's address, nil if
+// nothing's been heard about it.
+func GetEmailHealth(email string) (*EmailHealth, error) {
+	var d struct {
+		Health *EmailHealth `bson:"emailHealth"`
+	}
+	err := devs.Find(piiQuery(bson.M{"email": email})).Select(bson.M{"emailHealth": 1}).One(&d)
+	return d.Health, err
+}
+
+// SetEmailHealth stores the health of a developer's address.
+func SetEmailHealth(email string, h *EmailHealth) error {
+	h.UpdatedAt = time.Now()
+	return UpdateDeveloper(bson.M{"email": email}, bson.M{"emailHealth": h})
+}
+
+// GetUnhealthyEmails returns the developers whose address isn't healthy,
+// with their health.
+func GetUnhealthyEmails(limit int) (map[string]*EmailHealth, error) {
+	var rows []struct {
+		Email  string       `bson:"email"`
+		Health *EmailHealth `bson:"emailHealth"`
+	}
+	err := devs.Find(bson.M{
+		"emailHealth.status": bson.M{"$in": append([]string{EmailSoftBouncing}, UndeliverableEmails...)},
+	}).Select(bson.M{"email": 1, "emailHealth": 1}).Limit(limit).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	health := map[string]*EmailHealth{}
+	for _, row := range rows {
+		if err := openPIIFields(&row.Email); err != nil {
+			return nil, err
+		}
+		health[row.Email] = row.Health
+	}
+	return health, nil
+}
+
+// listEmailQuery matches the developer with an address on a mailing list,
+// by the address they signed up with or the one it was changed to.
+func listEmailQuery(email string) bson.M {
+	or := []bson.M{
+		{"email": email},
+		{"emailSubscription.email": email},
+	}
+	if hash := EmailHash(email); hash != "" {
+		or = append(or, bson.M{"emailHash": hash})
+	}
+
+	return bson.M{"$or": or}
+}
+
+// GetEmailSubscription returns the list subscription of the developer with
+// the address, nil if Mailchimp hasn't reported on it.
+func GetEmailSubscription(email string) (*EmailSubscription, error) {
+	var d struct {
+		Subscription *EmailSubscription `bson:"emailSubscription"`
+	}
+	err := devs.Find(listEmailQuery(email)).Select(bson.M{"emailSubscription": 1}).One(&d)
+	return d.Subscription, err
+}
+
+// SetEmailSubscription stores the list subscription of the developer with
+// the address.
+func SetEmailSubscription(email string, s *EmailSubscription) error {
+	s.UpdatedAt = time.Now()
+	return UpdateDeveloper(listEmailQuery(email), bson.M{"emailSubscription": s})
+}
+
+// SetListEmailHealth stores the health of the developer with the address
+// on a mailing list.
+func SetListEmailHealth(email string, h *EmailHealth) error {
+	h.UpdatedAt = time.Now()
+	return UpdateDeveloper(listEmailQuery(email), bson.M{"emailHealth": h})
+}
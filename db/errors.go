@@ -0,0 +1,38 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"errors"
+
+	"labix.org/v2/mgo"
+)
+
+// Errors returned by the package, so callers can tell what went wrong
+// without knowing about the driver.
+var (
+	// ErrNotFound is returned when nothing matches. It's the driver's own
+	// so lookups can return it as is.
+	ErrNotFound = mgo.ErrNotFound
+
+	// ErrDuplicate is returned when a save would break a unique index, or
+	// reuse an id.
+	ErrDuplicate = errors.New("already exists")
+
+	// ErrConflict is returned when an update is refused because the
+	// document changed since it was read, or isn't in a state it can be
+	// updated from.
+	ErrConflict = errors.New("changed by someone else")
+
+	// ErrDeadline is returned when a read made for a request runs past the
+	// request's deadline.
+	ErrDeadline = errors.New("request deadline passed")
+)
+
+// mapError returns the package's error for a driver error.
+func mapError(err error) error {
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+
+	return err
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Event is an analytics event, stored locally before it's forwarded to the
+// analytics provider.
+type Event struct {
+	ID          bson.ObjectId          `bson:"_id" json:"id"`
+	Name        string                 `bson:"name" json:"name"`
+	DeveloperID string                 `bson:"developerId,omitempty" json:"developerId,omitempty"`
+	Properties  map[string]interface{} `bson:"properties" json:"properties"`
+	Forwarded   bool                   `bson:"forwarded" json:"forwarded"`
+	CreatedAt   time.Time              `bson:"createdAt" json:"createdAt"`
+}
+
+var events *mgo.Collection
+
+func init() {
+	events = Client.Db.C("events")
+	ensureIndex(events, mgo.Index{Key: []string{"name", "-createdAt"}})
+}
+
+func SaveEvent(e *Event) error {
+	if e.ID == "" {
+		e.ID = bson.NewObjectId()
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	if e.Properties == nil {
+		e.Properties = map[string]interface{}{}
+	}
+
+	return events.Insert(e)
+}
+
+// GetEvents returns the newest events matching the query first.
+func GetEvents(query bson.M, limit int) ([]*Event, error) {
+	c, done := readFrom(ReadAdmin, events)
+	defer done()
+
+	es := []*Event{}
+	return es, c.Find(query).Sort("-createdAt").Limit(limit).All(&es)
+}
+
+// GetLastEvent returns the developer's most recent event.
+func GetLastEvent(developerID string) (*Event, error) {
+	e := &Event{}
+	return e, events.Find(bson.M{"developerId": developerID}).Sort("-createdAt").One(e)
+}
+
+func CountEvents(query bson.M) (int, error) {
+	c, done := readFrom(ReadReports, events)
+	defer done()
+
+	return c.Find(query).Count()
+}
+
+// GetUnforwardedEvents returns the oldest events not yet forwarded.
+func GetUnforwardedEvents(limit int) ([]*Event, error) {
+	es := []*Event{}
+	return es, events.Find(bson.M{"forwarded": false}).Sort("createdAt").Limit(limit).All(&es)
+}
+
+func MarkEventsForwarded(ids []bson.ObjectId) error {
+	_, err := events.UpdateAll(bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"forwarded": true}})
+	return err
+}
+
+// ActiveDeveloperIDs returns the ids of developers with a heartbeat since a
+// time.
+func ActiveDeveloperIDs(since time.Time) ([]string, error) {
+	c, done := readFrom(ReadReports, events)
+	defer done()
+
+	ids := []string{}
+	return ids, c.Find(bson.M{
+		"name":      "developer.heartbeat",
+		"createdAt": bson.M{"$gte": since},
+	}).Distinct("developerId", &ids)
+}
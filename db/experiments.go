@@ -0,0 +1,136 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Kinds of experiment events.
+const (
+	EventExposure   = "exposure"
+	EventConversion = "conversion"
+)
+
+// Experiment splits visitors of a template between variants. The first
+// variant is the control.
+type Experiment struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Name      string        `bson:"name" json:"name"`
+	Template  string        `bson:"template" json:"template"`
+	Variants  []string      `bson:"variants" json:"variants"`
+	Active    bool          `bson:"active" json:"active"`
+	CreatedAt time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+// ExperimentEvent records a visitor seeing or converting on a variant.
+type ExperimentEvent struct {
+	Experiment string    `bson:"experiment" json:"experiment"`
+	Variant    string    `bson:"variant" json:"variant"`
+	Visitor    string    `bson:"visitor" json:"visitor"`
+	Kind       string    `bson:"kind" json:"kind"`
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// VariantResult holds the totals for a single variant.
+type VariantResult struct {
+	Variant     string  `json:"variant"`
+	Exposures   int     `json:"exposures"`
+	Conversions int     `json:"conversions"`
+	Rate        float64 `json:"rate"`
+}
+
+var (
+	experiments      *mgo.Collection
+	experimentEvents *mgo.Collection
+)
+
+func init() {
+	experiments = Client.Db.C("experiments")
+	experimentEvents = Client.Db.C("experimentEvents")
+}
+
+func SaveExperiment(e *Experiment) error {
+	if e.ID == "" {
+		e.ID = bson.NewObjectId()
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+
+	return experiments.Insert(e)
+}
+
+func GetExperiment(query bson.M) (*Experiment, error) {
+	e := &Experiment{}
+	return e, experiments.Find(query).One(e)
+}
+
+func GetExperiments(query bson.M) ([]*Experiment, error) {
+	es := []*Experiment{}
+	return es, experiments.Find(query).Sort("-createdAt").All(&es)
+}
+
+func UpdateExperiment(query, update bson.M) error {
+	return experiments.Update(query, bson.M{"$set": update})
+}
+
+// RecordExperimentEvent stores an event once per visitor, variant and kind,
+// so reloading a page doesn't inflate exposures.
+func RecordExperimentEvent(ev *ExperimentEvent) error {
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now()
+	}
+
+	_, err := experimentEvents.Upsert(bson.M{
+		"experiment": ev.Experiment,
+		"variant":    ev.Variant,
+		"visitor":    ev.Visitor,
+		"kind":       ev.Kind,
+	}, bson.M{"$setOnInsert": bson.M{"createdAt": ev.CreatedAt}})
+	return err
+}
+
+// GetVisitorVariant returns the variant a visitor was exposed to, if any.
+func GetVisitorVariant(experiment, visitor string) (string, error) {
+	ev := &ExperimentEvent{}
+	err := experimentEvents.Find(bson.M{
+		"experiment": experiment,
+		"visitor":    visitor,
+		"kind":       EventExposure,
+	}).One(ev)
+	return ev.Variant, err
+}
+
+// ExperimentResults totals exposures and conversions for each variant.
+func ExperimentResults(e *Experiment) ([]*VariantResult, error) {
+	results := []*VariantResult{}
+
+	for _, variant := range e.Variants {
+		r := &VariantResult{Variant: variant}
+
+		var err error
+		r.Exposures, err = experimentEvents.Find(bson.M{
+			"experiment": e.Name, "variant": variant, "kind": EventExposure,
+		}).Count()
+		if err != nil {
+			return nil, err
+		}
+
+		r.Conversions, err = experimentEvents.Find(bson.M{
+			"experiment": e.Name, "variant": variant, "kind": EventConversion,
+		}).Count()
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Exposures > 0 {
+			r.Rate = float64(r.Conversions) / float64(r.Exposures)
+		}
+		results = append(results, r)
+	}
+
+	return results, nil
+}
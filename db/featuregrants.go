@@ -0,0 +1,59 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// FeatureGrant turns a feature flag on for one developer, until Until if
+// it's set.
+type FeatureGrant struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Feature     string        `bson:"feature" json:"feature"`
+	Until       time.Time     `bson:"until,omitempty" json:"until,omitempty"`
+	GrantedBy   string        `bson:"grantedBy" json:"grantedBy"`
+	GrantedAt   time.Time     `bson:"grantedAt" json:"grantedAt"`
+}
+
+var featureGrants *mgo.Collection
+
+func init() {
+	featureGrants = Client.Db.C("featureGrants")
+	ensureIndex(featureGrants, mgo.Index{Key: []string{"developerId", "feature"}, Unique: true})
+}
+
+// GrantFeature grants a developer a feature, replacing the grant they have
+// for it if any.
+func GrantFeature(g *FeatureGrant) error {
+	if g.GrantedAt.IsZero() {
+		g.GrantedAt = time.Now()
+	}
+
+	existing := &FeatureGrant{}
+	_, err := featureGrants.Find(bson.M{"developerId": g.DeveloperID, "feature": g.Feature}).Apply(mgo.Change{
+		Update: bson.M{
+			"$set":         bson.M{"until": g.Until, "grantedBy": g.GrantedBy, "grantedAt": g.GrantedAt},
+			"$setOnInsert": bson.M{"_id": bson.NewObjectId()},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, existing)
+	if err == nil {
+		g.ID = existing.ID
+	}
+	return err
+}
+
+// GetFeatureGrants returns the grants that haven't run out by now.
+func GetFeatureGrants(now time.Time) ([]*FeatureGrant, error) {
+	gs := []*FeatureGrant{}
+	return gs, featureGrants.Find(bson.M{"$or": []bson.M{
+		{"until": bson.M{"$exists": false}},
+		{"until": time.Time{}},
+		{"until": bson.M{"$gt": now}},
+	}}).All(&gs)
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Feedback is an NPS score and comment from a developer. Developers have a
+// single response per survey period.
+type Feedback struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Email       string        `bson:"email" json:"email"`
+	Period      string        `bson:"period" json:"period"`
+	Score       int           `bson:"score" json:"score"`
+	Comment     string        `bson:"comment" json:"comment"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+// NPSResult aggregates the responses for a period.
+type NPSResult struct {
+	Period     string `bson:"_id" json:"period"`
+	Responses  int    `bson:"responses" json:"responses"`
+	Promoters  int    `bson:"promoters" json:"promoters"`
+	Detractors int    `bson:"detractors" json:"detractors"`
+}
+
+// NPS returns the net promoter score, from -100 to 100.
+func (r *NPSResult) NPS() int {
+	if r.Responses == 0 {
+		return 0
+	}
+
+	return (r.Promoters - r.Detractors) * 100 / r.Responses
+}
+
+var feedback *mgo.Collection
+
+func init() {
+	feedback = Client.Db.C("feedback")
+}
+
+// SaveFeedback stores the response, replacing the developer's earlier
+// response for the same period. It reports whether the response is new.
+func SaveFeedback(f *Feedback) (bool, error) {
+	if f.CreatedAt.IsZero() {
+		f.CreatedAt = time.Now()
+	}
+	email, hash := f.Email, ""
+	if err := sealEmail(&email, &hash); err != nil {
+		return false, err
+	}
+
+	info, err := feedback.Upsert(bson.M{"developerId": f.DeveloperID, "period": f.Period}, bson.M{
+		"$set": bson.M{
+			"email":     email,
+			"emailHash": hash,
+			"score":     f.Score,
+			"comment":   f.Comment,
+			"createdAt": f.CreatedAt,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return info.UpsertedId != nil, nil
+}
+
+// GetFeedback returns the newest responses first.
+func GetFeedback(query bson.M, limit int) ([]*Feedback, error) {
+	fs := []*Feedback{}
+	if err := feedback.Find(query).Sort("-createdAt").Limit(limit).All(&fs); err != nil {
+		return fs, err
+	}
+
+	for _, f := range fs {
+		if err := openPIIFields(&f.Email); err != nil {
+			return fs, err
+		}
+	}
+	return fs, nil
+}
+
+// GetNPSResults aggregates responses per period, oldest period first.
+func GetNPSResults() ([]*NPSResult, error) {
+	c, done := readFrom(ReadReports, feedback)
+	defer done()
+
+	rs := []*NPSResult{}
+	return rs, c.Pipe([]bson.M{
+		{"$group": bson.M{
+			"_id":        "$period",
+			"responses":  bson.M{"$sum": 1},
+			"promoters":  bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$gte": []interface{}{"$score", 9}}, 1, 0}}},
+			"detractors": bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$lte": []interface{}{"$score", 6}}, 1, 0}}},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}).All(&rs)
+}
@@ -0,0 +1,46 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// FXRates are a day's exchange rates, the units of each currency one unit of
+// Base buys. Currencies are lower case like Stripe's.
+type FXRates struct {
+	ID        string             `bson:"_id" json:"id"`
+	Day       time.Time          `bson:"day" json:"day"`
+	Base      string             `bson:"base" json:"base"`
+	Rates     map[string]float64 `bson:"rates" json:"rates"`
+	Source    string             `bson:"source" json:"source"`
+	FetchedAt time.Time          `bson:"fetchedAt" json:"fetchedAt"`
+}
+
+var fxRates *mgo.Collection
+
+func init() {
+	fxRates = Client.Db.C("fxRates")
+	ensureIndex(fxRates, mgo.Index{Key: []string{"base", "-day"}})
+}
+
+// SaveFXRates stores the rates for a day, replacing any fetched before.
+func SaveFXRates(r *FXRates) error {
+	r.ID = r.Base + ":" + r.Day.Format("2006-01-02")
+	r.FetchedAt = time.Now()
+
+	_, err := fxRates.UpsertId(r.ID, r)
+	return err
+}
+
+// GetFXRates returns the rates for a day, or the latest before it if the
+// day's weren't fetched.
+func GetFXRates(base string, day time.Time) (*FXRates, error) {
+	r := &FXRates{}
+	return r, fxRates.Find(bson.M{
+		"base": base,
+		"day":  bson.M{"$lte": day},
+	}).Sort("-day").One(r)
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// What redeeming a gift code did.
+const (
+	GiftActivated = "activated"
+	GiftCredited  = "credited"
+	GiftExtended  = "extended"
+)
+
+// GiftCode is a prepaid code for months of a paid plan, redeemable once
+// until ExpiresAt. Developers already paying get it as credit instead.
+type GiftCode struct {
+	Code         string        `bson:"_id" json:"code"`
+	Months       int           `bson:"months" json:"months"`
+	Note         string        `bson:"note,omitempty" json:"note,omitempty"`
+	ExpiresAt    time.Time     `bson:"expiresAt" json:"expiresAt"`
+	CreatedBy    string        `bson:"createdBy" json:"createdBy"`
+	CreatedAt    time.Time     `bson:"createdAt" json:"createdAt"`
+	RedeemedBy   bson.ObjectId `bson:"redeemedBy,omitempty" json:"redeemedBy,omitempty"`
+	RedeemedAt   time.Time     `bson:"redeemedAt,omitempty" json:"redeemedAt,omitempty"`
+	Outcome      string        `bson:"outcome,omitempty" json:"outcome,omitempty"`
+	CreditAmount int64         `bson:"creditAmount,omitempty" json:"creditAmount,omitempty"`
+	Currency     string        `bson:"currency,omitempty" json:"currency,omitempty"`
+}
+
+var giftCodes *mgo.Collection
+
+func init() {
+	giftCodes = Client.Db.C("giftCodes")
+	ensureIndex(giftCodes, mgo.Index{Key: []string{"-createdAt"}})
+	ensureIndex(giftCodes, mgo.Index{Key: []string{"redeemedBy"}, Sparse: true})
+}
+
+// SaveGiftCodes stores new codes.
+func SaveGiftCodes(gs []*GiftCode) error {
+	docs := make([]interface{}, len(gs))
+	now := time.Now()
+	for i, g := range gs {
+		if g.CreatedAt.IsZero() {
+			g.CreatedAt = now
+		}
+		docs[i] = g
+	}
+
+	err := giftCodes.Insert(docs...)
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// GetGiftCodes returns the codes matching the query, newest first.
+func GetGiftCodes(query bson.M, limit int) ([]*GiftCode, error) {
+	gs := []*GiftCode{}
+	return gs, giftCodes.Find(query).Sort("-createdAt").Limit(limit).All(&gs)
+}
+
+// ClaimGiftCode marks a code redeemed by a developer if it's unused and
+// hasn't expired by now. It returns ErrNotFound for a code that doesn't
+// exist and ErrConflict for one that's used or expired, along with it.
+func ClaimGiftCode(code string, id bson.ObjectId, now time.Time) (*GiftCode, error) {
+	g := &GiftCode{}
+	_, err := giftCodes.Find(bson.M{
+		"_id":        code,
+		"redeemedBy": bson.M{"$exists": false},
+		"expiresAt":  bson.M{"$gt": now},
+	}).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"redeemedBy": id, "redeemedAt": now}},
+		ReturnNew: true,
+	}, g)
+	if err != mgo.ErrNotFound {
+		return g, err
+	}
+
+	if err := giftCodes.FindId(code).One(g); err != nil {
+		return nil, err
+	}
+	return g, ErrConflict
+}
+
+// FinishGiftCode records what redeeming a claimed code did.
+func FinishGiftCode(g *GiftCode) error {
+	return giftCodes.Update(bson.M{"_id": g.Code, "redeemedBy": g.RedeemedBy}, bson.M{"$set": bson.M{
+		"outcome":      g.Outcome,
+		"creditAmount": g.CreditAmount,
+		"currency":     g.Currency,
+	}})
+}
+
+// ReleaseGiftCode undoes a claim that couldn't be carried out, so the code
+// can be redeemed again.
+func ReleaseGiftCode(g *GiftCode) error {
+	return giftCodes.Update(bson.M{
+		"_id":        g.Code,
+		"redeemedBy": g.RedeemedBy,
+		"outcome":    bson.M{"$exists": false},
+	}, bson.M{"$unset": bson.M{"redeemedBy": "", "redeemedAt": ""}})
+}
@@ -0,0 +1,133 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Scopes a developer can grant to a teammate.
+const (
+	ScopeBillingRead = "billing:read"
+	ScopeDeploy      = "deploy"
+)
+
+// Grant gives a teammate scoped access to another developer's account. It
+// starts as an invitation and becomes usable once accepted.
+type Grant struct {
+	ID               bson.ObjectId `bson:"_id" json:"id"`
+	OwnerID          bson.ObjectId `bson:"ownerId" json:"ownerId"`
+	GranteeEmail     string        `bson:"granteeEmail" json:"granteeEmail"`
+	GranteeEmailHash string        `bson:"granteeEmailHash,omitempty" json:"-"`
+	GranteeID        bson.ObjectId `bson:"granteeId,omitempty" json:"granteeId,omitempty"`
+	Scopes           []string      `bson:"scopes" json:"scopes"`
+	Invite           string        `bson:"invite" json:"-"`
+	Accepted         bool          `bson:"accepted" json:"accepted"`
+	CreatedAt        time.Time     `bson:"createdAt" json:"createdAt"`
+	AcceptedAt       time.Time     `bson:"acceptedAt,omitempty" json:"acceptedAt,omitempty"`
+}
+
+// HasScope reports whether the grant includes the given scope.
+func (g *Grant) HasScope(scope string) bool {
+	for _, s := range g.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+var grants *mgo.Collection
+
+func init() {
+	grants = Client.Db.C("grants")
+}
+
+// ValidScope reports whether scope is one developers may grant.
+func ValidScope(scope string) bool {
+	return scope == ScopeBillingRead || scope == ScopeDeploy
+}
+
+// SaveGrant inserts a new invitation for the grant.
+func SaveGrant(g *Grant) error {
+	if g.ID == "" {
+		g.ID = bson.NewObjectId()
+	}
+	if g.Invite == "" {
+		g.Invite = uuid.New()
+	}
+	if g.CreatedAt.IsZero() {
+		g.CreatedAt = time.Now()
+	}
+
+	sealed := *g
+	if err := sealEmail(&sealed.GranteeEmail, &sealed.GranteeEmailHash); err != nil {
+		return err
+	}
+	return grants.Insert(&sealed)
+}
+
+func GetGrant(query bson.M) (*Grant, error) {
+	g := &Grant{}
+	if err := grants.Find(query).One(g); err != nil {
+		return g, err
+	}
+
+	return g, openPIIFields(&g.GranteeEmail)
+}
+
+func GetGrants(query bson.M) ([]*Grant, error) {
+	gs := []*Grant{}
+	if err := grants.Find(query).All(&gs); err != nil {
+		return gs, err
+	}
+
+	for _, g := range gs {
+		if err := openPIIFields(&g.GranteeEmail); err != nil {
+			return gs, err
+		}
+	}
+	return gs, nil
+}
+
+// AcceptGrant binds the invitation to the grantee.
+func AcceptGrant(invite string, granteeID bson.ObjectId) (*Grant, error) {
+	g, err := GetGrant(bson.M{"invite": invite, "accepted": false})
+	if err != nil {
+		return nil, err
+	}
+
+	g.Accepted = true
+	g.GranteeID = granteeID
+	g.AcceptedAt = time.Now()
+
+	return g, grants.UpdateId(g.ID, bson.M{"$set": bson.M{
+		"accepted":   g.Accepted,
+		"granteeId":  g.GranteeID,
+		"acceptedAt": g.AcceptedAt,
+	}})
+}
+
+// RevokeGrant removes a grant owned by ownerID, accepted or not.
+func RevokeGrant(ownerID, id bson.ObjectId) error {
+	return grants.Remove(bson.M{"_id": id, "ownerId": ownerID})
+}
+
+// HasGrant reports whether the grantee holds an accepted grant with the given
+// scope on the owner's account.
+func HasGrant(ownerID, granteeID bson.ObjectId, scope string) (bool, error) {
+	g, err := GetGrant(bson.M{"ownerId": ownerID, "granteeId": granteeID, "accepted": true})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return g.HasScope(scope), nil
+}
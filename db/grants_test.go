@@ -0,0 +1,54 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestGrantLifecycle(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	grantee := bson.NewObjectId()
+	g := &Grant{
+		OwnerID:      mock.ID,
+		GranteeEmail: "teammate@bowery.io",
+		Scopes:       []string{ScopeBillingRead},
+	}
+	if err := SaveGrant(g); err != nil {
+		t.Fatal("Unable to save grant:", err)
+	}
+	defer RevokeGrant(mock.ID, g.ID)
+
+	ok, err := HasGrant(mock.ID, grantee, ScopeBillingRead)
+	if err != nil {
+		t.Fatal("Unable to check grant:", err)
+	}
+	if ok {
+		t.Error("grant usable before acceptance.")
+	}
+
+	if _, err := AcceptGrant(g.Invite, grantee); err != nil {
+		t.Fatal("Unable to accept grant:", err)
+	}
+
+	if ok, _ = HasGrant(mock.ID, grantee, ScopeBillingRead); !ok {
+		t.Error("accepted grant not usable.")
+	}
+
+	if ok, _ = HasGrant(mock.ID, grantee, ScopeDeploy); ok {
+		t.Error("grant allowed a scope it was not given.")
+	}
+
+	if err := RevokeGrant(mock.ID, g.ID); err != nil {
+		t.Fatal("Unable to revoke grant:", err)
+	}
+
+	if ok, _ = HasGrant(mock.ID, grantee, ScopeBillingRead); ok {
+		t.Error("revoked grant still usable.")
+	}
+}
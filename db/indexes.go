@@ -0,0 +1,56 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"strings"
+
+	"labix.org/v2/mgo"
+)
+
+// ensuredIndex is an index a collection is set up with.
+type ensuredIndex struct {
+	c     *mgo.Collection
+	index mgo.Index
+}
+
+var ensuredIndexes = []*ensuredIndex{}
+
+// ensureIndex creates an index at startup, remembering it so
+// MissingIndexes can tell if it couldn't be built.
+func ensureIndex(c *mgo.Collection, index mgo.Index) {
+	ensuredIndexes = append(ensuredIndexes, &ensuredIndex{c: c, index: index})
+	c.EnsureIndex(index)
+}
+
+// MissingIndexes returns the indexes set up at startup that the database
+// doesn't have, as the collection and the index's keys.
+func MissingIndexes() ([]string, error) {
+	existing := map[string]map[string]bool{}
+	missing := []string{}
+	for _, e := range ensuredIndexes {
+		have, ok := existing[e.c.FullName]
+		if !ok {
+			indexes, err := e.c.Indexes()
+			if err != nil {
+				return nil, err
+			}
+
+			have = map[string]bool{}
+			for _, index := range indexes {
+				have[strings.Join(index.Key, ",")] = true
+			}
+			existing[e.c.FullName] = have
+		}
+
+		if key := strings.Join(e.index.Key, ","); !have[key] {
+			missing = append(missing, e.c.Name+" "+key)
+		}
+	}
+
+	return missing, nil
+}
+
+// Ping checks the database can be reached.
+func Ping() error {
+	return Client.Db.Session.Ping()
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// IP reputation sources.
+const (
+	ReputationAdmin     = "admin"
+	ReputationAbuseIPDB = "abuseipdb"
+)
+
+// IPReputation is how risky signups from an address or CIDR range are, from
+// 0 to 100. Admin entries are kept until removed, looked up entries expire
+// so they're checked again.
+type IPReputation struct {
+	IP        string    `bson:"_id" json:"ip"`
+	Range     bool      `bson:"range" json:"range"`
+	Score     int       `bson:"score" json:"score"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	Source    string    `bson:"source" json:"source"`
+	UpdatedBy string    `bson:"updatedBy,omitempty" json:"updatedBy,omitempty"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	ExpiresAt time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+}
+
+// SignupRisk is the signals recorded on a developer when they signed up,
+// kept for fraud review.
+type SignupRisk struct {
+	IP        string    `bson:"ip" json:"ip"`
+	Score     int       `bson:"score" json:"score"`
+	Sources   []string  `bson:"sources,omitempty" json:"sources,omitempty"`
+	Reasons   []string  `bson:"reasons,omitempty" json:"reasons,omitempty"`
+	Velocity  int       `bson:"velocity" json:"velocity"`
+	Flags     []string  `bson:"flags,omitempty" json:"flags,omitempty"`
+	Flagged   bool      `bson:"flagged" json:"flagged"`
+	CheckedAt time.Time `bson:"checkedAt" json:"checkedAt"`
+}
+
+// FlaggedSignup is a developer whose signup was flagged.
+type FlaggedSignup struct {
+	ID         bson.ObjectId `bson:"_id" json:"id"`
+	Name       string        `bson:"name" json:"name"`
+	Email      string        `bson:"email" json:"email"`
+	SignupRisk *SignupRisk   `bson:"signupRisk" json:"signupRisk"`
+}
+
+var ipReputations *mgo.Collection
+
+func init() {
+	ipReputations = Client.Db.C("ipReputations")
+	ensureIndex(ipReputations, mgo.Index{Key: []string{"range"}})
+	ensureIndex(ipReputations, mgo.Index{Key: []string{"expiresAt"}, ExpireAfter: time.Second})
+}
+
+// SaveIPReputation creates or replaces the reputation of an address or
+// range.
+func SaveIPReputation(r *IPReputation) error {
+	r.UpdatedAt = time.Now()
+	_, err := ipReputations.UpsertId(r.IP, r)
+	return err
+}
+
+// GetIPReputations returns the entries that apply to an address, its own
+// and every range. Callers check which ranges contain it.
+func GetIPReputations(ip string) ([]*IPReputation, error) {
+	rs := []*IPReputation{}
+	return rs, ipReputations.Find(bson.M{"$or": []bson.M{
+		{"_id": ip},
+		{"range": true},
+	}}).All(&rs)
+}
+
+// ListIPReputations returns entries matching the query, riskiest first.
+func ListIPReputations(query bson.M, limit int) ([]*IPReputation, error) {
+	rs := []*IPReputation{}
+	return rs, ipReputations.Find(query).Sort("-score", "_id").Limit(limit).All(&rs)
+}
+
+// DeleteIPReputation removes the entry for an address or range.
+func DeleteIPReputation(ip string) error {
+	return ipReputations.RemoveId(ip)
+}
+
+// SetSignupRisk records the signup signals on a developer.
+func SetSignupRisk(developerID bson.ObjectId, r *SignupRisk) error {
+	return UpdateDeveloper(bson.M{"_id": developerID}, bson.M{"signupRisk": r})
+}
+
+// GetFlaggedSignups returns developers whose signup was flagged, with their
+// signals, newest first.
+func GetFlaggedSignups(limit int) ([]*FlaggedSignup, error) {
+	fs := []*FlaggedSignup{}
+	err := devs.Find(bson.M{"signupRisk.flagged": true}).Select(bson.M{
+		"email": 1, "name": 1, "signupRisk": 1,
+	}).Sort("-signupRisk.checkedAt").Limit(limit).All(&fs)
+	if err != nil {
+		return fs, err
+	}
+	for _, f := range fs {
+		if err := openPIIFields(&f.Name, &f.Email); err != nil {
+			return fs, err
+		}
+	}
+
+	return fs, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Scheduled job states. Cancelled jobs keep the state of their last run
+// and are shown as cancelled.
+const (
+	JobIdle      = "idle"
+	JobRunning   = "running"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// JobState is what's known about a scheduled job across every instance.
+// RunRequestedAt is set when an admin asks for it to run before its next
+// turn, and Cancelled skips its runs until it's retried.
+type JobState struct {
+	Name           string    `bson:"_id" json:"name"`
+	Status         string    `bson:"status" json:"status"`
+	Runs           int       `bson:"runs" json:"runs"`
+	Failures       int       `bson:"failures" json:"failures"`
+	LastError      string    `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	Instance       string    `bson:"instance,omitempty" json:"instance,omitempty"`
+	Cancelled      bool      `bson:"cancelled" json:"cancelled"`
+	RunRequestedAt time.Time `bson:"runRequestedAt,omitempty" json:"runRequestedAt,omitempty"`
+	StartedAt      time.Time `bson:"startedAt,omitempty" json:"startedAt,omitempty"`
+	FinishedAt     time.Time `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+}
+
+var jobStates *mgo.Collection
+
+func init() {
+	jobStates = Client.Db.C("jobStates")
+}
+
+// StartJobRun records that instance started running the named job.
+func StartJobRun(name, instance string) error {
+	_, err := jobStates.UpsertId(name, bson.M{
+		"$set": bson.M{"status": JobRunning, "instance": instance, "startedAt": time.Now()},
+		"$inc": bson.M{"runs": 1},
+	})
+	return err
+}
+
+// FinishJobRun records how a run of the named job ended. Failures counts
+// the runs that failed in a row.
+func FinishJobRun(name string, runErr error) error {
+	update := bson.M{"$set": bson.M{"status": JobIdle, "lastError": "", "failures": 0, "finishedAt": time.Now()}}
+	if runErr != nil {
+		update = bson.M{
+			"$set": bson.M{"status": JobFailed, "lastError": runErr.Error(), "finishedAt": time.Now()},
+			"$inc": bson.M{"failures": 1},
+		}
+	}
+
+	_, err := jobStates.UpsertId(name, update)
+	return err
+}
+
+// GetJobStates returns the state of every job that's run, keyed by name.
+func GetJobStates() (map[string]*JobState, error) {
+	ss := []*JobState{}
+	if err := jobStates.Find(nil).All(&ss); err != nil {
+		return nil, err
+	}
+
+	res := map[string]*JobState{}
+	for _, s := range ss {
+		res[s.Name] = s
+	}
+	return res, nil
+}
+
+// GetJobState returns the state of the named job, a new idle one if it
+// hasn't run.
+func GetJobState(name string) (*JobState, error) {
+	s := &JobState{}
+	err := jobStates.FindId(name).One(s)
+	if err == ErrNotFound {
+		return &JobState{Name: name, Status: JobIdle}, nil
+	}
+
+	return s, err
+}
+
+// RequestJobRun asks for the named job to run as soon as an instance picks
+// it up, clearing a cancel.
+func RequestJobRun(name string) error {
+	_, err := jobStates.UpsertId(name, bson.M{
+		"$set":         bson.M{"runRequestedAt": time.Now(), "cancelled": false},
+		"$setOnInsert": bson.M{"status": JobIdle},
+	})
+	return err
+}
+
+// TakeJobRunRequest clears a request to run the named job, returning true
+// if there was one. Only one instance gets each request.
+func TakeJobRunRequest(name string) (bool, error) {
+	err := jobStates.Update(bson.M{"_id": name, "runRequestedAt": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"runRequestedAt": ""}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// CancelJob skips the named job's runs until it's retried.
+func CancelJob(name string) error {
+	_, err := jobStates.UpsertId(name, bson.M{
+		"$set":         bson.M{"cancelled": true},
+		"$unset":       bson.M{"runRequestedAt": ""},
+		"$setOnInsert": bson.M{"status": JobIdle},
+	})
+	return err
+}
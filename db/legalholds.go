@@ -0,0 +1,66 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// LegalHold keeps a developer's data from being purged or pruned until it's
+// released. Holds are kept apart from developers so they outlast deletion.
+type LegalHold struct {
+	DeveloperID bson.ObjectId `bson:"_id" json:"developerId"`
+	Email       string        `bson:"email" json:"email"`
+	Name        string        `bson:"name" json:"name"`
+	Reason      string        `bson:"reason" json:"reason"`
+	HeldBy      string        `bson:"heldBy" json:"heldBy"`
+	HeldAt      time.Time     `bson:"heldAt" json:"heldAt"`
+}
+
+var legalHolds *mgo.Collection
+
+func init() {
+	legalHolds = Client.Db.C("legalHolds")
+}
+
+// PlaceLegalHold holds a developer's data, replacing any hold already on it.
+func PlaceLegalHold(h *LegalHold) error {
+	if h.HeldAt.IsZero() {
+		h.HeldAt = time.Now()
+	}
+
+	_, err := legalHolds.UpsertId(h.DeveloperID, h)
+	return err
+}
+
+// ReleaseLegalHold removes the hold on a developer's data.
+func ReleaseLegalHold(id bson.ObjectId) error {
+	return legalHolds.RemoveId(id)
+}
+
+// GetLegalHold returns the hold on a developer.
+func GetLegalHold(id bson.ObjectId) (*LegalHold, error) {
+	h := &LegalHold{}
+	return h, legalHolds.FindId(id).One(h)
+}
+
+// GetLegalHolds returns every hold, oldest first.
+func GetLegalHolds() ([]*LegalHold, error) {
+	hs := []*LegalHold{}
+	return hs, legalHolds.Find(nil).Sort("heldAt").All(&hs)
+}
+
+// GetLegalHoldIDs returns the ids of developers on hold.
+func GetLegalHoldIDs() ([]bson.ObjectId, error) {
+	ids := []bson.ObjectId{}
+	return ids, legalHolds.Find(nil).Distinct("_id", &ids)
+}
+
+// OnLegalHold reports whether a developer's data is held, for anything
+// that would remove or anonymize it to check first.
+func OnLegalHold(id bson.ObjectId) (bool, error) {
+	n, err := legalHolds.FindId(id).Count()
+	return n > 0, err
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// License is a signed license key issued to a developer. KeyID is the
+// version of the key it's signed with.
+type License struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Key         string        `bson:"key" json:"key"`
+	KeyID       string        `bson:"keyId,omitempty" json:"keyId,omitempty"`
+	IssuedAt    time.Time     `bson:"issuedAt" json:"issuedAt"`
+	ExpiresAt   time.Time     `bson:"expiresAt" json:"expiresAt"`
+	Revoked     bool          `bson:"revoked" json:"revoked"`
+	RevokedAt   time.Time     `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+}
+
+var licenses *mgo.Collection
+
+func init() {
+	licenses = Client.Db.C("licenses")
+}
+
+func SaveLicense(l *License) error {
+	if l.ID == "" {
+		l.ID = bson.NewObjectId()
+	}
+
+	return licenses.Insert(l)
+}
+
+func GetLicense(query bson.M) (*License, error) {
+	l := &License{}
+	return l, licenses.Find(query).One(l)
+}
+
+// GetCurrentLicense returns the newest unrevoked license for the developer.
+func GetCurrentLicense(developerID bson.ObjectId) (*License, error) {
+	l := &License{}
+	return l, licenses.Find(bson.M{
+		"developerId": developerID,
+		"revoked":     false,
+	}).Sort("-issuedAt").One(l)
+}
+
+// GetRevokedLicenses returns every revoked license, oldest first.
+func GetRevokedLicenses() ([]*License, error) {
+	ls := []*License{}
+	return ls, licenses.Find(bson.M{"revoked": true}).Sort("revokedAt").All(&ls)
+}
+
+// GetLicensesToResign returns up to limit licenses that are still in use
+// and weren't signed with the key given.
+func GetLicensesToResign(keyID string, limit int) ([]*License, error) {
+	ls := []*License{}
+	return ls, licenses.Find(bson.M{
+		"keyId":     bson.M{"$ne": keyID},
+		"revoked":   false,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Limit(limit).All(&ls)
+}
+
+// ResignLicense replaces a license's key with one signed by another key,
+// on the developer too if it's theirs. It returns ErrConflict if the
+// license changed since it was read.
+func ResignLicense(l *License, key, keyID string) error {
+	err := licenses.Update(bson.M{"_id": l.ID, "key": l.Key}, bson.M{"$set": bson.M{
+		"key":   key,
+		"keyId": keyID,
+	}})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	err = UpdateDeveloper(bson.M{"_id": l.DeveloperID, "license": l.Key}, bson.M{"license": key})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func RevokeLicense(id bson.ObjectId) error {
+	return licenses.UpdateId(id, bson.M{"$set": bson.M{
+		"revoked":   true,
+		"revokedAt": time.Now(),
+	}})
+}
@@ -0,0 +1,192 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Lifecycle states a developer moves through.
+const (
+	LifecycleCreated  = "created"
+	LifecycleVerified = "verified"
+	LifecycleTrialing = "trialing"
+	LifecycleActive   = "active"
+	LifecyclePastDue  = "past_due"
+	LifecyclePaused   = "paused"
+	LifecycleCanceled = "canceled"
+	LifecyclePurged   = "purged"
+)
+
+// LifecycleStates lists the states in the order developers move through
+// them.
+var LifecycleStates = []string{
+	LifecycleCreated, LifecycleVerified, LifecycleTrialing, LifecycleActive,
+	LifecyclePastDue, LifecyclePaused, LifecycleCanceled, LifecyclePurged,
+}
+
+// lifecycleTransitions are the states each state can move to. Purged is
+// final.
+var lifecycleTransitions = map[string][]string{
+	LifecycleCreated:  {LifecycleVerified, LifecycleTrialing, LifecycleActive, LifecycleCanceled, LifecyclePurged},
+	LifecycleVerified: {LifecycleTrialing, LifecycleActive, LifecycleCanceled, LifecyclePurged},
+	LifecycleTrialing: {LifecycleActive, LifecycleCanceled, LifecyclePurged},
+	LifecycleActive:   {LifecyclePastDue, LifecyclePaused, LifecycleCanceled, LifecyclePurged},
+	LifecyclePastDue:  {LifecycleActive, LifecycleCanceled, LifecyclePurged},
+	LifecyclePaused:   {LifecycleActive, LifecycleCanceled, LifecyclePurged},
+	LifecycleCanceled: {LifecycleTrialing, LifecycleActive, LifecyclePurged},
+	LifecyclePurged:   {},
+}
+
+// LifecycleError is returned for a transition that isn't allowed.
+type LifecycleError struct {
+	From string
+	To   string
+}
+
+func (e *LifecycleError) Error() string {
+	return fmt.Sprintf("a developer can't go from %s to %s", e.From, e.To)
+}
+
+// ValidLifecycle reports whether state is a lifecycle state.
+func ValidLifecycle(state string) bool {
+	_, ok := lifecycleTransitions[state]
+	return ok
+}
+
+// CanTransition reports whether a developer in from can move to to.
+func CanTransition(from, to string) bool {
+	for _, state := range lifecycleTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DeriveLifecycle returns the state a developer document is in, the stored
+// one if it has one and otherwise what its paid flag and expiration say,
+// for developers from before states were kept.
+func DeriveLifecycle(doc bson.M, now time.Time) string {
+	if state, ok := doc["lifecycle"].(string); ok && ValidLifecycle(state) {
+		return state
+	}
+
+	paid, _ := doc["isPaid"].(bool)
+	expiration, _ := doc["expiration"].(time.Time)
+	switch {
+	case paid && (expiration.IsZero() || expiration.After(now)):
+		return LifecycleActive
+	case paid:
+		return LifecyclePastDue
+	case !expiration.IsZero() && expiration.After(now):
+		return LifecycleTrialing
+	case !expiration.IsZero():
+		return LifecycleCanceled
+	}
+	return LifecycleCreated
+}
+
+// lifecycleFields are the fields a developer's state is derived from.
+var lifecycleFields = bson.M{"lifecycle": 1, "isPaid": 1, "expiration": 1}
+
+// GetLifecycle returns the state of the developer matching the query.
+func GetLifecycle(query bson.M) (string, error) {
+	doc := bson.M{}
+	if err := devs.Find(query).Select(lifecycleFields).One(&doc); err != nil {
+		return "", err
+	}
+
+	return DeriveLifecycle(doc, time.Now()), nil
+}
+
+// GetLifecycles returns the states of the developers with the ids, keyed by
+// id.
+func GetLifecycles(ids []bson.ObjectId) (map[bson.ObjectId]string, error) {
+	res := map[bson.ObjectId]string{}
+	now := time.Now()
+	for start := 0; start < len(ids); start += developerLookupBatch {
+		end := start + developerLookupBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		docs := []bson.M{}
+		if err := devs.Find(bson.M{"_id": bson.M{"$in": ids[start:end]}}).Select(lifecycleFields).All(&docs); err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if id, ok := doc["_id"].(bson.ObjectId); ok {
+				res[id] = DeriveLifecycle(doc, now)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// TransitionDeveloper moves a developer to state, setting the fields in set
+// with it, and returns the state they were in. It returns a LifecycleError
+// if the move isn't allowed from their state, and ErrConflict if their
+// state changed while it was being made. Moving to the state a developer is
+// already in only sets the fields.
+func TransitionDeveloper(id bson.ObjectId, state string, set bson.M) (string, error) {
+	doc := bson.M{}
+	if err := devs.FindId(id).Select(lifecycleFields).One(&doc); err != nil {
+		return "", err
+	}
+	from := DeriveLifecycle(doc, time.Now())
+	if from != state && !CanTransition(from, state) {
+		return from, &LifecycleError{From: from, To: state}
+	}
+
+	query := bson.M{"_id": id, "lifecycle": doc["lifecycle"]}
+	if _, ok := doc["lifecycle"]; !ok {
+		query["lifecycle"] = bson.M{"$exists": false}
+	}
+	update := bson.M{"lifecycle": state}
+	if from != state {
+		update["lifecycleChangedAt"] = time.Now()
+	}
+	for k, v := range set {
+		update[k] = v
+	}
+
+	err := updateDeveloper(query, bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return from, ErrConflict
+	}
+	return from, err
+}
+
+// GetLapsedDevelopers returns developers whose expiration has passed but
+// are still trialing or active, up to limit.
+func GetLapsedDevelopers(now time.Time, limit int) ([]bson.M, error) {
+	docs := []bson.M{}
+	return docs, devs.Find(bson.M{
+		"lifecycle":  bson.M{"$in": []string{LifecycleTrialing, LifecycleActive}},
+		"expiration": bson.M{"$lt": now, "$gt": time.Time{}},
+	}).Select(lifecycleFields).Limit(limit).All(&docs)
+}
+
+// GetPausedDevelopers returns paused developers whose pause ends by before,
+// up to limit.
+func GetPausedDevelopers(before time.Time, limit int) ([]bson.M, error) {
+	docs := []bson.M{}
+	return docs, devs.Find(bson.M{
+		"lifecycle":   LifecyclePaused,
+		"pauseEndsAt": bson.M{"$lte": before},
+	}).Select(bson.M{"pauseEndsAt": 1}).Sort("pauseEndsAt").Limit(limit).All(&docs)
+}
+
+// GetPauseEnd returns when a developer's latest pause ends.
+func GetPauseEnd(id bson.ObjectId) (time.Time, error) {
+	doc := struct {
+		PauseEndsAt time.Time `bson:"pauseEndsAt"`
+	}{}
+	return doc.PauseEndsAt, devs.FindId(id).Select(bson.M{"pauseEndsAt": 1}).One(&doc)
+}
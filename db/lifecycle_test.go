@@ -0,0 +1,75 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestCanTransition(t *testing.T) {
+	allowed := [][2]string{
+		{LifecycleCreated, LifecycleTrialing},
+		{LifecycleTrialing, LifecycleActive},
+		{LifecycleActive, LifecyclePastDue},
+		{LifecyclePastDue, LifecycleActive},
+		{LifecycleCanceled, LifecycleActive},
+		{LifecycleCanceled, LifecyclePurged},
+	}
+	for _, pair := range allowed {
+		if !CanTransition(pair[0], pair[1]) {
+			t.Error("Expected", pair[0], "to be able to move to", pair[1])
+		}
+	}
+
+	denied := [][2]string{
+		{LifecyclePurged, LifecycleActive},
+		{LifecycleActive, LifecycleTrialing},
+		{LifecycleTrialing, LifecyclePastDue},
+		{LifecycleActive, LifecycleActive},
+		{"unknown", LifecycleActive},
+	}
+	for _, pair := range denied {
+		if CanTransition(pair[0], pair[1]) {
+			t.Error("Expected", pair[0], "not to be able to move to", pair[1])
+		}
+	}
+}
+
+func TestDeriveLifecycle(t *testing.T) {
+	now := time.Now()
+	docs := map[string]bson.M{
+		LifecycleCreated:  {},
+		LifecycleTrialing: {"expiration": now.Add(time.Hour)},
+		LifecycleCanceled: {"expiration": now.Add(-time.Hour)},
+		LifecycleActive:   {"isPaid": true, "expiration": now.Add(time.Hour)},
+		LifecyclePastDue:  {"isPaid": true, "expiration": now.Add(-time.Hour)},
+		LifecycleVerified: {"lifecycle": LifecycleVerified, "isPaid": true},
+	}
+	for want, doc := range docs {
+		if got := DeriveLifecycle(doc, now); got != want {
+			t.Error("Expected", doc, "to be", want, "got", got)
+		}
+	}
+}
+
+func TestTransitionDeveloper(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	if _, err := TransitionDeveloper(mock.ID, LifecycleActive, bson.M{"isPaid": true}); err != nil {
+		t.Fatal("Unable to activate developer:", err)
+	}
+	if state, err := GetLifecycle(bson.M{"_id": mock.ID}); err != nil || state != LifecycleActive {
+		t.Error("Expected developer to be active, got", state, err)
+	}
+
+	if _, err := TransitionDeveloper(mock.ID, LifecycleVerified, nil); err == nil {
+		t.Error("Expected moving an active developer to verified to fail.")
+	} else if _, ok := err.(*LifecycleError); !ok {
+		t.Error("Expected a lifecycle error, got", err)
+	}
+}
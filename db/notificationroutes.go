@@ -0,0 +1,72 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// NotificationRouting is a developer's or organization's choice of channels
+// for each kind of notification. Kinds missing from Routes fall back, a
+// developer's to their organization's and an organization's to the
+// defaults. SlackURL is the incoming webhook Slack notifications are
+// posted to.
+type NotificationRouting struct {
+	Owner     string              `bson:"_id" json:"-"`
+	Routes    map[string][]string `bson:"routes" json:"routes"`
+	SlackURL  string              `bson:"slackUrl,omitempty" json:"slackUrl,omitempty"`
+	UpdatedAt time.Time           `bson:"updatedAt" json:"updatedAt"`
+}
+
+var notificationRoutes *mgo.Collection
+
+func init() {
+	notificationRoutes = Client.Db.C("notificationRoutes")
+}
+
+// DeveloperRouting is the owner of a developer's routing.
+func DeveloperRouting(id bson.ObjectId) string {
+	return "developer:" + id.Hex()
+}
+
+// OrganizationRouting is the owner of an organization's routing.
+func OrganizationRouting(id bson.ObjectId) string {
+	return "organization:" + id.Hex()
+}
+
+// GetNotificationRouting returns the owner's routing, an empty one if they
+// haven't set any.
+func GetNotificationRouting(owner string) (*NotificationRouting, error) {
+	r := &NotificationRouting{}
+	err := notificationRoutes.FindId(owner).One(r)
+	if err == ErrNotFound {
+		return &NotificationRouting{Owner: owner, Routes: map[string][]string{}}, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	if r.Routes == nil {
+		r.Routes = map[string][]string{}
+	}
+
+	r.SlackURL, err = openPII(r.SlackURL)
+	return r, err
+}
+
+// SaveNotificationRouting replaces the owner's routing. The slack url is
+// sealed like other personal data since it can post to their workspace.
+func SaveNotificationRouting(r *NotificationRouting) error {
+	r.UpdatedAt = time.Now()
+
+	sealed := *r
+	url, err := sealPII(r.SlackURL)
+	if err != nil {
+		return err
+	}
+	sealed.SlackURL = url
+
+	_, err = notificationRoutes.UpsertId(r.Owner, &sealed)
+	return err
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Notification is a sent notification, kept for its suppression window so
+// the same notification isn't sent again by a retry or another instance.
+type Notification struct {
+	Key        string    `bson:"_id" json:"key"`
+	SentAt     time.Time `bson:"sentAt" json:"sentAt"`
+	ExpiresAt  time.Time `bson:"expiresAt" json:"expiresAt"`
+	Suppressed int       `bson:"suppressed" json:"suppressed"`
+}
+
+var notifications *mgo.Collection
+
+func init() {
+	notifications = Client.Db.C("notifications")
+	ensureIndex(notifications, mgo.Index{Key: []string{"expiresAt"}, ExpireAfter: time.Second})
+}
+
+// ClaimNotification reserves key for window, returning false if it's already
+// been sent within its window. Suppressed sends are counted on the key.
+func ClaimNotification(key string, window time.Duration) (bool, error) {
+	now := time.Now()
+	n := &Notification{Key: key, SentAt: now, ExpiresAt: now.Add(window)}
+	err := notifications.Insert(n)
+	if !mgo.IsDup(err) {
+		return err == nil, err
+	}
+
+	// Mongo removes expired keys in the background, so one may linger.
+	err = notifications.Update(bson.M{"_id": key, "expiresAt": bson.M{"$lte": now}}, n)
+	if err != mgo.ErrNotFound {
+		return err == nil, err
+	}
+
+	return false, notifications.UpdateId(key, bson.M{"$inc": bson.M{"suppressed": 1}})
+}
+
+// ReleaseNotification forgets key, used when the send it was claimed for
+// failed so a retry can send it.
+func ReleaseNotification(key string) error {
+	err := notifications.RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// GetNotifications returns the most recently sent notifications.
+func GetNotifications(query bson.M, limit int) ([]*Notification, error) {
+	ns := []*Notification{}
+	return ns, notifications.Find(query).Sort("-sentAt").Limit(limit).All(&ns)
+}
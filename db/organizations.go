@@ -0,0 +1,99 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Branding is how an organization's pages look. Colors are css hex values.
+type Branding struct {
+	LogoURL      string `bson:"logoUrl" json:"logoUrl"`
+	PrimaryColor string `bson:"primaryColor" json:"primaryColor"`
+	AccentColor  string `bson:"accentColor" json:"accentColor"`
+}
+
+// Organization is an enterprise customer with white labeled signup and
+// reset pages, served on its own domains or a subdomain of ours.
+type Organization struct {
+	ID        bson.ObjectId   `bson:"_id" json:"id"`
+	Name      string          `bson:"name" json:"name"`
+	Slug      string          `bson:"slug" json:"slug"`
+	Domains   []string        `bson:"domains" json:"domains"`
+	Branding  Branding        `bson:"branding" json:"branding"`
+	Billing   *BillingAddress `bson:"billingAddress,omitempty" json:"billingAddress,omitempty"`
+	Invoice   InvoiceDetails  `bson:"invoice" json:"invoice"`
+	CreatedAt time.Time       `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time       `bson:"updatedAt" json:"updatedAt"`
+}
+
+// Certificate is a TLS certificate provisioned for a custom domain, stored
+// so every instance serves the same one.
+type Certificate struct {
+	Key       string    `bson:"_id"`
+	Data      []byte    `bson:"data"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+var (
+	orgs  *mgo.Collection
+	certs *mgo.Collection
+)
+
+func init() {
+	orgs = Client.Db.C("organizations")
+	certs = Client.Db.C("certificates")
+
+	// A domain or slug can only point at one organization.
+	ensureIndex(orgs, mgo.Index{Key: []string{"slug"}, Unique: true})
+	ensureIndex(orgs, mgo.Index{Key: []string{"domains"}, Unique: true, Sparse: true})
+}
+
+// SaveOrganization creates or updates an organization.
+func SaveOrganization(o *Organization) error {
+	now := time.Now()
+	if o.ID == "" {
+		o.ID = bson.NewObjectId()
+		o.CreatedAt = now
+	}
+	o.UpdatedAt = now
+
+	_, err := orgs.UpsertId(o.ID, o)
+	return mapError(err)
+}
+
+// GetOrganization returns the organization matching the query.
+func GetOrganization(query bson.M) (*Organization, error) {
+	o := &Organization{}
+	return o, orgs.Find(query).One(o)
+}
+
+// GetOrganizations returns every organization by name.
+func GetOrganizations() ([]*Organization, error) {
+	all := []*Organization{}
+	return all, orgs.Find(nil).Sort("name").All(&all)
+}
+
+// GetCertificate returns the stored certificate data for key.
+func GetCertificate(key string) ([]byte, error) {
+	c := &Certificate{}
+	return c.Data, certs.FindId(key).One(c)
+}
+
+// SaveCertificate stores certificate data for key.
+func SaveCertificate(key string, data []byte) error {
+	_, err := certs.UpsertId(key, &Certificate{Key: key, Data: data, UpdatedAt: time.Now()})
+	return err
+}
+
+// DeleteCertificate removes the certificate data for key.
+func DeleteCertificate(key string) error {
+	err := certs.RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Outbox message states.
+const (
+	OutboxPending    = "pending"
+	OutboxDone       = "done"
+	OutboxFailed     = "failed"
+	OutboxDiscarded  = "discarded"
+	OutboxProcessing = "processing"
+)
+
+// OutboxMessage is a side effect of a write, e.g. an email to send once a
+// developer is saved. Messages for a new developer are written inside the
+// developer document itself, so they're saved if and only if the developer
+// is, and moved into the outbox by DrainDeveloperOutboxes.
+type OutboxMessage struct {
+	ID            bson.ObjectId          `bson:"_id" json:"id"`
+	Kind          string                 `bson:"kind" json:"kind"`
+	DeveloperID   bson.ObjectId          `bson:"developerId" json:"developerId"`
+	Payload       map[string]interface{} `bson:"payload" json:"payload"`
+	Status        string                 `bson:"status" json:"status"`
+	Attempts      int                    `bson:"attempts" json:"attempts"`
+	LastError     string                 `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	NextAttemptAt time.Time              `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	LockedBy      bson.ObjectId          `bson:"lockedBy,omitempty" json:"-"`
+	LockedUntil   time.Time              `bson:"lockedUntil,omitempty" json:"-"`
+	CreatedAt     time.Time              `bson:"createdAt" json:"createdAt"`
+	DoneAt        time.Time              `bson:"doneAt,omitempty" json:"doneAt,omitempty"`
+}
+
+var outbox *mgo.Collection
+
+func init() {
+	outbox = Client.Db.C("outbox")
+}
+
+// SaveOutboxMessages stores pending messages, due now unless they have a
+// NextAttemptAt.
+func SaveOutboxMessages(ms ...*OutboxMessage) error {
+	docs := []interface{}{}
+	for _, m := range prepareOutboxMessages(ms) {
+		docs = append(docs, m)
+	}
+
+	return outbox.Insert(docs...)
+}
+
+// prepareOutboxMessages fills in the ids, status and times of new messages.
+func prepareOutboxMessages(ms []*OutboxMessage) []*OutboxMessage {
+	now := time.Now()
+	for _, m := range ms {
+		if m.ID == "" {
+			m.ID = bson.NewObjectId()
+		}
+		if m.Payload == nil {
+			m.Payload = map[string]interface{}{}
+		}
+		m.Status = OutboxPending
+		m.CreatedAt = now
+		if m.NextAttemptAt.IsZero() {
+			m.NextAttemptAt = now
+		}
+	}
+
+	return ms
+}
+
+// withOutbox returns the developer document to insert, with the messages
+// embedded in it when there are any.
+func withOutbox(d *schemas.Developer, ms []*OutboxMessage) (interface{}, error) {
+	if len(ms) == 0 {
+		return d, nil
+	}
+
+	raw, err := bson.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(raw, doc); err != nil {
+		return nil, err
+	}
+	for _, m := range ms {
+		m.DeveloperID = d.ID
+	}
+	doc["outbox"] = prepareOutboxMessages(ms)
+
+	return doc, nil
+}
+
+// DrainDeveloperOutboxes moves the messages saved inside developer documents
+// into the outbox, returning how many were moved. A message is inserted
+// before it's pulled from its developer, and one that's already there is
+// skipped, so a drain that stops part way is repeated safely.
+func DrainDeveloperOutboxes(limit int) (int, error) {
+	var ds []struct {
+		ID     bson.ObjectId    `bson:"_id"`
+		Outbox []*OutboxMessage `bson:"outbox"`
+	}
+	err := devs.Find(bson.M{"outbox._id": bson.M{"$exists": true}}).
+		Select(bson.M{"outbox": 1}).Limit(limit).All(&ds)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, d := range ds {
+		ids := []bson.ObjectId{}
+		for _, m := range d.Outbox {
+			if err := outbox.Insert(m); err != nil && !mgo.IsDup(err) {
+				return n, err
+			}
+			ids = append(ids, m.ID)
+		}
+
+		err := devs.UpdateId(d.ID, bson.M{"$pull": bson.M{"outbox": bson.M{"_id": bson.M{"$in": ids}}}})
+		if err != nil && err != mgo.ErrNotFound {
+			return n, err
+		}
+		n += len(ids)
+	}
+
+	return n, nil
+}
+
+// DiscardOutboxMessages drops the pending messages for a developer whose
+// signup is being undone, including any not yet drained from the developer.
+func DiscardOutboxMessages(developerID bson.ObjectId) error {
+	err := devs.UpdateId(developerID, bson.M{"$unset": bson.M{"outbox": ""}})
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	_, err = outbox.UpdateAll(bson.M{
+		"developerId": developerID,
+		"status":      OutboxPending,
+	}, bson.M{"$set": bson.M{"status": OutboxDiscarded}})
+	return err
+}
+
+// ClaimOutboxMessage takes the next due message, holding it for lease so no
+// other worker performs it at the same time. Messages whose holder died are
+// claimed again once the lease runs out, under a new LockedBy.
+func ClaimOutboxMessage(lease time.Duration) (*OutboxMessage, error) {
+	now := time.Now()
+	m := &OutboxMessage{}
+	_, err := outbox.Find(bson.M{
+		"$or": []bson.M{
+			{"status": OutboxPending, "nextAttemptAt": bson.M{"$lte": now}},
+			{"status": OutboxProcessing, "lockedUntil": bson.M{"$lt": now}},
+		},
+	}).Sort("nextAttemptAt").Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"status":      OutboxProcessing,
+			"lockedBy":    bson.NewObjectId(),
+			"lockedUntil": now.Add(lease),
+		}},
+		ReturnNew: true,
+	}, m)
+
+	return m, err
+}
+
+// FinishOutboxMessage records the outcome of a claimed message, as long as
+// the claim is still the one holding it. It returns ErrConflict if the lease
+// ran out and the message was claimed again.
+func FinishOutboxMessage(m *OutboxMessage, update bson.M) error {
+	err := outbox.Update(bson.M{
+		"_id":      m.ID,
+		"status":   OutboxProcessing,
+		"lockedBy": m.LockedBy,
+	}, bson.M{"$set": update, "$unset": bson.M{"lockedBy": "", "lockedUntil": ""}})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
+
+// UpdateOutboxMessage sets the fields on a message.
+func UpdateOutboxMessage(id bson.ObjectId, update bson.M) error {
+	return outbox.UpdateId(id, bson.M{"$set": update})
+}
+
+// GetOutboxMessages returns the newest messages first.
+func GetOutboxMessages(query bson.M, limit int) ([]*OutboxMessage, error) {
+	ms := []*OutboxMessage{}
+	return ms, outbox.Find(query).Sort("-createdAt").Limit(limit).All(&ms)
+}
+
+// CountOutboxMessages counts messages matching the query.
+func CountOutboxMessages(query bson.M) (int, error) {
+	return outbox.Find(query).Count()
+}
+
+// SetOutboxMessageStatus moves a message to status if it's in one of from,
+// setting the fields in update too. It returns ErrConflict if it isn't.
+func SetOutboxMessageStatus(id bson.ObjectId, from []string, status string, update bson.M) error {
+	set := bson.M{"status": status}
+	for k, v := range update {
+		set[k] = v
+	}
+
+	err := outbox.Update(bson.M{"_id": id, "status": bson.M{"$in": from}}, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
+
+// PrioritizeOutboxMessage makes a pending message the next one claimed. It
+// returns ErrConflict if it isn't pending.
+func PrioritizeOutboxMessage(id bson.ObjectId) error {
+	// Claims go in nextAttemptAt order, so the earliest time goes first.
+	return SetOutboxMessageStatus(id, []string{OutboxPending}, OutboxPending, bson.M{"nextAttemptAt": time.Unix(0, 0)})
+}
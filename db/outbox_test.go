@@ -0,0 +1,71 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestSaveWithOutbox(t *testing.T) {
+	d := &schemas.Developer{
+		ID:    bson.NewObjectId(),
+		Email: bson.NewObjectId().Hex() + "@bowery.io",
+		Token: bson.NewObjectId().Hex(),
+	}
+	m := &OutboxMessage{Kind: "slack.signup"}
+	if err := TenantOf("").SaveWithOutbox(d, m); err != nil {
+		t.Fatal("Unable to save developer:", err)
+	}
+	defer devs.RemoveId(d.ID)
+	defer outbox.RemoveId(m.ID)
+
+	if n, err := outbox.FindId(m.ID).Count(); err != nil || n != 0 {
+		t.Fatal("message was in the outbox before it was drained.")
+	}
+
+	// Draining twice is the same as draining once.
+	for i := 0; i < 2; i++ {
+		if _, err := DrainDeveloperOutboxes(100); err != nil {
+			t.Fatal("Unable to drain outboxes:", err)
+		}
+	}
+
+	saved := &OutboxMessage{}
+	if err := outbox.FindId(m.ID).One(saved); err != nil {
+		t.Fatal("message wasn't drained into the outbox:", err)
+	}
+	if saved.DeveloperID != d.ID || saved.Status != OutboxPending {
+		t.Error("drained message doesn't belong to the developer or isn't pending.")
+	}
+	if n, _ := devs.Find(bson.M{"_id": d.ID, "outbox._id": m.ID}).Count(); n != 0 {
+		t.Error("drained message was left on the developer.")
+	}
+}
+
+func TestFinishOutboxMessage(t *testing.T) {
+	m := &OutboxMessage{Kind: "slack.signup", DeveloperID: bson.NewObjectId(), NextAttemptAt: time.Unix(1, 0)}
+	if err := SaveOutboxMessages(m); err != nil {
+		t.Fatal("Unable to save message:", err)
+	}
+	defer outbox.RemoveId(m.ID)
+
+	first, err := ClaimOutboxMessage(-time.Minute)
+	if err != nil || first.ID != m.ID {
+		t.Fatal("Unable to claim message:", err)
+	}
+	// The lease has already run out, so it's claimed again.
+	second, err := ClaimOutboxMessage(time.Minute)
+	if err != nil || second.ID != m.ID || second.LockedBy == first.LockedBy {
+		t.Fatal("Unable to claim message again:", err)
+	}
+
+	if err := FinishOutboxMessage(first, bson.M{"status": OutboxDone}); err != ErrConflict {
+		t.Error("expired claim finished the message:", err)
+	}
+	if err := FinishOutboxMessage(second, bson.M{"status": OutboxDone}); err != nil {
+		t.Error("Unable to finish message:", err)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Payment kinds.
+const (
+	PaymentPurchase = "purchase"
+	PaymentRenewal  = "renewal"
+)
+
+// Payment methods.
+const (
+	MethodCard = "card"
+	MethodACH  = "us_bank_account"
+)
+
+// Payment states. Processing payments are waiting for the money to arrive,
+// e.g. a bank transfer settling.
+const (
+	PaymentPending        = "pending"
+	PaymentRequiresAction = "requires_action"
+	PaymentProcessing     = "processing"
+	PaymentSucceeded      = "succeeded"
+	PaymentFailed         = "failed"
+)
+
+// Payment is a Stripe PaymentIntent made for a developer. Payments the bank
+// wants authenticated wait in requires_action until the developer confirms
+// them, and are fulfilled once they succeed. Wallet is set for cards paid
+// with e.g. apple_pay or google_pay.
+type Payment struct {
+	ID              string        `bson:"_id" json:"id"`
+	DeveloperID     bson.ObjectId `bson:"developerId" json:"developerId"`
+	Kind            string        `bson:"kind" json:"kind"`
+	Plan            string        `bson:"plan" json:"plan"`
+	Amount          int64         `bson:"amount" json:"amount"`
+	Currency        string        `bson:"currency" json:"currency"`
+	Method          string        `bson:"method" json:"method"`
+	PaymentMethod   string        `bson:"paymentMethod,omitempty" json:"-"`
+	Wallet          string        `bson:"wallet,omitempty" json:"wallet,omitempty"`
+	Status          string        `bson:"status" json:"status"`
+	Error           string        `bson:"error,omitempty" json:"error,omitempty"`
+	ActionEmailedAt time.Time     `bson:"actionEmailedAt,omitempty" json:"actionEmailedAt,omitempty"`
+	CreatedAt       time.Time     `bson:"createdAt" json:"createdAt"`
+	UpdatedAt       time.Time     `bson:"updatedAt" json:"updatedAt"`
+}
+
+// OpenPaymentStates are the states of payments that haven't finished.
+var OpenPaymentStates = []string{PaymentPending, PaymentRequiresAction, PaymentProcessing}
+
+var payments *mgo.Collection
+
+func init() {
+	payments = Client.Db.C("payments")
+	ensureIndex(payments, mgo.Index{Key: []string{"developerId", "-createdAt"}})
+}
+
+// SavePayment records a payment.
+func SavePayment(p *Payment) error {
+	now := time.Now()
+	p.CreatedAt = now
+	p.UpdatedAt = now
+	return mapError(payments.Insert(p))
+}
+
+// GetPayment returns the payment for a PaymentIntent id.
+func GetPayment(id string) (*Payment, error) {
+	p := &Payment{}
+	return p, payments.FindId(id).One(p)
+}
+
+// GetPayments returns payments matching the query, newest first.
+func GetPayments(query bson.M, limit int) ([]*Payment, error) {
+	ps := []*Payment{}
+	return ps, payments.Find(query).Sort("-createdAt").Limit(limit).All(&ps)
+}
+
+// UpdatePayment sets fields on a payment.
+func UpdatePayment(id string, update bson.M) error {
+	update["updatedAt"] = time.Now()
+	return payments.UpdateId(id, bson.M{"$set": update})
+}
+
+// FinishPayment moves a payment that hasn't finished to status, returning
+// false if it already had. Only the caller that finishes it fulfills it.
+func FinishPayment(id, status, paymentErr string) (bool, error) {
+	err := payments.Update(bson.M{
+		"_id":    id,
+		"status": bson.M{"$in": OpenPaymentStates},
+	}, bson.M{"$set": bson.M{"status": status, "error": paymentErr, "updatedAt": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// GetRevenuePayments returns payments that settled in [from, to).
+func GetRevenuePayments(from, to time.Time) ([]*Payment, error) {
+	c, done := readFrom(ReadReports, payments)
+	defer done()
+
+	ps := []*Payment{}
+	return ps, c.Find(bson.M{
+		"status":    PaymentSucceeded,
+		"updatedAt": bson.M{"$gte": from, "$lt": to},
+	}).Sort("updatedAt").All(&ps)
+}
@@ -0,0 +1,654 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// piiPrefix starts every sealed value, followed by the id of the key its
+// data key is wrapped with, the wrapped data key and the ciphertext.
+const piiPrefix = "pii1:"
+
+var (
+	// ErrNoPIIKey is returned when a value is sealed with a key that isn't
+	// loaded, or encrypt-pii runs without a current key.
+	ErrNoPIIKey = errors.New("the PII key isn't loaded")
+
+	// ErrSealedPII is returned for a sealed value that's been tampered
+	// with or cut short.
+	ErrSealedPII = errors.New("sealed PII is corrupt")
+)
+
+var (
+	piiMutex    sync.RWMutex
+	piiKeys     map[string]cipher.AEAD
+	piiKeyID    string
+	piiIndexKey []byte
+)
+
+// SetPIIKeys sets the 32 byte keys developers' emails, names and billing
+// addresses are sealed with, by id. New values are sealed with the current
+// one, the rest can only open values. The index key hashes emails so they
+// can still be looked up, it can't change without rehashing them all.
+func SetPIIKeys(current string, keys map[string][]byte, indexKey []byte) error {
+	if _, ok := keys[current]; !ok {
+		return errors.New("the current PII key isn't one of the keys")
+	}
+	if len(indexKey) == 0 {
+		return errors.New("the PII index key must be set")
+	}
+
+	gcms := map[string]cipher.AEAD{}
+	for id, key := range keys {
+		if strings.Contains(id, ":") {
+			return errors.New("PII key ids can't contain colons")
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return err
+		}
+		gcms[id] = gcm
+	}
+
+	piiMutex.Lock()
+	defer piiMutex.Unlock()
+	piiKeys = gcms
+	piiKeyID = current
+	piiIndexKey = indexKey
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// currentPIIKey returns the key new values are sealed with, and its id.
+// It's nil until keys are set, PII is stored as is until then.
+func currentPIIKey() (cipher.AEAD, string) {
+	piiMutex.RLock()
+	defer piiMutex.RUnlock()
+
+	return piiKeys[piiKeyID], piiKeyID
+}
+
+func getPIIKey(id string) (cipher.AEAD, error) {
+	piiMutex.RLock()
+	defer piiMutex.RUnlock()
+	gcm, ok := piiKeys[id]
+	if !ok {
+		return nil, ErrNoPIIKey
+	}
+
+	return gcm, nil
+}
+
+// piiIndexed reports whether emails are hashed, which they are once the
+// keys are set.
+func piiIndexed() bool {
+	piiMutex.RLock()
+	defer piiMutex.RUnlock()
+
+	return piiIndexKey != nil
+}
+
+// EmailHash returns the hash an email is looked up by, empty without an
+// index key.
+func EmailHash(email string) string {
+	piiMutex.RLock()
+	key := piiIndexKey
+	piiMutex.RUnlock()
+	if key == nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(email))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isSealed reports whether a value is sealed.
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, piiPrefix)
+}
+
+// sealPII seals a value with a new data key wrapped by the current key.
+// Empty and sealed values, and every value when there's no key, are
+// returned as is.
+func sealPII(value string) (string, error) {
+	kek, keyID := currentPIIKey()
+	if kek == nil || value == "" || isSealed(value) {
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(kek, dataKey, []byte(keyID))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(gcm, []byte(value), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return piiPrefix + keyID + ":" + base64.RawURLEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openPII returns a sealed value's plain text. Values that aren't sealed
+// are returned as is, they're from before encrypt-pii ran.
+func openPII(value string) (string, error) {
+	if !isSealed(value) {
+		return value, nil
+	}
+	_, dataKey, sealed, err := unwrapPII(value)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := open(gcm, sealed, nil)
+	return string(plain), err
+}
+
+// OpenPII returns a value opened if it's sealed, for code that reads
+// documents without going through the developer functions.
+func OpenPII(value string) (string, error) {
+	return openPII(value)
+}
+
+// rewrapPII returns a value sealed under the current key, and whether that
+// changed it. Values sealed under an older key only have their data key
+// rewrapped, the ciphertext is kept.
+func rewrapPII(value string) (string, bool, error) {
+	kek, current := currentPIIKey()
+	if kek == nil {
+		return value, false, ErrNoPIIKey
+	}
+	if !isSealed(value) {
+		sealed, err := sealPII(value)
+		return sealed, sealed != value, err
+	}
+
+	keyID, dataKey, sealed, err := unwrapPII(value)
+	if err != nil || keyID == current {
+		return value, false, err
+	}
+	wrapped, err := seal(kek, dataKey, []byte(current))
+	if err != nil {
+		return value, false, err
+	}
+
+	return piiPrefix + current + ":" + base64.RawURLEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawURLEncoding.EncodeToString(sealed), true, nil
+}
+
+// unwrapPII splits a sealed value, returning the id of the key its data
+// key was wrapped with, the unwrapped data key and the ciphertext.
+func unwrapPII(value string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, piiPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, ErrSealedPII
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrSealedPII
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, ErrSealedPII
+	}
+	kek, err := getPIIKey(parts[0])
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	dataKey, err := open(kek, wrapped, []byte(parts[0]))
+	return parts[0], dataKey, sealed, err
+}
+
+// seal seals plain with a random nonce, which it's prefixed with.
+func seal(gcm cipher.AEAD, plain, data []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plain, data), nil
+}
+
+func open(gcm cipher.AEAD, sealed, data []byte) ([]byte, error) {
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrSealedPII
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], data)
+	if err != nil {
+		return nil, ErrSealedPII
+	}
+
+	return plain, nil
+}
+
+// sealPIIFields seals strings in place.
+func sealPIIFields(fields ...*string) error {
+	for _, field := range fields {
+		sealed, err := sealPII(*field)
+		if err != nil {
+			return err
+		}
+		*field = sealed
+	}
+
+	return nil
+}
+
+// openPIIFields opens strings in place.
+func openPIIFields(fields ...*string) error {
+	for _, field := range fields {
+		plain, err := openPII(*field)
+		if err != nil {
+			return err
+		}
+		*field = plain
+	}
+
+	return nil
+}
+
+// sealedDeveloper returns a copy of a developer with their PII sealed.
+func sealedDeveloper(d *schemas.Developer) (*schemas.Developer, error) {
+	sealed := *d
+	return &sealed, sealPIIFields(&sealed.Email, &sealed.Name)
+}
+
+// openDeveloper opens a developer's PII in place.
+func openDeveloper(d *schemas.Developer) error {
+	if d == nil {
+		return nil
+	}
+
+	return openPIIFields(&d.Email, &d.Name)
+}
+
+// sealedDeveloperDoc returns a copy of a developer document, or the fields
+// of an update, with their PII sealed. Emails are hashed into emailHash
+// alongside.
+func sealedDeveloperDoc(doc bson.M) (bson.M, error) {
+	sealed := bson.M{}
+	for key, value := range doc {
+		sealed[key] = value
+	}
+
+	for _, field := range []string{"email", "name"} {
+		value, ok := doc[field].(string)
+		if !ok {
+			continue
+		}
+		if field == "email" && !isSealed(value) {
+			if hash := EmailHash(value); hash != "" {
+				sealed["emailHash"] = hash
+			}
+		}
+
+		var err error
+		sealed[field], err = sealPII(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if address, ok := doc["billingAddress"]; ok && address != nil {
+		value, err := sealBillingAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		sealed["billingAddress"] = value
+	}
+
+	return sealed, nil
+}
+
+// openDeveloperDoc opens a developer document's PII in place.
+func openDeveloperDoc(doc bson.M) error {
+	if doc == nil {
+		return nil
+	}
+
+	for _, field := range []string{"email", "name"} {
+		if value, ok := doc[field].(string); ok {
+			plain, err := openPII(value)
+			if err != nil {
+				return err
+			}
+			doc[field] = plain
+		}
+	}
+
+	if address, ok := doc["billingAddress"].(bson.M); ok {
+		plain, err := openBillingAddress(address)
+		if err != nil {
+			return err
+		}
+		doc["billingAddress"] = plain
+	}
+
+	return nil
+}
+
+// openDeveloperDocs opens the PII of developer documents in place.
+func openDeveloperDocs(docs []bson.M) error {
+	for _, doc := range docs {
+		if err := openDeveloperDoc(doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sealBillingAddress seals a billing address as a whole, keeping it a
+// document so the field's kind doesn't change. Without a key it's returned
+// as is.
+func sealBillingAddress(address interface{}) (interface{}, error) {
+	if kek, _ := currentPIIKey(); kek == nil {
+		return address, nil
+	}
+	if m, ok := address.(bson.M); ok {
+		if _, ok := m["sealed"]; ok {
+			return address, nil
+		}
+	}
+
+	raw, err := bson.Marshal(address)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealPII(string(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.M{"sealed": sealed}, nil
+}
+
+// openBillingAddress returns a billing address document as it was before
+// it was sealed.
+func openBillingAddress(address bson.M) (bson.M, error) {
+	sealed, ok := address["sealed"].(string)
+	if !ok {
+		return address, nil
+	}
+	raw, err := openPII(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := bson.M{}
+	return plain, bson.Unmarshal([]byte(raw), plain)
+}
+
+// piiQuery rewrites a developer query matching an email so it matches the
+// email's hash too, sealed emails can't be compared. Plain emails still
+// match, so lookups work before encrypt-pii has run. Only equality and $in
+// are rewritten, other operators only match plain emails.
+func piiQuery(query bson.M) bson.M {
+	value, ok := query["email"]
+	if !ok || !piiIndexed() {
+		return query
+	}
+
+	var hashed interface{}
+	switch v := value.(type) {
+	case string:
+		hashed = EmailHash(v)
+	case bson.M:
+		in, ok := v["$in"].([]string)
+		if !ok || len(v) != 1 {
+			return query
+		}
+		hashes := make([]string, len(in))
+		for i, email := range in {
+			hashes[i] = EmailHash(email)
+		}
+		hashed = bson.M{"$in": hashes}
+	default:
+		return query
+	}
+
+	q := bson.M{}
+	for key, v := range query {
+		q[key] = v
+	}
+	delete(q, "email")
+	match := bson.M{"$or": []bson.M{{"emailHash": hashed}, {"email": value}}}
+	if and, ok := query["$and"]; ok {
+		q["$and"] = []interface{}{bson.M{"$and": and}, match}
+	} else {
+		q["$and"] = []interface{}{match}
+	}
+
+	return q
+}
+
+// sealEmail seals an email kept outside the developer collections in place,
+// setting hash so it can still be matched.
+func sealEmail(email, hash *string) error {
+	*hash = EmailHash(*email)
+	return sealPIIFields(email)
+}
+
+// emailFieldQuery matches documents with email under field, sealed with
+// its hash in field+"Hash" or in plain text from before it was.
+func emailFieldQuery(field, email string) bson.M {
+	hash := EmailHash(email)
+	if hash == "" {
+		return bson.M{field: email}
+	}
+
+	return bson.M{"$or": []bson.M{{field + "Hash": hash}, {field: email}}}
+}
+
+// piiEmailFields are the emails kept outside the developer collections,
+// sealed alongside their hash. Free text, like audit details, isn't.
+var piiEmailFields = []struct {
+	collection **mgo.Collection
+	field      string
+}{
+	{&feedback, "email"},
+	{&grants, "granteeEmail"},
+	{&approvals, "requestedBy"},
+	{&approvals, "decidedBy"},
+	{&auditLogs, "actor"},
+}
+
+// EncryptEmailPII seals up to limit emails in each of piiEmailFields that
+// are in plain text, sealed under an older key or missing their hash,
+// returning how many were changed.
+func EncryptEmailPII(limit int) (int, error) {
+	kek, keyID := currentPIIKey()
+	if kek == nil {
+		return 0, ErrNoPIIKey
+	}
+	current := bson.RegEx{Pattern: "^" + piiPrefix + keyID + ":"}
+
+	changed := 0
+	for _, f := range piiEmailFields {
+		c := *f.collection
+		docs := []bson.M{}
+		err := c.Find(bson.M{"$or": []bson.M{
+			{f.field: bson.M{"$type": 2, "$ne": "", "$not": current}},
+			{f.field: bson.M{"$type": 2, "$ne": ""}, f.field + "Hash": bson.M{"$exists": false}},
+		}}).Select(bson.M{f.field: 1}).Limit(limit).All(&docs)
+		if err != nil {
+			return changed, err
+		}
+
+		for _, doc := range docs {
+			value, _ := doc[f.field].(string)
+			plain, err := openPII(value)
+			if err != nil {
+				return changed, err
+			}
+			sealed, _, err := rewrapPII(value)
+			if err != nil {
+				return changed, err
+			}
+
+			err = c.Update(bson.M{"_id": doc["_id"], f.field: value}, bson.M{"$set": bson.M{
+				f.field:          sealed,
+				f.field + "Hash": EmailHash(plain),
+			}})
+			if err != nil && err != ErrNotFound {
+				return changed, err
+			}
+			changed++
+		}
+	}
+
+	return changed, nil
+}
+
+// piiCollections are where developers' PII is kept, and the field each
+// keeps the developer's document under.
+var piiCollections = []struct {
+	collection **mgo.Collection
+	prefix     string
+}{
+	{&devs, ""},
+	{&deletedDevs, "developer."},
+	{&quarantine, "developer."},
+	{&developerVersions, "document."},
+}
+
+// EncryptDeveloperPII seals up to limit documents in each collection with
+// PII that's in plain text or sealed under an older key, returning how
+// many were changed. Older keys only have their data keys rewrapped.
+// Developers changed while they're sealed are left for the next batch.
+func EncryptDeveloperPII(limit int) (int, error) {
+	kek, keyID := currentPIIKey()
+	if kek == nil {
+		return 0, ErrNoPIIKey
+	}
+	current := bson.RegEx{Pattern: "^" + piiPrefix + keyID + ":"}
+
+	changed := 0
+	for _, c := range piiCollections {
+		p := c.prefix
+		stale := []bson.M{
+			{p + "email": bson.M{"$type": 2, "$ne": "", "$not": current}},
+			{p + "name": bson.M{"$type": 2, "$ne": "", "$not": current}},
+			{p + "billingAddress": bson.M{"$type": 3}, p + "billingAddress.sealed": bson.M{"$not": current}},
+		}
+		if p == "" {
+			stale = append(stale, bson.M{"email": bson.M{"$type": 2, "$ne": ""}, "emailHash": bson.M{"$exists": false}})
+		}
+
+		docs := []bson.M{}
+		err := (*c.collection).Find(bson.M{"$or": stale}).Select(bson.M{
+			p + "email": 1, p + "name": 1, p + "billingAddress": 1,
+		}).Limit(limit).All(&docs)
+		if err != nil {
+			return changed, err
+		}
+
+		for _, doc := range docs {
+			query, set, err := rewrapDeveloperDoc(doc, p)
+			if err != nil {
+				return changed, err
+			}
+			if len(set) == 0 {
+				continue
+			}
+
+			err = (*c.collection).Update(query, bson.M{"$set": set})
+			if err != nil && err != ErrNotFound {
+				return changed, err
+			}
+			changed++
+		}
+	}
+
+	return changed, nil
+}
+
+// rewrapDeveloperDoc returns the query matching a document as it was read
+// and the fields sealing its PII under the current key.
+func rewrapDeveloperDoc(doc bson.M, prefix string) (bson.M, bson.M, error) {
+	query := bson.M{"_id": doc["_id"]}
+	set := bson.M{}
+	if prefix != "" {
+		doc, _ = doc[strings.TrimSuffix(prefix, ".")].(bson.M)
+	}
+
+	for _, field := range []string{"email", "name"} {
+		value, ok := doc[field].(string)
+		if !ok {
+			continue
+		}
+		query[prefix+field] = value
+		if prefix == "" && field == "email" {
+			plain, err := openPII(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			set["emailHash"] = EmailHash(plain)
+		}
+
+		sealed, changed, err := rewrapPII(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if changed {
+			set[prefix+field] = sealed
+		}
+	}
+
+	if address, ok := doc["billingAddress"].(bson.M); ok {
+		if sealed, ok := address["sealed"].(string); ok {
+			query[prefix+"billingAddress.sealed"] = sealed
+			rewrapped, changed, err := rewrapPII(sealed)
+			if err != nil {
+				return nil, nil, err
+			}
+			if changed {
+				set[prefix+"billingAddress"] = bson.M{"sealed": rewrapped}
+			}
+		} else {
+			query[prefix+"billingAddress.updatedAt"] = address["updatedAt"]
+			value, err := sealBillingAddress(address)
+			if err != nil {
+				return nil, nil, err
+			}
+			set[prefix+"billingAddress"] = value
+		}
+	}
+
+	return query, set, nil
+}
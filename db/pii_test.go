@@ -0,0 +1,153 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestDeveloperPII(t *testing.T) {
+	keys := map[string][]byte{"old": bytes.Repeat([]byte{1}, 32), "new": bytes.Repeat([]byte{2}, 32)}
+	index := bytes.Repeat([]byte{3}, 32)
+	if err := SetPIIKeys("old", keys, index); err != nil {
+		t.Fatal("Unable to set PII keys:", err)
+	}
+	defer func() {
+		piiKeys, piiKeyID, piiIndexKey = nil, "", nil
+	}()
+
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+	if err := SetBillingAddress(mock.ID, &BillingAddress{Line1: "1 Main St", City: "New York", PostalCode: "10001", Country: "US"}); err != nil {
+		t.Fatal("Unable to set billing address:", err)
+	}
+
+	raw := bson.M{}
+	if err := devs.FindId(mock.ID).One(&raw); err != nil {
+		t.Fatal("Unable to read developer:", err)
+	}
+	for _, field := range []string{"email", "name"} {
+		if value, _ := raw[field].(string); !strings.HasPrefix(value, piiPrefix+"old:") {
+			t.Error("Expected", field, "to be sealed at rest, got", value)
+		}
+	}
+	if address, _ := raw["billingAddress"].(bson.M); address["line1"] != nil || address["sealed"] == nil {
+		t.Error("Expected the billing address to be sealed at rest, got", address)
+	}
+
+	dev, err := GetDeveloper(bson.M{"email": mock.Email})
+	if err != nil || dev.Email != mock.Email || dev.Name != mock.Name {
+		t.Fatal("Expected the developer by their email, opened, got", dev, err)
+	}
+	address, err := GetBillingAddress(mock.ID)
+	if err != nil || address.Line1 != "1 Main St" {
+		t.Error("Expected the billing address opened, got", address, err)
+	}
+
+	// Rotating rewraps the data keys under the new key.
+	if err := SetPIIKeys("new", keys, index); err != nil {
+		t.Fatal("Unable to set PII keys:", err)
+	}
+	for {
+		changed, err := EncryptDeveloperPII(100)
+		if err != nil {
+			t.Fatal("Unable to encrypt PII:", err)
+		}
+		if changed == 0 {
+			break
+		}
+	}
+	delete(keys, "old")
+	if err := SetPIIKeys("new", keys, index); err != nil {
+		t.Fatal("Unable to set PII keys:", err)
+	}
+	dev, err = GetDeveloperById(mock.ID.Hex())
+	if err != nil || dev.Email != mock.Email {
+		t.Error("Expected the developer opened with the new key, got", dev, err)
+	}
+	if address, err := GetBillingAddress(mock.ID); err != nil || address.City != "New York" {
+		t.Error("Expected the billing address opened with the new key, got", address, err)
+	}
+
+	sealed, err := sealPII("tampered")
+	if err != nil {
+		t.Fatal("Unable to seal:", err)
+	}
+	if _, err := openPII(sealed[:len(sealed)-4] + "AAAA"); err != ErrSealedPII {
+		t.Error("Expected a tampered value to fail to open, got", err)
+	}
+}
+
+func TestEmailPII(t *testing.T) {
+	keys := map[string][]byte{"current": bytes.Repeat([]byte{1}, 32)}
+	if err := SetPIIKeys("current", keys, bytes.Repeat([]byte{3}, 32)); err != nil {
+		t.Fatal("Unable to set PII keys:", err)
+	}
+	defer func() {
+		piiKeys, piiKeyID, piiIndexKey = nil, "", nil
+	}()
+
+	a := &Approval{Action: "refund", Method: "POST", Path: "/admin/refunds", RequestedBy: "byrd@bowery.io", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := SaveApproval(a); err != nil {
+		t.Fatal("Unable to save approval:", err)
+	}
+	defer approvals.RemoveId(a.ID)
+
+	raw := bson.M{}
+	if err := approvals.FindId(a.ID).One(&raw); err != nil {
+		t.Fatal("Unable to read approval:", err)
+	}
+	if value, _ := raw["requestedBy"].(string); !isSealed(value) {
+		t.Error("Expected the requester to be sealed at rest, got", value)
+	}
+	if err := DecideApproval(a.ID, ApprovalApproved, a.RequestedBy); err != ErrConflict {
+		t.Error("Expected a sealed requester not to decide their own approval, got", err)
+	}
+	if err := DecideApproval(a.ID, ApprovalApproved, "steve@bowery.io"); err != nil {
+		t.Fatal("Unable to approve:", err)
+	}
+	if got, err := GetApproval(a.ID); err != nil || got.RequestedBy != a.RequestedBy || got.DecidedBy != "steve@bowery.io" {
+		t.Error("Expected the approval opened, got", got, err)
+	}
+	if ok, err := UseApproval(a.ID, a.Action, a.Method, a.Path, "", a.RequestedBy); !ok {
+		t.Error("Expected the sealed requester to use their approval, got", err)
+	}
+
+	actor := "test-" + bson.NewObjectId().Hex() + "@bowery.io"
+	legacy := &AuditLog{ID: bson.NewObjectId(), Action: "test", Actor: actor, CreatedAt: time.Now()}
+	if err := auditLogs.Insert(legacy); err != nil {
+		t.Fatal("Unable to save audit log:", err)
+	}
+	if err := SaveAuditLog(&AuditLog{Action: "test", Actor: actor}); err != nil {
+		t.Fatal("Unable to save audit log:", err)
+	}
+	defer auditLogs.RemoveAll(bson.M{"action": "test", "createdAt": bson.M{"$gte": legacy.CreatedAt}})
+
+	ls, err := GetAuditLogs(bson.M{"actor": actor}, 10)
+	if err != nil || len(ls) != 2 || ls[0].Actor != actor || ls[1].Actor != actor {
+		t.Fatal("Expected the sealed and plain logs by their actor, got", ls, err)
+	}
+
+	for {
+		changed, err := EncryptEmailPII(100)
+		if err != nil {
+			t.Fatal("Unable to encrypt PII:", err)
+		}
+		if changed == 0 {
+			break
+		}
+	}
+	raw = bson.M{}
+	if err := auditLogs.FindId(legacy.ID).One(&raw); err != nil {
+		t.Fatal("Unable to read audit log:", err)
+	}
+	if value, _ := raw["actor"].(string); !isSealed(value) || raw["actorHash"] != EmailHash(actor) {
+		t.Error("Expected encrypt-pii to seal the plain actor, got", raw)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Plan slugs charged by the payment handlers.
+const (
+	PlanBowery = "bowery"
+	PlanCrosby = "crosby"
+
+	// Discounted plans, given to developers whose application for one is
+	// approved rather than bought from the pricing page.
+	PlanStudent    = "student"
+	PlanOpenSource = "open-source"
+)
+
+// Plan is a purchasable plan shown on the pricing page and charged by the
+// payment handlers. Amount is in the smallest currency unit.
+type Plan struct {
+	Slug        string    `bson:"slug" json:"slug"`
+	Name        string    `bson:"name" json:"name"`
+	Description string    `bson:"description" json:"description"`
+	Amount      int64     `bson:"amount" json:"amount"`
+	Currency    string    `bson:"currency" json:"currency"`
+	Interval    string    `bson:"interval" json:"interval"`
+	Features    []string  `bson:"features" json:"features"`
+	Order       int       `bson:"order" json:"order"`
+	Active      bool      `bson:"active" json:"active"`
+	UpdatedAt   time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// PlanChange is an entry in the pricing change history.
+type PlanChange struct {
+	Slug      string    `bson:"slug" json:"slug"`
+	Before    *Plan     `bson:"before,omitempty" json:"before,omitempty"`
+	After     *Plan     `bson:"after" json:"after"`
+	ChangedBy string    `bson:"changedBy" json:"changedBy"`
+	ChangedAt time.Time `bson:"changedAt" json:"changedAt"`
+}
+
+// DefaultPlans are used until a plan has been saved by an admin.
+var DefaultPlans = []*Plan{
+	{
+		Slug:        PlanBowery,
+		Name:        "Bowery 3",
+		Description: "Bowery 3",
+		Amount:      2900,
+		Currency:    "usd",
+		Interval:    "month",
+		Order:       0,
+		Active:      true,
+	},
+	{
+		Slug:        PlanCrosby,
+		Name:        "Crosby",
+		Description: "Crosby Annual License",
+		Amount:      2500,
+		Currency:    "usd",
+		Interval:    "year",
+		Order:       1,
+		Active:      true,
+	},
+	{
+		Slug:        PlanStudent,
+		Name:        "Bowery Student",
+		Description: "Bowery 3, student discount",
+		Amount:      900,
+		Currency:    "usd",
+		Interval:    "month",
+		Order:       2,
+	},
+	{
+		Slug:        PlanOpenSource,
+		Name:        "Bowery Open Source",
+		Description: "Bowery 3, open source discount",
+		Amount:      900,
+		Currency:    "usd",
+		Interval:    "month",
+		Order:       3,
+	},
+}
+
+var (
+	plans       *mgo.Collection
+	planChanges *mgo.Collection
+)
+
+func init() {
+	plans = Client.Db.C("plans")
+	planChanges = Client.Db.C("planChanges")
+}
+
+func defaultPlan(slug string) *Plan {
+	for _, p := range DefaultPlans {
+		if p.Slug == slug {
+			c := *p
+			return &c
+		}
+	}
+
+	return nil
+}
+
+// GetPlan returns the plan with the slug, falling back to the defaults.
+func GetPlan(slug string) (*Plan, error) {
+	p := &Plan{}
+	err := plans.Find(bson.M{"slug": slug}).One(p)
+	if err == mgo.ErrNotFound {
+		if d := defaultPlan(slug); d != nil {
+			return d, nil
+		}
+	}
+
+	return p, err
+}
+
+// GetPlans returns all plans ordered for display, including defaults that
+// haven't been saved yet.
+func GetPlans(query bson.M) ([]*Plan, error) {
+	ps := []*Plan{}
+	if err := plans.Find(query).Sort("order").All(&ps); err != nil {
+		return nil, err
+	}
+
+	if len(query) > 0 {
+		return ps, nil
+	}
+
+	for _, d := range DefaultPlans {
+		found := false
+		for _, p := range ps {
+			if p.Slug == d.Slug {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			c := *d
+			ps = append(ps, &c)
+		}
+	}
+
+	return ps, nil
+}
+
+// SavePlan upserts the plan and records the change in the history.
+func SavePlan(p *Plan, changedBy string) error {
+	before, err := GetPlan(p.Slug)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if err == mgo.ErrNotFound {
+		before = nil
+	}
+
+	p.UpdatedAt = time.Now()
+	if _, err := plans.Upsert(bson.M{"slug": p.Slug}, p); err != nil {
+		return err
+	}
+
+	return planChanges.Insert(&PlanChange{
+		Slug:      p.Slug,
+		Before:    before,
+		After:     p,
+		ChangedBy: changedBy,
+		ChangedAt: p.UpdatedAt,
+	})
+}
+
+// GetPlanChanges returns the most recent pricing changes first.
+func GetPlanChanges(query bson.M, limit int) ([]*PlanChange, error) {
+	cs := []*PlanChange{}
+	return cs, planChanges.Find(query).Sort("-changedAt").Limit(limit).All(&cs)
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Probe step statuses.
+const (
+	ProbePassed  = "passed"
+	ProbeFailed  = "failed"
+	ProbeSkipped = "skipped"
+)
+
+// ProbeStep is one step of a synthetic probe run, e.g. signup or login.
+type ProbeStep struct {
+	Name     string `bson:"name" json:"name"`
+	Status   string `bson:"status" json:"status"`
+	Millis   int64  `bson:"millis" json:"millis"`
+	Slow     bool   `bson:"slow,omitempty" json:"slow,omitempty"`
+	Error    string `bson:"error,omitempty" json:"error,omitempty"`
+	HTTPCode int    `bson:"httpCode,omitempty" json:"httpCode,omitempty"`
+}
+
+// ProbeRun is a synthetic probe's pass through every step.
+type ProbeRun struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Steps     []*ProbeStep  `bson:"steps" json:"steps"`
+	Passed    bool          `bson:"passed" json:"passed"`
+	Instance  string        `bson:"instance" json:"instance"`
+	CreatedAt time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+// Step returns the run's step with the name, or nil.
+func (r *ProbeRun) Step(name string) *ProbeStep {
+	for _, s := range r.Steps {
+		if s.Name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// How long probe runs are kept.
+const probeRunRetention = 30 * 24 * time.Hour
+
+var probeRuns *mgo.Collection
+
+func init() {
+	probeRuns = Client.Db.C("probeRuns")
+	ensureIndex(probeRuns, mgo.Index{Key: []string{"createdAt"}, ExpireAfter: probeRunRetention})
+}
+
+func SaveProbeRun(r *ProbeRun) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+
+	return probeRuns.Insert(r)
+}
+
+// GetProbeRuns returns the newest probe runs first.
+func GetProbeRuns(query bson.M, limit int) ([]*ProbeRun, error) {
+	rs := []*ProbeRun{}
+	return rs, probeRuns.Find(query).Sort("-createdAt").Limit(limit).All(&rs)
+}
+
+// RemoveProbeDeveloper removes the probe's developer outright, rather than
+// moving it to the deleted developers, so each run can sign up again.
+func RemoveProbeDeveloper(email string) error {
+	_, err := devs.RemoveAll(piiQuery(bson.M{"email": email}))
+	return err
+}
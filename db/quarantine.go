@@ -0,0 +1,81 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// QuarantinedSignup is a signup suspected to come from a bot, held until an
+// admin releases or discards it.
+type QuarantinedSignup struct {
+	ID        bson.ObjectId      `bson:"_id" json:"id"`
+	Developer *schemas.Developer `bson:"developer" json:"developer"`
+	Reasons   []string           `bson:"reasons" json:"reasons"`
+	IP        string             `bson:"ip" json:"ip"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+var quarantine *mgo.Collection
+
+func init() {
+	quarantine = Client.Db.C("quarantinedSignups")
+}
+
+// QuarantineSignup holds a signup for review. The password is hashed first
+// so it's never stored in plain text.
+func QuarantineSignup(q *QuarantinedSignup) error {
+	if q.ID == "" {
+		q.ID = bson.NewObjectId()
+	}
+	if q.CreatedAt.IsZero() {
+		q.CreatedAt = time.Now()
+	}
+	hashPassword(q.Developer)
+
+	sealed, err := sealedDeveloper(q.Developer)
+	if err != nil {
+		return err
+	}
+	held := *q
+	held.Developer = sealed
+	return quarantine.Insert(&held)
+}
+
+func GetQuarantinedSignups(query bson.M) ([]*QuarantinedSignup, error) {
+	qs := []*QuarantinedSignup{}
+	if err := quarantine.Find(query).Sort("-createdAt").All(&qs); err != nil {
+		return qs, err
+	}
+	for _, q := range qs {
+		if err := openDeveloper(q.Developer); err != nil {
+			return qs, err
+		}
+	}
+
+	return qs, nil
+}
+
+// ReleaseSignup creates the held developer and removes it from quarantine.
+func ReleaseSignup(id bson.ObjectId) (*schemas.Developer, error) {
+	q := &QuarantinedSignup{}
+	if err := quarantine.FindId(id).One(q); err != nil {
+		return nil, err
+	}
+	if err := openDeveloper(q.Developer); err != nil {
+		return nil, err
+	}
+
+	if err := Save(q.Developer); err != nil {
+		return nil, err
+	}
+
+	return q.Developer, quarantine.RemoveId(id)
+}
+
+func DiscardSignup(id bson.ObjectId) error {
+	return quarantine.RemoveId(id)
+}
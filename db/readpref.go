@@ -0,0 +1,97 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"os"
+	"strings"
+
+	"labix.org/v2/mgo"
+)
+
+// Kinds of reads, each of which can be sent to secondaries independently.
+const (
+	// Token and credential lookups. These always read the primary so a
+	// developer can log in straight after signing up.
+	ReadAuth = "auth"
+
+	// Aggregates and counts for digests, churn scoring and reports.
+	ReadReports = "reports"
+
+	// Listings in the admin pages.
+	ReadAdmin = "admin"
+
+	// Public content like the changelog.
+	ReadPublic = "public"
+)
+
+// Read preferences accepted in MONGO_READ_PREFERENCE.
+const (
+	PrefPrimary            = "primary"
+	PrefSecondaryPreferred = "secondaryPreferred"
+	PrefMonotonic          = "monotonic"
+)
+
+// readPreferences maps read kinds to their preference, read from
+// MONGO_READ_PREFERENCE as "kind:preference,kind:preference". Kinds left out
+// read the primary.
+var readPreferences = map[string]string{}
+
+func init() {
+	readPreferences = parseReadPreferences(os.Getenv("MONGO_READ_PREFERENCE"))
+
+	// Everything not routed through a read kind uses the primary.
+	Client.Db.Session.SetMode(mgo.Strong, true)
+}
+
+func parseReadPreferences(val string) map[string]string {
+	prefs := map[string]string{}
+	for _, pair := range strings.Split(val, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == ReadAuth {
+			continue
+		}
+
+		switch parts[1] {
+		case PrefPrimary, PrefSecondaryPreferred, PrefMonotonic:
+			prefs[parts[0]] = parts[1]
+		}
+	}
+
+	return prefs
+}
+
+// ReadPreferences returns the preference used for each kind of read.
+func ReadPreferences() map[string]string {
+	prefs := map[string]string{}
+	for _, kind := range []string{ReadAuth, ReadReports, ReadAdmin, ReadPublic} {
+		prefs[kind] = readPreference(kind)
+	}
+
+	return prefs
+}
+
+func readPreference(kind string) string {
+	if pref, ok := readPreferences[kind]; ok && kind != ReadAuth {
+		return pref
+	}
+
+	return PrefPrimary
+}
+
+// readFrom returns c on a session using the preference for kind, and a func
+// to release the session once the read is done.
+func readFrom(kind string, c *mgo.Collection) (*mgo.Collection, func()) {
+	var mode mgo.Mode
+	switch readPreference(kind) {
+	case PrefSecondaryPreferred:
+		mode = mgo.Eventual
+	case PrefMonotonic:
+		mode = mgo.Monotonic
+	default:
+		return c, func() {}
+	}
+
+	session := c.Database.Session.Copy()
+	session.SetMode(mode, true)
+	return c.With(session), session.Close
+}
@@ -0,0 +1,19 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+)
+
+func TestParseReadPreferences(t *testing.T) {
+	prefs := parseReadPreferences("reports:secondaryPreferred, admin:monotonic,public:nearest,auth:secondaryPreferred")
+	if prefs[ReadReports] != PrefSecondaryPreferred || prefs[ReadAdmin] != PrefMonotonic {
+		t.Error("Unexpected read preferences:", prefs)
+	}
+	if _, ok := prefs[ReadPublic]; ok {
+		t.Error("Unknown preferences should be ignored.")
+	}
+	if _, ok := prefs[ReadAuth]; ok {
+		t.Error("Auth reads must always use the primary.")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Refund request kinds. Credits go on the customer's Stripe balance instead
+// of back to their card.
+const (
+	RefundKindRefund = "refund"
+	RefundKindCredit = "credit"
+)
+
+// Refund request states. Requests under the approval amount skip pending.
+const (
+	RefundPending  = "pending"
+	RefundApproved = "approved"
+	RefundDenied   = "denied"
+	RefundExecuted = "executed"
+	RefundFailed   = "failed"
+)
+
+// RefundRequest is a refund or credit against a payment or checkout. It
+// only reaches Stripe once it's approved.
+type RefundRequest struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Kind        string        `bson:"kind" json:"kind"`
+	ChargeID    string        `bson:"chargeId" json:"chargeId"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Amount      int64         `bson:"amount" json:"amount"`
+	Currency    string        `bson:"currency" json:"currency"`
+	Reason      string        `bson:"reason" json:"reason"`
+	Status      string        `bson:"status" json:"status"`
+	RequestedBy string        `bson:"requestedBy" json:"requestedBy"`
+	DecidedBy   string        `bson:"decidedBy,omitempty" json:"decidedBy,omitempty"`
+	StripeID    string        `bson:"stripeId,omitempty" json:"stripeId,omitempty"`
+	Error       string        `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	DecidedAt   time.Time     `bson:"decidedAt,omitempty" json:"decidedAt,omitempty"`
+	ExecutedAt  time.Time     `bson:"executedAt,omitempty" json:"executedAt,omitempty"`
+}
+
+var refundRequests *mgo.Collection
+
+func init() {
+	refundRequests = Client.Db.C("refundRequests")
+
+	ensureIndex(refundRequests, mgo.Index{Key: []string{"status", "-createdAt"}})
+	ensureIndex(refundRequests, mgo.Index{Key: []string{"chargeId"}})
+}
+
+// SaveRefundRequest records a refund request with the status it starts in.
+func SaveRefundRequest(r *RefundRequest) error {
+	r.ID = bson.NewObjectId()
+	r.CreatedAt = time.Now()
+	return refundRequests.Insert(r)
+}
+
+// GetRefundRequest returns the refund request with the id.
+func GetRefundRequest(id bson.ObjectId) (*RefundRequest, error) {
+	r := &RefundRequest{}
+	return r, refundRequests.FindId(id).One(r)
+}
+
+// GetRefundRequests returns refund requests matching the query, newest first.
+func GetRefundRequests(query bson.M, limit int) ([]*RefundRequest, error) {
+	rs := []*RefundRequest{}
+	return rs, refundRequests.Find(query).Sort("-createdAt").Limit(limit).All(&rs)
+}
+
+// RefundedAmount returns the amount of a charge refunded, credited or
+// waiting to be, so a charge can't be refunded twice.
+func RefundedAmount(chargeID string) (int64, error) {
+	rs := []*RefundRequest{}
+	err := refundRequests.Find(bson.M{
+		"chargeId": chargeID,
+		"status":   bson.M{"$in": []string{RefundPending, RefundApproved, RefundExecuted}},
+	}).Select(bson.M{"amount": 1}).All(&rs)
+
+	total := int64(0)
+	for _, r := range rs {
+		total += r.Amount
+	}
+	return total, err
+}
+
+// CommittedRefundAmount returns the amount of a charge refunded, credited
+// or approved to be by requests other than except. Pending requests aren't
+// counted, whichever is approved first gets the balance.
+func CommittedRefundAmount(chargeID string, except bson.ObjectId) (int64, error) {
+	rs := []*RefundRequest{}
+	err := refundRequests.Find(bson.M{
+		"_id":      bson.M{"$ne": except},
+		"chargeId": chargeID,
+		"status":   bson.M{"$in": []string{RefundApproved, RefundExecuted}},
+	}).Select(bson.M{"amount": 1}).All(&rs)
+
+	total := int64(0)
+	for _, r := range rs {
+		total += r.Amount
+	}
+	return total, err
+}
+
+// DecideRefundRequest approves or denies a pending request, returning
+// ErrConflict if it isn't pending or by requested it. Only the admin that
+// decides it executes it.
+func DecideRefundRequest(id bson.ObjectId, status, by string) error {
+	err := refundRequests.Update(bson.M{
+		"_id":         id,
+		"status":      RefundPending,
+		"requestedBy": bson.M{"$ne": by},
+	}, bson.M{"$set": bson.M{"status": status, "decidedBy": by, "decidedAt": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+
+	return err
+}
+
+// FinishRefundRequest records the outcome of sending an approved request to
+// Stripe.
+func FinishRefundRequest(id bson.ObjectId, stripeID, refundErr string) error {
+	update := bson.M{"status": RefundExecuted, "stripeId": stripeID, "executedAt": time.Now()}
+	if refundErr != "" {
+		update = bson.M{"status": RefundFailed, "error": refundErr}
+	}
+
+	return refundRequests.UpdateId(id, bson.M{"$set": update})
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"errors"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Release is a client binary for a single platform.
+type Release struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Version   string        `bson:"version" json:"version"`
+	Platform  string        `bson:"platform" json:"platform"`
+	Checksum  string        `bson:"checksum" json:"checksum"`
+	URL       string        `bson:"url" json:"url"`
+	Notes     string        `bson:"notes" json:"notes,omitempty"`
+	CreatedAt time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+// ReleaseChannel points a channel at its current version, keeping the
+// previously promoted versions for rollbacks.
+type ReleaseChannel struct {
+	Channel   string    `bson:"channel" json:"channel"`
+	Version   string    `bson:"version" json:"version"`
+	History   []string  `bson:"history" json:"history"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+var ErrNoRollback = errors.New("no previous release to roll back to")
+
+var (
+	releases        *mgo.Collection
+	releaseChannels *mgo.Collection
+)
+
+func init() {
+	releases = Client.Db.C("releases")
+	releaseChannels = Client.Db.C("releaseChannels")
+}
+
+// SaveRelease publishes release metadata, replacing any existing release for
+// the same version and platform.
+func SaveRelease(r *Release) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+
+	_, err := releases.Upsert(bson.M{"version": r.Version, "platform": r.Platform}, r)
+	return err
+}
+
+func GetRelease(query bson.M) (*Release, error) {
+	r := &Release{}
+	return r, releases.Find(query).One(r)
+}
+
+func GetReleases(query bson.M) ([]*Release, error) {
+	rs := []*Release{}
+	return rs, releases.Find(query).Sort("-createdAt").All(&rs)
+}
+
+// GetReleaseChannel returns the channel, empty if nothing has been promoted.
+func GetReleaseChannel(channel string) (*ReleaseChannel, error) {
+	c := &ReleaseChannel{}
+	err := releaseChannels.Find(bson.M{"channel": channel}).One(c)
+	if err == mgo.ErrNotFound {
+		return &ReleaseChannel{Channel: channel, History: []string{}}, nil
+	}
+
+	return c, err
+}
+
+// PromoteRelease makes version the current release on the channel.
+func PromoteRelease(channel, version string) (*ReleaseChannel, error) {
+	if n, err := releases.Find(bson.M{"version": version}).Count(); err != nil || n == 0 {
+		if err == nil {
+			err = mgo.ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	c, err := GetReleaseChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Version != "" && c.Version != version {
+		c.History = append(c.History, c.Version)
+	}
+	c.Version = version
+	c.UpdatedAt = time.Now()
+
+	_, err = releaseChannels.Upsert(bson.M{"channel": channel}, c)
+	return c, err
+}
+
+// RollbackRelease restores the previously promoted version on the channel.
+func RollbackRelease(channel string) (*ReleaseChannel, error) {
+	c, err := GetReleaseChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.History) == 0 {
+		return nil, ErrNoRollback
+	}
+
+	c.Version = c.History[len(c.History)-1]
+	c.History = c.History[:len(c.History)-1]
+	c.UpdatedAt = time.Now()
+
+	_, err = releaseChannels.Upsert(bson.M{"channel": channel}, c)
+	return c, err
+}
@@ -0,0 +1,40 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestPromoteAndRollbackRelease(t *testing.T) {
+	releaseChannels.Remove(bson.M{"channel": ChannelBeta})
+
+	for _, version := range []string{"3.0.0", "3.1.0"} {
+		if err := SaveRelease(&Release{
+			Version:  version,
+			Platform: "linux_amd64",
+			Checksum: "abc",
+			URL:      "http://bowery.io/bowery_" + version + "_linux_amd64.zip",
+		}); err != nil {
+			t.Fatal("Unable to save release:", err)
+		}
+
+		if _, err := PromoteRelease(ChannelBeta, version); err != nil {
+			t.Fatal("Unable to promote release:", err)
+		}
+	}
+
+	c, err := RollbackRelease(ChannelBeta)
+	if err != nil {
+		t.Fatal("Unable to roll back release:", err)
+	}
+
+	if c.Version != "3.0.0" {
+		t.Error("rollback did not restore the previous version.")
+	}
+
+	if _, err := RollbackRelease(ChannelBeta); err != ErrNoRollback {
+		t.Error("rollback past the first release should fail.")
+	}
+}
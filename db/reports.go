@@ -0,0 +1,227 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Fields developers can be counted by.
+const (
+	CountByPlan       = "plan"
+	CountByPaid       = "isPaid"
+	CountBySignupWeek = "signupWeek"
+)
+
+const (
+	weekMillis = int64(7 * 24 * time.Hour / time.Millisecond)
+
+	// The first Monday after the epoch, weeks start on Mondays.
+	firstMondayMillis = int64(4 * 24 * time.Hour / time.Millisecond)
+)
+
+// DeveloperCount is how many developers share a value. Key is the plan
+// slug, "true" or "false" for paid, or the Monday a signup week starts on
+// as 2006-01-02.
+type DeveloperCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// developerCounts sorts counts by key.
+type developerCounts []*DeveloperCount
+
+func (c developerCounts) Len() int           { return len(c) }
+func (c developerCounts) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c developerCounts) Less(i, j int) bool { return c[i].Key < c[j].Key }
+
+// CountDevelopersBy counts the developers matching the query grouped by
+// one of the CountBy fields, sorted by key.
+func CountDevelopersBy(field string, query bson.M) ([]*DeveloperCount, error) {
+	match := bson.M{}
+	for k, v := range piiQuery(query) {
+		match[k] = v
+	}
+
+	var group interface{}
+	switch field {
+	case CountByPlan, CountByPaid:
+		group = "$" + field
+	case CountBySignupWeek:
+		// Developers store when they signed up in milliseconds, rounded
+		// down to the start of the week here.
+		if _, ok := match["createdAt"]; !ok {
+			match["createdAt"] = bson.M{"$gte": firstMondayMillis}
+		}
+		group = bson.M{"$subtract": []interface{}{"$createdAt", bson.M{"$mod": []interface{}{
+			bson.M{"$subtract": []interface{}{"$createdAt", firstMondayMillis}}, weekMillis,
+		}}}}
+	default:
+		return nil, errors.New("developers can't be counted by " + field)
+	}
+
+	c, done := readFrom(ReadReports, devs)
+	defer done()
+
+	var rows []struct {
+		ID    interface{} `bson:"_id"`
+		Count int         `bson:"count"`
+	}
+	err := c.Pipe([]bson.M{
+		{"$match": match},
+		{"$group": bson.M{"_id": group, "count": bson.M{"$sum": 1}}},
+	}).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Missing and empty values land on the same key, e.g. false for paid.
+	merged := map[string]*DeveloperCount{}
+	for _, row := range rows {
+		key := ""
+		switch v := row.ID.(type) {
+		case string:
+			key = v
+		case bool:
+			key = fmt.Sprint(v)
+		case int64:
+			key = time.Unix(0, v*int64(time.Millisecond)).UTC().Format("2006-01-02")
+		case float64:
+			key = time.Unix(0, int64(v)*int64(time.Millisecond)).UTC().Format("2006-01-02")
+		case nil:
+			if field == CountByPaid {
+				key = "false"
+			}
+		}
+
+		if count, ok := merged[key]; ok {
+			count.Count += row.Count
+			continue
+		}
+		merged[key] = &DeveloperCount{Key: key, Count: row.Count}
+	}
+
+	counts := make([]*DeveloperCount, 0, len(merged))
+	for _, count := range merged {
+		counts = append(counts, count)
+	}
+	sort.Sort(developerCounts(counts))
+	return counts, nil
+}
+
+// RevenueTotal is the revenue for a plan in a currency on a UTC day, the
+// day as 2006-01-02. Amounts are in the currency's smallest unit.
+type RevenueTotal struct {
+	Day      string `json:"day,omitempty"`
+	Plan     string `json:"plan,omitempty"`
+	Currency string `json:"currency"`
+	Count    int    `json:"count"`
+	Amount   int64  `json:"amount"`
+}
+
+// revenueRow is a row of a revenue pipeline's output.
+type revenueRow struct {
+	ID struct {
+		Year     int    `bson:"year"`
+		Month    int    `bson:"month"`
+		Day      int    `bson:"day"`
+		Plan     string `bson:"plan"`
+		Currency string `bson:"currency"`
+	} `bson:"_id"`
+	Count  int   `bson:"count"`
+	Amount int64 `bson:"amount"`
+}
+
+// revenueGroup groups a collection's revenue by the day of at, plan and
+// currency.
+func revenueGroup(at string) bson.M {
+	return bson.M{"$group": bson.M{
+		"_id": bson.M{
+			"year":     bson.M{"$year": at},
+			"month":    bson.M{"$month": at},
+			"day":      bson.M{"$dayOfMonth": at},
+			"plan":     "$plan",
+			"currency": bson.M{"$toLower": "$currency"},
+		},
+		"count":  bson.M{"$sum": 1},
+		"amount": bson.M{"$sum": "$amount"},
+	}}
+}
+
+// GetRevenueTotals totals the payments and checkouts settled in [from, to)
+// by day, plan and currency. If developerIDs is given only their revenue is
+// counted.
+func GetRevenueTotals(from, to time.Time, developerIDs []bson.ObjectId) ([]*RevenueTotal, error) {
+	paymentMatch := bson.M{"status": PaymentSucceeded, "updatedAt": bson.M{"$gte": from, "$lt": to}}
+	checkoutMatch := bson.M{"status": CheckoutComplete, "completedAt": bson.M{"$gte": from, "$lt": to}}
+	if developerIDs != nil {
+		paymentMatch["developerId"] = bson.M{"$in": developerIDs}
+		checkoutMatch["developerId"] = bson.M{"$in": developerIDs}
+	}
+
+	pc, pdone := readFrom(ReadReports, payments)
+	defer pdone()
+	cc, cdone := readFrom(ReadReports, checkouts)
+	defer cdone()
+
+	var ps, cs []revenueRow
+	err := pc.Pipe([]bson.M{{"$match": paymentMatch}, revenueGroup("$updatedAt")}).All(&ps)
+	if err == nil {
+		err = cc.Pipe([]bson.M{{"$match": checkoutMatch}, revenueGroup("$completedAt")}).All(&cs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	totals := map[string]*RevenueTotal{}
+	res := []*RevenueTotal{}
+	for _, row := range append(ps, cs...) {
+		day := time.Date(row.ID.Year, time.Month(row.ID.Month), row.ID.Day, 0, 0, 0, 0, time.UTC).Format("2006-01-02")
+		key := day + "|" + row.ID.Plan + "|" + row.ID.Currency
+
+		total, ok := totals[key]
+		if !ok {
+			total = &RevenueTotal{Day: day, Plan: row.ID.Plan, Currency: row.ID.Currency}
+			totals[key] = total
+			res = append(res, total)
+		}
+		total.Count += row.Count
+		total.Amount += row.Amount
+	}
+
+	return res, nil
+}
+
+// GetPaidEventTotals totals the developer.paid events in [from, to) by
+// currency, upper cased as the digest shows them.
+func GetPaidEventTotals(from, to time.Time) ([]*RevenueTotal, error) {
+	c, done := readFrom(ReadReports, events)
+	defer done()
+
+	var rows []struct {
+		Currency string `bson:"_id"`
+		Count    int    `bson:"count"`
+		Amount   int64  `bson:"amount"`
+	}
+	err := c.Pipe([]bson.M{
+		{"$match": bson.M{"name": "developer.paid", "createdAt": bson.M{"$gte": from, "$lt": to}}},
+		{"$group": bson.M{
+			"_id":    bson.M{"$toUpper": "$properties.currency"},
+			"count":  bson.M{"$sum": 1},
+			"amount": bson.M{"$sum": "$properties.amount"},
+		}},
+	}).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make([]*RevenueTotal, 0, len(rows))
+	for _, row := range rows {
+		totals = append(totals, &RevenueTotal{Currency: row.Currency, Count: row.Count, Amount: row.Amount})
+	}
+	return totals, nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestCountDevelopersBy(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	cases := map[string]string{
+		CountByPaid:       "false",
+		CountBySignupWeek: "2014-01-27",
+	}
+	for field, expected := range cases {
+		counts, err := CountDevelopersBy(field, bson.M{"_id": mock.ID})
+		if err != nil {
+			t.Fatal("Unable to count developers by", field, err)
+		}
+		if len(counts) != 1 || counts[0].Key != expected || counts[0].Count != 1 {
+			t.Errorf("Expected %s to count one developer as %s, got %v", field, expected, counts)
+		}
+	}
+
+	if _, err := CountDevelopersBy("password", bson.M{}); err == nil {
+		t.Error("Expected an unknown field to be refused.")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long prune runs are kept for the admin.
+const pruneRunRetention = time.Hour * 24 * 90
+
+// PruneRun records how many documents of a kind a retention run removed.
+type PruneRun struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Kind      string        `bson:"kind" json:"kind"`
+	Before    time.Time     `bson:"before" json:"before"`
+	Pruned    int           `bson:"pruned" json:"pruned"`
+	CreatedAt time.Time     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time     `bson:"expiresAt" json:"-"`
+}
+
+var pruneRuns *mgo.Collection
+
+func init() {
+	pruneRuns = Client.Db.C("pruneRuns")
+	ensureIndex(pruneRuns, mgo.Index{Key: []string{"expiresAt"}, ExpireAfter: time.Second})
+	ensureIndex(pruneRuns, mgo.Index{Key: []string{"-createdAt"}})
+}
+
+// PruneAuditLogs removes logs from before a time, other than those about
+// held developers. If exported is set only exported logs are removed.
+func PruneAuditLogs(before time.Time, held []bson.ObjectId, exported bool) (int, error) {
+	query := bson.M{"createdAt": bson.M{"$lt": before}}
+	if len(held) > 0 {
+		query["developerId"] = bson.M{"$nin": held}
+	}
+	if exported {
+		query["exported"] = true
+	}
+
+	info, err := auditLogs.RemoveAll(query)
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// PruneEvents removes events from before a time, other than those for held
+// developers.
+func PruneEvents(before time.Time, held []bson.ObjectId) (int, error) {
+	query := bson.M{"createdAt": bson.M{"$lt": before}}
+	if len(held) > 0 {
+		ids := []string{}
+		for _, id := range held {
+			ids = append(ids, id.Hex())
+		}
+		query["developerId"] = bson.M{"$nin": ids}
+	}
+
+	info, err := events.RemoveAll(query)
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// PruneShadowResults removes shadow results from before a time.
+func PruneShadowResults(before time.Time) (int, error) {
+	info, err := shadowResults.RemoveAll(bson.M{"createdAt": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func SavePruneRun(r *PruneRun) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+	r.ExpiresAt = r.CreatedAt.Add(pruneRunRetention)
+
+	return pruneRuns.Insert(r)
+}
+
+// GetPruneRuns returns the newest runs first.
+func GetPruneRuns(limit int) ([]*PruneRun, error) {
+	rs := []*PruneRun{}
+	return rs, pruneRuns.Find(nil).Sort("-createdAt").Limit(limit).All(&rs)
+}
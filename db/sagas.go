@@ -0,0 +1,125 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Saga states.
+const (
+	SagaRunning      = "running"
+	SagaCompleted    = "completed"
+	SagaCompensating = "compensating"
+	SagaCompensated  = "compensated"
+	// Compensation itself failed, support has to finish cleaning up.
+	SagaStuck = "stuck"
+)
+
+// Saga step states.
+const (
+	StepPending     = "pending"
+	StepDone        = "done"
+	StepFailed      = "failed"
+	StepCompensated = "compensated"
+	StepSkipped     = "skipped"
+)
+
+// SagaStep is one step of a saga and how far it got.
+type SagaStep struct {
+	Name      string    `bson:"name" json:"name"`
+	Status    string    `bson:"status" json:"status"`
+	Error     string    `bson:"error,omitempty" json:"error,omitempty"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// Saga records the steps of a multi-step write such as a signup, so a
+// failure part way through can be undone by compensating the steps that
+// already happened.
+type Saga struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Kind        string        `bson:"kind" json:"kind"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Email       string        `bson:"email" json:"email"`
+	State       string        `bson:"state" json:"state"`
+	Steps       []*SagaStep   `bson:"steps" json:"steps"`
+	Error       string        `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time     `bson:"updatedAt" json:"updatedAt"`
+}
+
+// Step returns the named step, or nil if the saga doesn't have it.
+func (s *Saga) Step(name string) *SagaStep {
+	for _, step := range s.Steps {
+		if step.Name == name {
+			return step
+		}
+	}
+
+	return nil
+}
+
+var sagas *mgo.Collection
+
+func init() {
+	sagas = Client.Db.C("sagas")
+}
+
+// SaveSaga starts a saga with the named steps pending.
+func SaveSaga(s *Saga, steps ...string) error {
+	now := time.Now()
+	if s.ID == "" {
+		s.ID = bson.NewObjectId()
+	}
+	s.State = SagaRunning
+	s.CreatedAt = now
+	s.UpdatedAt = now
+	s.Steps = []*SagaStep{}
+	for _, name := range steps {
+		s.Steps = append(s.Steps, &SagaStep{Name: name, Status: StepPending, UpdatedAt: now})
+	}
+
+	return sagas.Insert(s)
+}
+
+// GetSaga returns the saga matching the query.
+func GetSaga(query bson.M) (*Saga, error) {
+	s := &Saga{}
+	return s, sagas.Find(query).One(s)
+}
+
+// GetSagas returns the newest sagas first.
+func GetSagas(query bson.M, limit int) ([]*Saga, error) {
+	ss := []*Saga{}
+	return ss, sagas.Find(query).Sort("-createdAt").Limit(limit).All(&ss)
+}
+
+// UpdateSagaStep sets the status of a step.
+func UpdateSagaStep(id bson.ObjectId, name, status, stepErr string) error {
+	now := time.Now()
+	return sagas.Update(bson.M{"_id": id, "steps.name": name}, bson.M{"$set": bson.M{
+		"steps.$.status":    status,
+		"steps.$.error":     stepErr,
+		"steps.$.updatedAt": now,
+		"updatedAt":         now,
+	}})
+}
+
+// TransitionSaga moves a saga from one state to another, returning
+// ErrConflict if it isn't in the from state. This keeps two workers from
+// compensating the same saga.
+func TransitionSaga(id bson.ObjectId, from, to, sagaErr string) error {
+	update := bson.M{"state": to, "updatedAt": time.Now()}
+	if sagaErr != "" {
+		update["error"] = sagaErr
+	}
+
+	err := sagas.Update(bson.M{"_id": id, "state": from}, bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+
+	return err
+}
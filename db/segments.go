@@ -0,0 +1,197 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Segment is a saved cohort of developers, defined by a filter expression.
+// Materialized segments are evaluated nightly and read from their stored
+// members, the rest are evaluated when they're read.
+type Segment struct {
+	Slug           string    `bson:"_id" json:"slug"`
+	Name           string    `bson:"name" json:"name"`
+	Expression     string    `bson:"expression" json:"expression"`
+	Materialize    bool      `bson:"materialize" json:"materialize"`
+	Size           int       `bson:"size" json:"size"`
+	MaterializedAt time.Time `bson:"materializedAt,omitempty" json:"materializedAt,omitempty"`
+	UpdatedBy      string    `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt      time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// DeveloperAttributes are the developer fields segments filter on.
+type DeveloperAttributes struct {
+	ID                  bson.ObjectId `bson:"_id"`
+	Name                string        `bson:"name"`
+	Email               string        `bson:"email"`
+	IsPaid              bool          `bson:"isPaid"`
+	IsAdmin             bool          `bson:"isAdmin"`
+	Plan                string        `bson:"plan"`
+	Version             string        `bson:"version"`
+	IntegrationEngineer string        `bson:"integrationEngineer"`
+	CreatedAt           int64         `bson:"createdAt"`
+	Expiration          time.Time     `bson:"expiration"`
+	Tags                []string      `bson:"tags"`
+}
+
+// SignedUpAt returns when the developer signed up. Developers store it in
+// milliseconds since the epoch.
+func (a *DeveloperAttributes) SignedUpAt() time.Time {
+	return time.Unix(0, a.CreatedAt*int64(time.Millisecond))
+}
+
+var (
+	segments       *mgo.Collection
+	segmentMembers *mgo.Collection
+)
+
+func init() {
+	segments = Client.Db.C("segments")
+	segmentMembers = Client.Db.C("segmentMembers")
+
+	ensureIndex(segmentMembers, mgo.Index{Key: []string{"segment", "developerId"}})
+}
+
+// GetDeveloperAttributes returns the segment fields of developers matching
+// the query.
+func GetDeveloperAttributes(query bson.M) ([]*DeveloperAttributes, error) {
+	c, done := readFrom(ReadReports, devs)
+	defer done()
+
+	as := []*DeveloperAttributes{}
+	err := c.Find(piiQuery(query)).Select(bson.M{
+		"name": 1, "email": 1, "isPaid": 1, "isAdmin": 1, "plan": 1, "version": 1,
+		"integrationEngineer": 1, "createdAt": 1, "expiration": 1, "tags": 1,
+	}).All(&as)
+	if err != nil {
+		return as, err
+	}
+	for _, a := range as {
+		if err := openPIIFields(&a.Name, &a.Email); err != nil {
+			return as, err
+		}
+	}
+
+	return as, nil
+}
+
+// LastHeartbeats returns the time of each developer's last heartbeat, for
+// the developer ids given or everyone if there are none.
+func LastHeartbeats(developerIDs ...string) (map[string]time.Time, error) {
+	c, done := readFrom(ReadReports, events)
+	defer done()
+
+	match := bson.M{"name": "developer.heartbeat"}
+	if len(developerIDs) > 0 {
+		match["developerId"] = bson.M{"$in": developerIDs}
+	}
+
+	var rows []struct {
+		ID   string    `bson:"_id"`
+		Last time.Time `bson:"last"`
+	}
+	err := c.Pipe([]bson.M{
+		{"$match": match},
+		{"$group": bson.M{"_id": "$developerId", "last": bson.M{"$max": "$createdAt"}}},
+	}).All(&rows)
+
+	last := map[string]time.Time{}
+	for _, row := range rows {
+		last[row.ID] = row.Last
+	}
+	return last, err
+}
+
+// SaveSegment creates or replaces a segment. Changing the expression drops
+// the materialized members until the next run.
+func SaveSegment(s *Segment) error {
+	s.UpdatedAt = time.Now()
+	old, err := GetSegment(s.Slug)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if err == nil && old.Expression == s.Expression {
+		s.Size = old.Size
+		s.MaterializedAt = old.MaterializedAt
+	} else if _, err := segmentMembers.RemoveAll(bson.M{"segment": s.Slug}); err != nil {
+		return err
+	}
+
+	_, err = segments.UpsertId(s.Slug, s)
+	return err
+}
+
+// GetSegment returns the segment with the slug.
+func GetSegment(slug string) (*Segment, error) {
+	s := &Segment{}
+	return s, segments.FindId(slug).One(s)
+}
+
+// GetSegments returns segments matching the query by slug.
+func GetSegments(query bson.M) ([]*Segment, error) {
+	ss := []*Segment{}
+	return ss, segments.Find(query).Sort("_id").All(&ss)
+}
+
+// DeleteSegment removes a segment and its members.
+func DeleteSegment(slug string) error {
+	if err := segments.RemoveId(slug); err != nil {
+		return err
+	}
+
+	_, err := segmentMembers.RemoveAll(bson.M{"segment": slug})
+	return err
+}
+
+// ReplaceSegmentMembers stores a segment's members, replacing the last run.
+func ReplaceSegmentMembers(slug string, developerIDs []bson.ObjectId) error {
+	if _, err := segmentMembers.RemoveAll(bson.M{"segment": slug}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	docs := []interface{}{}
+	for i, id := range developerIDs {
+		docs = append(docs, bson.M{
+			"_id":         slug + ":" + id.Hex(),
+			"segment":     slug,
+			"developerId": id,
+		})
+
+		if len(docs) == 1000 || i == len(developerIDs)-1 {
+			if err := segmentMembers.Insert(docs...); err != nil {
+				return err
+			}
+			docs = []interface{}{}
+		}
+	}
+
+	return segments.UpdateId(slug, bson.M{"$set": bson.M{
+		"size":           len(developerIDs),
+		"materializedAt": now,
+	}})
+}
+
+// GetSegmentMemberIDs returns the stored members of a segment.
+func GetSegmentMemberIDs(slug string) ([]bson.ObjectId, error) {
+	var rows []struct {
+		DeveloperID bson.ObjectId `bson:"developerId"`
+	}
+	err := segmentMembers.Find(bson.M{"segment": slug}).Select(bson.M{"developerId": 1}).All(&rows)
+
+	ids := make([]bson.ObjectId, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.DeveloperID)
+	}
+	return ids, err
+}
+
+// IsSegmentMember reports whether a developer is a stored member of a
+// segment.
+func IsSegmentMember(slug string, developerID bson.ObjectId) (bool, error) {
+	n, err := segmentMembers.FindId(slug + ":" + developerID.Hex()).Count()
+	return n > 0, err
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ShadowResult compares the response of a production handler with the
+// experimental handler a mirrored request was sent to.
+type ShadowResult struct {
+	ID              bson.ObjectId `bson:"_id" json:"id"`
+	Route           string        `bson:"route" json:"route"`
+	Method          string        `bson:"method" json:"method"`
+	Path            string        `bson:"path" json:"path"`
+	Match           bool          `bson:"match" json:"match"`
+	PrimaryStatus   int           `bson:"primaryStatus" json:"primaryStatus"`
+	CandidateStatus int           `bson:"candidateStatus" json:"candidateStatus"`
+	PrimaryBody     string        `bson:"primaryBody,omitempty" json:"primaryBody,omitempty"`
+	CandidateBody   string        `bson:"candidateBody,omitempty" json:"candidateBody,omitempty"`
+	PrimaryTime     time.Duration `bson:"primaryTime" json:"primaryTime"`
+	CandidateTime   time.Duration `bson:"candidateTime" json:"candidateTime"`
+	Error           string        `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt       time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+// ShadowSummary is the match rate for a shadowed route.
+type ShadowSummary struct {
+	Route      string `bson:"_id" json:"route"`
+	Total      int    `bson:"total" json:"total"`
+	Mismatches int    `bson:"mismatches" json:"mismatches"`
+}
+
+var shadowResults *mgo.Collection
+
+func init() {
+	shadowResults = Client.Db.C("shadowResults")
+	ensureIndex(shadowResults, mgo.Index{Key: []string{"createdAt"}})
+}
+
+func SaveShadowResult(r *ShadowResult) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+
+	return shadowResults.Insert(r)
+}
+
+// GetShadowResults returns the newest results first.
+func GetShadowResults(query bson.M, limit int) ([]*ShadowResult, error) {
+	rs := []*ShadowResult{}
+	return rs, shadowResults.Find(query).Sort("-createdAt").Limit(limit).All(&rs)
+}
+
+// GetShadowSummaries returns the number of compared and mismatched responses
+// for each route since the given time.
+func GetShadowSummaries(since time.Time) ([]*ShadowSummary, error) {
+	c, done := readFrom(ReadReports, shadowResults)
+	defer done()
+
+	ss := []*ShadowSummary{}
+	return ss, c.Pipe([]bson.M{
+		{"$match": bson.M{"createdAt": bson.M{"$gte": since}}},
+		{"$group": bson.M{
+			"_id":   "$route",
+			"total": bson.M{"$sum": 1},
+			"mismatches": bson.M{"$sum": bson.M{
+				"$cond": []interface{}{"$match", 0, 1},
+			}},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}).All(&ss)
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// SLOCounts are a route's requests, those slower than its latency target
+// and those that failed with a server error.
+type SLOCounts struct {
+	Route  string `bson:"_id" json:"route"`
+	Total  int    `bson:"total" json:"total"`
+	Slow   int    `bson:"slow" json:"slow"`
+	Errors int    `bson:"errors" json:"errors"`
+}
+
+// How long SLO counts are kept, longer than the longest window.
+const sloRetention = 31 * 24 * time.Hour
+
+var sloMinutes *mgo.Collection
+
+func init() {
+	sloMinutes = Client.Db.C("sloMinutes")
+	ensureIndex(sloMinutes, mgo.Index{Key: []string{"route", "minute"}, Unique: true})
+	ensureIndex(sloMinutes, mgo.Index{Key: []string{"minute"}, ExpireAfter: sloRetention})
+}
+
+// AddSLOCounts adds to a route's counts for the minute, each instance adds
+// its own.
+func AddSLOCounts(minute time.Time, c *SLOCounts) error {
+	_, err := sloMinutes.Upsert(bson.M{"route": c.Route, "minute": minute.Truncate(time.Minute)}, bson.M{
+		"$inc": bson.M{"total": c.Total, "slow": c.Slow, "errors": c.Errors},
+	})
+	return err
+}
+
+// GetSLOCounts returns each route's counts since the given time.
+func GetSLOCounts(since time.Time) (map[string]*SLOCounts, error) {
+	c, done := readFrom(ReadReports, sloMinutes)
+	defer done()
+
+	cs := []*SLOCounts{}
+	err := c.Pipe([]bson.M{
+		{"$match": bson.M{"minute": bson.M{"$gte": since}}},
+		{"$group": bson.M{
+			"_id":    "$route",
+			"total":  bson.M{"$sum": "$total"},
+			"slow":   bson.M{"$sum": "$slow"},
+			"errors": bson.M{"$sum": "$errors"},
+		}},
+	}).All(&cs)
+
+	counts := map[string]*SLOCounts{}
+	for _, c := range cs {
+		counts[c.Route] = c
+	}
+
+	return counts, err
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Approval states.
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalDenied   = "denied"
+	ApprovalUsed     = "used"
+)
+
+// SudoSession is an admin's recent re-authentication, required for danger
+// zone actions until it expires.
+type SudoSession struct {
+	ID          string        `bson:"_id" json:"-"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Email       string        `bson:"email" json:"email"`
+	IP          string        `bson:"ip" json:"ip"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt   time.Time     `bson:"expiresAt" json:"expiresAt"`
+}
+
+// Approval is a second admin's sign off on a danger zone action. It's for
+// one request to Path with the same query and body (RequestHash), made by
+// the admin that asked for it.
+type Approval struct {
+	ID              bson.ObjectId `bson:"_id" json:"id"`
+	Action          string        `bson:"action" json:"action"`
+	Method          string        `bson:"method" json:"method"`
+	Path            string        `bson:"path" json:"path"`
+	RequestHash     string        `bson:"requestHash" json:"requestHash"`
+	Reason          string        `bson:"reason,omitempty" json:"reason,omitempty"`
+	Status          string        `bson:"status" json:"status"`
+	RequestedBy     string        `bson:"requestedBy" json:"requestedBy"`
+	DecidedBy       string        `bson:"decidedBy,omitempty" json:"decidedBy,omitempty"`
+	RequestedByHash string        `bson:"requestedByHash,omitempty" json:"-"`
+	CreatedAt       time.Time     `bson:"createdAt" json:"createdAt"`
+	DecidedAt       time.Time     `bson:"decidedAt,omitempty" json:"decidedAt,omitempty"`
+	ExpiresAt       time.Time     `bson:"expiresAt" json:"expiresAt"`
+}
+
+var (
+	sudoSessions *mgo.Collection
+	approvals    *mgo.Collection
+)
+
+func init() {
+	sudoSessions = Client.Db.C("sudoSessions")
+	approvals = Client.Db.C("approvals")
+
+	ensureIndex(sudoSessions, mgo.Index{Key: []string{"expiresAt"}, ExpireAfter: time.Second})
+	ensureIndex(approvals, mgo.Index{Key: []string{"status", "-createdAt"}})
+}
+
+// SaveSudoSession records a re-authentication.
+func SaveSudoSession(s *SudoSession) error {
+	s.CreatedAt = time.Now()
+	return sudoSessions.Insert(s)
+}
+
+// GetSudoSession returns an unexpired sudo session.
+func GetSudoSession(id string) (*SudoSession, error) {
+	s := &SudoSession{}
+	return s, sudoSessions.Find(bson.M{"_id": id, "expiresAt": bson.M{"$gt": time.Now()}}).One(s)
+}
+
+// SaveApproval records a pending approval request.
+func SaveApproval(a *Approval) error {
+	a.ID = bson.NewObjectId()
+	a.Status = ApprovalPending
+	a.CreatedAt = time.Now()
+
+	sealed := *a
+	if err := sealEmail(&sealed.RequestedBy, &sealed.RequestedByHash); err != nil {
+		return err
+	}
+	return approvals.Insert(&sealed)
+}
+
+// GetApproval returns the approval with the id.
+func GetApproval(id bson.ObjectId) (*Approval, error) {
+	a := &Approval{}
+	if err := approvals.FindId(id).One(a); err != nil {
+		return a, err
+	}
+
+	return a, openPIIFields(&a.RequestedBy, &a.DecidedBy)
+}
+
+// GetApprovals returns approvals matching the query, newest first.
+func GetApprovals(query bson.M, limit int) ([]*Approval, error) {
+	as := []*Approval{}
+	if err := approvals.Find(query).Sort("-createdAt").Limit(limit).All(&as); err != nil {
+		return as, err
+	}
+
+	for _, a := range as {
+		if err := openPIIFields(&a.RequestedBy, &a.DecidedBy); err != nil {
+			return as, err
+		}
+	}
+	return as, nil
+}
+
+// DecideApproval approves or denies a pending approval. Admins can't decide
+// their own requests, ErrConflict is returned if it isn't theirs to decide
+// or it's no longer pending.
+func DecideApproval(id bson.ObjectId, status, by string) error {
+	now := time.Now()
+	decidedBy, hash := by, ""
+	if err := sealEmail(&decidedBy, &hash); err != nil {
+		return err
+	}
+
+	err := approvals.Update(bson.M{
+		"_id":       id,
+		"status":    ApprovalPending,
+		"$nor":      []bson.M{emailFieldQuery("requestedBy", by)},
+		"expiresAt": bson.M{"$gt": now},
+	}, bson.M{"$set": bson.M{
+		"status":        status,
+		"decidedBy":     decidedBy,
+		"decidedByHash": hash,
+		"decidedAt":     now,
+	}})
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+
+	return err
+}
+
+// UseApproval marks an approved request as used, returning false if it
+// isn't approved for this request. Each approval is used once.
+func UseApproval(id bson.ObjectId, action, method, path, hash, by string) (bool, error) {
+	err := approvals.Update(bson.M{
+		"_id":         id,
+		"status":      ApprovalApproved,
+		"action":      action,
+		"method":      method,
+		"path":        path,
+		"requestHash": hash,
+		"$and":        []bson.M{emailFieldQuery("requestedBy", by)},
+		"expiresAt":   bson.M{"$gt": time.Now()},
+	}, bson.M{"$set": bson.M{"status": ApprovalUsed}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
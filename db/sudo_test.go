@@ -0,0 +1,39 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUseApproval(t *testing.T) {
+	a := &Approval{
+		Action:      "refund",
+		Method:      "POST",
+		Path:        "/admin/refunds",
+		RequestHash: "small",
+		RequestedBy: "byrd@bowery.io",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	if err := SaveApproval(a); err != nil {
+		t.Fatal("Unable to save approval:", err)
+	}
+	defer approvals.RemoveId(a.ID)
+
+	if ok, _ := UseApproval(a.ID, a.Action, a.Method, a.Path, a.RequestHash, a.RequestedBy); ok {
+		t.Error("pending approval was usable.")
+	}
+	if err := DecideApproval(a.ID, ApprovalApproved, "steve@bowery.io"); err != nil {
+		t.Fatal("Unable to approve:", err)
+	}
+
+	if ok, _ := UseApproval(a.ID, a.Action, a.Method, a.Path, "large", a.RequestedBy); ok {
+		t.Error("approval was usable for a different body.")
+	}
+	if ok, _ := UseApproval(a.ID, a.Action, a.Method, a.Path, a.RequestHash, a.RequestedBy); !ok {
+		t.Error("approval wasn't usable for the request it was given for.")
+	}
+	if ok, _ := UseApproval(a.ID, a.Action, a.Method, a.Path, a.RequestHash, a.RequestedBy); ok {
+		t.Error("approval was used twice.")
+	}
+}
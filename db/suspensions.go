@@ -0,0 +1,72 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Suspension is why and until when a developer's account is suspended,
+// stored on the developer. A zero Until lasts until it's lifted.
+type Suspension struct {
+	Reason      string    `bson:"reason" json:"reason"`
+	Until       time.Time `bson:"until,omitempty" json:"until,omitempty"`
+	SuspendedBy string    `bson:"suspendedBy" json:"suspendedBy"`
+	SuspendedAt time.Time `bson:"suspendedAt" json:"suspendedAt"`
+}
+
+// Active reports whether the suspension is still in force at now.
+func (s *Suspension) Active(now time.Time) bool {
+	return s != nil && (s.Until.IsZero() || now.Before(s.Until))
+}
+
+// SuspendedDeveloper is a suspended developer's credentials and suspension.
+type SuspendedDeveloper struct {
+	ID         bson.ObjectId `bson:"_id" json:"id"`
+	Email      string        `bson:"email" json:"email"`
+	Token      string        `bson:"token" json:"-"`
+	Suspension *Suspension   `bson:"suspension" json:"suspension"`
+}
+
+// SuspendDeveloper suspends a developer, replacing any suspension they
+// already have.
+func SuspendDeveloper(id bson.ObjectId, s *Suspension) error {
+	s.SuspendedAt = time.Now()
+	return updateDeveloper(bson.M{"_id": id}, bson.M{"$set": bson.M{"suspension": s}})
+}
+
+// UnsuspendDeveloper lifts a developer's suspension.
+func UnsuspendDeveloper(id bson.ObjectId) error {
+	return updateDeveloper(bson.M{
+		"_id":        id,
+		"suspension": bson.M{"$exists": true},
+	}, bson.M{"$unset": bson.M{"suspension": 1}})
+}
+
+// GetSuspension returns a developer's suspension, nil if they aren't
+// suspended.
+func GetSuspension(id bson.ObjectId) (*Suspension, error) {
+	d := &SuspendedDeveloper{}
+	err := devs.FindId(id).Select(bson.M{"suspension": 1}).One(d)
+	return d.Suspension, err
+}
+
+// GetSuspendedDevelopers returns every suspended developer, including ones
+// whose suspension has run out but hasn't been lifted.
+func GetSuspendedDevelopers() ([]*SuspendedDeveloper, error) {
+	ds := []*SuspendedDeveloper{}
+	err := devs.Find(bson.M{"suspension": bson.M{"$exists": true}}).Select(bson.M{
+		"email": 1, "token": 1, "suspension": 1,
+	}).All(&ds)
+	if err != nil {
+		return ds, err
+	}
+	for _, d := range ds {
+		if err := openPIIFields(&d.Email); err != nil {
+			return ds, err
+		}
+	}
+
+	return ds, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// TagCount is how many developers have a tag.
+type TagCount struct {
+	Tag   string `bson:"_id" json:"tag"`
+	Count int    `bson:"count" json:"count"`
+}
+
+func init() {
+	ensureIndex(devs, mgo.Index{Key: []string{"tags"}})
+}
+
+// SetDeveloperTags replaces a developer's tags.
+func SetDeveloperTags(id bson.ObjectId, tags []string) error {
+	return updateDeveloper(bson.M{"_id": id}, bson.M{"$set": bson.M{"tags": tags}})
+}
+
+// GetDeveloperTags returns a developer's tags.
+func GetDeveloperTags(id bson.ObjectId) ([]string, error) {
+	d := struct {
+		Tags []string `bson:"tags"`
+	}{}
+	err := devs.FindId(id).Select(bson.M{"tags": 1}).One(&d)
+	if d.Tags == nil {
+		d.Tags = []string{}
+	}
+	return d.Tags, err
+}
+
+// GetTagCounts returns every tag in use with how many developers have it,
+// most used first.
+func GetTagCounts() ([]*TagCount, error) {
+	c, done := readFrom(ReadReports, devs)
+	defer done()
+
+	counts := []*TagCount{}
+	return counts, c.Pipe([]bson.M{
+		{"$match": bson.M{"tags.0": bson.M{"$exists": true}}},
+		{"$unwind": "$tags"},
+		{"$group": bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.D{{"count", -1}, {"_id", 1}}},
+	}).All(&counts)
+}
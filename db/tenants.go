@@ -0,0 +1,189 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ErrTenantChange is returned when a scoped update tries to move a
+// developer to another organization.
+var ErrTenantChange = errors.New("developers can't be moved between organizations")
+
+// Tenant scopes developer queries to one organization's developers. The
+// zero Tenant is broome's own, the developers that signed up outside any
+// organization.
+type Tenant struct {
+	OrganizationID bson.ObjectId
+	all            bool
+	deadline       time.Time
+}
+
+// AllTenants reaches every organization's developers. Requests only get it
+// through the audited admin bypass.
+var AllTenants = &Tenant{all: true}
+
+// TenantOf returns the tenant for an organization, broome's own if id is
+// empty.
+func TenantOf(id bson.ObjectId) *Tenant {
+	return &Tenant{OrganizationID: id}
+}
+
+// All reports whether the tenant reaches every organization.
+func (t *Tenant) All() bool {
+	return t.all
+}
+
+// WithDeadline returns a copy of the tenant whose reads give up at
+// deadline, so reads made for a request don't outlive it. Writes aren't
+// bounded, a change is never left half saved.
+func (t *Tenant) WithDeadline(deadline time.Time) *Tenant {
+	bounded := *t
+	bounded.deadline = deadline
+	return &bounded
+}
+
+// read runs fn with the developers collection on a session that times out
+// at the tenant's deadline.
+func (t *Tenant) read(fn func(c *mgo.Collection) error) error {
+	if t.deadline.IsZero() {
+		return fn(devs)
+	}
+
+	timeout := time.Until(t.deadline)
+	if timeout <= 0 {
+		return ErrDeadline
+	}
+	session := devs.Database.Session.Copy()
+	defer session.Close()
+	session.SetSocketTimeout(timeout)
+
+	err := fn(devs.With(session))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrDeadline
+	}
+	return err
+}
+
+// Scope returns a copy of query limited to the tenant's developers. An
+// organizationId already in the query is replaced, so callers can't widen
+// it.
+func (t *Tenant) Scope(query bson.M) bson.M {
+	scoped := bson.M{}
+	for key, value := range query {
+		scoped[key] = value
+	}
+	if t.all {
+		return scoped
+	}
+
+	if t.OrganizationID == "" {
+		scoped["organizationId"] = bson.M{"$exists": false}
+	} else {
+		scoped["organizationId"] = t.OrganizationID
+	}
+
+	return scoped
+}
+
+// GetDeveloper returns the tenant's developer matching the query.
+func (t *Tenant) GetDeveloper(query bson.M) (*schemas.Developer, error) {
+	d := &schemas.Developer{}
+	err := t.read(func(c *mgo.Collection) error {
+		var err error
+		d, err = getDeveloper(c, t.Scope(query))
+		return err
+	})
+	return d, err
+}
+
+// GetDeveloperById returns the tenant's developer with the id.
+func (t *Tenant) GetDeveloperById(id string) (*schemas.Developer, error) {
+	if !bson.IsObjectIdHex(id) {
+		return &schemas.Developer{}, ErrNotFound
+	}
+
+	return t.GetDeveloper(bson.M{"_id": bson.ObjectIdHex(id)})
+}
+
+// GetDevelopers returns the tenant's developers matching the query.
+func (t *Tenant) GetDevelopers(query bson.M) ([]*schemas.Developer, error) {
+	ds := []*schemas.Developer{}
+	err := t.read(func(c *mgo.Collection) error {
+		var err error
+		ds, err = getDevelopers(c, t.Scope(query))
+		return err
+	})
+	return ds, err
+}
+
+// GetDeveloperPlan returns the plan slug and paid flag of the tenant's
+// developer matching the query.
+func (t *Tenant) GetDeveloperPlan(query bson.M) (string, bool, error) {
+	var plan string
+	var paid bool
+	err := t.read(func(c *mgo.Collection) error {
+		var err error
+		plan, paid, err = getDeveloperPlan(c, t.Scope(query))
+		return err
+	})
+	return plan, paid, err
+}
+
+// CountDevelopers counts the tenant's developers matching the query.
+func (t *Tenant) CountDevelopers(query bson.M) (int, error) {
+	if t.deadline.IsZero() {
+		return CountDevelopers(t.Scope(query))
+	}
+
+	var n int
+	err := t.read(func(c *mgo.Collection) error {
+		var err error
+		n, err = c.Find(piiQuery(t.Scope(query))).Count()
+		return err
+	})
+	return n, err
+}
+
+// UpdateDeveloper sets fields on the tenant's developers matching the
+// query.
+func (t *Tenant) UpdateDeveloper(query, update bson.M) error {
+	if _, ok := update["organizationId"]; ok && !t.all {
+		return ErrTenantChange
+	}
+
+	return UpdateDeveloper(t.Scope(query), update)
+}
+
+// Save creates a developer in the tenant's organization. Developers created
+// through the bypass belong to broome.
+func (t *Tenant) Save(d *schemas.Developer) error {
+	return t.SaveWithOutbox(d)
+}
+
+// SaveWithOutbox inserts a developer into the tenant with outbox messages
+// for it in the same write, so the messages exist only if the developer
+// does.
+func (t *Tenant) SaveWithOutbox(d *schemas.Developer, ms ...*OutboxMessage) error {
+	set := bson.M{}
+	if t.OrganizationID != "" {
+		set["organizationId"] = t.OrganizationID
+	}
+
+	return save(d, set, ms)
+}
+
+// GetDeveloperTenant returns the tenant of the developer matching the
+// query, whichever organization they're in.
+func GetDeveloperTenant(query bson.M) (*Tenant, error) {
+	var d struct {
+		OrganizationID bson.ObjectId `bson:"organizationId,omitempty"`
+	}
+	err := devs.Find(piiQuery(query)).Select(bson.M{"organizationId": 1}).One(&d)
+	return TenantOf(d.OrganizationID), err
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestTenantScope(t *testing.T) {
+	acme, other := bson.NewObjectId(), bson.NewObjectId()
+	query := bson.M{"token": "abc", "organizationId": other}
+
+	scoped := TenantOf(acme).Scope(query)
+	if scoped["organizationId"] != acme || scoped["token"] != "abc" {
+		t.Error("Expected the organization to replace the one queried, got", scoped)
+	}
+	if query["organizationId"] != other {
+		t.Error("Expected the query to be left alone, got", query)
+	}
+
+	own, ok := TenantOf("").Scope(bson.M{"token": "abc"})["organizationId"].(bson.M)
+	if !ok || own["$exists"] != false {
+		t.Error("Expected broome's tenant to exclude every organization, got", own)
+	}
+
+	if _, ok := AllTenants.Scope(query)["organizationId"]; !ok || !AllTenants.All() {
+		t.Error("Expected the bypass to leave the query unscoped")
+	}
+	if _, ok := AllTenants.Scope(bson.M{})["organizationId"]; ok {
+		t.Error("Expected the bypass not to add an organization")
+	}
+}
+
+func TestTenantUpdateCantMove(t *testing.T) {
+	err := TenantOf(bson.NewObjectId()).UpdateDeveloper(bson.M{"token": "abc"}, bson.M{"organizationId": bson.NewObjectId()})
+	if err != ErrTenantChange {
+		t.Error("Expected moving a developer to be refused, got", err)
+	}
+}
+
+func TestTenantDeadline(t *testing.T) {
+	mock, err := MockDB()
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	tenant := TenantOf("")
+	if _, err := tenant.WithDeadline(time.Now().Add(-time.Second)).GetDeveloper(bson.M{"token": mock.Token}); err != ErrDeadline {
+		t.Error("Expected a read past the deadline to give up, got", err)
+	}
+	if plan, _, err := tenant.WithDeadline(time.Now().Add(-time.Second)).GetDeveloperPlan(bson.M{"token": mock.Token}); err != ErrDeadline {
+		t.Error("Expected a read past the deadline to give up, got", plan, err)
+	}
+
+	d, err := tenant.WithDeadline(time.Now().Add(time.Minute)).GetDeveloper(bson.M{"token": mock.Token})
+	if err != nil || d.ID != mock.ID {
+		t.Error("Expected a read within the deadline to find the developer, got", d.ID, err)
+	}
+	if !tenant.deadline.IsZero() {
+		t.Error("Expected WithDeadline to leave the tenant alone")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// TestClock is a developer's virtual time outside production. Billing reads
+// the time from it instead of the wall clock, so it can be moved forward to
+// exercise expiry and renewals. StripeClockID is the Stripe test clock kept
+// in step with it.
+type TestClock struct {
+	DeveloperID   bson.ObjectId `bson:"_id" json:"developerId"`
+	Now           time.Time     `bson:"now" json:"now"`
+	StripeClockID string        `bson:"stripeClockId,omitempty" json:"stripeClockId,omitempty"`
+	StartedBy     string        `bson:"startedBy" json:"startedBy"`
+	StartedAt     time.Time     `bson:"startedAt" json:"startedAt"`
+	UpdatedAt     time.Time     `bson:"updatedAt" json:"updatedAt"`
+}
+
+var testClocks *mgo.Collection
+
+func init() {
+	testClocks = Client.Db.C("testClocks")
+}
+
+// SaveTestClock saves a developer's clock, replacing any they had.
+func SaveTestClock(c *TestClock) error {
+	c.UpdatedAt = time.Now()
+	if c.StartedAt.IsZero() {
+		c.StartedAt = c.UpdatedAt
+	}
+
+	_, err := testClocks.UpsertId(c.DeveloperID, c)
+	return err
+}
+
+// GetTestClock returns a developer's clock.
+func GetTestClock(id bson.ObjectId) (*TestClock, error) {
+	c := &TestClock{}
+	return c, testClocks.FindId(id).One(c)
+}
+
+// AdvanceTestClock moves a developer's clock to a later time. It fails with
+// ErrNotFound if the clock is gone or already past it.
+func AdvanceTestClock(id bson.ObjectId, to time.Time) error {
+	return testClocks.Update(bson.M{"_id": id, "now": bson.M{"$lt": to}},
+		bson.M{"$set": bson.M{"now": to, "updatedAt": time.Now()}})
+}
+
+// RemoveTestClock puts a developer back on the wall clock.
+func RemoveTestClock(id bson.ObjectId) error {
+	return testClocks.RemoveId(id)
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Theme re-skins the admin and signup pages for a deployment. Colors and the
+// font are css values, exposed to the templates as css variables.
+type Theme struct {
+	ProductName     string    `bson:"productName" json:"productName"`
+	LogoURL         string    `bson:"logoUrl" json:"logoUrl"`
+	PrimaryColor    string    `bson:"primaryColor" json:"primaryColor"`
+	AccentColor     string    `bson:"accentColor" json:"accentColor"`
+	BackgroundColor string    `bson:"backgroundColor" json:"backgroundColor"`
+	TextColor       string    `bson:"textColor" json:"textColor"`
+	Font            string    `bson:"font" json:"font"`
+	UpdatedBy       string    `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt       time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// DefaultTheme is used until a theme has been saved by an admin.
+var DefaultTheme = &Theme{
+	ProductName:     "broome",
+	LogoURL:         "/static/logo.png",
+	PrimaryColor:    "#333333",
+	AccentColor:     "#f7d117",
+	BackgroundColor: "#ffffff",
+	TextColor:       "#333333",
+	Font:            "proxima-nova, Helvetica, sans-serif",
+}
+
+// There's one theme per deployment, stored under this id.
+const themeID = "default"
+
+var themes *mgo.Collection
+
+func init() {
+	themes = Client.Db.C("themes")
+}
+
+// GetTheme returns the saved theme, falling back to the default.
+func GetTheme() (*Theme, error) {
+	t := &Theme{}
+	err := themes.FindId(themeID).One(t)
+	if err == mgo.ErrNotFound {
+		c := *DefaultTheme
+		return &c, nil
+	}
+
+	return t, err
+}
+
+// SaveTheme replaces the theme.
+func SaveTheme(t *Theme, updatedBy string) error {
+	t.UpdatedBy = updatedBy
+	t.UpdatedAt = time.Now()
+
+	_, err := themes.UpsertId(themeID, bson.M{"$set": t})
+	return err
+}
@@ -0,0 +1,54 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Client release channels.
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+)
+
+// VersionPolicy declares which CLI versions a channel supports. Clients below
+// Minimum or on a Blocked version must upgrade before continuing.
+type VersionPolicy struct {
+	Channel   string    `bson:"channel" json:"channel"`
+	Minimum   string    `bson:"minimum" json:"minimum"`
+	Latest    string    `bson:"latest" json:"latest"`
+	Blocked   []string  `bson:"blocked" json:"blocked"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+var versionPolicies *mgo.Collection
+
+func init() {
+	versionPolicies = Client.Db.C("versionPolicies")
+}
+
+// ValidChannel reports whether channel is a known release channel.
+func ValidChannel(channel string) bool {
+	return channel == ChannelStable || channel == ChannelBeta
+}
+
+// GetVersionPolicy returns the policy for the channel, an empty policy is
+// returned if none has been set.
+func GetVersionPolicy(channel string) (*VersionPolicy, error) {
+	p := &VersionPolicy{}
+	err := versionPolicies.Find(bson.M{"channel": channel}).One(p)
+	if err == mgo.ErrNotFound {
+		return &VersionPolicy{Channel: channel, Blocked: []string{}}, nil
+	}
+
+	return p, err
+}
+
+func SaveVersionPolicy(p *VersionPolicy) error {
+	p.UpdatedAt = time.Now()
+	_, err := versionPolicies.Upsert(bson.M{"channel": p.Channel}, p)
+	return err
+}
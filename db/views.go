@@ -0,0 +1,166 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ListConfig is how the admin developer list is filtered, sorted and which
+// columns it shows. Plan is "free" or "paid", Lifecycle a lifecycle state,
+// Segment a saved segment's slug and Sort a field, prefixed with "-" for
+// descending.
+type ListConfig struct {
+	Search    string   `bson:"search,omitempty" json:"search,omitempty"`
+	Tag       string   `bson:"tag,omitempty" json:"tag,omitempty"`
+	Plan      string   `bson:"plan,omitempty" json:"plan,omitempty"`
+	Lifecycle string   `bson:"lifecycle,omitempty" json:"lifecycle,omitempty"`
+	Segment   string   `bson:"segment,omitempty" json:"segment,omitempty"`
+	Sort      string   `bson:"sort,omitempty" json:"sort,omitempty"`
+	Columns   []string `bson:"columns,omitempty" json:"columns,omitempty"`
+}
+
+// AdminView is a named developer list configuration admins can share.
+type AdminView struct {
+	Slug       string `bson:"_id" json:"slug"`
+	Name       string `bson:"name" json:"name"`
+	ListConfig `bson:",inline"`
+	CreatedBy  string    `bson:"createdBy" json:"createdBy"`
+	UpdatedBy  string    `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt  time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// DeveloperRow is a developer as the admin list shows them.
+type DeveloperRow struct {
+	ID         bson.ObjectId `bson:"_id"`
+	Token      string        `bson:"token"`
+	Name       string        `bson:"name"`
+	Email      string        `bson:"email"`
+	IsPaid     bool          `bson:"isPaid"`
+	Plan       string        `bson:"plan"`
+	CreatedAt  int64         `bson:"createdAt"`
+	Expiration time.Time     `bson:"expiration"`
+	Lifecycle  string        `bson:"lifecycle"`
+	Tags       []string      `bson:"tags"`
+}
+
+var adminViews *mgo.Collection
+
+func init() {
+	adminViews = Client.Db.C("adminViews")
+}
+
+// SaveAdminView creates or replaces a view, keeping who created it.
+func SaveAdminView(v *AdminView) error {
+	v.UpdatedAt = time.Now()
+	old, err := GetAdminView(v.Slug)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		v.CreatedBy = old.CreatedBy
+	} else {
+		v.CreatedBy = v.UpdatedBy
+	}
+
+	_, err = adminViews.UpsertId(v.Slug, v)
+	return err
+}
+
+// GetAdminView returns the view with the slug.
+func GetAdminView(slug string) (*AdminView, error) {
+	v := &AdminView{}
+	return v, adminViews.FindId(slug).One(v)
+}
+
+// GetAdminViews returns every view by name.
+func GetAdminViews() ([]*AdminView, error) {
+	vs := []*AdminView{}
+	return vs, adminViews.Find(nil).Sort("name").All(&vs)
+}
+
+// DeleteAdminView removes a view and clears it as anyone's default.
+func DeleteAdminView(slug string) error {
+	if err := adminViews.RemoveId(slug); err != nil {
+		return err
+	}
+
+	_, err := devs.UpdateAll(bson.M{"adminDefaultView": slug}, bson.M{"$unset": bson.M{"adminDefaultView": 1}})
+	return err
+}
+
+// SetDefaultAdminView sets the view an admin's developer list opens with,
+// an empty slug clears it.
+func SetDefaultAdminView(id bson.ObjectId, slug string) error {
+	if slug == "" {
+		return devs.UpdateId(id, bson.M{"$unset": bson.M{"adminDefaultView": 1}})
+	}
+
+	return devs.UpdateId(id, bson.M{"$set": bson.M{"adminDefaultView": slug}})
+}
+
+// GetDefaultAdminView returns the slug of an admin's default view, empty if
+// they haven't set one.
+func GetDefaultAdminView(id bson.ObjectId) (string, error) {
+	d := struct {
+		View string `bson:"adminDefaultView"`
+	}{}
+	return d.View, devs.FindId(id).Select(bson.M{"adminDefaultView": 1}).One(&d)
+}
+
+// GetDeveloperRows returns the developers matching the query for the admin
+// list, sorted by the field given. Names and emails are sorted once they're
+// opened, Mongo can't sort them sealed.
+func GetDeveloperRows(query bson.M, by string) ([]*DeveloperRow, error) {
+	c, done := readFrom(ReadAdmin, devs)
+	defer done()
+
+	field := strings.TrimPrefix(by, "-")
+	q := c.Find(piiQuery(query)).Select(bson.M{
+		"token": 1, "name": 1, "email": 1, "isPaid": 1, "plan": 1,
+		"createdAt": 1, "expiration": 1, "lifecycle": 1, "tags": 1,
+	})
+	if field != "name" && field != "email" {
+		q = q.Sort(by)
+	}
+
+	rows := []*DeveloperRow{}
+	if err := q.All(&rows); err != nil {
+		return rows, err
+	}
+	for _, row := range rows {
+		if err := openPIIFields(&row.Name, &row.Email); err != nil {
+			return rows, err
+		}
+	}
+	if field == "name" || field == "email" {
+		sort.Stable(developerRows{rows, field, field != by})
+	}
+
+	return rows, nil
+}
+
+// developerRows sorts rows by name or email.
+type developerRows struct {
+	rows       []*DeveloperRow
+	field      string
+	descending bool
+}
+
+func (r developerRows) Len() int      { return len(r.rows) }
+func (r developerRows) Swap(i, j int) { r.rows[i], r.rows[j] = r.rows[j], r.rows[i] }
+func (r developerRows) Less(i, j int) bool {
+	a, b := r.rows[i].Name, r.rows[j].Name
+	if r.field == "email" {
+		a, b = r.rows[i].Email, r.rows[j].Email
+	}
+	if r.descending {
+		return b < a
+	}
+
+	return a < b
+}
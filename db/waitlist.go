@@ -0,0 +1,65 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// WaitlistEntry is someone who tried to sign up while signups were
+// restricted, kept so they can be invited later.
+type WaitlistEntry struct {
+	Email     string    `bson:"_id" json:"email"`
+	Name      string    `bson:"name,omitempty" json:"name,omitempty"`
+	Domain    string    `bson:"domain" json:"domain"`
+	IP        string    `bson:"ip" json:"ip"`
+	Attempts  int       `bson:"attempts" json:"attempts"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+var waitlist *mgo.Collection
+
+func init() {
+	waitlist = Client.Db.C("waitlist")
+	ensureIndex(waitlist, mgo.Index{Key: []string{"domain"}})
+	ensureIndex(waitlist, mgo.Index{Key: []string{"createdAt"}})
+}
+
+// JoinWaitlist adds someone to the waitlist, keeping when they first joined
+// if they try again.
+func JoinWaitlist(w *WaitlistEntry) error {
+	w.Email = strings.ToLower(w.Email)
+	w.UpdatedAt = time.Now()
+
+	_, err := waitlist.FindId(w.Email).Apply(mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{
+				"name":      w.Name,
+				"domain":    w.Domain,
+				"ip":        w.IP,
+				"updatedAt": w.UpdatedAt,
+			},
+			"$setOnInsert": bson.M{"createdAt": w.UpdatedAt},
+			"$inc":         bson.M{"attempts": 1},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, w)
+	return err
+}
+
+// GetWaitlist returns entries matching the query, oldest first so the
+// earliest are invited first.
+func GetWaitlist(query bson.M, limit int) ([]*WaitlistEntry, error) {
+	ws := []*WaitlistEntry{}
+	return ws, waitlist.Find(query).Sort("createdAt").Limit(limit).All(&ws)
+}
+
+// RemoveFromWaitlist removes someone once they've been let in.
+func RemoveFromWaitlist(email string) error {
+	return waitlist.RemoveId(strings.ToLower(email))
+}
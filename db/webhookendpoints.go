@@ -0,0 +1,263 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Webhook delivery states.
+const (
+	DeliveryPending    = "pending"
+	DeliveryProcessing = "processing"
+	DeliverySucceeded  = "succeeded"
+	DeliveryFailed     = "failed"
+	DeliveryDiscarded  = "discarded"
+)
+
+// How long delivery logs are kept.
+const deliveryRetention = 30 * 24 * time.Hour
+
+// WebhookEndpoint is a url a developer has events they subscribed to sent
+// to, signed with Secret. Failures counts deliveries that failed in a row,
+// the endpoint is disabled once there are too many.
+type WebhookEndpoint struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID    bson.ObjectId `bson:"developerId" json:"developerId"`
+	URL            string        `bson:"url" json:"url"`
+	Events         []string      `bson:"events" json:"events"`
+	Secret         string        `bson:"secret" json:"secret,omitempty"`
+	Disabled       bool          `bson:"disabled" json:"disabled"`
+	DisabledReason string        `bson:"disabledReason,omitempty" json:"disabledReason,omitempty"`
+	DisabledAt     time.Time     `bson:"disabledAt,omitempty" json:"disabledAt,omitempty"`
+	Failures       int           `bson:"failures" json:"failures"`
+	CreatedAt      time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+// WebhookDelivery is an event sent, or to be sent, to an endpoint. Payload
+// is kept so retries send the same body.
+type WebhookDelivery struct {
+	ID            bson.ObjectId `bson:"_id" json:"id"`
+	EndpointID    bson.ObjectId `bson:"endpointId" json:"endpointId"`
+	DeveloperID   bson.ObjectId `bson:"developerId" json:"developerId"`
+	EventID       string        `bson:"eventId" json:"eventId"`
+	Event         string        `bson:"event" json:"event"`
+	Payload       string        `bson:"payload" json:"payload"`
+	Status        string        `bson:"status" json:"status"`
+	Attempts      int           `bson:"attempts" json:"attempts"`
+	HTTPCode      int           `bson:"httpCode,omitempty" json:"httpCode,omitempty"`
+	LastError     string        `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	Millis        int64         `bson:"millis,omitempty" json:"millis,omitempty"`
+	NextAttemptAt time.Time     `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	LockedUntil   time.Time     `bson:"lockedUntil,omitempty" json:"-"`
+	CreatedAt     time.Time     `bson:"createdAt" json:"createdAt"`
+	DeliveredAt   time.Time     `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
+}
+
+var (
+	webhookEndpoints  *mgo.Collection
+	webhookDeliveries *mgo.Collection
+)
+
+func init() {
+	webhookEndpoints = Client.Db.C("webhookEndpoints")
+	webhookDeliveries = Client.Db.C("webhookDeliveries")
+
+	ensureIndex(webhookEndpoints, mgo.Index{Key: []string{"developerId"}})
+	ensureIndex(webhookEndpoints, mgo.Index{Key: []string{"events", "disabled"}})
+	ensureIndex(webhookDeliveries, mgo.Index{Key: []string{"status", "nextAttemptAt"}})
+	ensureIndex(webhookDeliveries, mgo.Index{Key: []string{"endpointId", "-createdAt"}})
+	ensureIndex(webhookDeliveries, mgo.Index{Key: []string{"endpointId", "eventId"}, Unique: true})
+	ensureIndex(webhookDeliveries, mgo.Index{Key: []string{"createdAt"}, ExpireAfter: deliveryRetention})
+}
+
+// openEndpoints opens the secrets of endpoints in place.
+func openEndpoints(es ...*WebhookEndpoint) error {
+	for _, e := range es {
+		secret, err := openPII(e.Secret)
+		if err != nil {
+			return err
+		}
+		e.Secret = secret
+	}
+
+	return nil
+}
+
+// SaveWebhookEndpoint creates an endpoint, sealing its secret.
+func SaveWebhookEndpoint(e *WebhookEndpoint) error {
+	e.ID = bson.NewObjectId()
+	e.CreatedAt = time.Now()
+
+	sealed := *e
+	secret, err := sealPII(e.Secret)
+	if err != nil {
+		return err
+	}
+	sealed.Secret = secret
+
+	return webhookEndpoints.Insert(&sealed)
+}
+
+// GetWebhookEndpoint returns a developer's endpoint.
+func GetWebhookEndpoint(developerID, id bson.ObjectId) (*WebhookEndpoint, error) {
+	e := &WebhookEndpoint{}
+	if err := webhookEndpoints.Find(bson.M{"_id": id, "developerId": developerID}).One(e); err != nil {
+		return e, err
+	}
+
+	return e, openEndpoints(e)
+}
+
+// GetWebhookEndpoints returns a developer's endpoints, oldest first.
+func GetWebhookEndpoints(developerID bson.ObjectId) ([]*WebhookEndpoint, error) {
+	es := []*WebhookEndpoint{}
+	if err := webhookEndpoints.Find(bson.M{"developerId": developerID}).Sort("_id").All(&es); err != nil {
+		return es, err
+	}
+
+	return es, openEndpoints(es...)
+}
+
+// CountWebhookEndpoints counts a developer's endpoints.
+func CountWebhookEndpoints(developerID bson.ObjectId) (int, error) {
+	return webhookEndpoints.Find(bson.M{"developerId": developerID}).Count()
+}
+
+// GetSubscribedEndpoints returns the enabled endpoints subscribed to event
+// of the developers given.
+func GetSubscribedEndpoints(event string, developerIDs []bson.ObjectId) ([]*WebhookEndpoint, error) {
+	es := []*WebhookEndpoint{}
+	err := webhookEndpoints.Find(bson.M{
+		"developerId": bson.M{"$in": developerIDs},
+		"events":      event,
+		"disabled":    false,
+	}).All(&es)
+	if err != nil {
+		return es, err
+	}
+
+	return es, openEndpoints(es...)
+}
+
+// GetEnabledEndpoints returns a developer's enabled endpoints, whatever
+// they're subscribed to.
+func GetEnabledEndpoints(developerID bson.ObjectId) ([]*WebhookEndpoint, error) {
+	es := []*WebhookEndpoint{}
+	if err := webhookEndpoints.Find(bson.M{"developerId": developerID, "disabled": false}).All(&es); err != nil {
+		return es, err
+	}
+
+	return es, openEndpoints(es...)
+}
+
+// RemoveWebhookEndpoint deletes a developer's endpoint and discards what's
+// still to be delivered to it.
+func RemoveWebhookEndpoint(developerID, id bson.ObjectId) error {
+	if err := webhookEndpoints.Remove(bson.M{"_id": id, "developerId": developerID}); err != nil {
+		return err
+	}
+
+	return DiscardWebhookDeliveries(id)
+}
+
+// EnableWebhookEndpoint turns a disabled endpoint back on with its failures
+// cleared.
+func EnableWebhookEndpoint(developerID, id bson.ObjectId) error {
+	return webhookEndpoints.Update(bson.M{"_id": id, "developerId": developerID}, bson.M{
+		"$set":   bson.M{"disabled": false, "failures": 0},
+		"$unset": bson.M{"disabledReason": "", "disabledAt": ""},
+	})
+}
+
+// ResetEndpointFailures clears an endpoint's failures after a delivery
+// succeeds.
+func ResetEndpointFailures(id bson.ObjectId) error {
+	return webhookEndpoints.UpdateId(id, bson.M{"$set": bson.M{"failures": 0}})
+}
+
+// AddEndpointFailure counts a failed delivery, disabling the endpoint once
+// limit have failed in a row. It returns true for the failure that
+// disabled it.
+func AddEndpointFailure(id bson.ObjectId, limit int, reason string) (bool, error) {
+	e := &WebhookEndpoint{}
+	_, err := webhookEndpoints.FindId(id).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"failures": 1}},
+		ReturnNew: true,
+	}, e)
+	if err != nil || e.Disabled || e.Failures < limit {
+		return false, err
+	}
+
+	err = webhookEndpoints.Update(bson.M{"_id": id, "disabled": false}, bson.M{"$set": bson.M{
+		"disabled":       true,
+		"disabledReason": reason,
+		"disabledAt":     time.Now(),
+	}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, DiscardWebhookDeliveries(id)
+}
+
+// SaveWebhookDelivery queues a delivery, due now unless it's saved already
+// claimed. An event already queued for the endpoint returns ErrDuplicate.
+func SaveWebhookDelivery(d *WebhookDelivery) error {
+	now := time.Now()
+	d.ID = bson.NewObjectId()
+	if d.Status == "" {
+		d.Status = DeliveryPending
+	}
+	d.CreatedAt = now
+	d.NextAttemptAt = now
+
+	return mapError(webhookDeliveries.Insert(d))
+}
+
+// ClaimWebhookDelivery takes the next due delivery, holding it for lease so
+// no other worker sends it at the same time.
+func ClaimWebhookDelivery(lease time.Duration) (*WebhookDelivery, error) {
+	now := time.Now()
+	d := &WebhookDelivery{}
+	_, err := webhookDeliveries.Find(bson.M{
+		"$or": []bson.M{
+			{"status": DeliveryPending, "nextAttemptAt": bson.M{"$lte": now}},
+			{"status": DeliveryProcessing, "lockedUntil": bson.M{"$lt": now}},
+		},
+	}).Sort("nextAttemptAt").Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"status":      DeliveryProcessing,
+			"lockedUntil": now.Add(lease),
+		}},
+		ReturnNew: true,
+	}, d)
+
+	return d, err
+}
+
+// UpdateWebhookDelivery sets the fields on a delivery.
+func UpdateWebhookDelivery(id bson.ObjectId, update bson.M) error {
+	return webhookDeliveries.UpdateId(id, bson.M{"$set": update})
+}
+
+// DiscardWebhookDeliveries drops what's still to be delivered to an
+// endpoint.
+func DiscardWebhookDeliveries(endpointID bson.ObjectId) error {
+	_, err := webhookDeliveries.UpdateAll(bson.M{
+		"endpointId": endpointID,
+		"status":     bson.M{"$in": []string{DeliveryPending, DeliveryProcessing}},
+	}, bson.M{"$set": bson.M{"status": DeliveryDiscarded}})
+	return err
+}
+
+// GetWebhookDeliveries returns an endpoint's newest deliveries first.
+func GetWebhookDeliveries(endpointID bson.ObjectId, limit int) ([]*WebhookDelivery, error) {
+	ds := []*WebhookDelivery{}
+	return ds, webhookDeliveries.Find(bson.M{"endpointId": endpointID}).Sort("-createdAt").Limit(limit).All(&ds)
+}
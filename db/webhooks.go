@@ -0,0 +1,85 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long received webhooks are kept for inspection and replay.
+const webhookRetention = time.Hour * 24 * 30
+
+// Webhook statuses.
+const (
+	WebhookReceived  = "received"
+	WebhookProcessed = "processed"
+	WebhookFailed    = "failed"
+)
+
+// Webhook is a payload received from a provider, or simulated by an admin,
+// and what happened when it was processed.
+type Webhook struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Provider    string        `bson:"provider" json:"provider"`
+	Events      string        `bson:"events,omitempty" json:"events,omitempty"`
+	Payload     string        `bson:"payload" json:"payload"`
+	Simulated   bool          `bson:"simulated,omitempty" json:"simulated,omitempty"`
+	Status      string        `bson:"status" json:"status"`
+	Error       string        `bson:"error,omitempty" json:"error,omitempty"`
+	Attempts    int           `bson:"attempts" json:"attempts"`
+	ReceivedAt  time.Time     `bson:"receivedAt" json:"receivedAt"`
+	ProcessedAt time.Time     `bson:"processedAt,omitempty" json:"processedAt,omitempty"`
+	ExpiresAt   time.Time     `bson:"expiresAt" json:"-"`
+}
+
+var webhooks *mgo.Collection
+
+func init() {
+	webhooks = Client.Db.C("webhooks")
+	ensureIndex(webhooks, mgo.Index{Key: []string{"provider", "status", "-receivedAt"}})
+	ensureIndex(webhooks, mgo.Index{Key: []string{"-receivedAt"}})
+	ensureIndex(webhooks, mgo.Index{Key: []string{"expiresAt"}, ExpireAfter: time.Second})
+}
+
+func SaveWebhook(w *Webhook) error {
+	if w.ID == "" {
+		w.ID = bson.NewObjectId()
+	}
+	if w.ReceivedAt.IsZero() {
+		w.ReceivedAt = time.Now()
+	}
+	if w.Status == "" {
+		w.Status = WebhookReceived
+	}
+	w.ExpiresAt = w.ReceivedAt.Add(webhookRetention)
+
+	return webhooks.Insert(w)
+}
+
+// FinishWebhook records the outcome of an attempt at processing a webhook.
+func FinishWebhook(id bson.ObjectId, events string, err error) error {
+	set := bson.M{"status": WebhookProcessed, "error": "", "processedAt": time.Now()}
+	if events != "" {
+		set["events"] = events
+	}
+	if err != nil {
+		set["status"] = WebhookFailed
+		set["error"] = err.Error()
+	}
+
+	return webhooks.UpdateId(id, bson.M{"$set": set, "$inc": bson.M{"attempts": 1}})
+}
+
+func GetWebhook(id bson.ObjectId) (*Webhook, error) {
+	w := &Webhook{}
+	return w, webhooks.FindId(id).One(w)
+}
+
+// GetWebhooks returns the webhooks matching the query, newest first,
+// without their payloads.
+func GetWebhooks(query bson.M, limit int) ([]*Webhook, error) {
+	ws := []*Webhook{}
+	return ws, webhooks.Find(query).Select(bson.M{"payload": 0}).Sort("-receivedAt").Limit(limit).All(&ws)
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for deleting and restoring developers.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+func init() {
+	schedule("purge-deleted-developers", time.Hour, purgeDeletedDevelopers)
+}
+
+// purgeDeletedDevelopers removes developers whose grace period has passed.
+func purgeDeletedDevelopers() error {
+	n, err := db.PurgeDeletedDevelopers(time.Now())
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		fmt.Println("purged", n, "deleted developers")
+	}
+	return nil
+}
+
+// DELETE /developers/{token}, Deletes a developer, restorable for 30 days
+func DeleteDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
+	token := mux.Vars(req)["token"]
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": token})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	dd, err := db.DeleteDeveloper(d)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	entitlements.invalidate(token)
+	audit(req, "developer.deleted", d.Email, "")
+
+	message, err := RenderEmail("deletion_email", map[string]interface{}{
+		"name":         strings.Split(d.Name, " ")[0],
+		"restoreToken": dd.RestoreToken,
+		"purgeAt":      dd.PurgeAt.Format("January 2, 2006"),
+	})
+	if err == nil {
+		err = sendEmail(context.Background(), gochimp.Message{
+			Subject:   "Your Bowery account has been deleted",
+			FromEmail: "support@bowery.io",
+			FromName:  "Bowery Support",
+			To: []gochimp.Recipient{{
+				Email: d.Email,
+				Name:  d.Name,
+			}},
+			Html: message,
+		})
+	}
+	if err != nil {
+		fmt.Println("unable to send deletion email to", d.Email, err)
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusSuccess,
+		"purgeAt": dd.PurgeAt,
+	})
+}
+
+// GET /developers/restore/{token}, Restores a deleted developer
+func RestoreDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := db.RestoreDeveloper(mux.Vars(req)["token"])
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": "This restore link is invalid or has expired."})
+		return
+	}
+	audit(req, "developer.restored", d.Email, "")
+
+	if err := RenderTemplate(rw, "restored", map[string]string{"Name": d.Name}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /admin/deletions, Lists developers pending purge
+func DeletionsHandler(rw http.ResponseWriter, req *http.Request) {
+	dds, err := db.GetDeletedDevelopers(bson.M{})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderAdminTemplate(rw, "deletions", map[string]interface{}{
+		"Deletions": dds,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
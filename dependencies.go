@@ -0,0 +1,131 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the calls to external services, each made through its own
+// circuit breaker so a failing provider is skipped rather than waited on.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Bowery/gopackages/requests"
+	"github.com/mattbaird/gochimp"
+)
+
+// Breakers by dependency. Thresholds are consecutive failures before the
+// breaker opens, the cooldown is how long until a trial call is let through.
+var dependencies = map[string]*circuitBreaker{
+	"stripe":     stripePool.breaker,
+	"mandrill":   newCircuitBreaker("mandrill", 5, time.Minute),
+	"mailchimp":  newCircuitBreaker("mailchimp", 5, 2*time.Minute),
+	"slack":      newCircuitBreaker("slack", 3, time.Minute),
+	"keen":       newCircuitBreaker("keen", 3, 5*time.Minute),
+	"fx":         newCircuitBreaker("fx", 3, 10*time.Minute),
+	"accounting": newCircuitBreaker("accounting", 3, 5*time.Minute),
+	"crm":        newCircuitBreaker("crm", 3, 5*time.Minute),
+	"abuseipdb":  newCircuitBreaker("abuseipdb", 3, 5*time.Minute),
+	"syslog":     newCircuitBreaker("syslog", 3, time.Minute),
+	"splunk":     newCircuitBreaker("splunk", 3, time.Minute),
+	"bus":        newCircuitBreaker("bus", 3, time.Minute),
+}
+
+// callDependency calls fn through the named dependency's breaker, retrying
+// errors retryable allows. Each attempt counts towards the breaker, apart
+// from those cut short by ctx, which say nothing about the dependency.
+func callDependency(ctx context.Context, name string, retryable func(error) bool, fn func() error) error {
+	b := dependencies[name]
+	return withRetry(ctx, name, retryable, func() error {
+		if !b.allow(time.Now()) {
+			return errBreakerOpen
+		}
+
+		err := fn()
+		if ctx.Err() != nil {
+			b.release()
+			return err
+		}
+		b.record(err != nil, time.Now())
+		return err
+	})
+}
+
+// sendEmail sends a message through Mandrill. Sends aren't idempotent so
+// they're only retried if Mandrill couldn't be reached. Mandrill's client
+// can't be interrupted, so ctx only stops a send that hasn't started.
+func sendEmail(ctx context.Context, msg gochimp.Message) error {
+	return callDependency(ctx, "mandrill", connectError, func() error {
+		res, err := mandrill.MessageSend(msg, false)
+		if err == nil {
+			recordSentEmails(msg, res)
+		}
+		return err
+	})
+}
+
+// subscribe adds an email to a Mailchimp list.
+func subscribe(ctx context.Context, listID, email string) error {
+	return callDependency(ctx, "mailchimp", transientError, func() error {
+		_, err := chimp.ListsSubscribe(gochimp.ListsSubscribe{
+			ListId: listID,
+			Email:  gochimp.Email{Email: email},
+		})
+		return err
+	})
+}
+
+// unsubscribe removes an email from a Mailchimp list without sending the
+// goodbye email, used to undo a subscribe.
+func unsubscribe(ctx context.Context, listID, email string) error {
+	return callDependency(ctx, "mailchimp", transientError, func() error {
+		return chimp.ListsUnsubscribe(gochimp.ListsUnsubscribe{
+			ListId:       listID,
+			Email:        gochimp.Email{Email: email},
+			DeleteMember: true,
+		})
+	})
+}
+
+// postSlack posts to a Slack channel. Posts are never tied to a request,
+// they're wanted even if its client has gone.
+func postSlack(channel, message string) error {
+	return callDependency(context.Background(), "slack", connectError, func() error {
+		return slackC.SendMessage(channel, redactString(message), "Drizzy Drake")
+	})
+}
+
+// notifySlack posts to a Slack channel. Notifications are best effort so
+// failures are only printed.
+func notifySlack(channel, message string) {
+	if err := postSlack(channel, message); err != nil {
+		fmt.Println("unable to post to slack", channel, err)
+	}
+}
+
+// GET /admin/dependencies, Shows breaker state and retries for each external service
+func DependenciesHandler(rw http.ResponseWriter, req *http.Request) {
+	names := []string{}
+	for name := range dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type dependency struct {
+		breakerMetrics
+		Retries retryMetrics `json:"retries"`
+	}
+
+	res := []*dependency{}
+	for _, name := range names {
+		res = append(res, &dependency{
+			breakerMetrics: dependencies[name].snapshot(),
+			Retries:        budgetFor(name).snapshot(),
+		})
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusFound,
+		"dependencies": res,
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the daily metrics digest sent to the team.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// digestRecipients are the addresses the digest goes to, read from
+// DIGEST_RECIPIENTS as a comma separated list.
+var digestRecipients = strings.Split(os.Getenv("DIGEST_RECIPIENTS"), ",")
+
+// digest holds the metrics for a single day.
+type digest struct {
+	Day             time.Time
+	Signups         int
+	Conversions     int
+	Revenue         map[string]int64
+	FailedCharges   int
+	Deleted         int
+	DeletedPaid     []string
+	TotalDevelopers int
+}
+
+func init() {
+	scheduleDaily("daily-digest", 13, sendDigest)
+}
+
+// compileDigest gathers the metrics for the day starting at start.
+func compileDigest(start time.Time) (*digest, error) {
+	end := start.Add(24 * time.Hour)
+	created := bson.M{"$gte": start, "$lt": end}
+	d := &digest{Day: start, Revenue: map[string]int64{}, DeletedPaid: []string{}}
+
+	var err error
+	d.Signups, err = db.CountDevelopers(bson.M{"createdAt": bson.M{
+		"$gte": start.UnixNano() / int64(time.Millisecond),
+		"$lt":  end.UnixNano() / int64(time.Millisecond),
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	d.TotalDevelopers, err = db.CountDevelopers(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	paid, err := db.GetPaidEventTotals(start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range paid {
+		d.Conversions += t.Count
+		d.Revenue[t.Currency] += t.Amount
+	}
+
+	d.FailedCharges, err = db.CountEvents(bson.M{"name": "charge.failed", "createdAt": created})
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := db.GetDeletedDevelopers(bson.M{"deletedAt": created})
+	if err != nil {
+		return nil, err
+	}
+	d.Deleted = len(deleted)
+	for _, dd := range deleted {
+		if dd.Developer.IsPaid {
+			d.DeletedPaid = append(d.DeletedPaid, dd.Developer.Email)
+		}
+	}
+
+	return d, nil
+}
+
+// RevenueLines formats revenue per currency, e.g. "58.00 USD".
+func (d *digest) RevenueLines() []string {
+	lines := []string{}
+	for currency, amount := range d.Revenue {
+		lines = append(lines, fmt.Sprintf("%.2f %s", float64(amount)/100, currency))
+	}
+
+	return lines
+}
+
+// yesterday returns the start of the previous UTC day.
+func yesterday() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(-24 * time.Hour)
+}
+
+// sendDigest emails and posts to Slack yesterday's metrics.
+func sendDigest() error {
+	d, err := compileDigest(yesterday())
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv("ENV") == "production" {
+		go notifySlack(slackChannel("activity"), fmt.Sprintf(
+			"%s: %d signups, %d conversions, revenue %s, %d failed charges, %d deletions (%d paid).",
+			d.Day.Format("Jan 2"), d.Signups, d.Conversions, strings.Join(d.RevenueLines(), ", "),
+			d.FailedCharges, d.Deleted, len(d.DeletedPaid),
+		))
+	}
+
+	to := []gochimp.Recipient{}
+	for _, email := range digestRecipients {
+		if email = strings.TrimSpace(email); email != "" {
+			to = append(to, gochimp.Recipient{Email: email})
+		}
+	}
+	if len(to) == 0 {
+		return nil
+	}
+
+	message, err := RenderEmail("digest_email", d)
+	if err != nil {
+		return err
+	}
+
+	return sendEmail(context.Background(), gochimp.Message{
+		Subject:   "Broome digest for " + d.Day.Format("January 2, 2006"),
+		FromEmail: "hello@bowery.io",
+		FromName:  "Broome",
+		To:        to,
+		Html:      message,
+	})
+}
+
+// GET /admin/digest, Previews the digest email for a day, yesterday by default
+func DigestHandler(rw http.ResponseWriter, req *http.Request) {
+	day := yesterday()
+	if val := req.FormValue("day"); val != "" {
+		t, err := time.Parse("2006-01-02", val)
+		if err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": "invalid day"})
+			return
+		}
+		day = t
+	}
+
+	d, err := compileDigest(day)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	message, err := RenderEmail("digest_email", d)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(rw, message)
+}
@@ -0,0 +1,374 @@
+// Copyright 2014 Bowery, Inc.
+// Contains discount applications. Students send a school email and open
+// source maintainers a link to their repository, admins approve or deny them
+// from a review queue with one of a few canned replies, and approved
+// developers are moved onto the discounted plan, which they're charged for
+// from then on.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Longest note kept with an application, or message added to a reply.
+	maxDiscountNote = 1000
+
+	// Applications listed on the review queue.
+	discountPageLimit = 200
+)
+
+// Hosts open source repositories are accepted from.
+var discountRepoHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+// discountResponses are the replies admins pick from when reviewing an
+// application, keyed by the status they're sent with.
+var discountResponses = map[string]map[string]string{
+	db.DiscountApproved: {
+		"approved": "Your application was approved, you'll be charged the discounted price from your next payment.",
+	},
+	db.DiscountDenied: {
+		"not-eligible":       "Unfortunately you aren't eligible for the discount.",
+		"insufficient-proof": "We weren't able to confirm your eligibility from what you sent, you're welcome to apply again with more detail.",
+		"inactive-repo":      "The repository you sent doesn't look actively maintained, you're welcome to apply again once it is.",
+	},
+}
+
+// discountReq is the body of a discount application.
+type discountReq struct {
+	Kind     string `json:"kind"`
+	EduEmail string `json:"eduEmail"`
+	RepoURL  string `json:"repoUrl"`
+	Note     string `json:"note"`
+}
+
+// isSchoolEmail reports whether an email is at a school's domain, e.g.
+// mit.edu, ox.ac.uk or unimelb.edu.au.
+func isSchoolEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return false
+	}
+	labels := strings.Split(strings.ToLower(email[at+1:]), ".")
+	if len(labels) < 2 {
+		return false
+	}
+	if labels[len(labels)-1] == "edu" {
+		return true
+	}
+
+	second := labels[len(labels)-2]
+	return len(labels) > 2 && (second == "ac" || second == "edu")
+}
+
+// isRepoURL reports whether a link is to a repository on a host we accept.
+func isRepoURL(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "https" || !discountRepoHosts[strings.ToLower(u.Host)] {
+		return false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	return len(parts) >= 2 && parts[0] != "" && parts[1] != ""
+}
+
+// validateDiscountApplication checks an application has the proof its kind
+// needs, dropping what it doesn't.
+func validateDiscountApplication(body *discountReq) error {
+	body.Kind = strings.TrimSpace(body.Kind)
+	body.EduEmail = strings.TrimSpace(body.EduEmail)
+	body.RepoURL = strings.TrimSpace(body.RepoURL)
+	body.Note = strings.TrimSpace(body.Note)
+
+	switch body.Kind {
+	case db.DiscountStudent:
+		body.RepoURL = ""
+		if !isSchoolEmail(body.EduEmail) {
+			return fmt.Errorf("eduEmail must be a school email address")
+		}
+	case db.DiscountOpenSource:
+		body.EduEmail = ""
+		if !isRepoURL(body.RepoURL) {
+			return fmt.Errorf("repoUrl must be an https link to a repository on GitHub, GitLab or Bitbucket")
+		}
+	default:
+		return fmt.Errorf("kind must be %s or %s", db.DiscountStudent, db.DiscountOpenSource)
+	}
+	if len(body.Note) > maxDiscountNote {
+		return fmt.Errorf("note can be up to %d characters", maxDiscountNote)
+	}
+
+	return nil
+}
+
+// errPlanUnavailable is returned when the plan a developer would be charged
+// for has been turned off or has no price.
+var errPlanUnavailable = errors.New("That plan isn't available, contact support@bowery.io.")
+
+// purchasePlan returns the plan a developer is charged for, their discounted
+// one if they've been approved for it and fallback otherwise. Discounted
+// plans aren't listed on the pricing page so they're sold while inactive,
+// to those approved for them.
+func purchasePlan(d *schemas.Developer, fallback string) (*db.Plan, error) {
+	slug, _, err := db.GetDeveloperPlan(bson.M{"_id": d.ID})
+	if err != nil {
+		return nil, err
+	}
+	discounted := slug == db.PlanStudent || slug == db.PlanOpenSource
+	if !discounted {
+		slug = fallback
+	}
+
+	plan, err := db.GetPlan(slug)
+	if err != nil {
+		return nil, err
+	}
+	if (!plan.Active && !discounted) || plan.Amount <= 0 {
+		return nil, errPlanUnavailable
+	}
+
+	return plan, nil
+}
+
+// POST /developers/{token}/discount-applications, Applies for the student or open source discount
+func CreateDiscountApplicationHandler(rw http.ResponseWriter, req *http.Request) {
+	var body discountReq
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateDiscountApplication(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	a := &db.DiscountApplication{
+		Kind:     body.Kind,
+		EduEmail: body.EduEmail,
+		RepoURL:  body.RepoURL,
+		Note:     body.Note,
+	}
+	if err == nil {
+		a.DeveloperID = d.ID
+		a.Email = d.Email
+		err = db.SaveDiscountApplication(a)
+	}
+	if err == db.ErrDuplicate {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "You already have an application waiting for review.",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	audit(req, "discount.applied", d.Email, d.Email+" "+a.Kind)
+	track("discount.applied", d, map[string]interface{}{"kind": a.Kind})
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":      requests.StatusCreated,
+		"application": a,
+	})
+}
+
+// GET /developers/{token}/discount-applications, Lists a developer's discount applications
+func DiscountApplicationsHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	var as []*db.DiscountApplication
+	if err == nil {
+		as, err = db.GetDiscountApplications(bson.M{"developerId": d.ID}, discountPageLimit)
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusFound,
+		"applications": as,
+	})
+}
+
+// GET /admin/discounts, Renders the queue of discount applications to review
+func DiscountsHandler(rw http.ResponseWriter, req *http.Request) {
+	status := req.FormValue("status")
+	if status == "" {
+		status = db.DiscountPending
+	}
+	query := bson.M{"status": status}
+	if status == "all" {
+		query = bson.M{}
+	}
+
+	as, err := db.GetDiscountApplications(query, discountPageLimit)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderAdminTemplate(rw, "discounts", map[string]interface{}{
+		"Applications": as,
+		"Responses":    discountResponses,
+		"Status":       status,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// POST /admin/discounts/{id}/{action}, Approves or denies a discount application with a templated reply
+func ReviewDiscountHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Template string `json:"template"`
+		Message  string `json:"message"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	vars := mux.Vars(req)
+	status := map[string]string{"approve": db.DiscountApproved, "deny": db.DiscountDenied}[vars["action"]]
+	if status == "" {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "action must be approve or deny",
+		})
+		return
+	}
+	if body.Template == "" && status == db.DiscountApproved {
+		body.Template = "approved"
+	}
+	response, ok := discountResponses[status][body.Template]
+	body.Message = strings.TrimSpace(body.Message)
+	if !ok || len(body.Message) > maxDiscountNote {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  fmt.Sprintf("A reply for %s and a message up to %d characters are required.", status, maxDiscountNote),
+		})
+		return
+	}
+	if body.Message != "" {
+		response += "\n\n" + body.Message
+	}
+
+	if !bson.IsObjectIdHex(vars["id"]) {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  db.ErrNotFound.Error(),
+		})
+		return
+	}
+	a, err := db.GetDiscountApplication(bson.ObjectIdHex(vars["id"]))
+	var d *schemas.Developer
+	if err == nil {
+		d, err = tenantFor(req).GetDeveloper(bson.M{"_id": a.DeveloperID})
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	a.Status = status
+	a.Response = response
+	a.ReviewedBy = actor
+	err = db.ReviewDiscountApplication(a)
+	if err == nil && status == db.DiscountApproved {
+		err = db.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{"plan": a.Kind})
+		entitlements.invalidate(d.Token)
+	}
+	if err == db.ErrConflict {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "This application has already been reviewed.",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	sendDiscountResponse(d, a)
+	audit(req, "discount."+status, actor, d.Email+" "+a.Kind+" "+body.Template)
+	track("discount."+status, d, map[string]interface{}{"kind": a.Kind, "template": body.Template})
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":      requests.StatusSuccess,
+		"application": a,
+	})
+}
+
+// sendDiscountResponse emails a developer the reply to their application.
+func sendDiscountResponse(d *schemas.Developer, a *db.DiscountApplication) {
+	subject := "Your Bowery discount application"
+	if a.Status == db.DiscountApproved {
+		subject = "Your Bowery discount was approved"
+	}
+
+	message, err := RenderEmail("discount_response_email", map[string]interface{}{
+		"name":     strings.Split(d.Name, " ")[0],
+		"approved": a.Status == db.DiscountApproved,
+		"response": strings.Split(a.Response, "\n\n"),
+	})
+	if err == nil {
+		err = sendEmail(context.Background(), gochimp.Message{
+			Subject:   subject,
+			FromEmail: "support@bowery.io",
+			FromName:  "Bowery Support",
+			To: []gochimp.Recipient{{
+				Email: d.Email,
+				Name:  d.Name,
+			}},
+			Html: message,
+		})
+	}
+	if err != nil {
+		fmt.Println("unable to send discount response to", d.Email, err)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the configuration checks "broome doctor" runs and the server
+// runs before it starts serving: the database and its indexes, Stripe,
+// Mandrill and Mailchimp credentials, the templates and the port. Each
+// failure says what to fix. The server refuses to start if a fatal check
+// fails, the rest are only printed since a provider being down shouldn't
+// keep broome from serving.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/env"
+)
+
+// How long each check that calls out can take.
+const doctorTimeout = 10 * time.Second
+
+// Templates every deployment needs, for errors, signup and payments.
+var requiredTemplates = []string{"layout", "admin_layout", "error", "signup", "pay", "thanks", "password_reset", "receipt_email"}
+
+// doctorCheck is a named check, fatal if the server can't run without it.
+type doctorCheck struct {
+	name  string
+	fatal bool
+	run   func() error
+}
+
+var doctorChecks = []*doctorCheck{
+	{"mongo", true, checkMongo},
+	{"indexes", false, checkIndexes},
+	{"stripe", false, checkStripe},
+	{"mandrill", false, checkMandrill},
+	{"mailchimp", false, checkMailchimp},
+	{"templates", true, checkTemplates},
+	{"port", true, checkPort},
+}
+
+// checkMongo pings the database.
+func checkMongo() error {
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("can't reach MONGO_ADDR %s: %s, check mongod is running and MONGO_USER and MONGO_PASS", env.Current.MongoAddr, err)
+	}
+
+	return nil
+}
+
+// checkIndexes looks for indexes that couldn't be built at startup.
+func checkIndexes() error {
+	missing, err := db.MissingIndexes()
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s, look for duplicate values or build them by hand", strings.Join(missing, "; "))
+	}
+
+	return nil
+}
+
+// checkStripe fetches the balance, which any valid secret key can, and
+// checks the key's mode matches the environment.
+func checkStripe() error {
+	secret, public := env.Current.StripeSecretKey, env.Current.StripePublicKey
+	if strings.HasPrefix(secret, "sk_test_") != strings.HasPrefix(public, "pk_test_") {
+		return errors.New("STRIPE_SECRET_KEY and STRIPE_PUBLIC_KEY are from different modes, use both test or both live keys")
+	}
+
+	var balance struct {
+		Livemode bool `json:"livemode"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	if err := stripeRequest(ctx, "GET", "/balance", nil, "", &balance); err != nil {
+		return fmt.Errorf("STRIPE_SECRET_KEY was refused: %s", redactError(err))
+	}
+	if balance.Livemode && !env.Current.Production {
+		return fmt.Errorf("stripe is in live mode in %s, use test keys", env.Current.Name)
+	}
+	if !balance.Livemode && env.Current.Production {
+		return errors.New("stripe is in test mode in production, use live keys")
+	}
+
+	return nil
+}
+
+// checkMandrill pings Mandrill with the key.
+func checkMandrill() error {
+	if mandrill == nil {
+		return errors.New("MANDRILL_KEY isn't a Mandrill key")
+	}
+	if _, err := mandrill.Ping(); err != nil {
+		return fmt.Errorf("MANDRILL_KEY was refused: %s", err)
+	}
+
+	return nil
+}
+
+// checkMailchimp pings Mailchimp with the key, if there is one.
+func checkMailchimp() error {
+	key := env.Current.MailchimpKey
+	if key == "" {
+		return nil
+	}
+	dc := key[strings.LastIndex(key, "-")+1:]
+	if !strings.Contains(key, "-") || dc == "" {
+		return errors.New("MAILCHIMP_KEY must end in its datacenter, e.g. -us1")
+	}
+
+	body, _ := json.Marshal(map[string]string{"apikey": key})
+	client := &http.Client{Timeout: doctorTimeout}
+	res, err := client.Post("https://"+dc+".api.mailchimp.com/2.0/helper/ping.json", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't reach Mailchimp: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("MAILCHIMP_KEY was refused, Mailchimp responded %s", res.Status)
+	}
+
+	return nil
+}
+
+// checkTemplates makes sure the required templates are there and every
+// template parses.
+func checkTemplates() error {
+	for _, name := range requiredTemplates {
+		if !templateExists(name) {
+			return fmt.Errorf("template %s is missing from %s, deploy the static directory with the binary", name, filepath.Dir(templatePath(name)))
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(templatePath("layout")), "*.html"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".html")
+		if _, err := loadTemplate(name); err != nil {
+			return fmt.Errorf("template %s doesn't parse: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkPort makes sure the server's ports are free, apart from those
+// handed over by an upgrade.
+func checkPort() error {
+	addrs := []string{serverPort()}
+	if httpConfig.ACME {
+		addrs = append(addrs, httpConfig.ACMEAddr)
+	}
+
+	inherited := inheritedListeners()
+	for _, addr := range addrs {
+		if _, ok := inherited[addr]; ok {
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("can't listen on %s: %s, stop whatever is using it or run as a user allowed to bind it", addr, err)
+		}
+		l.Close()
+	}
+
+	return nil
+}
+
+// runChecks runs the checks, printing each result, and returns how many
+// failed and how many of those were fatal.
+func runChecks(w io.Writer, checks []*doctorCheck) (int, int) {
+	failed, fatal := 0, 0
+	for _, c := range checks {
+		err := c.run()
+		if err == nil {
+			fmt.Fprintf(w, "ok   %s\n", c.name)
+			continue
+		}
+
+		failed++
+		level := "warn"
+		if c.fatal {
+			fatal++
+			level = "FAIL"
+		}
+		fmt.Fprintf(w, "%s %s: %s\n", level, c.name, redactString(err.Error()))
+	}
+
+	return failed, fatal
+}
+
+// selfCheck runs the checks before the server starts, failing if a fatal
+// one does.
+func selfCheck() error {
+	if _, fatal := runChecks(os.Stdout, doctorChecks); fatal > 0 {
+		return fmt.Errorf("%d startup checks failed, run broome doctor for details", fatal)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the embeddable signup widget. The form is served in a frame the
+// allowed origins can embed, and results are posted back to the parent page
+// with postMessage.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// validOrigin reports whether origin is just a scheme and host.
+func validOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" &&
+		u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+// embedAllowed reports whether origin may embed the widget.
+func embedAllowed(origin string) bool {
+	for _, allowed := range getSettings().EmbedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// embedPolicy is the content security policy for the widget. Scripts and
+// styles only load from broome, and only origin may frame it.
+func embedPolicy(origin string) string {
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src 'self'",
+		"style-src 'self'",
+		"img-src 'self' https: data:",
+		"connect-src 'self'",
+		"form-action 'self'",
+		"base-uri 'none'",
+		"frame-ancestors " + origin,
+	}, "; ")
+}
+
+// GET /embed/signup, Signup form for embedding, origin is the parent page's origin
+func EmbedSignupHandler(rw http.ResponseWriter, req *http.Request) {
+	origin := req.FormValue("origin")
+	if !validOrigin(origin) || !embedAllowed(origin) {
+		rw.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+		rw.WriteHeader(http.StatusForbidden)
+		RenderTemplate(rw, "error", map[string]string{"Error": "This page can't be embedded here."})
+		return
+	}
+
+	rw.Header().Set("Content-Security-Policy", embedPolicy(origin))
+	rw.Header().Set("Referrer-Policy", "origin")
+	if err := RenderLayout(rw, "embed_layout", "embed_signup", map[string]interface{}{
+		"origin":    origin,
+		"formToken": newFormToken(),
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /theme.css, The theme's css variables, for pages that can't use inline styles
+func ThemeCSSHandler(rw http.ResponseWriter, req *http.Request) {
+	t := getTheme()
+
+	rw.Header().Set("Content-Type", "text/css; charset=utf-8")
+	rw.Header().Set("Cache-Control", "public, max-age=60")
+	// Theme values are validated when saved so they're safe to write as is.
+	fmt.Fprintf(rw, `:root {
+  --primary: %s;
+  --accent: %s;
+  --background: %s;
+  --text: %s;
+  --font: %s;
+}
+body { background: var(--background); color: var(--text); font-family: var(--font); }
+a, h1, h2 { color: var(--primary); }
+.butterbar, button, .btn-submit { background: var(--accent); border-color: var(--accent); }
+`, t.PrimaryColor, t.AccentColor, t.BackgroundColor, t.TextColor, t.Font)
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the integration engineer book of business.
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// bookEntry is a developer assigned to an integration engineer.
+type bookEntry struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Plan         string    `json:"plan"`
+	IsPaid       bool      `json:"isPaid"`
+	Expiration   time.Time `json:"expiration"`
+	LastActivity time.Time `json:"lastActivity"`
+	ChurnRisk    float64   `json:"churnRisk"`
+	Issues       []string  `json:"issues"`
+}
+
+// GET /admin/engineers/{name}/book, Lists an engineer's developers. Filter
+// with plan, inactiveDays and atRisk, and export with format=csv.
+func EngineerBookHandler(rw http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	ds, err := db.GetDevelopersFor(db.ReadReports, tenantFor(req).Scope(bson.M{"integrationEngineer": name}))
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	plan := req.FormValue("plan")
+	atRisk := req.FormValue("atRisk") == "true"
+	inactiveDays, _ := strconv.Atoi(req.FormValue("inactiveDays"))
+
+	book := []*bookEntry{}
+	for _, d := range ds {
+		entry := &bookEntry{
+			ID:         d.ID.Hex(),
+			Name:       d.Name,
+			Email:      d.Email,
+			Plan:       developerPlan(d),
+			IsPaid:     d.IsPaid,
+			Expiration: d.Expiration,
+			Issues:     []string{},
+		}
+		if plan != "" && entry.Plan != plan {
+			continue
+		}
+
+		if e, err := db.GetLastEvent(entry.ID); err == nil {
+			entry.LastActivity = e.CreatedAt
+		}
+		if inactiveDays > 0 && time.Since(entry.LastActivity) < time.Duration(inactiveDays)*24*time.Hour {
+			continue
+		}
+
+		if c, err := db.GetChurnScore(d.ID); err == nil {
+			entry.ChurnRisk = c.Score
+			entry.Issues = c.Signals
+		}
+		if atRisk && entry.ChurnRisk < churnThreshold {
+			continue
+		}
+
+		book = append(book, entry)
+	}
+
+	if req.FormValue("format") == "csv" {
+		writeBookCSV(rw, name, book)
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusFound,
+		"engineer":   name,
+		"developers": book,
+	})
+}
+
+// writeBookCSV writes the book as a CSV download.
+func writeBookCSV(rw http.ResponseWriter, name string, book []*bookEntry) {
+	rw.Header().Set("Content-Type", "text/csv")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		strings.Replace(strings.ToLower(name), " ", "-", -1)+"-book.csv"))
+
+	w := csv.NewWriter(rw)
+	w.Write([]string{"id", "name", "email", "plan", "paid", "expiration", "last activity", "churn risk", "issues"})
+	for _, e := range book {
+		lastActivity := ""
+		if !e.LastActivity.IsZero() {
+			lastActivity = e.LastActivity.Format(time.RFC3339)
+		}
+
+		w.Write([]string{
+			e.ID,
+			e.Name,
+			e.Email,
+			e.Plan,
+			strconv.FormatBool(e.IsPaid),
+			e.Expiration.Format(time.RFC3339),
+			lastActivity,
+			strconv.FormatFloat(e.ChurnRisk, 'f', 2, 64),
+			strings.Join(e.Issues, "; "),
+		})
+	}
+	w.Flush()
+}
@@ -0,0 +1,331 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the cached entitlement checks used by other services.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// How long an entitlement is served from cache.
+	entitlementTTL = 30 * time.Second
+
+	// Most tokens looked up in a single entitlements request.
+	maxEntitlementBatch = 100
+
+	// Most tokens validated in a single bulk validation request.
+	maxValidateBatch = 1000
+
+	// How far before the last invalidation seen each sync reads from, so
+	// invalidations from instances with a clock behind ours aren't missed.
+	invalidationOverlap = 30 * time.Second
+)
+
+// entitlement is what other services need to know about a token.
+type entitlement struct {
+	Valid       bool      `json:"valid"`
+	DeveloperID string    `json:"developerId,omitempty"`
+	Paid        bool      `json:"paid"`
+	Lifecycle   string    `json:"lifecycle,omitempty"`
+	Limited     bool      `json:"limited,omitempty"`
+	Plan        string    `json:"plan,omitempty"`
+	Expiration  time.Time `json:"expiration,omitempty"`
+	Features    []string  `json:"features,omitempty"`
+	cachedAt    time.Time
+}
+
+// entitlementCache holds entitlements by token. Invalidations are read from
+// cursor, the newest seen, less the overlap, and seen holds the ones already
+// applied in that window so they aren't applied twice.
+type entitlementCache struct {
+	mutex   sync.RWMutex
+	entries map[string]*entitlement
+	cursor  bson.ObjectId
+	seen    map[bson.ObjectId]bool
+}
+
+var entitlements = &entitlementCache{entries: map[string]*entitlement{}, cursor: bson.NewObjectId()}
+
+func newEntitlement(d *schemas.Developer, lifecycle string) *entitlement {
+	// Paused developers keep their account but not what they pay for.
+	if lifecycle == db.LifecyclePaused {
+		return &entitlement{
+			Valid:       true,
+			DeveloperID: d.ID.Hex(),
+			Lifecycle:   lifecycle,
+			Limited:     true,
+			Plan:        "free",
+			Expiration:  d.Expiration,
+			cachedAt:    time.Now(),
+		}
+	}
+
+	return &entitlement{
+		Valid:       true,
+		DeveloperID: d.ID.Hex(),
+		Paid:        d.IsPaid,
+		Lifecycle:   lifecycle,
+		Plan:        developerPlan(d),
+		Expiration:  d.Expiration,
+		Features:    developerFeatures(d),
+		cachedAt:    time.Now(),
+	}
+}
+
+// get returns the cached entitlement if it hasn't expired.
+func (c *entitlementCache) get(token string) (*entitlement, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	e, ok := c.entries[token]
+	if !ok || time.Since(e.cachedAt) > entitlementTTL {
+		return nil, false
+	}
+
+	return e, true
+}
+
+func (c *entitlementCache) set(token string, e *entitlement) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[token] = e
+}
+
+// invalidate drops a token, used when a developer's token or billing
+// changes so the next check reads from the database. Other instances drop it
+// the next time they sync invalidations.
+func (c *entitlementCache) invalidate(token string) {
+	c.drop(token)
+
+	if err := db.SaveInvalidation("entitlements", token); err != nil {
+		fmt.Println("unable to share entitlement invalidation", err)
+	}
+}
+
+func (c *entitlementCache) drop(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, token)
+}
+
+// syncInvalidations drops tokens invalidated by any instance since the last
+// sync.
+func (c *entitlementCache) syncInvalidations() error {
+	from := bson.NewObjectIdWithTime(c.cursor.Time().Add(-invalidationOverlap))
+	is, err := db.GetInvalidations("entitlements", from)
+	if err != nil {
+		return err
+	}
+
+	seen := map[bson.ObjectId]bool{}
+	for _, i := range is {
+		seen[i.ID] = true
+		if !c.seen[i.ID] {
+			c.drop(i.Key)
+		}
+		if i.ID > c.cursor {
+			c.cursor = i.ID
+		}
+	}
+	c.seen = seen
+
+	return nil
+}
+
+// prune removes expired entries.
+func (c *entitlementCache) prune() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for token, e := range c.entries {
+		if time.Since(e.cachedAt) > entitlementTTL {
+			delete(c.entries, token)
+		}
+	}
+}
+
+// lookup returns entitlements for the tokens, reading any misses from the
+// database in a single query.
+func (c *entitlementCache) lookup(tokens []string) (map[string]*entitlement, error) {
+	res := map[string]*entitlement{}
+	missing := []string{}
+	for _, token := range tokens {
+		// Silent signups have no token, so an empty one must never match.
+		if token == "" {
+			res[token] = &entitlement{Valid: false}
+			continue
+		}
+
+		if e, ok := c.get(token); ok {
+			res[token] = e
+			continue
+		}
+
+		missing = append(missing, token)
+	}
+
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	ds, err := db.GetDevelopersByTokens(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]bson.ObjectId, 0, len(ds))
+	for _, d := range ds {
+		ids = append(ids, d.ID)
+	}
+	lifecycles, err := db.GetLifecycles(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for token, d := range ds {
+		e := newEntitlement(d, lifecycles[d.ID])
+		c.set(token, e)
+		res[token] = e
+	}
+
+	// Cache invalid tokens too so bad callers don't reach the database.
+	for _, token := range missing {
+		if _, ok := res[token]; !ok {
+			e := &entitlement{Valid: false, cachedAt: time.Now()}
+			c.set(token, e)
+			res[token] = e
+		}
+	}
+
+	return res, nil
+}
+
+func init() {
+	scheduleEveryInstance("sync-entitlements", 2*time.Second, entitlements.syncInvalidations)
+
+	go func() {
+		for _ = range time.Tick(entitlementTTL) {
+			entitlements.prune()
+		}
+	}()
+}
+
+// GET /entitlements?token=..., Returns whether tokens are valid and paid.
+// Multiple tokens can be given as repeated or comma separated values.
+func EntitlementsHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	tokens := []string{}
+	for _, val := range req.Form["token"] {
+		for _, token := range strings.Split(val, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	if len(tokens) == 0 || len(tokens) > maxEntitlementBatch {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Between 1 and 100 tokens required.",
+		})
+		return
+	}
+
+	res, err := entitlements.lookup(tokens)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if len(tokens) == 1 {
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status":      requests.StatusFound,
+			"entitlement": res[tokens[0]],
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusFound,
+		"entitlements": res,
+	})
+}
+
+// POST /developers/tokens/validate, Validates up to 1000 tokens at once so
+// gateways can warm their caches.
+func ValidateTokensHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Tokens []string `json:"tokens"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if len(body.Tokens) == 0 || len(body.Tokens) > maxValidateBatch {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Between 1 and 1000 tokens required.",
+		})
+		return
+	}
+
+	res, err := entitlements.lookup(body.Tokens)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	type result struct {
+		Token       string `json:"token"`
+		Valid       bool   `json:"valid"`
+		DeveloperID string `json:"developerId,omitempty"`
+		Plan        string `json:"plan,omitempty"`
+	}
+
+	results := make([]*result, len(body.Tokens))
+	for i, token := range body.Tokens {
+		e := res[token]
+		results[i] = &result{
+			Token:       token,
+			Valid:       e.Valid,
+			DeveloperID: e.DeveloperID,
+			Plan:        e.Plan,
+		}
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusSuccess,
+		"results": results,
+	})
+}
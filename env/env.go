@@ -0,0 +1,175 @@
+// Copyright 2014 Bowery, Inc.
+// Package env holds the key sets for each named environment broome can run
+// in. The environment is picked with ENV and individual keys can be
+// overridden with environment variables, e.g. MONGO_ADDR or STRIPE_SECRET_KEY.
+package env
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Bowery/gopackages/config"
+)
+
+// Environment names.
+const (
+	Development = "development"
+	Testing     = "testing"
+	Staging     = "staging"
+	Production  = "production"
+)
+
+// Hosts of the production database, test keys must never be used against it.
+const productionMongo = "ec2-54-166-124-190.compute-1.amazonaws.com,ec2-54-211-48-143.compute-1.amazonaws.com,ec2-54-87-106-210.compute-1.amazonaws.com"
+
+// KeySet is everything that differs between environments.
+type KeySet struct {
+	Name            string
+	Production      bool
+	MongoAddr       string
+	MongoUser       string
+	MongoPass       string
+	StripeSecretKey string
+	StripePublicKey string
+	MailchimpKey    string
+	MandrillKey     string
+	SlackToken      string
+	StatHatKey      string
+}
+
+// Current is the key set for the environment in ENV, defaulting to
+// development.
+var Current *KeySet
+
+var keySets = map[string]*KeySet{
+	Development: {
+		Name:            Development,
+		MongoAddr:       "localhost:27017",
+		StripeSecretKey: config.StripeTestSecretKey,
+		StripePublicKey: config.StripeTestPublicKey,
+		MailchimpKey:    config.MailchimpKey,
+		MandrillKey:     config.MandrillKey,
+		SlackToken:      config.SlackToken,
+		StatHatKey:      config.StatHatKey,
+	},
+	Testing: {
+		Name:            Testing,
+		MongoAddr:       "localhost:27017",
+		StripeSecretKey: config.StripeTestSecretKey,
+		StripePublicKey: config.StripeTestPublicKey,
+		MailchimpKey:    config.MailchimpKey,
+		MandrillKey:     config.MandrillKey,
+		SlackToken:      config.SlackToken,
+		StatHatKey:      config.StatHatKey,
+	},
+	// Staging has no database of its own checked in, MONGO_ADDR must be set.
+	Staging: {
+		Name:            Staging,
+		StripeSecretKey: config.StripeTestSecretKey,
+		StripePublicKey: config.StripeTestPublicKey,
+		MailchimpKey:    config.MailchimpKey,
+		MandrillKey:     config.MandrillKey,
+		SlackToken:      config.SlackToken,
+		StatHatKey:      config.StatHatKey,
+	},
+	Production: {
+		Name:            Production,
+		Production:      true,
+		MongoAddr:       productionMongo,
+		MongoUser:       "bowery",
+		MongoPass:       "java$cript",
+		StripeSecretKey: config.StripeLiveSecretKey,
+		StripePublicKey: config.StripeLivePublicKey,
+		MailchimpKey:    config.MailchimpKey,
+		MandrillKey:     config.MandrillKey,
+		SlackToken:      config.SlackToken,
+		StatHatKey:      config.StatHatKey,
+	},
+}
+
+func init() {
+	name := os.Getenv("ENV")
+	if name == "" {
+		name = Development
+	}
+
+	Current = Load(name)
+}
+
+// Load returns the key set for name with any overrides from the environment
+// applied. Unknown names get an empty key set which fails Verify.
+func Load(name string) *KeySet {
+	k := &KeySet{Name: name}
+	if base, ok := keySets[name]; ok {
+		copied := *base
+		k = &copied
+	}
+
+	for variable, dest := range map[string]*string{
+		"MONGO_ADDR":        &k.MongoAddr,
+		"MONGO_USER":        &k.MongoUser,
+		"MONGO_PASS":        &k.MongoPass,
+		"STRIPE_SECRET_KEY": &k.StripeSecretKey,
+		"STRIPE_PUBLIC_KEY": &k.StripePublicKey,
+		"MAILCHIMP_KEY":     &k.MailchimpKey,
+		"MANDRILL_KEY":      &k.MandrillKey,
+		"SLACK_TOKEN":       &k.SlackToken,
+		"STATHAT_KEY":       &k.StatHatKey,
+	} {
+		if val := os.Getenv(variable); val != "" {
+			*dest = val
+		}
+	}
+
+	return k
+}
+
+// Verify checks the key set is complete and that test and live keys aren't
+// mixed with the wrong database.
+func (k *KeySet) Verify() error {
+	if _, ok := keySets[k.Name]; !ok {
+		return fmt.Errorf("unknown environment %q", k.Name)
+	}
+
+	missing := []string{}
+	for key, val := range map[string]string{
+		"MONGO_ADDR":        k.MongoAddr,
+		"STRIPE_SECRET_KEY": k.StripeSecretKey,
+		"STRIPE_PUBLIC_KEY": k.StripePublicKey,
+		"MANDRILL_KEY":      k.MandrillKey,
+	} {
+		if val == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s is missing %s", k.Name, strings.Join(missing, ", "))
+	}
+
+	testKey := strings.HasPrefix(k.StripeSecretKey, "sk_test_")
+	if testKey && (k.Production || k.UsesProductionDB()) {
+		return errors.New("stripe test keys can't be used against the production database")
+	}
+	if strings.HasPrefix(k.StripeSecretKey, "sk_live_") && !k.Production {
+		return errors.New("stripe live keys can only be used in production")
+	}
+	if k.UsesProductionDB() && !k.Production {
+		return errors.New(k.Name + " can't use the production database")
+	}
+
+	return nil
+}
+
+// UsesProductionDB reports whether the key set points at the production
+// database.
+func (k *KeySet) UsesProductionDB() bool {
+	for _, host := range strings.Split(productionMongo, ",") {
+		if strings.Contains(k.MongoAddr, host) {
+			return true
+		}
+	}
+
+	return false
+}
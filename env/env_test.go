@@ -0,0 +1,57 @@
+// Copyright 2014 Bowery, Inc.
+package env
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadOverrides(t *testing.T) {
+	os.Setenv("MONGO_ADDR", "mongo.staging:27017")
+	defer os.Setenv("MONGO_ADDR", "")
+
+	k := Load(Staging)
+	if k.MongoAddr != "mongo.staging:27017" {
+		t.Error("MONGO_ADDR should override the key set:", k.MongoAddr)
+	}
+	if keySets[Staging].MongoAddr != "" {
+		t.Error("Overrides shouldn't modify the built in key sets.")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	k := &KeySet{
+		Name:            Staging,
+		MongoAddr:       "mongo.staging:27017",
+		StripeSecretKey: "sk_test_123",
+		StripePublicKey: "pk_test_123",
+		MandrillKey:     "mandrill",
+	}
+	if err := k.Verify(); err != nil {
+		t.Fatal("Valid key set failed verification:", err)
+	}
+
+	unknown := *k
+	unknown.Name = "qa"
+	if err := unknown.Verify(); err == nil {
+		t.Error("Unknown environments should fail verification.")
+	}
+
+	missing := *k
+	missing.MongoAddr = ""
+	if err := missing.Verify(); err == nil {
+		t.Error("Missing keys should fail verification.")
+	}
+
+	testOnProd := *k
+	testOnProd.MongoAddr = productionMongo
+	if err := testOnProd.Verify(); err == nil {
+		t.Error("Test keys against the production database should fail verification.")
+	}
+
+	liveOffProd := *k
+	liveOffProd.StripeSecretKey = "sk_live_123"
+	if err := liveOffProd.Verify(); err == nil {
+		t.Error("Live keys outside production should fail verification.")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2014 Bowery, Inc.
+// Contains analytics event tracking and forwarding to Keen.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Most events sent to Keen in one request.
+	eventBatchSize = 500
+
+	// Default and max number of events returned by the admin endpoint.
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+)
+
+var (
+	keenURL       = "https://api.keen.io/3.0/projects/"
+	keenProjectID = os.Getenv("KEEN_PROJECT_ID")
+	keenWriteKey  = os.Getenv("KEEN_WRITE_KEY")
+
+	// Only one forward runs at a time so events aren't sent twice, the
+	// database lock keeps other instances out too.
+	forwarding = make(chan struct{}, 1)
+)
+
+func init() {
+	schedule("forward-events", time.Minute, forwardEvents)
+}
+
+// track stores an event locally and forwards it in the background. Storing
+// first means an analytics outage never loses events.
+func track(name string, d *schemas.Developer, properties map[string]interface{}) {
+	e := &db.Event{Name: name, Properties: redactMap(properties)}
+	if d != nil {
+		e.DeveloperID = d.ID.Hex()
+	}
+
+	if err := db.SaveEvent(e); err != nil {
+		fmt.Println("unable to save event", name, err)
+		return
+	}
+
+	go forwardEvents()
+}
+
+// forwardEvents sends unforwarded events to Keen, marking them once Keen
+// accepts them. Events are kept locally if Keen isn't configured or is down.
+func forwardEvents() error {
+	if keenProjectID == "" || keenWriteKey == "" {
+		return nil
+	}
+
+	select {
+	case forwarding <- struct{}{}:
+		defer func() { <-forwarding }()
+	default:
+		return nil
+	}
+
+	locked, err := db.AcquireLock("forward-events", instanceID, time.Minute)
+	if err != nil || !locked {
+		return err
+	}
+	defer db.ReleaseLock("forward-events", instanceID)
+
+	es, err := db.GetUnforwardedEvents(eventBatchSize)
+	if err != nil || len(es) == 0 {
+		return err
+	}
+
+	batch := map[string][]map[string]interface{}{}
+	ids := []bson.ObjectId{}
+	for _, e := range es {
+		props := map[string]interface{}{}
+		for k, v := range e.Properties {
+			props[k] = v
+		}
+		props["developerId"] = e.DeveloperID
+		props["keen"] = map[string]interface{}{"timestamp": e.CreatedAt.UTC().Format(time.RFC3339)}
+
+		batch[e.Name] = append(batch[e.Name], props)
+		ids = append(ids, e.ID)
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", keenURL+keenProjectID+"/events", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", keenWriteKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	err = callDependency(context.Background(), "keen", connectError, func() error {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode >= 300 {
+			return fmt.Errorf("keen responded with %d", res.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.MarkEventsForwarded(ids)
+}
+
+// GET /admin/events, Lists local events filtered by name, developer and time
+func AdminEventsHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if name := req.FormValue("name"); name != "" {
+		query["name"] = name
+	}
+	if developer := req.FormValue("developer"); developer != "" {
+		query["developerId"] = developer
+	}
+
+	created := bson.M{}
+	for field, op := range map[string]string{"since": "$gte", "until": "$lt"} {
+		val := req.FormValue(field)
+		if val == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "invalid " + field,
+			})
+			return
+		}
+		created[op] = t
+	}
+	if len(created) > 0 {
+		query["createdAt"] = created
+	}
+
+	limit := defaultEventLimit
+	if l, err := strconv.Atoi(req.FormValue("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxEventLimit {
+		limit = maxEventLimit
+	}
+
+	es, err := db.GetEvents(query, limit)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"events": es,
+	})
+}
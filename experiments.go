@@ -0,0 +1,253 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the A/B testing routes and helpers for signup and pricing conversion.
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Cookie identifying a visitor across experiment exposures.
+const visitorCookie = "broome_visitor"
+
+// visitorID returns the visitor id for the request, setting a new cookie if
+// the visitor hasn't been seen before.
+func visitorID(rw http.ResponseWriter, req *http.Request) string {
+	if cookie, err := req.Cookie(visitorCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	id := uuid.New()
+	http.SetCookie(rw, &http.Cookie{
+		Name:    visitorCookie,
+		Value:   id,
+		Path:    "/",
+		Expires: time.Now().Add(time.Hour * 24 * 365),
+	})
+
+	return id
+}
+
+// assignVariant deterministically picks a variant for the visitor, so the
+// same visitor always sees the same template.
+func assignVariant(e *db.Experiment, visitor string) string {
+	if len(e.Variants) == 0 {
+		return ""
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + visitor))
+	return e.Variants[h.Sum32()%uint32(len(e.Variants))]
+}
+
+// experimentPages lists the pages that can be experimented on, and for each
+// the templates its variants may render. Variants are only ever looked up
+// here, never built into a template path from stored data.
+var experimentPages = map[string]map[string]string{
+	"signup": {
+		"control": "signup",
+		"compact": "signup_compact",
+	},
+	"pricing": {
+		"control": "plans",
+		"compact": "plans_compact",
+	},
+}
+
+// experimentTemplate returns the template to render for the page, recording
+// an exposure for the first active experiment on it. Unknown pages and
+// variants render the page's control template.
+func experimentTemplate(rw http.ResponseWriter, req *http.Request, page string) string {
+	templates, ok := experimentPages[page]
+	if !ok {
+		return page
+	}
+	control := templates["control"]
+
+	e, err := db.GetExperiment(bson.M{"template": page, "active": true})
+	if err != nil {
+		return control
+	}
+
+	visitor := visitorID(rw, req)
+	variant := assignVariant(e, visitor)
+	name, ok := templates[variant]
+	if !ok {
+		return control
+	}
+
+	go db.RecordExperimentEvent(&db.ExperimentEvent{
+		Experiment: e.Name,
+		Variant:    variant,
+		Visitor:    visitor,
+		Kind:       db.EventExposure,
+	})
+
+	return name
+}
+
+// recordConversion marks the visitor as converted for every active
+// experiment on the template they were exposed to.
+func recordConversion(req *http.Request, name string) {
+	cookie, err := req.Cookie(visitorCookie)
+	if err != nil || cookie.Value == "" {
+		return
+	}
+
+	es, err := db.GetExperiments(bson.M{"template": name, "active": true})
+	if err != nil {
+		return
+	}
+
+	for _, e := range es {
+		variant, err := db.GetVisitorVariant(e.Name, cookie.Value)
+		if err != nil {
+			continue
+		}
+
+		db.RecordExperimentEvent(&db.ExperimentEvent{
+			Experiment: e.Name,
+			Variant:    variant,
+			Visitor:    cookie.Value,
+			Kind:       db.EventConversion,
+		})
+	}
+}
+
+// GET /admin/experiments, Lists experiments and their results
+func ExperimentsHandler(rw http.ResponseWriter, req *http.Request) {
+	es, err := db.GetExperiments(bson.M{})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	type report struct {
+		*db.Experiment
+		Results []*db.VariantResult
+	}
+
+	reports := []*report{}
+	for _, e := range es {
+		results, err := db.ExperimentResults(e)
+		if err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+
+		reports = append(reports, &report{Experiment: e, Results: results})
+	}
+
+	if err := RenderAdminTemplate(rw, "experiments", map[string]interface{}{
+		"Experiments": reports,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// POST /admin/experiments, Creates a new experiment
+func CreateExperimentHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	variants := []string{}
+	for _, v := range strings.Split(req.FormValue("variants"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			variants = append(variants, v)
+		}
+	}
+
+	name := req.FormValue("name")
+	template := req.FormValue("template")
+	if name == "" || template == "" || len(variants) < 2 {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Name, Template and at least two Variants Required.",
+		})
+		return
+	}
+
+	templates, ok := experimentPages[template]
+	if !ok {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Template must be signup or pricing.",
+		})
+		return
+	}
+	for _, v := range variants {
+		if _, ok := templates[v]; !ok {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "Unknown variant " + v + " for " + template + ".",
+			})
+			return
+		}
+	}
+
+	if _, err := db.GetExperiment(bson.M{"name": name}); err == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "experiment already exists",
+		})
+		return
+	}
+
+	e := &db.Experiment{
+		Name:     name,
+		Template: template,
+		Variants: variants,
+		Active:   true,
+	}
+	if err := db.SaveExperiment(e); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusCreated,
+		"experiment": e,
+	})
+}
+
+// PUT /admin/experiments/{name}, Starts or stops an experiment
+func UpdateExperimentHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	active := req.FormValue("active")
+	update := map[string]interface{}{"active": active == "on" || active == "true"}
+	if err := db.UpdateExperiment(bson.M{"name": mux.Vars(req)["name"]}, update); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"update": update,
+	})
+}
@@ -25,7 +25,7 @@ def restart():
 
     sudo('cp -f ' + project + '.conf /etc/init/' + project + '.conf')
     sudo('initctl reload-configuration')
-    sudo('restart ' + project)
+    sudo('reload ' + project)
 
 def deploy():
   execute(restart, hosts=hosts)
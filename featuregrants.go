@@ -0,0 +1,67 @@
+// Copyright 2014 Bowery, Inc.
+// Contains feature grants, feature flags turned on for single developers.
+// Grants are few so every instance keeps them all, reloading them on an
+// interval like suspensions.
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"labix.org/v2/mgo/bson"
+)
+
+// How often each instance reloads the feature grants.
+const featureGrantReloadInterval = 15 * time.Second
+
+// grantedFeatures holds the features granted to each developer.
+type grantedFeatures struct {
+	sync.RWMutex
+	byDeveloper map[bson.ObjectId][]string
+}
+
+var featureGrants = &grantedFeatures{byDeveloper: map[bson.ObjectId][]string{}}
+
+func init() {
+	scheduleEveryInstance("reload-feature-grants", featureGrantReloadInterval, reloadFeatureGrants)
+}
+
+// reloadFeatureGrants replaces the granted features with the database's.
+func reloadFeatureGrants() error {
+	gs, err := db.GetFeatureGrants(time.Now())
+	if err != nil {
+		return err
+	}
+
+	byDeveloper := map[bson.ObjectId][]string{}
+	for _, g := range gs {
+		byDeveloper[g.DeveloperID] = append(byDeveloper[g.DeveloperID], g.Feature)
+	}
+
+	featureGrants.Lock()
+	featureGrants.byDeveloper = byDeveloper
+	featureGrants.Unlock()
+	return nil
+}
+
+// add records a grant on this instance ahead of the next reload.
+func (f *grantedFeatures) add(id bson.ObjectId, feature string) {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, name := range f.byDeveloper[id] {
+		if name == feature {
+			return
+		}
+	}
+	f.byDeveloper[id] = append(f.byDeveloper[id], feature)
+}
+
+// get returns the features granted to a developer.
+func (f *grantedFeatures) get(id bson.ObjectId) []string {
+	f.RLock()
+	defer f.RUnlock()
+
+	return f.byDeveloper[id]
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for NPS and feedback collection.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"labix.org/v2/mgo/bson"
+)
+
+// feedbackReq is the body clients send with a response.
+type feedbackReq struct {
+	Token   string `json:"token"`
+	Score   int    `json:"score"`
+	Comment string `json:"comment"`
+}
+
+// surveyPeriod returns the quarter t falls in, e.g. "2014-Q4". Developers
+// are surveyed at most once per period.
+func surveyPeriod(t time.Time) string {
+	return fmt.Sprintf("%d-Q%d", t.Year(), (int(t.Month())-1)/3+1)
+}
+
+// POST /feedback, Records an NPS score and comment for the developer
+func FeedbackHandler(rw http.ResponseWriter, req *http.Request) {
+	var body feedbackReq
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if body.Score < 0 || body.Score > 10 {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Score must be between 0 and 10.",
+		})
+		return
+	}
+
+	d, err := tenantForToken(req, body.Token).GetDeveloper(bson.M{"token": body.Token})
+	if err != nil || body.Token == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Invalid Token.",
+		})
+		return
+	}
+
+	f := &db.Feedback{
+		DeveloperID: d.ID,
+		Email:       d.Email,
+		Period:      surveyPeriod(time.Now()),
+		Score:       body.Score,
+		Comment:     body.Comment,
+	}
+	created, err := db.SaveFeedback(f)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if created && os.Getenv("ENV") == "production" {
+		go notifySlack(slackChannel("activity"), fmt.Sprintf("%s rated us %d/10: %s",
+			d.Email, f.Score, f.Comment))
+	}
+
+	status := requests.StatusCreated
+	if !created {
+		status = requests.StatusUpdated
+	}
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   status,
+		"feedback": f,
+	})
+}
+
+// GET /admin/feedback, NPS trend and recent comments
+func AdminFeedbackHandler(rw http.ResponseWriter, req *http.Request) {
+	results, err := db.GetNPSResults()
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	recent, err := db.GetFeedback(bson.M{"comment": bson.M{"$ne": ""}}, 50)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	type trend struct {
+		*db.NPSResult
+		NPS   int
+		Width int
+	}
+
+	trends := []*trend{}
+	for _, r := range results {
+		nps := r.NPS()
+		// Bars are drawn from -100 to 100 on a 0 to 100 percent scale.
+		trends = append(trends, &trend{NPSResult: r, NPS: nps, Width: (nps + 100) / 2})
+	}
+
+	if err := RenderAdminTemplate(rw, "feedback", map[string]interface{}{
+		"Trends": trends,
+		"Recent": recent,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2014 Bowery, Inc.
+// Contains single field edits for the admin developer page, so fields can be
+// edited inline. Each edit sends the developer's revision and fails if
+// someone else edited them since.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// maxTextField keeps names and engineers to a line on the admin page.
+const maxTextField = 100
+
+// developerField is a field that can be edited on its own. Key is where
+// it's stored and Parse validates a value sent for it.
+type developerField struct {
+	Key   string
+	Parse func(value interface{}) (interface{}, error)
+}
+
+var developerFields = map[string]*developerField{
+	"name":                {"name", parseTextField(maxTextField, true)},
+	"email":               {"email", parseEmailField},
+	"integrationEngineer": {"integrationEngineer", parseTextField(maxTextField, false)},
+	"isAdmin":             {"isAdmin", parseBoolField},
+	"isPaid":              {"isPaid", parseBoolField},
+	"expiration":          {"expiration", parseTimeField},
+	"poNumber":            {"invoice.poNumber", parseTextField(maxPONumber, false)},
+	"invoiceMemo":         {"invoice.memo", parseTextField(maxInvoiceMemo, false)},
+}
+
+// parseTextField returns a parser for strings up to max characters.
+func parseTextField(max int, required bool) func(value interface{}) (interface{}, error) {
+	return func(value interface{}) (interface{}, error) {
+		str, ok := value.(string)
+		if !ok {
+			return nil, errors.New("must be text")
+		}
+		str = strings.TrimSpace(str)
+		if required && str == "" {
+			return nil, errors.New("is required")
+		}
+		if len(str) > max {
+			return nil, fmt.Errorf("must be at most %d characters", max)
+		}
+		return str, nil
+	}
+}
+
+func parseEmailField(value interface{}) (interface{}, error) {
+	str, _ := value.(string)
+	addr, err := mail.ParseAddress(strings.TrimSpace(str))
+	if err != nil {
+		return nil, errors.New("must be an email address")
+	}
+	return addr.Address, nil
+}
+
+// parseBoolField takes booleans, and "on" from checkboxes.
+func parseBoolField(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if v == "on" || v == "true" {
+			return true, nil
+		}
+		if v == "" || v == "off" || v == "false" {
+			return false, nil
+		}
+	}
+	return nil, errors.New("must be true or false")
+}
+
+// parseTimeField takes RFC3339 times or dates.
+func parseTimeField(value interface{}) (interface{}, error) {
+	str, _ := value.(string)
+	str = strings.TrimSpace(str)
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", str); err == nil {
+		return t, nil
+	}
+	return nil, errors.New("must be a date or RFC3339 time")
+}
+
+// PATCH /admin/developers/{id}/{field}, Sets one field if the developer is still at the revision sent
+func UpdateDeveloperFieldHandler(rw http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["field"]
+	field, ok := developerFields[name]
+	if !ok {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "unknown field " + name,
+		})
+		return
+	}
+
+	var body struct {
+		Value    interface{} `json:"value"`
+		Revision int         `json:"revision"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	value, err := field.Parse(body.Value)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  name + " " + err.Error() + ".",
+		})
+		return
+	}
+
+	d, err := adminDeveloper(req)
+	if err == nil && name == "email" && value != d.Email {
+		if _, err = tenantFor(req).GetDeveloper(bson.M{"email": value}); err == nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "email already exists",
+			})
+			return
+		} else if err == db.ErrNotFound {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = db.UpdateDeveloperField(d.ID, body.Revision, field.Key, value)
+	}
+	if err == db.ErrConflict {
+		revision, _ := db.GetDeveloperRevision(d.ID)
+		renderer.JSON(rw, http.StatusConflict, map[string]interface{}{
+			"status":   requests.StatusFailed,
+			"error":    "Someone else edited this developer, reload to see their changes.",
+			"revision": revision,
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	entitlements.invalidate(d.Token)
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "developer.field_updated", actor, d.Email+": "+name)
+	if email, ok := value.(string); ok && name == "email" && email != d.Email {
+		previous := d.Email
+		d.Email = email
+		securityEvent(req, d, securityEmailChanged, actor, previous+" to "+email, map[string]interface{}{
+			"previousEmail": previous,
+			"email":         email,
+		})
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusUpdated,
+		"field":    name,
+		"value":    value,
+		"revision": body.Revision + 1,
+	})
+}
@@ -0,0 +1,318 @@
+// Copyright 2014 Bowery, Inc.
+// Contains gift codes, prepaid months of the paid plan admins generate and
+// developers redeem at /redeem without a card. Developers who are already
+// paying get the months as credit on their Stripe balance instead, or added
+// to their expiration if they've no Stripe customer to credit.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Characters codes are made of, without ones easily mistaken for
+	// another.
+	giftCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+	// Characters in a code, shown in groups of four.
+	giftCodeLength = 12
+
+	// Most codes generated at once, and months one can be for.
+	maxGiftCodeBatch  = 500
+	maxGiftCodeMonths = 24
+
+	// Days a code can be redeemed for unless it's given an expiry.
+	defaultGiftCodeDays = 365
+
+	// Codes listed on the admin page.
+	giftCodePageLimit = 200
+)
+
+// newGiftCode returns a random code, e.g. ABCD-EFGH-JKLM.
+func newGiftCode() (string, error) {
+	b := make([]byte, giftCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = giftCodeAlphabet[int(b[i])%len(giftCodeAlphabet)]
+	}
+
+	return normalizeGiftCode(string(b)), nil
+}
+
+// normalizeGiftCode returns a code as it's stored, upper case in groups of
+// four, however it was typed.
+func normalizeGiftCode(code string) string {
+	chars := []rune{}
+	for _, c := range strings.ToUpper(code) {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			if len(chars) > 0 && len(chars)%5 == 4 {
+				chars = append(chars, '-')
+			}
+			chars = append(chars, c)
+		}
+	}
+
+	return string(chars)
+}
+
+// creditGiftCode puts a code's months on a developer's Stripe balance. The
+// code is the idempotency key so a retried redemption can't credit twice.
+func creditGiftCode(ctx context.Context, d *schemas.Developer, g *db.GiftCode) error {
+	customer, err := db.GetStripeCustomer(d.ID, db.BillingCredit)
+	if err != nil {
+		return err
+	}
+	plan, err := db.GetPlan(db.PlanBowery)
+	if err != nil {
+		return err
+	}
+	g.CreditAmount = plan.Amount * int64(g.Months)
+	g.Currency = plan.Currency
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	params := url.Values{
+		"amount":             {fmt.Sprint(-g.CreditAmount)},
+		"currency":           {g.Currency},
+		"description":        {fmt.Sprintf("Gift code %s for %d months", g.Code, g.Months)},
+		"metadata[giftCode]": {g.Code},
+	}
+	return callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/customers/"+url.PathEscape(customer)+"/balance_transactions", params, "gift-code-"+g.Code, &result)
+	})
+}
+
+// redeemGiftCode applies a claimed code to a developer: paid months for
+// those who aren't paying, and credit for those who are.
+func redeemGiftCode(ctx context.Context, d *schemas.Developer, g *db.GiftCode) error {
+	state, err := developerLifecycle(d)
+	if err != nil {
+		return err
+	}
+	hasCustomer, err := db.HasStripeCustomer(d.ID)
+	if err != nil {
+		return err
+	}
+
+	paying := state == db.LifecycleActive || state == db.LifecyclePaused
+	switch {
+	case paying && hasCustomer:
+		g.Outcome = db.GiftCredited
+		err = creditGiftCode(ctx, d, g)
+	case paying:
+		g.Outcome = db.GiftExtended
+		d.Expiration = d.Expiration.AddDate(0, g.Months, 0)
+		err = transitionDeveloper(d, state, bson.M{"expiration": d.Expiration})
+	default:
+		g.Outcome = db.GiftActivated
+		if now := developerNow(d.ID); d.Expiration.Before(now) {
+			d.Expiration = now
+		}
+		d.Expiration = d.Expiration.AddDate(0, g.Months, 0)
+		d.IsPaid = true
+		err = transitionDeveloper(d, db.LifecycleActive, bson.M{"isPaid": true, "expiration": d.Expiration})
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.FinishGiftCode(g)
+}
+
+// GET /redeem, Renders the form for redeeming a gift code
+func RedeemHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := RenderTemplate(rw, "redeem", map[string]interface{}{
+		"Code": normalizeGiftCode(req.FormValue("code")),
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// POST /redeem, Redeems a gift code for the developer signing in with it
+func RedeemGiftCodeHandler(rw http.ResponseWriter, req *http.Request) {
+	code := normalizeGiftCode(req.PostFormValue("code"))
+	email := strings.TrimSpace(req.PostFormValue("email"))
+	if code == "" || email == "" {
+		RenderTemplate(rw, "error", map[string]string{"Error": "A code, email and password are required."})
+		return
+	}
+
+	d, err := tenantFor(req).GetDeveloper(bson.M{"email": email})
+	if err == nil && util.HashPassword(req.PostFormValue("password"), d.Salt) != d.Password {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": "Incorrect email or password."})
+		return
+	}
+
+	g, err := db.ClaimGiftCode(code, d.ID, time.Now())
+	if err == db.ErrNotFound {
+		RenderTemplate(rw, "error", map[string]string{"Error": "There's no such code."})
+		return
+	}
+	if err == db.ErrConflict {
+		RenderTemplate(rw, "error", map[string]string{"Error": "This code has already been used or has expired."})
+		return
+	}
+	if err == nil {
+		err = redeemGiftCode(req.Context(), d, g)
+		if err != nil {
+			if rerr := db.ReleaseGiftCode(g); rerr != nil {
+				fmt.Println("unable to release gift code", g.Code, rerr)
+			}
+		}
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	audit(req, "giftcode.redeemed", d.Email, fmt.Sprintf("%s %s for %d months", g.Code, g.Outcome, g.Months))
+	track("giftcode.redeemed", d, map[string]interface{}{"code": g.Code, "months": g.Months, "outcome": g.Outcome})
+
+	if err := RenderTemplate(rw, "redeemed", map[string]interface{}{
+		"Name":       d.Name,
+		"Months":     g.Months,
+		"Outcome":    g.Outcome,
+		"Credit":     g.CreditAmount,
+		"Currency":   g.Currency,
+		"Expiration": d.Expiration.Format("January 2, 2006"),
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /admin/gift-codes, Lists gift codes and who redeemed them
+func GiftCodesHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	switch req.FormValue("status") {
+	case "redeemed":
+		query["redeemedBy"] = bson.M{"$exists": true}
+	case "unused":
+		query["redeemedBy"] = bson.M{"$exists": false}
+		query["expiresAt"] = bson.M{"$gt": time.Now()}
+	case "expired":
+		query["redeemedBy"] = bson.M{"$exists": false}
+		query["expiresAt"] = bson.M{"$lte": time.Now()}
+	}
+
+	gs, err := db.GetGiftCodes(query, giftCodePageLimit)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	ids := []bson.ObjectId{}
+	for _, g := range gs {
+		if g.RedeemedBy != "" {
+			ids = append(ids, g.RedeemedBy)
+		}
+	}
+	ds, err := db.GetDevelopersByIDs(db.ReadAdmin, ids)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	emails := map[string]string{}
+	for id, d := range ds {
+		emails[id.Hex()] = d.Email
+	}
+
+	if err := RenderAdminTemplate(rw, "gift_codes", map[string]interface{}{
+		"Codes":  gs,
+		"Emails": emails,
+		"Status": req.FormValue("status"),
+		"Now":    time.Now(),
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// POST /admin/gift-codes, Generates gift codes
+func CreateGiftCodesHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Count     int       `json:"count"`
+		Months    int       `json:"months"`
+		Note      string    `json:"note"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if body.Count < 1 || body.Count > maxGiftCodeBatch || body.Months < 1 || body.Months > maxGiftCodeMonths {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  fmt.Sprintf("count must be between 1 and %d, and months between 1 and %d", maxGiftCodeBatch, maxGiftCodeMonths),
+		})
+		return
+	}
+	if body.ExpiresAt.IsZero() {
+		body.ExpiresAt = time.Now().AddDate(0, 0, defaultGiftCodeDays)
+	}
+	if !body.ExpiresAt.After(time.Now()) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "expiresAt must be in the future",
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	gs := make([]*db.GiftCode, body.Count)
+	codes := make([]string, body.Count)
+	for i := range gs {
+		code, err := newGiftCode()
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+		codes[i] = code
+		gs[i] = &db.GiftCode{
+			Code:      code,
+			Months:    body.Months,
+			Note:      strings.TrimSpace(body.Note),
+			ExpiresAt: body.ExpiresAt,
+			CreatedBy: actor,
+		}
+	}
+	if err := db.SaveGiftCodes(gs); err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "giftcode.created", actor, fmt.Sprintf("%d codes for %d months", body.Count, body.Months))
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"codes":  codes,
+	})
+}
@@ -0,0 +1,233 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for delegated access between developers.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// grantReq is the body sent when inviting a teammate.
+type grantReq struct {
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+// currentDeveloper returns the developer making the request using the
+// basic auth credentials already checked by AuthHandler.
+func currentDeveloper(req *http.Request) (*schemas.Developer, error) {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return nil, errors.New("Valid token required.")
+	}
+	if pass != "" {
+		return tenantFor(req).GetDeveloper(bson.M{"email": user})
+	}
+
+	return tenantFor(req).GetDeveloper(bson.M{"token": user})
+}
+
+// grantScopes lists the routes a grantee may use on someone else's account
+// and the scope each needs. Anything not listed stays with the owner.
+var grantScopes = map[string]string{
+	"GET /developers/{token}/discount-applications": db.ScopeBillingRead,
+	"GET /developers/{token}/license":               db.ScopeDeploy,
+}
+
+// requiredScope returns the scope a grantee needs to make req on someone
+// else's account, or an empty string if the route is owner only.
+func requiredScope(req *http.Request) string {
+	token := mux.Vars(req)["token"]
+	if token == "" {
+		return ""
+	}
+
+	path := strings.Replace(req.URL.Path, "/"+token, "/{token}", 1)
+	return grantScopes[req.Method+" "+path]
+}
+
+// authorizeGrant checks that dev holds a grant on the account identified by
+// the token in the route.
+func authorizeGrant(req *http.Request, dev *schemas.Developer, token string) (bool, error) {
+	scope := requiredScope(req)
+	if scope == "" {
+		return false, nil
+	}
+
+	owner, err := tenantFor(req).GetDeveloper(bson.M{"token": token})
+	if err != nil || owner.ID == "" {
+		return false, nil
+	}
+
+	return db.HasGrant(owner.ID, dev.ID, scope)
+}
+
+// POST /developers/{token}/grants, invites a teammate with the given scopes
+func CreateGrantHandler(rw http.ResponseWriter, req *http.Request) {
+	var body grantReq
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if body.Email == "" || len(body.Scopes) == 0 {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Email and Scopes Required.",
+		})
+		return
+	}
+
+	for _, scope := range body.Scopes {
+		if !db.ValidScope(scope) {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "invalid scope " + scope,
+			})
+			return
+		}
+	}
+
+	owner, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	g := &db.Grant{
+		OwnerID:      owner.ID,
+		GranteeEmail: body.Email,
+		Scopes:       body.Scopes,
+	}
+	if err := db.SaveGrant(g); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"grant":  g,
+		"invite": g.Invite,
+	})
+}
+
+// GET /developers/{token}/grants, lists the grants on an account
+func GetGrantsHandler(rw http.ResponseWriter, req *http.Request) {
+	owner, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	gs, err := db.GetGrants(bson.M{"ownerId": owner.ID})
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"grants": gs,
+	})
+}
+
+// DELETE /developers/{token}/grants/{id}, revokes a grant
+func RevokeGrantHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if !bson.IsObjectIdHex(vars["id"]) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid grant id",
+		})
+		return
+	}
+
+	owner, err := tenantFor(req).GetDeveloper(bson.M{"token": vars["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := db.RevokeGrant(owner.ID, bson.ObjectIdHex(vars["id"])); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// POST /grants/{invite}/accept, accepts an invitation as the logged in developer
+func AcceptGrantHandler(rw http.ResponseWriter, req *http.Request) {
+	dev, err := currentDeveloper(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	invite := mux.Vars(req)["invite"]
+	pending, err := db.GetGrant(bson.M{"invite": invite, "accepted": false})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Invalid invitation.",
+		})
+		return
+	}
+
+	if !strings.EqualFold(pending.GranteeEmail, dev.Email) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invitation was sent to another email",
+		})
+		return
+	}
+
+	g, err := db.AcceptGrant(invite, dev.ID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"grant":  g,
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright 2014 Bowery, Inc.
+// Contains developer history, the versions saved after each write to a
+// developer. Admins can compare versions and restore one, e.g. to undo a
+// bad bulk update, after seeing what restoring it would change.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Versions shown on the history page.
+const historyLimit = 50
+
+// hiddenFields are compared but never shown.
+var hiddenFields = map[string]bool{"password": true, "salt": true}
+
+// historyEntry is a version with what it changed from the one before.
+type historyEntry struct {
+	ID        string
+	CreatedAt time.Time
+	Changes   []*db.FieldChange
+}
+
+// flattenDocument adds a document's fields to out with dotted keys, e.g.
+// invoice.poNumber. Arrays are kept whole.
+func flattenDocument(prefix string, doc bson.M, out map[string]interface{}) {
+	for key, value := range doc {
+		if nested, ok := value.(bson.M); ok {
+			flattenDocument(prefix+key+".", nested, out)
+			continue
+		}
+		out[prefix+key] = value
+	}
+}
+
+// formatFieldValue returns how a value is shown in a diff.
+func formatFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case bson.ObjectId:
+		return v.Hex()
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// sameFieldValue reports whether two values are equal, times if they're
+// the same instant whatever their location.
+func sameFieldValue(a, b interface{}) bool {
+	if at, ok := a.(time.Time); ok {
+		bt, ok := b.(time.Time)
+		return ok && at.Equal(bt)
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// diffDocuments returns the fields that differ from one document to
+// another, by field. The revision is left out since every write bumps it.
+func diffDocuments(from, to bson.M) []*db.FieldChange {
+	a, b := map[string]interface{}{}, map[string]interface{}{}
+	flattenDocument("", from, a)
+	flattenDocument("", to, b)
+
+	fields := []string{}
+	for field := range a {
+		fields = append(fields, field)
+	}
+	for field := range b {
+		if _, ok := a[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []*db.FieldChange{}
+	for _, field := range fields {
+		if field == "revision" || sameFieldValue(a[field], b[field]) {
+			continue
+		}
+
+		c := &db.FieldChange{Field: field, From: formatFieldValue(a[field]), To: formatFieldValue(b[field])}
+		if hiddenFields[field] {
+			c.From, c.To = "(hidden)", "(hidden)"
+		}
+		changes = append(changes, c)
+	}
+
+	return changes
+}
+
+// developerVersionFromRoute returns the developer's current document and
+// the version in the route, writing the error response if either is
+// missing.
+func developerVersionFromRoute(rw http.ResponseWriter, req *http.Request) (bson.M, *db.DeveloperVersion, bool) {
+	vars := mux.Vars(req)
+	var current bson.M
+	var v *db.DeveloperVersion
+	err := error(db.ErrNotFound)
+	if bson.IsObjectIdHex(vars["id"]) && bson.IsObjectIdHex(vars["version"]) {
+		id := bson.ObjectIdHex(vars["id"])
+		_, err = adminDeveloper(req)
+		if err == nil {
+			current, err = db.GetDeveloperDocument(id)
+		}
+		if err == nil {
+			v, err = db.GetDeveloperVersion(id, bson.ObjectIdHex(vars["version"]))
+		}
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	return current, v, true
+}
+
+// GET /admin/developers/{id}/history, Lists a developer's versions with what each changed
+func DeveloperHistoryHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := adminDeveloper(req)
+	var vs []*db.DeveloperVersion
+	if err == nil {
+		// One more than shown, to diff the oldest shown against.
+		vs, err = db.GetDeveloperVersions(d.ID, historyLimit+1)
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	entries := []*historyEntry{}
+	for i, v := range vs {
+		if i == historyLimit {
+			break
+		}
+		previous := bson.M{}
+		if i+1 < len(vs) {
+			previous = vs[i+1].Document
+		}
+
+		entries = append(entries, &historyEntry{
+			ID:        v.ID.Hex(),
+			CreatedAt: v.CreatedAt,
+			Changes:   diffDocuments(previous, v.Document),
+		})
+	}
+
+	if err := RenderAdminTemplate(rw, "history", map[string]interface{}{
+		"ID":       d.ID.Hex(),
+		"Token":    d.Token,
+		"Name":     d.Name,
+		"Email":    d.Email,
+		"Versions": entries,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /admin/developers/{id}/versions/{version}, Shows what restoring a version would change
+func DeveloperVersionHandler(rw http.ResponseWriter, req *http.Request) {
+	current, v, ok := developerVersionFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"version": v,
+		"changes": diffDocuments(current, v.Document),
+	})
+}
+
+// POST /admin/developers/{id}/versions/{version}/restore, Restores a developer to a version
+func RestoreDeveloperVersionHandler(rw http.ResponseWriter, req *http.Request) {
+	current, v, ok := developerVersionFromRoute(rw, req)
+	if !ok {
+		return
+	}
+	changes := diffDocuments(current, v.Document)
+
+	restored, err := db.RestoreDeveloperVersion(v)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	for _, doc := range []bson.M{current, restored} {
+		if token, ok := doc["token"].(string); ok {
+			entitlements.invalidate(token)
+		}
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	fields := []string{}
+	for _, c := range changes {
+		fields = append(fields, c.Field)
+	}
+	email, _ := restored["email"].(string)
+	audit(req, "developer.version_restored", actor, fmt.Sprintf("%s: %s %v", email, v.ID.Hex(), fields))
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusUpdated,
+		"changes": changes,
+	})
+}
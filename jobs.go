@@ -0,0 +1,370 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the jobs page, every kind of background work in one queue: the
+// outbox's emails and other side effects, failed webhooks, backfills and
+// scheduled jobs. Each can be retried, cancelled or moved to the front
+// where that makes sense for its state, and each kind keeps its state in
+// its own collection so the queue survives restarts.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Kinds of job on the jobs page.
+const (
+	jobKindEmail     = "emails"
+	jobKindWebhook   = "webhooks"
+	jobKindBackfill  = "backfills"
+	jobKindScheduled = "scheduled"
+)
+
+// Actions that can be taken on a job.
+const (
+	jobRetry      = "retry"
+	jobCancel     = "cancel"
+	jobPrioritize = "prioritize"
+)
+
+// Jobs of each kind shown on the jobs page.
+const jobPageLimit = 50
+
+var jobKinds = []string{jobKindEmail, jobKindWebhook, jobKindBackfill, jobKindScheduled}
+
+// queuedJob is a row on the jobs page. Actions are those its state allows.
+type queuedJob struct {
+	Kind      string
+	ID        string
+	Name      string
+	State     string
+	Attempts  int
+	LastError string
+	Detail    string
+	At        time.Time
+	Actions   []string
+}
+
+// jobListers list the jobs of each kind, newest first.
+var jobListers = map[string]func() ([]*queuedJob, error){
+	jobKindEmail:     emailJobs,
+	jobKindWebhook:   webhookJobs,
+	jobKindBackfill:  backfillJobs,
+	jobKindScheduled: scheduledJobs,
+}
+
+// jobActions take an action on a job of each kind by its id. They return
+// ErrConflict if the job's state doesn't allow it.
+var jobActions = map[string]map[string]func(id string) error{
+	jobKindEmail: {
+		jobRetry: objectIDAction(func(id bson.ObjectId) error {
+			return db.SetOutboxMessageStatus(id, []string{db.OutboxFailed}, db.OutboxPending, bson.M{
+				"attempts":      0,
+				"lastError":     "",
+				"nextAttemptAt": time.Now(),
+			})
+		}),
+		jobCancel: objectIDAction(func(id bson.ObjectId) error {
+			return db.SetOutboxMessageStatus(id, []string{db.OutboxPending, db.OutboxFailed}, db.OutboxDiscarded, nil)
+		}),
+		jobPrioritize: objectIDAction(db.PrioritizeOutboxMessage),
+	},
+	jobKindWebhook: {
+		jobRetry: objectIDAction(func(id bson.ObjectId) error {
+			w, err := db.GetWebhook(id)
+			if err != nil {
+				return err
+			}
+			if w.Status != db.WebhookFailed {
+				return db.ErrConflict
+			}
+
+			_, err = replayWebhook(w)
+			return err
+		}),
+	},
+	jobKindBackfill: {
+		jobRetry: objectIDAction(func(id bson.ObjectId) error {
+			return db.SetBackfillStatus(id, []string{db.BackfillPaused, db.BackfillFailed}, db.BackfillPending)
+		}),
+		jobCancel: objectIDAction(func(id bson.ObjectId) error {
+			return db.SetBackfillStatus(id, []string{
+				db.BackfillPending, db.BackfillRunning, db.BackfillPaused, db.BackfillFailed,
+			}, db.BackfillCancelled)
+		}),
+		jobPrioritize: objectIDAction(db.PrioritizeBackfill),
+	},
+	jobKindScheduled: {
+		jobRetry:      scheduledJobAction(db.RequestJobRun),
+		jobCancel:     scheduledJobAction(db.CancelJob),
+		jobPrioritize: scheduledJobAction(db.RequestJobRun),
+	},
+}
+
+// objectIDAction takes an action on a job whose id is an object id.
+func objectIDAction(fn func(bson.ObjectId) error) func(string) error {
+	return func(id string) error {
+		if !bson.IsObjectIdHex(id) {
+			return db.ErrNotFound
+		}
+
+		return fn(bson.ObjectIdHex(id))
+	}
+}
+
+// scheduledJobAction takes an action on a scheduled job by name. Jobs that
+// run on every instance can't be acted on.
+func scheduledJobAction(fn func(string) error) func(string) error {
+	return func(name string) error {
+		if j, ok := findJob(name); !ok || j.everyInstance {
+			return db.ErrNotFound
+		}
+
+		return fn(name)
+	}
+}
+
+func emailJobs() ([]*queuedJob, error) {
+	ms, err := db.GetOutboxMessages(bson.M{"status": bson.M{"$in": []string{
+		db.OutboxPending, db.OutboxProcessing, db.OutboxFailed,
+	}}}, jobPageLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*queuedJob, 0, len(ms))
+	for _, m := range ms {
+		j := &queuedJob{
+			Kind:      jobKindEmail,
+			ID:        m.ID.Hex(),
+			Name:      m.Kind,
+			State:     m.Status,
+			Attempts:  m.Attempts,
+			LastError: m.LastError,
+			Detail:    "developer " + m.DeveloperID.Hex(),
+			At:        m.CreatedAt,
+		}
+		switch m.Status {
+		case db.OutboxPending:
+			j.Actions = []string{jobPrioritize, jobCancel}
+		case db.OutboxFailed:
+			j.Actions = []string{jobRetry, jobCancel}
+		}
+		res = append(res, j)
+	}
+
+	return res, nil
+}
+
+func webhookJobs() ([]*queuedJob, error) {
+	ws, err := db.GetWebhooks(bson.M{"status": db.WebhookFailed}, jobPageLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*queuedJob, 0, len(ws))
+	for _, w := range ws {
+		res = append(res, &queuedJob{
+			Kind:      jobKindWebhook,
+			ID:        w.ID.Hex(),
+			Name:      w.Provider,
+			State:     w.Status,
+			Attempts:  w.Attempts,
+			LastError: w.Error,
+			Detail:    w.Events,
+			At:        w.ReceivedAt,
+			Actions:   []string{jobRetry},
+		})
+	}
+
+	return res, nil
+}
+
+func backfillJobs() ([]*queuedJob, error) {
+	bs, err := db.GetBackfills(backfillPageLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*queuedJob, 0, len(bs))
+	for _, b := range bs {
+		j := &queuedJob{
+			Kind:      jobKindBackfill,
+			ID:        b.ID.Hex(),
+			Name:      b.Name,
+			State:     b.Status,
+			Attempts:  b.Errors,
+			LastError: b.LastError,
+			Detail:    fmt.Sprintf("%d of %d, %d changed", b.Processed, b.Total, b.Changed),
+			At:        b.CreatedAt,
+		}
+		if b.DryRun {
+			j.Detail += ", dry run"
+		}
+		switch b.Status {
+		case db.BackfillPending:
+			j.Actions = []string{jobPrioritize, jobCancel}
+		case db.BackfillRunning:
+			j.Actions = []string{jobCancel}
+		case db.BackfillPaused, db.BackfillFailed:
+			j.Actions = []string{jobRetry, jobCancel}
+		}
+		res = append(res, j)
+	}
+
+	return res, nil
+}
+
+func scheduledJobs() ([]*queuedJob, error) {
+	states, err := db.GetJobStates()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*queuedJob, 0, len(jobs))
+	for _, j := range jobs {
+		q := &queuedJob{Kind: jobKindScheduled, ID: j.name, Name: j.name, State: db.JobIdle}
+		if j.hour >= 0 {
+			q.Detail = fmt.Sprintf("daily at %d:00 UTC", j.hour)
+		} else {
+			q.Detail = "every " + j.interval.String()
+		}
+		if j.everyInstance {
+			q.Detail += " on every instance"
+			res = append(res, q)
+			continue
+		}
+
+		if s, ok := states[j.name]; ok {
+			q.State = s.Status
+			q.Attempts = s.Runs
+			q.LastError = s.LastError
+			q.At = s.StartedAt
+			if s.Cancelled {
+				q.State = db.JobCancelled
+			}
+		}
+		switch q.State {
+		case db.JobCancelled:
+			q.Actions = []string{jobRetry}
+		case db.JobFailed:
+			q.Actions = []string{jobRetry, jobCancel}
+		default:
+			q.Actions = []string{jobPrioritize, jobCancel}
+		}
+		res = append(res, q)
+	}
+
+	return res, nil
+}
+
+// backfillOption is a backfill that can be started from the jobs page.
+type backfillOption struct {
+	Name        string
+	Description string
+}
+
+// backfillOptions sorts options by name.
+type backfillOptions []*backfillOption
+
+func (o backfillOptions) Len() int           { return len(o) }
+func (o backfillOptions) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o backfillOptions) Less(i, j int) bool { return o[i].Name < o[j].Name }
+
+// GET /admin/jobs, Lists background jobs of every kind, or of ?kind=
+func JobsHandler(rw http.ResponseWriter, req *http.Request) {
+	kind := req.FormValue("kind")
+	queue := []*queuedJob{}
+	var err error
+	for _, k := range jobKinds {
+		if kind != "" && kind != k {
+			continue
+		}
+
+		var js []*queuedJob
+		js, err = jobListers[k]()
+		if err != nil {
+			break
+		}
+		queue = append(queue, js...)
+	}
+
+	if err == nil {
+		options := []*backfillOption{}
+		for name, bf := range backfills {
+			options = append(options, &backfillOption{name, bf.Description})
+		}
+		sort.Sort(backfillOptions(options))
+
+		err = RenderAdminTemplate(rw, "jobs", map[string]interface{}{
+			"Queue":   queue,
+			"Kinds":   jobKinds,
+			"Kind":    kind,
+			"Options": options,
+		})
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// POST /admin/jobs/{kind}/{id}/{action}, Retries, cancels or prioritizes a job
+func JobActionHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	kind, id, action := vars["kind"], vars["id"], vars["action"]
+
+	fn, ok := jobActions[kind][action]
+	if !ok {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  fmt.Sprintf("%s jobs can't be %s", kind, actionPastTense(action)),
+		})
+		return
+	}
+
+	err := fn(id)
+	if err == db.ErrConflict {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "the job can't be " + actionPastTense(action) + " in its current state",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "job."+action, actor, kind+" "+id)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// actionPastTense returns how an action reads in an error, e.g. retried.
+func actionPastTense(action string) string {
+	switch action {
+	case jobRetry:
+		return "retried"
+	case jobCancel:
+		return "cancelled"
+	case jobPrioritize:
+		return "prioritized"
+	}
+
+	return action + "ed"
+}
@@ -0,0 +1,32 @@
+// Copyright 2014 Bowery, Inc.
+// Contains versioned keys. Secrets and signing keys are comma separated
+// lists in the environment, newest first. The first signs and every one
+// verifies, so a key is rotated by putting a new one in front and dropping
+// the old one once what it signed has expired or been re-signed by
+// rotate-keys.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// splitKeys splits a list of keys, newest first, leaving out empty ones.
+func splitKeys(value string) []string {
+	keys := []string{}
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// keyVersion returns the id a key is known by in what it signs, a hash so
+// the key itself isn't given away.
+func keyVersion(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,163 @@
+// Copyright 2014 Bowery, Inc.
+// Contains legal holds, which keep a developer's data from being purged,
+// anonymized or pruned by retention until they're released. Holds can be
+// placed on developers pending purge too.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// holdReason reads the reason a hold is placed or released, which is
+// required so the record explains it.
+func holdReason(req *http.Request) (string, error) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	reason := strings.TrimSpace(body.Reason)
+	if reason == "" {
+		return "", errors.New("reason is required")
+	}
+
+	return reason, nil
+}
+
+// holdDeveloper returns the developer with the id in the route, including
+// deleted developers not yet purged.
+func holdDeveloper(req *http.Request) (*schemas.Developer, error) {
+	d, err := adminDeveloper(req)
+	if err != db.ErrNotFound {
+		return d, err
+	}
+
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		return nil, db.ErrNotFound
+	}
+	dds, err := db.GetDeletedDevelopers(bson.M{"_id": bson.ObjectIdHex(id)})
+	if err != nil {
+		return nil, err
+	}
+	if len(dds) == 0 {
+		return nil, db.ErrNotFound
+	}
+
+	return dds[0].Developer, nil
+}
+
+// POST /admin/developers/{id}/legal-hold, Holds a developer's data with a reason
+func PlaceLegalHoldHandler(rw http.ResponseWriter, req *http.Request) {
+	reason, err := holdReason(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	d, err := holdDeveloper(req)
+	h := &db.LegalHold{Reason: reason, HeldBy: actor}
+	if err == nil {
+		h.DeveloperID, h.Email, h.Name = d.ID, d.Email, d.Name
+		err = db.PlaceLegalHold(h)
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "developer.held", actor, d.Email+": "+reason)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"hold":   h,
+	})
+}
+
+// DELETE /admin/developers/{id}/legal-hold, Releases the hold on a developer's data with a reason
+func ReleaseLegalHoldHandler(rw http.ResponseWriter, req *http.Request) {
+	reason, err := holdReason(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	id := mux.Vars(req)["id"]
+	var h *db.LegalHold
+	if !bson.IsObjectIdHex(id) {
+		err = db.ErrNotFound
+	} else {
+		h, err = db.GetLegalHold(bson.ObjectIdHex(id))
+	}
+	if err == nil {
+		err = db.ReleaseLegalHold(h.DeveloperID)
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "developer.released", actor, h.Email+": "+reason)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// GET /admin/legal-holds, Lists developers under legal hold with who held them and why, as JSON with format=json
+func LegalHoldsHandler(rw http.ResponseWriter, req *http.Request) {
+	hs, err := db.GetLegalHolds()
+	if req.FormValue("format") == "json" {
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status": requests.StatusFound,
+			"holds":  hs,
+		})
+		return
+	}
+
+	if err == nil {
+		err = RenderAdminTemplate(rw, "legal_holds", map[string]interface{}{
+			"Holds": hs,
+		})
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
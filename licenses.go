@@ -0,0 +1,328 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for signed license keys.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long a license is valid for after it's issued.
+const licenseDuration = time.Hour * 24 * 365
+
+var (
+	// licenseSigningKey signs new licenses and revocation lists.
+	licenseSigningKey ed25519.PrivateKey
+
+	// licenseKeys are every key licenses are verified with, the signing
+	// key first, by version.
+	licenseKeys = map[string]ed25519.PublicKey{}
+)
+
+// licensePayload is the signed content of a license key. KeyID is the
+// version of the key it's signed with, licenses from before keys were
+// versioned don't have one.
+type licensePayload struct {
+	ID          string `json:"id"`
+	DeveloperID string `json:"developerId"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	IssuedAt    int64  `json:"issuedAt"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	KeyID       string `json:"kid,omitempty"`
+}
+
+// revocationList is the signed content of the revocation list.
+type revocationList struct {
+	Revoked  []string `json:"revoked"`
+	IssuedAt int64    `json:"issuedAt"`
+	KeyID    string   `json:"kid,omitempty"`
+}
+
+func init() {
+	// LICENSE_SIGNING_KEY holds base64 Ed25519 seeds, newest first. Outside
+	// production a throwaway key is fine since licenses issued there aren't
+	// distributed.
+	for _, encoded := range splitKeys(os.Getenv("LICENSE_SIGNING_KEY")) {
+		seed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			if os.Getenv("ENV") == "production" {
+				panic("LICENSE_SIGNING_KEY must be base64 encoded Ed25519 seeds")
+			}
+			continue
+		}
+
+		key := ed25519.NewKeyFromSeed(seed)
+		if licenseSigningKey == nil {
+			licenseSigningKey = key
+		}
+		pub := key.Public().(ed25519.PublicKey)
+		licenseKeys[keyVersion(pub)] = pub
+	}
+	if licenseSigningKey != nil {
+		return
+	}
+
+	if os.Getenv("ENV") == "production" {
+		panic("LICENSE_SIGNING_KEY must be base64 encoded Ed25519 seeds")
+	}
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	licenseSigningKey = key
+	licenseKeys[keyVersion(pub)] = pub
+}
+
+// licenseKeyID returns the version of the key new licenses are signed
+// with.
+func licenseKeyID() string {
+	return keyVersion(licenseSigningKey.Public().(ed25519.PublicKey))
+}
+
+// signPayload marshals v and signs it, returning "<payload>.<signature>"
+// with both parts base64url encoded.
+func signPayload(key ed25519.PrivateKey, v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	sig := ed25519.Sign(key, payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verifyPayload checks a value produced by signPayload and decodes it into v.
+// Client tools implement the same check offline.
+func verifyPayload(pub ed25519.PublicKey, signed string, v interface{}) error {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 2 {
+		return errors.New("malformed license")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pub, payload, sig) {
+		return errors.New("invalid license signature")
+	}
+
+	return json.Unmarshal(payload, v)
+}
+
+// resignLicense verifies a license with any of the license keys and signs
+// it again with the current one, keeping what it says.
+func resignLicense(key string) (string, error) {
+	payload := &licensePayload{}
+	err := errors.New("no license key verifies the license")
+	for _, pub := range licenseKeys {
+		if err = verifyPayload(pub, key, payload); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	payload.KeyID = licenseKeyID()
+	return signPayload(licenseSigningKey, payload)
+}
+
+// issueLicense signs a new license for the developer and stores it.
+func issueLicense(d *schemas.Developer) (*db.License, error) {
+	now := time.Now()
+	l := &db.License{
+		ID:          bson.NewObjectId(),
+		DeveloperID: d.ID,
+		KeyID:       licenseKeyID(),
+		IssuedAt:    now,
+		ExpiresAt:   now.Add(licenseDuration),
+	}
+
+	key, err := signPayload(licenseSigningKey, &licensePayload{
+		ID:          l.ID.Hex(),
+		DeveloperID: d.ID.Hex(),
+		Name:        d.Name,
+		Email:       d.Email,
+		IssuedAt:    l.IssuedAt.Unix(),
+		ExpiresAt:   l.ExpiresAt.Unix(),
+		KeyID:       l.KeyID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.Key = key
+
+	if err := db.SaveLicense(l); err != nil {
+		return nil, err
+	}
+
+	return l, db.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{"license": l.Key})
+}
+
+// resignLicenses signs up to limit licenses still in use with the current
+// key, returning how many were signed. Developers download the re-signed
+// license the next time they fetch it.
+func resignLicenses(limit int) (int, error) {
+	keyID := licenseKeyID()
+	ls, err := db.GetLicensesToResign(keyID, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, l := range ls {
+		key, err := resignLicense(l.Key)
+		if err != nil {
+			return i, fmt.Errorf("unable to re-sign license %s: %s", l.ID.Hex(), err)
+		}
+
+		err = db.ResignLicense(l, key, keyID)
+		if err != nil && err != db.ErrConflict {
+			return i, err
+		}
+	}
+
+	return len(ls), nil
+}
+
+// GET /developers/{token}/license, Downloads the developer's license key
+func LicenseHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	state, err := developerLifecycle(d)
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if !paidLifecycle(state) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "A paid account is required for a license.",
+		})
+		return
+	}
+
+	l, err := db.GetCurrentLicense(d.ID)
+	if err == db.ErrNotFound || (err == nil && l.ExpiresAt.Before(time.Now())) {
+		l, err = issueLicense(d)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"license": l,
+	})
+}
+
+// GET /.well-known/license-key, Public keys used to verify license keys, by the kid licenses carry
+func LicensePublicKeyHandler(rw http.ResponseWriter, req *http.Request) {
+	pub := licenseSigningKey.Public().(ed25519.PublicKey)
+	keys := map[string]string{}
+	for id, key := range licenseKeys {
+		keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"algorithm": "ed25519",
+		"publicKey": base64.StdEncoding.EncodeToString(pub),
+		"keyId":     licenseKeyID(),
+		"keys":      keys,
+	})
+}
+
+// GET /.well-known/license-revocations, Signed list of revoked license ids
+func LicenseRevocationsHandler(rw http.ResponseWriter, req *http.Request) {
+	ls, err := db.GetRevokedLicenses()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	list := &revocationList{Revoked: []string{}, IssuedAt: time.Now().Unix(), KeyID: licenseKeyID()}
+	for _, l := range ls {
+		list.Revoked = append(list.Revoked, l.ID.Hex())
+	}
+
+	signed, err := signPayload(licenseSigningKey, list)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"revoked": list.Revoked,
+		"signed":  signed,
+	})
+}
+
+// PUT /admin/licenses/{id}/revoke, Revokes a license key
+func RevokeLicenseHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid license id",
+		})
+		return
+	}
+
+	if err := db.RevokeLicense(bson.ObjectIdHex(id)); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	fmt.Println("revoked license", id)
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
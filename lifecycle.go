@@ -0,0 +1,100 @@
+// Copyright 2014 Bowery, Inc.
+// Contains developer lifecycle states, created through verified, trialing,
+// active, past due and canceled to purged. Which moves are allowed is kept
+// by the db package, so every change of state goes through
+// transitionDeveloper. Developers whose expiration passes are moved on by a
+// job rather than when they're next seen.
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+// Developers moved on by a single run of the lapse job.
+const lapseBatch = 500
+
+func init() {
+	schedule("lapse-developers", 10*time.Minute, lapseDevelopers)
+	backfills["set-lifecycle"] = &backfill{
+		"Stores the lifecycle state of developers from before it was kept, derived from their paid flag and expiration.",
+		lifecycleBackfill,
+	}
+}
+
+// paidLifecycle reports whether a developer in state is on a paid plan,
+// including while a payment is failing.
+func paidLifecycle(state string) bool {
+	return state == db.LifecycleActive || state == db.LifecyclePastDue
+}
+
+// developerLifecycle returns a developer's lifecycle state.
+func developerLifecycle(d *schemas.Developer) (string, error) {
+	return db.GetLifecycle(bson.M{"_id": d.ID})
+}
+
+// transitionDeveloper moves a developer to state, setting the fields in set
+// with it, and tracks the change.
+func transitionDeveloper(d *schemas.Developer, state string, set bson.M) error {
+	from, err := db.TransitionDeveloper(d.ID, state, set)
+	if err != nil {
+		return err
+	}
+	entitlements.invalidate(d.Token)
+
+	if from != state {
+		track("developer.lifecycle", d, map[string]interface{}{"from": from, "to": state})
+	}
+	return nil
+}
+
+// markPastDue moves a paid developer whose renewal charge failed to past
+// due. Developers who aren't paid are left as they are.
+func markPastDue(d *schemas.Developer) {
+	err := transitionDeveloper(d, db.LifecyclePastDue, nil)
+	if _, ok := err.(*db.LifecycleError); err != nil && !ok {
+		fmt.Println("unable to move", d.Email, "to past due", err)
+	}
+}
+
+// lapseDevelopers moves developers whose expiration has passed on, trials
+// to canceled and paid developers to past due until they're charged again.
+func lapseDevelopers() error {
+	docs, err := db.GetLapsedDevelopers(time.Now(), lapseBatch)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		id, _ := doc["_id"].(bson.ObjectId)
+		state := db.LifecycleCanceled
+		if doc["lifecycle"] == db.LifecycleActive {
+			state = db.LifecyclePastDue
+		}
+
+		d, err := db.GetDeveloper(bson.M{"_id": id})
+		if err == nil {
+			err = transitionDeveloper(d, state, nil)
+		}
+		if err != nil && err != db.ErrNotFound && err != db.ErrConflict {
+			fmt.Println("unable to move", id.Hex(), "to", state, err)
+		}
+	}
+
+	return nil
+}
+
+func lifecycleBackfill(doc bson.M) (bson.M, error) {
+	if _, ok := doc["lifecycle"].(string); ok {
+		return nil, nil
+	}
+
+	return bson.M{
+		"lifecycle":          db.DeriveLifecycle(doc, time.Now()),
+		"lifecycleChangedAt": time.Now(),
+	}, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 Bowery, Inc.
+// Contains Mailchimp's webhook. Unsubscribes, address changes and cleaned
+// addresses made in Mailchimp are copied back onto developers so broadcasts
+// respect them.
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+)
+
+// mailchimpEvent is a webhook post from Mailchimp, sent as a form.
+type mailchimpEvent struct {
+	Type     string
+	ListID   string
+	Email    string
+	NewEmail string
+	Reason   string
+}
+
+// parseMailchimpEvent reads an event from a webhook's form. Address
+// changes give the old and new address instead of the email.
+func parseMailchimpEvent(form url.Values) *mailchimpEvent {
+	e := &mailchimpEvent{
+		Type:   form.Get("type"),
+		ListID: form.Get("data[list_id]"),
+		Email:  form.Get("data[email]"),
+		Reason: form.Get("data[reason]"),
+	}
+	if e.Type == "upemail" {
+		e.Email = form.Get("data[old_email]")
+		e.NewEmail = form.Get("data[new_email]")
+	}
+	e.Email = strings.ToLower(strings.TrimSpace(e.Email))
+	e.NewEmail = strings.ToLower(strings.TrimSpace(e.NewEmail))
+
+	return e
+}
+
+// nextEmailSubscription returns a subscription after an event, nil if the
+// event doesn't change it.
+func nextEmailSubscription(s *db.EmailSubscription, e *mailchimpEvent) *db.EmailSubscription {
+	if s == nil {
+		s = &db.EmailSubscription{}
+	}
+	next := *s
+
+	switch e.Type {
+	case "subscribe":
+		next.Unsubscribed = false
+		next.Reason = ""
+	case "unsubscribe":
+		next.Unsubscribed = true
+		next.Reason = e.Reason
+	case "upemail":
+		if e.NewEmail == "" {
+			return nil
+		}
+		next.Email = e.NewEmail
+	default:
+		return nil
+	}
+
+	if next.Unsubscribed == s.Unsubscribed && next.Reason == s.Reason && next.Email == s.Email {
+		return nil
+	}
+	return &next
+}
+
+// applyMailchimpEvent copies an event onto the developer with the address.
+// Cleaned addresses are ones Mailchimp found undeliverable.
+func applyMailchimpEvent(e *mailchimpEvent) error {
+	if e.Type == "cleaned" {
+		err := db.SetListEmailHealth(e.Email, &db.EmailHealth{Status: db.EmailCleaned, Reason: e.Reason})
+		if err == db.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	s, err := db.GetEmailSubscription(e.Email)
+	if err == db.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if next := nextEmailSubscription(s, e); next != nil {
+		return db.SetEmailSubscription(e.Email, next)
+	}
+	return nil
+}
+
+// GET /webhooks/mailchimp, Lets Mailchimp check the webhook exists
+func MailchimpWebhookCheckHandler(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+}
+
+// POST /webhooks/mailchimp, Copies list changes made in Mailchimp onto developers
+func MailchimpWebhookHandler(rw http.ResponseWriter, req *http.Request) {
+	// Mailchimp doesn't sign webhooks, so the url it's given carries a key.
+	key := os.Getenv("MAILCHIMP_WEBHOOK_KEY")
+	if key == "" || !hmac.Equal([]byte(req.URL.Query().Get("key")), []byte(key)) {
+		http.Error(rw, "invalid key", http.StatusUnauthorized)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, 1<<20)
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := receiveWebhook("mailchimp", []byte(req.PostForm.Encode()), false); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e := parseMailchimpEvent(req.PostForm)
+	if e.ListID != signupListID || e.Email == "" {
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	detail := e.Email
+	if e.NewEmail != "" {
+		detail = fmt.Sprintf("%s -> %s", e.Email, e.NewEmail)
+	}
+	audit(req, "mailchimp."+e.Type, "mailchimp", detail)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// processMailchimpWebhook applies an event posted by Mailchimp, ignoring
+// those for other lists.
+func processMailchimpWebhook(payload []byte) (string, error) {
+	form, err := url.ParseQuery(string(payload))
+	if err != nil {
+		return "", err
+	}
+
+	e := parseMailchimpEvent(form)
+	if e.ListID != signupListID || e.Email == "" {
+		return e.Type, nil
+	}
+	return e.Type, applyMailchimpEvent(e)
+}
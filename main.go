@@ -3,9 +3,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
-	"github.com/Bowery/gopackages/config"
+	"github.com/Bowery/broome/env"
 	"github.com/Bowery/gopackages/web"
 	"github.com/Bowery/slack"
 )
@@ -15,18 +16,54 @@ var (
 )
 
 func main() {
-	slackC = slack.NewClient(config.SlackToken)
+	if err := env.Current.Verify(); err != nil {
+		panic(err)
+	}
+	if err := loadBillingKey(); err != nil {
+		panic(err)
+	}
+	if err := loadPIIKeys(); err != nil {
+		panic(err)
+	}
 
-	port := ":4000"
-	if os.Getenv("ENV") == "production" {
-		port = ":80"
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := redactOutput(); err != nil {
+		panic(err)
+	}
+	fmt.Println("starting broome in", env.Current.Name)
+
+	slackC = slack.NewClient(env.Current.SlackToken)
+
+	port := serverPort()
+	if err := selfCheck(); err != nil {
+		panic(err)
 	}
 
 	server := web.NewServer(port, []web.Handler{
 		new(web.SlashHandler),
 		new(web.CorsHandler),
-		&web.StatHandler{Key: config.StatHatKey, Name: "broome"},
+		&web.StatHandler{Key: env.Current.StatHatKey, Name: "broome"},
 	}, Routes)
 	server.AuthHandler = &web.AuthHandler{Auth: AuthHandler}
-	server.ListenAndServe()
+	if _, err := reloadSettings("startup"); err != nil {
+		fmt.Println("unable to load settings", err)
+	}
+	startJobs()
+
+	server.Prestart()
+	handler := withDeadline(adminAllowlisted(orgHosts(scopeTenants(enforceSuspensions(server.Handler)))), httpConfig.RequestTimeout)
+	handler = measureSLOs(handler, Routes)
+	if httpConfig.AccessLog {
+		handler = accessLog(handler, Routes)
+	}
+	srv := newHTTPServer(port, handler, httpConfig)
+	if err := listen(srv, httpConfig); err != nil {
+		panic(err)
+	}
 }
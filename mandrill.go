@@ -0,0 +1,295 @@
+// Copyright 2014 Bowery, Inc.
+// Contains email delivery tracking. Every message sent through Mandrill is
+// recorded, and Mandrill's webhook reports what happened to it: delivered,
+// opened, clicked, bounced or marked as spam. Bounces and complaints mark
+// the developer's address unhealthy.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/mattbaird/gochimp"
+)
+
+// softBounceLimit is the soft bounces in a row before an address is
+// marked soft-bouncing.
+const softBounceLimit = 3
+
+// mandrillEvent is an event in Mandrill's webhook payload.
+type mandrillEvent struct {
+	Event string `json:"event"`
+	TS    int64  `json:"ts"`
+	Msg   struct {
+		ID           string `json:"_id"`
+		Email        string `json:"email"`
+		Subject      string `json:"subject"`
+		State        string `json:"state"`
+		BounceDesc   string `json:"bounce_description"`
+		Diag         string `json:"diag"`
+		RejectReason string `json:"reject_reason"`
+	} `json:"msg"`
+}
+
+// mandrillStatuses are the message statuses webhook events move to. Opens
+// and clicks don't change it.
+var mandrillStatuses = map[string]string{
+	"send":        "sent",
+	"deferral":    "deferred",
+	"hard_bounce": "bounced",
+	"soft_bounce": "soft-bounced",
+	"spam":        "spam",
+	"reject":      "rejected",
+	"unsub":       "unsubscribed",
+	"delivered":   "delivered",
+}
+
+// recordSentEmails saves the messages Mandrill accepted. Recording is best
+// effort, it never fails a send.
+func recordSentEmails(msg gochimp.Message, res []gochimp.SendResponse) {
+	ms := []*db.EmailMessage{}
+	for _, r := range res {
+		if r.Id == "" {
+			continue
+		}
+		ms = append(ms, &db.EmailMessage{
+			ID:      r.Id,
+			Email:   r.Email,
+			Subject: msg.Subject,
+			Tags:    msg.Tags,
+			Status:  r.Status,
+		})
+	}
+	if len(ms) == 0 {
+		return
+	}
+
+	if err := db.SaveEmailMessages(ms...); err != nil {
+		fmt.Println("unable to record sent emails", err)
+	}
+}
+
+// mandrillSignature signs a webhook request the way Mandrill does, the url
+// followed by each form key and value sorted by key.
+func mandrillSignature(key, webhookURL string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	signed := webhookURL
+	for _, k := range keys {
+		signed += k + form.Get(k)
+	}
+
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(signed))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mandrillWebhookURL is the url Mandrill signs, MANDRILL_WEBHOOK_URL if
+// broome is behind a proxy that changes it.
+func mandrillWebhookURL(req *http.Request) string {
+	if u := os.Getenv("MANDRILL_WEBHOOK_URL"); u != "" {
+		return u
+	}
+
+	return baseURL(req) + req.URL.Path
+}
+
+// nextEmailHealth returns an address's health after an event, nil if the
+// event doesn't change it.
+func nextEmailHealth(h *db.EmailHealth, e *mandrillEvent) *db.EmailHealth {
+	if h == nil {
+		h = &db.EmailHealth{Status: db.EmailHealthy}
+	}
+	next := *h
+
+	switch e.Event {
+	case "hard_bounce":
+		next.Status = db.EmailBounced
+		next.Reason = e.Msg.BounceDesc
+	case "soft_bounce":
+		next.SoftBounces++
+		if next.SoftBounces >= softBounceLimit && next.Status == db.EmailHealthy {
+			next.Status = db.EmailSoftBouncing
+			next.Reason = e.Msg.BounceDesc
+		}
+	case "spam":
+		next.Status = db.EmailComplained
+		next.Reason = "marked as spam"
+	case "reject":
+		next.Status = db.EmailRejected
+		next.Reason = e.Msg.RejectReason
+	case "delivered", "open", "click":
+		// Delivering again clears soft bounces, not bounces or complaints.
+		if next.Status != db.EmailHealthy && next.Status != db.EmailSoftBouncing {
+			return nil
+		}
+		next.Status = db.EmailHealthy
+		next.SoftBounces = 0
+		next.Reason = ""
+	default:
+		return nil
+	}
+
+	if next == *h {
+		return nil
+	}
+	return &next
+}
+
+// applyMandrillEvent records an event on its message and the recipient's
+// email health.
+func applyMandrillEvent(e *mandrillEvent) error {
+	at := time.Unix(e.TS, 0)
+	err := db.ApplyEmailEvent(e.Msg.ID, e.Msg.Email, e.Msg.Subject, e.Event, mandrillStatuses[e.Event], at)
+	if err != nil {
+		return err
+	}
+
+	h, err := db.GetEmailHealth(e.Msg.Email)
+	if err == db.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if next := nextEmailHealth(h, e); next != nil {
+		return db.SetEmailHealth(e.Msg.Email, next)
+	}
+	return nil
+}
+
+// HEAD /webhooks/mandrill, Lets Mandrill check the webhook exists
+func MandrillWebhookCheckHandler(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+}
+
+// POST /webhooks/mandrill, Records delivery events for sent emails
+func MandrillWebhookHandler(rw http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(rw, req.Body, 10<<20)
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Keys are listed newest first while the webhook's key is being reset,
+	// so events signed with either are accepted.
+	signature := req.Header.Get("X-Mandrill-Signature")
+	valid := false
+	for _, key := range splitKeys(os.Getenv("MANDRILL_WEBHOOK_KEY")) {
+		expected := mandrillSignature(key, mandrillWebhookURL(req), req.PostForm)
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		http.Error(rw, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := receiveWebhook("mandrill", []byte(req.PostForm.Get("mandrill_events")), false); err != nil {
+		// Mandrill retries the batch, events are safe to apply again
+		// apart from open and click counts.
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// processMandrillWebhook applies a batch of Mandrill's events, returning
+// their names.
+func processMandrillWebhook(payload []byte) (string, error) {
+	var events []*mandrillEvent
+	if err := json.Unmarshal(payload, &events); err != nil {
+		return "", err
+	}
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, e := range events {
+		if !seen[e.Event] {
+			seen[e.Event] = true
+			names = append(names, e.Event)
+		}
+		if e.Msg.ID == "" {
+			continue
+		}
+		if err := applyMandrillEvent(e); err != nil {
+			return strings.Join(names, ", "), err
+		}
+	}
+
+	return strings.Join(names, ", "), nil
+}
+
+// GET /admin/email-deliverability, Reports sent emails by delivery status and lists unhealthy addresses
+func EmailDeliverabilityHandler(rw http.ResponseWriter, req *http.Request) {
+	from, to, err := reportRange(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	statuses, err := db.CountEmailStatuses(from, to)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	unhealthy, err := db.GetUnhealthyEmails(500)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	sent, opened, clicked, bounced := 0, 0, 0, 0
+	for _, s := range statuses {
+		sent += s.Count
+		opened += s.Opened
+		clicked += s.Clicked
+		if s.Status == "bounced" || s.Status == "soft-bounced" || s.Status == "rejected" {
+			bounced += s.Count
+		}
+	}
+	rates := map[string]float64{}
+	if sent > 0 {
+		rates["open"] = float64(opened) / float64(sent)
+		rates["click"] = float64(clicked) / float64(sent)
+		rates["bounce"] = float64(bounced) / float64(sent)
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"from":      from,
+		"to":        to,
+		"sent":      sent,
+		"statuses":  statuses,
+		"rates":     rates,
+		"unhealthy": unhealthy,
+	})
+}
@@ -0,0 +1,351 @@
+// Copyright 2014 Bowery, Inc.
+// Contains notification routing. Each kind of notification to a developer
+// is sent on the channels routed for it: email, their Slack workspace or
+// their webhook endpoints. Developers and organizations choose channels per
+// kind, a developer's choice wins over their organization's and that over
+// the defaults.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// Notification channels.
+const (
+	channelEmail   = "email"
+	channelSlack   = "slack"
+	channelWebhook = "webhook"
+)
+
+var noticeChannels = []string{channelEmail, channelSlack, channelWebhook}
+
+// Kinds of routed notification.
+const (
+	noticePaymentFailed  = "payment.failed"
+	noticePaymentAction  = "payment.action"
+	noticePaymentReceipt = "payment.receipt"
+	noticeAnnouncement   = "announcement"
+)
+
+// defaultNoticeRoutes are the channels for each kind when neither the
+// developer nor their organization chose.
+var defaultNoticeRoutes = map[string][]string{
+	noticePaymentFailed:  {channelEmail},
+	noticePaymentAction:  {channelEmail},
+	noticePaymentReceipt: {channelEmail},
+	noticeAnnouncement:   {channelEmail},
+}
+
+// requiredNotices need at least one channel, a developer who never hears
+// about them loses their license.
+var requiredNotices = map[string]bool{
+	noticePaymentFailed: true,
+	noticePaymentAction: true,
+}
+
+// Slack notifications can only be posted to incoming webhooks.
+const slackWebhookPrefix = "https://hooks.slack.com/"
+
+// notice is a notification to a developer. Key dedupes it on every
+// channel. Email is what's emailed, Text is posted to Slack and sent to
+// webhooks along with Data.
+type notice struct {
+	Kind  string
+	Key   string
+	Email gochimp.Message
+	Text  string
+	Data  map[string]interface{}
+}
+
+// noticeRoute returns the channels for kind and the Slack url to post to.
+func noticeRoute(dev, org *db.NotificationRouting, kind string) ([]string, string) {
+	channels, ok := dev.Routes[kind]
+	if !ok {
+		channels, ok = org.Routes[kind]
+	}
+	if !ok {
+		channels = defaultNoticeRoutes[kind]
+	}
+
+	slackURL := dev.SlackURL
+	if slackURL == "" {
+		slackURL = org.SlackURL
+	}
+
+	return channels, slackURL
+}
+
+// developerRouting returns the routing set by a developer and by their
+// organization, empty if they're not in one.
+func developerRouting(d *schemas.Developer) (*db.NotificationRouting, *db.NotificationRouting, error) {
+	dev, err := db.GetNotificationRouting(db.DeveloperRouting(d.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tenant, err := db.GetDeveloperTenant(bson.M{"_id": d.ID})
+	if err != nil && err != db.ErrNotFound {
+		return nil, nil, err
+	}
+	if tenant.OrganizationID == "" {
+		return dev, &db.NotificationRouting{Routes: map[string][]string{}}, nil
+	}
+
+	org, err := db.GetNotificationRouting(db.OrganizationRouting(tenant.OrganizationID))
+	return dev, org, err
+}
+
+// effectiveRoutes returns the channels every kind is sent on.
+func effectiveRoutes(dev, org *db.NotificationRouting) map[string][]string {
+	routes := map[string][]string{}
+	for kind := range defaultNoticeRoutes {
+		routes[kind], _ = noticeRoute(dev, org, kind)
+	}
+
+	return routes
+}
+
+// validateRouting checks the kinds and channels chosen, and the Slack url.
+func validateRouting(r *db.NotificationRouting) error {
+	for kind, channels := range r.Routes {
+		if _, ok := defaultNoticeRoutes[kind]; !ok {
+			return errors.New("Unknown notification " + kind + ".")
+		}
+		if len(channels) == 0 && requiredNotices[kind] {
+			return errors.New(kind + " notifications need at least one channel.")
+		}
+
+		seen := map[string]bool{}
+		for _, channel := range channels {
+			if !containsString(noticeChannels, channel) || seen[channel] {
+				return errors.New("Invalid channel " + channel + " for " + kind + ".")
+			}
+			seen[channel] = true
+		}
+	}
+
+	if r.SlackURL != "" && !strings.HasPrefix(r.SlackURL, slackWebhookPrefix) {
+		return errors.New("Slack url must be an incoming webhook, " + slackWebhookPrefix + "...")
+	}
+
+	return nil
+}
+
+// postSlackWebhook posts text to a Slack incoming webhook.
+func postSlackWebhook(url, text string) error {
+	body, _ := json.Marshal(map[string]string{"text": redactString(text)})
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := deliveryClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("slack responded " + res.Status)
+	}
+
+	return nil
+}
+
+// dispatchNotice sends n on the channels routed for its kind. It returns
+// whether it was emailed, and the error emailing it. Slack and webhooks are
+// best effort so their failures are only printed.
+func dispatchNotice(d *schemas.Developer, n *notice) (bool, error) {
+	dev, org, err := developerRouting(d)
+	if err != nil {
+		return false, err
+	}
+	channels, slackURL := noticeRoute(dev, org, n.Kind)
+
+	emailed := false
+	for _, channel := range channels {
+		switch channel {
+		case channelEmail:
+			err = sendOnce(n.Key, func() error {
+				emailed = true
+				return sendEmail(context.Background(), n.Email)
+			})
+		case channelSlack:
+			if slackURL == "" {
+				continue
+			}
+			if err := sendOnce(n.Key+":slack", func() error { return postSlackWebhook(slackURL, n.Text) }); err != nil {
+				fmt.Println("unable to post notification to slack", n.Key, err)
+			}
+		case channelWebhook:
+			if err := queueNoticeWebhook(d, n); err != nil {
+				fmt.Println("unable to queue notification webhook", n.Key, err)
+			}
+		}
+	}
+
+	return emailed && err == nil, err
+}
+
+// queueNoticeWebhook queues a notice for every enabled endpoint the
+// developer has, routing it there is the subscription.
+func queueNoticeWebhook(d *schemas.Developer, n *notice) error {
+	es, err := db.GetEnabledEndpoints(d.ID)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{"text": n.Text}
+	for k, v := range n.Data {
+		data[k] = v
+	}
+
+	return queueDeliveries(es, "notification."+n.Kind, n.Key, time.Now(), data)
+}
+
+// renderRouting renders a routing along with what it results in.
+func renderRouting(rw http.ResponseWriter, r, effective map[string][]string, slackURL string) {
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"routes":    r,
+		"slackUrl":  slackURL,
+		"effective": effective,
+		"channels":  noticeChannels,
+	})
+}
+
+// updateRouting decodes and saves a routing for owner.
+func updateRouting(req *http.Request, owner string) (*db.NotificationRouting, error) {
+	r := &db.NotificationRouting{}
+	if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+		return nil, err
+	}
+	if r.Routes == nil {
+		r.Routes = map[string][]string{}
+	}
+	if err := validateRouting(r); err != nil {
+		return nil, err
+	}
+
+	r.Owner = owner
+	return r, db.SaveNotificationRouting(r)
+}
+
+// GET /developers/{token}/notifications, Shows the channels each notification is sent on
+func NotificationRoutesHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := routeOwner(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	dev, org, err := developerRouting(d)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderRouting(rw, dev.Routes, effectiveRoutes(dev, org), dev.SlackURL)
+}
+
+// PUT /developers/{token}/notifications, Chooses the channels for each notification, kinds left out follow the organization
+func UpdateNotificationRoutesHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := routeOwner(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	dev, err := updateRouting(req, db.DeveloperRouting(d.ID))
+	var org *db.NotificationRouting
+	if err == nil {
+		_, org, err = developerRouting(d)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "notifications.update", d.Email, "")
+
+	renderRouting(rw, dev.Routes, effectiveRoutes(dev, org), dev.SlackURL)
+}
+
+// organizationFromRoute returns the organization with the slug in the route.
+func organizationFromRoute(req *http.Request) (*db.Organization, error) {
+	return db.GetOrganization(bson.M{"slug": mux.Vars(req)["slug"]})
+}
+
+// GET /admin/organizations/{slug}/notifications, Shows an organization's default channels for each notification
+func OrganizationNotificationRoutesHandler(rw http.ResponseWriter, req *http.Request) {
+	o, err := organizationFromRoute(req)
+	var org *db.NotificationRouting
+	if err == nil {
+		org, err = db.GetNotificationRouting(db.OrganizationRouting(o.ID))
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderRouting(rw, org.Routes, effectiveRoutes(&db.NotificationRouting{}, org), org.SlackURL)
+}
+
+// PUT /admin/organizations/{slug}/notifications, Chooses an organization's channels, which its developers can override
+func UpdateOrganizationNotificationRoutesHandler(rw http.ResponseWriter, req *http.Request) {
+	o, err := organizationFromRoute(req)
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	org, err := updateRouting(req, db.OrganizationRouting(o.ID))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "organization.notifications", actor, o.Slug)
+
+	renderRouting(rw, org.Routes, effectiveRoutes(&db.NotificationRouting{}, org), org.SlackURL)
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Bowery, Inc.
+// Contains deduplicated notifications. Each is sent under a key that's
+// claimed in a store shared by every instance, so a retried signup or a
+// replayed message sends it once.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long a sent notification suppresses duplicates. Signup notifications
+// are once per developer, so the window outlasts any retry.
+const notificationWindow = 30 * 24 * time.Hour
+
+// notificationKey builds the dedupe key for a kind of notification about
+// an email address. Keys use the email rather than the developer id since
+// concurrent retries of a signup may create more than one id.
+func notificationKey(kind, email string) string {
+	return kind + ":" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// sendOnce calls send unless key was already sent within the window. If the
+// send fails the key is released so a retry can send it.
+func sendOnce(key string, send func() error) error {
+	ok, err := db.ClaimNotification(key, notificationWindow)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("suppressed duplicate notification", key)
+		return nil
+	}
+
+	if err := send(); err != nil {
+		if rerr := db.ReleaseNotification(key); rerr != nil {
+			fmt.Println("unable to release notification", key, rerr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// sendEmailOnce sends msg unless key was already sent.
+func sendEmailOnce(key string, msg gochimp.Message) error {
+	return sendOnce(key, func() error { return sendEmail(context.Background(), msg) })
+}
+
+// notifySlackOnce posts to Slack unless key was already posted, printing
+// failures like notifySlack.
+func notifySlackOnce(key, channel, message string) {
+	err := sendOnce(key, func() error { return postSlack(channel, message) })
+	if err != nil {
+		fmt.Println("unable to post to slack", channel, err)
+	}
+}
+
+// GET /admin/notifications, Lists recent notifications and duplicates suppressed
+func AdminNotificationsHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if req.FormValue("suppressed") != "" {
+		query["suppressed"] = bson.M{"$gt": 0}
+	}
+
+	ns, err := db.GetNotifications(query, 100)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":        requests.StatusFound,
+		"notifications": ns,
+	})
+}
@@ -0,0 +1,305 @@
+// Copyright 2014 Bowery, Inc.
+// Contains white labeled organizations. Requests to an organization's custom
+// domain, or its subdomain of ORG_BASE_DOMAIN, are limited to the signup and
+// reset pages, which render with the organization's branding.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme/autocert"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long a host lookup is cached, including hosts with no organization.
+const orgCacheTTL = time.Minute
+
+// orgPaths are the path prefixes served on an organization's domains.
+var orgPaths = []string{
+	"/static/",
+	"/healthz",
+	"/admin/signup/",
+	"/admin/thanks!",
+	"/signup",
+	"/reset/",
+	"/developers/reset/",
+	"/checkout/",
+	"/payments/",
+	"/pay/",
+	"/.well-known/",
+}
+
+var (
+	slugPattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+	colorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+)
+
+type orgKey struct{}
+
+type orgCacheEntry struct {
+	org      *db.Organization
+	cachedAt time.Time
+}
+
+var (
+	orgMutex sync.RWMutex
+	orgCache = map[string]*orgCacheEntry{}
+)
+
+// hostname returns the request's host without a port, lower cased.
+func hostname(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(host)
+}
+
+// orgQuery returns the query for the organization serving host, or nil if
+// host is one of ours.
+func orgQuery(host, base string) bson.M {
+	if base != "" {
+		if host == base || host == "www."+base {
+			return nil
+		}
+
+		if slug := strings.TrimSuffix(host, "."+base); slug != host {
+			if !slugPattern.MatchString(slug) {
+				return nil
+			}
+
+			return bson.M{"slug": slug}
+		}
+	}
+
+	return bson.M{"domains": host}
+}
+
+// lookupOrg returns the organization serving host, or nil if there is none.
+func lookupOrg(host string) (*db.Organization, error) {
+	orgMutex.RLock()
+	e, ok := orgCache[host]
+	orgMutex.RUnlock()
+	if ok && time.Since(e.cachedAt) < orgCacheTTL {
+		return e.org, nil
+	}
+
+	var org *db.Organization
+	if query := orgQuery(host, os.Getenv("ORG_BASE_DOMAIN")); query != nil {
+		o, err := db.GetOrganization(query)
+		if err != nil && err != db.ErrNotFound {
+			return nil, err
+		}
+		if err == nil {
+			org = o
+		}
+	}
+
+	orgMutex.Lock()
+	orgCache[host] = &orgCacheEntry{org: org, cachedAt: time.Now()}
+	orgMutex.Unlock()
+	return org, nil
+}
+
+// orgPath reports whether path is served on organization domains.
+func orgPath(path string) bool {
+	for _, prefix := range orgPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	// The signup and sign in apis are posted to from the organization's
+	// pages and clients.
+	return path == "/developers" || path == "/developers/token"
+}
+
+// orgHosts routes requests for organization domains, attaching the
+// organization so pages can be branded. Hosts without one pass through.
+func orgHosts(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		org, err := lookupOrg(hostname(req))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if org == nil {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		if !orgPath(req.URL.Path) {
+			http.NotFound(rw, req)
+			return
+		}
+
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), orgKey{}, org)))
+	})
+}
+
+// orgFor returns the organization the request was made to, or nil.
+func orgFor(req *http.Request) *db.Organization {
+	org, _ := req.Context().Value(orgKey{}).(*db.Organization)
+	return org
+}
+
+// certCache stores provisioned certificates in the database so every
+// instance can serve them.
+type certCache struct{}
+
+func (certCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := db.GetCertificate(key)
+	if err == db.ErrNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return data, err
+}
+
+func (certCache) Put(ctx context.Context, key string, data []byte) error {
+	return db.SaveCertificate(key, data)
+}
+
+func (certCache) Delete(ctx context.Context, key string) error {
+	return db.DeleteCertificate(key)
+}
+
+// certManager provisions certificates from Let's Encrypt for organization
+// domains as they're first requested.
+var certManager = &autocert.Manager{
+	Prompt: autocert.AcceptTOS,
+	Cache:  certCache{},
+	Email:  os.Getenv("ACME_EMAIL"),
+	HostPolicy: func(ctx context.Context, host string) error {
+		org, err := lookupOrg(strings.ToLower(host))
+		if err != nil {
+			return err
+		}
+		if org == nil {
+			return errors.New("no organization for " + host)
+		}
+
+		return nil
+	},
+}
+
+// validateOrganization checks the fields an admin can set.
+func validateOrganization(o *db.Organization) error {
+	if o.Name == "" {
+		return errors.New("Name Required.")
+	}
+	if !slugPattern.MatchString(o.Slug) {
+		return errors.New("Slug must be lower case letters, numbers and dashes.")
+	}
+
+	for _, color := range []string{o.Branding.PrimaryColor, o.Branding.AccentColor} {
+		if color != "" && !colorPattern.MatchString(color) {
+			return errors.New("Colors must be hex values, e.g. #1a2b3c.")
+		}
+	}
+
+	for i, domain := range o.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			return errors.New("Invalid domain " + o.Domains[i])
+		}
+		o.Domains[i] = domain
+	}
+
+	return validateInvoiceDetails(&o.Invoice)
+}
+
+// GET /admin/organizations, Lists white labeled organizations
+func AdminOrganizationsHandler(rw http.ResponseWriter, req *http.Request) {
+	orgs, err := db.GetOrganizations()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":        requests.StatusFound,
+		"organizations": orgs,
+	})
+}
+
+// PUT /admin/organizations/{slug}, Creates or updates an organization's domains and branding
+func UpdateOrganizationHandler(rw http.ResponseWriter, req *http.Request) {
+	slug := mux.Vars(req)["slug"]
+
+	var body db.Organization
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	o, err := db.GetOrganization(bson.M{"slug": slug})
+	if err != nil && err != db.ErrNotFound {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err == db.ErrNotFound {
+		o = &db.Organization{Slug: slug}
+	}
+	o.Name = body.Name
+	o.Domains = body.Domains
+	o.Branding = body.Branding
+	o.Invoice = body.Invoice
+
+	if err := validateOrganization(o); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := db.SaveOrganization(o); err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	// Wallets only show on domains verified with Apple Pay.
+	go registerWalletDomains(o.Domains)
+
+	// Other instances pick up the change when their cache expires.
+	orgMutex.Lock()
+	orgCache = map[string]*orgCacheEntry{}
+	orgMutex.Unlock()
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "organization.update", actor, o.Slug+" "+strings.Join(o.Domains, ","))
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusUpdated,
+		"organization": o,
+	})
+}
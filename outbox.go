@@ -0,0 +1,219 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the worker that performs outbox messages, the side effects saved
+// alongside developer writes.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// Outbox message kinds.
+const (
+	outboxSubscribe    = "mailchimp.subscribe"
+	outboxWelcomeEmail = "email.welcome"
+	outboxSlackSignup  = "slack.signup"
+	outboxWinBackEmail = "email.winback"
+)
+
+const (
+	// Messages performed per run of the worker.
+	outboxBatchSize = 50
+
+	// How long a worker holds a message while performing it.
+	outboxLease = 2 * time.Minute
+
+	// Attempts before a message is marked failed.
+	outboxMaxAttempts = 8
+)
+
+// outboxHandlers perform each kind of message for the developer it belongs to.
+var outboxHandlers = map[string]func(*db.OutboxMessage, *schemas.Developer) error{
+	outboxSubscribe: func(m *db.OutboxMessage, d *schemas.Developer) error {
+		listID, _ := m.Payload["listId"].(string)
+		return subscribe(context.Background(), listID, d.Email)
+	},
+	outboxWelcomeEmail: func(m *db.OutboxMessage, d *schemas.Developer) error {
+		engineerName, _ := m.Payload["engineerName"].(string)
+		engineerEmail, _ := m.Payload["engineerEmail"].(string)
+
+		message, err := RenderEmail("welcome", map[string]interface{}{
+			"name": strings.Split(d.Name, " ")[0],
+			"engineer": map[string]string{
+				"Name":  engineerName,
+				"Email": engineerEmail,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		return sendEmailOnce(notificationKey(m.Kind, d.Email), gochimp.Message{
+			Subject:   "Welcome to Bowery!",
+			FromEmail: "hello@bowery.io",
+			FromName:  engineerName,
+			To: []gochimp.Recipient{{
+				Email: d.Email,
+				Name:  d.Name,
+			}},
+			Html: message,
+		})
+	},
+	outboxSlackSignup: func(m *db.OutboxMessage, d *schemas.Developer) error {
+		notifySlackOnce(notificationKey(m.Kind, d.Email), slackChannel("activity"), d.Name+" "+d.Email+" just signed up.")
+		return nil
+	},
+	outboxWinBackEmail: sendWinBackEmail,
+}
+
+func init() {
+	schedule("outbox", 10*time.Second, processOutbox)
+}
+
+// outboxBackoff returns the wait before retrying a message.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 6 {
+		return time.Hour
+	}
+
+	return time.Minute << uint(attempts)
+}
+
+// processOutbox moves messages saved with developers into the outbox, then
+// performs due messages.
+func processOutbox() error {
+	if _, err := db.DrainDeveloperOutboxes(outboxBatchSize); err != nil {
+		return err
+	}
+
+	for i := 0; i < outboxBatchSize; i++ {
+		m, err := db.ClaimOutboxMessage(outboxLease)
+		if err == db.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := performOutboxMessage(m); err == db.ErrConflict {
+			fmt.Println("outbox message", m.ID.Hex(), "was claimed again before it finished")
+		} else if err != nil {
+			fmt.Println("unable to update outbox message", m.ID.Hex(), err)
+		}
+	}
+
+	return nil
+}
+
+// performOutboxMessage runs a claimed message and records the outcome. The
+// outcome is only recorded while the claim still holds the message.
+func performOutboxMessage(m *db.OutboxMessage) error {
+	d, err := db.GetDeveloper(bson.M{"_id": m.DeveloperID})
+	if err == db.ErrNotFound {
+		// Messages are saved with their developer, so it's since been deleted.
+		return db.FinishOutboxMessage(m, bson.M{"status": db.OutboxDiscarded})
+	}
+
+	if err == nil {
+		handler, ok := outboxHandlers[m.Kind]
+		if !ok {
+			err = errors.New("unknown outbox message kind " + m.Kind)
+		} else {
+			err = handler(m, d)
+		}
+	}
+
+	step, inSaga := sagaSteps[m.Kind]
+	if err == nil {
+		if inSaga {
+			if err := completeSagaStep(m.DeveloperID, step); err != nil && err != db.ErrNotFound {
+				fmt.Println("unable to update signup saga", m.DeveloperID.Hex(), err)
+			}
+		}
+
+		return db.FinishOutboxMessage(m, bson.M{
+			"status":   db.OutboxDone,
+			"attempts": m.Attempts + 1,
+			"doneAt":   time.Now(),
+		})
+	}
+
+	update := bson.M{
+		"status":        db.OutboxPending,
+		"attempts":      m.Attempts + 1,
+		"lastError":     err.Error(),
+		"nextAttemptAt": time.Now().Add(outboxBackoff(m.Attempts)),
+	}
+	if m.Attempts+1 >= outboxMaxAttempts {
+		update["status"] = db.OutboxFailed
+		if inSaga {
+			if serr := failSagaStep(m.DeveloperID, step, err); serr != nil && serr != db.ErrNotFound {
+				fmt.Println("unable to undo signup", m.DeveloperID.Hex(), serr)
+			}
+		}
+	}
+
+	return db.FinishOutboxMessage(m, update)
+}
+
+// GET /admin/outbox, Lists outbox messages, failed ones by default
+func AdminOutboxHandler(rw http.ResponseWriter, req *http.Request) {
+	status := req.FormValue("status")
+	if status == "" {
+		status = db.OutboxFailed
+	}
+
+	ms, err := db.GetOutboxMessages(bson.M{"status": status}, 100)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"messages": ms,
+	})
+}
+
+// PUT /admin/outbox/{id}/retry, Queues a failed message to be performed again
+func RetryOutboxHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid message id",
+		})
+		return
+	}
+
+	err := db.UpdateOutboxMessage(bson.ObjectIdHex(id), bson.M{
+		"status":        db.OutboxPending,
+		"attempts":      0,
+		"nextAttemptAt": time.Now(),
+	})
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
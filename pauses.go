@@ -0,0 +1,276 @@
+// Copyright 2014 Bowery, Inc.
+// Contains pausing subscriptions. A paused developer isn't charged and is
+// entitled to a limited mode until their pause ends, when they're resumed
+// automatically with the paid time they had left. The pause is kept on the
+// developer and on their Stripe customer's metadata, and they're emailed a
+// few days before it ends.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Months a subscription can be paused for.
+	minPauseMonths = 1
+	maxPauseMonths = 3
+
+	// How long before a pause ends developers are reminded.
+	pauseReminderBefore = 3 * 24 * time.Hour
+
+	// Paused developers handled by a single run of the resume job.
+	resumeBatch = 200
+)
+
+func init() {
+	schedule("resume-paused-developers", 10*time.Minute, resumePausedDevelopers)
+}
+
+// pausedExpiration returns a developer's expiration once paused from now
+// until end, pushed out by the pause so they keep the time they paid for.
+func pausedExpiration(expiration, now, end time.Time) time.Time {
+	if expiration.Before(now) {
+		return end
+	}
+
+	return expiration.Add(end.Sub(now))
+}
+
+// resumedExpiration returns a paused developer's expiration once resumed at
+// now, taking back the part of the pause they didn't use.
+func resumedExpiration(expiration, now, end time.Time) time.Time {
+	if now.After(end) {
+		return expiration
+	}
+
+	return expiration.Add(-end.Sub(now))
+}
+
+// setStripePause records a pause on a developer's Stripe customer, clearing
+// it if until is zero.
+func setStripePause(ctx context.Context, d *schemas.Developer, until time.Time) error {
+	customer, err := db.GetStripeCustomer(d.ID, db.BillingPause)
+	if err != nil || customer == "" {
+		return err
+	}
+	value := ""
+	if !until.IsZero() {
+		value = until.UTC().Format(time.RFC3339)
+	}
+
+	params := url.Values{"metadata[paused_until]": {value}}
+	return callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/customers/"+url.PathEscape(customer), params, "", &struct{}{})
+	})
+}
+
+// resumeDeveloper ends a developer's pause at now.
+func resumeDeveloper(ctx context.Context, d *schemas.Developer, now time.Time) error {
+	end, err := db.GetPauseEnd(d.ID)
+	if err != nil {
+		return err
+	}
+	if err := setStripePause(ctx, d, time.Time{}); err != nil {
+		return err
+	}
+
+	d.Expiration = resumedExpiration(d.Expiration, now, end)
+	return transitionDeveloper(d, db.LifecycleActive, bson.M{"expiration": d.Expiration, "resumedAt": now})
+}
+
+// resumePausedDevelopers resumes developers whose pause has ended and
+// reminds those whose pause ends soon.
+func resumePausedDevelopers() error {
+	now := time.Now()
+	docs, err := db.GetPausedDevelopers(now.Add(pauseReminderBefore), resumeBatch)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		id, _ := doc["_id"].(bson.ObjectId)
+		end, _ := doc["pauseEndsAt"].(time.Time)
+		d, err := db.GetDeveloper(bson.M{"_id": id})
+		if err != nil {
+			fmt.Println("unable to get paused developer", id.Hex(), err)
+			continue
+		}
+
+		if end.After(now) {
+			if err := sendPauseReminder(d, end); err != nil {
+				fmt.Println("unable to remind", d.Email, "of their pause ending", err)
+			}
+			continue
+		}
+
+		if err := resumeDeveloper(context.Background(), d, end); err != nil {
+			fmt.Println("unable to resume", d.Email, err)
+			continue
+		}
+		track("subscription.resumed", d, map[string]interface{}{"automatic": true})
+	}
+
+	return nil
+}
+
+// sendPauseReminder emails a developer that their pause ends soon, once a
+// pause.
+func sendPauseReminder(d *schemas.Developer, end time.Time) error {
+	message, err := RenderEmail("pause_reminder_email", map[string]interface{}{
+		"name":       strings.Split(d.Name, " ")[0],
+		"token":      d.Token,
+		"resumesAt":  end.Format("January 2, 2006"),
+		"expiration": d.Expiration.Format("January 2, 2006"),
+	})
+	if err != nil {
+		return err
+	}
+
+	key := notificationKey(fmt.Sprintf("email.pause-reminder-%d", end.Unix()), d.Email)
+	return sendEmailOnce(key, gochimp.Message{
+		Subject:   "Your Bowery subscription resumes soon",
+		FromEmail: "hello@bowery.io",
+		FromName:  "Bowery",
+		To: []gochimp.Recipient{{
+			Email: d.Email,
+			Name:  d.Name,
+		}},
+		Html: message,
+	})
+}
+
+// POST /developers/{token}/subscription/pause, Pauses a developer's subscription for 1 to 3 months
+func PauseSubscriptionHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Months int `json:"months"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if body.Months < minPauseMonths || body.Months > maxPauseMonths {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  fmt.Sprintf("months must be between %d and %d", minPauseMonths, maxPauseMonths),
+		})
+		return
+	}
+
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	var state string
+	if err == nil {
+		state, err = developerLifecycle(d)
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if !db.CanTransition(state, db.LifecyclePaused) {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Only active subscriptions can be paused.",
+		})
+		return
+	}
+
+	now := developerNow(d.ID)
+	end := now.AddDate(0, body.Months, 0)
+	err = setStripePause(req.Context(), d, end)
+	if stripeUnavailable(rw, err) {
+		return
+	}
+	if err == nil {
+		d.Expiration = pausedExpiration(d.Expiration, now, end)
+		err = transitionDeveloper(d, db.LifecyclePaused, bson.M{
+			"expiration":  d.Expiration,
+			"pausedAt":    now,
+			"pauseEndsAt": end,
+		})
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := d.Email
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "subscription.paused", actor, fmt.Sprintf("%s for %d months", d.Email, body.Months))
+	track("subscription.paused", d, map[string]interface{}{"months": body.Months})
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusSuccess,
+		"resumesAt":  end,
+		"expiration": d.Expiration,
+	})
+}
+
+// POST /developers/{token}/subscription/resume, Resumes a paused subscription early
+func ResumeSubscriptionHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	var state string
+	if err == nil {
+		state, err = developerLifecycle(d)
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if state != db.LifecyclePaused {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "The subscription isn't paused.",
+		})
+		return
+	}
+
+	err = resumeDeveloper(req.Context(), d, developerNow(d.ID))
+	if stripeUnavailable(rw, err) {
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := d.Email
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "subscription.resumed", actor, d.Email)
+	track("subscription.resumed", d, map[string]interface{}{"automatic": false})
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusSuccess,
+		"expiration": d.Expiration,
+	})
+}
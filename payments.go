@@ -0,0 +1,541 @@
+// Copyright 2014 Bowery, Inc.
+// Contains payments made with Stripe PaymentIntents, which support Strong
+// Customer Authentication. When a bank asks for 3-D Secure the developer is
+// sent to confirm the payment, by redirect when they're paying in the
+// browser or by email when a renewal is charged off session.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// Payments waiting on the developer are checked with Stripe after this, in
+// case they authenticated but never came back.
+const paymentReconcileAfter = 10 * time.Minute
+
+// paymentIntent is the part of a Stripe PaymentIntent broome uses.
+type paymentIntent struct {
+	ID               string          `json:"id"`
+	Status           string          `json:"status"`
+	Amount           int64           `json:"amount"`
+	Currency         string          `json:"currency"`
+	Customer         string          `json:"customer"`
+	PaymentMethod    string          `json:"payment_method"`
+	ClientSecret     string          `json:"client_secret"`
+	LastPaymentError *stripeAPIError `json:"last_payment_error"`
+	NextAction       *struct {
+		Type          string `json:"type"`
+		RedirectToURL *struct {
+			URL string `json:"url"`
+		} `json:"redirect_to_url"`
+	} `json:"next_action"`
+}
+
+// authenticationRequired reports whether an off session payment failed
+// because the bank wants the developer to authenticate it. Stripe leaves
+// these waiting for a payment method rather than an action.
+func (pi *paymentIntent) authenticationRequired() bool {
+	return pi.Status == "requires_payment_method" && pi.LastPaymentError != nil &&
+		pi.LastPaymentError.Code == "authentication_required"
+}
+
+// actionURL returns where the developer authenticates the payment, if the
+// bank asked for it.
+func (pi *paymentIntent) actionURL() string {
+	if pi.NextAction == nil || pi.NextAction.RedirectToURL == nil {
+		return ""
+	}
+
+	return pi.NextAction.RedirectToURL.URL
+}
+
+func init() {
+	schedule("reconcile-payments", paymentReconcileAfter, reconcilePayments)
+}
+
+// paymentReturnURL is where Stripe sends the developer after authenticating.
+func paymentReturnURL(base string, d *schemas.Developer, id string) string {
+	if id == "" {
+		// Stripe doesn't fill in the intent id, it's appended as a query.
+		return base + "/payments/" + d.Token + "/complete"
+	}
+
+	return base + "/payments/" + d.Token + "/" + id + "/complete"
+}
+
+// createStripeCustomer creates a customer for the developer, with their
+// billing address if they've given one.
+func createStripeCustomer(ctx context.Context, d *schemas.Developer) (string, error) {
+	var customer struct {
+		ID string `json:"id"`
+	}
+	params := url.Values{
+		"email":                 {d.Email},
+		"description":           {d.Name},
+		"metadata[developerId]": {d.ID.Hex()},
+	}
+
+	key := "customer-" + d.ID.Hex()
+	if clock := developerTestClock(d.ID); clock != "" {
+		// A new customer on the clock, the old one can't be moved to it.
+		params.Set("test_clock", clock)
+		key += "-" + clock
+	}
+	address, err := db.GetBillingAddress(d.ID)
+	if err != nil {
+		return "", err
+	}
+	if address != nil {
+		// Stripe rejects a reused key with different params.
+		addressParams(params, "address", address)
+		key += "-" + strconv.FormatInt(address.UpdatedAt.Unix(), 10)
+	}
+
+	return customer.ID, callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/customers", params, key, &customer)
+	})
+}
+
+// defaultPaymentMethod returns the card a customer saved for future charges.
+func defaultPaymentMethod(ctx context.Context, customer string) (string, error) {
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+
+	err := callStripe(ctx, func() error {
+		return stripeRequest(ctx, "GET", "/payment_methods?type=card&limit=1&customer="+url.QueryEscape(customer), url.Values{}, "", &list)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(list.Data) == 0 {
+		return "", errors.New("no saved card for customer " + customer)
+	}
+
+	return list.Data[0].ID, nil
+}
+
+// confirmPaymentIntent creates and confirms a PaymentIntent. A payment that
+// needs authentication off session comes back as an error from Stripe, with
+// the intent attached.
+func confirmPaymentIntent(ctx context.Context, params url.Values, key string) (*paymentIntent, error) {
+	params.Set("confirm", "true")
+
+	pi := &paymentIntent{}
+	err := callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/payment_intents", params, key, pi)
+	})
+	if e, ok := err.(*stripeAPIError); ok && e.PaymentIntent != nil {
+		return e.PaymentIntent, nil
+	}
+
+	return pi, err
+}
+
+// chargeCard pays for a plan with a card token collected on session, saving
+// the card for renewals.
+func chargeCard(ctx context.Context, d *schemas.Developer, plan *db.Plan, customer, cardToken, base string) (*paymentIntent, error) {
+	params := url.Values{
+		"amount":                           {strconv.FormatInt(plan.Amount, 10)},
+		"currency":                         {plan.Currency},
+		"description":                      {plan.Description},
+		"customer":                         {customer},
+		"payment_method_data[type]":        {"card"},
+		"payment_method_data[card][token]": {cardToken},
+		"setup_future_usage":               {"off_session"},
+		"return_url":                       {paymentReturnURL(base, d, "")},
+		"metadata[developerId]":            {d.ID.Hex()},
+		"metadata[plan]":                   {plan.Slug},
+	}
+
+	return confirmPaymentIntent(ctx, params, "purchase-"+d.ID.Hex()+"-"+cardToken)
+}
+
+// chargeOffSession renews a plan with the customer's saved card while the
+// developer isn't around. Stripe applies the merchant initiated exemption,
+// and if the bank still wants authentication the intent needs action.
+func chargeOffSession(ctx context.Context, d *schemas.Developer, plan *db.Plan, customer string) (*paymentIntent, error) {
+	pm, err := defaultPaymentMethod(ctx, customer)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{
+		"amount":                {strconv.FormatInt(plan.Amount, 10)},
+		"currency":              {plan.Currency},
+		"description":           {plan.Description},
+		"customer":              {customer},
+		"payment_method":        {pm},
+		"off_session":           {"true"},
+		"metadata[developerId]": {d.ID.Hex()},
+		"metadata[plan]":        {plan.Slug},
+	}
+
+	// One renewal attempt per developer per day, by their clock so a test
+	// clock moved on a day can renew again.
+	key := "renewal-" + d.ID.Hex() + "-" + developerNow(d.ID).UTC().Format("2006-01-02")
+	pi, err := confirmPaymentIntent(ctx, params, key)
+	if pi != nil && pi.PaymentMethod == "" {
+		// Stripe detaches the card when authentication is required, it's
+		// needed to confirm the payment later.
+		pi.PaymentMethod = pm
+	}
+
+	return pi, err
+}
+
+// getPaymentIntent retrieves a PaymentIntent from Stripe.
+func getPaymentIntent(ctx context.Context, id string) (*paymentIntent, error) {
+	pi := &paymentIntent{}
+	return pi, callStripe(ctx, func() error {
+		return stripeRequest(ctx, "GET", "/payment_intents/"+url.PathEscape(id), url.Values{}, "", pi)
+	})
+}
+
+// recordPayment saves the outcome of a PaymentIntent for a developer.
+func recordPayment(d *schemas.Developer, plan *db.Plan, kind, method string, pi *paymentIntent) (*db.Payment, error) {
+	p := &db.Payment{
+		ID:            pi.ID,
+		DeveloperID:   d.ID,
+		Kind:          kind,
+		Plan:          plan.Slug,
+		Amount:        plan.Amount,
+		Currency:      plan.Currency,
+		Method:        method,
+		PaymentMethod: pi.PaymentMethod,
+		Status:        db.PaymentPending,
+	}
+
+	err := db.SavePayment(p)
+	if err == db.ErrDuplicate {
+		// Retried with the same idempotency key, Stripe returned the same intent.
+		return db.GetPayment(pi.ID)
+	}
+
+	return p, err
+}
+
+// settlePayment applies an intent's status to its payment, fulfilling it if
+// it succeeded. It returns the payment's status afterwards.
+func settlePayment(p *db.Payment, pi *paymentIntent) (string, error) {
+	switch pi.Status {
+	case "succeeded":
+		finished, err := db.FinishPayment(p.ID, db.PaymentSucceeded, "")
+		if err != nil || !finished {
+			return db.PaymentSucceeded, err
+		}
+		recordWallet(p, pi)
+		clearPendingPayment(p)
+		queuePaymentSucceeded(p)
+
+		return db.PaymentSucceeded, fulfillPayment(p)
+	case "requires_action", "requires_payment_method":
+		if pi.Status == "requires_payment_method" && !pi.authenticationRequired() {
+			return failPayment(p, pi)
+		}
+
+		if p.Status != db.PaymentRequiresAction {
+			if err := db.UpdatePayment(p.ID, bson.M{"status": db.PaymentRequiresAction}); err != nil {
+				return "", err
+			}
+		}
+
+		return db.PaymentRequiresAction, nil
+	case "processing":
+		if p.Status != db.PaymentProcessing {
+			if err := db.UpdatePayment(p.ID, bson.M{"status": db.PaymentProcessing}); err != nil {
+				return "", err
+			}
+		}
+
+		return db.PaymentProcessing, nil
+	case "canceled":
+		return failPayment(p, pi)
+	}
+
+	return db.PaymentPending, nil
+}
+
+// failPayment records why a payment failed.
+func failPayment(p *db.Payment, pi *paymentIntent) (string, error) {
+	msg := "payment " + pi.Status
+	if pi.LastPaymentError != nil {
+		msg = pi.LastPaymentError.Message
+	}
+
+	finished, err := db.FinishPayment(p.ID, db.PaymentFailed, msg)
+	if finished {
+		clearPendingPayment(p)
+
+		// Failed purchases are shown to the developer as they pay.
+		if p.Kind == db.PaymentRenewal {
+			if err := notifyPaymentFailed(p, msg); err != nil {
+				fmt.Println("unable to notify", p.DeveloperID.Hex(), "of failed payment", p.ID, err)
+			}
+		}
+	}
+
+	return db.PaymentFailed, err
+}
+
+// fulfillPayment gives the developer what they paid for.
+func fulfillPayment(p *db.Payment) error {
+	d, err := db.GetDeveloper(bson.M{"_id": p.DeveloperID})
+	if err != nil {
+		return err
+	}
+	plan, err := db.GetPlan(p.Plan)
+	if err != nil {
+		return err
+	}
+
+	if p.Kind == db.PaymentRenewal {
+		err = renewDeveloper(d)
+	} else {
+		err = markPaid(d, plan)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := notifyReceipt(d, p, plan); err != nil {
+		fmt.Println("unable to send receipt for", p.ID, err)
+	}
+	return nil
+}
+
+// renewDeveloper records a renewal charge.
+func renewDeveloper(d *schemas.Developer) error {
+	d.Expiration = developerNow(d.ID)
+	return transitionDeveloper(d, db.LifecycleActive, bson.M{"expiration": d.Expiration})
+}
+
+// notifyPaymentAction asks the developer to confirm a renewal their bank
+// wants authenticated.
+func notifyPaymentAction(d *schemas.Developer, p *db.Payment, base string) error {
+	message, err := RenderEmail("payment_action_email", map[string]interface{}{
+		"name":     strings.Split(d.Name, " ")[0],
+		"amount":   p.Amount,
+		"currency": p.Currency,
+		"url":      base + "/payments/" + d.Token + "/" + p.ID + "/authenticate",
+	})
+	if err != nil {
+		return err
+	}
+
+	to, err := billingRecipients(d)
+	if err != nil {
+		return err
+	}
+
+	_, err = dispatchNotice(d, &notice{
+		Kind: noticePaymentAction,
+		Key:  notificationKey("payment.action", p.ID),
+		Email: gochimp.Message{
+			Subject:   "Please confirm your Bowery payment",
+			FromEmail: "support@bowery.io",
+			FromName:  "Bowery Support",
+			To:        to,
+			Html:      message,
+		},
+		Text: "Your bank needs you to confirm your Bowery payment of " + formatCurrency(p.Amount, p.Currency) + ", we've emailed you a link.",
+		Data: map[string]interface{}{"payment": p},
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.UpdatePayment(p.ID, bson.M{"actionEmailedAt": time.Now()})
+}
+
+// notifyPaymentFailed tells the developer a renewal failed and where to
+// update their card.
+func notifyPaymentFailed(p *db.Payment, reason string) error {
+	d, err := db.GetDeveloper(bson.M{"_id": p.DeveloperID})
+	if err != nil {
+		return err
+	}
+
+	message, err := RenderEmail("payment_failed_email", map[string]interface{}{
+		"name":     strings.Split(d.Name, " ")[0],
+		"amount":   p.Amount,
+		"currency": p.Currency,
+		"error":    reason,
+		"url":      "https://broome.io/checkout/" + d.Token,
+	})
+	if err != nil {
+		return err
+	}
+
+	to, err := billingRecipients(d)
+	if err != nil {
+		return err
+	}
+
+	_, err = dispatchNotice(d, &notice{
+		Kind: noticePaymentFailed,
+		Key:  notificationKey("payment.failed", p.ID),
+		Email: gochimp.Message{
+			Subject:   "Your Bowery payment failed",
+			FromEmail: "support@bowery.io",
+			FromName:  "Bowery Support",
+			To:        to,
+			Html:      message,
+		},
+		Text: "Your Bowery renewal of " + formatCurrency(p.Amount, p.Currency) + " failed: " + reason,
+		Data: map[string]interface{}{"payment": p, "error": reason},
+	})
+	return err
+}
+
+// reconcilePayments settles payments that were authenticated without the
+// developer coming back to broome.
+func reconcilePayments() error {
+	ps, err := db.GetPayments(bson.M{
+		"status":    bson.M{"$in": db.OpenPaymentStates},
+		"updatedAt": bson.M{"$lt": time.Now().Add(-paymentReconcileAfter)},
+	}, 100)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range ps {
+		pi, err := getPaymentIntent(context.Background(), p.ID)
+		if err == nil {
+			_, err = settlePayment(p, pi)
+		}
+		if err != nil {
+			fmt.Println("unable to reconcile payment", p.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// paymentFor returns the developer's payment named in the request.
+func paymentFor(req *http.Request) (*schemas.Developer, *db.Payment, error) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		return nil, nil, errors.New("Invalid Token")
+	}
+
+	id := mux.Vars(req)["id"]
+	if id == "" {
+		id = req.FormValue("payment_intent")
+	}
+
+	p, err := db.GetPayment(id)
+	if err == db.ErrNotFound || (err == nil && p.DeveloperID != d.ID) {
+		return nil, nil, errors.New("Unknown payment")
+	}
+
+	return d, p, err
+}
+
+// GET /payments/{token}/{id}/authenticate, Sends the developer to their bank to confirm a payment
+func PaymentAuthenticateHandler(rw http.ResponseWriter, req *http.Request) {
+	d, p, err := paymentFor(req)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	if p.Status == db.PaymentSucceeded {
+		http.Redirect(rw, req, paymentReturnURL(baseURL(req), d, p.ID), http.StatusSeeOther)
+		return
+	}
+
+	// Confirming on session lets the bank show its challenge.
+	params := url.Values{"return_url": {paymentReturnURL(baseURL(req), d, p.ID)}}
+	if p.PaymentMethod != "" {
+		params.Set("payment_method", p.PaymentMethod)
+	}
+
+	pi := &paymentIntent{}
+	err = callStripe(req.Context(), func() error {
+		return stripeRequest(req.Context(), "POST", "/payment_intents/"+url.PathEscape(p.ID)+"/confirm", params, "", pi)
+	})
+	if e, ok := err.(*stripeAPIError); ok && e.PaymentIntent != nil {
+		pi, err = e.PaymentIntent, nil
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if u := pi.actionURL(); u != "" {
+		http.Redirect(rw, req, u, http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(rw, req, paymentReturnURL(baseURL(req), d, p.ID), http.StatusSeeOther)
+}
+
+// GET /payments/{token}/{id}/complete, Where the developer returns after authenticating a payment
+func PaymentCompleteHandler(rw http.ResponseWriter, req *http.Request) {
+	_, p, err := paymentFor(req)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	status := p.Status
+	if status == db.PaymentPending || status == db.PaymentRequiresAction || status == db.PaymentProcessing {
+		pi, err := getPaymentIntent(req.Context(), p.ID)
+		if err == nil {
+			status, err = settlePayment(p, pi)
+		}
+		if err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+	}
+
+	switch status {
+	case db.PaymentSucceeded:
+		if err := RenderTemplate(rw, "thanks", map[string]interface{}{"org": orgFor(req)}); err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		}
+	case db.PaymentFailed:
+		RenderTemplate(rw, "error", map[string]string{"Error": "Your payment couldn't be completed, please try another card."})
+	default:
+		RenderTemplate(rw, "error", map[string]string{"Error": "Your payment is still processing, please check back in a few minutes."})
+	}
+}
+
+// GET /admin/payments, Lists payments waiting on the developer by default
+func AdminPaymentsHandler(rw http.ResponseWriter, req *http.Request) {
+	status := req.FormValue("status")
+	if status == "" {
+		status = db.PaymentRequiresAction
+	}
+
+	ps, err := db.GetPayments(bson.M{"status": status}, 100)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"payments": ps,
+	})
+}
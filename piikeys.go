@@ -0,0 +1,91 @@
+// Copyright 2014 Bowery, Inc.
+// Contains loading the keys developers' emails, names and billing addresses
+// are sealed with. Like the billing key, in production they're data keys
+// wrapped by AWS KMS and unwrapped once at startup. The first of
+// PII_DATA_KEYS seals new values, the rest are keys rotated out that values
+// can still be opened with until encrypt-pii rewraps them.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/env"
+)
+
+var (
+	piiDataKeys      = os.Getenv("PII_DATA_KEYS")
+	piiIndexDataKey  = os.Getenv("PII_INDEX_DATA_KEY")
+	piiPlainKeys     = os.Getenv("PII_KEYS")
+	piiPlainIndexKey = os.Getenv("PII_INDEX_KEY")
+)
+
+// loadPIIKeys sets the keys PII is sealed with from the environment.
+// Without them PII is stored as is, which is only allowed outside
+// production.
+func loadPIIKeys() error {
+	keys, index := piiDataKeys, piiIndexDataKey
+	unwrap := func(wrapped string) ([]byte, error) {
+		data, err := base64.StdEncoding.DecodeString(wrapped)
+		if err != nil {
+			return nil, errors.New("PII data keys must be base64")
+		}
+		return kmsDecrypt(data)
+	}
+	switch {
+	case piiDataKeys != "":
+	case piiPlainKeys != "" && !env.Current.Production:
+		keys, index = piiPlainKeys, piiPlainIndexKey
+		unwrap = func(plain string) ([]byte, error) {
+			return base64.StdEncoding.DecodeString(plain)
+		}
+	case env.Current.Production:
+		return errors.New("PII_DATA_KEYS must be set in production")
+	default:
+		fmt.Println("no PII keys, emails, names and billing addresses are stored unencrypted")
+		return nil
+	}
+	if index == "" {
+		return errors.New("the PII index key must be set with the PII keys")
+	}
+
+	current := ""
+	byID := map[string][]byte{}
+	for _, wrapped := range splitKeys(keys) {
+		key, err := unwrap(wrapped)
+		if err != nil {
+			return err
+		}
+		if len(key) != 32 {
+			return errors.New("PII keys must be 32 bytes")
+		}
+
+		id := wrappedKeyID(wrapped)
+		if current == "" {
+			current = id
+		}
+		byID[id] = key
+	}
+
+	indexKey, err := unwrap(index)
+	if err != nil {
+		return err
+	}
+	if len(indexKey) < 32 {
+		return errors.New("the PII index key must be at least 32 bytes")
+	}
+
+	return db.SetPIIKeys(current, byID, indexKey)
+}
+
+// wrappedKeyID returns the id a key is known by, the hash of its wrapped
+// form, which is safe to store alongside what it seals.
+func wrappedKeyID(wrapped string) string {
+	sum := sha256.Sum256([]byte(wrapped))
+	return hex.EncodeToString(sum[:8])
+}
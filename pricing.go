@@ -0,0 +1,175 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for plans and pricing.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// GET /pricing.json, Lists the active plans for the pricing page
+func PricingHandler(rw http.ResponseWriter, req *http.Request) {
+	active, err := activePlans()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"plans":  active,
+	})
+}
+
+// GET /pricing, Renders the public pricing page, or the variant the
+// visitor is assigned to by a pricing experiment
+func PricingPageHandler(rw http.ResponseWriter, req *http.Request) {
+	active, err := activePlans()
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderTemplate(rw, experimentTemplate(rw, req, "pricing"), map[string]interface{}{
+		"Plans": active,
+		"org":   orgFor(req),
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// activePlans returns the plans currently offered to the public.
+func activePlans() ([]*db.Plan, error) {
+	ps, err := db.GetPlans(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	active := []*db.Plan{}
+	for _, p := range ps {
+		if p.Active {
+			active = append(active, p)
+		}
+	}
+
+	return active, nil
+}
+
+// GET /admin/pricing, Admin editor for plans with their change history
+func AdminPricingHandler(rw http.ResponseWriter, req *http.Request) {
+	ps, err := db.GetPlans(bson.M{})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	changes, err := db.GetPlanChanges(bson.M{}, 50)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderAdminTemplate(rw, "pricing", map[string]interface{}{
+		"Plans":   ps,
+		"Changes": changes,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// PUT /admin/pricing/{slug}, Creates or edits a plan
+func UpdatePlanHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	p, err := db.GetPlan(mux.Vars(req)["slug"])
+	if err != nil {
+		p = &db.Plan{Slug: mux.Vars(req)["slug"], Currency: "usd"}
+	}
+
+	for field, dest := range map[string]*string{
+		"name":        &p.Name,
+		"description": &p.Description,
+		"currency":    &p.Currency,
+		"interval":    &p.Interval,
+	} {
+		if val := req.FormValue(field); val != "" {
+			*dest = val
+		}
+	}
+
+	if amount := req.FormValue("amount"); amount != "" {
+		p.Amount, err = strconv.ParseInt(amount, 10, 64)
+		if err != nil || p.Amount <= 0 {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "invalid amount",
+			})
+			return
+		}
+	}
+
+	if order := req.FormValue("order"); order != "" {
+		p.Order, _ = strconv.Atoi(order)
+	}
+
+	if active := req.FormValue("active"); active != "" {
+		p.Active = active == "on" || active == "true"
+	}
+
+	if _, ok := req.Form["features"]; ok {
+		p.Features = []string{}
+		for _, f := range strings.Split(req.FormValue("features"), "\n") {
+			if f = strings.TrimSpace(f); f != "" {
+				p.Features = append(p.Features, f)
+			}
+		}
+	}
+
+	if p.Name == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Name Required.",
+		})
+		return
+	}
+	if p.Amount <= 0 {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Amount Required.",
+		})
+		return
+	}
+
+	changedBy := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		changedBy = dev.Email
+	}
+
+	if err := db.SavePlan(p, changedBy); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"plan":   p,
+	})
+}
@@ -0,0 +1,314 @@
+// Copyright 2014 Bowery, Inc.
+// Contains synthetic probes. Every few minutes a reserved developer signs
+// up, logs in, fetches /developers/me and, with test Stripe keys, pays,
+// all through this server's own HTTP API. Each run is kept for
+// /admin/probes and tracked as events, and a step that starts failing or
+// gets much slower than usual is posted to Slack.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/env"
+	"github.com/Bowery/gopackages/requests"
+)
+
+const (
+	// How often the probe runs.
+	probeInterval = 5 * time.Minute
+
+	// How long each step can take before it fails.
+	probeTimeout = 30 * time.Second
+
+	// A step is slow once it takes this many times its median over recent
+	// passing runs, and at least probeSlowMin.
+	probeSlowFactor = 3
+	probeSlowMin    = time.Second
+
+	// Runs the median is taken over, and shown on the admin page.
+	probeHistory = 12
+)
+
+// Probe steps, in the order they run.
+const (
+	probeSignup  = "signup"
+	probeLogin   = "login"
+	probeMe      = "me"
+	probePayment = "payment"
+)
+
+var (
+	// probeEmail is the reserved developer, removed before each run. It's
+	// a bowery.io address so signing up sends no emails.
+	probeEmail = "probe@bowery.io"
+
+	// probeURL is where the server is reached from itself.
+	probeURL = "http://localhost" + serverPort()
+)
+
+func init() {
+	if email := os.Getenv("PROBE_EMAIL"); email != "" {
+		probeEmail = email
+	}
+	if url := os.Getenv("PROBE_URL"); url != "" {
+		probeURL = strings.TrimRight(url, "/")
+	}
+
+	schedule("synthetic-probes", probeInterval, runProbes)
+}
+
+// probeClient is the probe's HTTP client.
+var probeClient = &http.Client{Timeout: probeTimeout}
+
+// probeCall makes a JSON request to the server, decoding the response into
+// res and failing unless it's a 200.
+func probeCall(method, path string, body, res interface{}) (int, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest(method, probeURL+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "broome-probe")
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var failed struct {
+		Error string `json:"error"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&failed)
+		if failed.Error == "" {
+			failed.Error = http.StatusText(resp.StatusCode)
+		}
+		// The path isn't given, it can hold the probe's token.
+		return resp.StatusCode, fmt.Errorf("responded with %d: %s", resp.StatusCode, failed.Error)
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(res)
+}
+
+// probePayments reports whether the payment step runs, only with test
+// Stripe keys so the probe never charges a card.
+func probePayments() bool {
+	return strings.HasPrefix(env.Current.StripeSecretKey, "sk_test_")
+}
+
+// probe runs each step in turn against the server, skipping those after a
+// failure.
+func probe() (*db.ProbeRun, error) {
+	if err := db.RemoveProbeDeveloper(probeEmail); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	password := hex.EncodeToString(secret)
+
+	var token string
+	steps := []struct {
+		name string
+		run  func() (int, error)
+	}{
+		{probeSignup, func() (int, error) {
+			var res struct {
+				Status string `json:"status"`
+			}
+			code, err := probeCall("POST", "/developers/cli", map[string]string{
+				"name": "Synthetic Probe", "email": probeEmail, "password": password,
+			}, &res)
+			if err == nil && res.Status != requests.StatusCreated {
+				err = errors.New("signup responded " + res.Status)
+			}
+			return code, err
+		}},
+		{probeLogin, func() (int, error) {
+			var res struct {
+				Token string `json:"token"`
+			}
+			code, err := probeCall("POST", "/developers/token", map[string]string{
+				"email": probeEmail, "password": password,
+			}, &res)
+			if err == nil && res.Token == "" {
+				err = errors.New("login responded without a token")
+			}
+			token = res.Token
+			return code, err
+		}},
+		{probeMe, func() (int, error) {
+			var res struct {
+				Developer struct {
+					Email string `json:"email"`
+				} `json:"developer"`
+			}
+			code, err := probeCall("GET", "/developers/me?token="+token, nil, &res)
+			if err == nil && res.Developer.Email != probeEmail {
+				err = errors.New("/developers/me responded with another developer")
+			}
+			return code, err
+		}},
+		{probePayment, func() (int, error) {
+			var res struct {
+				Status string `json:"status"`
+			}
+			code, err := probeCall("POST", "/developers/"+token+"/pay", map[string]string{"stripeToken": "tok_visa"}, &res)
+			if err == nil && res.Status != requests.StatusSuccess {
+				err = errors.New("payment responded " + res.Status)
+			}
+			return code, err
+		}},
+	}
+
+	run := &db.ProbeRun{Passed: true, Instance: instanceID}
+	for _, s := range steps {
+		step := &db.ProbeStep{Name: s.name, Status: db.ProbeSkipped}
+		run.Steps = append(run.Steps, step)
+		if !run.Passed || (s.name == probePayment && !probePayments()) {
+			continue
+		}
+
+		start := time.Now()
+		code, err := s.run()
+		step.Millis = int64(time.Since(start) / time.Millisecond)
+		step.HTTPCode = code
+		step.Status = db.ProbePassed
+		if err != nil {
+			step.Status = db.ProbeFailed
+			step.Error = redactString(err.Error())
+			run.Passed = false
+		}
+	}
+
+	return run, nil
+}
+
+// medianMillis returns the median duration of a step over passing runs, 0
+// if it hasn't passed in any.
+func medianMillis(history []*db.ProbeRun, name string) int64 {
+	ms := []int{}
+	for _, r := range history {
+		if s := r.Step(name); s != nil && s.Status == db.ProbePassed {
+			ms = append(ms, int(s.Millis))
+		}
+	}
+	if len(ms) == 0 {
+		return 0
+	}
+	sort.Ints(ms)
+
+	return int64(ms[len(ms)/2])
+}
+
+// probeRegressions marks a run's slow steps and returns what got worse
+// since the newest run in history: steps that failed after passing and
+// steps that turned slow.
+func probeRegressions(history []*db.ProbeRun, run *db.ProbeRun) []string {
+	regressions := []string{}
+	var last *db.ProbeRun
+	if len(history) > 0 {
+		last = history[0]
+	}
+
+	for _, s := range run.Steps {
+		var prev *db.ProbeStep
+		if last != nil {
+			prev = last.Step(s.Name)
+		}
+
+		if s.Status == db.ProbeFailed {
+			if prev == nil || prev.Status != db.ProbeFailed {
+				regressions = append(regressions, fmt.Sprintf("%s failed: %s", s.Name, s.Error))
+			}
+			continue
+		}
+		if s.Status != db.ProbePassed {
+			continue
+		}
+
+		median := medianMillis(history, s.Name)
+		took := time.Duration(s.Millis) * time.Millisecond
+		s.Slow = median > 0 && s.Millis >= median*probeSlowFactor && took >= probeSlowMin
+		if s.Slow && (prev == nil || !prev.Slow) {
+			regressions = append(regressions, fmt.Sprintf("%s took %s, usually %s", s.Name, took, time.Duration(median)*time.Millisecond))
+		}
+	}
+
+	return regressions
+}
+
+// runProbes runs the probe, records it and alerts on regressions.
+func runProbes() error {
+	history, err := db.GetProbeRuns(nil, probeHistory)
+	if err != nil {
+		return err
+	}
+	run, err := probe()
+	if err != nil {
+		return err
+	}
+	regressions := probeRegressions(history, run)
+	if err := db.SaveProbeRun(run); err != nil {
+		return err
+	}
+
+	for _, s := range run.Steps {
+		track("probe.step", nil, map[string]interface{}{
+			"step": s.Name, "status": s.Status, "millis": s.Millis, "slow": s.Slow,
+		})
+	}
+	if len(regressions) > 0 {
+		notifySlack(slackChannel("alerts"), "Synthetic probe regressed: "+strings.Join(regressions, "; "))
+	}
+	if !run.Passed {
+		return errors.New("probe failed")
+	}
+
+	return nil
+}
+
+// GET /admin/probes, Shows recent synthetic probe runs and each step's median
+func AdminProbesHandler(rw http.ResponseWriter, req *http.Request) {
+	runs, err := db.GetProbeRuns(nil, probeHistory)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	medians := map[string]int64{}
+	for _, name := range []string{probeSignup, probeLogin, probeMe, probePayment} {
+		medians[name] = medianMillis(runs, name)
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"email":   probeEmail,
+		"url":     probeURL,
+		"medians": medians,
+		"runs":    runs,
+	})
+}
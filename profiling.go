@@ -0,0 +1,109 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the pprof endpoints for profiling a running server. They're off
+// unless the "pprof" feature is enabled in the settings, and only admins can
+// use them.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime/pprof"
+
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+)
+
+// Feature flag that turns profiling on.
+const pprofFeature = "pprof"
+
+func init() {
+	// PPROF_ADDR serves the profiles on an internal address as well, e.g.
+	// localhost:6060 for use over an ssh tunnel.
+	if addr := os.Getenv("PPROF_ADDR"); addr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/debug/pprof/", pprofEnabled(httppprof.Index))
+			mux.HandleFunc("/debug/pprof/cmdline", pprofEnabled(httppprof.Cmdline))
+			mux.HandleFunc("/debug/pprof/profile", pprofEnabled(httppprof.Profile))
+			mux.HandleFunc("/debug/pprof/symbol", pprofEnabled(httppprof.Symbol))
+			mux.HandleFunc("/debug/pprof/trace", pprofEnabled(httppprof.Trace))
+
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				fmt.Println("unable to serve pprof on", addr, err)
+			}
+		}()
+	}
+}
+
+// pprofEnabled only calls handler while profiling is turned on.
+func pprofEnabled(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !featureEnabled(pprofFeature) {
+			renderer.JSON(rw, http.StatusNotFound, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "profiling is disabled",
+			})
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+// GET /admin/debug/pprof, Lists the available profiles
+func PprofIndexHandler(rw http.ResponseWriter, req *http.Request) {
+	pprofEnabled(func(rw http.ResponseWriter, req *http.Request) {
+		// Profiles must finish inside the server write timeout.
+		profiles := map[string]string{
+			"profile": "/admin/debug/pprof/profile?seconds=20",
+			"trace":   "/admin/debug/pprof/trace?seconds=5",
+			"cmdline": "/admin/debug/pprof/cmdline",
+		}
+		for _, p := range pprof.Profiles() {
+			profiles[p.Name()] = "/admin/debug/pprof/" + p.Name()
+		}
+
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status":   requests.StatusFound,
+			"profiles": profiles,
+		})
+	})(rw, req)
+}
+
+// GET /admin/debug/pprof/{profile}, Downloads a profile
+func PprofHandler(rw http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["profile"]
+
+	var handler http.HandlerFunc
+	switch name {
+	case "cmdline":
+		handler = httppprof.Cmdline
+	case "profile":
+		handler = httppprof.Profile
+	case "symbol":
+		handler = httppprof.Symbol
+	case "trace":
+		handler = httppprof.Trace
+	default:
+		if pprof.Lookup(name) == nil {
+			renderer.JSON(rw, http.StatusNotFound, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "unknown profile " + name,
+			})
+			return
+		}
+		handler = httppprof.Handler(name).ServeHTTP
+	}
+
+	pprofEnabled(func(rw http.ResponseWriter, req *http.Request) {
+		actor := ""
+		if dev, err := currentDeveloper(req); err == nil {
+			actor = dev.Email
+		}
+		audit(req, "pprof", actor, name)
+
+		handler(rw, req)
+	})(rw, req)
+}
@@ -0,0 +1,206 @@
+// Copyright 2014 Bowery, Inc.
+// Contains daily API quotas. Calls made with a developer's token are counted
+// per day, and once the quota for their plan is used up requests get a 429
+// until the day rolls over in UTC.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// quotaCounterTTL keeps a day's count around long enough to report on it
+// after the day is over.
+const quotaCounterTTL = 48 * time.Hour
+
+// quotaCaller is who a request counts against, by token or by email for
+// requests made with a password.
+type quotaCaller struct {
+	query bson.M
+	key   string
+}
+
+// apiCaller returns who a request counts against, nil if it has no
+// credentials.
+func apiCaller(req *http.Request) *quotaCaller {
+	token := ""
+	if user, pass, ok := req.BasicAuth(); ok {
+		if pass != "" {
+			return &quotaCaller{query: bson.M{"email": user}, key: quotaKey("email:" + user)}
+		}
+		token = user
+	}
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+	if token == "" {
+		token = mux.Vars(req)["token"]
+	}
+	if token == "" {
+		return nil
+	}
+
+	return &quotaCaller{query: bson.M{"token": token}, key: quotaKey(token)}
+}
+
+// quotaKey is the counter key for a caller. Tokens are hashed so they
+// aren't stored in the counters.
+func quotaKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "quota:" + hex.EncodeToString(sum[:16])
+}
+
+// quotaFor returns the daily quota for a plan, 0 meaning unlimited.
+// Developers without a plan slug use the free or paid quota.
+func quotaFor(plan string, paid bool) int {
+	quotas := getSettings().Quotas
+	if quota, ok := quotas[plan]; ok && plan != "" {
+		return quota
+	}
+	if paid {
+		return quotas["paid"]
+	}
+
+	return quotas["free"]
+}
+
+// quotaWindow returns the start of the day now is in and when it resets.
+func quotaWindow(now time.Time) (time.Time, time.Time) {
+	start := now.UTC().Truncate(24 * time.Hour)
+	return start, start.Add(24 * time.Hour)
+}
+
+// setQuotaHeaders tells the caller where they are in their quota.
+func setQuotaHeaders(rw http.ResponseWriter, limit, used int, reset time.Time) {
+	remaining := limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	rw.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+}
+
+// withQuota wraps an API handler so calls are counted against the caller's
+// daily quota. Requests without credentials, or whose developer can't be
+// found, are left to the handler to reject.
+func withQuota(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		caller := apiCaller(req)
+		if caller == nil {
+			handler(rw, req)
+			return
+		}
+
+		plan, paid, err := tenantFor(req).GetDeveloperPlan(caller.query)
+		if err != nil {
+			if err != db.ErrNotFound {
+				fmt.Println("unable to find plan for quota", err)
+			}
+			handler(rw, req)
+			return
+		}
+
+		now := time.Now()
+		start, reset := quotaWindow(now)
+		used, err := db.IncrementCounter(caller.key, start, quotaCounterTTL)
+		if err != nil {
+			// Counting is best effort, a database hiccup doesn't lock out the API.
+			fmt.Println("unable to count request for quota", err)
+			handler(rw, req)
+			return
+		}
+
+		limit := quotaFor(plan, paid)
+		if limit == 0 {
+			handler(rw, req)
+			return
+		}
+
+		setQuotaHeaders(rw, limit, used, reset)
+		if used > limit {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			renderer.JSON(rw, http.StatusTooManyRequests, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "Daily API quota used up, it resets at " + reset.Format(time.RFC3339) + ".",
+			})
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+// GET /developers/me/quota, Gets the developer's API usage today and their quota
+func QuotaHandler(rw http.ResponseWriter, req *http.Request) {
+	caller := apiCaller(req)
+	if caller == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Valid token required.",
+		})
+		return
+	}
+
+	plan, paid, err := tenantFor(req).GetDeveloperPlan(caller.query)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == db.ErrNotFound {
+			status = http.StatusNotFound
+			err = errors.New("Invalid Token.")
+		}
+
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	start, reset := quotaWindow(time.Now())
+	used, err := db.GetCounter(caller.key, start)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if plan == "" {
+		plan = "free"
+		if paid {
+			plan = "paid"
+		}
+	}
+	res := map[string]interface{}{
+		"status":    requests.StatusFound,
+		"plan":      plan,
+		"used":      used,
+		"resetAt":   reset,
+		"unlimited": true,
+	}
+	if limit := quotaFor(plan, paid); limit > 0 {
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		res["unlimited"] = false
+		res["limit"] = limit
+		res["remaining"] = remaining
+		setQuotaHeaders(rw, limit, used, reset)
+	}
+
+	renderer.JSON(rw, http.StatusOK, res)
+}
@@ -0,0 +1,130 @@
+// Copyright 2014 Bowery, Inc.
+// Contains per client rate limiting for public endpoints. Counts are kept in
+// the database so limits hold across instances.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+)
+
+// rateWindow counts a client's requests in the current minute.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// rateLimiter tracks request counts by limit name and client, and the
+// clients already over a shared limit in the current window.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	windows   map[string]*rateWindow
+	exhausted map[string]time.Time
+}
+
+// limiter counts locally when the shared counters can't be reached, and
+// remembers exhausted clients so they aren't counted again.
+var limiter = &rateLimiter{windows: map[string]*rateWindow{}, exhausted: map[string]time.Time{}}
+
+// allowRequest records a request for key against the shared counter for the
+// current minute. That's one findAndModify on the counters collection per
+// request, but only writes (signups, logins, redemptions and the like) are
+// rate limited, never reads. A client over its limit isn't counted again by
+// this instance until the window ends, so a flood costs one write per
+// instance rather than one per request.
+func allowRequest(key string, limit int) bool {
+	now := time.Now()
+	window := now.Truncate(time.Minute)
+	if limiter.isExhausted(key, window) {
+		return false
+	}
+
+	count, err := db.IncrementCounter("rate:"+key, window, 2*time.Minute)
+	if err != nil {
+		fmt.Println("unable to count request for", key, err)
+		return limiter.allow(key, limit, now)
+	}
+
+	if count > limit {
+		limiter.exhaust(key, window)
+		return false
+	}
+
+	return true
+}
+
+// isExhausted reports whether key went over its limit in window.
+func (l *rateLimiter) isExhausted(key string, window time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.exhausted[key].Equal(window)
+}
+
+// exhaust marks key as over its limit for window.
+func (l *rateLimiter) exhaust(key string, window time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Drop past windows so the map doesn't grow with every client seen.
+	if len(l.exhausted) > 10000 {
+		for k, w := range l.exhausted {
+			if w.Before(window) {
+				delete(l.exhausted, k)
+			}
+		}
+	}
+	l.exhausted[key] = window
+}
+
+// allow records a request for key, returning false once limit requests have
+// been made in the current minute.
+func (l *rateLimiter) allow(key string, limit int, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		// Drop expired windows so the map doesn't grow with every client seen.
+		if len(l.windows) > 10000 {
+			for k, old := range l.windows {
+				if now.Sub(old.start) >= time.Minute {
+					delete(l.windows, k)
+				}
+			}
+		}
+
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+
+	if w.count >= limit {
+		return false
+	}
+
+	w.count++
+	return true
+}
+
+// rateLimited wraps a handler with the named limit from the settings, applied
+// per client ip. A limit of 0 disables it.
+func rateLimited(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		limit := rateLimit(name)
+		if limit > 0 && !allowRequest(name+":"+clientIP(req), limit) {
+			rw.Header().Set("Retry-After", "60")
+			renderer.JSON(rw, http.StatusTooManyRequests, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "Too many requests, try again in a minute.",
+			})
+			return
+		}
+
+		handler(rw, req)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2014 Bowery, Inc.
+// Contains redaction, which keeps passwords, tokens, Stripe ids and keys,
+// and card data out of everything that leaves the database: printed logs,
+// audit entries, Keen events, job errors and Slack posts. Structured values
+// are redacted by the names of their fields and free text by the shapes
+// secrets have.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Replaces redacted values.
+const redacted = "REDACTED"
+
+// Field names whose values are always redacted, lowercase without
+// separators.
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"card":          true,
+	"code":          true,
+	"cvc":           true,
+	"cvv":           true,
+	"emailhash":     true,
+	"key":           true,
+	"license":       true,
+	"salt":          true,
+	"tokenhash":     true,
+	"writekey":      true,
+}
+
+// Endings of field names whose values are redacted, e.g. stripeToken or
+// newPassword.
+var sensitiveSuffixes = []string{"token", "password", "secret", "apikey", "signature", "cardnumber"}
+
+// Patterns of secrets in free text, replaced wherever they appear.
+var sensitivePatterns = []*regexp.Regexp{
+	// Stripe keys, and ids of customers, cards and payment methods.
+	regexp.MustCompile(`\b(?:sk|pk|rk)_(?:live|test)_[0-9A-Za-z]+`),
+	regexp.MustCompile(`\b(?:tok|btok|card|pm|src|ba|cus)_[0-9A-Za-z]{8,}`),
+	regexp.MustCompile(`\b(?:pi|seti)_[0-9A-Za-z]+_secret_[0-9A-Za-z]+`),
+	// Authorization header values.
+	regexp.MustCompile(`(?i)\b(?:bearer|basic)\s+[0-9A-Za-z._~+/=-]{8,}`),
+}
+
+var (
+	// A sensitive name followed by its value, e.g. password=hunter2 or
+	// "stripeToken": "cus_123".
+	sensitiveAssignment = regexp.MustCompile(`(?i)\b([a-z_]*(?:password|token|secret|api_?key|signature|salt))(["']?\s*[:=]\s*["']?)([^\s"'&,;}]+)`)
+
+	// Runs of 13 to 19 digits, possibly grouped, that could be card numbers.
+	cardNumber = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+)
+
+// isSensitiveKey reports whether values named key are redacted.
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(strings.NewReplacer("_", "", "-", "", ".", "").Replace(key))
+	if sensitiveKeys[key] {
+		return true
+	}
+	for _, suffix := range sensitiveSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// luhnValid reports whether digits pass the Luhn check card numbers do.
+func luhnValid(digits string) bool {
+	sum := 0
+	for i := range digits {
+		n := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+
+	return sum%10 == 0
+}
+
+// redactString replaces the secrets in free text.
+func redactString(s string) string {
+	for _, pattern := range sensitivePatterns {
+		s = pattern.ReplaceAllString(s, redacted)
+	}
+	s = sensitiveAssignment.ReplaceAllString(s, "${1}${2}"+redacted)
+
+	return cardNumber.ReplaceAllStringFunc(s, func(match string) string {
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(match)
+		if luhnValid(digits) {
+			return redacted
+		}
+		return match
+	})
+}
+
+// redactError returns err with the secrets in its message replaced.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := redactString(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+
+	return errors.New(msg)
+}
+
+// redactMap returns a copy of m with sensitive fields replaced and the
+// rest redacted in turn.
+func redactMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+
+	clean := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		if isSensitiveKey(key) && value != nil && value != "" {
+			clean[key] = redacted
+			continue
+		}
+		clean[key] = redactValue(value)
+	}
+
+	return clean
+}
+
+// redactValue returns v with its secrets replaced. Structs go through JSON,
+// so they're redacted by the names they're serialized with.
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, bson.ObjectId, time.Time:
+		return v
+	case string:
+		return redactString(v)
+	case map[string]interface{}:
+		return redactMap(v)
+	case bson.M:
+		return bson.M(redactMap(v))
+	case []interface{}:
+		clean := make([]interface{}, len(v))
+		for i, item := range v {
+			clean[i] = redactValue(item)
+		}
+		return clean
+	case []string:
+		clean := make([]string, len(v))
+		for i, item := range v {
+			clean[i] = redactString(item)
+		}
+		return clean
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		return v
+	}
+
+	var generic interface{}
+	body, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(body, &generic)
+	}
+	if err != nil {
+		return redacted
+	}
+
+	return redactValue(generic)
+}
+
+// redactQuery returns a query string with sensitive parameters replaced.
+func redactQuery(query url.Values) string {
+	clean := url.Values{}
+	for key, values := range query {
+		if isSensitiveKey(key) {
+			values = []string{redacted}
+		}
+		clean[key] = values
+	}
+
+	return clean.Encode()
+}
+
+// redactPath returns a path with the values of sensitive route variables
+// replaced.
+func redactPath(path string, vars map[string]string) string {
+	for name, value := range vars {
+		if value != "" && isSensitiveKey(name) {
+			path = strings.Replace(path, value, redacted, -1)
+		}
+	}
+
+	return redactString(path)
+}
+
+// redactOutput sends everything printed to stdout through redactString, a
+// line at a time, so no log line can carry a secret.
+func redactOutput() error {
+	out := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	os.Stdout = w
+
+	go func() {
+		lines := bufio.NewReader(r)
+		for {
+			line, err := lines.ReadString('\n')
+			if line != "" {
+				io.WriteString(out, redactString(line))
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "redacted output stopped:", err)
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,432 @@
+// Copyright 2014 Bowery, Inc.
+// Contains refunds and credits issued by admins. Requests above the
+// settings' refundApprovalAmount wait in a queue until a second admin
+// approves them, and only then reach Stripe. Refunds go back to the card,
+// credits go on the customer's Stripe balance for their next invoice.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// maxRefundReason limits the reason, it's sent to Stripe as metadata.
+const maxRefundReason = 500
+
+func init() {
+	scheduleDaily("remind-refund-approvals", 9, remindRefundApprovals)
+}
+
+// refundApprovalAmount returns the amount refunds and credits above need a
+// second admin for, 0 meaning none do.
+func refundApprovalAmount() int64 {
+	return getSettings().RefundApprovalAmount
+}
+
+// refundCharge is what a refund is made against.
+type refundCharge struct {
+	ID          string
+	DeveloperID bson.ObjectId
+	Amount      int64
+	Currency    string
+}
+
+// getRefundCharge returns the succeeded payment or completed checkout with
+// the id.
+func getRefundCharge(id string) (*refundCharge, error) {
+	if p, err := db.GetPayment(id); err == nil {
+		if p.Status != db.PaymentSucceeded {
+			return nil, errors.New("only succeeded payments can be refunded")
+		}
+		return &refundCharge{p.ID, p.DeveloperID, p.Amount, p.Currency}, nil
+	} else if err != db.ErrNotFound {
+		return nil, err
+	}
+
+	c, err := db.GetCheckout(id)
+	if err == db.ErrNotFound {
+		return nil, errors.New("no payment or checkout " + id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Status != db.CheckoutComplete {
+		return nil, errors.New("only completed checkouts can be refunded")
+	}
+	return &refundCharge{c.ID, c.DeveloperID, c.Amount, c.Currency}, nil
+}
+
+// validateRefundRequest checks a request against its charge and what's
+// already been refunded from it.
+func validateRefundRequest(r *db.RefundRequest, charge *refundCharge, refunded int64) error {
+	if r.Kind != db.RefundKindRefund && r.Kind != db.RefundKindCredit {
+		return errors.New("kind must be refund or credit")
+	}
+	if r.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if r.Amount > charge.Amount-refunded {
+		return fmt.Errorf("amount must be at most %d, the unrefunded amount", charge.Amount-refunded)
+	}
+	if strings.TrimSpace(r.Reason) == "" {
+		return errors.New("reason is required")
+	}
+	if len(r.Reason) > maxRefundReason {
+		return fmt.Errorf("reason must be at most %d characters", maxRefundReason)
+	}
+
+	return nil
+}
+
+// chargePaymentIntent returns the PaymentIntent behind a charge, checkouts
+// only have one on the session.
+func chargePaymentIntent(ctx context.Context, id string) (*paymentIntent, error) {
+	if strings.HasPrefix(id, "cs_") {
+		s, err := getCheckoutSession(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		id = s.PaymentIntent
+	}
+
+	return getPaymentIntent(ctx, id)
+}
+
+// executeRefund sends an approved request to Stripe. The request id is the
+// idempotency key so retrying it can't refund twice.
+func executeRefund(ctx context.Context, r *db.RefundRequest) (string, error) {
+	pi, err := chargePaymentIntent(ctx, r.ChargeID)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	key := "refund-request-" + r.ID.Hex()
+	params := url.Values{
+		"metadata[refundRequest]": {r.ID.Hex()},
+		"metadata[requestedBy]":   {r.RequestedBy},
+		"metadata[reason]":        {r.Reason},
+	}
+
+	if r.Kind == db.RefundKindCredit {
+		if pi.Customer == "" {
+			return "", errors.New("payment has no customer to credit")
+		}
+		params.Set("amount", fmt.Sprint(-r.Amount))
+		params.Set("currency", r.Currency)
+		params.Set("description", r.Reason)
+		err = callStripe(ctx, func() error {
+			return stripeRequest(ctx, "POST", "/customers/"+url.PathEscape(pi.Customer)+"/balance_transactions", params, key, &result)
+		})
+		return result.ID, err
+	}
+
+	params.Set("payment_intent", pi.ID)
+	params.Set("amount", fmt.Sprint(r.Amount))
+	err = callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/refunds", params, key, &result)
+	})
+	return result.ID, err
+}
+
+// errOverRefund is returned when other refunds on the charge were approved
+// since a request was made, leaving too little of it to refund.
+var errOverRefund = errors.New("refund is more than is left of the charge")
+
+// checkRefundable checks an approved request still fits in what's left of
+// its charge. Other requests on the charge may have been approved since it
+// was made.
+func checkRefundable(r *db.RefundRequest) error {
+	charge, err := getRefundCharge(r.ChargeID)
+	if err != nil {
+		return err
+	}
+	committed, err := db.CommittedRefundAmount(charge.ID, r.ID)
+	if err != nil {
+		return err
+	}
+	if r.Amount > charge.Amount-committed {
+		return errOverRefund
+	}
+
+	return nil
+}
+
+// runRefund executes an approved request and records the outcome.
+func runRefund(req *http.Request, r *db.RefundRequest, actor string) error {
+	id := ""
+	err := checkRefundable(r)
+	if err == nil {
+		id, err = executeRefund(req.Context(), r)
+	}
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+		r.Status = db.RefundFailed
+		r.Error = msg
+	} else {
+		r.Status = db.RefundExecuted
+		r.StripeID = id
+	}
+	if ferr := db.FinishRefundRequest(r.ID, id, msg); ferr != nil {
+		fmt.Println("unable to record refund", r.ID.Hex(), ferr)
+	}
+
+	audit(req, "refund."+r.Status, actor, fmt.Sprintf("%s %d %s on %s", r.Kind, r.Amount, r.Currency, r.ChargeID))
+	return err
+}
+
+// remindRefundApprovals posts the refunds waiting on a second admin.
+func remindRefundApprovals() error {
+	rs, err := db.GetRefundRequests(bson.M{"status": db.RefundPending}, 100)
+	if err != nil || len(rs) == 0 {
+		return err
+	}
+
+	notifySlack(slackChannel("billing"), fmt.Sprintf("%d refunds are waiting for approval at /admin/refunds", len(rs)))
+	return nil
+}
+
+// POST /admin/refunds, Refunds or credits a payment, queueing it for a second admin above the approval amount
+func CreateRefundHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		ChargeID string `json:"chargeId"`
+		Kind     string `json:"kind"`
+		Amount   int64  `json:"amount"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	r := &db.RefundRequest{
+		Kind:     body.Kind,
+		ChargeID: body.ChargeID,
+		Amount:   body.Amount,
+		Reason:   body.Reason,
+	}
+	if r.Kind == "" {
+		r.Kind = db.RefundKindRefund
+	}
+
+	charge, err := getRefundCharge(r.ChargeID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	refunded, err := db.RefundedAmount(charge.ID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if err := validateRefundRequest(r, charge, refunded); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	// Routes are wrapped in dangerous, so this is the admin in sudo mode.
+	dev, err := currentDeveloper(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusUnauthorized, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	r.DeveloperID = charge.DeveloperID
+	r.Currency = charge.Currency
+	r.RequestedBy = dev.Email
+	r.Status = db.RefundApproved
+	if limit := refundApprovalAmount(); limit > 0 && r.Amount > limit {
+		r.Status = db.RefundPending
+	}
+	if err := db.SaveRefundRequest(r); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if r.Status == db.RefundPending {
+		audit(req, "refund.requested", dev.Email, fmt.Sprintf("%s %d %s on %s", r.Kind, r.Amount, r.Currency, r.ChargeID))
+		go notifySlack(slackChannel("billing"), fmt.Sprintf("%s requested a %s of %d %s on %s: %s. Approve at /admin/refunds/%s/approve",
+			dev.Email, r.Kind, r.Amount, r.Currency, r.ChargeID, r.Reason, r.ID.Hex()))
+
+		renderer.JSON(rw, http.StatusAccepted, map[string]interface{}{
+			"status": requests.StatusCreated,
+			"refund": r,
+		})
+		return
+	}
+
+	if err := runRefund(req, r, dev.Email); err != nil {
+		if stripeUnavailable(rw, err) {
+			return
+		}
+		if err == errOverRefund {
+			renderer.JSON(rw, http.StatusConflict, map[string]interface{}{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+				"refund": r,
+			})
+			return
+		}
+		renderer.JSON(rw, http.StatusBadGateway, map[string]interface{}{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+			"refund": r,
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusCreated, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"refund": r,
+	})
+}
+
+// GET /admin/refunds, Lists refund requests, pending ones by default
+func AdminRefundsHandler(rw http.ResponseWriter, req *http.Request) {
+	status := req.FormValue("status")
+	if status == "" {
+		status = db.RefundPending
+	}
+
+	rs, err := db.GetRefundRequests(bson.M{"status": status}, 100)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"refunds": rs,
+	})
+}
+
+// POST /admin/refunds/{id}/approve, Approves another admin's refund and sends it to Stripe
+func ApproveRefundHandler(rw http.ResponseWriter, req *http.Request) {
+	r, dev, ok := decideRefund(rw, req, db.RefundApproved)
+	if !ok {
+		return
+	}
+
+	if err := runRefund(req, r, dev.Email); err != nil {
+		if stripeUnavailable(rw, err) {
+			return
+		}
+		if err == errOverRefund {
+			renderer.JSON(rw, http.StatusConflict, map[string]interface{}{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+				"refund": r,
+			})
+			return
+		}
+		renderer.JSON(rw, http.StatusBadGateway, map[string]interface{}{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+			"refund": r,
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"refund": r,
+	})
+}
+
+// POST /admin/refunds/{id}/deny, Denies another admin's refund
+func DenyRefundHandler(rw http.ResponseWriter, req *http.Request) {
+	r, _, ok := decideRefund(rw, req, db.RefundDenied)
+	if !ok {
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"refund": r,
+	})
+}
+
+// decideRefund approves or denies a pending request, writing the error
+// response if it can't. Admins can't decide their own.
+func decideRefund(rw http.ResponseWriter, req *http.Request, status string) (*db.RefundRequest, *schemas.Developer, bool) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid refund id",
+		})
+		return nil, nil, false
+	}
+
+	dev, err := sudoAdmin(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusForbidden, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	err = db.DecideRefundRequest(bson.ObjectIdHex(id), status, dev.Email)
+	if err == db.ErrConflict {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Refund isn't pending or was requested by you.",
+		})
+		return nil, nil, false
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	r, err := db.GetRefundRequest(bson.ObjectIdHex(id))
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	audit(req, "refund."+status, dev.Email, fmt.Sprintf("%s %d %s on %s requested by %s",
+		r.Kind, r.Amount, r.Currency, r.ChargeID, r.RequestedBy))
+	return r, dev, true
+}
@@ -0,0 +1,210 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for client release metadata.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// releaseReq is the body sent when publishing a release.
+type releaseReq struct {
+	Version  string `json:"version"`
+	Platform string `json:"platform"`
+	Checksum string `json:"checksum"`
+	URL      string `json:"url"`
+	Notes    string `json:"notes"`
+}
+
+// syncLatestVersion keeps the channel's version policy pointing at the
+// promoted release.
+func syncLatestVersion(c *db.ReleaseChannel) error {
+	p, err := db.GetVersionPolicy(c.Channel)
+	if err != nil {
+		return err
+	}
+
+	p.Latest = c.Version
+	return db.SaveVersionPolicy(p)
+}
+
+// GET /releases/{channel}/latest, Returns the current release for a platform
+func LatestReleaseHandler(rw http.ResponseWriter, req *http.Request) {
+	channel := mux.Vars(req)["channel"]
+	if !db.ValidChannel(channel) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid channel",
+		})
+		return
+	}
+
+	platform := req.FormValue("platform")
+	if platform == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Platform Required.",
+		})
+		return
+	}
+
+	c, err := db.GetReleaseChannel(channel)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	r, err := db.GetRelease(bson.M{"version": c.Version, "platform": platform})
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "no release for " + platform + " on " + channel,
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"release": r,
+	})
+}
+
+// GET /admin/releases, Lists releases and what each channel points at
+func AdminReleasesHandler(rw http.ResponseWriter, req *http.Request) {
+	rs, err := db.GetReleases(bson.M{})
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	channels := []*db.ReleaseChannel{}
+	for _, name := range []string{db.ChannelStable, db.ChannelBeta} {
+		c, err := db.GetReleaseChannel(name)
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		channels = append(channels, c)
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"releases": rs,
+		"channels": channels,
+	})
+}
+
+// POST /admin/releases, Publishes metadata for a release binary
+func CreateReleaseHandler(rw http.ResponseWriter, req *http.Request) {
+	var body releaseReq
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if body.Version == "" || body.Platform == "" || body.Checksum == "" || body.URL == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Version, Platform, Checksum and URL Required.",
+		})
+		return
+	}
+
+	r := &db.Release{
+		Version:  body.Version,
+		Platform: body.Platform,
+		Checksum: body.Checksum,
+		URL:      body.URL,
+		Notes:    body.Notes,
+	}
+	if err := db.SaveRelease(r); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusCreated,
+		"release": r,
+	})
+}
+
+// PUT /admin/releases/{channel}/promote, Points a channel at a version
+func PromoteReleaseHandler(rw http.ResponseWriter, req *http.Request) {
+	channel := mux.Vars(req)["channel"]
+	version := req.FormValue("version")
+	if !db.ValidChannel(channel) || version == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Valid Channel and Version Required.",
+		})
+		return
+	}
+
+	c, err := db.PromoteRelease(channel, version)
+	if err == nil {
+		err = syncLatestVersion(c)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusUpdated,
+		"channel": c,
+	})
+}
+
+// PUT /admin/releases/{channel}/rollback, Restores the previous version
+func RollbackReleaseHandler(rw http.ResponseWriter, req *http.Request) {
+	channel := mux.Vars(req)["channel"]
+	if !db.ValidChannel(channel) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid channel",
+		})
+		return
+	}
+
+	c, err := db.RollbackRelease(channel)
+	if err == nil {
+		err = syncLatestVersion(c)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusUpdated,
+		"channel": c,
+	})
+}
@@ -6,80 +6,208 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/env"
 )
 
 var (
 	TEMPLATE_DIR string = "static"
 )
 
-func execute(name string, data interface{}) (*bytes.Buffer, error) {
-	fmt.Println("executed template", name, "with data:", data)
+// Partials are parsed into every template and included with
+// {{template "name" .}}, where name is the file name without .html.
+const partialsDir = "partials"
+
+// templateCache holds parsed templates by name. Templates are only cached
+// in production so edits show up on reload during development.
+var templateCache = struct {
+	sync.RWMutex
+	templates map[string]*template.Template
+}{templates: map[string]*template.Template{}}
+
+// formatCurrency formats an amount in cents, e.g. 2900 "usd" is "$29.00".
+func formatCurrency(amount int64, currency string) string {
+	symbol := strings.ToUpper(currency) + " "
+	switch strings.ToLower(currency) {
+	case "usd":
+		symbol = "$"
+	case "eur":
+		symbol = "€"
+	case "gbp":
+		symbol = "£"
+	}
 
-	tmplName := name + "-partial"
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%s%d.%02d", sign, symbol, amount/100, amount%100)
+}
 
-	t := template.New(tmplName)
+// templateFuncs are available in every template.
+var templateFuncs = template.FuncMap{
+	// Overwritten per render, declared so templates parse.
+	"yield":   func() (template.HTML, error) { return "", fmt.Errorf("yield called with no layout defined") },
+	"current": func() (string, error) { return "", nil },
+
+	// theme is the deployment's current theme.
+	"theme": getTheme,
+
+	// date formats a time with a Go layout, empty for the zero time.
+	"date": func(t time.Time, layout string) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(layout)
+	},
+
+	"currency": formatCurrency,
+
+	// pluralize picks the singular or plural form for n.
+	"pluralize": func(n int, singular, plural string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, singular)
+		}
+		return fmt.Sprintf("%d %s", n, plural)
+	},
+}
 
+// templatePath returns the location of the named template on disk.
+func templatePath(name string) string {
 	path := TEMPLATE_DIR + "/" + name + ".html"
 	if os.Getenv("ENV") == "production" {
 		dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 		path = dir + "/" + path
 	}
 
-	buf, err := ioutil.ReadFile(path)
+	return path
+}
+
+// templateExists reports whether the named template is available.
+func templateExists(name string) bool {
+	_, err := os.Stat(templatePath(name))
+	return err == nil
+}
+
+// loadTemplate parses the named template with the partials, using the cache
+// in production.
+func loadTemplate(name string) (*template.Template, error) {
+	cache := os.Getenv("ENV") == "production"
+	if cache {
+		templateCache.RLock()
+		t, ok := templateCache.templates[name]
+		templateCache.RUnlock()
+		if ok {
+			return t, nil
+		}
+	}
+
+	t, err := template.New(filepath.Base(templatePath(name))).Funcs(templateFuncs).ParseFiles(templatePath(name))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	t = t.Funcs(template.FuncMap{
-		"yield": func() (string, error) {
-			return "", fmt.Errorf("yield called with no layout defined")
-		},
-		"current": func() (string, error) {
-			return name, nil
-		},
-	})
+	partials, _ := filepath.Glob(filepath.Join(filepath.Dir(templatePath(name)), partialsDir, "*.html"))
+	for _, partial := range partials {
+		buf, err := ioutil.ReadFile(partial)
+		if err != nil {
+			return nil, err
+		}
+
+		partialName := strings.TrimSuffix(filepath.Base(partial), ".html")
+		if _, err := t.New(partialName).Parse(string(buf)); err != nil {
+			return nil, err
+		}
+	}
+
+	if cache {
+		templateCache.Lock()
+		templateCache.templates[name] = t
+		templateCache.Unlock()
+	}
+
+	return t, nil
+}
 
-	t, err = t.Parse(string(buf))
+func execute(name string, data interface{}) (*bytes.Buffer, error) {
+	t, err := loadTemplate(name)
 	if err != nil {
 		return nil, err
 	}
 
+	t, err = t.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	t.Funcs(template.FuncMap{
+		"current": func() (string, error) {
+			return name, nil
+		},
+	})
+
 	outBuf := new(bytes.Buffer)
 	return outBuf, t.Execute(outBuf, data)
 }
 
-func RenderTemplate(wr io.Writer, name string, data interface{}) error {
-	tmpl := template.New(name).Funcs(template.FuncMap{
+// RenderLayout renders the named template inside layout, which includes the
+// page with {{yield}}.
+func RenderLayout(wr io.Writer, layout, name string, data interface{}) error {
+	return renderLayout(wr, layout, name, data, nil)
+}
+
+// renderLayout is RenderLayout with funcs overriding the layout's template
+// functions, e.g. to preview a theme.
+func renderLayout(wr io.Writer, layout, name string, data interface{}, funcs template.FuncMap) error {
+	if rw, ok := wr.(http.ResponseWriter); ok {
+		rw.Header().Set(envHeader, env.Current.Name)
+	}
+
+	t, err := loadTemplate(layout)
+	if err != nil {
+		return err
+	}
+
+	t, err = t.Clone()
+	if err != nil {
+		return err
+	}
+
+	t.Funcs(template.FuncMap{
 		"yield": func() (template.HTML, error) {
 			buf, err := execute(name, data)
+			if err != nil {
+				return "", err
+			}
 
 			// return safe html here since we are rendering our own template
-			fmt.Println("Yeild was called")
-			return template.HTML(buf.String()), err
+			return template.HTML(buf.String()), nil
 		},
 		"current": func() (string, error) {
 			return name, nil
 		},
 	})
-
-	layoutPath := TEMPLATE_DIR + "/layout.html"
-	if os.Getenv("ENV") == "production" {
-		dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-		layoutPath = dir + "/" + layoutPath
+	if funcs != nil {
+		t.Funcs(funcs)
 	}
 
-	buf, err := ioutil.ReadFile(layoutPath)
-	if err != nil {
-		return err
-	}
+	return t.Execute(wr, data)
+}
 
-	tmpl, err = tmpl.Parse(string(buf))
-	if err != nil {
-		return err
-	}
-	return tmpl.Execute(wr, data)
+func RenderTemplate(wr io.Writer, name string, data interface{}) error {
+	return RenderLayout(wr, "layout", name, data)
+}
+
+// RenderAdminTemplate renders an admin page with the shared admin navigation.
+func RenderAdminTemplate(wr io.Writer, name string, data interface{}) error {
+	return RenderLayout(wr, "admin_layout", name, data)
 }
 
 func RenderEmail(name string, data interface{}) (string, error) {
@@ -0,0 +1,103 @@
+// Copyright 2014 Bowery, Inc.
+// Contains retention, the daily job pruning audit logs, events and shadow
+// results older than the days set for them. Developers on legal hold keep
+// all of their logs and events, see legalholds.go.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"labix.org/v2/mgo/bson"
+)
+
+// Prune runs shown by the admin endpoint.
+const pruneRunLimit = 50
+
+// pruners remove the documents of each kind from before a time, skipping
+// those of held developers.
+var pruners = map[string]func(before time.Time, held []bson.ObjectId) (int, error){
+	"auditLogs": func(before time.Time, held []bson.ObjectId) (int, error) {
+		// Logs waiting to be exported to a SIEM are kept until they are.
+		return db.PruneAuditLogs(before, held, len(siemDestinations()) > 0)
+	},
+	"events":            db.PruneEvents,
+	"developerVersions": db.PruneDeveloperVersions,
+	"shadowResults": func(before time.Time, held []bson.ObjectId) (int, error) {
+		return db.PruneShadowResults(before)
+	},
+}
+
+func init() {
+	scheduleDaily("prune-retention", 4, pruneRetention)
+}
+
+// pruneRetention prunes each kind with a retention set, recording how many
+// were removed.
+func pruneRetention() error {
+	retention := getSettings().Retention
+	if len(retention) == 0 {
+		return nil
+	}
+	held, err := db.GetLegalHoldIDs()
+	if err != nil {
+		return err
+	}
+
+	kinds := []string{}
+	for kind := range retention {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	now := time.Now()
+	for _, kind := range kinds {
+		before := now.AddDate(0, 0, -retention[kind])
+		n, err := pruners[kind](before, held)
+		if err != nil {
+			return err
+		}
+
+		if err := db.SavePruneRun(&db.PruneRun{Kind: kind, Before: before, Pruned: n}); err != nil {
+			fmt.Println("unable to save prune run", kind, err)
+		}
+		if n > 0 {
+			fmt.Println("pruned", n, kind, "from before", before.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// GET /admin/retention, Shows retention by kind, held developers and what recent runs pruned
+func RetentionHandler(rw http.ResponseWriter, req *http.Request) {
+	held, err := db.GetLegalHoldIDs()
+	var runs []*db.PruneRun
+	if err == nil {
+		runs, err = db.GetPruneRuns(pruneRunLimit)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	pruned := map[string]int{}
+	for _, r := range runs {
+		pruned[r.Kind] += r.Pruned
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"retention": getSettings().Retention,
+		"held":      held,
+		"pruned":    pruned,
+		"runs":      runs,
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2014 Bowery, Inc.
+// Contains retries with exponential backoff and jitter for calls to external
+// services. Each service has a retry budget so retries can't multiply the
+// load on a provider that's already struggling.
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Attempts made for a call, including the first.
+	retryAttempts = 3
+
+	// Backoff before the first retry, doubled for each one after.
+	retryBaseDelay = 200 * time.Millisecond
+
+	// Longest backoff between attempts.
+	retryMaxDelay = 2 * time.Second
+
+	// Each call earns this fraction of a retry, so retries stay under about
+	// 20% of calls. The budget starts full and holds at most retryMaxTokens.
+	retryTokenRatio = 0.2
+	retryMaxTokens  = 10
+)
+
+// retryBudget limits retries for a service and keeps metrics on them.
+type retryBudget struct {
+	mutex     sync.Mutex
+	tokens    float64
+	calls     int64
+	retries   int64
+	recovered int64
+	exhausted int64
+}
+
+// retryMetrics are running totals for a service's retries.
+type retryMetrics struct {
+	Calls     int64 `json:"calls"`
+	Retries   int64 `json:"retries"`
+	Recovered int64 `json:"recovered"`
+	Exhausted int64 `json:"budgetExhausted"`
+}
+
+var (
+	retryMutex   sync.Mutex
+	retryBudgets = map[string]*retryBudget{}
+)
+
+func budgetFor(name string) *retryBudget {
+	retryMutex.Lock()
+	defer retryMutex.Unlock()
+
+	b, ok := retryBudgets[name]
+	if !ok {
+		b = &retryBudget{tokens: retryMaxTokens}
+		retryBudgets[name] = b
+	}
+
+	return b
+}
+
+func (b *retryBudget) deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.calls++
+	b.tokens += retryTokenRatio
+	if b.tokens > retryMaxTokens {
+		b.tokens = retryMaxTokens
+	}
+}
+
+// withdraw takes a token for a retry, returning false if none are left.
+func (b *retryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.tokens < 1 {
+		b.exhausted++
+		return false
+	}
+
+	b.tokens--
+	b.retries++
+	return true
+}
+
+func (b *retryBudget) snapshot() retryMetrics {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return retryMetrics{
+		Calls:     b.calls,
+		Retries:   b.retries,
+		Recovered: b.recovered,
+		Exhausted: b.exhausted,
+	}
+}
+
+// backoff returns the wait before the given retry, chosen at random up to the
+// exponential delay so clients retrying together spread out.
+func backoff(retry int) time.Duration {
+	delay := retryBaseDelay << uint(retry)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// withRetry calls fn, retrying errors retryable reports as transient while
+// the service's budget allows it. Only pass calls that are safe to repeat.
+// Nothing is tried once ctx is done, and backoff stops waiting when it is.
+func withRetry(ctx context.Context, name string, retryable func(error) bool, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := budgetFor(name)
+	b.deposit()
+	defer func(start time.Time) { recordDependency(ctx, name, time.Since(start)) }(time.Now())
+
+	err := fn()
+	for retry := 0; err != nil && retry < retryAttempts-1; retry++ {
+		if err == errBreakerOpen || !retryable(err) || ctx.Err() != nil || !b.withdraw() {
+			return err
+		}
+
+		timer := time.NewTimer(backoff(retry))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		if err = fn(); err == nil {
+			b.mutex.Lock()
+			b.recovered++
+			b.mutex.Unlock()
+		}
+	}
+
+	return err
+}
+
+// unwrapNetError returns the network error behind err, if any.
+func unwrapNetError(err error) (net.Error, bool) {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	netErr, ok := err.(net.Error)
+	return netErr, ok
+}
+
+// connectError reports whether err happened before the request was sent,
+// which makes it safe to retry even calls that aren't idempotent.
+func connectError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	if opErr, ok := err.(*net.OpError); ok {
+		return opErr.Op == "dial"
+	}
+
+	_, ok := err.(*net.DNSError)
+	return ok
+}
+
+// transientError reports whether err is a network failure that may succeed
+// if tried again, used for idempotent calls.
+func transientError(err error) bool {
+	if connectError(err) {
+		return true
+	}
+
+	netErr, ok := unwrapNetError(err)
+	return ok && (netErr.Timeout() || netErr.Temporary())
+}
@@ -0,0 +1,352 @@
+// Copyright 2014 Bowery, Inc.
+// Contains revenue reporting for finance. Revenue is totalled by day, plan
+// and currency, and converted to the reporting currency with that day's
+// exchange rates, fetched daily from a rate provider.
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// reportCurrency is what revenue is converted to, read from REPORT_CURRENCY.
+var reportCurrency = "usd"
+
+// rateProvider returns the units of each currency one unit of base buys on
+// a day. Currencies are lower case.
+type rateProvider interface {
+	Name() string
+	Rates(base string, day time.Time) (map[string]float64, error)
+}
+
+// fxProvider is where daily rates come from, FX_RATES_URL overrides the
+// default provider's endpoint.
+var fxProvider rateProvider = &httpRateProvider{
+	URL: "https://api.frankfurter.app/{date}?from={base}",
+}
+
+var fxHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// zeroDecimal are currencies Stripe amounts aren't in hundredths of.
+var zeroDecimal = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true,
+	"kmf": true, "krw": true, "mga": true, "pyg": true, "rwf": true,
+	"ugx": true, "vnd": true, "vuv": true, "xaf": true, "xof": true,
+	"xpf": true,
+}
+
+func init() {
+	if currency := os.Getenv("REPORT_CURRENCY"); currency != "" {
+		reportCurrency = strings.ToLower(currency)
+	}
+	if url := os.Getenv("FX_RATES_URL"); url != "" {
+		fxProvider = &httpRateProvider{URL: url}
+	}
+
+	scheduleDaily("fetch-fx-rates", 1, func() error {
+		return fetchFXRates(yesterday())
+	})
+}
+
+// httpRateProvider reads rates from a JSON API with a "rates" object keyed
+// by currency. {base} and {date} in the URL are filled in.
+type httpRateProvider struct {
+	URL string
+}
+
+func (p *httpRateProvider) Name() string {
+	return p.URL
+}
+
+func (p *httpRateProvider) Rates(base string, day time.Time) (map[string]float64, error) {
+	url := strings.NewReplacer("{base}", strings.ToUpper(base), "{date}", day.Format("2006-01-02")).Replace(p.URL)
+	res, err := fxHTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fx rates returned %s", res.Status)
+	}
+
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	rates := map[string]float64{}
+	for currency, rate := range body.Rates {
+		rates[strings.ToLower(currency)] = rate
+	}
+	return rates, nil
+}
+
+// fetchFXRates stores the rates for a day from the provider.
+func fetchFXRates(day time.Time) error {
+	var rates map[string]float64
+	err := callDependency(context.Background(), "fx", transientError, func() error {
+		var err error
+		rates, err = fxProvider.Rates(reportCurrency, day)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.SaveFXRates(&db.FXRates{
+		Day:    day,
+		Base:   reportCurrency,
+		Rates:  rates,
+		Source: fxProvider.Name(),
+	})
+}
+
+// majorAmount converts an amount in currency's smallest unit to whole
+// units, e.g. 2900 "usd" is 29.
+func majorAmount(amount int64, currency string) float64 {
+	if zeroDecimal[currency] {
+		return float64(amount)
+	}
+
+	return float64(amount) / 100
+}
+
+// convertAmount converts an amount in currency's smallest unit to base's,
+// where rate is the units of currency one unit of base buys.
+func convertAmount(amount int64, currency, base string, rate float64) int64 {
+	converted := majorAmount(amount, currency) / rate
+	if !zeroDecimal[base] {
+		converted *= 100
+	}
+	return int64(math.Floor(converted + 0.5))
+}
+
+// revenueRow is the revenue for a plan in a currency on a day.
+type revenueRow struct {
+	Day       string  `json:"day"`
+	Plan      string  `json:"plan"`
+	Currency  string  `json:"currency"`
+	Count     int     `json:"count"`
+	Amount    int64   `json:"amount"`
+	Rate      float64 `json:"rate"`
+	Converted int64   `json:"converted"`
+
+	// Set when there were no rates for the day or currency, Converted is 0.
+	MissingRate bool `json:"missingRate,omitempty"`
+}
+
+// revenueReport totals revenue for days in [from, to), converted to base.
+// If developers is given only their revenue is counted.
+func revenueReport(from, to time.Time, base string, developers []bson.ObjectId) ([]*revenueRow, error) {
+	totals, err := db.GetRevenueTotals(from, to, developers)
+	if err != nil {
+		return nil, err
+	}
+
+	report := make([]*revenueRow, 0, len(totals))
+	rates := map[string]map[string]float64{}
+	for _, t := range totals {
+		row := &revenueRow{Day: t.Day, Plan: t.Plan, Currency: t.Currency, Count: t.Count, Amount: t.Amount}
+		dayRates, ok := rates[row.Day]
+		if !ok {
+			day, _ := time.Parse("2006-01-02", row.Day)
+			r, err := db.GetFXRates(base, day)
+			if err != nil && err != db.ErrNotFound {
+				return nil, err
+			}
+			dayRates = r.Rates
+			rates[row.Day] = dayRates
+		}
+
+		row.Rate = dayRates[row.Currency]
+		if row.Currency == base {
+			row.Rate = 1
+		}
+		if row.Rate > 0 {
+			row.Converted = convertAmount(row.Amount, row.Currency, base, row.Rate)
+		} else {
+			row.MissingRate = true
+		}
+		report = append(report, row)
+	}
+
+	sort.Sort(revenueRows(report))
+	return report, nil
+}
+
+// revenueRows sorts rows by day, plan then currency.
+type revenueRows []*revenueRow
+
+func (r revenueRows) Len() int      { return len(r) }
+func (r revenueRows) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r revenueRows) Less(i, j int) bool {
+	if r[i].Day != r[j].Day {
+		return r[i].Day < r[j].Day
+	}
+	if r[i].Plan != r[j].Plan {
+		return r[i].Plan < r[j].Plan
+	}
+	return r[i].Currency < r[j].Currency
+}
+
+// revenueSummary is the dashboard's view of a report.
+type revenueSummary struct {
+	Currency    string
+	Total       int64
+	ByPlan      map[string]int64
+	MissingRate bool
+}
+
+// summarizeRevenue totals a report's converted revenue by plan.
+func summarizeRevenue(report []*revenueRow, base string) *revenueSummary {
+	s := &revenueSummary{Currency: base, ByPlan: map[string]int64{}}
+	for _, row := range report {
+		s.Total += row.Converted
+		s.ByPlan[row.Plan] += row.Converted
+		s.MissingRate = s.MissingRate || row.MissingRate
+	}
+
+	return s
+}
+
+// reportRange reads the from and to days of a report, the last 30 days by
+// default. To is exclusive.
+func reportRange(req *http.Request) (time.Time, time.Time, error) {
+	to := yesterday().Add(24 * time.Hour)
+	from := to.AddDate(0, 0, -30)
+
+	var err error
+	if v := req.FormValue("from"); v != "" {
+		if from, err = time.Parse("2006-01-02", v); err != nil {
+			return from, to, errors.New("from must be a date, e.g. 2014-11-10")
+		}
+	}
+	if v := req.FormValue("to"); v != "" {
+		if to, err = time.Parse("2006-01-02", v); err != nil {
+			return from, to, errors.New("to must be a date, e.g. 2014-11-10")
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+
+	return from, to, nil
+}
+
+// GET /admin/reports/revenue, Exports revenue by day, plan and currency as
+// CSV, or JSON with format=json. Limit it to a saved segment with segment.
+func RevenueReportHandler(rw http.ResponseWriter, req *http.Request) {
+	from, to, err := reportRange(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var developers []bson.ObjectId
+	if slug := req.FormValue("segment"); slug != "" {
+		ids, err := segmentMemberIDs(slug)
+		if err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		// Not nil even if the segment's empty, so no one's revenue counts.
+		developers = append([]bson.ObjectId{}, ids...)
+	}
+
+	report, err := revenueReport(from, to, reportCurrency, developers)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if req.FormValue("format") == "json" {
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status":   requests.StatusFound,
+			"currency": reportCurrency,
+			"revenue":  report,
+		})
+		return
+	}
+
+	writeRevenueCSV(rw, from, to, report)
+}
+
+// writeRevenueCSV writes a report as a CSV download. Amounts are in each
+// currency's smallest unit, as Stripe reports them.
+func writeRevenueCSV(rw http.ResponseWriter, from, to time.Time, report []*revenueRow) {
+	rw.Header().Set("Content-Type", "text/csv")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		"revenue-"+from.Format("2006-01-02")+"-"+to.Format("2006-01-02")+".csv"))
+
+	w := csv.NewWriter(rw)
+	w.Write([]string{"day", "plan", "currency", "payments", "amount", "rate", reportCurrency + " amount"})
+	for _, row := range report {
+		rate, converted := "", ""
+		if !row.MissingRate {
+			rate = strconv.FormatFloat(row.Rate, 'f', -1, 64)
+			converted = strconv.FormatInt(row.Converted, 10)
+		}
+
+		w.Write([]string{
+			row.Day,
+			row.Plan,
+			row.Currency,
+			strconv.Itoa(row.Count),
+			strconv.FormatInt(row.Amount, 10),
+			rate,
+			converted,
+		})
+	}
+	w.Flush()
+}
+
+// POST /admin/reports/fx/{day}, Fetches the exchange rates for a day, for days the daily job missed
+func FetchFXRatesHandler(rw http.ResponseWriter, req *http.Request) {
+	day, err := time.Parse("2006-01-02", mux.Vars(req)["day"])
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "day must be a date, e.g. 2014-11-10",
+		})
+		return
+	}
+
+	if err := fetchFXRates(day); err != nil {
+		renderer.JSON(rw, http.StatusBadGateway, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
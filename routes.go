@@ -14,7 +14,7 @@ import (
 	"time"
 
 	"github.com/Bowery/broome/db"
-	"github.com/Bowery/gopackages/config"
+	"github.com/Bowery/broome/env"
 	"github.com/Bowery/gopackages/requests"
 	"github.com/Bowery/gopackages/schemas"
 	"github.com/Bowery/gopackages/util"
@@ -23,7 +23,6 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/mattbaird/gochimp"
 	"github.com/unrolled/render"
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 )
 
@@ -32,6 +31,12 @@ const (
 	httpMaxMem = 32 << 10
 )
 
+// Header naming the environment a response came from.
+const envHeader = "X-Broome-Env"
+
+// Weeks of signups shown on the dashboard.
+const dashboardSignupWeeks = 8
+
 var (
 	STATIC_DIR      string = TEMPLATE_DIR
 	chimp           *gochimp.ChimpAPI
@@ -39,31 +44,264 @@ var (
 	stripePublicKey string
 )
 
-var renderer = render.New(render.Options{
+var renderer = &envRenderer{render.New(render.Options{
 	IndentJSON:    true,
 	IsDevelopment: true,
-})
+})}
+
+// envRenderer tags JSON responses with the environment that served them.
+type envRenderer struct {
+	*render.Render
+}
+
+func (r *envRenderer) JSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set(envHeader, env.Current.Name)
+	r.Render.JSON(rw, status, v)
+}
+
+// dbErrorStatus returns the status for an error from the db package.
+func dbErrorStatus(err error) int {
+	switch err {
+	case db.ErrNotFound:
+		return http.StatusNotFound
+	case db.ErrDuplicate, db.ErrConflict:
+		return http.StatusConflict
+	case db.ErrDeadline:
+		return http.StatusServiceUnavailable
+	}
+	if _, ok := err.(*db.LifecycleError); ok {
+		return http.StatusConflict
+	}
+	if _, ok := err.(*db.SchemaError); ok {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
 
 // List of named routes.
 var Routes = []web.Route{
 	{"GET", "/admin", HomeHandler, true},
 	{"GET", "/admin/developers", AdminHandler, true},
-	{"POST", "/developers", CreateDeveloperHandler, false},
-	{"POST", "/developers/token", CreateTokenHandler, false},
+	{"GET", "/admin/experiments", ExperimentsHandler, true},
+	{"POST", "/admin/experiments", CreateExperimentHandler, true},
+	{"PUT", "/admin/experiments/{name}", UpdateExperimentHandler, true},
+	{"POST", "/developers", rateLimited("signup", CreateDeveloperHandler), false},
+	{"POST", "/developers/cli", rateLimited("signup-cli", CreateCLIDeveloperHandler), false},
+	{"POST", "/developers/token", rateLimited("login", CreateTokenHandler), false},
+	{"POST", "/developers/tokens/validate", signedOnly(ValidateTokensHandler), false},
 	{"POST", "/developers/check-admin", CheckAdminHandler, false},
-	{"GET", "/developers/me", GetCurrentDeveloperHandler, false},
-	{"GET", "/developers/{id}", GetDeveloperByIDHandler, false},
+	{"GET", "/developers/me", withQuota(shadow("developers.me", GetCurrentDeveloperHandler)), false},
+	{"GET", "/developers/me/quota", QuotaHandler, false},
+	{"GET", "/developers/{id}", shadow("developers.get", GetDeveloperByIDHandler), false},
 	{"GET", "/admin/developers/new", NewDevHandler, true},
+	{"GET", "/admin/developers/schema", SchemaFlagsHandler, true},
+	{"POST", "/admin/developers/schema/repair", RepairSchemaHandler, true},
 	{"PUT", "/developers/{token}", UpdateDeveloperHandler, true},
+	{"DELETE", "/developers/{token}", DeleteDeveloperHandler, true},
+	{"DELETE", "/developers/{token}/subscription", CancelSubscriptionHandler, true},
+	{"POST", "/developers/{token}/subscription/pause", PauseSubscriptionHandler, true},
+	{"POST", "/developers/{token}/subscription/resume", ResumeSubscriptionHandler, true},
+	{"GET", "/developers/{token}/discount-applications", DiscountApplicationsHandler, true},
+	{"POST", "/developers/{token}/discount-applications", CreateDiscountApplicationHandler, true},
+	{"GET", "/developers/restore/{token}", RestoreDeveloperHandler, false},
+	{"GET", "/admin/deletions", DeletionsHandler, true},
+	{"GET", "/admin/gift-codes", GiftCodesHandler, true},
+	{"POST", "/admin/gift-codes", CreateGiftCodesHandler, true},
+	{"GET", "/admin/discounts", DiscountsHandler, true},
+	{"POST", "/admin/discounts/{id}/{action}", ReviewDiscountHandler, true},
+	{"GET", "/redeem", RedeemHandler, false},
+	{"POST", "/redeem", rateLimited("redeem", RedeemGiftCodeHandler), false},
 	{"GET", "/admin/developers/{token}", DeveloperInfoHandler, true},
-	{"POST", "/developers/{token}/pay", PaymentHandler, false},
-	{"GET", "/session/{id}", SessionInfoHandler, false},
+	{"POST", "/admin/developers/{id}/suspend", SuspendDeveloperHandler, true},
+	{"POST", "/admin/developers/{id}/unsuspend", UnsuspendDeveloperHandler, true},
+	{"PUT", "/admin/developers/{id}/tags", UpdateTagsHandler, true},
+	{"POST", "/admin/developers/{id}/legal-hold", PlaceLegalHoldHandler, true},
+	{"DELETE", "/admin/developers/{id}/legal-hold", ReleaseLegalHoldHandler, true},
+	{"GET", "/admin/developers/{id}/test-clock", TestClockHandler, true},
+	{"POST", "/admin/developers/{id}/test-clock", StartTestClockHandler, true},
+	{"POST", "/admin/developers/{id}/test-clock/advance", AdvanceTestClockHandler, true},
+	{"DELETE", "/admin/developers/{id}/test-clock", StopTestClockHandler, true},
+	{"GET", "/admin/developers/{id}/history", DeveloperHistoryHandler, true},
+	{"GET", "/admin/developers/{id}/versions/{version}", DeveloperVersionHandler, true},
+	{"POST", "/admin/developers/{id}/versions/{version}/restore", RestoreDeveloperVersionHandler, true},
+	{"PATCH", "/admin/developers/{id}/{field}", UpdateDeveloperFieldHandler, true},
+	{"GET", "/admin/tags", TagsHandler, true},
+	{"GET", "/admin/views", AdminViewsHandler, true},
+	{"PUT", "/admin/views/default", DefaultViewHandler, true},
+	{"PUT", "/admin/views/{slug}", UpdateViewHandler, true},
+	{"DELETE", "/admin/views/{slug}", DeleteViewHandler, true},
+	{"GET", "/admin/suspensions", AdminSuspensionsHandler, true},
+	{"POST", "/abuse", rateLimited("abuse", AbuseReportHandler), false},
+	{"GET", "/admin/abuse", AdminAbuseHandler, true},
+	{"GET", "/admin/abuse/{id}", AdminAbuseCaseHandler, true},
+	{"PUT", "/admin/abuse/{id}", UpdateAbuseCaseHandler, true},
+	{"POST", "/developers/{token}/pay", canary("billing.pay", PaymentHandler), false},
+	{"POST", "/developers/{token}/ach", CreateACHPaymentHandler, false},
+	{"POST", "/developers/{token}/ach/{id}/verify", VerifyACHPaymentHandler, false},
+	{"GET", "/developers/{token}/payments", withQuota(GetPaymentsHandler), false},
+	{"GET", "/developers/{token}/security-events", withQuota(SecurityEventsHandler), false},
+	{"GET", "/developers/{token}/billing-address", GetBillingAddressHandler, false},
+	{"PUT", "/developers/{token}/billing-address", UpdateBillingAddressHandler, false},
+	{"GET", "/developers/{token}/invoice-details", GetInvoiceDetailsHandler, false},
+	{"PUT", "/developers/{token}/invoice-details", UpdateInvoiceDetailsHandler, false},
+	{"GET", "/developers/{token}/billing-contact", GetBillingContactHandler, false},
+	{"PUT", "/developers/{token}/billing-contact", UpdateBillingContactHandler, false},
+	{"DELETE", "/developers/{token}/billing-contact", DeleteBillingContactHandler, false},
+	{"POST", "/developers/{token}/grants", CreateGrantHandler, true},
+	{"GET", "/developers/{token}/grants", GetGrantsHandler, true},
+	{"DELETE", "/developers/{token}/grants/{id}", RevokeGrantHandler, true},
+	{"POST", "/developers/{token}/webhooks", CreateWebhookEndpointHandler, false},
+	{"GET", "/developers/{token}/webhooks", GetWebhookEndpointsHandler, false},
+	{"DELETE", "/developers/{token}/webhooks/{id}", DeleteWebhookEndpointHandler, false},
+	{"POST", "/developers/{token}/webhooks/{id}/enable", EnableWebhookEndpointHandler, false},
+	{"POST", "/developers/{token}/webhooks/{id}/ping", rateLimited("webhook-ping", PingWebhookEndpointHandler), false},
+	{"GET", "/developers/{token}/webhooks/{id}/deliveries", WebhookDeliveriesHandler, false},
+	{"GET", "/developers/{token}/notifications", NotificationRoutesHandler, false},
+	{"PUT", "/developers/{token}/notifications", UpdateNotificationRoutesHandler, false},
+	{"POST", "/grants/{invite}/accept", AcceptGrantHandler, true},
+	{"GET", "/session/{id}", shadow("session.info", SessionInfoHandler), false},
 	{"GET", "/admin/signup/{id}", SignUpHandler, false},
-	{"POST", "/signup", CreateSessionHandler, false},
+	{"POST", "/signup", rateLimited("signup", CreateSessionHandler), false},
 	{"GET", "/admin/thanks!", ThanksHandler, false},
+	{"GET", "/embed/signup", EmbedSignupHandler, false},
+	{"GET", "/checkout/{token}", CheckoutHandler, false},
+	{"GET", "/checkout/{token}/complete", CheckoutCompleteHandler, false},
+	{"GET", "/admin/checkouts", AdminCheckoutsHandler, true},
+	{"GET", "/payments/{token}/complete", PaymentCompleteHandler, false},
+	{"GET", "/payments/{token}/{id}/authenticate", PaymentAuthenticateHandler, false},
+	{"GET", "/payments/{token}/{id}/complete", PaymentCompleteHandler, false},
+	{"GET", "/payments/{token}/{id}/invoice", InvoiceHandler, false},
+	{"GET", "/admin/payments", AdminPaymentsHandler, true},
+	{"GET", "/pay/{token}", PayHandler, false},
+	{"GET", applePayAssociationPath, ApplePayAssociationHandler, false},
+	{"GET", "/admin/wallets/domains", WalletDomainsHandler, true},
+	{"POST", "/admin/wallets/domains/{domain}", RegisterWalletDomainHandler, true},
+	{"GET", "/theme.css", ThemeCSSHandler, false},
 	{"GET", "/reset/{email}", ResetPasswordHandler, false},
 	{"GET", "/developers/reset/{token}/{id}", ResetHandler, false},
 	{"PUT", "/developers/reset/{token}", PasswordEditHandler, false},
+	{"GET", "/pricing.json", shadow("pricing", PricingHandler), false},
+	{"GET", "/pricing", PricingPageHandler, false},
+	{"GET", "/admin/pricing", AdminPricingHandler, true},
+	{"PUT", "/admin/pricing/{slug}", UpdatePlanHandler, true},
+	{"GET", "/admin/theme", AdminThemeHandler, true},
+	{"GET", "/admin/theme/preview", ThemePreviewHandler, true},
+	{"PUT", "/admin/theme", UpdateThemeHandler, true},
+	{"GET", "/announcements", withQuota(GetAnnouncementsHandler), false},
+	{"POST", "/announcements/{id}/read", ReadAnnouncementHandler, false},
+	{"GET", "/admin/announcements", AdminAnnouncementsHandler, true},
+	{"POST", "/admin/announcements", CreateAnnouncementHandler, true},
+	{"PUT", "/admin/announcements/{id}", UpdateAnnouncementHandler, true},
+	{"DELETE", "/admin/announcements/{id}", DeleteAnnouncementHandler, true},
+	{"GET", "/versions", VersionsHandler, false},
+	{"PUT", "/admin/versions/{channel}", UpdateVersionPolicyHandler, true},
+	{"GET", "/releases/{channel}/latest", LatestReleaseHandler, false},
+	{"GET", "/admin/releases", AdminReleasesHandler, true},
+	{"POST", "/admin/releases", CreateReleaseHandler, true},
+	{"PUT", "/admin/releases/{channel}/promote", PromoteReleaseHandler, true},
+	{"PUT", "/admin/releases/{channel}/rollback", RollbackReleaseHandler, true},
+	{"GET", "/developers/{token}/license", withQuota(LicenseHandler), true},
+	{"GET", "/.well-known/license-key", LicensePublicKeyHandler, false},
+	{"GET", "/.well-known/license-revocations", LicenseRevocationsHandler, false},
+	{"PUT", "/admin/licenses/{id}/revoke", dangerous("license.revoke", RevokeLicenseHandler), true},
+	{"GET", "/entitlements", signedOnly(shadow("entitlements", EntitlementsHandler)), false},
+	{"GET", "/admin/quarantine", QuarantineHandler, true},
+	{"PUT", "/admin/quarantine/{id}/release", ReleaseSignupHandler, true},
+	{"DELETE", "/admin/quarantine/{id}", dangerous("signup.discard", DiscardSignupHandler), true},
+	{"GET", "/admin/signups/flagged", FlaggedSignupsHandler, true},
+	{"GET", "/admin/ip-reputation", AdminIPReputationHandler, true},
+	{"PUT", "/admin/ip-reputation", UpdateIPReputationHandler, true},
+	{"DELETE", "/admin/ip-reputation", DeleteIPReputationHandler, true},
+	{"GET", "/admin/waitlist", AdminWaitlistHandler, true},
+	{"DELETE", "/admin/waitlist", RemoveWaitlistHandler, true},
+	{"GET", "/admin/events", AdminEventsHandler, true},
+	{"GET", "/admin/activity", ActivityHandler, true},
+	{"GET", "/admin/digest", DigestHandler, true},
+	{"GET", "/admin/churn", ChurnHandler, true},
+	{"GET", "/admin/engineers/{name}/book", EngineerBookHandler, true},
+	{"POST", "/feedback", FeedbackHandler, false},
+	{"GET", "/admin/feedback", AdminFeedbackHandler, true},
+	{"GET", "/changelog", ChangelogHandler, false},
+	{"POST", "/changelog/read", ReadChangelogHandler, false},
+	{"POST", "/admin/changelog", CreateChangelogHandler, true},
+	{"PUT", "/admin/changelog/{id}", UpdateChangelogHandler, true},
+	{"DELETE", "/admin/changelog/{id}", DeleteChangelogHandler, true},
+	{"GET", "/admin/shadow", AdminShadowHandler, true},
+	{"GET", "/admin/canaries", AdminCanariesHandler, true},
+	{"PUT", "/admin/canaries/{route}", UpdateCanaryHandler, true},
+	{"GET", "/admin/settings", AdminSettingsHandler, true},
+	{"POST", "/admin/settings/reload", ReloadSettingsHandler, true},
+	{"GET", "/admin/debug/pprof", requireAdmin(PprofIndexHandler), true},
+	{"GET", "/admin/debug/pprof/{profile}", requireAdmin(PprofHandler), true},
+	{"GET", "/admin/dependencies", DependenciesHandler, true},
+	{"GET", "/admin/probes", AdminProbesHandler, true},
+	{"GET", "/admin/slo", SLOHandler, true},
+	{"GET", "/admin/siem", SIEMHandler, true},
+	{"GET", "/admin/retention", RetentionHandler, true},
+	{"GET", "/admin/legal-holds", LegalHoldsHandler, true},
+	{"GET", "/admin/backups", BackupsHandler, true},
+	{"POST", "/admin/bulk/{mutation}", BulkHandler, true},
+	{"GET", "/admin/bulk/reports/{id}", BulkReportHandler, true},
+	{"GET", "/admin/outbox", AdminOutboxHandler, true},
+	{"PUT", "/admin/outbox/{id}/retry", RetryOutboxHandler, true},
+	{"GET", "/admin/sagas", AdminSagasHandler, true},
+	{"GET", "/admin/notifications", AdminNotificationsHandler, true},
+	{"GET", "/admin/organizations", AdminOrganizationsHandler, true},
+	{"PUT", "/admin/organizations/{slug}", UpdateOrganizationHandler, true},
+	{"PUT", "/admin/organizations/{slug}/billing-address", UpdateOrganizationBillingHandler, true},
+	{"GET", "/admin/organizations/{slug}/notifications", OrganizationNotificationRoutesHandler, true},
+	{"PUT", "/admin/organizations/{slug}/notifications", UpdateOrganizationNotificationRoutesHandler, true},
+	{"GET", "/admin/reports/revenue", RevenueReportHandler, true},
+	{"POST", "/admin/reports/fx/{day}", FetchFXRatesHandler, true},
+	{"POST", "/secret-scanning/github", GitHubSecretScanningHandler, false},
+	{"GET", "/admin/accounting", AdminAccountingHandler, true},
+	{"PUT", "/admin/accounting", UpdateAccountingHandler, true},
+	{"GET", "/admin/accounting/unsynced", UnsyncedAccountingHandler, true},
+	{"POST", "/admin/accounting/{id}/retry", RetryAccountingHandler, true},
+	{"GET", "/admin/crm", AdminCRMHandler, true},
+	{"PUT", "/admin/crm", UpdateCRMHandler, true},
+	{"GET", "/admin/crm/syncs", AdminCRMSyncsHandler, true},
+	{"POST", "/admin/crm/{id}/retry", RetryCRMHandler, true},
+	{"POST", "/admin/sagas/{id}/compensate", dangerous("saga.compensate", CompensateSagaHandler), true},
+	{"POST", "/admin/sudo", rateLimited("sudo", SudoHandler), true},
+	{"GET", "/admin/approvals", AdminApprovalsHandler, true},
+	{"POST", "/admin/approvals/{id}/approve", ApproveHandler, true},
+	{"POST", "/admin/approvals/{id}/deny", DenyHandler, true},
+	{"GET", "/admin/refunds", AdminRefundsHandler, true},
+	{"POST", "/admin/refunds", dangerous("refund", CreateRefundHandler), true},
+	{"POST", "/admin/refunds/{id}/approve", ApproveRefundHandler, true},
+	{"POST", "/admin/refunds/{id}/deny", DenyRefundHandler, true},
+	{"GET", "/admin/campaigns", AdminCampaignsHandler, true},
+	{"POST", "/admin/campaigns", CreateCampaignHandler, true},
+	{"GET", "/admin/campaigns/{id}", AdminCampaignHandler, true},
+	{"PUT", "/admin/campaigns/{id}", UpdateCampaignHandler, true},
+	{"GET", "/admin/campaigns/{id}/preview", PreviewCampaignHandler, true},
+	{"POST", "/admin/campaigns/{id}/schedule", dangerous("email.broadcast", ScheduleCampaignHandler), true},
+	{"POST", "/admin/campaigns/{id}/cancel", CancelCampaignHandler, true},
+	{"GET", "/campaigns/{id}/open/{developer}", CampaignOpenHandler, false},
+	{"GET", "/admin/segments", AdminSegmentsHandler, true},
+	{"PUT", "/admin/segments/{slug}", UpdateSegmentHandler, true},
+	{"DELETE", "/admin/segments/{slug}", DeleteSegmentHandler, true},
+	{"GET", "/admin/segments/{slug}/members", SegmentMembersHandler, true},
+	{"GET", "/admin/segments/{slug}/members/{email}", SegmentMemberHandler, true},
+	{"POST", "/admin/segments/{slug}/materialize", MaterializeSegmentHandler, true},
+	{"HEAD", "/webhooks/mandrill", MandrillWebhookCheckHandler, false},
+	{"POST", "/webhooks/mandrill", MandrillWebhookHandler, false},
+	{"GET", "/admin/email-deliverability", EmailDeliverabilityHandler, true},
+	{"GET", "/webhooks/mailchimp", MailchimpWebhookCheckHandler, false},
+	{"POST", "/webhooks/mailchimp", MailchimpWebhookHandler, false},
+	{"POST", "/webhooks/stripe", StripeWebhookHandler, false},
+	{"GET", "/admin/webhooks", WebhooksHandler, true},
+	{"GET", "/admin/webhooks/{id}", WebhookHandler, true},
+	{"POST", "/admin/webhooks/{id}/replay", ReplayWebhookHandler, true},
+	{"POST", "/admin/webhooks/simulate/{provider}", SimulateWebhookHandler, true},
+	{"GET", "/admin/jobs", JobsHandler, true},
+	{"POST", "/admin/jobs/backfills", StartBackfillHandler, true},
+	{"GET", "/admin/jobs/backfills/{id}", BackfillHandler, true},
+	{"POST", "/admin/jobs/backfills/{id}/pause", PauseBackfillHandler, true},
+	{"POST", "/admin/jobs/backfills/{id}/resume", ResumeBackfillHandler, true},
+	{"POST", "/admin/jobs/{kind}/{id}/{action}", JobActionHandler, true},
 	{"GET", "/healthz", HealthzHandler, false},
 	{"GET", "/static/{rest}", StaticHandler, false},
 }
@@ -71,29 +309,26 @@ var Routes = []web.Route{
 func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	stripeSecretKey := config.StripeTestSecretKey
-	stripePublicKey = config.StripeTestPublicKey
+	stripePublicKey = env.Current.StripePublicKey
 
 	var cwd, _ = filepath.Abs(filepath.Dir(os.Args[0]))
 	if os.Getenv("ENV") == "production" {
 		STATIC_DIR = cwd + "/" + STATIC_DIR
-		stripeSecretKey = config.StripeLiveSecretKey
-		stripePublicKey = config.StripeLivePublicKey
 	}
-	stripe.SetKey(stripeSecretKey)
-	chimp = gochimp.NewChimp(config.MailchimpKey, true)
-	mandrill, _ = gochimp.NewMandrill(config.MandrillKey)
+	stripe.SetKey(env.Current.StripeSecretKey)
+	chimp = gochimp.NewChimp(env.Current.MailchimpKey, true)
+	mandrill, _ = gochimp.NewMandrill(env.Current.MandrillKey)
 }
 
 func AuthHandler(req *http.Request, user, pass string) (bool, error) {
-	query := bson.M{}
+	// Tokens only work in their organization, admins aren't scoped.
+	var dev *schemas.Developer
+	var err error
 	if pass == "" {
-		query["token"] = user
+		dev, err = tenantFor(req).GetDeveloper(bson.M{"token": user})
 	} else {
-		query["email"] = user
+		dev, err = tenantFor(req).GetDeveloper(bson.M{"email": user})
 	}
-
-	dev, err := db.GetDeveloper(query)
 	if err != nil || dev.ID == "" {
 		return false, err
 	}
@@ -102,26 +337,111 @@ func AuthHandler(req *http.Request, user, pass string) (bool, error) {
 		return false, nil
 	}
 
+	// Acting on another developer's account requires a grant from them.
+	if token := mux.Vars(req)["token"]; token != "" && token != dev.Token && !dev.IsAdmin {
+		return authorizeGrant(req, dev, token)
+	}
+
 	return true, nil
 }
 
 // GET /admin, Introduction
 func HomeHandler(rw http.ResponseWriter, req *http.Request) {
-	if err := RenderTemplate(rw, "home", map[string]string{"Name": "Broome"}); err != nil {
+	data := map[string]interface{}{"Name": "Broome"}
+
+	// The dashboard still renders if the report can't be run.
+	to := yesterday().Add(24 * time.Hour)
+	if report, err := revenueReport(to.AddDate(0, 0, -30), to, reportCurrency, nil); err == nil {
+		data["Revenue"] = summarizeRevenue(report, reportCurrency)
+	} else {
+		fmt.Println("unable to report revenue", err)
+	}
+
+	count := func(key, field string, query bson.M) {
+		if counts, err := db.CountDevelopersBy(field, tenantFor(req).Scope(query)); err == nil {
+			data[key] = counts
+		} else {
+			fmt.Println("unable to count developers by", field, err)
+		}
+	}
+	if stats, err := db.GetCancellationStats(to.AddDate(0, 0, -30)); err == nil {
+		data["Cancellations"] = stats
+	} else {
+		fmt.Println("unable to summarize cancellations", err)
+	}
+
+	count("Plans", db.CountByPlan, bson.M{})
+	count("Paid", db.CountByPaid, bson.M{})
+	// Developers store when they signed up in milliseconds.
+	count("Signups", db.CountBySignupWeek, bson.M{"createdAt": bson.M{
+		"$gte": to.AddDate(0, 0, -7*dashboardSignupWeeks).UnixNano() / int64(time.Millisecond),
+	}})
+
+	if err := RenderAdminTemplate(rw, "home", data); err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 	}
 }
 
-// GET /admin/developers, Admin Interface that lists developers
+// GET /admin/developers, Admin Interface that lists developers, filtered, sorted and with the columns of ?view= or the query
 func AdminHandler(rw http.ResponseWriter, req *http.Request) {
-	ds, err := db.GetDevelopers(map[string]interface{}{})
+	config, view, err := developerList(req)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	query, err := listQuery(config)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	ds, err := db.GetDeveloperRows(tenantFor(req).Scope(query), config.Sort)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	tags, err := db.GetTagCounts()
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	views, err := db.GetAdminViews()
 	if err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 		return
 	}
 
-	if err := RenderTemplate(rw, "admin", map[string][]*schemas.Developer{
-		"Developers": ds,
+	headers := []string{}
+	for _, column := range config.Columns {
+		headers = append(headers, listColumns[column].Label)
+	}
+	type row struct {
+		Token string
+		Cells []string
+	}
+	rows := make([]*row, 0, len(ds))
+	for _, d := range ds {
+		r := &row{Token: d.Token}
+		for _, column := range config.Columns {
+			r.Cells = append(r.Cells, listColumns[column].Value(d))
+		}
+		rows = append(rows, r)
+	}
+
+	shareURL := listURL(config)
+	if view != nil {
+		shareURL = "/admin/developers?view=" + view.Slug
+	}
+	if err := RenderAdminTemplate(rw, "admin", map[string]interface{}{
+		"Config":          config,
+		"Columns":         strings.Join(config.Columns, ","),
+		"Headers":         headers,
+		"Rows":            rows,
+		"Tags":            tags,
+		"Views":           views,
+		"View":            view,
+		"ShareURL":        shareURL,
+		"LifecycleStates": db.LifecycleStates,
 	}); err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 	}
@@ -130,15 +450,37 @@ func AdminHandler(rw http.ResponseWriter, req *http.Request) {
 // GET /admin/developers/{token}, Admin Interface for a single developer
 func DeveloperInfoHandler(rw http.ResponseWriter, req *http.Request) {
 	token := mux.Vars(req)["token"]
-	d, err := db.GetDeveloper(map[string]interface{}{"token": token})
+	d, err := tenantFor(req).GetDeveloper(map[string]interface{}{"token": token})
 	if err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 		return
 	}
 
 	marshalledTime, _ := d.Expiration.MarshalJSON()
+	details, err := db.GetInvoiceDetails(d.ID)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	contact, err := db.GetBillingContact(d.ID)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	tags, err := db.GetDeveloperTags(d.ID)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	revision, err := db.GetDeveloperRevision(d.ID)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
 
-	RenderTemplate(rw, "developer", map[string]interface{}{
+	RenderAdminTemplate(rw, "developer", map[string]interface{}{
+		"ID":                  d.ID.Hex(),
+		"Revision":            revision,
 		"Token":               d.Token,
 		"Name":                d.Name,
 		"Email":               d.Email,
@@ -146,6 +488,9 @@ func DeveloperInfoHandler(rw http.ResponseWriter, req *http.Request) {
 		"IsPaid":              d.IsPaid,
 		"NextPaymentTime":     string(marshalledTime[1 : len(marshalledTime)-1]), // trim inexplainable quotes and Z at the end that breaks shit
 		"IntegrationEngineer": d.IntegrationEngineer,
+		"InvoiceDetails":      details,
+		"BillingContact":      contact,
+		"Tags":                strings.Join(tags, ", "),
 	})
 }
 
@@ -171,7 +516,7 @@ func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 	query := map[string]interface{}{"token": token}
 	update := map[string]interface{}{}
 
-	u, err := db.GetDeveloper(query)
+	u, err := tenantFor(req).GetDeveloper(query)
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -205,6 +550,38 @@ func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		update["isPaid"] = isPaid == "on" || isPaid == "true"
 	}
 
+	// Invoice details can be cleared, so they're set when the field is sent.
+	if _, ok := req.Form["poNumber"]; ok {
+		details := &db.InvoiceDetails{PONumber: req.FormValue("poNumber"), Memo: req.FormValue("invoiceMemo")}
+		if err := validateInvoiceDetails(details); err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+		update["invoice"] = details
+	}
+
+	// An empty billing contact sends billing emails back to the developer.
+	clearContact := false
+	if _, ok := req.Form["billingContact"]; ok {
+		if email := req.FormValue("billingContact"); email != "" {
+			cc := req.FormValue("billingContactCC")
+			contact := &db.BillingContact{Email: email, CC: cc == "on" || cc == "true"}
+			if err := validateBillingContact(contact); err != nil {
+				renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+					"status": requests.StatusFailed,
+					"error":  err.Error(),
+				})
+				return
+			}
+			update["billingContact"] = contact
+		} else {
+			clearContact = true
+		}
+	}
+
 	// TODO add datetime parsing
 	for _, field := range []string{"name", "email", "integrationEngineer"} {
 		val := req.FormValue(field)
@@ -213,13 +590,34 @@ func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	if err := db.UpdateDeveloper(query, update); err != nil {
+	err = tenantFor(req).UpdateDeveloper(query, update)
+	if err == nil && clearContact {
+		err = db.SetBillingContact(u.ID, nil)
+	}
+	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
+	entitlements.invalidate(token)
+
+	actor := u.Email
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	if _, ok := update["password"]; ok {
+		securityEvent(req, u, securityPasswordChanged, actor, "", nil)
+	}
+	if email, ok := update["email"].(string); ok && email != u.Email {
+		previous := u.Email
+		u.Email = email
+		securityEvent(req, u, securityEmailChanged, actor, previous+" to "+email, map[string]interface{}{
+			"previousEmail": previous,
+			"email":         email,
+		})
+	}
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status": requests.StatusUpdated,
@@ -227,8 +625,20 @@ func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 	})
 }
 
-// POST /developers, Creates a new developer
+// POST /developers, Creates a new developer from the signup page or embed
 func CreateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
+	createDeveloper(rw, req, true)
+}
+
+// POST /developers/cli, Creates a new developer from the CLI, which has no
+// form to check
+func CreateCLIDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
+	createDeveloper(rw, req, false)
+}
+
+// createDeveloper signs up a developer, holding form signups that look
+// automated for review.
+func createDeveloper(rw http.ResponseWriter, req *http.Request, fromForm bool) {
 	type engineer struct {
 		Name  string
 		Email string
@@ -242,7 +652,11 @@ func CreateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 
 	integrationEngineer := integrationEngineers[rand.Int()%len(integrationEngineers)]
 
-	var body requests.LoginReq
+	var body struct {
+		requests.LoginReq
+		Website   string
+		FormToken string
+	}
 
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&body)
@@ -262,17 +676,26 @@ func CreateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	token, err := newDeveloperToken()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
 	u := &schemas.Developer{
 		Name:                body.Name,
 		Email:               body.Email,
 		Password:            body.Password,
-		Token:               util.HashToken(),
+		Token:               token,
 		IntegrationEngineer: integrationEngineer.Name,
 		IsPaid:              false,
 		CreatedAt:           time.Now().UnixNano() / int64(time.Millisecond),
 	}
 
-	_, err = db.GetDeveloper(bson.M{"email": u.Email})
+	_, err = tenantFor(req).GetDeveloper(bson.M{"email": u.Email})
 	if err == nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -281,66 +704,67 @@ func CreateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if os.Getenv("ENV") == "production" && !strings.Contains(body.Email, "@bowery.io") {
-		if _, err := chimp.ListsSubscribe(gochimp.ListsSubscribe{
-			ListId: "200e892f56",
-			Email:  gochimp.Email{Email: u.Email},
-		}); err != nil {
-			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
-			return
-		}
+	if !signupDomainAllowed(u.Email, getSettings().SignupDomains) {
+		waitlistSignup(rw, req, u.Name, u.Email)
+		return
+	}
 
-		message, err := RenderEmail("welcome", map[string]interface{}{
-			"name":     strings.Split(u.Name, " ")[0],
-			"engineer": integrationEngineer,
-		})
+	risk, ok := checkSignupIP(rw, req, u.Email)
+	if !ok {
+		return
+	}
 
-		if err != nil {
-			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
+	if fromForm {
+		if reasons := botReasons(&signupSignals{Honeypot: body.Website, FormToken: body.FormToken}); len(reasons) > 0 {
+			quarantineSignup(rw, req, u, reasons)
 			return
 		}
+	}
 
-		_, err = mandrill.MessageSend(gochimp.Message{
-			Subject:   "Welcome to Bowery!",
-			FromEmail: "hello@bowery.io",
-			FromName:  integrationEngineer.Name,
-			To: []gochimp.Recipient{{
-				Email: u.Email,
-				Name:  u.Name,
-			}},
-			Html: message,
-		}, false)
+	// Side effects are saved inside the developer document in the same
+	// write, so a failed save leaves nothing behind on Mailchimp or in
+	// anyone's inbox. The saga records each step so a signup that fails
+	// later on is undone.
+	u.ID = bson.NewObjectId()
+	sideEffects := os.Getenv("ENV") == "production" && !strings.Contains(body.Email, "@bowery.io")
+	if _, err := startSignupSaga(u.ID, u.Email, sideEffects); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
 
-		if err != nil {
-			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
-			return
-		}
+	ms := []*db.OutboxMessage{}
+	if sideEffects {
+		ms = append(ms,
+			&db.OutboxMessage{Kind: outboxSubscribe, Payload: map[string]interface{}{"listId": signupListID}},
+			&db.OutboxMessage{Kind: outboxWelcomeEmail, Payload: map[string]interface{}{
+				"engineerName":  integrationEngineer.Name,
+				"engineerEmail": integrationEngineer.Email,
+			}},
+			&db.OutboxMessage{Kind: outboxSlackSignup},
+		)
 	}
 
-	if err := db.Save(u); err != nil {
+	if err := tenantFor(req).SaveWithOutbox(u, ms...); err != nil {
+		if serr := failSagaStep(u.ID, stepSave, err); serr != nil {
+			fmt.Println("unable to undo signup", u.Email, serr)
+		}
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
-
-	// Post to slack
-	if os.Getenv("ENV") == "production" && !strings.Contains(body.Email, "@bowery.io") {
-		channel := "#activity"
-		message := u.Name + " " + u.Email + " just signed up."
-		username := "Drizzy Drake"
-		go slackC.SendMessage(channel, message, username)
+	if err := completeSagaStep(u.ID, stepSave); err != nil {
+		fmt.Println("unable to update signup saga", u.Email, err)
 	}
+	recordSignupRisk(u, risk)
+	leaveWaitlist(u.Email)
+	go processOutbox()
+
+	track("developer.created", u, map[string]interface{}{"engineer": integrationEngineer.Name})
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status":    requests.StatusCreated,
@@ -350,7 +774,7 @@ func CreateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 
 // GET /admin/developers/new, Admin helper for creating developers
 func NewDevHandler(rw http.ResponseWriter, req *http.Request) {
-	if err := RenderTemplate(rw, "new", map[string]string{}); err != nil {
+	if err := RenderAdminTemplate(rw, "new", map[string]string{}); err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 	}
 }
@@ -378,10 +802,11 @@ func CreateTokenHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	query := map[string]interface{}{"email": email}
-	u, err := db.GetDeveloper(query)
+	tenant := tenantFor(req)
+	query := bson.M{"email": email}
+	u, err := tenant.GetDeveloper(query)
 	if err != nil {
-		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
 			"status": requests.StatusFailed,
 			"error":  "No such developer with email " + email + ".",
 		})
@@ -395,17 +820,31 @@ func CreateTokenHandler(rw http.ResponseWriter, req *http.Request) {
 		})
 		return
 	}
+	if sus, err := db.GetSuspension(u.ID); err == nil && sus.Active(time.Now()) {
+		renderSuspended(rw, sus)
+		return
+	}
 
-	token := util.HashToken()
+	token, err := newDeveloperToken()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
 
 	update := map[string]interface{}{"token": token}
-	if err := db.UpdateDeveloper(query, update); err != nil {
+	if err := tenant.UpdateDeveloper(query, update); err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
+	entitlements.invalidate(u.Token)
+	track("developer.login", u, nil)
+	loginEvents(req, u)
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status": requests.StatusCreated,
@@ -436,7 +875,7 @@ func CheckAdminHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	query := map[string]interface{}{"email": email}
-	u, err := db.GetDeveloper(query)
+	u, err := tenantFor(req).GetDeveloper(query)
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -478,7 +917,7 @@ func GetDeveloperByIDHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	dev, err := db.GetDeveloperById(id)
+	dev, err := tenantFor(req).GetDeveloperById(id)
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -524,9 +963,9 @@ func GetCurrentDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	query := map[string]interface{}{"token": token}
-	u, err := db.GetDeveloper(query)
+	u, err := tenantFor(req).GetDeveloper(query)
 	if err != nil {
-		if err == mgo.ErrNotFound {
+		if err == db.ErrNotFound {
 			err = errors.New("Invalid Token.")
 		}
 
@@ -538,8 +977,9 @@ func GetCurrentDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
-		"status":    requests.StatusFound,
-		"developer": u,
+		"status":          requests.StatusFound,
+		"developer":       u,
+		"upgradeRequired": requestUpgradeRequired(req),
 	})
 }
 
@@ -567,14 +1007,36 @@ func CreateSessionHandler(rw http.ResponseWriter, req *http.Request) {
 		ID:         bson.ObjectIdHex(id),
 	}
 
+	if !signupDomainAllowed(u.Email, getSettings().SignupDomains) {
+		waitlistSignup(rw, req, u.Name, u.Email)
+		return
+	}
+
+	risk, ok := checkSignupIP(rw, req, u.Email)
+	if !ok {
+		return
+	}
+
+	if reasons := botReasons(&signupSignals{
+		Honeypot:  req.PostFormValue(honeypotField),
+		FormToken: req.PostFormValue("formToken"),
+	}); len(reasons) > 0 {
+		quarantineSignup(rw, req, u, reasons)
+		return
+	}
+
 	// Silent Signup from cli and not signup form. Will not charge them, but will give them a free month
-	if err := db.Save(u); err != nil {
+	if err := tenantFor(req).Save(u); err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
+	recordSignupRisk(u, risk)
+	leaveWaitlist(u.Email)
+	recordConversion(req, "signup")
+	track("session.created", u, nil)
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status":    requests.StatusCreated,
@@ -584,7 +1046,10 @@ func CreateSessionHandler(rw http.ResponseWriter, req *http.Request) {
 
 // POST /developers/{token}/pay payments
 func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
-	var body requests.PaymentReq
+	var body struct {
+		requests.PaymentReq
+		BillingAddress *db.BillingAddress `json:"billingAddress"`
+	}
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&body)
 	if err != nil {
@@ -595,7 +1060,7 @@ func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	d, err := db.GetDeveloper(map[string]interface{}{"token": mux.Vars(req)["token"]})
+	d, err := tenantFor(req).GetDeveloper(map[string]interface{}{"token": mux.Vars(req)["token"]})
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -604,37 +1069,72 @@ func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Create Stripe Customer
-	customerParams := stripe.CustomerParams{
-		Email: d.Email,
-		Desc:  d.Name,
-		Token: body.StripeToken,
+	// Clients without a card token are sent to the hosted checkout.
+	if body.StripeToken == "" {
+		renderer.JSON(rw, http.StatusPaymentRequired, map[string]string{
+			"status":      requests.StatusFailed,
+			"error":       "Payment must be completed in the browser.",
+			"checkoutUrl": baseURL(req) + "/checkout/" + d.Token,
+		})
+		return
 	}
 
-	customer, err := stripe.Customers.Create(&customerParams)
+	plan, err := purchasePlan(d, db.PlanBowery)
 	if err != nil {
-		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+		status := http.StatusInternalServerError
+		if err == errPlanUnavailable {
+			status = http.StatusBadRequest
+		}
+		renderer.JSON(rw, status, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
+	plan = winBackPlan(d, plan)
+
+	// Older clients don't send an address, Checkout collects it instead.
+	if body.BillingAddress != nil {
+		if err := saveBillingAddress(d.ID, body.BillingAddress); err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+	}
 
-	// Charge Stripe Customer
-	chargeParams := stripe.ChargeParams{
-		Desc:     "Bowery 3",
-		Amount:   2900,
-		Currency: "usd",
-		Customer: customer.Id,
+	customer, err := createStripeCustomer(req.Context(), d)
+	if stripeUnavailable(rw, err) {
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
 	}
 
-	_, err = stripe.Charges.Create(&chargeParams)
+	pi, err := chargeCard(req.Context(), d, plan, customer, body.StripeToken, baseURL(req))
+	if stripeUnavailable(rw, err) {
+		return
+	}
 	if err != nil {
+		track("charge.failed", d, map[string]interface{}{"error": err.Error()})
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 		return
 	}
+	// The card is saved on the customer for renewals.
+	if err := db.SetStripeCustomer(d.ID, customer); err != nil {
+		fmt.Println("unable to save stripe customer for", d.Email, err)
+	}
 
-	if err := db.UpdateDeveloper(map[string]interface{}{"token": d.Token}, map[string]interface{}{"isPaid": true}); err != nil {
+	p, err := recordPayment(d, plan, db.PaymentPurchase, db.MethodCard, pi)
+	if err == nil {
+		_, err = settlePayment(p, pi)
+	}
+	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
@@ -642,6 +1142,33 @@ func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if pi.Status == "requires_action" {
+		// The bank wants 3-D Secure, the client opens actionUrl in a browser.
+		track("charge.action_required", d, nil)
+		renderer.JSON(rw, http.StatusPaymentRequired, map[string]string{
+			"status":    db.PaymentRequiresAction,
+			"error":     "Your bank needs you to confirm this payment.",
+			"actionUrl": pi.actionURL(),
+		})
+		return
+	}
+	if pi.Status == "processing" {
+		renderer.JSON(rw, http.StatusAccepted, map[string]string{
+			"status": db.PaymentPending,
+		})
+		return
+	}
+	if pi.Status != "succeeded" {
+		msg := "Your payment couldn't be completed."
+		if pi.LastPaymentError != nil {
+			msg = pi.LastPaymentError.Message
+		}
+		track("charge.failed", d, map[string]interface{}{"error": msg})
+		RenderTemplate(rw, "error", map[string]string{"Error": msg})
+		return
+	}
+
+	d.IsPaid = true
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status":    requests.StatusSuccess,
 		"developer": d,
@@ -653,7 +1180,7 @@ func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
 func SessionInfoHandler(rw http.ResponseWriter, req *http.Request) {
 	id := mux.Vars(req)["id"]
 	fmt.Println("Getting user by id", id)
-	u, err := db.GetDeveloperById(id)
+	u, err := tenantFor(req).GetDeveloperById(id)
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -661,41 +1188,133 @@ func SessionInfoHandler(rw http.ResponseWriter, req *http.Request) {
 		})
 		return
 	}
+	track("developer.heartbeat", u, nil)
+	state, err := developerLifecycle(u)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
 
-	if u.Expiration.After(time.Now()) {
+	// Paused developers are in a limited mode and aren't renewed.
+	if state == db.LifecyclePaused {
 		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 			"status":    requests.StatusFound,
 			"developer": u,
+			"lifecycle": state,
+			"limited":   true,
 		})
 		return
 	}
 
-	if u.StripeToken == "" {
+	if u.Expiration.After(developerNow(u.ID)) {
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status":          requests.StatusFound,
+			"developer":       u,
+			"lifecycle":       state,
+			"upgradeRequired": requestUpgradeRequired(req),
+		})
+		return
+	}
+
+	// Canceled developers aren't renewed.
+	customer := ""
+	if state != db.LifecycleCanceled {
+		customer, err = db.GetStripeCustomer(u.ID, db.BillingRenewal)
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+	}
+	if customer == "" {
 		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 			"status":    requests.StatusExpired,
 			"developer": u,
+			"lifecycle": state,
 		})
 		return
 	}
 
-	// Charge them, update expiration, & respond with found.
-	// Charge Stripe Customer
-	chargeParams := stripe.ChargeParams{
-		Desc:     "Crosby Annual License",
-		Amount:   2500,
-		Currency: "usd",
-		Customer: u.StripeToken,
+	plan, err := purchasePlan(u, db.PlanCrosby)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == errPlanUnavailable {
+			status = http.StatusBadRequest
+		}
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	// Charge them off session, update expiration, & respond with found.
+	pi, err := chargeOffSession(req.Context(), u, plan, customer)
+	if stripeUnavailable(rw, err) {
+		return
 	}
-	_, err = stripe.Charges.Create(&chargeParams)
 	if err != nil {
+		track("charge.failed", u, map[string]interface{}{"error": err.Error()})
+		markPastDue(u)
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
-	u.Expiration = time.Now()
-	if err := db.Save(u); err != nil { // not actually a save, but an update. fix
+
+	p, err := recordPayment(u, plan, db.PaymentRenewal, db.MethodCard, pi)
+	var status string
+	if err == nil {
+		status, err = settlePayment(p, pi)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	switch status {
+	case db.PaymentRequiresAction:
+		// The bank wants the developer to authenticate the renewal, they're
+		// emailed a link and the cli can open it too.
+		track("charge.action_required", u, nil)
+		if err := notifyPaymentAction(u, p, baseURL(req)); err != nil {
+			fmt.Println("unable to notify", u.Email, "of payment action", err)
+		}
+
+		renderer.JSON(rw, http.StatusPaymentRequired, map[string]string{
+			"status":    db.PaymentRequiresAction,
+			"error":     "Your bank needs you to confirm this payment.",
+			"actionUrl": baseURL(req) + "/payments/" + u.Token + "/" + p.ID + "/authenticate",
+		})
+		return
+	case db.PaymentFailed:
+		msg := "Your payment couldn't be completed."
+		if pi.LastPaymentError != nil {
+			msg = pi.LastPaymentError.Message
+		}
+		track("charge.failed", u, map[string]interface{}{"error": msg})
+		markPastDue(u)
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  msg,
+		})
+		return
+	}
+
+	u, err = tenantFor(req).GetDeveloperById(id)
+	if err == nil {
+		state, err = developerLifecycle(u)
+	}
+	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
@@ -704,17 +1323,27 @@ func SessionInfoHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
-		"status": requests.StatusFound,
-		"user":   u,
+		"status":    requests.StatusFound,
+		"user":      u,
+		"lifecycle": state,
 	})
 }
 
 // GET /admin/signup/:id, Renders signup find. Will also handle billing
 func SignUpHandler(rw http.ResponseWriter, req *http.Request) {
-	if err := RenderTemplate(rw, "signup", map[string]interface{}{
+	plan, err := db.GetPlan(db.PlanCrosby)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderTemplate(rw, experimentTemplate(rw, req, "signup"), map[string]interface{}{
 		"isSignup":     true,
 		"stripePubKey": stripePublicKey,
 		"id":           mux.Vars(req)["id"],
+		"plan":         plan,
+		"formToken":    newFormToken(),
+		"org":          orgFor(req),
 	}); err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 	}
@@ -722,7 +1351,7 @@ func SignUpHandler(rw http.ResponseWriter, req *http.Request) {
 
 // GET /admin/thanks!, Renders a thank you/confirmation message stored in static/thanks.html
 func ThanksHandler(rw http.ResponseWriter, req *http.Request) {
-	if err := RenderTemplate(rw, "thanks", map[string]interface{}{}); err != nil {
+	if err := RenderTemplate(rw, "thanks", map[string]interface{}{"org": orgFor(req)}); err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 	}
 }
@@ -739,7 +1368,7 @@ func ResetPasswordHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	u, err := db.GetDeveloper(map[string]interface{}{"email": email})
+	u, err := tenantFor(req).GetDeveloper(map[string]interface{}{"email": email})
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -748,7 +1377,16 @@ func ResetPasswordHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Reset links go back to the organization's domain if asked from one.
+	host := "http://broome.io"
+	fromName := "Bowery Support"
+	if org := orgFor(req); org != nil {
+		host = "https://" + hostname(req)
+		fromName = org.Name + " Support"
+	}
+
 	message, err := RenderEmail("password_email", map[string]interface{}{
+		"host":     host,
 		"name":     strings.Split(u.Name, " ")[0],
 		"id":       u.ID.Hex(),
 		"token":    u.Token,
@@ -762,16 +1400,16 @@ func ResetPasswordHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	_, err = mandrill.MessageSend(gochimp.Message{
+	err = sendEmail(req.Context(), gochimp.Message{
 		Subject:   "Bowery Password Reset",
 		FromEmail: "support@bowery.io",
-		FromName:  "Bowery Support",
+		FromName:  fromName,
 		To: []gochimp.Recipient{{
 			Email: u.Email,
 			Name:  u.Name,
 		}},
 		Html: message,
-	}, false)
+	})
 
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
@@ -791,7 +1429,7 @@ func ResetHandler(rw http.ResponseWriter, req *http.Request) {
 	id := mux.Vars(req)["id"]
 	token := mux.Vars(req)["token"]
 
-	u, err := db.GetDeveloperById(id)
+	u, err := tenantFor(req).GetDeveloperById(id)
 	if err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 		return
@@ -805,6 +1443,7 @@ func ResetHandler(rw http.ResponseWriter, req *http.Request) {
 	if err := RenderTemplate(rw, "password_reset", map[string]interface{}{
 		"Token": u.Token,
 		"ID":    u.ID.Hex(),
+		"org":   orgFor(req),
 	}); err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 	}
@@ -821,7 +1460,7 @@ func PasswordEditHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	id := req.FormValue("id")
-	u, err := db.GetDeveloperById(id)
+	u, err := tenantFor(req).GetDeveloperById(id)
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -832,13 +1471,14 @@ func PasswordEditHandler(rw http.ResponseWriter, req *http.Request) {
 
 	query := map[string]interface{}{"token": mux.Vars(req)["token"]}
 	update := map[string]interface{}{"password": util.HashPassword(req.FormValue("new"), u.Salt)}
-	if err := db.UpdateDeveloper(query, update); err != nil {
+	if err := tenantFor(req).UpdateDeveloper(query, update); err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
+	securityEvent(req, u, securityPasswordChanged, u.Email, "", nil)
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status": requests.StatusSuccess,
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Bowery/broome/db"
+)
+
+// benchThresholds are the most nanoseconds per request each benchmark may
+// take before TestBenchmarkThresholds fails, see scripts/loadtest.
+type benchThresholds map[string]int64
+
+// benchSetup mocks a developer and turns off rate limits, which would
+// otherwise reject the repeated requests from one client.
+func benchSetup(b *testing.B) string {
+	mock, err := db.MockDB()
+	if err != nil {
+		b.Fatal("Could not Mock DB:", err)
+	}
+
+	settingsMutex.Lock()
+	currentSettings = defaultSettings()
+	currentSettings.RateLimits = map[string]int{}
+	settingsMutex.Unlock()
+
+	return mock.ID.Hex()
+}
+
+func benchRequest(b *testing.B, newReq func() *http.Request) {
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		res := httptest.NewRecorder()
+		broomeServer(res, newReq())
+
+		if res.Code != http.StatusOK {
+			b.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+		}
+	}
+}
+
+func BenchmarkCreateToken(b *testing.B) {
+	benchSetup(b)
+	body, _ := json.Marshal(map[string]string{"Email": "byrd@bowery.io", "Password": "java$cript"})
+
+	benchRequest(b, func() *http.Request {
+		req, _ := http.NewRequest("POST", "http://broome.io/developers/token", bytes.NewReader(body))
+		return req
+	})
+}
+
+func BenchmarkDeveloperMe(b *testing.B) {
+	benchSetup(b)
+	mock, _ := db.GetDeveloper(map[string]interface{}{"email": "byrd@bowery.io"})
+
+	benchRequest(b, func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://broome.io/developers/me?token="+mock.Token, nil)
+		return req
+	})
+}
+
+func BenchmarkSessionInfo(b *testing.B) {
+	id := benchSetup(b)
+
+	benchRequest(b, func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://broome.io/session/"+id, nil)
+		return req
+	})
+}
+
+// TestBenchmarkThresholds runs the auth benchmarks and fails if any is slower
+// than its threshold. It's slow so only runs with BENCH_THRESHOLDS set.
+func TestBenchmarkThresholds(t *testing.T) {
+	path := os.Getenv("BENCH_THRESHOLDS")
+	if path == "" {
+		t.Skip("set BENCH_THRESHOLDS to the thresholds file to check for regressions")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thresholds := benchThresholds{}
+	if err := json.Unmarshal(data, &thresholds); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, bench := range map[string]func(*testing.B){
+		"CreateToken": BenchmarkCreateToken,
+		"DeveloperMe": BenchmarkDeveloperMe,
+		"SessionInfo": BenchmarkSessionInfo,
+	} {
+		max, ok := thresholds[name]
+		if !ok {
+			continue
+		}
+
+		res := testing.Benchmark(bench)
+		if res.NsPerOp() > max {
+			t.Errorf("%s took %dns/op, over the %dns/op threshold", name, res.NsPerOp(), max)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the signup saga. Each step of a signup is recorded as it happens,
+// and if one fails for good the steps already done are undone so nobody is
+// left half signed up.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Signup saga steps.
+const (
+	stepSave      = "save"
+	stepSubscribe = "subscribe"
+	stepEmail     = "email"
+)
+
+// Mailchimp list new developers are subscribed to.
+const signupListID = "200e892f56"
+
+// Sagas compensating for longer than this are assumed to have lost their
+// worker and are compensated again.
+const sagaCompensateTimeout = 5 * time.Minute
+
+// sagaSteps maps the outbox messages that are part of a signup to their step.
+// Messages without a step, e.g. Slack notifications, are best effort.
+var sagaSteps = map[string]string{
+	outboxSubscribe:    stepSubscribe,
+	outboxWelcomeEmail: stepEmail,
+}
+
+func init() {
+	schedule("sagas", time.Minute, resumeSagas)
+}
+
+// startSignupSaga records a signup before any of its steps happen. Only the
+// save is a step unless the developer is sent to Mailchimp and emailed.
+func startSignupSaga(developerID bson.ObjectId, email string, sideEffects bool) (*db.Saga, error) {
+	steps := []string{stepSave}
+	if sideEffects {
+		steps = append(steps, stepSubscribe, stepEmail)
+	}
+
+	s := &db.Saga{Kind: "signup", DeveloperID: developerID, Email: email}
+	return s, db.SaveSaga(s, steps...)
+}
+
+// completeSagaStep marks a step done, completing the saga once every step is.
+func completeSagaStep(developerID bson.ObjectId, step string) error {
+	s, err := db.GetSaga(bson.M{"developerId": developerID})
+	if err != nil {
+		return err
+	}
+
+	if err := db.UpdateSagaStep(s.ID, step, db.StepDone, ""); err != nil {
+		return err
+	}
+
+	for _, st := range s.Steps {
+		if st.Name != step && st.Status != db.StepDone {
+			return nil
+		}
+	}
+
+	err = db.TransitionSaga(s.ID, db.SagaRunning, db.SagaCompleted, "")
+	if err == db.ErrConflict {
+		// Already compensating, the step will be undone with the rest.
+		return nil
+	}
+
+	return err
+}
+
+// failSagaStep marks a step failed and undoes the saga.
+func failSagaStep(developerID bson.ObjectId, step string, cause error) error {
+	s, err := db.GetSaga(bson.M{"developerId": developerID})
+	if err != nil {
+		return err
+	}
+	if s.State != db.SagaRunning {
+		return nil
+	}
+
+	if err := db.UpdateSagaStep(s.ID, step, db.StepFailed, cause.Error()); err != nil {
+		return err
+	}
+
+	return compensateSaga(s.ID, db.SagaRunning, step+": "+cause.Error())
+}
+
+// compensateSaga claims a saga in the from state and undoes it. Claiming it
+// first means only one worker compensates a saga at a time.
+func compensateSaga(id bson.ObjectId, from, reason string) error {
+	err := db.TransitionSaga(id, from, db.SagaCompensating, reason)
+	if err == db.ErrConflict {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s, err := db.GetSaga(bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	return runCompensation(s)
+}
+
+// runCompensation undoes each step of a saga that happened. Every action is
+// safe to repeat, so a saga that fails part way is compensated again from
+// the start.
+func runCompensation(s *db.Saga) error {
+	errs := []string{}
+	undo := func(step string, fn func() error) {
+		st := s.Step(step)
+		if st == nil || st.Status == db.StepCompensated {
+			return
+		}
+
+		if err := fn(); err != nil {
+			errs = append(errs, step+": "+err.Error())
+			return
+		}
+
+		status := db.StepCompensated
+		if st.Status == db.StepPending {
+			status = db.StepSkipped
+		}
+		if err := db.UpdateSagaStep(s.ID, step, status, st.Error); err != nil {
+			errs = append(errs, step+": "+err.Error())
+		}
+	}
+
+	// Drop pending side effects first so none are performed mid compensation.
+	if err := db.DiscardOutboxMessages(s.DeveloperID); err != nil {
+		errs = append(errs, "outbox: "+err.Error())
+	}
+
+	undo(stepSubscribe, func() error {
+		if s.Step(stepSubscribe).Status != db.StepDone {
+			return nil
+		}
+
+		return unsubscribe(context.Background(), signupListID, s.Email)
+	})
+
+	// Welcome emails can't be unsent, so only one that wasn't sent is undone.
+	if st := s.Step(stepEmail); st != nil && st.Status != db.StepDone {
+		undo(stepEmail, func() error { return nil })
+	}
+
+	// The save is undone even if it failed, since a failed write may still
+	// have landed. Deleted developers can be restored by support.
+	undo(stepSave, func() error {
+		d, err := db.GetDeveloper(bson.M{"_id": s.DeveloperID})
+		if err == db.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = db.DeleteDeveloper(d)
+		return err
+	})
+
+	if len(errs) > 0 {
+		reason := strings.Join(errs, ", ")
+		notifySlack(slackChannel("activity"), "Unable to undo the signup for "+s.Email+", "+reason)
+		return db.TransitionSaga(s.ID, db.SagaCompensating, db.SagaStuck, reason)
+	}
+
+	return db.TransitionSaga(s.ID, db.SagaCompensating, db.SagaCompensated, "")
+}
+
+// resumeSagas compensates sagas whose worker died mid compensation.
+func resumeSagas() error {
+	ss, err := db.GetSagas(bson.M{
+		"state":     db.SagaCompensating,
+		"updatedAt": bson.M{"$lt": time.Now().Add(-sagaCompensateTimeout)},
+	}, 100)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range ss {
+		if err := runCompensation(s); err != nil {
+			fmt.Println("unable to compensate saga", s.ID.Hex(), err)
+		}
+	}
+
+	return nil
+}
+
+// GET /admin/sagas, Lists signup sagas, stuck ones by default
+func AdminSagasHandler(rw http.ResponseWriter, req *http.Request) {
+	state := req.FormValue("state")
+	if state == "" {
+		state = db.SagaStuck
+	}
+
+	ss, err := db.GetSagas(bson.M{"state": state}, 100)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"sagas":  ss,
+	})
+}
+
+// POST /admin/sagas/{id}/compensate, Tries again to undo a stuck saga
+func CompensateSagaHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid saga id",
+		})
+		return
+	}
+
+	// Sagas that aren't stuck are left alone and returned as they are.
+	err := compensateSaga(bson.ObjectIdHex(id), db.SagaStuck, "")
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	s, err := db.GetSaga(bson.M{"_id": bson.ObjectIdHex(id)})
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "saga.compensate", actor, s.Email+" "+s.State)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"saga":   s,
+	})
+}
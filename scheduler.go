@@ -0,0 +1,154 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the scheduler for recurring background jobs.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/Bowery/broome/db"
+)
+
+// job is a task run on an interval, optionally waiting until a time of day
+// before the first run. Jobs run on a single instance per interval unless
+// everyInstance is set.
+type job struct {
+	name          string
+	interval      time.Duration
+	hour          int
+	everyInstance bool
+	run           func() error
+}
+
+var jobs = []*job{}
+
+func init() {
+	scheduleEveryInstance("requested-jobs", 15*time.Second, runRequestedJobs)
+}
+
+// instanceID identifies this process when coordinating with other instances.
+var instanceID = func() string {
+	host, _ := os.Hostname()
+	return host + ":" + strconv.Itoa(os.Getpid()) + ":" + uuid.New()[:8]
+}()
+
+// schedule registers a job to run every interval once the server starts.
+func schedule(name string, interval time.Duration, run func() error) {
+	jobs = append(jobs, &job{name: name, interval: interval, hour: -1, run: run})
+}
+
+// scheduleEveryInstance registers a job that keeps this instance's own state
+// up to date, so it runs on every instance rather than just one.
+func scheduleEveryInstance(name string, interval time.Duration, run func() error) {
+	jobs = append(jobs, &job{name: name, interval: interval, hour: -1, everyInstance: true, run: run})
+}
+
+// scheduleDaily registers a job to run once a day at the given UTC hour.
+func scheduleDaily(name string, hour int, run func() error) {
+	jobs = append(jobs, &job{name: name, interval: 24 * time.Hour, hour: hour, run: run})
+}
+
+// findJob returns the registered job with the name.
+func findJob(name string) (*job, bool) {
+	for _, j := range jobs {
+		if j.name == name {
+			return j, true
+		}
+	}
+
+	return nil, false
+}
+
+// untilHour returns how long from now until the next occurrence of hour UTC.
+func untilHour(now time.Time, hour int) time.Duration {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+
+	return next.Sub(now)
+}
+
+func (j *job) exec() {
+	// Jobs on every instance keep that instance's own state, so they
+	// aren't recorded in the job store or cancellable.
+	if j.everyInstance {
+		if err := j.run(); err != nil {
+			fmt.Println("job", j.name, "failed:", err)
+		}
+		return
+	}
+
+	// The lock is held for most of the interval and not released, so the
+	// other instances skip this run instead of repeating it.
+	ok, err := db.AcquireLock("job:"+j.name, instanceID, j.interval*9/10)
+	if err != nil {
+		fmt.Println("job", j.name, "unable to lock:", err)
+		return
+	}
+	if ok {
+		j.runOnce()
+	}
+}
+
+// runOnce runs the job unless it's cancelled, recording the run in the job
+// store.
+func (j *job) runOnce() {
+	state, err := db.GetJobState(j.name)
+	if err != nil {
+		fmt.Println("job", j.name, "unable to get state:", err)
+	} else if state.Cancelled {
+		return
+	}
+
+	if err := db.StartJobRun(j.name, instanceID); err != nil {
+		fmt.Println("job", j.name, "unable to record run:", err)
+	}
+	err = j.run()
+	if err != nil {
+		fmt.Println("job", j.name, "failed:", err)
+	}
+	if err := db.FinishJobRun(j.name, redactError(err)); err != nil {
+		fmt.Println("job", j.name, "unable to record run:", err)
+	}
+}
+
+// runRequestedJobs runs the jobs an admin asked to run before their next
+// turn. Each request is taken by one instance.
+func runRequestedJobs() error {
+	for _, j := range jobs {
+		if j.everyInstance {
+			continue
+		}
+
+		ok, err := db.TakeJobRunRequest(j.name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			go j.runOnce()
+		}
+	}
+
+	return nil
+}
+
+// startJobs runs each registered job on its own ticker.
+func startJobs() {
+	for _, j := range jobs {
+		go func(j *job) {
+			if j.hour >= 0 {
+				time.Sleep(untilHour(time.Now(), j.hour))
+				j.exec()
+			}
+
+			for _ = range time.Tick(j.interval) {
+				j.exec()
+			}
+		}(j)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the repair of developer documents that don't match the schema.
+// The db package refuses writes that would break it and flags documents
+// that already do when they're read, and a daily job converts the fields it
+// can and leaves the rest flagged at /admin/developers/schema.
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+)
+
+// Flagged developers listed at once.
+const schemaFlagLimit = 200
+
+func init() {
+	scheduleDaily("repair-developer-schema", 5, repairDeveloperSchema)
+}
+
+// repairDeveloperSchema repairs every developer, printing what's left.
+func repairDeveloperSchema() error {
+	res, err := db.RepairDeveloperDocuments(false)
+	if err != nil {
+		return err
+	}
+
+	if res.Repaired > 0 || len(res.Flagged) > 0 {
+		fmt.Println("developer schema:", res.Checked, "checked,", res.Repaired, "repaired,", len(res.Flagged), "flagged")
+	}
+	return nil
+}
+
+// GET /admin/developers/schema, Lists developers whose documents don't match the schema
+func SchemaFlagsHandler(rw http.ResponseWriter, req *http.Request) {
+	fs, err := db.GetSchemaFlags(schemaFlagLimit)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusFound,
+		"developers": fs,
+	})
+}
+
+// POST /admin/developers/schema/repair, Repairs developer documents now, or with ?dryRun=true reports what it would change
+func RepairSchemaHandler(rw http.ResponseWriter, req *http.Request) {
+	dryRun := req.URL.Query().Get("dryRun") == "true"
+	res, err := db.RepairDeveloperDocuments(dryRun)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if !dryRun {
+		actor := ""
+		if dev, err := currentDeveloper(req); err == nil {
+			actor = dev.Email
+		}
+		audit(req, "developer.schema_repaired", actor, fmt.Sprintf("%d repaired, %d flagged", res.Repaired, len(res.Flagged)))
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusSuccess,
+		"repair": res,
+	})
+}
@@ -0,0 +1,51 @@
+// k6 load profile for the auth endpoints.
+//
+//   BROOME_URL=http://localhost:4000 BROOME_EMAIL=... BROOME_PASSWORD=... \
+//     k6 run scripts/loadtest/auth.js
+//
+// Rate limits should be raised in the settings first, otherwise most token
+// requests are rejected.
+import http from "k6/http";
+import { check } from "k6";
+
+const base = __ENV.BROOME_URL || "http://localhost:4000";
+
+export const options = {
+  stages: [
+    { duration: "30s", target: 20 },
+    { duration: "2m", target: 50 },
+    { duration: "30s", target: 0 },
+  ],
+  // Same limits as the regression thresholds in thresholds.json, but end to
+  // end rather than per handler.
+  thresholds: {
+    http_req_failed: ["rate<0.01"],
+    "http_req_duration{name:token}": ["p(95)<150"],
+    "http_req_duration{name:me}": ["p(95)<75"],
+    "http_req_duration{name:session}": ["p(95)<100"],
+  },
+};
+
+export function setup() {
+  const res = http.post(base + "/developers/token", JSON.stringify({
+    email: __ENV.BROOME_EMAIL,
+    password: __ENV.BROOME_PASSWORD,
+  }), { headers: { "Content-Type": "application/json" } });
+
+  const body = res.json();
+  return { token: body.token, id: body.developer ? body.developer._id : "" };
+}
+
+export default function (data) {
+  const token = http.post(base + "/developers/token", JSON.stringify({
+    email: __ENV.BROOME_EMAIL,
+    password: __ENV.BROOME_PASSWORD,
+  }), { headers: { "Content-Type": "application/json" }, tags: { name: "token" } });
+  check(token, { "token created": (r) => r.status === 200 });
+
+  const me = http.get(base + "/developers/me?token=" + data.token, { tags: { name: "me" } });
+  check(me, { "me found": (r) => r.status === 200 });
+
+  const session = http.get(base + "/session/" + data.id, { tags: { name: "session" } });
+  check(session, { "session found": (r) => r.status === 200 });
+}
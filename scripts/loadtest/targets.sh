@@ -0,0 +1,25 @@
+#!/bin/bash
+#
+# Writes vegeta targets for the auth endpoints and runs an attack.
+#
+#   BROOME_URL=http://localhost:4000 BROOME_TOKEN=... BROOME_ID=... \
+#     ./scripts/loadtest/targets.sh 50 60s
+#
+RATE=${1:-50}
+DURATION=${2:-60s}
+URL=${BROOME_URL:-http://localhost:4000}
+TARGETS=$(mktemp)
+
+cat > $TARGETS <<TARGETS
+GET $URL/developers/me?token=$BROOME_TOKEN
+
+GET $URL/session/$BROOME_ID
+
+POST $URL/developers/token
+Content-Type: application/json
+@$(dirname $0)/token.json
+TARGETS
+
+echo "{\"email\": \"$BROOME_EMAIL\", \"password\": \"$BROOME_PASSWORD\"}" > $(dirname $0)/token.json
+vegeta attack -targets=$TARGETS -rate=$RATE -duration=$DURATION | vegeta report
+rm -f $TARGETS $(dirname $0)/token.json
@@ -0,0 +1,177 @@
+// Copyright 2014 Bowery, Inc.
+// Contains security events on developer accounts. Each is recorded in the
+// audit log against the developer, shown to them in their security feed and
+// emailed to them with the event's template.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// Security events.
+const (
+	securityPasswordChanged = "password.changed"
+	securityEmailChanged    = "email.changed"
+	securityTokenCreated    = "token.created"
+	securityTokenRevoked    = "token.revoked"
+	securityNewCountry      = "login.new-country"
+)
+
+// securityEmail is the email sent for an event.
+type securityEmail struct {
+	Subject  string
+	Template string
+}
+
+var securityEmails = map[string]*securityEmail{
+	securityPasswordChanged: {"Your Bowery password was changed", "security_password_email"},
+	securityEmailChanged:    {"Your Bowery email was changed", "security_email_email"},
+	securityTokenCreated:    {"A new Bowery token was created", "security_token_email"},
+	securityTokenRevoked:    {"Your Bowery token was revoked", "security_revoked_email"},
+	securityNewCountry:      {"New sign in to your Bowery account", "security_country_email"},
+}
+
+// securityActions are the audit log actions shown in a developer's feed.
+var securityActions = []string{
+	securityPasswordChanged,
+	securityEmailChanged,
+	securityTokenCreated,
+	securityTokenRevoked,
+	securityNewCountry,
+}
+
+// requestCountry returns the caller's country code, set by the CDN in front
+// of broome. Like X-Forwarded-For it's only trusted with TRUST_PROXY.
+func requestCountry(req *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "" {
+		return ""
+	}
+
+	header := os.Getenv("COUNTRY_HEADER")
+	if header == "" {
+		header = "CF-IPCountry"
+	}
+
+	country := strings.ToUpper(strings.TrimSpace(req.Header.Get(header)))
+	if len(country) != 2 || country == "XX" {
+		return ""
+	}
+	return country
+}
+
+// securityEvent records an event on d's account and emails them about it.
+// data is passed to the template, with previousEmail also emailed so a
+// changed address can't hide the change.
+func securityEvent(req *http.Request, d *schemas.Developer, action, actor, detail string, data map[string]interface{}) {
+	country := requestCountry(req)
+	err := db.SaveAuditLog(&db.AuditLog{
+		Action:      action,
+		Actor:       actor,
+		DeveloperID: d.ID,
+		IP:          clientIP(req),
+		Country:     country,
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		Detail:      detail,
+	})
+	if err != nil {
+		fmt.Println("unable to save audit log", action, err)
+	} else {
+		go exportAuditLogs()
+	}
+
+	if err := sendSecurityEmail(d, action, clientIP(req), country, data); err != nil {
+		fmt.Println("unable to send security email", action, "to", d.Email, err)
+	}
+}
+
+// sendSecurityEmail sends the email for an event.
+func sendSecurityEmail(d *schemas.Developer, action, ip, country string, data map[string]interface{}) error {
+	e, ok := securityEmails[action]
+	if !ok {
+		return nil
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["name"] = strings.Split(d.Name, " ")[0]
+	data["ip"] = ip
+	data["country"] = country
+	data["time"] = time.Now().UTC().Format("January 2, 2006 at 15:04 MST")
+
+	message, err := RenderEmail(e.Template, data)
+	if err != nil {
+		return err
+	}
+
+	to := []gochimp.Recipient{{Email: d.Email, Name: d.Name}}
+	if previous, ok := data["previousEmail"].(string); ok && previous != "" && previous != d.Email {
+		to = append(to, gochimp.Recipient{Email: previous, Name: d.Name})
+	}
+
+	return sendEmail(context.Background(), gochimp.Message{
+		Subject:   e.Subject,
+		FromEmail: "support@bowery.io",
+		FromName:  "Bowery Support",
+		To:        to,
+		Html:      message,
+	})
+}
+
+// loginEvents records a sign in. A new country is emailed instead of the
+// new token, so a sign in sends one email.
+func loginEvents(req *http.Request, d *schemas.Developer) {
+	if country := requestCountry(req); country != "" {
+		isNew, err := db.AddLoginCountry(d.ID, country)
+		if err != nil {
+			fmt.Println("unable to record login country for", d.Email, err)
+		}
+		if isNew {
+			securityEvent(req, d, securityNewCountry, d.Email, "", nil)
+			return
+		}
+	}
+
+	securityEvent(req, d, securityTokenCreated, d.Email, "", nil)
+}
+
+// GET /developers/{token}/security-events, Lists security events on the developer's account
+func SecurityEventsHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	ls, err := db.GetAuditLogs(bson.M{
+		"developerId": d.ID,
+		"action":      bson.M{"$in": securityActions},
+	}, 50)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"events": ls,
+	})
+}
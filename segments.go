@@ -0,0 +1,734 @@
+// Copyright 2014 Bowery, Inc.
+// Contains saved developer segments. A segment is a filter expression like
+//
+//	plan = pro AND lastActiveAt < 30d
+//
+// made of comparisons joined with AND, OR and NOT and grouped with
+// parentheses. Durations compare a time's age, so lastActiveAt < 30d is
+// active in the last 30 days, while dates compare the time itself. tag = vip
+// matches developers with the tag, tag != vip those without it.
+// Segments feed broadcast email, exports, feature flags and the revenue
+// report. Big segments are materialized nightly.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Kinds of segment fields.
+const (
+	segmentString = iota
+	segmentBool
+	segmentVersion
+	segmentTime
+	segmentTags
+)
+
+// segmentSubject is a developer as segments see them.
+type segmentSubject struct {
+	*db.DeveloperAttributes
+	LastActiveAt time.Time
+}
+
+// segmentField is a field expressions can filter on.
+type segmentField struct {
+	Kind  int
+	Value func(s *segmentSubject) interface{}
+}
+
+var segmentFields = map[string]*segmentField{
+	"plan": {segmentString, func(s *segmentSubject) interface{} {
+		if s.Plan != "" {
+			return s.Plan
+		}
+		if s.IsPaid {
+			return "paid"
+		}
+		return "free"
+	}},
+	"email":        {segmentString, func(s *segmentSubject) interface{} { return s.Email }},
+	"name":         {segmentString, func(s *segmentSubject) interface{} { return s.Name }},
+	"engineer":     {segmentString, func(s *segmentSubject) interface{} { return s.IntegrationEngineer }},
+	"paid":         {segmentBool, func(s *segmentSubject) interface{} { return s.IsPaid }},
+	"admin":        {segmentBool, func(s *segmentSubject) interface{} { return s.IsAdmin }},
+	"version":      {segmentVersion, func(s *segmentSubject) interface{} { return s.Version }},
+	"createdAt":    {segmentTime, func(s *segmentSubject) interface{} { return s.SignedUpAt() }},
+	"expiration":   {segmentTime, func(s *segmentSubject) interface{} { return s.Expiration }},
+	"lastActiveAt": {segmentTime, func(s *segmentSubject) interface{} { return s.LastActiveAt }},
+	"tag":          {segmentTags, func(s *segmentSubject) interface{} { return s.Tags }},
+}
+
+var segmentDuration = regexp.MustCompile(`^(\d+)([hdw])$`)
+
+func init() {
+	scheduleDaily("materialize-segments", 3, materializeSegments)
+}
+
+// segmentExpr is a parsed expression.
+type segmentExpr interface {
+	match(s *segmentSubject, now time.Time) bool
+}
+
+type segmentAnd struct{ left, right segmentExpr }
+type segmentOr struct{ left, right segmentExpr }
+type segmentNot struct{ expr segmentExpr }
+
+func (e *segmentAnd) match(s *segmentSubject, now time.Time) bool {
+	return e.left.match(s, now) && e.right.match(s, now)
+}
+
+func (e *segmentOr) match(s *segmentSubject, now time.Time) bool {
+	return e.left.match(s, now) || e.right.match(s, now)
+}
+
+func (e *segmentNot) match(s *segmentSubject, now time.Time) bool {
+	return !e.expr.match(s, now)
+}
+
+// segmentCond compares a field to a value. Value is a string, bool, date
+// or an age.
+type segmentCond struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+func (c *segmentCond) match(s *segmentSubject, now time.Time) bool {
+	field := segmentFields[c.Field]
+	value := field.Value(s)
+
+	switch field.Kind {
+	case segmentString:
+		str, want := strings.ToLower(value.(string)), strings.ToLower(c.Value.(string))
+		if c.Op == "contains" {
+			return strings.Contains(str, want)
+		}
+		return compareOp(c.Op, strings.Compare(str, want))
+	case segmentBool:
+		return (value.(bool) == c.Value.(bool)) == (c.Op == "=")
+	case segmentTags:
+		want := strings.ToLower(c.Value.(string))
+		has := false
+		for _, tag := range value.([]string) {
+			if c.Op == "contains" {
+				has = has || strings.Contains(tag, want)
+			} else {
+				has = has || tag == want
+			}
+		}
+		return has == (c.Op != "!=")
+	case segmentVersion:
+		if value.(string) == "" {
+			return false
+		}
+		return compareOp(c.Op, compareVersions(value.(string), c.Value.(string)))
+	case segmentTime:
+		t := value.(time.Time)
+		if age, ok := c.Value.(time.Duration); ok {
+			actual := time.Duration(math.MaxInt64)
+			if !t.IsZero() {
+				actual = now.Sub(t)
+			}
+			return compareOp(c.Op, compareDurations(actual, age))
+		}
+		return compareOp(c.Op, compareTimes(t, c.Value.(time.Time)))
+	}
+
+	return false
+}
+
+// compareOp applies op to the result of a comparison.
+func compareOp(op string, cmp int) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+
+	return false
+}
+
+func compareDurations(a, b time.Duration) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// lexSegment splits an expression into tokens. Quoted strings keep their
+// quotes so values can't be mistaken for keywords.
+func lexSegment(expr string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(expr); {
+		ch := rune(expr[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '"' || ch == '\'':
+			end := strings.IndexRune(expr[i+1:], ch)
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, expr[i:i+end+2])
+			i += end + 2
+		case strings.ContainsRune("=!<>", ch):
+			op := string(ch)
+			if i+1 < len(expr) && expr[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, errors.New("expected !=")
+			}
+			tokens = append(tokens, op)
+			i += len(op)
+		default:
+			start := i
+			for i < len(expr) && !unicode.IsSpace(rune(expr[i])) && !strings.ContainsRune("()=!<>\"'", rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, expr[start:i])
+		}
+	}
+
+	return tokens, nil
+}
+
+// segmentParser is a recursive descent parser over the tokens.
+type segmentParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseSegment parses and checks an expression.
+func parseSegment(expr string) (segmentExpr, error) {
+	tokens, err := lexSegment(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("expression is empty")
+	}
+
+	p := &segmentParser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+func (p *segmentParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *segmentParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *segmentParser) or() (segmentExpr, error) {
+	left, err := p.and()
+	for err == nil && strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		var right segmentExpr
+		if right, err = p.and(); err == nil {
+			left = &segmentOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *segmentParser) and() (segmentExpr, error) {
+	left, err := p.unary()
+	for err == nil && strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		var right segmentExpr
+		if right, err = p.unary(); err == nil {
+			left = &segmentAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *segmentParser) unary() (segmentExpr, error) {
+	switch t := p.peek(); {
+	case strings.EqualFold(t, "NOT"):
+		p.next()
+		e, err := p.unary()
+		return &segmentNot{e}, err
+	case t == "(":
+		p.next()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("expected )")
+		}
+		return e, nil
+	}
+
+	return p.cond()
+}
+
+func (p *segmentParser) cond() (segmentExpr, error) {
+	name := p.next()
+	field, ok := segmentFields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+
+	op := strings.ToLower(p.next())
+	raw := p.next()
+	if raw == "" || raw == "(" || raw == ")" {
+		return nil, fmt.Errorf("%s %s needs a value", name, op)
+	}
+	quoted := strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'")
+	if quoted {
+		raw = raw[1 : len(raw)-1]
+	}
+
+	c := &segmentCond{Field: name, Op: op}
+	switch field.Kind {
+	case segmentString, segmentTags:
+		if op != "=" && op != "!=" && op != "contains" {
+			return nil, fmt.Errorf("%s takes =, != or contains", name)
+		}
+		c.Value = raw
+	case segmentBool:
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("%s takes = or !=", name)
+		}
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", name)
+		}
+		c.Value = b
+	case segmentVersion:
+		if !validOp(op) {
+			return nil, fmt.Errorf("unknown operator %q", op)
+		}
+		c.Value = raw
+	case segmentTime:
+		if op != "<" && op != "<=" && op != ">" && op != ">=" {
+			return nil, fmt.Errorf("%s takes <, <=, > or >=", name)
+		}
+		if m := segmentDuration.FindStringSubmatch(raw); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			unit := map[string]time.Duration{"h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[m[2]]
+			c.Value = time.Duration(n) * unit
+		} else if t, err := time.Parse("2006-01-02", raw); err == nil {
+			c.Value = t
+		} else if t, err := time.Parse(time.RFC3339, raw); err == nil {
+			c.Value = t
+		} else {
+			return nil, fmt.Errorf("%s must be compared to an age like 30d or a date", name)
+		}
+	}
+
+	return c, nil
+}
+
+// validOp reports whether op is a comparison.
+func validOp(op string) bool {
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// segmentSubjects loads the developers matching a query for segments.
+func segmentSubjects(query bson.M) ([]*segmentSubject, error) {
+	attrs, err := db.GetDeveloperAttributes(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only read heartbeats for everyone when loading everyone.
+	ids := []string{}
+	if _, scoped := query["_id"]; scoped {
+		for _, a := range attrs {
+			ids = append(ids, a.ID.Hex())
+		}
+	}
+	last, err := db.LastHeartbeats(ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	subjects := make([]*segmentSubject, 0, len(attrs))
+	for _, a := range attrs {
+		subjects = append(subjects, &segmentSubject{DeveloperAttributes: a, LastActiveAt: last[a.ID.Hex()]})
+	}
+	return subjects, nil
+}
+
+// evaluateSegment returns the ids of developers matching a segment now.
+func evaluateSegment(s *db.Segment) ([]bson.ObjectId, error) {
+	e, err := parseSegment(s.Expression)
+	if err != nil {
+		return nil, err
+	}
+	subjects, err := segmentSubjects(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ids := []bson.ObjectId{}
+	for _, subject := range subjects {
+		if e.match(subject, now) {
+			ids = append(ids, subject.ID)
+		}
+	}
+	return ids, nil
+}
+
+// segmentMemberIDs returns a segment's members, the stored ones if it's
+// been materialized.
+func segmentMemberIDs(slug string) ([]bson.ObjectId, error) {
+	s, err := db.GetSegment(slug)
+	if err != nil {
+		return nil, err
+	}
+	if s.Materialize && !s.MaterializedAt.IsZero() {
+		return db.GetSegmentMemberIDs(slug)
+	}
+
+	return evaluateSegment(s)
+}
+
+// inSegment reports whether a developer is in a segment, only evaluating
+// the developer for segments that aren't materialized.
+func inSegment(slug string, d *schemas.Developer) (bool, error) {
+	s, err := db.GetSegment(slug)
+	if err != nil {
+		return false, err
+	}
+	if s.Materialize && !s.MaterializedAt.IsZero() {
+		return db.IsSegmentMember(slug, d.ID)
+	}
+
+	e, err := parseSegment(s.Expression)
+	if err != nil {
+		return false, err
+	}
+	subjects, err := segmentSubjects(bson.M{"_id": d.ID})
+	if err != nil || len(subjects) == 0 {
+		return false, err
+	}
+	return e.match(subjects[0], time.Now()), nil
+}
+
+// materializeSegments stores the members of materialized segments.
+func materializeSegments() error {
+	ss, err := db.GetSegments(bson.M{"materialize": true})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range ss {
+		if err := materializeSegment(s); err != nil {
+			return fmt.Errorf("segment %s: %s", s.Slug, err)
+		}
+	}
+	return nil
+}
+
+// materializeSegment evaluates a segment and stores its members.
+func materializeSegment(s *db.Segment) error {
+	ids, err := evaluateSegment(s)
+	if err != nil {
+		return err
+	}
+
+	return db.ReplaceSegmentMembers(s.Slug, ids)
+}
+
+// validateSegment checks a segment before it's saved.
+func validateSegment(s *db.Segment) error {
+	if !slugPattern.MatchString(s.Slug) {
+		return errors.New("slug must be lower case letters, numbers and dashes")
+	}
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	_, err := parseSegment(s.Expression)
+	return err
+}
+
+// segmentFromRoute returns the segment in the route, writing the error
+// response if there isn't one.
+func segmentFromRoute(rw http.ResponseWriter, req *http.Request) (*db.Segment, bool) {
+	s, err := db.GetSegment(mux.Vars(req)["slug"])
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return nil, false
+	}
+
+	return s, true
+}
+
+// GET /admin/segments, Lists saved segments
+func AdminSegmentsHandler(rw http.ResponseWriter, req *http.Request) {
+	ss, err := db.GetSegments(bson.M{})
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"segments": ss,
+	})
+}
+
+// PUT /admin/segments/{slug}, Creates or replaces a segment
+func UpdateSegmentHandler(rw http.ResponseWriter, req *http.Request) {
+	s := &db.Segment{}
+	if err := json.NewDecoder(req.Body).Decode(s); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	s.Slug = mux.Vars(req)["slug"]
+	s.Name = strings.TrimSpace(s.Name)
+	s.Size, s.MaterializedAt = 0, time.Time{}
+	if err := validateSegment(s); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if dev, err := currentDeveloper(req); err == nil {
+		s.UpdatedBy = dev.Email
+	}
+	if err := db.SaveSegment(s); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	audit(req, "segment.saved", s.UpdatedBy, s.Slug+": "+s.Expression)
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusUpdated,
+		"segment": s,
+	})
+}
+
+// DELETE /admin/segments/{slug}, Removes a segment
+func DeleteSegmentHandler(rw http.ResponseWriter, req *http.Request) {
+	s, ok := segmentFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteSegment(s.Slug); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "segment.deleted", actor, s.Slug)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// GET /admin/segments/{slug}/members, Lists a segment's developers, or exports them with format=csv
+func SegmentMembersHandler(rw http.ResponseWriter, req *http.Request) {
+	s, ok := segmentFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	ids, err := segmentMemberIDs(s.Slug)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	subjects, err := segmentSubjects(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if req.FormValue("format") == "csv" {
+		writeSegmentCSV(rw, s.Slug, subjects)
+		return
+	}
+
+	type member struct {
+		ID           string    `json:"id"`
+		Name         string    `json:"name"`
+		Email        string    `json:"email"`
+		Plan         string    `json:"plan"`
+		Tags         []string  `json:"tags"`
+		LastActiveAt time.Time `json:"lastActiveAt,omitempty"`
+	}
+	members := []*member{}
+	for _, subject := range subjects {
+		members = append(members, &member{
+			ID:           subject.ID.Hex(),
+			Name:         subject.Name,
+			Email:        subject.Email,
+			Plan:         segmentFields["plan"].Value(subject).(string),
+			Tags:         subject.Tags,
+			LastActiveAt: subject.LastActiveAt,
+		})
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":         requests.StatusFound,
+		"segment":        s,
+		"materializedAt": s.MaterializedAt,
+		"members":        members,
+	})
+}
+
+// writeSegmentCSV writes a segment's members as a CSV download.
+func writeSegmentCSV(rw http.ResponseWriter, slug string, subjects []*segmentSubject) {
+	rw.Header().Set("Content-Type", "text/csv")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", slug+"-segment.csv"))
+
+	w := csv.NewWriter(rw)
+	w.Write([]string{"id", "name", "email", "plan", "paid", "created", "last activity", "tags"})
+	for _, s := range subjects {
+		lastActive := ""
+		if !s.LastActiveAt.IsZero() {
+			lastActive = s.LastActiveAt.Format(time.RFC3339)
+		}
+
+		w.Write([]string{
+			s.ID.Hex(),
+			s.Name,
+			s.Email,
+			segmentFields["plan"].Value(s).(string),
+			strconv.FormatBool(s.IsPaid),
+			s.SignedUpAt().Format(time.RFC3339),
+			lastActive,
+			strings.Join(s.Tags, " "),
+		})
+	}
+	w.Flush()
+}
+
+// GET /admin/segments/{slug}/members/{email}, Checks whether a developer is in a segment
+func SegmentMemberHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"email": mux.Vars(req)["email"]})
+	if err != nil {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	member, err := inSegment(mux.Vars(req)["slug"], d)
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"member": member,
+	})
+}
+
+// POST /admin/segments/{slug}/materialize, Stores a segment's members now instead of waiting for the nightly run
+func MaterializeSegmentHandler(rw http.ResponseWriter, req *http.Request) {
+	s, ok := segmentFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	if err := materializeSegment(s); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
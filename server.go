@@ -0,0 +1,167 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the http server settings. The CLI makes lots of small requests so
+// connections are kept alive and HTTP/2 is enabled to multiplex them.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// serverConfig holds the connection settings, each can be overridden with
+// the environment variable noted.
+type serverConfig struct {
+	ReadTimeout       time.Duration // HTTP_READ_TIMEOUT
+	ReadHeaderTimeout time.Duration // HTTP_READ_HEADER_TIMEOUT
+	WriteTimeout      time.Duration // HTTP_WRITE_TIMEOUT
+	IdleTimeout       time.Duration // HTTP_IDLE_TIMEOUT
+	RequestTimeout    time.Duration // HTTP_REQUEST_TIMEOUT, how long a handler's calls out can take
+	MaxHeaderBytes    int           // HTTP_MAX_HEADER_BYTES
+	HTTP2             bool          // HTTP2, "false" disables it
+	TLSCert           string        // TLS_CERT
+	TLSKey            string        // TLS_KEY
+	ACME              bool          // ACME, "true" provisions certificates for organization domains
+	ACMEAddr          string        // ACME_ADDR, where TLS is served when ACME is on
+	AccessLog         bool          // ACCESS_LOG, "false" turns the access log off
+	ShutdownTimeout   time.Duration // SHUTDOWN_TIMEOUT, how long in-flight requests get to finish
+}
+
+var httpConfig = loadServerConfig(os.Getenv)
+
+func defaultServerConfig() *serverConfig {
+	return &serverConfig{
+		ReadTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		RequestTimeout:    25 * time.Second,
+		MaxHeaderBytes:    64 << 10,
+		HTTP2:             true,
+		ACMEAddr:          ":443",
+		AccessLog:         true,
+		ShutdownTimeout:   30 * time.Second,
+	}
+}
+
+// loadServerConfig applies environment overrides to the defaults, values
+// that can't be parsed are ignored.
+func loadServerConfig(getenv func(string) string) *serverConfig {
+	c := defaultServerConfig()
+
+	for variable, dest := range map[string]*time.Duration{
+		"HTTP_READ_TIMEOUT":        &c.ReadTimeout,
+		"HTTP_READ_HEADER_TIMEOUT": &c.ReadHeaderTimeout,
+		"HTTP_WRITE_TIMEOUT":       &c.WriteTimeout,
+		"HTTP_IDLE_TIMEOUT":        &c.IdleTimeout,
+		"HTTP_REQUEST_TIMEOUT":     &c.RequestTimeout,
+		"SHUTDOWN_TIMEOUT":         &c.ShutdownTimeout,
+	} {
+		if d, err := time.ParseDuration(getenv(variable)); err == nil && d > 0 {
+			*dest = d
+		}
+	}
+
+	if n, err := strconv.Atoi(getenv("HTTP_MAX_HEADER_BYTES")); err == nil && n > 0 {
+		c.MaxHeaderBytes = n
+	}
+	if val := getenv("HTTP2"); val != "" {
+		c.HTTP2 = val != "false" && val != "0"
+	}
+	c.TLSCert = getenv("TLS_CERT")
+	c.TLSKey = getenv("TLS_KEY")
+	c.ACME = getenv("ACME") == "true"
+	if addr := getenv("ACME_ADDR"); addr != "" {
+		c.ACMEAddr = addr
+	}
+	if val := getenv("ACCESS_LOG"); val != "" {
+		c.AccessLog = val != "false" && val != "0"
+	}
+
+	return c
+}
+
+// withDeadline gives each request's context a deadline, so calls made with
+// it are abandoned once the response can't be written anyway. The context
+// is also cancelled when the client goes away. The default is under the
+// write timeout to leave time for the error response.
+func withDeadline(handler http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// newHTTPServer builds the server for handler. Without TLS, HTTP/2 is served
+// in cleartext for load balancers that speak it to their backends.
+func newHTTPServer(addr string, handler http.Handler, c *serverConfig) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+	srv.SetKeepAlivesEnabled(true)
+	if c.ACME {
+		srv.TLSConfig = certManager.TLSConfig()
+	}
+
+	if !c.HTTP2 {
+		// A non nil, empty TLSNextProto turns off HTTP/2 over TLS.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		srv.Handler = handler
+		return srv
+	}
+
+	h2 := &http2.Server{IdleTimeout: c.IdleTimeout}
+	if c.ACME || (c.TLSCert != "" && c.TLSKey != "") {
+		http2.ConfigureServer(srv, h2)
+		srv.Handler = handler
+		return srv
+	}
+
+	srv.Handler = h2c.NewHandler(handler, h2)
+	return srv
+}
+
+// serverPort returns the address the server listens on.
+func serverPort() string {
+	if os.Getenv("ENV") == "production" {
+		return ":80"
+	}
+
+	return ":4000"
+}
+
+// listen serves on srv, using TLS when a certificate is configured. With
+// ACME, srv's address answers certificate challenges and everything else is
+// served over TLS on the ACME address. It returns once a signal has shut
+// the servers down and their requests have drained.
+func listen(srv *http.Server, c *serverConfig) error {
+	if c.ACME {
+		challenges := &http.Server{
+			Addr:              srv.Addr,
+			Handler:           certManager.HTTPHandler(srv.Handler),
+			ReadHeaderTimeout: c.ReadHeaderTimeout,
+		}
+
+		srv.Addr = c.ACMEAddr
+		return serve(&servedServer{srv: challenges}, &servedServer{srv: srv, tls: true})
+	}
+
+	if c.TLSCert != "" && c.TLSKey != "" {
+		return serve(&servedServer{srv: srv, tls: true, cert: c.TLSCert, key: c.TLSKey})
+	}
+
+	return serve(&servedServer{srv: srv})
+}
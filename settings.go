@@ -0,0 +1,430 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the runtime settings that can be changed without a restart. The
+// settings are read from SETTINGS_FILE or SETTINGS_URL and polled for changes.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// How often the settings source is checked for changes.
+const settingsPollInterval = 15 * time.Second
+
+// settings are the values that can change at runtime.
+type settings struct {
+	// Requests allowed per client per minute, by limit name.
+	RateLimits map[string]int `json:"rateLimits"`
+
+	// API requests allowed per token per day, by plan slug, or "free" and
+	// "paid" for developers without one. Plans without a quota are unlimited.
+	Quotas map[string]int `json:"quotas"`
+
+	// Signup IP risk thresholds.
+	SignupRisk signupRiskSettings `json:"signupRisk"`
+
+	// Email domains signups are restricted to during a private beta, e.g.
+	// "partner.com". Others are added to the waitlist. Empty lets anyone
+	// sign up.
+	SignupDomains []string `json:"signupDomains"`
+
+	// Days kept before logs are pruned, by kind: "auditLogs", "events",
+	// "developerVersions" and "shadowResults". Kinds left out are kept
+	// forever.
+	Retention map[string]int `json:"retention"`
+
+	// Feature flags by name.
+	Features map[string]bool `json:"features"`
+
+	// Saved segments feature flags are also on for, by flag name.
+	FeatureSegments map[string]string `json:"featureSegments"`
+
+	// Slack channels by purpose, e.g. "activity".
+	SlackChannels map[string]string `json:"slackChannels"`
+
+	// Plans to create or update, saved the same way as the pricing editor.
+	Plans []*db.Plan `json:"plans"`
+
+	// Origins allowed to embed the signup widget, e.g. "https://bowery.io".
+	EmbedOrigins []string `json:"embedOrigins"`
+
+	// Danger zone actions that need a second admin's approval, e.g. "refund".
+	Approvals []string `json:"approvals"`
+
+	// Refunds and credits above this amount, in the charge's smallest
+	// currency unit, need a second admin. 0 means none do.
+	RefundApprovalAmount int64 `json:"refundApprovalAmount"`
+
+	// Service level objectives by route, as the access log names them,
+	// e.g. "POST /developers/token".
+	SLOs map[string]*sloTarget `json:"slos"`
+}
+
+// signupRiskSettings are the IP reputation scores, from 0 to 100, signups
+// are refused or flagged at and how many signups an IP may make an hour. 0
+// turns a check off.
+type signupRiskSettings struct {
+	BlockScore   int `json:"blockScore"`
+	FlagScore    int `json:"flagScore"`
+	PerIPPerHour int `json:"perIpPerHour"`
+}
+
+// defaultSettings are used until a settings source has been loaded.
+func defaultSettings() *settings {
+	return &settings{
+		RateLimits: map[string]int{
+			"signup":       10,
+			"signup-cli":   5,
+			"login":        30,
+			"abuse":        5,
+			"redeem":       10,
+			"webhook-ping": 10,
+		},
+		Quotas:          map[string]int{},
+		SignupRisk:      signupRiskSettings{BlockScore: 90, FlagScore: 50, PerIPPerHour: 5},
+		Retention:       map[string]int{},
+		Features:        map[string]bool{},
+		FeatureSegments: map[string]string{},
+		SlackChannels:   map[string]string{"activity": "#activity"},
+		Plans:           []*db.Plan{},
+		EmbedOrigins:    []string{"https://bowery.io"},
+		SLOs: map[string]*sloTarget{
+			"POST /developers/token": {LatencyMs: 500, LatencyPercent: 99, Availability: 99.9},
+		},
+	}
+}
+
+var (
+	settingsMutex   sync.RWMutex
+	currentSettings = defaultSettings()
+	settingsVersion string
+)
+
+func init() {
+	scheduleEveryInstance("reload-settings", settingsPollInterval, func() error {
+		_, err := reloadSettings("poll")
+		return err
+	})
+}
+
+// getSettings returns the settings in use. The returned value must not be
+// modified.
+func getSettings() *settings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return currentSettings
+}
+
+// featureEnabled reports whether the named feature flag is on.
+func featureEnabled(name string) bool {
+	return getSettings().Features[name]
+}
+
+// developerFeatures returns the feature flags on for a developer, those on
+// for everyone, those on for a segment they're in and those granted to them.
+func developerFeatures(d *schemas.Developer) []string {
+	s := getSettings()
+	features := []string{}
+	on := map[string]bool{}
+	for name, enabled := range s.Features {
+		if enabled {
+			features = append(features, name)
+			on[name] = true
+		}
+	}
+	for _, name := range featureGrants.get(d.ID) {
+		if !on[name] {
+			features = append(features, name)
+			on[name] = true
+		}
+	}
+	for name, slug := range s.FeatureSegments {
+		if on[name] {
+			continue
+		}
+		member, err := inSegment(slug, d)
+		if err != nil {
+			fmt.Println("unable to check segment", slug, "for", d.Email, err)
+		}
+		if member {
+			features = append(features, name)
+		}
+	}
+
+	sort.Strings(features)
+	return features
+}
+
+// slackChannel returns the channel messages for purpose are sent to.
+func slackChannel(purpose string) string {
+	if channel, ok := getSettings().SlackChannels[purpose]; ok {
+		return channel
+	}
+
+	return "#activity"
+}
+
+// rateLimit returns the per minute limit for name, 0 meaning unlimited.
+func rateLimit(name string) int {
+	return getSettings().RateLimits[name]
+}
+
+// readSettingsSource returns the raw settings, or nil if no source is set.
+func readSettingsSource() ([]byte, error) {
+	if path := os.Getenv("SETTINGS_FILE"); path != "" {
+		return ioutil.ReadFile(path)
+	}
+
+	url := os.Getenv("SETTINGS_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("settings source returned " + res.Status)
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// parseSettings decodes and validates raw settings. Sections left out keep
+// their defaults.
+func parseSettings(data []byte) (*settings, error) {
+	s := defaultSettings()
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+
+	for name, limit := range s.RateLimits {
+		if limit < 0 {
+			return nil, fmt.Errorf("rate limit %s must not be negative", name)
+		}
+	}
+
+	for plan, quota := range s.Quotas {
+		if quota < 0 {
+			return nil, fmt.Errorf("quota for %s must not be negative", plan)
+		}
+	}
+
+	r := s.SignupRisk
+	if r.BlockScore < 0 || r.BlockScore > 100 || r.FlagScore < 0 || r.FlagScore > 100 {
+		return nil, errors.New("signup risk scores must be from 0 to 100")
+	}
+	if r.PerIPPerHour < 0 {
+		return nil, errors.New("signup risk per IP limit must not be negative")
+	}
+
+	for i, domain := range s.SignupDomains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if !strings.Contains(domain, ".") || strings.ContainsAny(domain, "@/ ") {
+			return nil, fmt.Errorf("signup domain %s must be a domain, e.g. partner.com", s.SignupDomains[i])
+		}
+		s.SignupDomains[i] = domain
+	}
+
+	for kind, days := range s.Retention {
+		if _, ok := pruners[kind]; !ok {
+			return nil, fmt.Errorf("unknown retention kind %s", kind)
+		}
+		if days < 1 {
+			return nil, fmt.Errorf("retention for %s must be at least a day", kind)
+		}
+	}
+
+	if s.RefundApprovalAmount < 0 {
+		return nil, errors.New("refund approval amount must not be negative")
+	}
+
+	for purpose, channel := range s.SlackChannels {
+		if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "@") {
+			return nil, fmt.Errorf("slack channel for %s must start with # or @", purpose)
+		}
+	}
+
+	for route, t := range s.SLOs {
+		if err := t.validate(route); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, origin := range s.EmbedOrigins {
+		if !validOrigin(origin) {
+			return nil, fmt.Errorf("embed origin %s must be a scheme and host, e.g. https://bowery.io", origin)
+		}
+	}
+
+	for _, p := range s.Plans {
+		if p.Slug == "" || p.Name == "" {
+			return nil, errors.New("plans require a slug and name")
+		}
+		if p.Amount <= 0 {
+			return nil, fmt.Errorf("plan %s amount must be positive", p.Slug)
+		}
+		if p.Currency == "" {
+			p.Currency = "usd"
+		}
+	}
+
+	return s, nil
+}
+
+// settingsChanges lists the sections that differ between two settings.
+func settingsChanges(old, s *settings) []string {
+	changes := []string{}
+	if !reflect.DeepEqual(old.RateLimits, s.RateLimits) {
+		changes = append(changes, "rateLimits")
+	}
+	if !reflect.DeepEqual(old.Quotas, s.Quotas) {
+		changes = append(changes, "quotas")
+	}
+	if old.SignupRisk != s.SignupRisk {
+		changes = append(changes, "signupRisk")
+	}
+	if !reflect.DeepEqual(old.SignupDomains, s.SignupDomains) {
+		changes = append(changes, "signupDomains")
+	}
+	if !reflect.DeepEqual(old.Retention, s.Retention) {
+		changes = append(changes, "retention")
+	}
+	if !reflect.DeepEqual(old.Features, s.Features) {
+		changes = append(changes, "features")
+	}
+	if !reflect.DeepEqual(old.FeatureSegments, s.FeatureSegments) {
+		changes = append(changes, "featureSegments")
+	}
+	if !reflect.DeepEqual(old.SlackChannels, s.SlackChannels) {
+		changes = append(changes, "slackChannels")
+	}
+	if !reflect.DeepEqual(old.Plans, s.Plans) {
+		changes = append(changes, "plans")
+	}
+	if !reflect.DeepEqual(old.EmbedOrigins, s.EmbedOrigins) {
+		changes = append(changes, "embedOrigins")
+	}
+	if !reflect.DeepEqual(old.Approvals, s.Approvals) {
+		changes = append(changes, "approvals")
+	}
+	if old.RefundApprovalAmount != s.RefundApprovalAmount {
+		changes = append(changes, "refundApprovalAmount")
+	}
+	if !reflect.DeepEqual(old.SLOs, s.SLOs) {
+		changes = append(changes, "slos")
+	}
+
+	return changes
+}
+
+// reloadSettings reads the settings source and applies it if it changed,
+// returning the sections that changed. Invalid settings are rejected and the
+// current settings kept.
+func reloadSettings(actor string) ([]string, error) {
+	data, err := readSettingsSource()
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	version := hex.EncodeToString(sum[:])
+	settingsMutex.RLock()
+	unchanged := version == settingsVersion
+	settingsMutex.RUnlock()
+	if unchanged {
+		return nil, nil
+	}
+
+	s, err := parseSettings(data)
+	if err != nil {
+		db.SaveAuditLog(&db.AuditLog{
+			Action: "settings.rejected",
+			Actor:  actor,
+			Detail: err.Error(),
+		})
+		return nil, err
+	}
+
+	for _, p := range s.Plans {
+		existing, err := db.GetPlan(p.Slug)
+		if err == nil && existing.Name == p.Name && existing.Amount == p.Amount &&
+			existing.Currency == p.Currency && existing.Interval == p.Interval &&
+			existing.Active == p.Active {
+			continue
+		}
+
+		if err := db.SavePlan(p, "settings "+actor); err != nil {
+			return nil, err
+		}
+	}
+
+	settingsMutex.Lock()
+	changes := settingsChanges(currentSettings, s)
+	currentSettings = s
+	settingsVersion = version
+	settingsMutex.Unlock()
+
+	if len(changes) > 0 {
+		err = db.SaveAuditLog(&db.AuditLog{
+			Action: "settings.reload",
+			Actor:  actor,
+			Detail: "changed " + strings.Join(changes, ", "),
+		})
+	}
+
+	return changes, err
+}
+
+// GET /admin/settings, Shows the settings in use
+func AdminSettingsHandler(rw http.ResponseWriter, req *http.Request) {
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":          requests.StatusFound,
+		"settings":        getSettings(),
+		"readPreferences": db.ReadPreferences(),
+	})
+}
+
+// POST /admin/settings/reload, Reloads the settings immediately
+func ReloadSettingsHandler(rw http.ResponseWriter, req *http.Request) {
+	actor := "admin"
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+
+	changes, err := reloadSettings(actor)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusUpdated,
+		"changes":  changes,
+		"settings": getSettings(),
+	})
+}
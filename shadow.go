@@ -0,0 +1,244 @@
+// Copyright 2014 Bowery, Inc.
+// Contains dark launch support, mirroring production requests to
+// experimental handlers and recording how their responses compare.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Bodies longer than this aren't stored with mismatches.
+	maxShadowBody = 4096
+
+	// Number of mirrored requests allowed in flight at once, past this
+	// requests simply aren't mirrored.
+	maxShadowInFlight = 50
+)
+
+var (
+	// shadowPercent is the percentage of eligible requests mirrored, read
+	// from SHADOW_PERCENT. Shadowing is off unless it's set.
+	shadowPercent float64
+
+	// Candidate handlers by route name, registered with registerShadow.
+	shadowMutex      sync.RWMutex
+	shadowCandidates = map[string]http.HandlerFunc{}
+
+	shadowInFlight = make(chan struct{}, maxShadowInFlight)
+)
+
+// Headers that are never passed on to a candidate handler.
+var shadowStripHeaders = []string{"Cookie", signatureHeader, breakGlassHeader}
+
+func init() {
+	percent, err := strconv.ParseFloat(os.Getenv("SHADOW_PERCENT"), 64)
+	if err == nil && percent > 0 && percent <= 100 {
+		shadowPercent = percent
+	}
+}
+
+// registerShadow sets the experimental implementation for a route. Candidates
+// must be free of side effects, they only see read requests but nothing stops
+// them writing to the database.
+func registerShadow(route string, candidate http.HandlerFunc) {
+	shadowMutex.Lock()
+	defer shadowMutex.Unlock()
+	shadowCandidates[route] = candidate
+}
+
+func shadowCandidate(route string) (http.HandlerFunc, bool) {
+	shadowMutex.RLock()
+	defer shadowMutex.RUnlock()
+	candidate, ok := shadowCandidates[route]
+	return candidate, ok
+}
+
+// shadow wraps a production handler so a sample of its read requests are
+// also sent to the candidate registered for route. The client always gets
+// the production response, the candidate runs after it's been written.
+func shadow(route string, primary http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		candidate, ok := shadowCandidate(route)
+		if !ok || !shouldShadow(req) {
+			primary(rw, req)
+			return
+		}
+
+		select {
+		case shadowInFlight <- struct{}{}:
+		default:
+			primary(rw, req)
+			return
+		}
+
+		mirror, err := sanitizeRequest(req)
+		if err != nil {
+			<-shadowInFlight
+			primary(rw, req)
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		primary(rec, req)
+		primaryTime := time.Since(start)
+
+		for key, vals := range rec.HeaderMap {
+			rw.Header()[key] = vals
+		}
+		rw.WriteHeader(rec.Code)
+		rw.Write(rec.Body.Bytes())
+
+		go func() {
+			defer func() { <-shadowInFlight }()
+			compareShadow(route, mirror, rec, primaryTime, candidate)
+		}()
+	}
+}
+
+// shouldShadow reports whether the request is sampled for mirroring. Only
+// reads are mirrored so a candidate can't double apply a change.
+func shouldShadow(req *http.Request) bool {
+	if shadowPercent <= 0 || (req.Method != "GET" && req.Method != "HEAD") {
+		return false
+	}
+
+	return rand.Float64()*100 < shadowPercent
+}
+
+// sanitizeRequest copies req for the candidate, dropping credentials the
+// candidate has no need for. The copy keeps the route vars and tenant scope
+// in req's context, but not its cancellation since the candidate runs after
+// the response has been written.
+func sanitizeRequest(req *http.Request) (*http.Request, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	mirror := req.Clone(context.WithoutCancel(req.Context()))
+	mirror.Body = ioutil.NopCloser(bytes.NewReader(body))
+	for _, key := range shadowStripHeaders {
+		mirror.Header.Del(key)
+	}
+
+	return mirror, nil
+}
+
+// compareShadow runs the candidate and records how it compared.
+func compareShadow(route string, req *http.Request, primary *httptest.ResponseRecorder, primaryTime time.Duration, candidate http.HandlerFunc) {
+	rec := httptest.NewRecorder()
+	result := &db.ShadowResult{
+		Route:         route,
+		Method:        req.Method,
+		Path:          req.URL.Path,
+		PrimaryStatus: primary.Code,
+		PrimaryTime:   primaryTime,
+	}
+
+	start := time.Now()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				result.Error = fmt.Sprint("candidate panicked: ", r)
+			}
+		}()
+
+		candidate(rec, req)
+	}()
+	result.CandidateTime = time.Since(start)
+	result.CandidateStatus = rec.Code
+
+	result.Match = result.Error == "" && primary.Code == rec.Code &&
+		sameBody(primary.Body.Bytes(), rec.Body.Bytes())
+	if !result.Match {
+		result.PrimaryBody = truncateBody(primary.Body.Bytes())
+		result.CandidateBody = truncateBody(rec.Body.Bytes())
+	}
+
+	if err := db.SaveShadowResult(result); err != nil {
+		fmt.Println("unable to save shadow result", route, err)
+	}
+}
+
+// sameBody compares response bodies, ignoring formatting and key order when
+// both are JSON.
+func sameBody(a, b []byte) bool {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) == nil && json.Unmarshal(b, &bv) == nil {
+		return reflect.DeepEqual(av, bv)
+	}
+
+	return bytes.Equal(a, b)
+}
+
+func truncateBody(body []byte) string {
+	if len(body) > maxShadowBody {
+		body = body[:maxShadowBody]
+	}
+
+	return string(body)
+}
+
+// GET /admin/shadow, Shows match rates and recent mismatches for shadowed routes
+func AdminShadowHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{"match": false}
+	if route := req.FormValue("route"); route != "" {
+		query["route"] = route
+	}
+
+	summaries, err := db.GetShadowSummaries(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	mismatches, err := db.GetShadowResults(query, 50)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	routes := []string{}
+	shadowMutex.RLock()
+	for route := range shadowCandidates {
+		routes = append(routes, route)
+	}
+	shadowMutex.RUnlock()
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusFound,
+		"percent":    shadowPercent,
+		"candidates": routes,
+		"summaries":  summaries,
+		"mismatches": mismatches,
+	})
+}
@@ -0,0 +1,298 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the export of audit logs, including security events, to a SIEM
+// over syslog or Splunk's HTTP Event Collector. Logs are saved first and
+// exported oldest first, so a slow or down SIEM only grows the backlog.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Most logs sent to the SIEM at once.
+	siemBatchSize = 200
+
+	// Batches exported per run, the scheduled run picks up the rest.
+	siemMaxBatches = 20
+
+	// Logs are authpriv.notice, facility 10 severity 5.
+	syslogPriority = 10*8 + 5
+
+	// RFC 5424 limits the MSGID to 32 characters.
+	syslogMaxMsgID = 32
+)
+
+var (
+	// SIEM_SYSLOG_ADDR is a url like udp://host:514, tcp://host:601 or
+	// tls://host:6514.
+	siemSyslogAddr = os.Getenv("SIEM_SYSLOG_ADDR")
+	splunkHECURL   = os.Getenv("SPLUNK_HEC_URL")
+	splunkHECToken = os.Getenv("SPLUNK_HEC_TOKEN")
+
+	siemHTTPClient = &http.Client{Timeout: 20 * time.Second}
+	siemHost, _    = os.Hostname()
+
+	// Only one export runs at a time so logs aren't sent twice, the database
+	// lock keeps other instances out too. Exports asked for while one runs
+	// are dropped since the running export keeps going until it's caught up.
+	exporting = make(chan struct{}, 1)
+)
+
+func init() {
+	schedule("export-audit-logs", 10*time.Second, exportAuditLogs)
+}
+
+// siemDestinations returns the configured destinations.
+func siemDestinations() []string {
+	destinations := []string{}
+	if siemSyslogAddr != "" {
+		destinations = append(destinations, "syslog")
+	}
+	if splunkHECURL != "" && splunkHECToken != "" {
+		destinations = append(destinations, "splunk")
+	}
+
+	return destinations
+}
+
+// exportAuditLogs sends unexported logs to each destination, marking them
+// once all of them accept. A batch failing anywhere is sent again in full,
+// so destinations may see a log twice and should dedupe by its id.
+func exportAuditLogs() error {
+	destinations := siemDestinations()
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	select {
+	case exporting <- struct{}{}:
+		defer func() { <-exporting }()
+	default:
+		return nil
+	}
+	defer db.ReleaseLock("export-audit-logs", instanceID)
+
+	for i := 0; i < siemMaxBatches; i++ {
+		// Taken again each batch to extend it while the export runs.
+		locked, err := db.AcquireLock("export-audit-logs", instanceID, time.Minute)
+		if err != nil || !locked {
+			return err
+		}
+
+		ls, err := db.GetUnexportedAuditLogs(siemBatchSize)
+		if err != nil || len(ls) == 0 {
+			return err
+		}
+
+		for _, destination := range destinations {
+			if destination == "syslog" {
+				err = sendSyslog(ls)
+			} else {
+				err = sendSplunk(ls)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		ids := []bson.ObjectId{}
+		for _, l := range ls {
+			ids = append(ids, l.ID)
+		}
+		if err := db.MarkAuditLogsExported(ids); err != nil {
+			return err
+		}
+		if len(ls) < siemBatchSize {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// siemRecord returns the fields exported for a log. Logs about a
+// developer's account are security events, the rest admin and system audits.
+func siemRecord(l *db.AuditLog) map[string]interface{} {
+	category := "audit"
+	developerID := ""
+	if l.DeveloperID != "" {
+		category = "security"
+		developerID = l.DeveloperID.Hex()
+	}
+
+	return map[string]interface{}{
+		"id":          l.ID.Hex(),
+		"category":    category,
+		"action":      l.Action,
+		"actor":       l.Actor,
+		"developerId": developerID,
+		"ip":          l.IP,
+		"country":     l.Country,
+		"method":      l.Method,
+		"path":        l.Path,
+		"detail":      l.Detail,
+		"createdAt":   l.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// syslogMessage formats a log as an RFC 5424 message with the action as
+// the MSGID and the record as JSON.
+func syslogMessage(host string, l *db.AuditLog) (string, error) {
+	record, err := json.Marshal(siemRecord(l))
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "-"
+	}
+	msgID := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, l.Action)
+	if msgID == "" {
+		msgID = "-"
+	}
+	if len(msgID) > syslogMaxMsgID {
+		msgID = msgID[:syslogMaxMsgID]
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s broome - %s - %s", syslogPriority,
+		l.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000Z"), host, msgID, record), nil
+}
+
+// sendSyslog sends logs to the syslog server. Over udp each message is its
+// own datagram, over tcp and tls messages are framed by their length as
+// RFC 6587 and RFC 5425 describe.
+func sendSyslog(ls []*db.AuditLog) error {
+	addr, err := url.Parse(siemSyslogAddr)
+	if err != nil {
+		return err
+	}
+
+	return callDependency(context.Background(), "syslog", connectError, func() error {
+		var conn net.Conn
+		var err error
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		switch addr.Scheme {
+		case "udp", "tcp":
+			conn, err = dialer.Dial(addr.Scheme, addr.Host)
+		case "tls":
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr.Host, &tls.Config{})
+		default:
+			err = fmt.Errorf("unknown syslog scheme %q", addr.Scheme)
+		}
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(20 * time.Second))
+
+		for _, l := range ls {
+			msg, err := syslogMessage(siemHost, l)
+			if err != nil {
+				return err
+			}
+			if addr.Scheme != "udp" {
+				msg = fmt.Sprintf("%d %s", len(msg), msg)
+			}
+
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// splunkHECBody returns the logs as HEC events, which are sent one after
+// another in the same body.
+func splunkHECBody(host string, ls []*db.AuditLog) ([]byte, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, l := range ls {
+		record := siemRecord(l)
+		err := enc.Encode(map[string]interface{}{
+			"time":       float64(l.CreatedAt.UnixNano()) / float64(time.Second),
+			"host":       host,
+			"source":     "broome",
+			"sourcetype": "broome:" + record["category"].(string),
+			"event":      record,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return body.Bytes(), nil
+}
+
+// sendSplunk sends logs to Splunk's HTTP Event Collector.
+func sendSplunk(ls []*db.AuditLog) error {
+	body, err := splunkHECBody(siemHost, ls)
+	if err != nil {
+		return err
+	}
+
+	return callDependency(context.Background(), "splunk", connectError, func() error {
+		req, err := http.NewRequest("POST", strings.TrimSuffix(splunkHECURL, "/")+"/services/collector/event", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Splunk "+splunkHECToken)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := siemHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode >= 300 {
+			return fmt.Errorf("splunk responded with %d", res.StatusCode)
+		}
+		return nil
+	})
+}
+
+// GET /admin/siem, Shows where audit logs are exported and how many are waiting
+func SIEMHandler(rw http.ResponseWriter, req *http.Request) {
+	backlog, err := db.CountUnexportedAuditLogs()
+	var oldest []*db.AuditLog
+	if err == nil {
+		oldest, err = db.GetUnexportedAuditLogs(1)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	res := map[string]interface{}{
+		"status":       requests.StatusFound,
+		"destinations": siemDestinations(),
+		"backlog":      backlog,
+	}
+	if len(oldest) > 0 {
+		res["oldest"] = oldest[0].CreatedAt
+	}
+	renderer.JSON(rw, http.StatusOK, res)
+}
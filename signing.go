@@ -0,0 +1,173 @@
+// Copyright 2014 Bowery, Inc.
+// Contains HMAC request signing for server to server callers.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+)
+
+// Headers signed requests carry.
+const (
+	serviceHeader   = "X-Broome-Service"
+	timestampHeader = "X-Broome-Timestamp"
+	signatureHeader = "X-Broome-Signature"
+)
+
+// How far a signed request's timestamp may drift from our clock. Signatures
+// are remembered for twice this long to reject replays.
+const signatureSkew = 5 * time.Minute
+
+// maxSignedBody caps the body read to check a signature.
+const maxSignedBody = 1 << 20
+
+// serviceSecrets maps internal service names to their shared secrets, read
+// from SERVICE_SECRETS as "name:secret,name:secret". A service listed more
+// than once can sign with any of its secrets, so a service's secret is
+// rotated by adding the new one, moving the service over, then removing
+// the old one.
+var serviceSecrets = map[string][]string{}
+
+var seenSignatures = &signatureLog{seen: map[string]time.Time{}}
+
+func init() {
+	for _, pair := range splitKeys(os.Getenv("SERVICE_SECRETS")) {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			serviceSecrets[parts[0]] = append(serviceSecrets[parts[0]], parts[1])
+		}
+	}
+}
+
+// signatureLog remembers recently used signatures.
+type signatureLog struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+// use records the signature, returning false if it was already used.
+func (l *signatureLog) use(sig string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for s, t := range l.seen {
+		if now.Sub(t) > 2*signatureSkew {
+			delete(l.seen, s)
+		}
+	}
+
+	if _, ok := l.seen[sig]; ok {
+		return false
+	}
+
+	l.seen[sig] = now
+	return true
+}
+
+// signRequest computes the signature for a request. The body is hashed so
+// large payloads don't need to be held alongside the signature input.
+func signRequest(secret, method, path, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write([]byte(hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isSignedRequest reports whether req uses the HMAC scheme.
+func isSignedRequest(req *http.Request) bool {
+	return req.Header.Get(signatureHeader) != ""
+}
+
+// signedOnly wraps a handler meant for other services so only requests
+// they've signed reach it. A signature is only accepted on these routes,
+// everywhere else services authenticate like anyone else.
+func signedOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		err := errors.New("signed service request required")
+		if isSignedRequest(req) {
+			err = verifySignedRequest(rw, req)
+		}
+		if err != nil {
+			renderer.JSON(rw, http.StatusUnauthorized, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+// verifySignedRequest checks the signature headers on req, leaving the body
+// intact for the handler.
+func verifySignedRequest(rw http.ResponseWriter, req *http.Request) error {
+	secrets, ok := serviceSecrets[req.Header.Get(serviceHeader)]
+	if !ok {
+		return errors.New("unknown service")
+	}
+
+	timestamp := req.Header.Get(timestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+
+	drift := time.Since(time.Unix(unix, 0))
+	if drift > signatureSkew || drift < -signatureSkew {
+		return errors.New("timestamp outside allowed window")
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, maxSignedBody))
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	sig := req.Header.Get(signatureHeader)
+	valid := false
+	for _, secret := range secrets {
+		expected := signRequest(secret, req.Method, req.URL.RequestURI(), timestamp, body)
+		if hmac.Equal([]byte(expected), []byte(sig)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+
+	if !seenSignatures.use(sig) {
+		return errors.New("signature already used")
+	}
+
+	// Check the other instances haven't seen it either.
+	fresh, err := db.UseNonce("sig:"+sig, 2*signatureSkew)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errors.New("signature already used")
+	}
+
+	return nil
+}
@@ -0,0 +1,360 @@
+// Copyright 2014 Bowery, Inc.
+// Contains signup IP checks. Each signup's IP is scored from the local
+// reputation store and, with ABUSEIPDB_KEY set, AbuseIPDB. High scores are
+// refused or flagged for review, and IPs signing up too often are throttled.
+// The signals are recorded on the developer.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+// Actions taken on a signup.
+const (
+	signupAllow    = ""
+	signupFlag     = "flag"
+	signupBlock    = "block"
+	signupThrottle = "throttle"
+)
+
+// How long AbuseIPDB scores are kept before an IP is looked up again.
+const abuseIPDBCacheTTL = 24 * time.Hour
+
+// abuseIPDBKey enables AbuseIPDB lookups for IPs without a local entry.
+var abuseIPDBKey = os.Getenv("ABUSEIPDB_KEY")
+
+var abuseIPDBHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+// reputationScore returns the highest score of the entries matching ip,
+// with where they came from and why. Ranges are matched by containment.
+func reputationScore(ip string, entries []*db.IPReputation) (int, []string, []string) {
+	addr := net.ParseIP(ip)
+	score := 0
+	sources := []string{}
+	reasons := []string{}
+	for _, e := range entries {
+		if e.Range {
+			_, ipnet, err := net.ParseCIDR(e.IP)
+			if err != nil || addr == nil || !ipnet.Contains(addr) {
+				continue
+			}
+		} else if e.IP != ip {
+			continue
+		}
+
+		if e.Score > score {
+			score = e.Score
+		}
+		sources = append(sources, e.Source)
+		if e.Reason != "" {
+			reasons = append(reasons, e.Reason)
+		}
+	}
+
+	return score, sources, reasons
+}
+
+// lookupAbuseIPDB returns AbuseIPDB's confidence that ip is abusive.
+func lookupAbuseIPDB(ctx context.Context, ip string) (int, error) {
+	req, err := http.NewRequest("GET", "https://api.abuseipdb.com/api/v2/check?maxAgeInDays=90&ipAddress="+ip, nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Key", abuseIPDBKey)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := abuseIPDBHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("abuseipdb returned %s", res.Status)
+	}
+
+	var body struct {
+		Data struct {
+			AbuseConfidenceScore int `json:"abuseConfidenceScore"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+	return body.Data.AbuseConfidenceScore, nil
+}
+
+// hasEntry reports whether ip has its own entry, so it isn't looked up.
+func hasEntry(ip string, entries []*db.IPReputation) bool {
+	for _, e := range entries {
+		if !e.Range && e.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// assessSignupIP counts a signup from ip and scores it. Failures are only
+// printed so a broken store or AbuseIPDB never stops signups.
+func assessSignupIP(ctx context.Context, ip string, now time.Time) *db.SignupRisk {
+	risk := &db.SignupRisk{IP: ip, CheckedAt: now}
+
+	count, err := db.IncrementCounter("signup-ip:"+ip, now.Truncate(time.Hour), 2*time.Hour)
+	if err != nil {
+		fmt.Println("unable to count signups from", ip, err)
+	}
+	risk.Velocity = count
+
+	entries, err := db.GetIPReputations(ip)
+	if err != nil {
+		fmt.Println("unable to get reputation of", ip, err)
+	}
+
+	addr := net.ParseIP(ip)
+	if abuseIPDBKey != "" && err == nil && addr != nil && !addr.IsLoopback() && !hasEntry(ip, entries) {
+		var score int
+		err := callDependency(ctx, "abuseipdb", transientError, func() error {
+			var err error
+			score, err = lookupAbuseIPDB(ctx, ip)
+			return err
+		})
+		if err == nil {
+			e := &db.IPReputation{
+				IP:        ip,
+				Score:     score,
+				Source:    db.ReputationAbuseIPDB,
+				ExpiresAt: now.Add(abuseIPDBCacheTTL),
+			}
+			if err := db.SaveIPReputation(e); err != nil {
+				fmt.Println("unable to cache reputation of", ip, err)
+			}
+			entries = append(entries, e)
+		} else {
+			fmt.Println("unable to look up", ip, "on abuseipdb", err)
+		}
+	}
+
+	risk.Score, risk.Sources, risk.Reasons = reputationScore(ip, entries)
+	return risk
+}
+
+// signupAction returns what to do with a signup, flagging it if it's let
+// through with a high score or many signups from its IP.
+func signupAction(risk *db.SignupRisk, s signupRiskSettings) string {
+	if s.BlockScore > 0 && risk.Score >= s.BlockScore {
+		return signupBlock
+	}
+	if s.PerIPPerHour > 0 && risk.Velocity > s.PerIPPerHour {
+		return signupThrottle
+	}
+
+	flags := []string{}
+	if s.FlagScore > 0 && risk.Score >= s.FlagScore {
+		flags = append(flags, fmt.Sprintf("IP scored %d", risk.Score))
+	}
+	if s.PerIPPerHour > 1 && risk.Velocity > s.PerIPPerHour/2 {
+		flags = append(flags, fmt.Sprintf("%d signups from IP this hour", risk.Velocity))
+	}
+	if len(flags) == 0 {
+		return signupAllow
+	}
+
+	risk.Flags = flags
+	risk.Flagged = true
+	return signupFlag
+}
+
+// checkSignupIP assesses a signup for email, responding and returning false
+// if it's refused.
+func checkSignupIP(rw http.ResponseWriter, req *http.Request, email string) (*db.SignupRisk, bool) {
+	now := time.Now()
+	risk := assessSignupIP(req.Context(), clientIP(req), now)
+	switch signupAction(risk, getSettings().SignupRisk) {
+	case signupBlock:
+		audit(req, "signup.blocked", email, fmt.Sprintf("%s scored %d", risk.IP, risk.Score))
+		renderer.JSON(rw, http.StatusForbidden, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Signups from your network aren't allowed. Contact support@bowery.io if this is a mistake.",
+		})
+		return nil, false
+	case signupThrottle:
+		audit(req, "signup.throttled", email, fmt.Sprintf("%d signups from %s this hour", risk.Velocity, risk.IP))
+		next := now.Truncate(time.Hour).Add(time.Hour)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(next.Sub(now).Seconds())+1))
+		renderer.JSON(rw, http.StatusTooManyRequests, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Too many signups from your network, try again later.",
+		})
+		return nil, false
+	}
+
+	return risk, true
+}
+
+// recordSignupRisk saves the signup signals on a new developer and posts
+// flagged signups to Slack. Failures are only printed.
+func recordSignupRisk(d *schemas.Developer, risk *db.SignupRisk) {
+	if err := db.SetSignupRisk(d.ID, risk); err != nil {
+		fmt.Println("unable to record signup risk for", d.Email, err)
+	}
+	if risk.Flagged {
+		notifySlack(slackChannel("abuse"), fmt.Sprintf("Flagged signup %s from %s: %s",
+			d.Email, risk.IP, strings.Join(append(risk.Flags, risk.Reasons...), ", ")))
+	}
+}
+
+// normalizeReputationIP returns the canonical form of an IP or CIDR range,
+// and whether it's a range.
+func normalizeReputationIP(ip string) (string, bool, error) {
+	ip = strings.TrimSpace(ip)
+	if strings.Contains(ip, "/") {
+		_, ipnet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return "", false, errors.New("IP must be an address or CIDR range.")
+		}
+		return ipnet.String(), true, nil
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", false, errors.New("IP must be an address or CIDR range.")
+	}
+	return addr.String(), false, nil
+}
+
+// GET /admin/ip-reputation, Lists IP reputation entries, ?source= filters
+func AdminIPReputationHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if source := req.URL.Query().Get("source"); source != "" {
+		query["source"] = source
+	}
+
+	rs, err := db.ListIPReputations(query, 500)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"entries": rs,
+	})
+}
+
+// PUT /admin/ip-reputation, Sets the score of an IP or CIDR range
+func UpdateIPReputationHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		IP     string `json:"ip"`
+		Score  int    `json:"score"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	ip, isRange, err := normalizeReputationIP(body.IP)
+	if err == nil && (body.Score < 0 || body.Score > 100) {
+		err = errors.New("Score must be from 0 to 100.")
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	e := &db.IPReputation{
+		IP:        ip,
+		Range:     isRange,
+		Score:     body.Score,
+		Reason:    strings.TrimSpace(body.Reason),
+		Source:    db.ReputationAdmin,
+		UpdatedBy: actor,
+	}
+	if err := db.SaveIPReputation(e); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "ip_reputation.updated", actor, fmt.Sprintf("%s scored %d", ip, body.Score))
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"entry":  e,
+	})
+}
+
+// DELETE /admin/ip-reputation?ip=, Removes the entry for an IP or CIDR range
+func DeleteIPReputationHandler(rw http.ResponseWriter, req *http.Request) {
+	ip, _, err := normalizeReputationIP(req.URL.Query().Get("ip"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := db.DeleteIPReputation(ip); err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "ip_reputation.deleted", actor, ip)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// GET /admin/signups/flagged, Lists developers whose signup was flagged
+func FlaggedSignupsHandler(rw http.ResponseWriter, req *http.Request) {
+	fs, err := db.GetFlaggedSignups(200)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusFound,
+		"developers": fs,
+	})
+}
@@ -0,0 +1,289 @@
+// Copyright 2014 Bowery, Inc.
+// Contains service level objectives. Routes with an objective in the slos
+// setting have their requests counted, each instance adding its counts to
+// per minute buckets every minute. Compliance and the error budget left are
+// measured over 30 days on /admin/slo, and a route burning its budget fast
+// enough to run out early is posted to Slack.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/web"
+	"github.com/gorilla/mux"
+)
+
+// Objectives are measured over this window.
+const sloWindow = 30 * 24 * time.Hour
+
+// Fewest requests in a burn rate's long window before it's trusted.
+const sloMinRequests = 20
+
+// Indicators a route's objectives are measured on.
+const (
+	sloLatency      = "latency"
+	sloAvailability = "availability"
+)
+
+// sloBurnAlerts are the burn rates alerted on. A rate is how many times
+// faster than sustainable the budget is going, so 14.4 over an hour spends
+// 2% of a 30 day budget. The short window has to be burning too, so an
+// alert stops soon after the route recovers.
+var sloBurnAlerts = []struct {
+	name        string
+	long, short time.Duration
+	rate        float64
+}{
+	{"fast", time.Hour, 5 * time.Minute, 14.4},
+	{"slow", 6 * time.Hour, 30 * time.Minute, 6},
+}
+
+// sloRoute matches a route as the access log names it.
+var sloRoute = regexp.MustCompile(`^[A-Z]+ /`)
+
+// sloTarget is a route's objectives: LatencyPercent of requests served
+// within LatencyMs, and Availability percent without a server error.
+type sloTarget struct {
+	LatencyMs      int     `json:"latencyMs"`
+	LatencyPercent float64 `json:"latencyPercent"`
+	Availability   float64 `json:"availability"`
+}
+
+func (t *sloTarget) validate(route string) error {
+	if !sloRoute.MatchString(route) {
+		return fmt.Errorf("slo route %s must be a method and path, e.g. POST /developers/token", route)
+	}
+	if t == nil || t.LatencyMs <= 0 {
+		return fmt.Errorf("slo for %s needs a latency in milliseconds", route)
+	}
+	if t.LatencyPercent <= 0 || t.LatencyPercent >= 100 || t.Availability <= 0 || t.Availability >= 100 {
+		return errors.New("slo percentages for " + route + " must be between 0 and 100")
+	}
+
+	return nil
+}
+
+// budget returns the share of requests allowed to miss an indicator.
+func (t *sloTarget) budget(indicator string) float64 {
+	if indicator == sloLatency {
+		return 1 - t.LatencyPercent/100
+	}
+
+	return 1 - t.Availability/100
+}
+
+// badShare returns the share of requests that missed an indicator.
+func badShare(c *db.SLOCounts, indicator string) float64 {
+	if c == nil || c.Total == 0 {
+		return 0
+	}
+	bad := c.Errors
+	if indicator == sloLatency {
+		bad = c.Slow
+	}
+
+	return float64(bad) / float64(c.Total)
+}
+
+// burnRate returns how many times faster than sustainable a route's
+// budget for an indicator is being spent.
+func burnRate(t *sloTarget, c *db.SLOCounts, indicator string) float64 {
+	return badShare(c, indicator) / t.budget(indicator)
+}
+
+var sloCounts = struct {
+	sync.Mutex
+	routes map[string]*db.SLOCounts
+}{routes: map[string]*db.SLOCounts{}}
+
+func init() {
+	scheduleEveryInstance("flush-slo-counts", time.Minute, flushSLOCounts)
+	schedule("slo-burn-rates", 5*time.Minute, checkSLOBurnRates)
+}
+
+// measureSLOs wraps the server, counting requests to routes with an
+// objective. Routes are matched again like the access log.
+func measureSLOs(h http.Handler, routes []web.Route) http.Handler {
+	router := mux.NewRouter()
+	for _, r := range routes {
+		router.Methods(r.Method).Path(r.Path).Name(r.Method + " " + r.Path)
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var match mux.RouteMatch
+		if !router.Match(req, &match) {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		route := match.Route.GetName()
+		target, ok := getSettings().SLOs[route]
+		if !ok {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		start := time.Now()
+		cw := &countingWriter{ResponseWriter: rw, status: http.StatusOK}
+		h.ServeHTTP(cw, req)
+		recordSLO(route, target, cw.status, time.Since(start))
+	})
+}
+
+// recordSLO counts a request to a route until the next flush.
+func recordSLO(route string, t *sloTarget, status int, took time.Duration) {
+	sloCounts.Lock()
+	defer sloCounts.Unlock()
+	c, ok := sloCounts.routes[route]
+	if !ok {
+		c = &db.SLOCounts{Route: route}
+		sloCounts.routes[route] = c
+	}
+
+	c.Total++
+	if status >= http.StatusInternalServerError {
+		c.Errors++
+	}
+	if took > time.Duration(t.LatencyMs)*time.Millisecond {
+		c.Slow++
+	}
+}
+
+// flushSLOCounts adds this instance's counts to the current minute.
+func flushSLOCounts() error {
+	sloCounts.Lock()
+	routes := sloCounts.routes
+	sloCounts.routes = map[string]*db.SLOCounts{}
+	sloCounts.Unlock()
+
+	now := time.Now()
+	for _, c := range routes {
+		if err := db.AddSLOCounts(now, c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSLOBurnRates alerts on routes burning their budget too fast. Each
+// alert is held for its long window so it isn't repeated every run, the
+// lock's owner is the run so even this instance can't extend it.
+func checkSLOBurnRates() error {
+	s := getSettings()
+	now := time.Now()
+	owner := instanceID + ":" + strconv.FormatInt(now.UnixNano(), 10)
+	for _, alert := range sloBurnAlerts {
+		long, err := db.GetSLOCounts(now.Add(-alert.long))
+		if err != nil {
+			return err
+		}
+		short, err := db.GetSLOCounts(now.Add(-alert.short))
+		if err != nil {
+			return err
+		}
+
+		for route, t := range s.SLOs {
+			c := long[route]
+			if c == nil || c.Total < sloMinRequests {
+				continue
+			}
+
+			for _, indicator := range []string{sloLatency, sloAvailability} {
+				rate := burnRate(t, c, indicator)
+				if rate < alert.rate || burnRate(t, short[route], indicator) < alert.rate {
+					continue
+				}
+
+				key := "slo:" + route + ":" + indicator + ":" + alert.name
+				if ok, err := db.AcquireLock(key, owner, alert.long); err != nil || !ok {
+					continue
+				}
+				notifySlack(slackChannel("alerts"), fmt.Sprintf("%s is burning its %s budget %.1fx too fast over the last %s, see /admin/slo",
+					route, indicator, rate, alert.long))
+			}
+		}
+	}
+
+	return nil
+}
+
+// sloStatus is how a route is doing against one of its objectives.
+type sloStatus struct {
+	Route      string
+	Indicator  string
+	Objective  float64
+	Requests   int
+	Compliance float64
+	BudgetLeft float64
+	Burn       map[string]float64
+	Met        bool
+}
+
+// sloStatuses returns each route's indicators against their objectives,
+// given the counts over the window and the burn rate windows.
+func sloStatuses(slos map[string]*sloTarget, window map[string]*db.SLOCounts, burns map[string]map[string]*db.SLOCounts) []*sloStatus {
+	routes := []string{}
+	for route := range slos {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	statuses := []*sloStatus{}
+	for _, route := range routes {
+		t := slos[route]
+		for _, indicator := range []string{sloLatency, sloAvailability} {
+			objective := t.Availability
+			if indicator == sloLatency {
+				objective = t.LatencyPercent
+			}
+
+			st := &sloStatus{
+				Route:      route,
+				Indicator:  indicator,
+				Objective:  objective,
+				Compliance: 100 * (1 - badShare(window[route], indicator)),
+				BudgetLeft: 100 * (1 - burnRate(t, window[route], indicator)),
+				Burn:       map[string]float64{},
+			}
+			if c := window[route]; c != nil {
+				st.Requests = c.Total
+			}
+			st.Met = st.Compliance >= objective
+			for name, counts := range burns {
+				st.Burn[name] = burnRate(t, counts[route], indicator)
+			}
+			statuses = append(statuses, st)
+		}
+	}
+
+	return statuses
+}
+
+// GET /admin/slo, Shows each route's compliance, error budget and burn rates
+func SLOHandler(rw http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	window, err := db.GetSLOCounts(now.Add(-sloWindow))
+	burns := map[string]map[string]*db.SLOCounts{}
+	for _, d := range []time.Duration{time.Hour, 6 * time.Hour} {
+		if err != nil {
+			break
+		}
+		burns[d.String()], err = db.GetSLOCounts(now.Add(-d))
+	}
+	if err == nil {
+		err = RenderAdminTemplate(rw, "slo", map[string]interface{}{
+			"Statuses": sloStatuses(getSettings().SLOs, window, burns),
+		})
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
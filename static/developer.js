@@ -10,6 +10,17 @@ function DevController () {
   this.editUrl = '/developers/' + this.formEl.data('token')
   console.log(this.editUrl)
   $('.group-developer .btn-submit').click(this.editDev.bind(this))
+
+  this.fieldsUrl = '/admin/developers/' + this.formEl.data('id') + '/'
+  this.revision = this.formEl.data('revision')
+  this.formEl.find('[data-field]').each(function (i, el) {
+    $(el).data('saved', this.fieldValue(el))
+  }.bind(this))
+  this.formEl.find('[data-field]').change(this.editField.bind(this))
+
+  this.tagsEl = $('.group-tags .form')
+  this.tagsUrl = '/admin/developers/' + this.tagsEl.data('id') + '/tags'
+  $('.group-tags .btn-submit').click(this.editTags.bind(this))
 }
 
 /**
@@ -35,6 +46,71 @@ DevController.prototype.editDev = function (e) {
     .error(butterbar.bind(this, 'Update Failed.', 'alert'))
 }
 
+/**
+ * Returns the value of a field's input, checkboxes as booleans.
+ * @param {Element} el
+ */
+DevController.prototype.fieldValue = function (el) {
+  return el.type == 'checkbox' ? el.checked : el.value
+}
+
+/**
+ * Saves a field as soon as it changes. The change is kept on the page while
+ * it saves and undone if it fails.
+ * @param {Event} e
+ */
+DevController.prototype.editField = function (e) {
+  var el = e.target
+  var field = $(el).data('field')
+  var saved = $(el).data('saved')
+  var value = this.fieldValue(el)
+
+  $.ajax({
+    url: this.fieldsUrl + field,
+    type: 'PATCH',
+    contentType: 'application/json',
+    data: JSON.stringify({value: value, revision: this.revision})
+  })
+    .done(function (res) {
+      this.revision = res.revision
+      $(el).data('saved', value)
+      butterbar('Saved ' + field + '.', 'confirm')
+    }.bind(this))
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      if (el.type == 'checkbox') {
+        el.checked = saved
+      } else {
+        el.value = saved
+      }
+      butterbar(res.error || 'Saving ' + field + ' Failed.', 'alert')
+    })
+}
+
+/**
+ * Replaces the developer's tags with the comma separated ones in the form.
+ * @param {Event} e
+ */
+DevController.prototype.editTags = function (e) {
+  e.preventDefault()
+
+  var tags = $('.group-tags .tags').val().split(',')
+  $.ajax({
+    url: this.tagsUrl,
+    type: 'PUT',
+    contentType: 'application/json',
+    data: JSON.stringify({tags: tags})
+  })
+    .done(function (res) {
+      $('.group-tags .tags').val(res.tags.join(', '))
+      butterbar('Tags Saved.', 'confirm')
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Saving Tags Failed.', 'alert')
+    })
+}
+
 $(document).ready(function () {
   var dc = new DevController()
 })
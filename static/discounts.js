@@ -0,0 +1,41 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Reviews discount applications.
+ * @constructor
+ */
+function DiscountsController () {
+  $('.form-review-discount').submit(this.review.bind(this))
+}
+
+/**
+ * Approves or denies an application with the chosen reply.
+ * @param {Event} e
+ */
+DiscountsController.prototype.review = function (e) {
+  e.preventDefault()
+  var form = $(e.target)
+  var row = form.closest('tr')
+  var choice = form.find('[name=template]').val().split(' ')
+
+  $.ajax({
+    url: '/admin/discounts/' + row.data('id') + '/' + choice[0],
+    type: 'POST',
+    data: JSON.stringify({
+      template: choice[1],
+      message: form.find('[name=message]').val()
+    }),
+    contentType: 'application/json'
+  })
+    .done(function (res) {
+      butterbar('Application ' + res.application.status + '.', 'confirm')
+      form.replaceWith(res.application.status)
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Review Failed.', 'alert')
+    })
+}
+
+$(document).ready(function () {
+  var dc = new DiscountsController()
+})
@@ -0,0 +1,94 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Submits the embedded signup form and posts the result to the parent page.
+ * Messages are objects with a type of broome:ready, broome:resize or
+ * broome:signup, and are only sent to the origin the widget was opened for.
+ * @constructor
+ */
+function EmbedController () {
+  this.form = document.querySelector('.embed-signup')
+  this.origin = this.form.getAttribute('data-origin')
+  this.message = this.form.querySelector('.message')
+
+  this.form.addEventListener('submit', this.submit.bind(this))
+  this.post({type: 'broome:ready'})
+  this.resize()
+}
+
+/**
+ * Sends a message to the parent page.
+ * @param {Object} data
+ */
+EmbedController.prototype.post = function (data) {
+  if (window.parent !== window) window.parent.postMessage(data, this.origin)
+}
+
+/**
+ * Tells the parent page how tall the form is so it can size the frame.
+ */
+EmbedController.prototype.resize = function () {
+  this.post({type: 'broome:resize', height: document.body.scrollHeight})
+}
+
+/**
+ * Shows an error in the form.
+ * @param {String} text
+ */
+EmbedController.prototype.showError = function (text) {
+  this.message.textContent = text
+  this.message.hidden = false
+  this.resize()
+}
+
+/**
+ * Creates the developer. Only the id and email are posted to the parent, never
+ * the token.
+ * @param {Event} e
+ */
+EmbedController.prototype.submit = function (e) {
+  e.preventDefault()
+
+  var field = function (name) {
+    return this.form.querySelector('[name=' + name + ']').value
+  }.bind(this)
+  var token = field('formToken')
+
+  var req = new XMLHttpRequest()
+  req.open('POST', '/developers')
+  req.setRequestHeader('Content-Type', 'application/json')
+  req.onload = function () {
+    var res = {}
+    try {
+      res = JSON.parse(req.responseText)
+    } catch (err) {}
+
+    if (req.status !== 200 || !res.developer) {
+      var error = res.error || 'Signup failed, please try again.'
+      this.showError(error)
+      this.post({type: 'broome:signup', status: 'failed', error: error})
+      return
+    }
+
+    this.post({
+      type: 'broome:signup',
+      status: 'created',
+      developer: {id: res.developer._id || res.developer.id, email: res.developer.email}
+    })
+  }.bind(this)
+  req.onerror = function () {
+    this.showError('Signup failed, please try again.')
+    this.post({type: 'broome:signup', status: 'failed', error: 'network error'})
+  }.bind(this)
+
+  req.send(JSON.stringify({
+    name: field('name'),
+    email: field('email'),
+    password: field('password'),
+    website: field('website'),
+    formToken: token
+  }))
+}
+
+document.addEventListener('DOMContentLoaded', function () {
+  var ec = new EmbedController()
+})
@@ -0,0 +1,42 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Generates gift codes.
+ * @constructor
+ */
+function GiftCodesController () {
+  $('.form-gift-codes').submit(this.generate.bind(this))
+}
+
+/**
+ * Generates a batch of codes and shows them to be copied.
+ * @param {Event} e
+ */
+GiftCodesController.prototype.generate = function (e) {
+  e.preventDefault()
+  var form = $(e.target)
+  var expiresAt = form.find('[name=expiresAt]').val()
+
+  $.ajax({
+    url: '/admin/gift-codes',
+    type: 'POST',
+    data: JSON.stringify({
+      count: parseInt(form.find('[name=count]').val(), 10) || 0,
+      months: parseInt(form.find('[name=months]').val(), 10) || 0,
+      note: form.find('[name=note]').val(),
+      expiresAt: expiresAt ? new Date(expiresAt).toISOString() : undefined
+    }),
+    contentType: 'application/json'
+  })
+    .done(function (res) {
+      butterbar('Codes Generated.', 'confirm')
+      $('.generated-codes').val(res.codes.join('\n')).removeClass('hidden')
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Generating Failed.', 'alert')
+    })
+}
+
+$(document).ready(function () {
+  var gc = new GiftCodesController()
+})
@@ -0,0 +1,51 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Restores a developer to a version once the changes it would make are
+ * confirmed.
+ * @constructor
+ */
+function HistoryController () {
+  this.historyEl = $('.group-history')
+  this.versionsUrl = '/admin/developers/' + this.historyEl.data('id') + '/versions/'
+
+  $('.group-history .btn-restore').click(this.restore.bind(this))
+}
+
+/**
+ * Shows what restoring the version would change and restores it if the
+ * admin goes ahead.
+ * @param {Event} e
+ */
+HistoryController.prototype.restore = function (e) {
+  e.preventDefault()
+  var url = this.versionsUrl + $(e.target).data('version')
+
+  $.ajax({url: url, type: 'GET'})
+    .done(function (res) {
+      if (!res.changes.length)
+        return butterbar('Already at this version.', 'confirm')
+
+      var lines = res.changes.map(function (c) {
+        return c.field + ': ' + c.from + ' -> ' + c.to
+      })
+      if (!confirm('Restoring this version will change:\n\n' + lines.join('\n')))
+        return
+
+      $.ajax({url: url + '/restore', type: 'POST'})
+        .done(function () {
+          window.location.reload()
+        })
+        .error(function (xhr) {
+          var res = xhr.responseJSON || {}
+          butterbar(res.error || 'Restore Failed.', 'alert')
+        })
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Loading Version Failed.', 'alert')
+    })
+}
+
+$(document).ready(function () {
+  var hc = new HistoryController()
+})
@@ -0,0 +1,85 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Retries, cancels and prioritizes jobs and starts backfills, refreshing
+ * the progress of backfills running.
+ * @constructor
+ */
+function JobsController () {
+  $('.form-backfill').submit(this.start.bind(this))
+  $('.btn-job').click(this.act.bind(this))
+  setInterval(this.refresh.bind(this), 5000)
+}
+
+/**
+ * Starts a backfill.
+ * @param {Event} e
+ */
+JobsController.prototype.start = function (e) {
+  e.preventDefault()
+  var form = $(e.target)
+
+  $.ajax({
+    url: '/admin/jobs/backfills',
+    type: 'POST',
+    data: JSON.stringify({
+      name: form.find('[name=name]').val(),
+      rate: parseInt(form.find('[name=rate]').val(), 10) || 0,
+      dryRun: form.find('[name=dryRun]').is(':checked')
+    }),
+    contentType: 'application/json'
+  })
+    .done(function () {
+      butterbar('Backfill Started.', 'confirm')
+      setTimeout(function () { window.location.reload() }, 1000)
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Starting Failed.', 'alert')
+    })
+}
+
+/**
+ * Takes the action on a job, e.g. retry.
+ * @param {Event} e
+ */
+JobsController.prototype.act = function (e) {
+  e.preventDefault()
+  var row = $(e.target).closest('tr')
+  var action = $(e.target).data('action')
+
+  $.ajax({url: '/admin/jobs/' + row.data('kind') + '/' + row.data('id') + '/' + action, type: 'POST'})
+    .done(function () {
+      window.location.reload()
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Update Failed.', 'alert')
+    })
+}
+
+/**
+ * Updates the progress of backfills that are pending or running.
+ */
+JobsController.prototype.refresh = function () {
+  $('.group-jobs tr[data-kind=backfills]').each(function () {
+    var row = $(this)
+    var state = row.find('.job-state').text()
+    if (state !== 'pending' && state !== 'running') return
+
+    $.ajax({url: '/admin/jobs/backfills/' + row.data('id'), type: 'GET'})
+      .done(function (res) {
+        var b = res.backfill
+        var detail = b.processed + ' of ' + b.total + ', ' + b.changed + ' changed'
+        if (b.dryRun) detail += ', dry run'
+
+        row.find('.job-state').text(b.status)
+        row.find('.job-detail').text(detail)
+        row.find('.job-attempts').text(b.errors)
+        row.find('.job-error').text(b.lastError || '')
+      })
+  })
+}
+
+$(document).ready(function () {
+  var jc = new JobsController()
+})
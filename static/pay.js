@@ -0,0 +1,73 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Shows an Apple Pay or Google Pay button when the browser supports one and
+ * confirms the payment with the wallet's card.
+ * @constructor
+ */
+function PayController () {
+  var el = $('.group-pay')
+  this.secret = el.data('secret')
+  this.returnUrl = el.data('return-url')
+  this.message = el.find('.message')
+  this.stripe = Stripe(el.data('key'))
+
+  this.request = this.stripe.paymentRequest({
+    country: el.data('country') || 'US',
+    currency: el.data('currency'),
+    total: {label: el.data('label'), amount: el.data('amount')},
+    requestPayerName: true,
+    requestPayerEmail: true
+  })
+  this.request.on('paymentmethod', this.confirm.bind(this))
+
+  var button = this.stripe.elements().create('paymentRequestButton', {
+    paymentRequest: this.request
+  })
+  this.request.canMakePayment().then(function (result) {
+    if (result) button.mount('.payment-request-button')
+  })
+}
+
+/**
+ * Confirms the payment with the card from the wallet, then lets the bank
+ * authenticate it if it asks to.
+ * @param {Object} ev
+ */
+PayController.prototype.confirm = function (ev) {
+  var self = this
+
+  this.stripe.confirmCardPayment(this.secret, {payment_method: ev.paymentMethod.id}, {handleActions: false})
+    .then(function (result) {
+      if (result.error) {
+        ev.complete('fail')
+        return self.showError(result.error.message)
+      }
+
+      ev.complete('success')
+      if (result.paymentIntent.status !== 'requires_action') return self.done()
+
+      self.stripe.confirmCardPayment(self.secret).then(function (result) {
+        if (result.error) return self.showError(result.error.message)
+        self.done()
+      })
+    })
+}
+
+/**
+ * Shows an error under the button.
+ * @param {String} text
+ */
+PayController.prototype.showError = function (text) {
+  this.message.text(text).prop('hidden', false)
+}
+
+/**
+ * Sends the developer on to see the payment's outcome.
+ */
+PayController.prototype.done = function () {
+  window.location = this.returnUrl
+}
+
+$(document).ready(function () {
+  var pc = new PayController()
+})
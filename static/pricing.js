@@ -0,0 +1,29 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Saves plans from the admin pricing editor.
+ * @constructor
+ */
+function PricingController () {
+  $('.group-pricing .btn-submit').click(this.savePlan.bind(this))
+}
+
+/**
+ * Submits the form the clicked button belongs to.
+ * @param {Event} e
+ */
+PricingController.prototype.savePlan = function (e) {
+  e.preventDefault()
+
+  var form = $(e.target).closest('form')
+  $.ajax({
+    url: '/admin/pricing/' + form.data('slug'),
+    type: 'PUT',
+    data: form.serialize()
+  })
+    .done(butterbar.bind(this, 'Plan Saved.', 'confirm'))
+    .error(butterbar.bind(this, 'Save Failed.', 'alert'))
+}
+
+$(document).ready(function () {
+  var pc = new PricingController()
+})
@@ -0,0 +1,42 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Saves the theme and keeps the preview up to date while editing.
+ * @constructor
+ */
+function ThemeController () {
+  this.form = $('.group-theme form')
+  this.preview = $('.theme-preview')
+
+  this.form.find('input, select').on('input change', this.refresh.bind(this))
+  this.form.find('.btn-submit').click(this.saveTheme.bind(this))
+}
+
+/**
+ * Reloads the preview with the form's unsaved values.
+ */
+ThemeController.prototype.refresh = function () {
+  clearTimeout(this.timeout)
+  this.timeout = setTimeout(function () {
+    this.preview.attr('src', '/admin/theme/preview?' + this.form.serialize())
+  }.bind(this), 300)
+}
+
+/**
+ * Submits the theme.
+ * @param {Event} e
+ */
+ThemeController.prototype.saveTheme = function (e) {
+  e.preventDefault()
+
+  $.ajax({
+    url: '/admin/theme',
+    type: 'PUT',
+    data: this.form.serialize()
+  })
+    .done(butterbar.bind(this, 'Theme Saved.', 'confirm'))
+    .error(butterbar.bind(this, 'Save Failed.', 'alert'))
+}
+
+$(document).ready(function () {
+  var tc = new ThemeController()
+})
@@ -0,0 +1,70 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Saves the developer list's filters as views and picks the default one.
+ * @constructor
+ */
+function ViewsController () {
+  this.listEl = $('.group-list-options .form-list')
+  this.viewEl = $('.group-list-options .form-view')
+
+  $('.group-list-options .btn-save-view').click(this.saveView.bind(this))
+  $('.group-list-options .btn-default-view').click(this.makeDefault.bind(this))
+}
+
+/**
+ * Saves the filters in the list form as the named view.
+ * @param {Event} e
+ */
+ViewsController.prototype.saveView = function (e) {
+  e.preventDefault()
+
+  var field = function (name) {
+    return this.listEl.find('[name=' + name + ']').val()
+  }.bind(this)
+  var slug = this.viewEl.find('[name=slug]').val()
+  var columns = field('columns')
+
+  $.ajax({
+    url: '/admin/views/' + slug,
+    type: 'PUT',
+    contentType: 'application/json',
+    data: JSON.stringify({
+      name: this.viewEl.find('[name=name]').val(),
+      search: field('search'),
+      tag: field('tag'),
+      plan: field('plan'),
+      segment: field('segment'),
+      sort: field('sort'),
+      columns: columns ? columns.split(',') : []
+    })
+  })
+    .done(function (res) {
+      window.location = res.url
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Saving View Failed.', 'alert')
+    })
+}
+
+/**
+ * Makes the view being looked at open by default, or clears the default
+ * when there isn't one.
+ * @param {Event} e
+ */
+ViewsController.prototype.makeDefault = function (e) {
+  e.preventDefault()
+
+  $.ajax({
+    url: '/admin/views/default',
+    type: 'PUT',
+    contentType: 'application/json',
+    data: JSON.stringify({slug: this.viewEl.data('view') || ''})
+  })
+    .done(butterbar.bind(this, 'Default View Saved.', 'confirm'))
+    .error(butterbar.bind(this, 'Saving Default View Failed.', 'alert'))
+}
+
+$(document).ready(function () {
+  var vc = new ViewsController()
+})
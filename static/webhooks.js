@@ -0,0 +1,56 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Replays failed webhooks and, outside production, simulates providers.
+ * @constructor
+ */
+function WebhooksController () {
+  $('.btn-replay').click(this.replay.bind(this))
+  $('.form-simulate').submit(this.simulate.bind(this))
+}
+
+/**
+ * Processes a failed webhook again.
+ * @param {Event} e
+ */
+WebhooksController.prototype.replay = function (e) {
+  e.preventDefault()
+  var id = $(e.target).data('id')
+
+  $.ajax({url: '/admin/webhooks/' + id + '/replay', type: 'POST'})
+    .done(function () {
+      butterbar('Webhook Replayed.', 'confirm')
+      setTimeout(function () { window.location.reload() }, 1000)
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Replay Failed.', 'alert')
+    })
+}
+
+/**
+ * Sends a payload as if the provider had.
+ * @param {Event} e
+ */
+WebhooksController.prototype.simulate = function (e) {
+  e.preventDefault()
+  var form = $(e.target)
+  var provider = form.find('[name=provider]').val()
+
+  $.ajax({
+    url: '/admin/webhooks/simulate/' + provider,
+    type: 'POST',
+    data: form.find('[name=payload]').val(),
+    contentType: 'text/plain'
+  })
+    .done(function (res) {
+      window.location = '/admin/webhooks/' + res.webhook.id
+    })
+    .error(function (xhr) {
+      var res = xhr.responseJSON || {}
+      butterbar(res.error || 'Simulating Failed.', 'alert')
+    })
+}
+
+$(document).ready(function () {
+  var wc = new WebhooksController()
+})
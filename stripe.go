@@ -0,0 +1,153 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the bounded pool Stripe calls are made through. When Stripe slows
+// down requests queue up to a limit and are then shed, and repeated failures
+// trip a breaker so requests fail fast instead of piling up.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Bowery/gopackages/requests"
+	"github.com/bradrydzewski/go.stripe"
+)
+
+const (
+	// Stripe calls made at once.
+	stripeWorkers = 10
+
+	// Calls allowed to wait for a worker, past this they're shed.
+	stripeQueueSize = 50
+
+	// Longest a call waits for a worker.
+	stripeQueueTimeout = 10 * time.Second
+
+	// Calls slower than this count as failures for the breaker.
+	stripeSlowCall = 15 * time.Second
+)
+
+// errStripeBusy is returned when a call is shed because the queue is full.
+var errStripeBusy = errors.New("Payments are busy right now, please try again shortly.")
+
+// callPool bounds the calls in flight to a service and those waiting.
+type callPool struct {
+	workers chan struct{}
+	mutex   sync.Mutex
+	waiting int
+	queue   int
+	timeout time.Duration
+	breaker *circuitBreaker
+}
+
+var stripePool = &callPool{
+	workers: make(chan struct{}, stripeWorkers),
+	queue:   stripeQueueSize,
+	timeout: stripeQueueTimeout,
+	breaker: newCircuitBreaker("stripe", 5, 30*time.Second),
+}
+
+// do runs fn once a worker is free, shedding it if the queue is full or the
+// wait is too long, and giving up if ctx is done first. countFailure decides
+// if an error means the service is unhealthy, as opposed to e.g. a declined
+// card.
+func (p *callPool) do(ctx context.Context, fn func() error, countFailure func(error) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !p.breaker.allow(time.Now()) {
+		return errBreakerOpen
+	}
+
+	select {
+	case p.workers <- struct{}{}:
+	default:
+		p.mutex.Lock()
+		if p.waiting >= p.queue {
+			p.mutex.Unlock()
+			p.breaker.release()
+			return errStripeBusy
+		}
+		p.waiting++
+		p.mutex.Unlock()
+
+		timer := time.NewTimer(p.timeout)
+		select {
+		case p.workers <- struct{}{}:
+			timer.Stop()
+		case <-timer.C:
+			p.mutex.Lock()
+			p.waiting--
+			p.mutex.Unlock()
+			p.breaker.record(true, time.Now())
+			return errStripeBusy
+		case <-ctx.Done():
+			timer.Stop()
+			p.mutex.Lock()
+			p.waiting--
+			p.mutex.Unlock()
+			p.breaker.release()
+			return ctx.Err()
+		}
+
+		p.mutex.Lock()
+		p.waiting--
+		p.mutex.Unlock()
+	}
+	defer func() { <-p.workers }()
+
+	start := time.Now()
+	err := fn()
+	if ctx.Err() != nil {
+		// Cut short by the caller, it says nothing about the service.
+		p.breaker.release()
+		return err
+	}
+	p.breaker.record((err != nil && countFailure(err)) || time.Since(start) > stripeSlowCall, time.Now())
+
+	return err
+}
+
+// stripeFailure reports whether err means Stripe itself is having trouble.
+// Card and request errors are the caller's problem.
+func stripeFailure(err error) bool {
+	if e, ok := err.(*stripe.Error); ok {
+		return e.Type == "api_error"
+	}
+	if e, ok := err.(*stripeAPIError); ok {
+		return e.Type == "api_error"
+	}
+
+	return true
+}
+
+// callStripe makes a Stripe call through the pool, abandoning it if ctx is
+// done. Charges and customers aren't idempotent so calls are only retried
+// if Stripe couldn't be reached.
+func callStripe(ctx context.Context, fn func() error) error {
+	return stripePool.do(ctx, func() error {
+		return withRetry(ctx, "stripe", connectError, fn)
+	}, stripeFailure)
+}
+
+// stripeUnavailable writes a 503 if err is from load shedding or the
+// breaker, returning false for any other error.
+func stripeUnavailable(rw http.ResponseWriter, err error) bool {
+	if err != errStripeBusy && err != errBreakerOpen {
+		return false
+	}
+
+	msg := err.Error()
+	if err == errBreakerOpen {
+		msg = "Payments are temporarily unavailable, please try again in a minute."
+	}
+
+	rw.Header().Set("Retry-After", "30")
+	renderer.JSON(rw, http.StatusServiceUnavailable, map[string]string{
+		"status": requests.StatusFailed,
+		"error":  msg,
+	})
+	return true
+}
@@ -0,0 +1,379 @@
+// Copyright 2014 Bowery, Inc.
+// Contains account suspension. Suspended developers can't log in, requests
+// made with their token or for their account fail with the
+// account_suspended code, and they can't be charged. Suspensions with an
+// end date are lifted when it passes, and paid time lost while suspended is
+// given back.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"github.com/mattbaird/gochimp"
+	"labix.org/v2/mgo/bson"
+)
+
+// How often each instance reloads the suspended accounts.
+const suspensionReloadInterval = 15 * time.Second
+
+// codeSuspended is the error code sent for suspended accounts, so clients
+// can tell a suspension from a bad token.
+const codeSuspended = "account_suspended"
+
+// maxSuspensionReason keeps reasons to a line in the email.
+const maxSuspensionReason = 500
+
+// suspendedAccounts holds the suspensions by token and email so requests are
+// checked without a query. Suspensions are rare so every instance keeps them
+// all.
+type suspendedAccounts struct {
+	sync.RWMutex
+	byToken map[string]*db.Suspension
+	byEmail map[string]*db.Suspension
+}
+
+var suspended = &suspendedAccounts{
+	byToken: map[string]*db.Suspension{},
+	byEmail: map[string]*db.Suspension{},
+}
+
+func init() {
+	scheduleEveryInstance("reload-suspensions", suspensionReloadInterval, reloadSuspensions)
+	schedule("lift-suspensions", 10*time.Minute, liftExpiredSuspensions)
+}
+
+// reloadSuspensions replaces the suspended accounts with the database's.
+func reloadSuspensions() error {
+	ds, err := db.GetSuspendedDevelopers()
+	if err != nil {
+		return err
+	}
+
+	byToken := map[string]*db.Suspension{}
+	byEmail := map[string]*db.Suspension{}
+	for _, d := range ds {
+		if d.Token != "" {
+			byToken[d.Token] = d.Suspension
+		}
+		byEmail[strings.ToLower(d.Email)] = d.Suspension
+	}
+
+	suspended.Lock()
+	suspended.byToken = byToken
+	suspended.byEmail = byEmail
+	suspended.Unlock()
+	return nil
+}
+
+// set records a suspension locally, so the instance that made it enforces it
+// before the next reload. A nil suspension removes it.
+func (s *suspendedAccounts) set(token, email string, sus *db.Suspension) {
+	s.Lock()
+	defer s.Unlock()
+
+	email = strings.ToLower(email)
+	if sus == nil {
+		delete(s.byToken, token)
+		delete(s.byEmail, email)
+		return
+	}
+	if token != "" {
+		s.byToken[token] = sus
+	}
+	s.byEmail[email] = sus
+}
+
+// forRequest returns the active suspension of the account a request is
+// made by or for, nil if there isn't one. Outside of admin routes any path
+// segment that's a suspended token counts, which covers every route taking
+// a token.
+func (s *suspendedAccounts) forRequest(req *http.Request, now time.Time) *db.Suspension {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.byToken) == 0 && len(s.byEmail) == 0 {
+		return nil
+	}
+
+	candidates := []*db.Suspension{s.byToken[req.URL.Query().Get("token")]}
+	if user, pass, ok := req.BasicAuth(); ok {
+		if pass != "" {
+			candidates = append(candidates, s.byEmail[strings.ToLower(user)])
+		} else {
+			candidates = append(candidates, s.byToken[user])
+		}
+	}
+	if !strings.HasPrefix(req.URL.Path, "/admin/") {
+		for _, segment := range strings.Split(req.URL.Path, "/") {
+			candidates = append(candidates, s.byToken[segment])
+		}
+	}
+
+	for _, sus := range candidates {
+		if sus.Active(now) {
+			return sus
+		}
+	}
+	return nil
+}
+
+// renderSuspended responds to a request from a suspended account.
+func renderSuspended(rw http.ResponseWriter, sus *db.Suspension) {
+	msg := "This account is suspended"
+	if !sus.Until.IsZero() {
+		msg += " until " + sus.Until.UTC().Format("January 2, 2006")
+	}
+	if sus.Reason != "" {
+		msg += ": " + sus.Reason
+	}
+
+	res := map[string]interface{}{
+		"status": requests.StatusFailed,
+		"error":  msg + ".",
+		"code":   codeSuspended,
+	}
+	if !sus.Until.IsZero() {
+		res["until"] = sus.Until
+	}
+	renderer.JSON(rw, http.StatusForbidden, res)
+}
+
+// enforceSuspensions wraps the server so suspended accounts can't make
+// requests, authenticated or not.
+func enforceSuspensions(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if sus := suspended.forRequest(req, time.Now()); sus != nil {
+			renderSuspended(rw, sus)
+			return
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// restoredExpiration returns a paid developer's expiration pushed back by
+// the time they were suspended, since they couldn't use or pay for it.
+func restoredExpiration(expiration time.Time, sus *db.Suspension, now time.Time) time.Time {
+	end := now
+	if !sus.Until.IsZero() && sus.Until.Before(now) {
+		end = sus.Until
+	}
+	if end.Before(sus.SuspendedAt) || expiration.Before(sus.SuspendedAt) {
+		return expiration
+	}
+
+	return expiration.Add(end.Sub(sus.SuspendedAt))
+}
+
+// liftSuspension unsuspends a developer, giving back paid time lost while
+// suspended.
+func liftSuspension(d *schemas.Developer, sus *db.Suspension) error {
+	if err := db.UnsuspendDeveloper(d.ID); err != nil {
+		return err
+	}
+	suspended.set(d.Token, d.Email, nil)
+	entitlements.invalidate(d.Token)
+
+	state, err := developerLifecycle(d)
+	if err != nil {
+		return err
+	}
+	if paidLifecycle(state) {
+		expiration := restoredExpiration(d.Expiration, sus, time.Now())
+		if !expiration.Equal(d.Expiration) {
+			return db.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{"expiration": expiration})
+		}
+	}
+	return nil
+}
+
+// liftExpiredSuspensions unsuspends developers whose suspension has ended.
+func liftExpiredSuspensions() error {
+	ds, err := db.GetSuspendedDevelopers()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, sd := range ds {
+		if sd.Suspension.Active(now) {
+			continue
+		}
+
+		d, err := db.GetDeveloper(bson.M{"_id": sd.ID})
+		if err != nil {
+			return err
+		}
+		if err := liftSuspension(d, sd.Suspension); err != nil {
+			return err
+		}
+		sendSuspensionEmail(d, nil)
+		if err := db.SaveAuditLog(&db.AuditLog{Action: "developer.unsuspended", Actor: "scheduler", Detail: d.Email}); err != nil {
+			fmt.Println("unable to save audit log", err)
+		}
+	}
+
+	return nil
+}
+
+// sendSuspensionEmail tells a developer they've been suspended, or that
+// their suspension was lifted if sus is nil. Failures are only printed.
+func sendSuspensionEmail(d *schemas.Developer, sus *db.Suspension) {
+	data := map[string]interface{}{"name": strings.Split(d.Name, " ")[0]}
+	subject := "Your Bowery account has been reinstated"
+	if sus != nil {
+		subject = "Your Bowery account has been suspended"
+		data["reason"] = sus.Reason
+		if !sus.Until.IsZero() {
+			data["until"] = sus.Until.UTC().Format("January 2, 2006")
+		}
+	}
+
+	message, err := RenderEmail("suspension_email", data)
+	if err == nil {
+		err = sendEmail(context.Background(), gochimp.Message{
+			Subject:   subject,
+			FromEmail: "support@bowery.io",
+			FromName:  "Bowery Support",
+			To: []gochimp.Recipient{{
+				Email: d.Email,
+				Name:  d.Name,
+			}},
+			Html: message,
+		})
+	}
+	if err != nil {
+		fmt.Println("unable to send suspension email to", d.Email, err)
+	}
+}
+
+// adminDeveloper returns the developer with the id in the route, in the
+// admin's tenant.
+func adminDeveloper(req *http.Request) (*schemas.Developer, error) {
+	return tenantFor(req).GetDeveloperById(mux.Vars(req)["id"])
+}
+
+// POST /admin/developers/{id}/suspend, Suspends a developer with a reason and optional end date
+func SuspendDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Reason string    `json:"reason"`
+		Until  time.Time `json:"until"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" || len(body.Reason) > maxSuspensionReason {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  fmt.Sprintf("Reason Required, up to %d characters.", maxSuspensionReason),
+		})
+		return
+	}
+	if !body.Until.IsZero() && !body.Until.After(time.Now()) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Until must be in the future.",
+		})
+		return
+	}
+
+	d, err := adminDeveloper(req)
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	sus := &db.Suspension{Reason: body.Reason, Until: body.Until, SuspendedBy: actor}
+	if err := db.SuspendDeveloper(d.ID, sus); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	suspended.set(d.Token, d.Email, sus)
+	entitlements.invalidate(d.Token)
+	audit(req, "developer.suspended", actor, d.Email+": "+body.Reason)
+	sendSuspensionEmail(d, sus)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusUpdated,
+		"suspension": sus,
+	})
+}
+
+// POST /admin/developers/{id}/unsuspend, Lifts a developer's suspension
+func UnsuspendDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := adminDeveloper(req)
+	var sus *db.Suspension
+	if err == nil {
+		sus, err = db.GetSuspension(d.ID)
+	}
+	if err == nil && sus == nil {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := liftSuspension(d, sus); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "developer.unsuspended", actor, d.Email)
+	sendSuspensionEmail(d, nil)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// GET /admin/suspensions, Lists suspended developers
+func AdminSuspensionsHandler(rw http.ResponseWriter, req *http.Request) {
+	ds, err := db.GetSuspendedDevelopers()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusFound,
+		"developers": ds,
+	})
+}
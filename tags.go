@@ -0,0 +1,158 @@
+// Copyright 2014 Bowery, Inc.
+// Contains developer tags, free form labels like "vip" or "at-risk" admins
+// put on developers. Tags can be filtered on in the admin, segments and
+// broadcasts.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+)
+
+// maxTags keeps a developer's tags to what fits on the admin page.
+const maxTags = 20
+
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_:-]{0,39}$`)
+
+// normalizeTags lower cases, dedupes and checks tags, e.g. " VIP" is "vip".
+func normalizeTags(tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !validTag.MatchString(tag) {
+			return nil, fmt.Errorf("Tag %q must be up to 40 letters, numbers, dashes, underscores or colons.", tag)
+		}
+
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// changeTags returns tags with add added and remove removed, sorted.
+func changeTags(tags, add, remove []string) []string {
+	// Removed tags are skipped, as are tags already kept.
+	skip := map[string]bool{}
+	for _, tag := range remove {
+		skip[tag] = true
+	}
+
+	changed := []string{}
+	for _, tag := range append(append([]string{}, tags...), add...) {
+		if !skip[tag] {
+			skip[tag] = true
+			changed = append(changed, tag)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// GET /admin/tags, Lists the tags in use with how many developers have each
+func TagsHandler(rw http.ResponseWriter, req *http.Request) {
+	counts, err := db.GetTagCounts()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"tags":   counts,
+	})
+}
+
+// PUT /admin/developers/{id}/tags, Replaces a developer's tags, or adds and removes some
+func UpdateTagsHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Tags   *[]string `json:"tags"`
+		Add    []string  `json:"add"`
+		Remove []string  `json:"remove"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var tags, add, remove []string
+	err := func() error {
+		var err error
+		if body.Tags != nil {
+			if tags, err = normalizeTags(*body.Tags); err != nil {
+				return err
+			}
+		}
+		if add, err = normalizeTags(body.Add); err != nil {
+			return err
+		}
+		remove, err = normalizeTags(body.Remove)
+		return err
+	}()
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := adminDeveloper(req)
+	if err == nil && body.Tags == nil {
+		tags, err = db.GetDeveloperTags(d.ID)
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	tags = changeTags(tags, add, remove)
+	if len(tags) > maxTags {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  fmt.Sprintf("Up to %d tags allowed.", maxTags),
+		})
+		return
+	}
+
+	if err := db.SetDeveloperTags(d.ID, tags); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "developer.tagged", actor, d.Email+": "+strings.Join(tags, ", "))
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"tags":   tags,
+	})
+}
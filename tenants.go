@@ -0,0 +1,137 @@
+// Copyright 2014 Bowery, Inc.
+// Contains tenant scoping. Developer queries made for a request only reach
+// the caller's organization: the organization whose domain the request was
+// made to, otherwise the organization of the developer whose token was
+// sent. Requests without a token, including admins signed in with a
+// password, are scoped to broome's own developers. Admins in sudo mode can
+// reach every organization by sending the X-Tenant-Bypass header with a
+// reason, each use is audited.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+const tenantBypassHeader = "X-Tenant-Bypass"
+
+type tenantKey struct{}
+
+// tenantScope is the tenant attached to a request, resolved the first time
+// it's needed since most routes look up the caller anyway.
+type tenantScope struct {
+	bypass bool
+	once   sync.Once
+	tenant *db.Tenant
+}
+
+// callerToken returns the token the request was made with, preferring
+// basic auth so a grantee is scoped by their own account rather than the
+// one in the route.
+func callerToken(req *http.Request) string {
+	if user, pass, ok := req.BasicAuth(); ok {
+		if pass == "" {
+			return user
+		}
+
+		// Passwords are only used by broome's own admins.
+		return ""
+	}
+	if token := mux.Vars(req)["token"]; token != "" {
+		return token
+	}
+
+	return req.FormValue("token")
+}
+
+// resolveTenant returns the tenant req is made in by the caller with token.
+func resolveTenant(req *http.Request, token string) *db.Tenant {
+	if org := orgFor(req); org != nil {
+		return db.TenantOf(org.ID)
+	}
+
+	if token == "" {
+		return db.TenantOf("")
+	}
+
+	// An unknown token gets broome's tenant, where lookups by it fail too.
+	t, err := db.GetDeveloperTenant(bson.M{"token": token})
+	if err != nil {
+		return db.TenantOf("")
+	}
+
+	return t
+}
+
+// tenantFor returns the tenant developer queries for req are scoped to,
+// with reads bounded by the request's deadline.
+func tenantFor(req *http.Request) *db.Tenant {
+	scope, ok := req.Context().Value(tenantKey{}).(*tenantScope)
+	if !ok {
+		return withRequestDeadline(req, resolveTenant(req, callerToken(req)))
+	}
+	if scope.bypass {
+		return withRequestDeadline(req, db.AllTenants)
+	}
+
+	scope.once.Do(func() {
+		scope.tenant = withRequestDeadline(req, resolveTenant(req, callerToken(req)))
+	})
+	return scope.tenant
+}
+
+// tenantForToken returns the tenant to look up a token sent in the body of
+// req in, which tenantFor can't see.
+func tenantForToken(req *http.Request, token string) *db.Tenant {
+	if scope, ok := req.Context().Value(tenantKey{}).(*tenantScope); ok && scope.bypass {
+		return withRequestDeadline(req, db.AllTenants)
+	}
+
+	return withRequestDeadline(req, resolveTenant(req, token))
+}
+
+// withRequestDeadline bounds the tenant's reads by req's deadline, if it
+// has one.
+func withRequestDeadline(req *http.Request, t *db.Tenant) *db.Tenant {
+	if deadline, ok := req.Context().Deadline(); ok {
+		return t.WithDeadline(deadline)
+	}
+
+	return t
+}
+
+// scopeTenants attaches a tenant scope to requests, checking and auditing
+// admin bypasses.
+func scopeTenants(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scope := &tenantScope{}
+		if _, ok := req.Header[tenantBypassHeader]; ok {
+			admin, err := sudoAdmin(req)
+			reason := strings.TrimSpace(req.Header.Get(tenantBypassHeader))
+			if err == nil && reason == "" {
+				err = errors.New(tenantBypassHeader + " must give a reason.")
+			}
+			if err != nil {
+				audit(req, "tenant.bypass.denied", "", err.Error())
+				renderer.JSON(rw, http.StatusForbidden, map[string]string{
+					"status": requests.StatusFailed,
+					"error":  err.Error(),
+				})
+				return
+			}
+
+			audit(req, "tenant.bypass", admin.Email, reason)
+			scope.bypass = true
+		}
+
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), tenantKey{}, scope)))
+	})
+}
@@ -0,0 +1,282 @@
+// Copyright 2014 Bowery, Inc.
+// Contains test clocks, which give a developer their own virtual time
+// outside production. Expiry and renewals read the developer's clock, so an
+// admin can move it forward days at a time instead of waiting. Each clock
+// has a Stripe test clock alongside it, and Stripe customers created for
+// the developer while it runs are attached to it so Stripe's side of a
+// renewal moves with ours.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/env"
+	"github.com/Bowery/gopackages/requests"
+	"labix.org/v2/mgo/bson"
+)
+
+// Longest a clock can be moved in one go, Stripe refuses to advance a test
+// clock further than a couple of billing periods at once.
+const maxTestClockAdvance = 60 * 24 * time.Hour
+
+var errTestClocksDisabled = errors.New("test clocks are only available outside production")
+
+// stripeTestClock is the part of a Stripe test clock broome uses.
+type stripeTestClock struct {
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	FrozenTime int64  `json:"frozen_time"`
+}
+
+// developerNow returns the time for a developer, their test clock's if
+// they have one and the wall clock's otherwise. Production never reads
+// test clocks.
+func developerNow(id bson.ObjectId) time.Time {
+	if env.Current.Production {
+		return time.Now()
+	}
+
+	c, err := db.GetTestClock(id)
+	if err != nil {
+		return time.Now()
+	}
+	return c.Now
+}
+
+// developerTestClock returns the id of the developer's Stripe test clock,
+// if they have one.
+func developerTestClock(id bson.ObjectId) string {
+	if env.Current.Production {
+		return ""
+	}
+
+	c, err := db.GetTestClock(id)
+	if err != nil {
+		return ""
+	}
+	return c.StripeClockID
+}
+
+// createStripeTestClock creates a Stripe test clock frozen at a time.
+func createStripeTestClock(ctx context.Context, id bson.ObjectId, now time.Time) (*stripeTestClock, error) {
+	clock := &stripeTestClock{}
+	params := url.Values{
+		"frozen_time": {strconv.FormatInt(now.Unix(), 10)},
+		"name":        {"broome " + id.Hex()},
+	}
+
+	return clock, callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/test_helpers/test_clocks", params, "", clock)
+	})
+}
+
+// advanceStripeTestClock moves a Stripe test clock to a later time. Stripe
+// advances it in the background, running anything due on the way.
+func advanceStripeTestClock(ctx context.Context, clockID string, to time.Time) error {
+	params := url.Values{"frozen_time": {strconv.FormatInt(to.Unix(), 10)}}
+
+	return callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/test_helpers/test_clocks/"+url.PathEscape(clockID)+"/advance", params, "", &stripeTestClock{})
+	})
+}
+
+// deleteStripeTestClock deletes a Stripe test clock and the customers
+// attached to it.
+func deleteStripeTestClock(ctx context.Context, clockID string) error {
+	return callStripe(ctx, func() error {
+		return stripeRequest(ctx, "DELETE", "/test_helpers/test_clocks/"+url.PathEscape(clockID), url.Values{}, "", &stripeTestClock{})
+	})
+}
+
+// testClockFailed writes the error response for a test clock request.
+func testClockFailed(rw http.ResponseWriter, err error) {
+	if stripeUnavailable(rw, err) {
+		return
+	}
+
+	status := dbErrorStatus(err)
+	if err == errTestClocksDisabled {
+		status = http.StatusForbidden
+	}
+
+	renderer.JSON(rw, status, map[string]string{
+		"status": requests.StatusFailed,
+		"error":  err.Error(),
+	})
+}
+
+// GET /admin/developers/{id}/test-clock, Shows a developer's test clock
+func TestClockHandler(rw http.ResponseWriter, req *http.Request) {
+	if env.Current.Production {
+		testClockFailed(rw, errTestClocksDisabled)
+		return
+	}
+
+	d, err := adminDeveloper(req)
+	var c *db.TestClock
+	if err == nil {
+		c, err = db.GetTestClock(d.ID)
+	}
+	if err != nil {
+		testClockFailed(rw, err)
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"clock":   c,
+		"expired": !d.Expiration.IsZero() && d.Expiration.Before(c.Now),
+	})
+}
+
+// POST /admin/developers/{id}/test-clock, Starts a test clock for a developer at the current time
+func StartTestClockHandler(rw http.ResponseWriter, req *http.Request) {
+	if env.Current.Production {
+		testClockFailed(rw, errTestClocksDisabled)
+		return
+	}
+
+	d, err := adminDeveloper(req)
+	if err != nil {
+		testClockFailed(rw, err)
+		return
+	}
+	if _, err := db.GetTestClock(d.ID); err != db.ErrNotFound {
+		if err == nil {
+			renderer.JSON(rw, http.StatusConflict, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "developer already has a test clock, stop it first",
+			})
+			return
+		}
+		testClockFailed(rw, err)
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	c := &db.TestClock{DeveloperID: d.ID, Now: time.Now().Truncate(time.Second), StartedBy: actor}
+	sc, err := createStripeTestClock(req.Context(), d.ID, c.Now)
+	if err == nil {
+		c.StripeClockID = sc.ID
+		err = db.SaveTestClock(c)
+	}
+	if err != nil {
+		testClockFailed(rw, err)
+		return
+	}
+	audit(req, "developer.test_clock_started", actor, d.Email)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"clock":  c,
+	})
+}
+
+// POST /admin/developers/{id}/test-clock/advance, Moves a developer's test clock forward by a duration, e.g. {"by": "720h"}
+func AdvanceTestClockHandler(rw http.ResponseWriter, req *http.Request) {
+	if env.Current.Production {
+		testClockFailed(rw, errTestClocksDisabled)
+		return
+	}
+
+	var body struct {
+		By string `json:"by"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	var by time.Duration
+	if err == nil {
+		by, err = time.ParseDuration(body.By)
+	}
+	if err == nil && (by <= 0 || by > maxTestClockAdvance) {
+		err = errors.New("by must be positive and at most " + maxTestClockAdvance.String())
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := adminDeveloper(req)
+	var c *db.TestClock
+	if err == nil {
+		c, err = db.GetTestClock(d.ID)
+	}
+	if err != nil {
+		testClockFailed(rw, err)
+		return
+	}
+
+	// Stripe goes first, if it won't advance ours stays in step with it.
+	to := c.Now.Add(by)
+	if c.StripeClockID != "" {
+		err = advanceStripeTestClock(req.Context(), c.StripeClockID, to)
+	}
+	if err == nil {
+		err = db.AdvanceTestClock(d.ID, to)
+	}
+	if err != nil {
+		testClockFailed(rw, err)
+		return
+	}
+	c.Now = to
+	entitlements.invalidate(d.Token)
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "developer.test_clock_advanced", actor, d.Email+": "+by.String()+" to "+to.UTC().Format(time.RFC3339))
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusUpdated,
+		"clock":   c,
+		"expired": !d.Expiration.IsZero() && d.Expiration.Before(c.Now),
+	})
+}
+
+// DELETE /admin/developers/{id}/test-clock, Stops a developer's test clock, putting them back on the wall clock
+func StopTestClockHandler(rw http.ResponseWriter, req *http.Request) {
+	if env.Current.Production {
+		testClockFailed(rw, errTestClocksDisabled)
+		return
+	}
+
+	d, err := adminDeveloper(req)
+	var c *db.TestClock
+	if err == nil {
+		c, err = db.GetTestClock(d.ID)
+	}
+	if err == nil && c.StripeClockID != "" {
+		err = deleteStripeTestClock(req.Context(), c.StripeClockID)
+	}
+	if err == nil {
+		err = db.RemoveTestClock(d.ID)
+	}
+	if err != nil {
+		testClockFailed(rw, err)
+		return
+	}
+	entitlements.invalidate(d.Token)
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "developer.test_clock_stopped", actor, d.Email)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusDeleted,
+	})
+}
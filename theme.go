@@ -0,0 +1,171 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the deployment's theme, the product name, logo and css variables
+// the templates are rendered with, and the admin editor with a live preview.
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+)
+
+var (
+	themeMutex   sync.RWMutex
+	currentTheme = copyTheme(db.DefaultTheme)
+
+	themeColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+	themeFontPattern  = regexp.MustCompile(`^[a-zA-Z0-9 ,-]+$`)
+)
+
+func init() {
+	scheduleEveryInstance("theme", 30*time.Second, loadTheme)
+}
+
+func copyTheme(t *db.Theme) *db.Theme {
+	c := *t
+	return &c
+}
+
+// getTheme returns the theme pages are rendered with.
+func getTheme() *db.Theme {
+	themeMutex.RLock()
+	defer themeMutex.RUnlock()
+	return currentTheme
+}
+
+// loadTheme reads the theme from the database, so a theme saved on any
+// instance is picked up by all of them.
+func loadTheme() error {
+	t, err := db.GetTheme()
+	if err != nil {
+		return err
+	}
+
+	themeMutex.Lock()
+	currentTheme = t
+	themeMutex.Unlock()
+	return nil
+}
+
+// themeFromForm applies the form's values to a copy of base, validating
+// them since they're written into css.
+func themeFromForm(req *http.Request, base *db.Theme) (*db.Theme, error) {
+	t := copyTheme(base)
+	for field, dest := range map[string]*string{
+		"productName":     &t.ProductName,
+		"logoUrl":         &t.LogoURL,
+		"primaryColor":    &t.PrimaryColor,
+		"accentColor":     &t.AccentColor,
+		"backgroundColor": &t.BackgroundColor,
+		"textColor":       &t.TextColor,
+		"font":            &t.Font,
+	} {
+		if val := req.FormValue(field); val != "" {
+			*dest = val
+		}
+	}
+
+	for _, color := range []string{t.PrimaryColor, t.AccentColor, t.BackgroundColor, t.TextColor} {
+		if !themeColorPattern.MatchString(color) {
+			return nil, errors.New("Colors must be hex values, e.g. #1a2b3c.")
+		}
+	}
+	if !themeFontPattern.MatchString(t.Font) {
+		return nil, errors.New("Font must be a list of font names.")
+	}
+
+	return t, nil
+}
+
+// GET /admin/theme, Theme editor with a live preview
+func AdminThemeHandler(rw http.ResponseWriter, req *http.Request) {
+	t, err := db.GetTheme()
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderAdminTemplate(rw, "theme", map[string]interface{}{
+		"Theme": t,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /admin/theme/preview, Renders a sample page with the theme in the query
+func ThemePreviewHandler(rw http.ResponseWriter, req *http.Request) {
+	t, err := themeFromForm(req, getTheme())
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	layout := "layout"
+	if req.FormValue("layout") == "admin" {
+		layout = "admin_layout"
+	}
+
+	err = renderLayout(rw, layout, "theme_preview", map[string]interface{}{}, template.FuncMap{
+		"theme": func() *db.Theme { return t },
+	})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// PUT /admin/theme, Saves the theme
+func UpdateThemeHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	base, err := db.GetTheme()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	t, err := themeFromForm(req, base)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	if err := db.SaveTheme(t, actor); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	themeMutex.Lock()
+	currentTheme = t
+	themeMutex.Unlock()
+	audit(req, "theme.update", actor, t.ProductName)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"theme":  t,
+	})
+}
@@ -0,0 +1,274 @@
+// Copyright 2014 Bowery, Inc.
+// Contains developer token issuing and leaked token intake. Tokens start
+// with brm_live_ or brm_test_ and end in a checksum, so secret scanners can
+// find them with a pattern and tell them from random strings. GitHub reports
+// the tokens it finds in public repos to the intake, which revokes them.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Token prefixes. Test tokens are issued outside production.
+const (
+	tokenPrefixLive = "brm_live_"
+	tokenPrefixTest = "brm_test_"
+)
+
+const (
+	base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// tokenRandomLength is the random part's length, about 178 bits.
+	tokenRandomLength = 30
+
+	// tokenChecksumLength is the base62 crc32 of the random part.
+	tokenChecksumLength = 6
+)
+
+// tokenPattern matches issued tokens, it's the pattern given to scanners.
+var tokenPattern = regexp.MustCompile(`^brm_(live|test)_[0-9A-Za-z]{36}$`)
+
+// githubKeysURL lists the keys GitHub signs secret scanning reports with.
+var githubKeysURL = "https://api.github.com/meta/public_keys/secret_scanning"
+
+var githubHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var githubKeys = struct {
+	sync.Mutex
+	keys      map[string]*ecdsa.PublicKey
+	fetchedAt time.Time
+}{}
+
+// tokenPrefix returns the prefix for tokens issued by this deployment.
+func tokenPrefix() string {
+	if os.Getenv("ENV") == "production" {
+		return tokenPrefixLive
+	}
+
+	return tokenPrefixTest
+}
+
+// encodeBase62 encodes n in base62, left padded with zeros to length.
+func encodeBase62(n uint64, length int) string {
+	buf := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		buf[i] = base62[n%62]
+		n /= 62
+	}
+
+	return string(buf)
+}
+
+// tokenChecksum returns the checksum for a token's random part.
+func tokenChecksum(random string) string {
+	return encodeBase62(uint64(crc32.ChecksumIEEE([]byte(random))), tokenChecksumLength)
+}
+
+// newDeveloperToken returns a new prefixed token.
+func newDeveloperToken() (string, error) {
+	max := big.NewInt(int64(len(base62)))
+	random := make([]byte, tokenRandomLength)
+	for i := range random {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		random[i] = base62[n.Int64()]
+	}
+
+	return tokenPrefix() + string(random) + tokenChecksum(string(random)), nil
+}
+
+// validToken reports whether token is a prefixed token with a matching
+// checksum. Tokens issued before prefixes don't pass.
+func validToken(token string) bool {
+	if !tokenPattern.MatchString(token) {
+		return false
+	}
+
+	body := token[len(tokenPrefixLive):]
+	random := body[:tokenRandomLength]
+	return body[tokenRandomLength:] == tokenChecksum(random)
+}
+
+// githubKey returns the GitHub secret scanning key with the identifier,
+// refetching the keys if it isn't known yet. The keys are fetched outside
+// the lock, and at most once a minute.
+func githubKey(id string) (*ecdsa.PublicKey, error) {
+	githubKeys.Lock()
+	if key, ok := githubKeys.keys[id]; ok {
+		githubKeys.Unlock()
+		return key, nil
+	}
+	if time.Since(githubKeys.fetchedAt) < time.Minute {
+		githubKeys.Unlock()
+		return nil, errors.New("unknown key " + id)
+	}
+	githubKeys.fetchedAt = time.Now()
+	githubKeys.Unlock()
+
+	keys, err := fetchGitHubKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	githubKeys.Lock()
+	githubKeys.keys = keys
+	githubKeys.Unlock()
+
+	if key, ok := keys[id]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown key " + id)
+}
+
+// fetchGitHubKeys reads GitHub's secret scanning keys by identifier.
+func fetchGitHubKeys() (map[string]*ecdsa.PublicKey, error) {
+	res, err := githubHTTPClient.Get(githubKeysURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to fetch github keys: " + res.Status)
+	}
+
+	var body struct {
+		PublicKeys []struct {
+			ID  string `json:"key_identifier"`
+			Key string `json:"key"`
+		} `json:"public_keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*ecdsa.PublicKey{}
+	for _, k := range body.PublicKeys {
+		block, _ := pem.Decode([]byte(k.Key))
+		if block == nil {
+			continue
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if ecKey, ok := pub.(*ecdsa.PublicKey); err == nil && ok {
+			keys[k.ID] = ecKey
+		}
+	}
+
+	return keys, nil
+}
+
+// verifyGitHubSignature checks a secret scanning report was signed by GitHub.
+func verifyGitHubSignature(payload []byte, keyID, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	key, err := githubKey(keyID)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(key, digest[:], sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// revokeLeakedToken replaces a leaked token and tells the developer where
+// it was found. It returns false if the token isn't a developer's.
+func revokeLeakedToken(req *http.Request, token, source, url string) (bool, error) {
+	if !validToken(token) {
+		return false, nil
+	}
+
+	tenant := tenantForToken(req, token)
+	d, err := tenant.GetDeveloper(bson.M{"token": token})
+	if err != nil {
+		return false, nil
+	}
+
+	replacement, err := newDeveloperToken()
+	if err != nil {
+		return true, err
+	}
+	if err := tenant.UpdateDeveloper(bson.M{"_id": d.ID, "token": token}, bson.M{"token": replacement}); err != nil {
+		return true, err
+	}
+	entitlements.invalidate(token)
+
+	track("token.leaked", d, map[string]interface{}{"source": source})
+	securityEvent(req, d, securityTokenRevoked, source, url, map[string]interface{}{
+		"source": source,
+		"url":    url,
+	})
+
+	return true, nil
+}
+
+// POST /secret-scanning/github, Revokes tokens GitHub found in public repos
+func GitHubSecretScanningHandler(rw http.ResponseWriter, req *http.Request) {
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, 1<<20))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = verifyGitHubSignature(payload,
+		req.Header.Get("Github-Public-Key-Identifier"), req.Header.Get("Github-Public-Key-Signature"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var matches []struct {
+		Token  string `json:"token"`
+		Type   string `json:"type"`
+		URL    string `json:"url"`
+		Source string `json:"source"`
+	}
+	if err := json.Unmarshal(payload, &matches); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type feedback struct {
+		Token string `json:"token_raw"`
+		Type  string `json:"token_type"`
+		Label string `json:"label"`
+	}
+	results := []*feedback{}
+	for _, m := range matches {
+		revoked, err := revokeLeakedToken(req, m.Token, "github "+m.Source, m.URL)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		label := "false_positive"
+		if revoked {
+			label = "true_positive"
+		}
+		results = append(results, &feedback{Token: m.Token, Type: m.Type, Label: label})
+	}
+
+	renderer.JSON(rw, http.StatusOK, results)
+}
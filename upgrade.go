@@ -0,0 +1,302 @@
+// Copyright 2014 Bowery, Inc.
+// Contains graceful shutdown and zero downtime upgrades. SIGTERM and SIGINT
+// stop accepting connections and give in-flight requests SHUTDOWN_TIMEOUT to
+// finish. SIGHUP upgrades to the binary on disk without closing the
+// listening sockets: a bridge process is started on copies of them, the
+// old process drains once the bridge is serving, then execs the new binary
+// in its place on the same sockets and stops the bridge. Connections wait in
+// the socket's backlog rather than being refused, and the pid stays the
+// same so upstart keeps tracking it.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Variables the sockets are handed over in. Listeners are addr=fd pairs,
+// comma separated.
+const (
+	listenersEnv = "BROOME_LISTENERS"
+	readyFDEnv   = "BROOME_READY_FD"
+	bridgePIDEnv = "BROOME_BRIDGE_PID"
+)
+
+// How long a bridge has to start serving before the upgrade is abandoned.
+const upgradeTimeout = time.Minute
+
+var (
+	// executable is the binary upgrades run, resolved before anything can
+	// change directory.
+	executable, _ = filepath.Abs(os.Args[0])
+
+	// processStdout is stdout before it's redacted, bridges get it so their
+	// output doesn't go through a pipe that's gone once this process execs.
+	processStdout = os.Stdout
+
+	listenersMutex sync.Mutex
+	listeners      = map[string]*net.TCPListener{}
+)
+
+// servedServer is a server and how it's served.
+type servedServer struct {
+	srv       *http.Server
+	tls       bool
+	cert, key string
+}
+
+// inheritedListeners returns the sockets handed over by the previous
+// process, by address.
+func inheritedListeners() map[string]int {
+	fds := map[string]int{}
+	for _, pair := range strings.Split(os.Getenv(listenersEnv), ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			continue
+		}
+		if fd, err := strconv.Atoi(pair[i+1:]); err == nil {
+			fds[pair[:i]] = fd
+		}
+	}
+
+	return fds
+}
+
+// listenOn returns a listener for addr, the one handed over if there is
+// one.
+func listenOn(addr string) (*net.TCPListener, error) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	var l net.Listener
+	var err error
+	if fd, ok := inheritedListeners()[addr]; ok {
+		f := os.NewFile(uintptr(fd), addr)
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tcp, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, errors.New(addr + " isn't a TCP socket")
+	}
+	listeners[addr] = tcp
+	return tcp, nil
+}
+
+// serve serves each server until a signal shuts them down.
+func serve(servers ...*servedServer) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		l, err := listenOn(s.srv.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func(s *servedServer) {
+			if s.tls {
+				errs <- s.srv.ServeTLS(l, s.cert, s.key)
+				return
+			}
+			errs <- s.srv.Serve(l)
+		}(s)
+	}
+	handedOver()
+
+	drained := make(chan struct{})
+	go handleSignals(servers, drained)
+	err := <-errs
+	if err == http.ErrServerClosed {
+		<-drained
+		return nil
+	}
+
+	return err
+}
+
+// handedOver tells whoever handed the sockets over that this process is
+// serving: the process upgrading through this bridge, or the bridge once
+// the upgraded binary is running.
+func handedOver() {
+	if fd, err := strconv.Atoi(os.Getenv(readyFDEnv)); err == nil {
+		ready := os.NewFile(uintptr(fd), "ready")
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+
+	if pid, err := strconv.Atoi(os.Getenv(bridgePIDEnv)); err == nil {
+		if bridge, err := os.FindProcess(pid); err == nil {
+			bridge.Signal(syscall.SIGTERM)
+			go bridge.Wait()
+		}
+	}
+
+	for _, variable := range []string{listenersEnv, readyFDEnv, bridgePIDEnv} {
+		os.Unsetenv(variable)
+	}
+}
+
+// handleSignals shuts down on SIGTERM and SIGINT, closing drained once
+// requests finish, and upgrades on SIGHUP.
+func handleSignals(servers []*servedServer, drained chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if err := upgrade(servers); err != nil {
+				fmt.Println("unable to upgrade:", err)
+			}
+			continue
+		}
+
+		fmt.Println("received", sig, "draining requests before shutting down")
+		shutdown(servers)
+		close(drained)
+		return
+	}
+}
+
+// shutdown stops the servers accepting connections and waits for their
+// requests to finish, up to the shutdown timeout.
+func shutdown(servers []*servedServer) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpConfig.ShutdownTimeout)
+	defer cancel()
+
+	for _, s := range servers {
+		if err := s.srv.Shutdown(ctx); err != nil {
+			fmt.Println("unable to drain", s.srv.Addr, err)
+		}
+	}
+}
+
+// handoverEnv returns env without any previous handover, plus the
+// listeners at their fds.
+func handoverEnv(env []string, fds map[string]int) []string {
+	clean := []string{}
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "BROOME_") {
+			clean = append(clean, kv)
+		}
+	}
+
+	pairs := []string{}
+	for addr, fd := range fds {
+		pairs = append(pairs, addr+"="+strconv.Itoa(fd))
+	}
+
+	return append(clean, listenersEnv+"="+strings.Join(pairs, ","))
+}
+
+// upgrade hands the sockets to a bridge, drains, then execs the binary on
+// disk in place. Until the drain starts a failed upgrade leaves this
+// process serving.
+func upgrade(servers []*servedServer) error {
+	listenersMutex.Lock()
+	addrs := []string{}
+	files := []*os.File{}
+	for addr, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			listenersMutex.Unlock()
+			return err
+		}
+		addrs = append(addrs, addr)
+		files = append(files, f)
+	}
+	listenersMutex.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	bridge, err := startBridge(addrs, files)
+	if err != nil {
+		return err
+	}
+	fmt.Println("bridge", bridge.Process.Pid, "is serving, draining requests before upgrading")
+	shutdown(servers)
+
+	// The copies of the sockets are kept open across the exec, at the fds
+	// they have here.
+	fds := map[string]int{}
+	for i, f := range files {
+		fd := f.Fd()
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0); errno != 0 {
+			err = errno
+		}
+		fds[addrs[i]] = int(fd)
+	}
+	if err == nil {
+		env := append(handoverEnv(os.Environ(), fds), bridgePIDEnv+"="+strconv.Itoa(bridge.Process.Pid))
+		err = syscall.Exec(executable, os.Args, env)
+	}
+
+	// The bridge is still serving, so this process lives as long as it.
+	fmt.Println("unable to exec", executable, err, "leaving the bridge serving")
+	bridge.Wait()
+	os.Exit(1)
+	return err
+}
+
+// startBridge starts the binary on disk serving on copies of the sockets,
+// returning once it's serving.
+func startBridge(addrs []string, files []*os.File) (*exec.Cmd, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	fds := map[string]int{}
+	for i, addr := range addrs {
+		fds[addr] = 3 + i
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = processStdout, os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), w)
+	cmd.Env = append(handoverEnv(os.Environ(), fds), readyFDEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := r.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("bridge didn't start serving in " + upgradeTimeout.String())
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("bridge failed: %s", err)
+	}
+
+	return cmd, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routes for client version compatibility.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+)
+
+// Headers clients use to report their version and channel.
+const (
+	versionHeader = "X-Bowery-Version"
+	channelHeader = "X-Bowery-Channel"
+)
+
+// compareVersions compares two dotted versions like "3.1.2", returning -1, 0
+// or 1. Missing components count as zero and non numeric suffixes such as
+// "-beta" are ignored.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = versionPart(as[i])
+		}
+		if i < len(bs) {
+			y = versionPart(bs[i])
+		}
+
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func versionPart(part string) int {
+	if idx := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' }); idx >= 0 {
+		part = part[:idx]
+	}
+
+	n, _ := strconv.Atoi(part)
+	return n
+}
+
+// clientVersion returns the version and channel the client reported.
+func clientVersion(req *http.Request) (string, string) {
+	version := req.Header.Get(versionHeader)
+	if version == "" {
+		version = req.FormValue("version")
+	}
+
+	channel := req.Header.Get(channelHeader)
+	if channel == "" {
+		channel = req.FormValue("channel")
+	}
+	if !db.ValidChannel(channel) {
+		channel = db.ChannelStable
+	}
+
+	return version, channel
+}
+
+// upgradeRequired reports whether version must upgrade under the policy.
+// Clients that don't report a version are never forced to upgrade.
+func upgradeRequired(p *db.VersionPolicy, version string) bool {
+	if version == "" {
+		return false
+	}
+
+	for _, blocked := range p.Blocked {
+		if compareVersions(version, blocked) == 0 {
+			return true
+		}
+	}
+
+	return p.Minimum != "" && compareVersions(version, p.Minimum) < 0
+}
+
+// requestUpgradeRequired checks the version reported on req against its
+// channel's policy.
+func requestUpgradeRequired(req *http.Request) bool {
+	version, channel := clientVersion(req)
+	p, err := db.GetVersionPolicy(channel)
+	if err != nil {
+		return false
+	}
+
+	return upgradeRequired(p, version)
+}
+
+// GET /versions, Returns the version policy for the client's channel
+func VersionsHandler(rw http.ResponseWriter, req *http.Request) {
+	version, channel := clientVersion(req)
+	p, err := db.GetVersionPolicy(channel)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	available := version != "" && p.Latest != "" && compareVersions(version, p.Latest) < 0
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":           requests.StatusFound,
+		"policy":           p,
+		"upgradeRequired":  upgradeRequired(p, version),
+		"upgradeAvailable": available,
+	})
+}
+
+// PUT /admin/versions/{channel}, Edits the version policy for a channel
+func UpdateVersionPolicyHandler(rw http.ResponseWriter, req *http.Request) {
+	channel := mux.Vars(req)["channel"]
+	if !db.ValidChannel(channel) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid channel",
+		})
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	p, err := db.GetVersionPolicy(channel)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if val, ok := req.Form["minimum"]; ok {
+		p.Minimum = strings.TrimSpace(val[0])
+	}
+	if val, ok := req.Form["latest"]; ok {
+		p.Latest = strings.TrimSpace(val[0])
+	}
+	if _, ok := req.Form["blocked"]; ok {
+		p.Blocked = []string{}
+		for _, v := range strings.Split(req.FormValue("blocked"), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				p.Blocked = append(p.Blocked, v)
+			}
+		}
+	}
+
+	if err := db.SaveVersionPolicy(p); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"policy": p,
+	})
+}
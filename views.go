@@ -0,0 +1,353 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the admin developer list's filters, sorting and columns, and
+// saved views of them. Views are shared as /admin/developers?view={slug} and
+// each admin can pick one the list opens with.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// listColumns are the columns the developer list can show, by name.
+var listColumns = map[string]struct {
+	Label string
+	Value func(r *db.DeveloperRow) string
+}{
+	"name":  {"Name", func(r *db.DeveloperRow) string { return r.Name }},
+	"email": {"Email", func(r *db.DeveloperRow) string { return r.Email }},
+	"plan": {"Plan", func(r *db.DeveloperRow) string {
+		if r.Plan != "" {
+			return r.Plan
+		}
+		if r.IsPaid {
+			return "paid"
+		}
+		return "free"
+	}},
+	"paid": {"Paid", func(r *db.DeveloperRow) string { return strconv.FormatBool(r.IsPaid) }},
+	"createdAt": {"Signed Up", func(r *db.DeveloperRow) string {
+		return time.Unix(0, r.CreatedAt*int64(time.Millisecond)).UTC().Format("2006-01-02")
+	}},
+	"expiration": {"Expires", func(r *db.DeveloperRow) string {
+		if r.Expiration.IsZero() {
+			return ""
+		}
+		return r.Expiration.UTC().Format("2006-01-02")
+	}},
+	"lifecycle": {"Lifecycle", func(r *db.DeveloperRow) string { return r.Lifecycle }},
+	"tags":      {"Tags", func(r *db.DeveloperRow) string { return strings.Join(r.Tags, ", ") }},
+}
+
+// defaultListColumns are shown when a list doesn't pick its own.
+var defaultListColumns = []string{"name", "email", "plan", "createdAt"}
+
+// listSorts are the fields the developer list can be sorted by.
+var listSorts = map[string]bool{"name": true, "email": true, "createdAt": true, "expiration": true}
+
+var viewSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,59}$`)
+
+// listConfigFromForm reads a list configuration from query parameters,
+// with columns comma separated.
+func listConfigFromForm(form url.Values) *db.ListConfig {
+	c := &db.ListConfig{
+		Search:    form.Get("search"),
+		Tag:       form.Get("tag"),
+		Plan:      form.Get("plan"),
+		Lifecycle: form.Get("lifecycle"),
+		Segment:   form.Get("segment"),
+		Sort:      form.Get("sort"),
+	}
+	if columns := form.Get("columns"); columns != "" {
+		c.Columns = strings.Split(columns, ",")
+	}
+	return c
+}
+
+// hasListParams reports whether the query sets any of the list's options,
+// so the admin's default view isn't applied over them.
+func hasListParams(form url.Values) bool {
+	for _, key := range []string{"search", "tag", "plan", "lifecycle", "segment", "sort", "columns"} {
+		if _, ok := form[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeListConfig checks a list configuration and fills in defaults.
+func normalizeListConfig(c *db.ListConfig) error {
+	c.Search = strings.TrimSpace(c.Search)
+	c.Tag = strings.ToLower(strings.TrimSpace(c.Tag))
+	if c.Plan != "" && c.Plan != "free" && c.Plan != "paid" {
+		return errors.New("plan must be free or paid")
+	}
+	if c.Lifecycle != "" && !db.ValidLifecycle(c.Lifecycle) {
+		return errors.New("lifecycle must be one of " + strings.Join(db.LifecycleStates, ", "))
+	}
+	if !listSorts[strings.TrimPrefix(c.Sort, "-")] {
+		if c.Sort != "" {
+			return errors.New("sort must be one of name, email, createdAt or expiration, prefixed with - for descending")
+		}
+		c.Sort = "name"
+	}
+
+	columns := []string{}
+	for _, column := range c.Columns {
+		column = strings.TrimSpace(column)
+		if _, ok := listColumns[column]; !ok {
+			return fmt.Errorf("unknown column %q", column)
+		}
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		columns = defaultListColumns
+	}
+	c.Columns = columns
+
+	return nil
+}
+
+// listQuery returns the developer query for a list configuration.
+func listQuery(c *db.ListConfig) (bson.M, error) {
+	query := bson.M{}
+	if c.Search != "" {
+		// Sealed names and emails can't be searched, but a whole email
+		// still matches its hash. Emails are hashed as they were entered,
+		// so the search is tried as typed and lower cased.
+		pattern := bson.RegEx{Pattern: regexp.QuoteMeta(c.Search), Options: "i"}
+		query["$or"] = []bson.M{{"name": pattern}, {"email": pattern}}
+		email := strings.TrimSpace(c.Search)
+		if hash := db.EmailHash(email); hash != "" {
+			hashes := []string{hash, db.EmailHash(strings.ToLower(email))}
+			query["$or"] = append(query["$or"].([]bson.M), bson.M{"emailHash": bson.M{"$in": hashes}})
+		}
+	}
+	if c.Tag != "" {
+		query["tags"] = c.Tag
+	}
+	if c.Plan != "" {
+		query["isPaid"] = c.Plan == "paid"
+	}
+	if c.Lifecycle != "" {
+		query["lifecycle"] = c.Lifecycle
+	}
+	if c.Segment != "" {
+		ids, err := segmentMemberIDs(c.Segment)
+		if err != nil {
+			return nil, err
+		}
+		query["_id"] = bson.M{"$in": ids}
+	}
+
+	return query, nil
+}
+
+// listURL returns the shareable url of a list configuration.
+func listURL(c *db.ListConfig) string {
+	form := url.Values{}
+	for key, value := range map[string]string{
+		"search":    c.Search,
+		"tag":       c.Tag,
+		"plan":      c.Plan,
+		"lifecycle": c.Lifecycle,
+		"segment":   c.Segment,
+		"sort":      c.Sort,
+		"columns":   strings.Join(c.Columns, ","),
+	} {
+		if value != "" {
+			form.Set(key, value)
+		}
+	}
+
+	return "/admin/developers?" + form.Encode()
+}
+
+// developerList resolves the list a request asks for: a view by slug, the
+// options in the query, or the admin's default view if there are neither.
+func developerList(req *http.Request) (*db.ListConfig, *db.AdminView, error) {
+	slug := req.FormValue("view")
+	if slug == "" && !hasListParams(req.Form) {
+		if dev, err := currentDeveloper(req); err == nil {
+			if slug, err = db.GetDefaultAdminView(dev.ID); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if slug != "" {
+		v, err := db.GetAdminView(slug)
+		if err != nil {
+			return nil, nil, err
+		}
+		c := v.ListConfig
+		return &c, v, normalizeListConfig(&c)
+	}
+
+	c := listConfigFromForm(req.Form)
+	return c, nil, normalizeListConfig(c)
+}
+
+// viewFromRoute returns the view in the route, writing the error response
+// if there isn't one.
+func viewFromRoute(rw http.ResponseWriter, req *http.Request) (*db.AdminView, bool) {
+	v, err := db.GetAdminView(mux.Vars(req)["slug"])
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return nil, false
+	}
+
+	return v, true
+}
+
+// GET /admin/views, Lists saved developer list views
+func AdminViewsHandler(rw http.ResponseWriter, req *http.Request) {
+	vs, err := db.GetAdminViews()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusFound,
+		"views":  vs,
+	})
+}
+
+// PUT /admin/views/{slug}, Creates or replaces a developer list view
+func UpdateViewHandler(rw http.ResponseWriter, req *http.Request) {
+	v := &db.AdminView{}
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	v.Slug = mux.Vars(req)["slug"]
+	v.Name = strings.TrimSpace(v.Name)
+
+	err := normalizeListConfig(&v.ListConfig)
+	if err == nil && (!viewSlugPattern.MatchString(v.Slug) || v.Slug == "default") {
+		err = errors.New("slug must be lower case letters, numbers and dashes, other than default")
+	}
+	if err == nil && v.Name == "" {
+		err = errors.New("name is required")
+	}
+	if err == nil && v.Segment != "" {
+		if _, serr := db.GetSegment(v.Segment); serr != nil {
+			err = errors.New("no saved segment " + v.Segment)
+		}
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if dev, err := currentDeveloper(req); err == nil {
+		v.UpdatedBy = dev.Email
+	}
+	if err := db.SaveAdminView(v); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	audit(req, "view.saved", v.UpdatedBy, v.Slug)
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"view":   v,
+		"url":    "/admin/developers?view=" + v.Slug,
+	})
+}
+
+// DELETE /admin/views/{slug}, Removes a developer list view
+func DeleteViewHandler(rw http.ResponseWriter, req *http.Request) {
+	v, ok := viewFromRoute(rw, req)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteAdminView(v.Slug); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "view.deleted", actor, v.Slug)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// PUT /admin/views/default, Sets the view the admin's developer list opens with, an empty slug clears it
+func DefaultViewHandler(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Slug string `json:"slug"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	dev, err := currentDeveloper(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusUnauthorized, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if body.Slug != "" {
+		_, err = db.GetAdminView(body.Slug)
+	}
+	if err == nil {
+		err = db.SetDefaultAdminView(dev.ID, body.Slug)
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+		"view":   body.Slug,
+	})
+}
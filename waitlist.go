@@ -0,0 +1,132 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the private beta signup restriction. With signupDomains set in
+// the settings only emails at those domains can sign up, everyone else is
+// added to the waitlist.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"labix.org/v2/mgo/bson"
+)
+
+// Status returned for signups added to the waitlist.
+const statusWaitlisted = "waitlisted"
+
+// emailDomain returns the lower cased domain of an email address.
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(email[at+1:]))
+}
+
+// signupDomainAllowed reports whether email may sign up, matching the
+// domains and their subdomains. No domains lets everyone sign up.
+func signupDomainAllowed(email string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+
+	domain := emailDomain(email)
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitlistSignup adds a signup outside the allowed domains to the waitlist.
+// Form posts get a page explaining it, everyone else a pending response
+// with the same message.
+func waitlistSignup(rw http.ResponseWriter, req *http.Request, name, email string) {
+	w := &db.WaitlistEntry{
+		Email:  email,
+		Name:   name,
+		Domain: emailDomain(email),
+		IP:     clientIP(req),
+	}
+	if err := db.JoinWaitlist(w); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "signup.waitlisted", w.Email, "")
+
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		if err := RenderTemplate(rw, "waitlist", map[string]string{
+			"Name":  strings.Split(name, " ")[0],
+			"Email": w.Email,
+		}); err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		}
+		return
+	}
+
+	renderer.JSON(rw, http.StatusAccepted, map[string]string{
+		"status": statusWaitlisted,
+		"error":  "We're in a private beta, so we've added you to the waitlist and will email you when a spot opens up.",
+	})
+}
+
+// GET /admin/waitlist, Lists the waitlist oldest first, ?domain= filters
+func AdminWaitlistHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	if domain := req.URL.Query().Get("domain"); domain != "" {
+		query["domain"] = strings.ToLower(domain)
+	}
+
+	ws, err := db.GetWaitlist(query, 1000)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"domains":  getSettings().SignupDomains,
+		"waitlist": ws,
+	})
+}
+
+// DELETE /admin/waitlist?email=, Removes someone from the waitlist
+func RemoveWaitlistHandler(rw http.ResponseWriter, req *http.Request) {
+	email := req.URL.Query().Get("email")
+	if err := db.RemoveFromWaitlist(email); err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "waitlist.removed", actor, email)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// leaveWaitlist removes a new developer from the waitlist, e.g. once their
+// domain is allowed. Failures other than not being on it are printed.
+func leaveWaitlist(email string) {
+	if err := db.RemoveFromWaitlist(email); err != nil && err != db.ErrNotFound {
+		fmt.Println("unable to remove", email, "from the waitlist", err)
+	}
+}
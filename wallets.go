@@ -0,0 +1,210 @@
+// Copyright 2014 Bowery, Inc.
+// Contains Apple Pay and Google Pay. The hosted payment page offers whichever
+// wallet the browser supports through Stripe's payment request button, and
+// domains are verified with Apple through Stripe before they can show it.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Where Apple looks for the domain association file.
+const applePayAssociationPath = "/.well-known/apple-developer-merchantid-domain-association"
+
+// createOnSessionIntent creates a PaymentIntent for the developer to confirm
+// in the browser, saving the card for renewals.
+func createOnSessionIntent(ctx context.Context, d *schemas.Developer, customer string, plan *db.Plan) (*paymentIntent, error) {
+	params := url.Values{
+		"amount":                 {strconv.FormatInt(plan.Amount, 10)},
+		"currency":               {plan.Currency},
+		"description":            {plan.Description},
+		"customer":               {customer},
+		"payment_method_types[]": {"card"},
+		"setup_future_usage":     {"off_session"},
+		"metadata[developerId]":  {d.ID.Hex()},
+		"metadata[plan]":         {plan.Slug},
+	}
+
+	pi := &paymentIntent{}
+	key := "pay-" + d.ID.Hex() + "-" + bson.NewObjectId().Hex()
+	return pi, callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/payment_intents", params, key, pi)
+	})
+}
+
+// walletFor returns the wallet a payment method's card came from, if any.
+func walletFor(ctx context.Context, paymentMethod string) (string, error) {
+	var pm struct {
+		Card struct {
+			Wallet *struct {
+				Type string `json:"type"`
+			} `json:"wallet"`
+		} `json:"card"`
+	}
+
+	err := callStripe(ctx, func() error {
+		return stripeRequest(ctx, "GET", "/payment_methods/"+url.PathEscape(paymentMethod), url.Values{}, "", &pm)
+	})
+	if err != nil || pm.Card.Wallet == nil {
+		return "", err
+	}
+
+	return pm.Card.Wallet.Type, nil
+}
+
+// recordWallet saves the wallet a successful payment was made with.
+func recordWallet(p *db.Payment, pi *paymentIntent) {
+	if pi.PaymentMethod == "" || p.Wallet != "" {
+		return
+	}
+
+	wallet, err := walletFor(context.Background(), pi.PaymentMethod)
+	if err == nil && wallet != "" {
+		err = db.UpdatePayment(p.ID, bson.M{"wallet": wallet})
+	}
+	if err != nil {
+		fmt.Println("unable to record wallet for payment", p.ID, err)
+	}
+}
+
+// registerWalletDomain verifies a domain with Apple Pay through Stripe, which
+// also enables it for Google Pay. Registering a domain twice is harmless.
+func registerWalletDomain(ctx context.Context, domain string) error {
+	var res struct {
+		ID string `json:"id"`
+	}
+
+	return callStripe(ctx, func() error {
+		return stripeRequest(ctx, "POST", "/apple_pay/domains", url.Values{"domain_name": {domain}}, "wallet-domain-"+domain, &res)
+	})
+}
+
+// registerWalletDomains registers each domain, printing failures.
+func registerWalletDomains(domains []string) {
+	for _, domain := range domains {
+		if err := registerWalletDomain(context.Background(), domain); err != nil {
+			fmt.Println("unable to register wallet domain", domain, err)
+		}
+	}
+}
+
+// GET /pay/{token}, Payment page offering Apple Pay or Google Pay, with the hosted checkout for cards
+func PayHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": "Invalid Token"})
+		return
+	}
+
+	plan, err := db.GetPlan(db.PlanBowery)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	customer, err := createStripeCustomer(req.Context(), d)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	var p *db.Payment
+	pi, err := createOnSessionIntent(req.Context(), d, customer, plan)
+	if err == nil {
+		p, err = recordPayment(d, plan, db.PaymentPurchase, db.MethodCard, pi)
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderTemplate(rw, "pay", map[string]interface{}{
+		"stripePubKey": stripePublicKey,
+		"clientSecret": pi.ClientSecret,
+		"plan":         plan,
+		"country":      os.Getenv("STRIPE_COUNTRY"),
+		"returnUrl":    paymentReturnURL(baseURL(req), d, p.ID),
+		"checkoutUrl":  "/checkout/" + d.Token,
+		"org":          orgFor(req),
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /.well-known/apple-developer-merchantid-domain-association, Apple Pay domain verification file
+func ApplePayAssociationHandler(rw http.ResponseWriter, req *http.Request) {
+	path := os.Getenv("APPLE_PAY_ASSOCIATION_FILE")
+	if path == "" {
+		path = STATIC_DIR + "/apple-developer-merchantid-domain-association"
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Write(data)
+}
+
+// GET /admin/wallets/domains, Lists domains verified for Apple Pay and Google Pay
+func WalletDomainsHandler(rw http.ResponseWriter, req *http.Request) {
+	var res struct {
+		Data []struct {
+			ID         string `json:"id"`
+			DomainName string `json:"domain_name"`
+			Livemode   bool   `json:"livemode"`
+		} `json:"data"`
+	}
+
+	err := callStripe(req.Context(), func() error {
+		return stripeRequest(req.Context(), "GET", "/apple_pay/domains?limit=100", url.Values{}, "", &res)
+	})
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadGateway, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusFound,
+		"domains": res.Data,
+	})
+}
+
+// POST /admin/wallets/domains/{domain}, Verifies a domain for Apple Pay and Google Pay
+func RegisterWalletDomainHandler(rw http.ResponseWriter, req *http.Request) {
+	domain := mux.Vars(req)["domain"]
+	if err := registerWalletDomain(req.Context(), domain); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	audit(req, "wallet.domain", actor, domain)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusCreated,
+	})
+}
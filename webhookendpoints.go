@@ -0,0 +1,631 @@
+// Copyright 2014 Bowery, Inc.
+// Contains webhook endpoints developers register for their own events.
+// Events are queued as deliveries and sent by a worker, signed like
+// Stripe's with the endpoint's secret and retried with backoff. An endpoint
+// is disabled once too many deliveries fail in a row, until the developer
+// enables it again. Endpoints can only be public urls.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/env"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+// Events endpoints can subscribe to, and the test ping.
+const (
+	eventPaymentSucceeded = "payment.succeeded"
+	eventWebhookPing      = "ping"
+)
+
+var webhookEndpointEvents = []string{eventDeveloperUpdated, eventPaymentSucceeded}
+
+const (
+	// Endpoints a developer can register.
+	webhookEndpointLimit = 5
+
+	// How long an endpoint has to respond.
+	deliveryTimeout = 10 * time.Second
+
+	// How long a worker holds a delivery while sending it.
+	deliveryLease = time.Minute
+
+	// Deliveries sent per run of the worker.
+	deliveryBatchSize = 50
+
+	// Attempts before a delivery is marked failed.
+	deliveryMaxAttempts = 6
+
+	// Failed attempts in a row, across deliveries, that disable an endpoint.
+	endpointFailureLimit = 15
+
+	// Delivery logs shown per endpoint.
+	deliveryLogLimit = 50
+
+	// Response bodies kept in the delivery log.
+	deliveryResponseLimit = 512
+)
+
+func init() {
+	schedule("webhook-deliveries", 10*time.Second, deliverWebhooks)
+	schedule("queue-developer-webhooks", 10*time.Second, queueDeveloperWebhooks)
+}
+
+// webhookPayload is the body posted to endpoints.
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// errPrivateAddress is returned dialing an endpoint that resolves to one
+// of our own networks.
+var errPrivateAddress = errors.New("endpoint resolves to a private address")
+
+// privateNetworks are the networks endpoints can't be on.
+var privateNetworks = func() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+
+	return nets
+}()
+
+// privateIP reports whether ip is on a private network.
+func privateIP(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return ip.IsUnspecified() || ip.IsMulticast()
+}
+
+// deliveryClient sends deliveries, refusing to connect to private addresses
+// whatever the endpoint's host resolves to when it's sent.
+var deliveryClient = &http.Client{
+	Timeout: deliveryTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: deliveryTimeout,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+					return errPrivateAddress
+				}
+
+				return nil
+			},
+		}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// validateEndpoint checks an endpoint's url and events. Urls must be https
+// in production.
+func validateEndpoint(e *db.WebhookEndpoint) error {
+	u, err := url.Parse(e.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return errors.New("URL must be an absolute http or https url.")
+	}
+	if u.Scheme != "https" && env.Current.Production {
+		return errors.New("URL must use https.")
+	}
+	if u.User != nil {
+		return errors.New("URL can't contain credentials.")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && privateIP(ip) {
+		return errPrivateAddress
+	}
+
+	if len(e.Events) == 0 {
+		return errors.New("Events Required.")
+	}
+	for _, event := range e.Events {
+		if !containsString(webhookEndpointEvents, event) {
+			return errors.New("Unknown event " + event + ".")
+		}
+	}
+
+	return nil
+}
+
+// newEndpointSecret returns a secret for signing deliveries.
+func newEndpointSecret() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return "whsec_" + hex.EncodeToString(secret), nil
+}
+
+// endpointSignature returns the Broome-Signature header for a payload sent
+// at t.
+func endpointSignature(secret string, t time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + stripeSignature(secret, timestamp, payload)
+}
+
+// queueWebhookEvent queues an event for the endpoints of the developers
+// subscribed to it. Events already queued for an endpoint are skipped, so
+// an event can be queued again after a failure.
+func queueWebhookEvent(event, id string, occurredAt time.Time, data map[string]interface{}, developerIDs ...bson.ObjectId) error {
+	es, err := db.GetSubscribedEndpoints(event, developerIDs)
+	if err != nil {
+		return err
+	}
+
+	return queueDeliveries(es, event, id, occurredAt, data)
+}
+
+// queueDeliveries queues an event for each endpoint.
+func queueDeliveries(es []*db.WebhookEndpoint, event, id string, occurredAt time.Time, data map[string]interface{}) error {
+	if len(es) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(&webhookPayload{ID: id, Type: event, CreatedAt: occurredAt, Data: data})
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		err := db.SaveWebhookDelivery(&db.WebhookDelivery{
+			EndpointID:  e.ID,
+			DeveloperID: e.DeveloperID,
+			EventID:     id,
+			Event:       event,
+			Payload:     string(body),
+		})
+		if err != nil && err != db.ErrDuplicate {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// queuePaymentSucceeded queues the payment.succeeded event for a payment.
+func queuePaymentSucceeded(p *db.Payment) {
+	paid := *p
+	paid.Status = db.PaymentSucceeded
+	err := queueWebhookEvent(eventPaymentSucceeded, p.ID+":"+eventPaymentSucceeded, time.Now(), map[string]interface{}{
+		"payment": &paid,
+	}, p.DeveloperID)
+	if err != nil {
+		fmt.Println("unable to queue webhooks for payment", p.ID, err)
+	}
+}
+
+// queueDeveloperWebhooks queues developer.updated events for the developer
+// versions saved since the last run. The first run starts from now rather
+// than sending every past change.
+func queueDeveloperWebhooks() error {
+	cursor, err := db.GetBusCursor("webhooks")
+	if err != nil {
+		return err
+	}
+	before := time.Now().Add(-busVersionLag)
+	if cursor.After == "" {
+		cursor.After = bson.NewObjectIdWithTime(before)
+		return db.SaveBusCursor(cursor)
+	}
+
+	for i := 0; i < busMaxBatches; i++ {
+		vs, err := db.GetDeveloperVersionsAfter(cursor.After, before, busBatchSize)
+		if err != nil || len(vs) == 0 {
+			return err
+		}
+
+		// Only developers with endpoints need their previous versions.
+		ids := []bson.ObjectId{}
+		for _, v := range vs {
+			ids = append(ids, v.DeveloperID)
+		}
+		es, err := db.GetSubscribedEndpoints(eventDeveloperUpdated, ids)
+		if err != nil {
+			return err
+		}
+		subscribed := map[bson.ObjectId]bool{}
+		for _, e := range es {
+			subscribed[e.DeveloperID] = true
+		}
+
+		for _, v := range vs {
+			if !subscribed[v.DeveloperID] {
+				continue
+			}
+			prev, err := db.GetPreviousDeveloperVersion(v)
+			if err == db.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, e := range versionEvents(v, prev) {
+				if e.Type != eventDeveloperUpdated {
+					continue
+				}
+
+				err := queueWebhookEvent(e.Type, e.ID, e.OccurredAt, map[string]interface{}{
+					"developer": e.Developer,
+					"changed":   e.Changed,
+				}, v.DeveloperID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		cursor.After = vs[len(vs)-1].ID
+		if err := db.SaveBusCursor(cursor); err != nil || len(vs) < busBatchSize {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendDelivery posts a delivery to its endpoint, returning the response's
+// status code.
+func sendDelivery(e *db.WebhookEndpoint, d *db.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	payload := []byte(d.Payload)
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Broome-Webhooks/1.0")
+	req.Header.Set("Broome-Event", d.Event)
+	req.Header.Set("Broome-Delivery", d.ID.Hex())
+	req.Header.Set("Broome-Signature", endpointSignature(e.Secret, time.Now(), payload))
+
+	res, err := deliveryClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, deliveryResponseLimit))
+		return res.StatusCode, fmt.Errorf("endpoint responded %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+
+	return res.StatusCode, nil
+}
+
+// deliveryBackoff returns the wait before retrying a delivery.
+func deliveryBackoff(attempts int) time.Duration {
+	return time.Minute << uint(attempts)
+}
+
+// attemptDelivery sends a claimed delivery and records the outcome. Pings
+// aren't retried or counted against the endpoint, so a broken endpoint can
+// be tested before it's enabled again.
+func attemptDelivery(e *db.WebhookEndpoint, d *db.WebhookDelivery) error {
+	start := time.Now()
+	code, err := sendDelivery(e, d)
+	d.Attempts++
+	d.HTTPCode = code
+	d.Millis = int64(time.Since(start) / time.Millisecond)
+
+	update := bson.M{"attempts": d.Attempts, "httpCode": code, "millis": d.Millis}
+	if err == nil {
+		d.Status, d.DeliveredAt, d.LastError = db.DeliverySucceeded, time.Now(), ""
+		update["status"], update["deliveredAt"], update["lastError"] = d.Status, d.DeliveredAt, ""
+		if d.Event != eventWebhookPing && e.Failures > 0 {
+			if err := db.ResetEndpointFailures(e.ID); err != nil {
+				fmt.Println("unable to reset failures for endpoint", e.ID.Hex(), err)
+			}
+		}
+
+		return db.UpdateWebhookDelivery(d.ID, update)
+	}
+
+	d.LastError = redactString(err.Error())
+	update["lastError"] = d.LastError
+	d.Status = db.DeliveryPending
+	if d.Event == eventWebhookPing || d.Attempts >= deliveryMaxAttempts {
+		d.Status = db.DeliveryFailed
+	} else {
+		d.NextAttemptAt = time.Now().Add(deliveryBackoff(d.Attempts))
+		update["nextAttemptAt"] = d.NextAttemptAt
+	}
+	update["status"] = d.Status
+	if err := db.UpdateWebhookDelivery(d.ID, update); err != nil {
+		return err
+	}
+	if d.Event == eventWebhookPing {
+		return nil
+	}
+
+	disabled, err := db.AddEndpointFailure(e.ID, endpointFailureLimit, d.LastError)
+	if disabled {
+		fmt.Println("disabled webhook endpoint", e.ID.Hex(), "after", endpointFailureLimit, "failures")
+		if dev, err := db.GetDeveloper(bson.M{"_id": e.DeveloperID}); err == nil {
+			track("webhook.disabled", dev, map[string]interface{}{"endpoint": e.ID.Hex(), "error": d.LastError})
+		}
+	}
+
+	return err
+}
+
+// deliverWebhooks sends due deliveries.
+func deliverWebhooks() error {
+	for i := 0; i < deliveryBatchSize; i++ {
+		d, err := db.ClaimWebhookDelivery(deliveryLease)
+		if err == db.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		e, err := db.GetWebhookEndpoint(d.DeveloperID, d.EndpointID)
+		if err == nil && e.Disabled {
+			err = db.ErrNotFound
+		}
+		if err == db.ErrNotFound {
+			err = db.UpdateWebhookDelivery(d.ID, bson.M{"status": db.DeliveryDiscarded})
+		} else if err == nil {
+			err = attemptDelivery(e, d)
+		}
+		if err != nil {
+			fmt.Println("unable to update webhook delivery", d.ID.Hex(), err)
+		}
+	}
+
+	return nil
+}
+
+// routeOwner returns the developer with the token in the route.
+func routeOwner(req *http.Request) (*schemas.Developer, error) {
+	d, err := tenantFor(req).GetDeveloper(bson.M{"token": mux.Vars(req)["token"]})
+	if err == db.ErrNotFound {
+		err = errors.New("Invalid Token.")
+	}
+
+	return d, err
+}
+
+// endpointFromRoute returns the owner's endpoint with the id in the route.
+func endpointFromRoute(req *http.Request) (*schemas.Developer, *db.WebhookEndpoint, error) {
+	d, err := routeOwner(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		return nil, nil, db.ErrNotFound
+	}
+	e, err := db.GetWebhookEndpoint(d.ID, bson.ObjectIdHex(id))
+	return d, e, err
+}
+
+// renderEndpointError renders an error looking up an endpoint.
+func renderEndpointError(rw http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if err == db.ErrNotFound {
+		status = http.StatusNotFound
+	}
+
+	renderer.JSON(rw, status, map[string]string{
+		"status": requests.StatusFailed,
+		"error":  err.Error(),
+	})
+}
+
+// POST /developers/{token}/webhooks, Registers a webhook endpoint, returning its signing secret
+func CreateWebhookEndpointHandler(rw http.ResponseWriter, req *http.Request) {
+	var body db.WebhookEndpoint
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	d, err := routeOwner(req)
+	if err != nil {
+		renderEndpointError(rw, err)
+		return
+	}
+
+	e := &db.WebhookEndpoint{DeveloperID: d.ID, URL: body.URL, Events: body.Events}
+	if err := validateEndpoint(e); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	count, err := db.CountWebhookEndpoints(d.ID)
+	if err == nil && count >= webhookEndpointLimit {
+		err = fmt.Errorf("Only %d webhook endpoints are allowed.", webhookEndpointLimit)
+	}
+	if err == nil {
+		e.Secret, err = newEndpointSecret()
+	}
+	if err == nil {
+		err = db.SaveWebhookEndpoint(e)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	audit(req, "webhook.create", d.Email, e.URL)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusCreated,
+		"endpoint": e,
+	})
+}
+
+// GET /developers/{token}/webhooks, Lists the developer's webhook endpoints without their secrets
+func GetWebhookEndpointsHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := routeOwner(req)
+	if err != nil {
+		renderEndpointError(rw, err)
+		return
+	}
+
+	es, err := db.GetWebhookEndpoints(d.ID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	for _, e := range es {
+		e.Secret = ""
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusFound,
+		"endpoints": es,
+		"events":    webhookEndpointEvents,
+	})
+}
+
+// DELETE /developers/{token}/webhooks/{id}, Removes a webhook endpoint
+func DeleteWebhookEndpointHandler(rw http.ResponseWriter, req *http.Request) {
+	d, e, err := endpointFromRoute(req)
+	if err == nil {
+		err = db.RemoveWebhookEndpoint(d.ID, e.ID)
+	}
+	if err != nil {
+		renderEndpointError(rw, err)
+		return
+	}
+	audit(req, "webhook.delete", d.Email, e.URL)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusDeleted,
+	})
+}
+
+// POST /developers/{token}/webhooks/{id}/enable, Turns an endpoint disabled after failures back on
+func EnableWebhookEndpointHandler(rw http.ResponseWriter, req *http.Request) {
+	d, e, err := endpointFromRoute(req)
+	if err == nil {
+		err = db.EnableWebhookEndpoint(d.ID, e.ID)
+	}
+	if err != nil {
+		renderEndpointError(rw, err)
+		return
+	}
+	audit(req, "webhook.enable", d.Email, e.URL)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// POST /developers/{token}/webhooks/{id}/ping, Sends a test event to an endpoint and returns the delivery
+func PingWebhookEndpointHandler(rw http.ResponseWriter, req *http.Request) {
+	_, e, err := endpointFromRoute(req)
+	if err != nil {
+		renderEndpointError(rw, err)
+		return
+	}
+
+	id := bson.NewObjectId()
+	body, _ := json.Marshal(&webhookPayload{
+		ID:        id.Hex() + ":" + eventWebhookPing,
+		Type:      eventWebhookPing,
+		CreatedAt: time.Now(),
+		Data:      map[string]interface{}{"endpoint": e.ID},
+	})
+	d := &db.WebhookDelivery{
+		EndpointID:  e.ID,
+		DeveloperID: e.DeveloperID,
+		EventID:     id.Hex() + ":" + eventWebhookPing,
+		Event:       eventWebhookPing,
+		Payload:     string(body),
+		Status:      db.DeliveryProcessing,
+		LockedUntil: time.Now().Add(deliveryLease),
+	}
+	err = db.SaveWebhookDelivery(d)
+	if err == nil {
+		err = attemptDelivery(e, d)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusSuccess,
+		"delivery": d,
+	})
+}
+
+// GET /developers/{token}/webhooks/{id}/deliveries, Lists an endpoint's recent deliveries and their outcomes
+func WebhookDeliveriesHandler(rw http.ResponseWriter, req *http.Request) {
+	_, e, err := endpointFromRoute(req)
+	if err != nil {
+		renderEndpointError(rw, err)
+		return
+	}
+
+	ds, err := db.GetWebhookDeliveries(e.ID, deliveryLogLimit)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusFound,
+		"deliveries": ds,
+	})
+}
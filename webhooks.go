@@ -0,0 +1,368 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the record of webhooks received from providers. Every payload is
+// saved with whether it was processed, so failures can be inspected at
+// /admin/webhooks and replayed once the bug behind them is fixed. Outside
+// production admins can also simulate a provider by posting a payload of
+// their own.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/env"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// Webhooks shown on the admin page.
+	webhookPageLimit = 200
+
+	// How old a Stripe signature can be, so captured requests can't be
+	// replayed at us later.
+	stripeSignatureTolerance = 5 * time.Minute
+)
+
+// webhookProcessors apply a provider's payload, returning the events it
+// had for the record.
+var webhookProcessors = map[string]func(payload []byte) (string, error){
+	"mandrill":  processMandrillWebhook,
+	"mailchimp": processMailchimpWebhook,
+	"stripe":    processStripeWebhook,
+}
+
+// receiveWebhook records a payload and processes it, returning the record
+// and the error processing it. Recording is best effort, a payload is
+// processed even if it can't be saved.
+func receiveWebhook(provider string, payload []byte, simulated bool) (*db.Webhook, error) {
+	w := &db.Webhook{Provider: provider, Payload: string(payload), Simulated: simulated}
+	saved := true
+	if err := db.SaveWebhook(w); err != nil {
+		fmt.Println("unable to record webhook from", provider, err)
+		saved = false
+	}
+
+	events, err := webhookProcessors[provider](payload)
+	w.Events, w.Attempts, w.ProcessedAt = events, w.Attempts+1, time.Now()
+	w.Status, w.Error = db.WebhookProcessed, ""
+	if err != nil {
+		w.Status, w.Error = db.WebhookFailed, err.Error()
+	}
+	if saved {
+		if err := db.FinishWebhook(w.ID, events, err); err != nil {
+			fmt.Println("unable to record webhook", w.ID.Hex(), err)
+		}
+	}
+
+	return w, err
+}
+
+// stripeSignature signs a payload the way Stripe does, the timestamp and
+// payload joined by a dot.
+func stripeSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyStripeSignature checks a Stripe-Signature header, which has the
+// timestamp and one or more v1 signatures, against the payload.
+func verifyStripeSignature(secret, header string, payload []byte, now time.Time) bool {
+	if secret == "" {
+		return false
+	}
+
+	timestamp := ""
+	signatures := []string{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return false
+	}
+
+	expected := stripeSignature(secret, timestamp, payload)
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return true
+		}
+	}
+	return false
+}
+
+// processStripeWebhook settles the payment a PaymentIntent event is about.
+// The intent is fetched again rather than trusting the event, so events
+// arriving out of order or replayed later settle with its current state.
+func processStripeWebhook(payload []byte) (string, error) {
+	var event struct {
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID string `json:"id"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(event.Type, "payment_intent.") {
+		return event.Type, nil
+	}
+
+	p, err := db.GetPayment(event.Data.Object.ID)
+	if err == db.ErrNotFound {
+		// Not a payment broome made, e.g. one from Checkout.
+		return event.Type, nil
+	}
+	if err != nil {
+		return event.Type, err
+	}
+	open := false
+	for _, status := range db.OpenPaymentStates {
+		open = open || p.Status == status
+	}
+	if !open {
+		return event.Type, nil
+	}
+
+	// Not the request's context, Stripe hanging up or an admin leaving a
+	// replay shouldn't stop a payment settling.
+	pi, err := getPaymentIntent(context.Background(), p.ID)
+	if err == nil {
+		_, err = settlePayment(p, pi)
+	}
+	return event.Type, err
+}
+
+// POST /webhooks/stripe, Settles payments as Stripe reports changes to their intents
+func StripeWebhookHandler(rw http.ResponseWriter, req *http.Request) {
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, 1<<20))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Stripe signs with the old and new secret while one's being rolled,
+	// so either is accepted.
+	valid := false
+	for _, secret := range splitKeys(os.Getenv("STRIPE_WEBHOOK_SECRET")) {
+		if verifyStripeSignature(secret, req.Header.Get("Stripe-Signature"), payload, time.Now()) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		http.Error(rw, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := receiveWebhook("stripe", payload, false); err != nil {
+		// Stripe retries for three days, and the payment reconciler
+		// catches anything it gives up on.
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// formatWebhookPayload returns a payload for reading, indented if it's
+// JSON and a field a line if it's a form.
+func formatWebhookPayload(payload string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(payload), "", "  "); err == nil {
+		return buf.String()
+	}
+
+	form, err := url.ParseQuery(payload)
+	if err != nil || len(form) == 0 {
+		return payload
+	}
+	keys := []string{}
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := []string{}
+	for _, key := range keys {
+		for _, value := range form[key] {
+			lines = append(lines, key+" = "+value)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// webhookFromRoute returns the webhook with the id in the route.
+func webhookFromRoute(req *http.Request) (*db.Webhook, error) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		return nil, db.ErrNotFound
+	}
+
+	return db.GetWebhook(bson.ObjectIdHex(id))
+}
+
+// GET /admin/webhooks, Lists received webhooks, filtered by provider and status
+func WebhooksHandler(rw http.ResponseWriter, req *http.Request) {
+	query := bson.M{}
+	provider, status := req.FormValue("provider"), req.FormValue("status")
+	if provider != "" {
+		query["provider"] = provider
+	}
+	if status != "" {
+		query["status"] = status
+	}
+
+	ws, err := db.GetWebhooks(query, webhookPageLimit)
+	if err == nil {
+		providers := []string{}
+		for name := range webhookProcessors {
+			providers = append(providers, name)
+		}
+		sort.Strings(providers)
+
+		err = RenderAdminTemplate(rw, "webhooks", map[string]interface{}{
+			"Webhooks":  ws,
+			"Providers": providers,
+			"Provider":  provider,
+			"Status":    status,
+			"Simulate":  !env.Current.Production,
+		})
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /admin/webhooks/{id}, Shows a webhook's payload and what happened processing it
+func WebhookHandler(rw http.ResponseWriter, req *http.Request) {
+	w, err := webhookFromRoute(req)
+	if err == nil {
+		err = RenderAdminTemplate(rw, "webhook", map[string]interface{}{
+			"Webhook": w,
+			"Payload": formatWebhookPayload(w.Payload),
+		})
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// replayWebhook processes a webhook again and records the outcome.
+func replayWebhook(w *db.Webhook) (string, error) {
+	events, err := webhookProcessors[w.Provider]([]byte(w.Payload))
+	if ferr := db.FinishWebhook(w.ID, events, err); ferr != nil {
+		fmt.Println("unable to record webhook", w.ID.Hex(), ferr)
+	}
+
+	return events, err
+}
+
+// POST /admin/webhooks/{id}/replay, Processes a failed webhook again with the current code
+func ReplayWebhookHandler(rw http.ResponseWriter, req *http.Request) {
+	w, err := webhookFromRoute(req)
+	if err == nil && w.Status != db.WebhookFailed {
+		// Processed payloads aren't always safe to apply twice, e.g.
+		// Mandrill's open counts.
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "only failed webhooks can be replayed",
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, dbErrorStatus(err), map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	events, err := replayWebhook(w)
+
+	actor := ""
+	if dev, err := currentDeveloper(req); err == nil {
+		actor = dev.Email
+	}
+	outcome := db.WebhookProcessed
+	if err != nil {
+		outcome = db.WebhookFailed + ": " + err.Error()
+	}
+	audit(req, "webhook.replayed", actor, fmt.Sprintf("%s %s %s", w.Provider, w.ID.Hex(), outcome))
+
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadGateway, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+		"events": events,
+	})
+}
+
+// POST /admin/webhooks/simulate/{provider}, Processes a payload as if the provider had sent it, outside production
+func SimulateWebhookHandler(rw http.ResponseWriter, req *http.Request) {
+	provider := mux.Vars(req)["provider"]
+	err := error(nil)
+	status := http.StatusBadRequest
+	if env.Current.Production {
+		err, status = errors.New("webhooks can only be simulated outside production"), http.StatusForbidden
+	} else if _, ok := webhookProcessors[provider]; !ok {
+		err, status = errors.New("unknown provider "+provider), http.StatusNotFound
+	}
+	var payload []byte
+	if err == nil {
+		payload, err = ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, 1<<20))
+	}
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	// A payload that fails to process is still simulated, the record has why.
+	w, _ := receiveWebhook(provider, payload, true)
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusCreated,
+		"webhook": w,
+	})
+}